@@ -2,19 +2,24 @@ package handler
 
 import (
 	"net/http"
-	"os"
 
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
 	"github.com/tracoco/DifyGate/config"
+	"github.com/tracoco/DifyGate/events"
 	"github.com/tracoco/DifyGate/gate"
 	"github.com/tracoco/DifyGate/gateapi"
+	"github.com/tracoco/DifyGate/history"
+	"github.com/tracoco/DifyGate/sentry"
+	"github.com/tracoco/DifyGate/store"
+	"github.com/tracoco/DifyGate/version"
 )
 
 var (
 	log         *logrus.Logger
 	router      *gin.Engine
 	mailService *gate.Service
+	kv          store.Store
 )
 
 func init() {
@@ -22,28 +27,67 @@ func init() {
 	log = logrus.New()
 	log.SetFormatter(&logrus.JSONFormatter{})
 
-	// Check for API key
-	apiKey := os.Getenv("DIFYGATE_API_KEY")
-	if apiKey == "" {
-		log.Warn("DIFYGATE_API_KEY environment variable not set - API endpoints will not be securely protected")
-	}
-
 	// Load configuration
 	cfg, err := config.Load()
 	if err != nil {
 		log.WithError(err).Fatal("Failed to load configuration")
 	}
 
+	if err := cfg.Validate(); err != nil {
+		log.WithError(err).Fatal("Invalid configuration")
+	}
+
+	// Apply configured log level and format
+	if err := config.ConfigureLogger(log, cfg.Log); err != nil {
+		log.WithError(err).Warn("Invalid logging configuration, using defaults")
+	}
+
+	build := version.Get()
+	log.WithFields(logrus.Fields{
+		"version":    build.Version,
+		"git_sha":    build.GitSHA,
+		"build_date": build.BuildDate,
+		"go_version": build.GoVersion,
+	}).Info("Starting DifyGate")
+
+	// Report panics and upstream failures, if DIFYGATE_SENTRY_DSN is set
+	if err := sentry.Init(cfg.Sentry, log); err != nil {
+		log.WithError(err).Warn("Invalid Sentry configuration, not reporting errors")
+	}
+
+	// Check for API key
+	if len(cfg.Auth.EffectiveKeys()) == 0 && !cfg.Auth.JWT.Enabled() {
+		log.Warn("No API keys or JWT validation configured - protected API endpoints will reject every request")
+	}
+
 	// Initialize email service
 	mailService = gate.NewService(cfg.DIFYGATE, log)
 
-	// Initialize Gin router in release mode for production
-	gin.SetMode(gin.ReleaseMode)
-	router = gin.New()
-	router.Use(gin.Recovery())
+	// Verify SMTP connectivity so bad credentials show up immediately
+	if err := mailService.Ping(); err != nil {
+		log.WithError(err).Error("SMTP connectivity check failed - emails will not be delivered")
+	} else {
+		log.WithField("smtp_host", cfg.DIFYGATE.Host).Info("SMTP connectivity check succeeded")
+	}
+
+	// Initialize shared store
+	if kv, err = gateapi.NewStore(cfg.Store, log); err != nil {
+		log.WithError(err).Fatal("Failed to open the store")
+	}
+
+	// Serverless instances are short-lived, so history stays in memory
+	// unless a path on persistent storage is configured
+	recorder, err := history.New(cfg.History, log)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to open message history")
+	}
+
+	// Initialize Gin router
+	router = gateapi.NewRouter(cfg.Server, log)
 
-	// Register API routes
-	gateapi.RegisterRoutes(router, mailService, log)
+	// Register API routes. Serverless instances are replaced rather than
+	// reloaded, so the configuration stays as loaded.
+	gateapi.RegisterRoutes(router, gateapi.NewReloader(cfg, nil, log), mailService, kv, events.NewDispatcher(cfg.Webhooks, log), recorder, gateapi.NewReadiness(cfg, log), log)
 }
 
 // Handler - Vercel serverless function entrypoint
@@ -0,0 +1,244 @@
+// Package apierror defines the JSON envelope of every API error response and
+// the registry of its stable codes, which clients can match on instead of
+// the wording of messages
+package apierror
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+)
+
+// RequestIDKey is the Gin context key holding the request ID echoed in
+// error responses
+const RequestIDKey = "request_id"
+
+// CodeKey is the Gin context key New records the error code under, for
+// middleware reporting failed requests
+const CodeKey = "error_code"
+
+// Error codes. A code never changes meaning once released; new failures get
+// new codes.
+const (
+	InvalidRequest       = "invalid_request"
+	InvalidBody          = "invalid_body"
+	BodyTooLarge         = "body_too_large"
+	InvalidAttachment    = "invalid_attachment"
+	AuthRequired         = "auth_required"
+	InvalidCredentials   = "invalid_credentials"
+	InvalidToken         = "invalid_token"
+	AuthNotConfigured    = "auth_not_configured"
+	InsufficientScope    = "insufficient_scope"
+	IPNotAllowed         = "ip_not_allowed"
+	InvalidSignature     = "invalid_signature"
+	VerificationFailed   = "verification_failed"
+	RateLimited          = "rate_limited"
+	IdempotencyConflict  = "idempotency_conflict"
+	NotFound             = "not_found"
+	FeatureDisabled      = "feature_disabled"
+	NotConfigured        = "not_configured"
+	NotHandedOff         = "not_handed_off"
+	ConfigInvalid        = "config_invalid"
+	EmailSendFailed      = "email_send_failed"
+	RecipientsSuppressed = "recipients_suppressed"
+	DifyError            = "dify_error"
+	DifyOverloaded       = "dify_overloaded"
+	WhatsAppUnreachable  = "whatsapp_unreachable"
+	WhatsAppError        = "whatsapp_error"
+	WhatsAppWindowClosed = "whatsapp_window_closed"
+	WhatsAppRateLimited  = "whatsapp_rate_limited"
+	Internal             = "internal_error"
+)
+
+// Codes describes every error code, for documentation
+var Codes = map[string]string{
+	InvalidRequest:       "The request failed validation; details.fields lists the fields at fault",
+	InvalidBody:          "The body could not be read or is not valid JSON or form data",
+	BodyTooLarge:         "The body is over the route's size limit; details.limit is the limit in bytes",
+	InvalidAttachment:    "An attachment is not valid base64",
+	AuthRequired:         "No Authorization header was sent",
+	InvalidCredentials:   "The Authorization header is malformed or the API key is unknown",
+	InvalidToken:         "The JWT was rejected",
+	AuthNotConfigured:    "The gateway has no API keys configured",
+	InsufficientScope:    "The API key lacks the scope the route needs; details.scope names it",
+	IPNotAllowed:         "The client IP address is outside the route's allowed ranges",
+	InvalidSignature:     "The webhook signature doesn't match the body",
+	VerificationFailed:   "The webhook subscription handshake failed",
+	RateLimited:          "Too many requests; retry after the Retry-After header",
+	IdempotencyConflict:  "A request with the same Idempotency-Key is still being processed",
+	NotFound:             "The route or resource doesn't exist",
+	FeatureDisabled:      "The feature the route serves is turned off",
+	NotConfigured:        "The integration the route serves is not configured",
+	NotHandedOff:         "The user isn't handed off to a person",
+	ConfigInvalid:        "The configuration could not be loaded or is invalid; the one in use is kept",
+	EmailSendFailed:      "The SMTP server didn't accept the email",
+	RecipientsSuppressed: "Every to recipient is on the suppression list; details.suppressed lists them",
+	DifyError:            "Dify failed to answer; details.dify_code is Dify's code, when it gave one",
+	DifyOverloaded:       "Dify is over its quota or rate limit; details.dify_code is Dify's code",
+	WhatsAppUnreachable:  "The WhatsApp API could not be reached",
+	WhatsAppError:        "The WhatsApp API refused the message; details has Meta's code",
+	WhatsAppWindowClosed: "The user hasn't written in the last 24 hours; send a template instead",
+	WhatsAppRateLimited:  "The WhatsApp API is rate limiting the business number",
+	Internal:             "The gateway failed unexpectedly; quote the request_id when reporting it",
+}
+
+// Detail is the error object of the envelope
+type Detail struct {
+	Code    string                 `json:"code"`
+	Message string                 `json:"message"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// Envelope is the body of every error response
+type Envelope struct {
+	Error     Detail `json:"error"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// New builds the envelope of an error in the request c
+func New(c *gin.Context, code, message string, details map[string]interface{}) Envelope {
+	c.Set(CodeKey, code)
+	return Envelope{
+		Error:     Detail{Code: code, Message: message, Details: details},
+		RequestID: c.GetString(RequestIDKey),
+	}
+}
+
+// Respond answers c with an error
+func Respond(c *gin.Context, status int, code, message string) {
+	c.JSON(status, New(c, code, message, nil))
+}
+
+// RespondWithDetails answers c with an error carrying details
+func RespondWithDetails(c *gin.Context, status int, code, message string, details map[string]interface{}) {
+	c.JSON(status, New(c, code, message, details))
+}
+
+// Abort answers c with an error and stops the handler chain, for middleware
+func Abort(c *gin.Context, status int, code, message string) {
+	c.AbortWithStatusJSON(status, New(c, code, message, nil))
+}
+
+// AbortWithDetails answers c with an error carrying details and stops the
+// handler chain
+func AbortWithDetails(c *gin.Context, status int, code, message string, details map[string]interface{}) {
+	c.AbortWithStatusJSON(status, New(c, code, message, details))
+}
+
+// FieldError is a field that failed binding or validation
+type FieldError struct {
+	// Field is the JSON name of the field, dotted for nested ones
+	Field string `json:"field"`
+	// Rule is the validation rule that failed, e.g. required, or type when
+	// the value has the wrong JSON type
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// RespondBinding answers c with a 400 for an error from ShouldBind, listing
+// the fields at fault instead of the validator's wording
+func RespondBinding(c *gin.Context, err error) {
+	fields := BindingFields(err)
+	if len(fields) == 0 {
+		Respond(c, http.StatusBadRequest, InvalidBody, "Invalid request body: "+err.Error())
+		return
+	}
+	messages := make([]string, len(fields))
+	for i, f := range fields {
+		messages[i] = f.Message
+	}
+	RespondWithDetails(c, http.StatusBadRequest, InvalidRequest, "Invalid request: "+strings.Join(messages, "; "),
+		map[string]interface{}{"fields": fields})
+}
+
+// BindingFields returns the fields at fault in a binding error, or nil when
+// the error isn't about fields, e.g. malformed JSON
+func BindingFields(err error) []FieldError {
+	var verrs validator.ValidationErrors
+	if errors.As(err, &verrs) {
+		fields := make([]FieldError, 0, len(verrs))
+		for _, fe := range verrs {
+			fields = append(fields, FieldError{Field: fieldPath(fe), Rule: fe.Tag(), Message: ruleMessage(fieldPath(fe), fe)})
+		}
+		return fields
+	}
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		return []FieldError{{Field: typeErr.Field, Rule: "type", Message: typeErr.Field + " must be " + jsonType(typeErr.Type)}}
+	}
+	return nil
+}
+
+// fieldPath is the dotted JSON path of a field, without the struct name
+func fieldPath(fe validator.FieldError) string {
+	ns := fe.Namespace()
+	if i := strings.Index(ns, "."); i >= 0 {
+		return ns[i+1:]
+	}
+	return fe.Field()
+}
+
+// ruleMessage says what a validation rule requires of field
+func ruleMessage(field string, fe validator.FieldError) string {
+	switch fe.Tag() {
+	case "required":
+		return field + " is required"
+	case "min":
+		if fe.Kind() == reflect.Slice || fe.Kind() == reflect.Map {
+			return field + " must have at least " + fe.Param() + " item(s)"
+		}
+		return field + " must be at least " + fe.Param()
+	case "max":
+		if fe.Kind() == reflect.Slice || fe.Kind() == reflect.Map {
+			return field + " must have at most " + fe.Param() + " item(s)"
+		}
+		return field + " must be at most " + fe.Param()
+	case "oneof":
+		return field + " must be one of " + fe.Param()
+	case "email":
+		return field + " must be an email address"
+	default:
+		return field + " failed the " + fe.Tag() + " rule"
+	}
+}
+
+// jsonType names a Go type the way a JSON client would
+func jsonType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	case reflect.Map, reflect.Struct:
+		return "an object"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	default:
+		return "a " + t.String()
+	}
+}
+
+func init() {
+	// Validation errors name fields as clients send them
+	if v, ok := binding.Validator.Engine().(*validator.Validate); ok {
+		v.RegisterTagNameFunc(func(f reflect.StructField) string {
+			for _, tag := range []string{"json", "form"} {
+				if name := strings.SplitN(f.Tag.Get(tag), ",", 2)[0]; name != "" && name != "-" {
+					return name
+				}
+			}
+			return f.Name
+		})
+	}
+}
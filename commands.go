@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/config"
+	"github.com/tracoco/DifyGate/gate"
+	"github.com/tracoco/DifyGate/version"
+)
+
+const usage = `Usage: difygate [command] [flags]
+
+Commands:
+  serve            run the server (the default)
+  check-config     validate the configuration and print it with secrets redacted
+  send-test-email  send a test email to check SMTP delivery end to end
+
+Run "difygate <command> -h" to list a command's flags.
+`
+
+// run dispatches to the command named by the first argument and returns
+// the process exit code
+func run(args []string) int {
+	command := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	switch command {
+	case "serve":
+		fs, envFile := newFlagSet("serve")
+		checkConfig := fs.Bool("check-config", false, "same as the check-config command")
+		if code, ok := parseFlags(fs, args); !ok {
+			return code
+		}
+		if *checkConfig || os.Getenv("DIFYGATE_CHECK_CONFIG") == "true" {
+			return runCheckConfig(*envFile)
+		}
+		return runServe(*envFile)
+	case "check-config":
+		fs, envFile := newFlagSet("check-config")
+		if code, ok := parseFlags(fs, args); !ok {
+			return code
+		}
+		return runCheckConfig(*envFile)
+	case "send-test-email":
+		fs, envFile := newFlagSet("send-test-email")
+		to := fs.String("to", "", "recipient `address`")
+		if code, ok := parseFlags(fs, args); !ok {
+			return code
+		}
+		if *to == "" {
+			fmt.Fprintln(os.Stderr, "send-test-email requires --to")
+			fs.Usage()
+			return 2
+		}
+		return runSendTestEmail(*envFile, *to)
+	case "help":
+		fmt.Print(usage)
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n%s", command, usage)
+		return 2
+	}
+}
+
+// newFlagSet creates the flags of a command, including --env-file
+func newFlagSet(command string) (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet(command, flag.ContinueOnError)
+	envFile := fs.String("env-file", "", "read environment variables from this `file` instead of .env")
+	return fs, envFile
+}
+
+// parseFlags parses a command's flags, returning false and the exit code
+// when the command shouldn't run
+func parseFlags(fs *flag.FlagSet, args []string) (int, bool) {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0, false
+		}
+		return 2, false
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "Unexpected argument %q\n", fs.Arg(0))
+		fs.Usage()
+		return 2, false
+	}
+	return 0, true
+}
+
+// runCheckConfig loads and validates the configuration, prints the effective
+// values with secrets redacted, and returns the process exit code
+func runCheckConfig(envFile string) int {
+	cfg, err := config.LoadEnvFile(envFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+		return 1
+	}
+
+	out, err := cfg.RedactedYAML()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to render configuration: %v\n", err)
+		return 1
+	}
+	fmt.Print(string(out))
+
+	for _, problem := range cfg.CriticalProblems() {
+		fmt.Fprintf(os.Stderr, "Warning: %s\n", problem)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration:\n%v\n", err)
+		return 1
+	}
+
+	fmt.Fprintln(os.Stderr, "Configuration OK")
+	return 0
+}
+
+// runSendTestEmail sends a canned message to the given address through the
+// configured SMTP server and returns the process exit code. Only the SMTP
+// settings are used, so the rest of the configuration needn't be complete.
+func runSendTestEmail(envFile, to string) int {
+	cfg, err := config.LoadEnvFile(envFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+		return 1
+	}
+
+	log := logrus.New()
+	log.SetOutput(os.Stderr)
+	if err := config.ConfigureLogger(log, cfg.Log); err != nil {
+		log.WithError(err).Warn("Invalid logging configuration, using defaults")
+	}
+
+	host, _ := os.Hostname()
+	err = gate.NewService(cfg.DIFYGATE, log).Send(gate.Message{
+		To:      []string{to},
+		Subject: "DifyGate test email",
+		Body: fmt.Sprintf("This is a test email from DifyGate %s on %s, sent at %s.\n\nIf you can read it, SMTP delivery works.",
+			version.Get().Version, host, time.Now().UTC().Format(time.RFC1123)),
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to send test email through %s:%d: %v\n", cfg.DIFYGATE.Host, cfg.DIFYGATE.Port, err)
+		return 1
+	}
+
+	fmt.Fprintf(os.Stderr, "Sent test email to %s through %s:%d\n", to, cfg.DIFYGATE.Host, cfg.DIFYGATE.Port)
+	return 0
+}
@@ -0,0 +1,72 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+// Canned response match types
+const (
+	// CannedMatchExact matches the whole message, ignoring surrounding
+	// whitespace
+	CannedMatchExact = "exact"
+	// CannedMatchContains matches messages containing the pattern, in any
+	// case
+	CannedMatchContains = "contains"
+	// CannedMatchRegex matches messages the regular expression matches
+	CannedMatchRegex = "regex"
+)
+
+// CannedResponseConfig answers matching chat messages with a fixed reply
+// instead of asking Dify
+type CannedResponseConfig struct {
+	// Name identifies the rule in logs, metrics and the admin API
+	Name string `yaml:"name" json:"name"`
+	// Match is exact, contains or regex
+	Match   string `yaml:"match" json:"match"`
+	Pattern string `yaml:"pattern" json:"pattern"`
+	Reply   string `yaml:"reply" json:"reply"`
+	// Enabled rules are tried; others are kept but skipped
+	Enabled bool `yaml:"enabled" json:"enabled"`
+}
+
+// Validate checks the rule's name, match type and pattern
+func (r CannedResponseConfig) Validate() error {
+	var errs []error
+	if !hookNamePattern.MatchString(r.Name) {
+		errs = append(errs, fmt.Errorf("name %q must be lowercase letters, digits, - or _", r.Name))
+	}
+	switch r.Match {
+	case CannedMatchExact, CannedMatchContains:
+		if r.Pattern == "" {
+			errs = append(errs, errors.New("pattern is empty"))
+		}
+	case CannedMatchRegex:
+		if _, err := regexp.Compile(r.Pattern); err != nil {
+			errs = append(errs, err)
+		}
+	default:
+		errs = append(errs, fmt.Errorf("match %q must be exact, contains or regex", r.Match))
+	}
+	if r.Reply == "" {
+		errs = append(errs, errors.New("reply is empty"))
+	}
+	return errors.Join(errs...)
+}
+
+// validateCannedResponses checks each rule and that names are unique
+func validateCannedResponses(rules []CannedResponseConfig) error {
+	var errs []error
+	names := make(map[string]bool)
+	for i, r := range rules {
+		if err := r.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("canned response #%d: %w", i+1, err))
+		}
+		if names[r.Name] {
+			errs = append(errs, fmt.Errorf("canned response name %q is used more than once", r.Name))
+		}
+		names[r.Name] = true
+	}
+	return errors.Join(errs...)
+}
@@ -1,34 +1,2024 @@
 package config
 
 import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
 	"os"
+	"regexp"
 	"strconv"
+	"strings"
+	"time"
 
-	"github.com/joho/godotenv"
+	"github.com/sirupsen/logrus"
 	"github.com/tracoco/DifyGate/gate"
+	"github.com/tracoco/DifyGate/phone"
 )
 
 // Config holds all application configuration
 type Config struct {
-	DIFYGATE gate.DIFYGateConfig
+	Auth           AuthConfig             `yaml:"auth"`
+	DIFYGATE       gate.DIFYGateConfig    `yaml:"smtp"`
+	Chat           ChatConfig             `yaml:"chat"`
+	Messages       MessagesConfig         `yaml:"messages"`
+	WhatsApp       WhatsAppConfig         `yaml:"whatsapp"`
+	Slack          SlackConfig            `yaml:"slack"`
+	Discord        DiscordConfig          `yaml:"discord"`
+	Messenger      MessengerConfig        `yaml:"messenger"`
+	Twilio         TwilioConfig           `yaml:"twilio"`
+	Hooks          []HookConfig           `yaml:"hooks"`
+	Webhooks       OutgoingWebhooksConfig `yaml:"outgoing_webhooks"`
+	Dify           DifyConfig             `yaml:"dify"`
+	Store          StoreConfig            `yaml:"store"`
+	History        HistoryConfig          `yaml:"history"`
+	EmailRateLimit RateLimitConfig        `yaml:"email_rate_limit"`
+	// EmailIdempotency makes retried email sends with the same
+	// Idempotency-Key send once
+	EmailIdempotency IdempotencyConfig `yaml:"email_idempotency"`
+	// EmailAlert notifies operators when email sends start failing
+	EmailAlert EmailAlertConfig `yaml:"email_alert"`
+	// SignatureAlert tells operators when webhooks keep failing signature
+	// verification, e.g. after the platform rotated a secret
+	SignatureAlert SignatureAlertConfig `yaml:"signature_alert"`
+	// Digest emails operators a summary of the gateway's activity
+	Digest DigestConfig `yaml:"digest"`
+	// Handoff lets WhatsApp users pause the bot and ask for a person
+	Handoff HandoffConfig `yaml:"handoff"`
+	// Abuse mutes chat users who flood or repeat themselves for a while
+	Abuse AbuseConfig `yaml:"abuse"`
+	// Transcript emails a WhatsApp user's conversation from the message
+	// history
+	Transcript TranscriptConfig `yaml:"transcript"`
+	// Broadcast sends one message to many WhatsApp users
+	Broadcast BroadcastConfig `yaml:"broadcast"`
+	// Schedule sends WhatsApp messages at a later time
+	Schedule ScheduleConfig `yaml:"schedule"`
+	// ChatJobs runs chat queries in the background for callers that poll
+	ChatJobs ChatJobsConfig `yaml:"chat_jobs"`
+	// AnswerCache reuses Dify's answers to repeated stateless questions
+	AnswerCache AnswerCacheConfig `yaml:"answer_cache"`
+	// Cost prices Dify's answers and caps what each chat user may spend
+	// a day
+	Cost         CostConfig         `yaml:"cost"`
+	APIRateLimit APIRateLimitConfig `yaml:"api_rate_limit"`
+	Server       ServerConfig       `yaml:"server"`
+	TLS          TLSConfig          `yaml:"tls"`
+	Log          LogConfig          `yaml:"log"`
+	// Sentry reports panics, 5xx responses and failures needing an
+	// operator to Sentry
+	Sentry     SentryConfig     `yaml:"sentry"`
+	Debug      DebugConfig      `yaml:"debug"`
+	HTTPClient HTTPClientConfig `yaml:"http_client"`
+	Mock       MockConfig       `yaml:"mock"`
+	// Features turns parts of the gateway on and off
+	Features FeaturesConfig `yaml:"features"`
 }
 
-// Load loads configuration from environment variables
+// AuthConfig holds API authentication settings
+type AuthConfig struct {
+	// APIKey is a single bearer token with every scope, kept for
+	// deployments that predate named keys
+	APIKey string `yaml:"api_key" secret:"true"`
+	// APIKeySHA256 is the hex SHA-256 of that key, so the plaintext never
+	// has to live in config. It takes precedence over APIKey.
+	APIKeySHA256 string `yaml:"api_key_sha256"`
+	// PreviousAPIKeys (and their hashes) are still accepted with the same
+	// scopes as APIKey while clients move to a rotated key
+	PreviousAPIKeys       []string `yaml:"previous_api_keys" secret:"true"`
+	PreviousAPIKeySHA256s []string `yaml:"previous_api_key_sha256s"`
+	// Keys are named bearer tokens, each limited to its scopes
+	Keys []APIKeyConfig `yaml:"keys"`
+	// JWT accepts bearer JWTs from an identity provider alongside the keys
+	JWT JWTConfig `yaml:"jwt"`
+	// EmailAllowedCIDRs and AdminAllowedCIDRs restrict those route groups
+	// to the listed IPs/CIDRs; empty means no restriction
+	EmailAllowedCIDRs []string `yaml:"email_allowed_cidrs"`
+	AdminAllowedCIDRs []string `yaml:"admin_allowed_cidrs"`
+}
+
+// JWTConfig holds JWT validation settings. Exactly one of JWKSURL,
+// HMACSecret or RSAPublicKeyFile enables JWT authentication.
+type JWTConfig struct {
+	JWKSURL          string `yaml:"jwks_url"`
+	HMACSecret       string `yaml:"hmac_secret" secret:"true"`
+	RSAPublicKeyFile string `yaml:"rsa_public_key_file"` // PEM
+	// Issuer and Audience are checked against iss and aud when set
+	Issuer   string `yaml:"issuer"`
+	Audience string `yaml:"audience"`
+	// IdentityClaim names the caller for logging and rate limiting
+	IdentityClaim string `yaml:"identity_claim"`
+	// ScopesClaim holds the granted scopes, space-separated or as an array
+	ScopesClaim string `yaml:"scopes_claim"`
+	// Leeway tolerates clock skew when checking exp and nbf
+	Leeway time.Duration `yaml:"leeway"`
+}
+
+// Enabled reports whether JWT authentication is configured
+func (j JWTConfig) Enabled() bool {
+	return j.JWKSURL != "" || j.HMACSecret != "" || j.RSAPublicKeyFile != ""
+}
+
+// APIKeyConfig is one named API key and the scopes it grants
+type APIKeyConfig struct {
+	Key string `json:"key" yaml:"key" secret:"true"`
+	// KeySHA256 is the hex SHA-256 of the key and takes precedence over Key
+	KeySHA256 string   `json:"key_sha256" yaml:"key_sha256"`
+	Name      string   `json:"name" yaml:"name"`
+	Scopes    []string `json:"scopes" yaml:"scopes"`
+	// Deprecated keys still work but log a warning whenever they're used
+	Deprecated bool `json:"deprecated" yaml:"deprecated"`
+}
+
+// Digest returns the SHA-256 digest presented keys are compared against
+func (k APIKeyConfig) Digest() ([sha256.Size]byte, error) {
+	var digest [sha256.Size]byte
+	if k.KeySHA256 == "" {
+		if k.Key == "" {
+			return digest, errors.New("neither key nor key_sha256 is set")
+		}
+		return sha256.Sum256([]byte(k.Key)), nil
+	}
+
+	b, err := hex.DecodeString(k.KeySHA256)
+	if err != nil || len(b) != sha256.Size {
+		return digest, errors.New("key_sha256 must be 64 hex characters")
+	}
+	copy(digest[:], b)
+	return digest, nil
+}
+
+// ScopeAll grants every scope
+const ScopeAll = "*"
+
+// EffectiveKeys returns the configured keys, including DIFYGATE_API_KEY as
+// a key named "default" with every scope and each previous key as a
+// deprecated "default-previous-N"
+func (a AuthConfig) EffectiveKeys() []APIKeyConfig {
+	var keys []APIKeyConfig
+	if a.APIKey != "" || a.APIKeySHA256 != "" {
+		keys = append(keys, APIKeyConfig{Key: a.APIKey, KeySHA256: a.APIKeySHA256, Name: "default", Scopes: []string{ScopeAll}})
+	}
+
+	n := 0
+	previous := func(key, hash string) {
+		n++
+		keys = append(keys, APIKeyConfig{
+			Key:        key,
+			KeySHA256:  hash,
+			Name:       fmt.Sprintf("default-previous-%d", n),
+			Scopes:     []string{ScopeAll},
+			Deprecated: true,
+		})
+	}
+	for _, k := range a.PreviousAPIKeys {
+		previous(k, "")
+	}
+	for _, h := range a.PreviousAPIKeySHA256s {
+		previous("", h)
+	}
+
+	return append(keys, a.Keys...)
+}
+
+// LogConfig holds logging settings
+type LogConfig struct {
+	Level  string `yaml:"level"`  // debug, info, warn or error
+	Format string `yaml:"format"` // json or text
+	// AccessSkipPaths are left out of the access log while they succeed,
+	// so probes don't drown real traffic
+	AccessSkipPaths []string `yaml:"access_skip_paths"`
+	// AccessSamplePaths are high-volume paths whose successful requests
+	// are logged at AccessSampleRate
+	AccessSamplePaths []string `yaml:"access_sample_paths"`
+	// AccessSampleRate is the fraction of successful requests to
+	// AccessSamplePaths that are logged, from 0 to 1
+	AccessSampleRate float64 `yaml:"access_sample_rate"`
+}
+
+// SentryConfig reports errors to Sentry, or any service accepting its
+// protocol; an empty DSN reports nothing
+type SentryConfig struct {
+	DSN string `yaml:"dsn" secret:"true"`
+	// Environment tags every event, e.g. production
+	Environment string `yaml:"environment"`
+	// SignatureBurst webhook signature failures on a channel within
+	// SignatureWindow are reported, once per window
+	SignatureBurst  int           `yaml:"signature_burst"`
+	SignatureWindow time.Duration `yaml:"signature_window"`
+}
+
+// MockConfig swaps Dify and the Graph API for built-in fakes, for local
+// development and integration tests
+type MockConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Answer is the mock Dify's answer to every query; {query} is
+	// replaced with the query
+	Answer string `yaml:"answer"`
+	// Delay is how long the mock Dify thinks before answering
+	Delay time.Duration `yaml:"delay"`
+	// ChunkDelay is the pause between the words of a streamed answer
+	ChunkDelay time.Duration `yaml:"chunk_delay"`
+}
+
+// DebugConfig holds the profiling endpoints, which are off by default
+type DebugConfig struct {
+	// EnablePprof mounts pprof and runtime snapshot endpoints
+	EnablePprof bool `yaml:"enable_pprof"`
+	// Port serves them on a separate unauthenticated listener; 0 mounts
+	// them on the main listener behind the admin scope instead
+	Port int `yaml:"port"`
+	// BindAddr is the separate listener's interface, loopback by default
+	BindAddr string `yaml:"bind_addr"`
+}
+
+// ServerConfig holds HTTP server settings
+type ServerConfig struct {
+	Port     int    `yaml:"port"`
+	BindAddr string `yaml:"bind_addr"` // empty listens on all interfaces
+	// ExternalURL is the public base URL (e.g. https://gate.example.com),
+	// used where the gateway describes itself; empty derives it per request
+	ExternalURL string `yaml:"external_url"`
+	// ReadHeaderTimeout bounds how long a client may take to send headers,
+	// which is what stops slow-loris clients holding connections open
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	ReadTimeout       time.Duration `yaml:"read_timeout"`
+	// WriteTimeout bounds writing a response. Handlers that stream (SSE)
+	// must clear their own deadline with http.ResponseController.
+	WriteTimeout time.Duration `yaml:"write_timeout"`
+	IdleTimeout  time.Duration `yaml:"idle_timeout"`
+	// ShutdownDrain is how long readiness reports not-ready before the
+	// server stops accepting connections, giving load balancers time to react
+	ShutdownDrain time.Duration `yaml:"shutdown_drain"`
+	// ShutdownTimeout bounds how long in-flight requests may take to finish
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	// TrustedProxies lists the IPs/CIDRs whose forwarding headers are
+	// believed when resolving the client IP; empty trusts none
+	TrustedProxies []string `yaml:"trusted_proxies"`
+	// RealIPHeader replaces X-Forwarded-For/X-Real-IP as the header carrying
+	// the client IP (e.g. CF-Connecting-IP). Only honored from trusted proxies.
+	RealIPHeader string `yaml:"real_ip_header"`
+	// MaxBodyBytes caps request bodies on the API; the webhook and email
+	// endpoints have their own limits
+	MaxBodyBytes        int `yaml:"max_body_bytes"`
+	WebhookMaxBodyBytes int `yaml:"webhook_max_body_bytes"`
+	EmailMaxBodyBytes   int `yaml:"email_max_body_bytes"`
+	MediaMaxBodyBytes   int `yaml:"media_max_body_bytes"`
+	// GinMode is debug, release or test; debug prints Gin's route table
+	GinMode string `yaml:"gin_mode"`
+}
+
+// TLSConfig holds HTTPS settings. With nothing set the server speaks plain
+// HTTP, e.g. behind a TLS-terminating proxy.
+type TLSConfig struct {
+	// CertFile and KeyFile serve a static certificate
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// AutocertDomains obtains certificates from Let's Encrypt for these
+	// domains, serving HTTPS on 443 and challenges/redirects on 80
+	AutocertDomains  []string `yaml:"autocert_domains"`
+	AutocertCacheDir string   `yaml:"autocert_cache_dir"`
+	AutocertEmail    string   `yaml:"autocert_email"`
+}
+
+// SlackConfig holds Slack Events API settings; the channel is off until
+// SigningSecret and BotToken are set
+type SlackConfig struct {
+	// SigningSecret verifies the X-Slack-Signature of incoming events
+	SigningSecret string `yaml:"signing_secret" secret:"true"`
+	// BotToken (xoxb-...) authenticates chat.postMessage
+	BotToken string `yaml:"bot_token" secret:"true"`
+	// APIBaseURL is the Web API host, overridable for testing
+	APIBaseURL string `yaml:"api_base_url"`
+	// ConversationTTL is how long a thread keeps its Dify conversation
+	ConversationTTL time.Duration `yaml:"conversation_ttl"`
+}
+
+// Enabled reports whether the Slack channel is configured
+func (s SlackConfig) Enabled() bool {
+	return s.SigningSecret != "" && s.BotToken != ""
+}
+
+// DiscordConfig holds Discord interactions settings; the channel is off
+// until PublicKey is set
+type DiscordConfig struct {
+	// PublicKey is the application's hex Ed25519 key that signs interactions
+	PublicKey string `yaml:"public_key"`
+	// APIBaseURL is the REST API host, overridable for testing
+	APIBaseURL string `yaml:"api_base_url"`
+	// ConversationTTL is how long a user keeps their Dify conversation in a channel
+	ConversationTTL time.Duration `yaml:"conversation_ttl"`
+}
+
+// Enabled reports whether the Discord channel is configured
+func (d DiscordConfig) Enabled() bool {
+	return d.PublicKey != ""
+}
+
+// MessengerConfig holds Facebook Messenger settings. Webhooks are verified
+// with the WhatsApp app secret and verify token, as both products are
+// normally added to the same Meta app.
+type MessengerConfig struct {
+	// PageAccessToken authenticates the Send API for the page
+	PageAccessToken string `yaml:"page_access_token" secret:"true"`
+	// ConversationTTL is how long a sender keeps their Dify conversation
+	ConversationTTL time.Duration `yaml:"conversation_ttl"`
+}
+
+// TwilioConfig holds Twilio SMS settings; the channel is off until
+// AccountSID and AuthToken are set
+type TwilioConfig struct {
+	AccountSID string `yaml:"account_sid"`
+	// AuthToken verifies X-Twilio-Signature and authenticates the REST API
+	AuthToken string `yaml:"auth_token" secret:"true"`
+	// APIBaseURL is the REST API host, overridable for testing
+	APIBaseURL string `yaml:"api_base_url"`
+	// SyncReplyTimeout is how long to wait for Dify before answering the
+	// webhook with empty TwiML and sending the reply through the REST API;
+	// it must stay under Twilio's 15 second webhook timeout
+	SyncReplyTimeout time.Duration `yaml:"sync_reply_timeout"`
+	// MaxSegments caps the SMS segments per reply; longer answers are truncated
+	MaxSegments int `yaml:"max_segments"`
+	// ConversationTTL is how long a number keeps its Dify conversation
+	ConversationTTL time.Duration `yaml:"conversation_ttl"`
+}
+
+// Enabled reports whether the Twilio channel is configured
+func (t TwilioConfig) Enabled() bool {
+	return t.AccountSID != "" && t.AuthToken != ""
+}
+
+// Reply modes for chat channels
+const (
+	ReplyModeFinal       = "final"
+	ReplyModeIncremental = "incremental"
+)
+
+// Ways to send the segments of a chatflow answer, one per Answer node or
+// ChatConfig.SegmentDelimiter
+const (
+	SegmentsConcatenate = "concatenate"
+	SegmentsSplit       = "split"
+)
+
+// Ways a Dify stream handles a full buffer
+const (
+	BackpressureBlock = "block"
+	BackpressureDrop  = "drop"
+)
+
+// Ways to name chat users to Dify. Without one, each channel keeps its
+// own: WhatsApp users by their bare number, the rest prefixed.
+const (
+	UserIDRaw      = "raw"
+	UserIDHashed   = "hashed"
+	UserIDPrefixed = "prefixed"
+)
+
+// Ways to handle a query over ChatConfig.MaxQueryLength
+const (
+	QueryLengthTruncate = "truncate"
+	QueryLengthReject   = "reject"
+)
+
+// What ChatConfig.Debounce does with a message that comes in while the
+// user's previous one is being answered
+const (
+	// DebounceQueue answers it after the previous one, joined only by the
+	// messages within the window of it
+	DebounceQueue = "queue"
+	// DebounceAppend joins it with every message that comes in until the
+	// previous answer is done
+	DebounceAppend = "append"
+)
+
+// ChatConfig holds behavior shared by the chat channels; reply pacing only
+// applies to those that go through the message pipeline (WhatsApp, Messenger)
+type ChatConfig struct {
+	// ReplyMode is final (one reply when Dify finishes) or incremental
+	// (sentences are sent as they are generated)
+	ReplyMode string `yaml:"reply_mode"`
+	// ReplyMinInterval and ReplyMinChunk must both be reached before an
+	// incremental reply is sent
+	ReplyMinInterval time.Duration `yaml:"reply_min_interval"`
+	ReplyMinChunk    int           `yaml:"reply_min_chunk"`
+	// ReplyMaxMessages caps incremental replies per answer; whatever is
+	// left goes out with the final reply
+	ReplyMaxMessages int `yaml:"reply_max_messages"`
+	// Segments is concatenate (a chatflow's Answer nodes make one answer)
+	// or split (each is sent as a message of its own, within
+	// ReplyMaxMessages)
+	Segments string `yaml:"segments"`
+	// SegmentDelimiter also ends a segment where the answer contains it,
+	// for prompts that split their own answer; empty disables it
+	SegmentDelimiter string `yaml:"segment_delimiter"`
+	// AckDelay sends the ack message when Dify has not started answering
+	// this long after being asked; 0 sends none
+	AckDelay time.Duration `yaml:"ack_delay"`
+	// MaxQueryLength caps the characters (runes) of a message sent to Dify;
+	// 0 disables the limit
+	MaxQueryLength int `yaml:"max_query_length"`
+	// QueryLengthMode is truncate (send the start with a notice) or reject
+	// (ask the user to shorten the message)
+	QueryLengthMode string `yaml:"query_length_mode"`
+	// LanguageHints passes the user's language to Dify as the input
+	// detected_language and lets users pick it with /lang
+	LanguageHints bool `yaml:"language_hints"`
+	// MaxQueuedMessages caps the messages from one user waiting while their
+	// previous one is answered; more are turned away
+	MaxQueuedMessages int `yaml:"max_queued_messages"`
+	// Debounce joins a user's messages that come in within this long of
+	// each other, before Dify is asked, into one query; 0 asks Dify about
+	// each one
+	Debounce time.Duration `yaml:"debounce"`
+	// DebounceInFlight is queue or append: what Debounce does with the
+	// messages that come in while the user's previous one is answered
+	DebounceInFlight string `yaml:"debounce_in_flight"`
+	// DurableInbox saves WhatsApp and Messenger messages to the store
+	// before acknowledging them, so they are answered after a crash, and
+	// drops redeliveries
+	DurableInbox bool `yaml:"durable_inbox"`
+	// SendRetryWindow is how long a reply that failed to send is retried
+	// from the store before it is given up; 0 drops it at once
+	SendRetryWindow time.Duration `yaml:"send_retry_window"`
+	// Hooks configures the built-in message hooks of the pipeline
+	Hooks MessageHooksConfig `yaml:"hooks"`
+	// Sanitize picks what is removed from answers before users see them
+	Sanitize SanitizeConfig `yaml:"sanitize"`
+	// CannedResponses answer common questions without Dify; the first
+	// enabled match wins. Edits made through the admin API replace them.
+	CannedResponses []CannedResponseConfig `yaml:"canned_responses"`
+}
+
+// SanitizeConfig picks the model and RAG artifacts removed from answers
+type SanitizeConfig struct {
+	// ThinkTags removes <think>…</think> reasoning blocks
+	ThinkTags bool `yaml:"think_tags"`
+	// Citations removes citation markers such as [1] or [2, 3]
+	Citations bool `yaml:"citations"`
+	// Sources removes a trailing "Sources:" or "References" section
+	Sources bool `yaml:"sources"`
+}
+
+// MessageHooksConfig configures the built-in hooks that rewrite WhatsApp
+// and Messenger messages before Dify sees them and answers before users do
+type MessageHooksConfig struct {
+	// StripPatterns are regular expressions removed from inbound messages,
+	// e.g. signatures or links
+	StripPatterns []string `yaml:"strip_patterns"`
+	// ReplyPrefix and ReplySuffix are added to the start and end of answers,
+	// e.g. a disclaimer
+	ReplyPrefix string `yaml:"reply_prefix"`
+	ReplySuffix string `yaml:"reply_suffix"`
+	// ProfanityWords are masked with asterisks in messages and answers
+	ProfanityWords []string `yaml:"profanity_words"`
+}
+
+// WhatsAppConfig holds WhatsApp Cloud API settings
+type WhatsAppConfig struct {
+	// AppSecret verifies the X-Hub-Signature-256 of incoming webhooks
+	AppSecret string `yaml:"app_secret" secret:"true"`
+	// SkipSignatureVerify accepts webhooks without checking their
+	// signature, for local tunnels during development only
+	SkipSignatureVerify bool `yaml:"skip_signature_verify"`
+	// VerifyToken is echoed back by Meta during webhook verification
+	VerifyToken string `yaml:"verify_token" secret:"true"`
+	// GraphAPIToken authenticates calls to the Graph API
+	GraphAPIToken string `yaml:"graph_api_token" secret:"true"`
+	// GraphAPIBaseURL is the Graph API host, overridable for testing
+	GraphAPIBaseURL string `yaml:"graph_api_base_url"`
+	// APIVersion is the Graph API version, e.g. v22.0
+	APIVersion string `yaml:"api_version"`
+	// PhoneNumberID is the business phone number used for token checks
+	PhoneNumberID string `yaml:"phone_number_id"`
+	// PhoneNumberIDs are the business numbers this instance answers for;
+	// empty answers every number subscribed to the app
+	PhoneNumberIDs []string `yaml:"phone_number_ids"`
+	// ConversationTTL is how long a sender keeps their Dify conversation
+	ConversationTTL time.Duration `yaml:"conversation_ttl"`
+	// UnsupportedReplyInterval is how long after telling a sender a message
+	// type isn't supported before telling them again; 0 never replies
+	UnsupportedReplyInterval time.Duration `yaml:"unsupported_reply_interval"`
+	// LinkPreviews lets WhatsApp render preview cards for URLs in text
+	// messages
+	LinkPreviews bool `yaml:"link_previews"`
+	// MarkRead marks received messages as read, showing the sender blue
+	// ticks
+	MarkRead bool `yaml:"mark_read"`
+	// MarkReadNumbers overrides MarkRead for a business phone number ID
+	MarkReadNumbers map[string]bool `yaml:"mark_read_numbers"`
+	// ReadReceiptTimeout bounds each attempt to mark a message as read
+	ReadReceiptTimeout time.Duration `yaml:"read_receipt_timeout"`
+	// VoiceReplies sends the speech Dify streams for an answer, with text
+	// to speech auto-play on in the app, as audio after the text
+	VoiceReplies bool `yaml:"voice_replies"`
+	// Inputs maps a business phone number ID to Dify inputs for its
+	// messages, overriding the Dify default inputs
+	Inputs map[string]map[string]interface{} `yaml:"inputs"`
+	// StatusRetention is how long the delivery status of a sent message is
+	// kept for lookup; 0 doesn't track delivery
+	StatusRetention time.Duration `yaml:"status_retention"`
+	// ReactionProcessing is the emoji put on a user's message when it is
+	// taken up, e.g. ⏳; empty doesn't react
+	ReactionProcessing string `yaml:"reaction_processing"`
+	// ReactionDone replaces it once the message has been answered, e.g. ✅;
+	// empty leaves it
+	ReactionDone string `yaml:"reaction_done"`
+}
+
+// ServesPhoneNumber reports whether webhooks for the business number
+// phoneNumberID should be handled
+func (w WhatsAppConfig) ServesPhoneNumber(phoneNumberID string) bool {
+	if len(w.PhoneNumberIDs) == 0 {
+		return true
+	}
+	for _, id := range w.PhoneNumberIDs {
+		if id == phoneNumberID {
+			return true
+		}
+	}
+	return false
+}
+
+// MarksRead reports whether messages to the business number phoneNumberID
+// are marked as read
+func (w WhatsAppConfig) MarksRead(phoneNumberID string) bool {
+	if markRead, ok := w.MarkReadNumbers[phoneNumberID]; ok {
+		return markRead
+	}
+	return w.MarkRead
+}
+
+// DifyConfig holds Dify API settings
+type DifyConfig struct {
+	BaseURL  string `yaml:"base_url"`
+	APIKey   string `yaml:"api_key" secret:"true"`
+	ClientID string `yaml:"client_id"`
+	// RequestTimeout bounds blocking chat-message calls
+	RequestTimeout time.Duration `yaml:"request_timeout"`
+	// StreamTimeout bounds processing of a streamed answer for one message
+	StreamTimeout time.Duration `yaml:"stream_timeout"`
+	// StreamMaxAge is how old a stream may get before it is taken as
+	// orphaned, logged and cancelled; zero means twice StreamTimeout
+	StreamMaxAge time.Duration `yaml:"stream_max_age"`
+	// StreamBufferSize is how many events a stream buffers for a consumer
+	// that falls behind
+	StreamBufferSize int `yaml:"stream_buffer_size"`
+	// StreamBackpressure is what a stream does with a full buffer: block
+	// until the consumer catches up or the request ends, or drop answer
+	// chunks (never message_end or errors)
+	StreamBackpressure string `yaml:"stream_backpressure"`
+	// BreakerCooldown is how long Dify calls are held back after a quota or
+	// rate limit error, unless Dify sends Retry-After
+	BreakerCooldown time.Duration `yaml:"breaker_cooldown"`
+	// DefaultInputs are merged into the inputs of every chat-message
+	// request, under per-number and per-request inputs
+	DefaultInputs map[string]interface{} `yaml:"default_inputs"`
+	// UserIDMode is how chat users are named to Dify: raw as the channel
+	// knows them, prefixed with the channel, or hashed with UserIDSalt so
+	// Dify never sees phone numbers; empty keeps each channel's own way
+	UserIDMode string `yaml:"user_id_mode"`
+	// UserIDSalt keys the HMAC of hashed user IDs
+	UserIDSalt string `yaml:"user_id_salt" secret:"true"`
+}
+
+// ProxyDirect as an outbound proxy connects without one, even when
+// HTTPS_PROXY names one
+const ProxyDirect = "direct"
+
+// HTTPClientConfig tunes the long-lived clients used for Dify, the Graph
+// API and outgoing webhooks. Proxies come from HTTPS_PROXY, HTTP_PROXY and
+// NO_PROXY unless an outbound proxy is set.
+type HTTPClientConfig struct {
+	MaxIdleConnsPerHost int           `yaml:"max_idle_conns_per_host"`
+	DialTimeout         time.Duration `yaml:"dial_timeout"`
+	TLSHandshakeTimeout time.Duration `yaml:"tls_handshake_timeout"`
+	IdleConnTimeout     time.Duration `yaml:"idle_conn_timeout"`
+	// ResponseHeaderTimeout bounds the wait for a streaming answer to start;
+	// blocking calls are bounded by DIFYGATE_DIFY_REQUEST_TIMEOUT instead
+	ResponseHeaderTimeout time.Duration `yaml:"response_header_timeout"`
+	// HTTP2 negotiates HTTP/2 with servers that offer it
+	HTTP2 bool `yaml:"http2"`
+	// OutboundProxy is the proxy URL for every destination, in place of
+	// the environment's, or ProxyDirect; it may hold credentials
+	OutboundProxy string `yaml:"outbound_proxy" secret:"true"`
+	// OutboundProxyDify, OutboundProxyMeta and OutboundProxyWebhooks
+	// override OutboundProxy for calls to Dify, to the Graph API (media
+	// downloads included) and for outgoing webhooks
+	OutboundProxyDify     string `yaml:"outbound_proxy_dify" secret:"true"`
+	OutboundProxyMeta     string `yaml:"outbound_proxy_meta" secret:"true"`
+	OutboundProxyWebhooks string `yaml:"outbound_proxy_webhooks" secret:"true"`
+}
+
+// ProxyFor is the outbound proxy of a destination's calls, or empty for
+// the environment's
+func (c HTTPClientConfig) ProxyFor(destination string) string {
+	override := map[string]string{
+		"dify":     c.OutboundProxyDify,
+		"meta":     c.OutboundProxyMeta,
+		"webhooks": c.OutboundProxyWebhooks,
+	}[destination]
+	if override != "" {
+		return override
+	}
+	return c.OutboundProxy
+}
+
+// StoreConfig holds settings for the shared key-value store
+type StoreConfig struct {
+	// URL selects the backend, e.g. redis://:password@host:6379/0.
+	// Empty means in-memory.
+	URL string `yaml:"url" secret:"true"`
+	// EncryptionKeys are base64 AES-256 keys sealing the values of keys
+	// holding customer data, such as conversation mappings and queued
+	// replies. The first encrypts and every one decrypts, so a key is
+	// rotated by putting the new one first.
+	EncryptionKeys []string `yaml:"encryption_keys" secret:"true"`
+}
+
+// HistoryConfig holds the gateway's own record of chat messages, kept for
+// support lookups; it is off unless Enabled
+type HistoryConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Path is the file records are kept in; empty keeps them in memory only
+	Path string `yaml:"path"`
+	// Retention is how long a record is kept
+	Retention time.Duration `yaml:"retention"`
+	// PruneInterval is how often records past Retention are removed
+	PruneInterval time.Duration `yaml:"prune_interval"`
+	// EncryptionKeys are base64 AES-256 keys; when set, message bodies are
+	// encrypted in the file with the first and opened with any, like the
+	// store's. Without them the store's keys are used.
+	EncryptionKeys []string `yaml:"encryption_keys" secret:"true"`
+}
+
+// RateLimitConfig holds fixed-window request limits; zero disables a window
+type RateLimitConfig struct {
+	PerMinute int `yaml:"per_minute"`
+	PerHour   int `yaml:"per_hour"`
+}
+
+// Ways to answer a request whose Idempotency-Key is still being processed
+const (
+	IdempotencyConflict = "conflict"
+	IdempotencyWait     = "wait"
+)
+
+// IdempotencyConfig replays the response to a request for later requests
+// with the same Idempotency-Key
+type IdempotencyConfig struct {
+	// TTL is how long a response is kept for replay; 0 ignores the key
+	TTL time.Duration `yaml:"ttl"`
+	// InFlight is conflict (answer 409) or wait (for the first request's
+	// response) when the first request with the key hasn't finished
+	InFlight string `yaml:"in_flight"`
+}
+
+// EmailAlertConfig raises an alert when the share of failed email sends
+// over a sliding window reaches FailureRate
+type EmailAlertConfig struct {
+	// FailureRate is the share of failed sends, from 0 to 1, that raises
+	// the alert; 0 disables it
+	FailureRate float64 `yaml:"failure_rate"`
+	// Window is how far back sends are counted
+	Window time.Duration `yaml:"window"`
+	// MinSends is how many sends the window needs before the rate counts,
+	// so one failure on a quiet day doesn't page anyone
+	MinSends int `yaml:"min_sends"`
+	// Cooldown is the least time between two alerts
+	Cooldown time.Duration `yaml:"cooldown"`
+	// WhatsAppTo is an operator number the alert is also sent to over
+	// WhatsApp, from the default business number
+	WhatsAppTo string `yaml:"whatsapp_to"`
+}
+
+// SignatureAlertConfig raises an alert when a channel's webhooks fail
+// signature verification Threshold times in a row within Window
+type SignatureAlertConfig struct {
+	// Threshold is how many failures in a row raise the alert; 0 disables
+	// it
+	Threshold int `yaml:"threshold"`
+	// Window is how close together the failures must come
+	Window time.Duration `yaml:"window"`
+	// Cooldown is the least time between two notifications for a channel
+	Cooldown time.Duration `yaml:"cooldown"`
+	// NotifyEmail are operator addresses the alert is emailed to
+	NotifyEmail []string `yaml:"notify_email"`
+}
+
+// DigestConfig emails operators the previous day's activity on a schedule
+type DigestConfig struct {
+	// Recipients are the operator addresses of the digest; empty disables
+	// it
+	Recipients []string `yaml:"recipients"`
+	// Schedule is when the digest is sent, as a cron expression in
+	// Timezone, e.g. "0 7 * * *" for 07:00 every day
+	Schedule string `yaml:"schedule"`
+	// Timezone is the IANA time zone of Schedule and of the days reported
+	Timezone string `yaml:"timezone"`
+}
+
+// HandoffConfig hands a WhatsApp chat to a person: the bot stops
+// answering the user and operators are told, until it is resumed
+type HandoffConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Triggers are phrases that ask for a person when a message contains
+	// one, ignoring case; /human always does
+	Triggers []string `yaml:"triggers"`
+	// NotifyEmail are operator addresses told of each handoff
+	NotifyEmail []string `yaml:"notify_email"`
+	// NotifyWhatsAppTo is an operator number told of each handoff, from
+	// the business number the user wrote to
+	NotifyWhatsAppTo string `yaml:"notify_whatsapp_to"`
+	// TranscriptLength is how many recent messages the notice quotes from
+	// the message history
+	TranscriptLength int `yaml:"transcript_length"`
+	// AgentReplyPrefix starts an operator's reply when they give their
+	// name, which replaces {agent}; empty sends the text as it is
+	AgentReplyPrefix string `yaml:"agent_reply_prefix"`
+	// AgentReplyRequiresHandoff refuses operator replies to users who
+	// aren't handed off, rather than only warning
+	AgentReplyRequiresHandoff bool `yaml:"agent_reply_requires_handoff"`
+}
+
+// AbuseConfig mutes chat users who send too much: their messages are
+// dropped without asking Dify until the mute expires
+type AbuseConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// MaxMessages a user may send per Window; later ones in the window are
+	// dropped and the window counts as a strike
+	MaxMessages int           `yaml:"max_messages"`
+	Window      time.Duration `yaml:"window"`
+	// Strikes within StrikeWindow mute the user
+	Strikes      int           `yaml:"strikes"`
+	StrikeWindow time.Duration `yaml:"strike_window"`
+	// MaxIdentical identical messages in a row, each within StrikeWindow
+	// of the last, mute the user; 0 allows any
+	MaxIdentical int `yaml:"max_identical"`
+	// MuteDuration is the first mute, doubled for every mute within
+	// OffenseMemory of the last, up to MaxMuteDuration
+	MuteDuration    time.Duration `yaml:"mute_duration"`
+	MaxMuteDuration time.Duration `yaml:"max_mute_duration"`
+	OffenseMemory   time.Duration `yaml:"offense_memory"`
+}
+
+// TranscriptConfig shapes the emailed transcripts of WhatsApp
+// conversations
+type TranscriptConfig struct {
+	// MaxMessages are the most recent messages a transcript quotes
+	MaxMessages int `yaml:"max_messages"`
+	// MaxMessageLength truncates longer messages, in characters
+	MaxMessageLength int `yaml:"max_message_length"`
+	// UserCommand lets users email themselves their conversation with
+	// /transcript <address>, at most once per UserCooldown
+	UserCommand  bool          `yaml:"user_command"`
+	UserCooldown time.Duration `yaml:"user_cooldown"`
+}
+
+// BroadcastConfig paces WhatsApp broadcasts and decides who never gets them
+type BroadcastConfig struct {
+	// Rate is the messages per second of a broadcast that doesn't set its
+	// own, and MaxRate the most one may set
+	Rate    float64 `yaml:"rate"`
+	MaxRate float64 `yaml:"max_rate"`
+	// MaxRecipients bounds the recipients of one broadcast
+	MaxRecipients int `yaml:"max_recipients"`
+	// Retention is how long a broadcast's progress is kept after its last
+	// update
+	Retention time.Duration `yaml:"retention"`
+	// Blocklist are numbers never broadcast to
+	Blocklist []string `yaml:"blocklist"`
+	// OptOutKeywords and OptInKeywords are whole messages, in any case,
+	// with which a WhatsApp user stops and resumes broadcasts to them;
+	// empty lists turn the keywords off
+	OptOutKeywords []string `yaml:"opt_out_keywords"`
+	OptInKeywords  []string `yaml:"opt_in_keywords"`
+}
+
+// ScheduleConfig paces the scheduler of WhatsApp messages sent later
+type ScheduleConfig struct {
+	// Interval is how often the store is scanned for messages due
+	Interval time.Duration `yaml:"interval"`
+	// MaxAhead is how far ahead a message may be scheduled
+	MaxAhead time.Duration `yaml:"max_ahead"`
+	// MaxAttempts is how often a message is tried while WhatsApp throttles
+	// or fails, waiting longer each time
+	MaxAttempts int `yaml:"max_attempts"`
+	// Retention is how long a message is kept after it was sent, failed
+	// or was cancelled
+	Retention time.Duration `yaml:"retention"`
+}
+
+// ChatJobsConfig bounds the background chat jobs of POST /chat/jobs
+type ChatJobsConfig struct {
+	// TTL is how long a job and its result are kept after its last update
+	TTL time.Duration `yaml:"ttl"`
+	// MaxConcurrent is how many jobs of one API key run at once; later
+	// ones wait their turn
+	MaxConcurrent int `yaml:"max_concurrent"`
+	// MaxQueued is how many jobs of one API key may wait or run at once
+	// before new ones are refused
+	MaxQueued int `yaml:"max_queued"`
+}
+
+// AnswerCacheConfig caches Dify's answers to questions asked outside a
+// conversation, keyed on the normalized question, the inputs and the app
+type AnswerCacheConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// TTL is how long an answer is reused
+	TTL time.Duration `yaml:"ttl"`
+	// MaxEntries caps the answers cached at once; new answers aren't
+	// cached while it is reached
+	MaxEntries int `yaml:"max_entries"`
+}
+
+// CostConfig prices the answers Dify gives chat users, by the tokens
+// used, and can cap what each user spends a day
+type CostConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Currency names the unit of the prices; Dify's own price of an answer
+	// is used only when it is in this currency
+	Currency string `yaml:"currency"`
+	// PromptPrice and CompletionPrice are per 1,000 tokens, for models
+	// Models doesn't list
+	PromptPrice     float64 `yaml:"prompt_price"`
+	CompletionPrice float64 `yaml:"completion_price"`
+	// Models are the prices of specific models, by the name Dify reports
+	Models map[string]ModelPrice `yaml:"models"`
+	// DailyBudget is what one user may spend a day before they are told
+	// to come back tomorrow; 0 doesn't limit
+	DailyBudget float64 `yaml:"daily_budget"`
+	// Timezone is where days, and so budgets, start at midnight
+	Timezone string `yaml:"timezone"`
+	// Retention is how long a user's spend on a day is kept
+	Retention time.Duration `yaml:"retention"`
+}
+
+// ModelPrice is what a model costs per 1,000 tokens
+type ModelPrice struct {
+	PromptPrice     float64 `yaml:"prompt_price"`
+	CompletionPrice float64 `yaml:"completion_price"`
+}
+
+// TokenBucketConfig allows Rate requests per second on average, in bursts
+// of up to Burst; a zero Rate disables limiting
+type TokenBucketConfig struct {
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+}
+
+// APIRateLimitConfig throttles the protected API per caller
+type APIRateLimitConfig struct {
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+	// Overrides replaces the limit for specific API keys, by key name
+	Overrides map[string]TokenBucketConfig `yaml:"overrides"`
+}
+
+// Load loads configuration. Settings are layered, lowest precedence first:
+//
+//  1. built-in defaults
+//  2. the YAML or JSON file named by DIFYGATE_CONFIG_FILE, if set
+//  3. environment variables (including those from a .env file)
+//
+// An environment variable overrides the file only when it is set, so the
+// file can hold the full configuration and the environment just secrets.
+// Secrets may also be given as NAME_FILE pointing at a mounted secret file.
 func Load() (*Config, error) {
-	// Load .env file if it exists
-	_ = godotenv.Load()
+	return LoadEnvFile("")
+}
+
+// LoadEnvFile is Load reading environment variables from envFile instead
+// of .env. Unlike .env, a named file must exist. Calling it again, to
+// reload, picks up changes to the file.
+func LoadEnvFile(envFile string) (*Config, error) {
+	if err := loadEnvFile(envFile); err != nil {
+		return nil, err
+	}
+
+	config := defaults()
+
+	if path := os.Getenv("DIFYGATE_CONFIG_FILE"); path != "" {
+		if err := loadFile(path, config); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := config.applyEnv(); err != nil {
+		return nil, err
+	}
+	if err := config.Messages.loadDir(); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
 
-	config := &Config{
+// defaults returns the built-in configuration
+func defaults() *Config {
+	return &Config{
 		DIFYGATE: gate.DIFYGateConfig{
-			Host:     getEnv("DIFYGATE_SMTP_HOST", "smtp.gmail.com"),
-			Port:     getEnvAsInt("DIFYGATE_SMTP_PORT", 587),
-			Username: os.Getenv("DIFYGATE_SMTP_USERNAME"),
-			Password: os.Getenv("DIFYGATE_SMTP_PASSWORD"),
-			FromName: getEnv("DIFYGATE_SMTP_FROM_NAME", "DifyGate Email Service"),
+			Host:     "smtp.gmail.com",
+			Port:     587,
+			FromName: "DifyGate Email Service",
+		},
+		Chat: ChatConfig{
+			ReplyMode:         ReplyModeFinal,
+			ReplyMinInterval:  5 * time.Second,
+			ReplyMinChunk:     200,
+			ReplyMaxMessages:  5,
+			Segments:          SegmentsConcatenate,
+			MaxQueryLength:    8000,
+			QueryLengthMode:   QueryLengthTruncate,
+			MaxQueuedMessages: 3,
+			DebounceInFlight:  DebounceQueue,
+			SendRetryWindow:   time.Hour,
+			Sanitize: SanitizeConfig{
+				ThinkTags: true,
+			},
+		},
+		Messages: MessagesConfig{
+			DefaultLocale: DefaultLocale,
+		},
+		WhatsApp: WhatsAppConfig{
+			GraphAPIBaseURL:          "https://graph.facebook.com",
+			APIVersion:               "v22.0",
+			ConversationTTL:          7 * 24 * time.Hour,
+			UnsupportedReplyInterval: time.Hour,
+			LinkPreviews:             true,
+			MarkRead:                 true,
+			ReadReceiptTimeout:       5 * time.Second,
+			StatusRetention:          7 * 24 * time.Hour,
+		},
+		Slack: SlackConfig{
+			APIBaseURL:      "https://slack.com/api",
+			ConversationTTL: 7 * 24 * time.Hour,
+		},
+		Discord: DiscordConfig{
+			APIBaseURL:      "https://discord.com/api/v10",
+			ConversationTTL: 7 * 24 * time.Hour,
+		},
+		Messenger: MessengerConfig{
+			ConversationTTL: 7 * 24 * time.Hour,
+		},
+		Twilio: TwilioConfig{
+			APIBaseURL:       "https://api.twilio.com",
+			SyncReplyTimeout: 10 * time.Second,
+			MaxSegments:      4,
+			ConversationTTL:  7 * 24 * time.Hour,
+		},
+		Webhooks: OutgoingWebhooksConfig{
+			MaxAttempts: 5,
+			QueueSize:   1000,
+		},
+		Dify: DifyConfig{
+			BaseURL:            "https://api.dify.ai/v1",
+			RequestTimeout:     60 * time.Second,
+			StreamTimeout:      120 * time.Second,
+			BreakerCooldown:    30 * time.Second,
+			StreamBufferSize:   100,
+			StreamBackpressure: BackpressureBlock,
+		},
+		EmailRateLimit: RateLimitConfig{
+			PerMinute: 60,
+			PerHour:   1000,
+		},
+		EmailIdempotency: IdempotencyConfig{
+			TTL:      24 * time.Hour,
+			InFlight: IdempotencyConflict,
+		},
+		EmailAlert: EmailAlertConfig{
+			Window:   10 * time.Minute,
+			MinSends: 5,
+			Cooldown: time.Hour,
+		},
+		SignatureAlert: SignatureAlertConfig{
+			Threshold: 10,
+			Window:    10 * time.Minute,
+			Cooldown:  time.Hour,
+		},
+		Digest: DigestConfig{
+			Schedule: "0 7 * * *",
+			Timezone: "UTC",
+		},
+		Handoff: HandoffConfig{
+			Triggers:         []string{"talk to a human", "speak to a human", "talk to a person", "speak to a person", "human agent"},
+			TranscriptLength: 10,
+			AgentReplyPrefix: "*{agent}:* ",
+		},
+		Abuse: AbuseConfig{
+			MaxMessages:     20,
+			Window:          time.Minute,
+			Strikes:         3,
+			StrikeWindow:    time.Hour,
+			MaxIdentical:    5,
+			MuteDuration:    time.Hour,
+			MaxMuteDuration: 24 * time.Hour,
+			OffenseMemory:   7 * 24 * time.Hour,
+		},
+		Transcript: TranscriptConfig{
+			MaxMessages:      200,
+			MaxMessageLength: 2000,
+			UserCooldown:     10 * time.Minute,
+		},
+		Broadcast: BroadcastConfig{
+			Rate:           10,
+			MaxRate:        50,
+			MaxRecipients:  10000,
+			Retention:      7 * 24 * time.Hour,
+			OptOutKeywords: []string{"stop", "unsubscribe"},
+			OptInKeywords:  []string{"start", "subscribe"},
+		},
+		Schedule: ScheduleConfig{
+			Interval:    15 * time.Second,
+			MaxAhead:    90 * 24 * time.Hour,
+			MaxAttempts: 5,
+			Retention:   7 * 24 * time.Hour,
+		},
+		Features: allFeatures(),
+		AnswerCache: AnswerCacheConfig{
+			TTL:        time.Hour,
+			MaxEntries: 10000,
+		},
+		Cost: CostConfig{
+			Currency:  "USD",
+			Timezone:  "UTC",
+			Retention: 90 * 24 * time.Hour,
+		},
+		ChatJobs: ChatJobsConfig{
+			TTL:           24 * time.Hour,
+			MaxConcurrent: 2,
+			MaxQueued:     20,
+		},
+		Auth: AuthConfig{
+			JWT: JWTConfig{
+				IdentityClaim: "sub",
+				ScopesClaim:   "scope",
+				Leeway:        30 * time.Second,
+			},
+		},
+		APIRateLimit: APIRateLimitConfig{
+			Rate:  10,
+			Burst: 20,
+		},
+		Server: ServerConfig{
+			Port:                6001,
+			ReadHeaderTimeout:   5 * time.Second,
+			ReadTimeout:         30 * time.Second,
+			WriteTimeout:        60 * time.Second,
+			IdleTimeout:         120 * time.Second,
+			ShutdownDrain:       5 * time.Second,
+			ShutdownTimeout:     30 * time.Second,
+			MaxBodyBytes:        1 << 20,   // 1 MiB
+			WebhookMaxBodyBytes: 256 << 10, // Meta payloads are a few KiB
+			EmailMaxBodyBytes:   25 << 20,  // room for base64 attachments
+			MediaMaxBodyBytes:   101 << 20, // Meta's 100 MB document limit plus the form
+			GinMode:             defaultGinMode(),
+		},
+		TLS: TLSConfig{
+			AutocertCacheDir: "autocert-cache",
+		},
+		Log: LogConfig{
+			Level:            defaultLogLevel(),
+			Format:           "json",
+			AccessSkipPaths:  []string{"/healthz", "/readyz", "/api/v1/health"},
+			AccessSampleRate: 1,
+		},
+		Sentry: SentryConfig{
+			SignatureBurst:  10,
+			SignatureWindow: 5 * time.Minute,
+		},
+		History: HistoryConfig{
+			Retention:     30 * 24 * time.Hour,
+			PruneInterval: time.Hour,
+		},
+		Debug: DebugConfig{
+			BindAddr: "127.0.0.1",
+		},
+		Mock: MockConfig{
+			Answer:     "You said: {query}",
+			Delay:      300 * time.Millisecond,
+			ChunkDelay: 50 * time.Millisecond,
+		},
+		HTTPClient: HTTPClientConfig{
+			MaxIdleConnsPerHost:   16,
+			DialTimeout:           5 * time.Second,
+			TLSHandshakeTimeout:   5 * time.Second,
+			IdleConnTimeout:       90 * time.Second,
+			ResponseHeaderTimeout: 60 * time.Second,
+			HTTP2:                 true,
 		},
 	}
+}
 
-	return config, nil
+// applyEnv overrides settings with any environment variables that are set
+func (c *Config) applyEnv() error {
+	var errs []error
+	secret := func(dst *string, key string) {
+		value, err := getSecretEnv(key, *dst)
+		if err != nil {
+			errs = append(errs, err)
+			return
+		}
+		*dst = value
+	}
+
+	secret(&c.Auth.APIKey, "DIFYGATE_API_KEY")
+	c.Auth.APIKeySHA256 = getEnv("DIFYGATE_API_KEY_SHA256", c.Auth.APIKeySHA256)
+	previousKeys := strings.Join(c.Auth.PreviousAPIKeys, ",")
+	secret(&previousKeys, "DIFYGATE_API_KEY_PREVIOUS")
+	c.Auth.PreviousAPIKeys = splitList(previousKeys)
+	c.Auth.PreviousAPIKeySHA256s = getEnvAsList("DIFYGATE_API_KEY_PREVIOUS_SHA256", c.Auth.PreviousAPIKeySHA256s)
+	c.Auth.EmailAllowedCIDRs = getEnvAsList("DIFYGATE_EMAIL_ALLOWED_CIDRS", c.Auth.EmailAllowedCIDRs)
+	c.Auth.AdminAllowedCIDRs = getEnvAsList("DIFYGATE_ADMIN_ALLOWED_CIDRS", c.Auth.AdminAllowedCIDRs)
+	c.Auth.JWT.JWKSURL = getEnv("DIFYGATE_JWT_JWKS_URL", c.Auth.JWT.JWKSURL)
+	secret(&c.Auth.JWT.HMACSecret, "DIFYGATE_JWT_HMAC_SECRET")
+	c.Auth.JWT.RSAPublicKeyFile = getEnv("DIFYGATE_JWT_RSA_PUBLIC_KEY_FILE", c.Auth.JWT.RSAPublicKeyFile)
+	c.Auth.JWT.Issuer = getEnv("DIFYGATE_JWT_ISSUER", c.Auth.JWT.Issuer)
+	c.Auth.JWT.Audience = getEnv("DIFYGATE_JWT_AUDIENCE", c.Auth.JWT.Audience)
+	c.Auth.JWT.IdentityClaim = getEnv("DIFYGATE_JWT_IDENTITY_CLAIM", c.Auth.JWT.IdentityClaim)
+	c.Auth.JWT.ScopesClaim = getEnv("DIFYGATE_JWT_SCOPES_CLAIM", c.Auth.JWT.ScopesClaim)
+	c.Auth.JWT.Leeway = getEnvAsDuration("DIFYGATE_JWT_LEEWAY", c.Auth.JWT.Leeway)
+	var keysJSON string
+	secret(&keysJSON, "DIFYGATE_API_KEYS")
+	if keysJSON != "" {
+		var keys []APIKeyConfig
+		if err := json.Unmarshal([]byte(keysJSON), &keys); err != nil {
+			errs = append(errs, fmt.Errorf("DIFYGATE_API_KEYS: %w", err))
+		} else {
+			c.Auth.Keys = keys
+		}
+	}
+
+	var hooksJSON string
+	secret(&hooksJSON, "DIFYGATE_HOOKS")
+	if hooksJSON != "" {
+		var hooks []HookConfig
+		if err := json.Unmarshal([]byte(hooksJSON), &hooks); err != nil {
+			errs = append(errs, fmt.Errorf("DIFYGATE_HOOKS: %w", err))
+		} else {
+			c.Hooks = hooks
+		}
+	}
+
+	var webhooksJSON string
+	secret(&webhooksJSON, "DIFYGATE_OUTGOING_WEBHOOKS")
+	if webhooksJSON != "" {
+		var targets []OutgoingWebhookConfig
+		if err := json.Unmarshal([]byte(webhooksJSON), &targets); err != nil {
+			errs = append(errs, fmt.Errorf("DIFYGATE_OUTGOING_WEBHOOKS: %w", err))
+		} else {
+			c.Webhooks.Targets = targets
+		}
+	}
+	c.Webhooks.MaxAttempts = getEnvAsInt("DIFYGATE_OUTGOING_WEBHOOK_MAX_ATTEMPTS", c.Webhooks.MaxAttempts)
+	c.Webhooks.QueueSize = getEnvAsInt("DIFYGATE_OUTGOING_WEBHOOK_QUEUE_SIZE", c.Webhooks.QueueSize)
+
+	c.DIFYGATE.Host = getEnv("DIFYGATE_SMTP_HOST", c.DIFYGATE.Host)
+	c.DIFYGATE.Port = getEnvAsInt("DIFYGATE_SMTP_PORT", c.DIFYGATE.Port)
+	c.DIFYGATE.Username = getEnv("DIFYGATE_SMTP_USERNAME", c.DIFYGATE.Username)
+	secret(&c.DIFYGATE.Password, "DIFYGATE_SMTP_PASSWORD")
+	c.DIFYGATE.FromName = getEnv("DIFYGATE_SMTP_FROM_NAME", c.DIFYGATE.FromName)
+
+	c.Chat.ReplyMode = getEnv("DIFYGATE_REPLY_MODE", c.Chat.ReplyMode)
+	c.Chat.ReplyMinInterval = getEnvAsDuration("DIFYGATE_REPLY_MIN_INTERVAL", c.Chat.ReplyMinInterval)
+	c.Chat.ReplyMinChunk = getEnvAsInt("DIFYGATE_REPLY_MIN_CHUNK", c.Chat.ReplyMinChunk)
+	c.Chat.ReplyMaxMessages = getEnvAsInt("DIFYGATE_REPLY_MAX_MESSAGES", c.Chat.ReplyMaxMessages)
+	c.Chat.Segments = getEnv("DIFYGATE_ANSWER_SEGMENTS", c.Chat.Segments)
+	c.Chat.SegmentDelimiter = getEnv("DIFYGATE_ANSWER_SEGMENT_DELIMITER", c.Chat.SegmentDelimiter)
+	c.Chat.AckDelay = getEnvAsDuration("DIFYGATE_ACK_DELAY", c.Chat.AckDelay)
+	c.Chat.MaxQueryLength = getEnvAsInt("DIFYGATE_MAX_QUERY_LENGTH", c.Chat.MaxQueryLength)
+	c.Chat.QueryLengthMode = getEnv("DIFYGATE_QUERY_LENGTH_MODE", c.Chat.QueryLengthMode)
+	c.Chat.LanguageHints = getEnvAsBool("DIFYGATE_LANGUAGE_HINTS", c.Chat.LanguageHints)
+	c.Chat.MaxQueuedMessages = getEnvAsInt("DIFYGATE_MAX_QUEUED_MESSAGES", c.Chat.MaxQueuedMessages)
+	c.Chat.Debounce = getEnvAsDuration("DIFYGATE_MESSAGE_DEBOUNCE", c.Chat.Debounce)
+	c.Chat.DebounceInFlight = getEnv("DIFYGATE_MESSAGE_DEBOUNCE_IN_FLIGHT", c.Chat.DebounceInFlight)
+	c.Chat.DurableInbox = getEnvAsBool("DIFYGATE_DURABLE_INBOX", c.Chat.DurableInbox)
+	c.Chat.SendRetryWindow = getEnvAsDuration("DIFYGATE_SEND_RETRY_WINDOW", c.Chat.SendRetryWindow)
+	if cannedJSON := getEnv("DIFYGATE_CANNED_RESPONSES", ""); cannedJSON != "" {
+		var canned []CannedResponseConfig
+		if err := json.Unmarshal([]byte(cannedJSON), &canned); err != nil {
+			errs = append(errs, fmt.Errorf("DIFYGATE_CANNED_RESPONSES: %w", err))
+		} else {
+			c.Chat.CannedResponses = canned
+		}
+	}
+	// Patterns are a JSON array, since regular expressions may hold commas
+	if patternsJSON := getEnv("DIFYGATE_STRIP_PATTERNS", ""); patternsJSON != "" {
+		var patterns []string
+		if err := json.Unmarshal([]byte(patternsJSON), &patterns); err != nil {
+			errs = append(errs, fmt.Errorf("DIFYGATE_STRIP_PATTERNS: %w", err))
+		} else {
+			c.Chat.Hooks.StripPatterns = patterns
+		}
+	}
+	c.Chat.Hooks.ReplyPrefix = getEnv("DIFYGATE_REPLY_PREFIX", c.Chat.Hooks.ReplyPrefix)
+	c.Chat.Hooks.ReplySuffix = getEnv("DIFYGATE_REPLY_SUFFIX", c.Chat.Hooks.ReplySuffix)
+	c.Chat.Hooks.ProfanityWords = getEnvAsList("DIFYGATE_PROFANITY_WORDS", c.Chat.Hooks.ProfanityWords)
+	c.Chat.Sanitize.ThinkTags = getEnvAsBool("DIFYGATE_STRIP_THINK_TAGS", c.Chat.Sanitize.ThinkTags)
+	c.Chat.Sanitize.Citations = getEnvAsBool("DIFYGATE_STRIP_CITATIONS", c.Chat.Sanitize.Citations)
+	c.Chat.Sanitize.Sources = getEnvAsBool("DIFYGATE_STRIP_SOURCES", c.Chat.Sanitize.Sources)
+
+	c.Messages.DefaultLocale = getEnv("DIFYGATE_LOCALE", c.Messages.DefaultLocale)
+	c.Messages.DetectLanguage = getEnvAsBool("DIFYGATE_DETECT_LANGUAGE", c.Messages.DetectLanguage)
+	c.Messages.Dir = getEnv("DIFYGATE_MESSAGES_DIR", c.Messages.Dir)
+	var messagesJSON string
+	secret(&messagesJSON, "DIFYGATE_MESSAGES")
+	if messagesJSON != "" {
+		var catalog map[string]map[string]string
+		if err := json.Unmarshal([]byte(messagesJSON), &catalog); err != nil {
+			errs = append(errs, fmt.Errorf("DIFYGATE_MESSAGES: %w", err))
+		} else {
+			c.Messages.Catalog = catalog
+		}
+	}
+
+	secret(&c.WhatsApp.AppSecret, "DIFYGATE_WHATSAPP_APP_SECRET")
+	c.WhatsApp.SkipSignatureVerify = getEnvAsBool("DIFYGATE_WHATSAPP_SKIP_SIGNATURE_VERIFY", c.WhatsApp.SkipSignatureVerify)
+	secret(&c.WhatsApp.VerifyToken, "DIFYGATE_WEBHOOK_VERIFY_TOKEN")
+	secret(&c.WhatsApp.GraphAPIToken, "DIFYGATE_GRAPH_API_TOKEN")
+	c.WhatsApp.GraphAPIBaseURL = getEnv("DIFYGATE_GRAPH_API_BASE_URL", c.WhatsApp.GraphAPIBaseURL)
+	c.WhatsApp.APIVersion = getEnv("DIFYGATE_GRAPH_API_VERSION", c.WhatsApp.APIVersion)
+	c.WhatsApp.PhoneNumberID = getEnv("DIFYGATE_WHATSAPP_PHONE_NUMBER_ID", c.WhatsApp.PhoneNumberID)
+	c.WhatsApp.PhoneNumberIDs = getEnvAsList("DIFYGATE_WHATSAPP_PHONE_NUMBER_IDS", c.WhatsApp.PhoneNumberIDs)
+	c.WhatsApp.ConversationTTL = getEnvAsDuration("DIFYGATE_WHATSAPP_CONVERSATION_TTL", c.WhatsApp.ConversationTTL)
+	c.WhatsApp.UnsupportedReplyInterval = getEnvAsDuration("DIFYGATE_WHATSAPP_UNSUPPORTED_REPLY_INTERVAL", c.WhatsApp.UnsupportedReplyInterval)
+	c.WhatsApp.StatusRetention = getEnvAsDuration("DIFYGATE_WHATSAPP_STATUS_RETENTION", c.WhatsApp.StatusRetention)
+	c.WhatsApp.LinkPreviews = getEnvAsBool("DIFYGATE_WHATSAPP_LINK_PREVIEWS", c.WhatsApp.LinkPreviews)
+	c.WhatsApp.ReactionProcessing = getEnv("DIFYGATE_WHATSAPP_REACTION_PROCESSING", c.WhatsApp.ReactionProcessing)
+	c.WhatsApp.ReactionDone = getEnv("DIFYGATE_WHATSAPP_REACTION_DONE", c.WhatsApp.ReactionDone)
+	if v := os.Getenv("DIFYGATE_WHATSAPP_INPUTS"); v != "" {
+		var inputs map[string]map[string]interface{}
+		if err := json.Unmarshal([]byte(v), &inputs); err != nil {
+			errs = append(errs, fmt.Errorf("DIFYGATE_WHATSAPP_INPUTS: must map phone number IDs to JSON objects: %w", err))
+		} else {
+			c.WhatsApp.Inputs = inputs
+		}
+	}
+	c.WhatsApp.MarkRead = getEnvAsBool("DIFYGATE_WHATSAPP_MARK_READ", c.WhatsApp.MarkRead)
+	c.WhatsApp.VoiceReplies = getEnvAsBool("DIFYGATE_WHATSAPP_VOICE_REPLIES", c.WhatsApp.VoiceReplies)
+	if v := os.Getenv("DIFYGATE_WHATSAPP_MARK_READ_NUMBERS"); v != "" {
+		var numbers map[string]bool
+		if err := json.Unmarshal([]byte(v), &numbers); err != nil {
+			errs = append(errs, fmt.Errorf("DIFYGATE_WHATSAPP_MARK_READ_NUMBERS: must map phone number IDs to true or false: %w", err))
+		} else {
+			c.WhatsApp.MarkReadNumbers = numbers
+		}
+	}
+	c.WhatsApp.ReadReceiptTimeout = getEnvAsDuration("DIFYGATE_WHATSAPP_READ_RECEIPT_TIMEOUT", c.WhatsApp.ReadReceiptTimeout)
+
+	secret(&c.Slack.SigningSecret, "DIFYGATE_SLACK_SIGNING_SECRET")
+	secret(&c.Slack.BotToken, "DIFYGATE_SLACK_BOT_TOKEN")
+	c.Slack.APIBaseURL = getEnv("DIFYGATE_SLACK_API_BASE_URL", c.Slack.APIBaseURL)
+	c.Slack.ConversationTTL = getEnvAsDuration("DIFYGATE_SLACK_CONVERSATION_TTL", c.Slack.ConversationTTL)
+
+	c.Discord.PublicKey = getEnv("DIFYGATE_DISCORD_PUBLIC_KEY", c.Discord.PublicKey)
+	c.Discord.APIBaseURL = getEnv("DIFYGATE_DISCORD_API_BASE_URL", c.Discord.APIBaseURL)
+	c.Discord.ConversationTTL = getEnvAsDuration("DIFYGATE_DISCORD_CONVERSATION_TTL", c.Discord.ConversationTTL)
+
+	secret(&c.Messenger.PageAccessToken, "DIFYGATE_MESSENGER_PAGE_ACCESS_TOKEN")
+	c.Messenger.ConversationTTL = getEnvAsDuration("DIFYGATE_MESSENGER_CONVERSATION_TTL", c.Messenger.ConversationTTL)
+
+	c.Twilio.AccountSID = getEnv("DIFYGATE_TWILIO_ACCOUNT_SID", c.Twilio.AccountSID)
+	secret(&c.Twilio.AuthToken, "DIFYGATE_TWILIO_AUTH_TOKEN")
+	c.Twilio.APIBaseURL = getEnv("DIFYGATE_TWILIO_API_BASE_URL", c.Twilio.APIBaseURL)
+	c.Twilio.SyncReplyTimeout = getEnvAsDuration("DIFYGATE_TWILIO_SYNC_REPLY_TIMEOUT", c.Twilio.SyncReplyTimeout)
+	c.Twilio.MaxSegments = getEnvAsInt("DIFYGATE_SMS_MAX_SEGMENTS", c.Twilio.MaxSegments)
+	c.Twilio.ConversationTTL = getEnvAsDuration("DIFYGATE_SMS_CONVERSATION_TTL", c.Twilio.ConversationTTL)
+
+	c.Dify.BaseURL = getEnv("DIFYGATE_DIFY_BASE_URL", c.Dify.BaseURL)
+	secret(&c.Dify.APIKey, "DIFYGATE_DIFY_API_KEY")
+	c.Dify.ClientID = getEnv("DIFYGATE_DIFY_CLIENT_ID", c.Dify.ClientID)
+	c.Dify.RequestTimeout = getEnvAsDuration("DIFYGATE_DIFY_REQUEST_TIMEOUT", c.Dify.RequestTimeout)
+	c.Dify.StreamTimeout = getEnvAsDuration("DIFYGATE_DIFY_STREAM_TIMEOUT", c.Dify.StreamTimeout)
+	c.Dify.StreamMaxAge = getEnvAsDuration("DIFYGATE_DIFY_STREAM_MAX_AGE", c.Dify.StreamMaxAge)
+	c.Dify.StreamBufferSize = getEnvAsInt("DIFYGATE_DIFY_STREAM_BUFFER_SIZE", c.Dify.StreamBufferSize)
+	c.Dify.StreamBackpressure = getEnv("DIFYGATE_DIFY_STREAM_BACKPRESSURE", c.Dify.StreamBackpressure)
+	c.Dify.BreakerCooldown = getEnvAsDuration("DIFYGATE_DIFY_BREAKER_COOLDOWN", c.Dify.BreakerCooldown)
+	c.Dify.UserIDMode = getEnv("DIFYGATE_DIFY_USER_ID_MODE", c.Dify.UserIDMode)
+	secret(&c.Dify.UserIDSalt, "DIFYGATE_DIFY_USER_ID_SALT")
+	if v := os.Getenv("DIFYGATE_DIFY_DEFAULT_INPUTS"); v != "" {
+		var inputs map[string]interface{}
+		if err := json.Unmarshal([]byte(v), &inputs); err != nil {
+			errs = append(errs, fmt.Errorf("DIFYGATE_DIFY_DEFAULT_INPUTS: must be a JSON object: %w", err))
+		} else {
+			c.Dify.DefaultInputs = inputs
+		}
+	}
+
+	c.HTTPClient.MaxIdleConnsPerHost = getEnvAsInt("DIFYGATE_HTTP_MAX_IDLE_CONNS_PER_HOST", c.HTTPClient.MaxIdleConnsPerHost)
+	c.HTTPClient.DialTimeout = getEnvAsDuration("DIFYGATE_HTTP_DIAL_TIMEOUT", c.HTTPClient.DialTimeout)
+	c.HTTPClient.TLSHandshakeTimeout = getEnvAsDuration("DIFYGATE_HTTP_TLS_HANDSHAKE_TIMEOUT", c.HTTPClient.TLSHandshakeTimeout)
+	c.HTTPClient.IdleConnTimeout = getEnvAsDuration("DIFYGATE_HTTP_IDLE_CONN_TIMEOUT", c.HTTPClient.IdleConnTimeout)
+	c.HTTPClient.ResponseHeaderTimeout = getEnvAsDuration("DIFYGATE_HTTP_RESPONSE_HEADER_TIMEOUT", c.HTTPClient.ResponseHeaderTimeout)
+	c.HTTPClient.HTTP2 = getEnvAsBool("DIFYGATE_HTTP2", c.HTTPClient.HTTP2)
+	secret(&c.HTTPClient.OutboundProxy, "DIFYGATE_OUTBOUND_PROXY")
+	secret(&c.HTTPClient.OutboundProxyDify, "DIFYGATE_OUTBOUND_PROXY_DIFY")
+	secret(&c.HTTPClient.OutboundProxyMeta, "DIFYGATE_OUTBOUND_PROXY_META")
+	secret(&c.HTTPClient.OutboundProxyWebhooks, "DIFYGATE_OUTBOUND_PROXY_WEBHOOKS")
+
+	c.Store.URL = getEnv("DIFYGATE_STORE_URL", c.Store.URL)
+	storeKeys := strings.Join(c.Store.EncryptionKeys, ",")
+	secret(&storeKeys, "DIFYGATE_STORE_ENCRYPTION_KEY")
+	c.Store.EncryptionKeys = splitList(storeKeys)
+
+	c.History.Enabled = getEnvAsBool("DIFYGATE_HISTORY_ENABLED", c.History.Enabled)
+	c.History.Path = getEnv("DIFYGATE_HISTORY_PATH", c.History.Path)
+	c.History.Retention = getEnvAsDuration("DIFYGATE_HISTORY_RETENTION", c.History.Retention)
+	c.History.PruneInterval = getEnvAsDuration("DIFYGATE_HISTORY_PRUNE_INTERVAL", c.History.PruneInterval)
+	historyKeys := strings.Join(c.History.EncryptionKeys, ",")
+	secret(&historyKeys, "DIFYGATE_HISTORY_ENCRYPTION_KEY")
+	c.History.EncryptionKeys = splitList(historyKeys)
+	if len(c.History.EncryptionKeys) == 0 {
+		c.History.EncryptionKeys = c.Store.EncryptionKeys
+	}
+
+	c.EmailRateLimit.PerMinute = getEnvAsInt("DIFYGATE_EMAIL_RATE_LIMIT_PER_MINUTE", c.EmailRateLimit.PerMinute)
+	c.EmailRateLimit.PerHour = getEnvAsInt("DIFYGATE_EMAIL_RATE_LIMIT_PER_HOUR", c.EmailRateLimit.PerHour)
+	c.EmailIdempotency.TTL = getEnvAsDuration("DIFYGATE_EMAIL_IDEMPOTENCY_TTL", c.EmailIdempotency.TTL)
+	c.EmailIdempotency.InFlight = getEnv("DIFYGATE_EMAIL_IDEMPOTENCY_IN_FLIGHT", c.EmailIdempotency.InFlight)
+	c.EmailAlert.FailureRate = getEnvAsFloat("DIFYGATE_EMAIL_ALERT_FAILURE_RATE", c.EmailAlert.FailureRate)
+	c.EmailAlert.Window = getEnvAsDuration("DIFYGATE_EMAIL_ALERT_WINDOW", c.EmailAlert.Window)
+	c.EmailAlert.MinSends = getEnvAsInt("DIFYGATE_EMAIL_ALERT_MIN_SENDS", c.EmailAlert.MinSends)
+	c.EmailAlert.Cooldown = getEnvAsDuration("DIFYGATE_EMAIL_ALERT_COOLDOWN", c.EmailAlert.Cooldown)
+	c.EmailAlert.WhatsAppTo = getEnv("DIFYGATE_EMAIL_ALERT_WHATSAPP_TO", c.EmailAlert.WhatsAppTo)
+	c.SignatureAlert.Threshold = getEnvAsInt("DIFYGATE_SIGNATURE_ALERT_THRESHOLD", c.SignatureAlert.Threshold)
+	c.SignatureAlert.Window = getEnvAsDuration("DIFYGATE_SIGNATURE_ALERT_WINDOW", c.SignatureAlert.Window)
+	c.SignatureAlert.Cooldown = getEnvAsDuration("DIFYGATE_SIGNATURE_ALERT_COOLDOWN", c.SignatureAlert.Cooldown)
+	c.SignatureAlert.NotifyEmail = getEnvAsList("DIFYGATE_SIGNATURE_ALERT_NOTIFY_EMAIL", c.SignatureAlert.NotifyEmail)
+	c.Handoff.Enabled = getEnvAsBool("DIFYGATE_HANDOFF_ENABLED", c.Handoff.Enabled)
+	c.Handoff.Triggers = getEnvAsList("DIFYGATE_HANDOFF_TRIGGERS", c.Handoff.Triggers)
+	c.Digest.Recipients = getEnvAsList("DIFYGATE_DIGEST_RECIPIENTS", c.Digest.Recipients)
+	c.Digest.Schedule = getEnv("DIFYGATE_DIGEST_SCHEDULE", c.Digest.Schedule)
+	c.Digest.Timezone = getEnv("DIFYGATE_DIGEST_TIMEZONE", c.Digest.Timezone)
+	c.Handoff.NotifyEmail = getEnvAsList("DIFYGATE_HANDOFF_NOTIFY_EMAIL", c.Handoff.NotifyEmail)
+	c.Handoff.NotifyWhatsAppTo = getEnv("DIFYGATE_HANDOFF_NOTIFY_WHATSAPP_TO", c.Handoff.NotifyWhatsAppTo)
+	c.Handoff.TranscriptLength = getEnvAsInt("DIFYGATE_HANDOFF_TRANSCRIPT_LENGTH", c.Handoff.TranscriptLength)
+	c.Handoff.AgentReplyPrefix = getEnv("DIFYGATE_HANDOFF_AGENT_REPLY_PREFIX", c.Handoff.AgentReplyPrefix)
+	c.Handoff.AgentReplyRequiresHandoff = getEnvAsBool("DIFYGATE_HANDOFF_AGENT_REPLY_REQUIRES_HANDOFF", c.Handoff.AgentReplyRequiresHandoff)
+
+	c.Abuse.Enabled = getEnvAsBool("DIFYGATE_ABUSE_ENABLED", c.Abuse.Enabled)
+	c.Abuse.MaxMessages = getEnvAsInt("DIFYGATE_ABUSE_MAX_MESSAGES", c.Abuse.MaxMessages)
+	c.Abuse.Window = getEnvAsDuration("DIFYGATE_ABUSE_WINDOW", c.Abuse.Window)
+	c.Abuse.Strikes = getEnvAsInt("DIFYGATE_ABUSE_STRIKES", c.Abuse.Strikes)
+	c.Abuse.StrikeWindow = getEnvAsDuration("DIFYGATE_ABUSE_STRIKE_WINDOW", c.Abuse.StrikeWindow)
+	c.Abuse.MaxIdentical = getEnvAsInt("DIFYGATE_ABUSE_MAX_IDENTICAL", c.Abuse.MaxIdentical)
+	c.Abuse.MuteDuration = getEnvAsDuration("DIFYGATE_ABUSE_MUTE_DURATION", c.Abuse.MuteDuration)
+	c.Abuse.MaxMuteDuration = getEnvAsDuration("DIFYGATE_ABUSE_MAX_MUTE_DURATION", c.Abuse.MaxMuteDuration)
+	c.Abuse.OffenseMemory = getEnvAsDuration("DIFYGATE_ABUSE_OFFENSE_MEMORY", c.Abuse.OffenseMemory)
+
+	c.Transcript.MaxMessages = getEnvAsInt("DIFYGATE_TRANSCRIPT_MAX_MESSAGES", c.Transcript.MaxMessages)
+	c.Transcript.MaxMessageLength = getEnvAsInt("DIFYGATE_TRANSCRIPT_MAX_MESSAGE_LENGTH", c.Transcript.MaxMessageLength)
+	c.Transcript.UserCommand = getEnvAsBool("DIFYGATE_TRANSCRIPT_USER_COMMAND", c.Transcript.UserCommand)
+	c.Transcript.UserCooldown = getEnvAsDuration("DIFYGATE_TRANSCRIPT_USER_COOLDOWN", c.Transcript.UserCooldown)
+	c.Broadcast.Rate = getEnvAsFloat("DIFYGATE_BROADCAST_RATE", c.Broadcast.Rate)
+	c.Broadcast.MaxRate = getEnvAsFloat("DIFYGATE_BROADCAST_MAX_RATE", c.Broadcast.MaxRate)
+	c.Broadcast.MaxRecipients = getEnvAsInt("DIFYGATE_BROADCAST_MAX_RECIPIENTS", c.Broadcast.MaxRecipients)
+	c.Broadcast.Retention = getEnvAsDuration("DIFYGATE_BROADCAST_RETENTION", c.Broadcast.Retention)
+	c.Broadcast.Blocklist = getEnvAsList("DIFYGATE_BROADCAST_BLOCKLIST", c.Broadcast.Blocklist)
+	c.Broadcast.OptOutKeywords = getEnvAsList("DIFYGATE_BROADCAST_OPT_OUT_KEYWORDS", c.Broadcast.OptOutKeywords)
+	c.Broadcast.OptInKeywords = getEnvAsList("DIFYGATE_BROADCAST_OPT_IN_KEYWORDS", c.Broadcast.OptInKeywords)
+	c.Schedule.Interval = getEnvAsDuration("DIFYGATE_SCHEDULE_INTERVAL", c.Schedule.Interval)
+	c.Schedule.MaxAhead = getEnvAsDuration("DIFYGATE_SCHEDULE_MAX_AHEAD", c.Schedule.MaxAhead)
+	c.Schedule.MaxAttempts = getEnvAsInt("DIFYGATE_SCHEDULE_MAX_ATTEMPTS", c.Schedule.MaxAttempts)
+	c.Schedule.Retention = getEnvAsDuration("DIFYGATE_SCHEDULE_RETENTION", c.Schedule.Retention)
+
+	if err := c.Features.applyEnv(); err != nil {
+		errs = append(errs, err)
+	}
+
+	c.AnswerCache.Enabled = getEnvAsBool("DIFYGATE_ANSWER_CACHE", c.AnswerCache.Enabled)
+	c.AnswerCache.TTL = getEnvAsDuration("DIFYGATE_ANSWER_CACHE_TTL", c.AnswerCache.TTL)
+	c.AnswerCache.MaxEntries = getEnvAsInt("DIFYGATE_ANSWER_CACHE_MAX_ENTRIES", c.AnswerCache.MaxEntries)
+
+	c.Cost.Enabled = getEnvAsBool("DIFYGATE_COST_ENABLED", c.Cost.Enabled)
+	c.Cost.Currency = getEnv("DIFYGATE_COST_CURRENCY", c.Cost.Currency)
+	c.Cost.PromptPrice = getEnvAsFloat("DIFYGATE_COST_PROMPT_PRICE", c.Cost.PromptPrice)
+	c.Cost.CompletionPrice = getEnvAsFloat("DIFYGATE_COST_COMPLETION_PRICE", c.Cost.CompletionPrice)
+	c.Cost.DailyBudget = getEnvAsFloat("DIFYGATE_COST_DAILY_BUDGET", c.Cost.DailyBudget)
+	c.Cost.Timezone = getEnv("DIFYGATE_COST_TIMEZONE", c.Cost.Timezone)
+	c.Cost.Retention = getEnvAsDuration("DIFYGATE_COST_RETENTION", c.Cost.Retention)
+
+	c.ChatJobs.TTL = getEnvAsDuration("DIFYGATE_CHAT_JOBS_TTL", c.ChatJobs.TTL)
+	c.ChatJobs.MaxConcurrent = getEnvAsInt("DIFYGATE_CHAT_JOBS_MAX_CONCURRENT", c.ChatJobs.MaxConcurrent)
+	c.ChatJobs.MaxQueued = getEnvAsInt("DIFYGATE_CHAT_JOBS_MAX_QUEUED", c.ChatJobs.MaxQueued)
+	c.APIRateLimit.Rate = getEnvAsFloat("DIFYGATE_API_RATE_LIMIT_RATE", c.APIRateLimit.Rate)
+	c.APIRateLimit.Burst = getEnvAsInt("DIFYGATE_API_RATE_LIMIT_BURST", c.APIRateLimit.Burst)
+
+	c.Server.Port = getEnvAsInt("DIFYGATE_PORT", c.Server.Port)
+	c.Server.BindAddr = getEnv("DIFYGATE_BIND_ADDR", c.Server.BindAddr)
+	c.Server.ReadHeaderTimeout = getEnvAsDuration("DIFYGATE_READ_HEADER_TIMEOUT", c.Server.ReadHeaderTimeout)
+	c.Server.ReadTimeout = getEnvAsDuration("DIFYGATE_READ_TIMEOUT", c.Server.ReadTimeout)
+	c.Server.WriteTimeout = getEnvAsDuration("DIFYGATE_WRITE_TIMEOUT", c.Server.WriteTimeout)
+	c.Server.IdleTimeout = getEnvAsDuration("DIFYGATE_IDLE_TIMEOUT", c.Server.IdleTimeout)
+	c.Server.ShutdownDrain = getEnvAsDuration("DIFYGATE_SHUTDOWN_DRAIN", c.Server.ShutdownDrain)
+	c.Server.ShutdownTimeout = getEnvAsDuration("DIFYGATE_SHUTDOWN_TIMEOUT", c.Server.ShutdownTimeout)
+	c.Server.GinMode = getEnv("DIFYGATE_GIN_MODE", c.Server.GinMode)
+	c.Server.MaxBodyBytes = getEnvAsInt("DIFYGATE_MAX_BODY_BYTES", c.Server.MaxBodyBytes)
+	c.Server.WebhookMaxBodyBytes = getEnvAsInt("DIFYGATE_WEBHOOK_MAX_BODY_BYTES", c.Server.WebhookMaxBodyBytes)
+	c.Server.EmailMaxBodyBytes = getEnvAsInt("DIFYGATE_EMAIL_MAX_BODY_BYTES", c.Server.EmailMaxBodyBytes)
+	c.Server.MediaMaxBodyBytes = getEnvAsInt("DIFYGATE_MEDIA_MAX_BODY_BYTES", c.Server.MediaMaxBodyBytes)
+
+	c.Server.ExternalURL = getEnv("DIFYGATE_EXTERNAL_URL", c.Server.ExternalURL)
+	c.Server.TrustedProxies = getEnvAsList("DIFYGATE_TRUSTED_PROXIES", c.Server.TrustedProxies)
+	c.Server.RealIPHeader = getEnv("DIFYGATE_REAL_IP_HEADER", c.Server.RealIPHeader)
+
+	c.TLS.CertFile = getEnv("DIFYGATE_TLS_CERT_FILE", c.TLS.CertFile)
+	c.TLS.KeyFile = getEnv("DIFYGATE_TLS_KEY_FILE", c.TLS.KeyFile)
+	c.TLS.AutocertDomains = getEnvAsList("DIFYGATE_AUTOCERT_DOMAINS", c.TLS.AutocertDomains)
+	c.TLS.AutocertCacheDir = getEnv("DIFYGATE_AUTOCERT_CACHE_DIR", c.TLS.AutocertCacheDir)
+	c.TLS.AutocertEmail = getEnv("DIFYGATE_AUTOCERT_EMAIL", c.TLS.AutocertEmail)
+
+	c.Log.Level = getEnv("DIFYGATE_LOG_LEVEL", c.Log.Level)
+	c.Log.Format = getEnv("DIFYGATE_LOG_FORMAT", c.Log.Format)
+	c.Log.AccessSkipPaths = getEnvAsList("DIFYGATE_ACCESS_LOG_SKIP_PATHS", c.Log.AccessSkipPaths)
+	c.Log.AccessSamplePaths = getEnvAsList("DIFYGATE_ACCESS_LOG_SAMPLE_PATHS", c.Log.AccessSamplePaths)
+	c.Log.AccessSampleRate = getEnvAsFloat("DIFYGATE_ACCESS_LOG_SAMPLE_RATE", c.Log.AccessSampleRate)
+
+	secret(&c.Sentry.DSN, "DIFYGATE_SENTRY_DSN")
+	c.Sentry.Environment = getEnv("DIFYGATE_SENTRY_ENVIRONMENT", c.Sentry.Environment)
+	c.Sentry.SignatureBurst = getEnvAsInt("DIFYGATE_SENTRY_SIGNATURE_BURST", c.Sentry.SignatureBurst)
+	c.Sentry.SignatureWindow = getEnvAsDuration("DIFYGATE_SENTRY_SIGNATURE_WINDOW", c.Sentry.SignatureWindow)
+
+	c.Debug.EnablePprof = getEnvAsBool("DIFYGATE_ENABLE_PPROF", c.Debug.EnablePprof)
+	c.Debug.Port = getEnvAsInt("DIFYGATE_PPROF_PORT", c.Debug.Port)
+	c.Debug.BindAddr = getEnv("DIFYGATE_PPROF_BIND_ADDR", c.Debug.BindAddr)
+
+	c.Mock.Enabled = getEnvAsBool("DIFYGATE_MOCK_MODE", c.Mock.Enabled)
+	c.Mock.Answer = getEnv("DIFYGATE_MOCK_ANSWER", c.Mock.Answer)
+	c.Mock.Delay = getEnvAsDuration("DIFYGATE_MOCK_DELAY", c.Mock.Delay)
+	c.Mock.ChunkDelay = getEnvAsDuration("DIFYGATE_MOCK_CHUNK_DELAY", c.Mock.ChunkDelay)
+
+	errs = append(errs, c.normalizeNumbers()...)
+	return errors.Join(errs...)
+}
+
+// normalizeNumbers puts the WhatsApp user numbers configured into the
+// canonical form they are compared in
+func (c *Config) normalizeNumbers() []error {
+	var errs []error
+	normalize := func(name string, number *string) {
+		if *number == "" {
+			return
+		}
+		n, err := phone.Normalize(*number)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			return
+		}
+		*number = n
+	}
+	normalize("DIFYGATE_EMAIL_ALERT_WHATSAPP_TO", &c.EmailAlert.WhatsAppTo)
+	normalize("DIFYGATE_HANDOFF_NOTIFY_WHATSAPP_TO", &c.Handoff.NotifyWhatsAppTo)
+	for i := range c.Broadcast.Blocklist {
+		normalize("DIFYGATE_BROADCAST_BLOCKLIST", &c.Broadcast.Blocklist[i])
+	}
+	return errs
+}
+
+var graphAPIVersionPattern = regexp.MustCompile(`^v\d+\.\d+$`)
+
+// Validate reports settings that are present but invalid. Missing optional
+// settings are not errors; see CriticalProblems for those.
+func (c *Config) Validate() error {
+	var errs []error
+
+	// Settings of disabled features aren't checked
+	f := c.Features
+	if err := validateURL(c.Dify.BaseURL); f.Dify() && err != nil {
+		errs = append(errs, fmt.Errorf("DIFYGATE_DIFY_BASE_URL: %w", err))
+	}
+	if c.Dify.RequestTimeout <= 0 {
+		errs = append(errs, errors.New("DIFYGATE_DIFY_REQUEST_TIMEOUT must be positive"))
+	}
+	if c.Dify.StreamTimeout <= 0 {
+		errs = append(errs, errors.New("DIFYGATE_DIFY_STREAM_TIMEOUT must be positive"))
+	}
+	if err := validateURL(c.WhatsApp.GraphAPIBaseURL); (f.WhatsApp || f.Messenger) && err != nil {
+		errs = append(errs, fmt.Errorf("DIFYGATE_GRAPH_API_BASE_URL: %w", err))
+	}
+	if err := validateURL(c.Slack.APIBaseURL); f.Slack && err != nil {
+		errs = append(errs, fmt.Errorf("DIFYGATE_SLACK_API_BASE_URL: %w", err))
+	}
+	if err := validateURL(c.Discord.APIBaseURL); f.Discord && err != nil {
+		errs = append(errs, fmt.Errorf("DIFYGATE_DISCORD_API_BASE_URL: %w", err))
+	}
+	if f.SMS {
+		if err := validateURL(c.Twilio.APIBaseURL); err != nil {
+			errs = append(errs, fmt.Errorf("DIFYGATE_TWILIO_API_BASE_URL: %w", err))
+		}
+		if c.Twilio.SyncReplyTimeout <= 0 || c.Twilio.SyncReplyTimeout >= 15*time.Second {
+			errs = append(errs, errors.New("DIFYGATE_TWILIO_SYNC_REPLY_TIMEOUT must be positive and under 15s"))
+		}
+		if c.Twilio.MaxSegments < 1 {
+			errs = append(errs, errors.New("DIFYGATE_SMS_MAX_SEGMENTS must be at least 1"))
+		}
+	}
+	if f.Discord && c.Discord.PublicKey != "" {
+		if key, err := hex.DecodeString(c.Discord.PublicKey); err != nil || len(key) != ed25519.PublicKeySize {
+			errs = append(errs, errors.New("DIFYGATE_DISCORD_PUBLIC_KEY must be a 64-character hex Ed25519 key"))
+		}
+	}
+	if c.Server.Port < 1 || c.Server.Port > 65535 {
+		errs = append(errs, fmt.Errorf("DIFYGATE_PORT: %d is not a valid port", c.Server.Port))
+	}
+	switch c.Chat.ReplyMode {
+	case ReplyModeFinal, ReplyModeIncremental:
+	default:
+		errs = append(errs, fmt.Errorf("DIFYGATE_REPLY_MODE: %q must be final or incremental", c.Chat.ReplyMode))
+	}
+	if c.Chat.ReplyMinInterval < 0 || c.Chat.ReplyMinChunk < 0 {
+		errs = append(errs, errors.New("DIFYGATE_REPLY_MIN_INTERVAL and DIFYGATE_REPLY_MIN_CHUNK must not be negative"))
+	}
+	if c.Chat.ReplyMaxMessages < 1 {
+		errs = append(errs, errors.New("DIFYGATE_REPLY_MAX_MESSAGES must be at least 1"))
+	}
+	switch c.Chat.Segments {
+	case SegmentsConcatenate, SegmentsSplit:
+	default:
+		errs = append(errs, fmt.Errorf("DIFYGATE_ANSWER_SEGMENTS: %q must be concatenate or split", c.Chat.Segments))
+	}
+	if c.Chat.MaxQueryLength < 0 {
+		errs = append(errs, errors.New("DIFYGATE_MAX_QUERY_LENGTH must not be negative"))
+	}
+	if c.Chat.MaxQueuedMessages < 0 {
+		errs = append(errs, errors.New("DIFYGATE_MAX_QUEUED_MESSAGES must not be negative"))
+	}
+	if c.Chat.Debounce < 0 {
+		errs = append(errs, errors.New("DIFYGATE_MESSAGE_DEBOUNCE must not be negative"))
+	}
+	switch c.Chat.DebounceInFlight {
+	case DebounceQueue, DebounceAppend:
+	default:
+		errs = append(errs, fmt.Errorf("DIFYGATE_MESSAGE_DEBOUNCE_IN_FLIGHT: %q must be queue or append", c.Chat.DebounceInFlight))
+	}
+	if c.Dify.StreamBufferSize < 1 {
+		errs = append(errs, errors.New("DIFYGATE_DIFY_STREAM_BUFFER_SIZE must be at least 1"))
+	}
+	switch c.Dify.StreamBackpressure {
+	case BackpressureBlock, BackpressureDrop:
+	default:
+		errs = append(errs, fmt.Errorf("DIFYGATE_DIFY_STREAM_BACKPRESSURE: %q must be block or drop", c.Dify.StreamBackpressure))
+	}
+	switch c.Dify.UserIDMode {
+	case "", UserIDRaw, UserIDPrefixed:
+	case UserIDHashed:
+		if len(c.Dify.UserIDSalt) < 16 {
+			errs = append(errs, errors.New("DIFYGATE_DIFY_USER_ID_SALT must have at least 16 characters with hashed user IDs"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("DIFYGATE_DIFY_USER_ID_MODE: %q must be raw, hashed or prefixed", c.Dify.UserIDMode))
+	}
+	switch c.EmailIdempotency.InFlight {
+	case IdempotencyConflict, IdempotencyWait:
+	default:
+		if f.Email {
+			errs = append(errs, fmt.Errorf("DIFYGATE_EMAIL_IDEMPOTENCY_IN_FLIGHT: %q must be conflict or wait", c.EmailIdempotency.InFlight))
+		}
+	}
+	if f.Email && (c.EmailAlert.FailureRate < 0 || c.EmailAlert.FailureRate > 1) {
+		errs = append(errs, fmt.Errorf("DIFYGATE_EMAIL_ALERT_FAILURE_RATE must be between 0 and 1, got %v", c.EmailAlert.FailureRate))
+	}
+	if f.Email && c.EmailAlert.FailureRate > 0 {
+		if c.EmailAlert.Window <= 0 {
+			errs = append(errs, errors.New("DIFYGATE_EMAIL_ALERT_WINDOW must be positive"))
+		}
+		if c.EmailAlert.MinSends < 1 {
+			errs = append(errs, errors.New("DIFYGATE_EMAIL_ALERT_MIN_SENDS must be at least 1"))
+		}
+		if c.EmailAlert.WhatsAppTo != "" && c.WhatsApp.GraphAPIToken == "" {
+			errs = append(errs, errors.New("DIFYGATE_EMAIL_ALERT_WHATSAPP_TO needs DIFYGATE_GRAPH_API_TOKEN"))
+		}
+	}
+	if c.SignatureAlert.Threshold < 0 {
+		errs = append(errs, errors.New("DIFYGATE_SIGNATURE_ALERT_THRESHOLD must not be negative"))
+	}
+	if c.SignatureAlert.Threshold > 0 {
+		if c.SignatureAlert.Window <= 0 {
+			errs = append(errs, errors.New("DIFYGATE_SIGNATURE_ALERT_WINDOW must be positive"))
+		}
+		if c.SignatureAlert.Cooldown < 0 {
+			errs = append(errs, errors.New("DIFYGATE_SIGNATURE_ALERT_COOLDOWN must not be negative"))
+		}
+		if len(c.SignatureAlert.NotifyEmail) > 0 && (!f.Email || c.DIFYGATE.Host == "") {
+			errs = append(errs, errors.New("DIFYGATE_SIGNATURE_ALERT_NOTIFY_EMAIL needs the email feature and DIFYGATE_SMTP_HOST"))
+		}
+	}
+	if f.Email && len(c.Digest.Recipients) > 0 {
+		if c.DIFYGATE.Host == "" {
+			errs = append(errs, errors.New("DIFYGATE_DIGEST_RECIPIENTS needs DIFYGATE_SMTP_HOST"))
+		}
+		if _, err := ParseCron(c.Digest.Schedule); err != nil {
+			errs = append(errs, fmt.Errorf("DIFYGATE_DIGEST_SCHEDULE: %w", err))
+		}
+		if _, err := time.LoadLocation(c.Digest.Timezone); err != nil {
+			errs = append(errs, fmt.Errorf("DIFYGATE_DIGEST_TIMEZONE: %w", err))
+		}
+	}
+	if f.WhatsApp && c.Handoff.Enabled {
+		if c.Handoff.TranscriptLength < 0 {
+			errs = append(errs, errors.New("DIFYGATE_HANDOFF_TRANSCRIPT_LENGTH must not be negative"))
+		}
+		if len(c.Handoff.NotifyEmail) > 0 && c.DIFYGATE.Host == "" {
+			errs = append(errs, errors.New("DIFYGATE_HANDOFF_NOTIFY_EMAIL needs DIFYGATE_SMTP_HOST"))
+		}
+		if c.Handoff.NotifyWhatsAppTo != "" && c.WhatsApp.GraphAPIToken == "" {
+			errs = append(errs, errors.New("DIFYGATE_HANDOFF_NOTIFY_WHATSAPP_TO needs DIFYGATE_GRAPH_API_TOKEN"))
+		}
+	}
+	if c.Abuse.Enabled {
+		if c.Abuse.MaxMessages <= 0 || c.Abuse.Window <= 0 || c.Abuse.Strikes <= 0 || c.Abuse.StrikeWindow <= 0 {
+			errs = append(errs, errors.New("DIFYGATE_ABUSE_MAX_MESSAGES, DIFYGATE_ABUSE_WINDOW, DIFYGATE_ABUSE_STRIKES and DIFYGATE_ABUSE_STRIKE_WINDOW must be positive"))
+		}
+		if c.Abuse.MaxIdentical < 0 {
+			errs = append(errs, errors.New("DIFYGATE_ABUSE_MAX_IDENTICAL must not be negative"))
+		}
+		if c.Abuse.MuteDuration <= 0 || c.Abuse.MaxMuteDuration < c.Abuse.MuteDuration || c.Abuse.OffenseMemory <= 0 {
+			errs = append(errs, errors.New("DIFYGATE_ABUSE_MUTE_DURATION and DIFYGATE_ABUSE_OFFENSE_MEMORY must be positive, and DIFYGATE_ABUSE_MAX_MUTE_DURATION at least the mute duration"))
+		}
+	}
+	if c.Transcript.MaxMessages <= 0 || c.Transcript.MaxMessageLength <= 0 {
+		errs = append(errs, errors.New("DIFYGATE_TRANSCRIPT_MAX_MESSAGES and DIFYGATE_TRANSCRIPT_MAX_MESSAGE_LENGTH must be positive"))
+	}
+	if f.WhatsApp && c.Transcript.UserCommand {
+		if !c.History.Enabled || !f.Email || c.DIFYGATE.Host == "" {
+			errs = append(errs, errors.New("DIFYGATE_TRANSCRIPT_USER_COMMAND needs DIFYGATE_HISTORY_ENABLED, the email feature and DIFYGATE_SMTP_HOST"))
+		}
+		if c.Transcript.UserCooldown < 0 {
+			errs = append(errs, errors.New("DIFYGATE_TRANSCRIPT_USER_COOLDOWN must not be negative"))
+		}
+	}
+	if f.WhatsApp {
+		if c.Broadcast.Rate <= 0 || c.Broadcast.MaxRate < c.Broadcast.Rate {
+			errs = append(errs, errors.New("DIFYGATE_BROADCAST_RATE must be positive and at most DIFYGATE_BROADCAST_MAX_RATE"))
+		}
+		if c.Broadcast.MaxRecipients <= 0 || c.Broadcast.Retention <= 0 {
+			errs = append(errs, errors.New("DIFYGATE_BROADCAST_MAX_RECIPIENTS and DIFYGATE_BROADCAST_RETENTION must be positive"))
+		}
+		if c.Schedule.Interval <= 0 || c.Schedule.MaxAhead <= 0 || c.Schedule.MaxAttempts <= 0 || c.Schedule.Retention <= 0 {
+			errs = append(errs, errors.New("DIFYGATE_SCHEDULE_INTERVAL, DIFYGATE_SCHEDULE_MAX_AHEAD, DIFYGATE_SCHEDULE_MAX_ATTEMPTS and DIFYGATE_SCHEDULE_RETENTION must be positive"))
+		}
+	}
+	if c.AnswerCache.Enabled && (c.AnswerCache.TTL <= 0 || c.AnswerCache.MaxEntries <= 0) {
+		errs = append(errs, errors.New("DIFYGATE_ANSWER_CACHE_TTL and DIFYGATE_ANSWER_CACHE_MAX_ENTRIES must be positive"))
+	}
+	if c.Cost.Enabled {
+		if c.Cost.PromptPrice < 0 || c.Cost.CompletionPrice < 0 || c.Cost.DailyBudget < 0 {
+			errs = append(errs, errors.New("DIFYGATE_COST_PROMPT_PRICE, DIFYGATE_COST_COMPLETION_PRICE and DIFYGATE_COST_DAILY_BUDGET must not be negative"))
+		}
+		for model, price := range c.Cost.Models {
+			if price.PromptPrice < 0 || price.CompletionPrice < 0 {
+				errs = append(errs, fmt.Errorf("cost.models.%s: prices must not be negative", model))
+			}
+		}
+		if _, err := time.LoadLocation(c.Cost.Timezone); err != nil {
+			errs = append(errs, fmt.Errorf("DIFYGATE_COST_TIMEZONE: %w", err))
+		}
+		if c.Cost.Retention <= 0 {
+			errs = append(errs, errors.New("DIFYGATE_COST_RETENTION must be positive"))
+		}
+	}
+	if f.ChatAPI {
+		if c.ChatJobs.TTL <= 0 || c.ChatJobs.MaxConcurrent <= 0 {
+			errs = append(errs, errors.New("DIFYGATE_CHAT_JOBS_TTL and DIFYGATE_CHAT_JOBS_MAX_CONCURRENT must be positive"))
+		}
+		if c.ChatJobs.MaxQueued < c.ChatJobs.MaxConcurrent {
+			errs = append(errs, errors.New("DIFYGATE_CHAT_JOBS_MAX_QUEUED must be at least DIFYGATE_CHAT_JOBS_MAX_CONCURRENT"))
+		}
+	}
+	switch c.Chat.QueryLengthMode {
+	case QueryLengthTruncate, QueryLengthReject:
+	default:
+		errs = append(errs, fmt.Errorf("DIFYGATE_QUERY_LENGTH_MODE: %q must be truncate or reject", c.Chat.QueryLengthMode))
+	}
+	for _, pattern := range c.Chat.Hooks.StripPatterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			errs = append(errs, fmt.Errorf("DIFYGATE_STRIP_PATTERNS: %w", err))
+		}
+	}
+	for _, k := range c.Store.EncryptionKeys {
+		if key, err := base64.StdEncoding.DecodeString(k); err != nil || len(key) != 32 {
+			errs = append(errs, errors.New("DIFYGATE_STORE_ENCRYPTION_KEY must be a comma-separated list of 32-byte keys, base64 encoded"))
+			break
+		}
+	}
+	if c.History.Enabled {
+		if c.History.Retention <= 0 || c.History.PruneInterval <= 0 {
+			errs = append(errs, errors.New("DIFYGATE_HISTORY_RETENTION and DIFYGATE_HISTORY_PRUNE_INTERVAL must be positive"))
+		}
+		for _, k := range c.History.EncryptionKeys {
+			if key, err := base64.StdEncoding.DecodeString(k); err != nil || len(key) != 32 {
+				errs = append(errs, errors.New("DIFYGATE_HISTORY_ENCRYPTION_KEY must be a comma-separated list of 32-byte keys, base64 encoded"))
+				break
+			}
+		}
+	}
+	if c.HTTPClient.MaxIdleConnsPerHost < 1 {
+		errs = append(errs, errors.New("DIFYGATE_HTTP_MAX_IDLE_CONNS_PER_HOST must be at least 1"))
+	}
+	for name, proxy := range map[string]string{
+		"DIFYGATE_OUTBOUND_PROXY":          c.HTTPClient.OutboundProxy,
+		"DIFYGATE_OUTBOUND_PROXY_DIFY":     c.HTTPClient.OutboundProxyDify,
+		"DIFYGATE_OUTBOUND_PROXY_META":     c.HTTPClient.OutboundProxyMeta,
+		"DIFYGATE_OUTBOUND_PROXY_WEBHOOKS": c.HTTPClient.OutboundProxyWebhooks,
+	} {
+		if err := validateProxy(proxy); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+	for name, d := range map[string]time.Duration{
+		"DIFYGATE_HTTP_DIAL_TIMEOUT":             c.HTTPClient.DialTimeout,
+		"DIFYGATE_HTTP_TLS_HANDSHAKE_TIMEOUT":    c.HTTPClient.TLSHandshakeTimeout,
+		"DIFYGATE_HTTP_IDLE_CONN_TIMEOUT":        c.HTTPClient.IdleConnTimeout,
+		"DIFYGATE_HTTP_RESPONSE_HEADER_TIMEOUT":  c.HTTPClient.ResponseHeaderTimeout,
+		"DIFYGATE_WHATSAPP_READ_RECEIPT_TIMEOUT": c.WhatsApp.ReadReceiptTimeout,
+	} {
+		if d <= 0 {
+			errs = append(errs, fmt.Errorf("%s must be positive", name))
+		}
+	}
+	switch c.Server.GinMode {
+	case "debug", "release", "test":
+	default:
+		errs = append(errs, fmt.Errorf("DIFYGATE_GIN_MODE: %q must be debug, release or test", c.Server.GinMode))
+	}
+	if c.Debug.Port < 0 || c.Debug.Port > 65535 {
+		errs = append(errs, fmt.Errorf("DIFYGATE_PPROF_PORT: %d is not a valid port", c.Debug.Port))
+	} else if c.Debug.Port != 0 && c.Debug.Port == c.Server.Port {
+		errs = append(errs, errors.New("DIFYGATE_PPROF_PORT must differ from DIFYGATE_PORT"))
+	}
+	for name, d := range map[string]time.Duration{
+		"DIFYGATE_READ_HEADER_TIMEOUT":                 c.Server.ReadHeaderTimeout,
+		"DIFYGATE_READ_TIMEOUT":                        c.Server.ReadTimeout,
+		"DIFYGATE_WRITE_TIMEOUT":                       c.Server.WriteTimeout,
+		"DIFYGATE_IDLE_TIMEOUT":                        c.Server.IdleTimeout,
+		"DIFYGATE_WHATSAPP_UNSUPPORTED_REPLY_INTERVAL": c.WhatsApp.UnsupportedReplyInterval,
+		"DIFYGATE_WHATSAPP_STATUS_RETENTION":           c.WhatsApp.StatusRetention,
+		"DIFYGATE_SEND_RETRY_WINDOW":                   c.Chat.SendRetryWindow,
+		"DIFYGATE_ACK_DELAY":                           c.Chat.AckDelay,
+		"DIFYGATE_EMAIL_IDEMPOTENCY_TTL":               c.EmailIdempotency.TTL,
+		"DIFYGATE_EMAIL_ALERT_COOLDOWN":                c.EmailAlert.Cooldown,
+		"DIFYGATE_MOCK_DELAY":                          c.Mock.Delay,
+		"DIFYGATE_MOCK_CHUNK_DELAY":                    c.Mock.ChunkDelay,
+		"DIFYGATE_DIFY_BREAKER_COOLDOWN":               c.Dify.BreakerCooldown,
+		"DIFYGATE_DIFY_STREAM_MAX_AGE":                 c.Dify.StreamMaxAge,
+	} {
+		if d < 0 {
+			errs = append(errs, fmt.Errorf("%s must not be negative", name))
+		}
+	}
+	for name, n := range map[string]int{
+		"DIFYGATE_MAX_BODY_BYTES":         c.Server.MaxBodyBytes,
+		"DIFYGATE_WEBHOOK_MAX_BODY_BYTES": c.Server.WebhookMaxBodyBytes,
+		"DIFYGATE_EMAIL_MAX_BODY_BYTES":   c.Server.EmailMaxBodyBytes,
+		"DIFYGATE_MEDIA_MAX_BODY_BYTES":   c.Server.MediaMaxBodyBytes,
+	} {
+		if n <= 0 {
+			errs = append(errs, fmt.Errorf("%s must be positive", name))
+		}
+	}
+	if err := c.Auth.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := validateHooks(c.Hooks, c.WhatsApp); f.Hooks && err != nil {
+		errs = append(errs, err)
+	}
+	if err := validateCannedResponses(c.Chat.CannedResponses); err != nil {
+		errs = append(errs, err)
+	}
+	if err := validateMessages(c.Messages); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.Webhooks.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if c.Log.AccessSampleRate < 0 || c.Log.AccessSampleRate > 1 {
+		errs = append(errs, fmt.Errorf("DIFYGATE_ACCESS_LOG_SAMPLE_RATE must be between 0 and 1, got %v", c.Log.AccessSampleRate))
+	}
+	if c.Sentry.DSN != "" {
+		if u, err := url.Parse(c.Sentry.DSN); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.User == nil ||
+			u.Host == "" || strings.Trim(u.Path, "/") == "" {
+			errs = append(errs, errors.New("DIFYGATE_SENTRY_DSN must be a DSN such as https://<key>@o0.ingest.sentry.io/<project>"))
+		}
+		if c.Sentry.SignatureBurst <= 0 || c.Sentry.SignatureWindow <= 0 {
+			errs = append(errs, errors.New("DIFYGATE_SENTRY_SIGNATURE_BURST and DIFYGATE_SENTRY_SIGNATURE_WINDOW must be positive"))
+		}
+	}
+	if err := validateTokenBucket(c.APIRateLimit.Rate, c.APIRateLimit.Burst); err != nil {
+		errs = append(errs, fmt.Errorf("DIFYGATE_API_RATE_LIMIT: %w", err))
+	}
+	for name, o := range c.APIRateLimit.Overrides {
+		if err := validateTokenBucket(o.Rate, o.Burst); err != nil {
+			errs = append(errs, fmt.Errorf("api_rate_limit override %q: %w", name, err))
+		}
+	}
+	if c.Server.ExternalURL != "" {
+		if err := validateURL(c.Server.ExternalURL); err != nil {
+			errs = append(errs, fmt.Errorf("DIFYGATE_EXTERNAL_URL: %w", err))
+		}
+	}
+	for _, proxy := range c.Server.TrustedProxies {
+		if !validIPOrCIDR(proxy) {
+			errs = append(errs, fmt.Errorf("DIFYGATE_TRUSTED_PROXIES: %q is not an IP address or CIDR", proxy))
+		}
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		errs = append(errs, errors.New("DIFYGATE_TLS_CERT_FILE and DIFYGATE_TLS_KEY_FILE must be set together"))
+	}
+	if c.TLS.CertFile != "" && len(c.TLS.AutocertDomains) > 0 {
+		errs = append(errs, errors.New("static TLS certificates and DIFYGATE_AUTOCERT_DOMAINS are mutually exclusive"))
+	}
+	if !graphAPIVersionPattern.MatchString(c.WhatsApp.APIVersion) {
+		errs = append(errs, fmt.Errorf("DIFYGATE_GRAPH_API_VERSION: %q is not of the form v22.0", c.WhatsApp.APIVersion))
+	}
+	for id := range c.WhatsApp.Inputs {
+		if !c.WhatsApp.ServesPhoneNumber(id) {
+			errs = append(errs, fmt.Errorf("DIFYGATE_WHATSAPP_INPUTS: phone number ID %s is not in DIFYGATE_WHATSAPP_PHONE_NUMBER_IDS", id))
+		}
+	}
+	for id := range c.WhatsApp.MarkReadNumbers {
+		if !c.WhatsApp.ServesPhoneNumber(id) {
+			errs = append(errs, fmt.Errorf("DIFYGATE_WHATSAPP_MARK_READ_NUMBERS: phone number ID %s is not in DIFYGATE_WHATSAPP_PHONE_NUMBER_IDS", id))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// validate checks that every key is usable and that keys and names are unique
+func (a AuthConfig) validate() error {
+	var errs []error
+	names := make(map[string]bool)
+	digests := make(map[[sha256.Size]byte]bool)
+	for i, k := range a.EffectiveKeys() {
+		digest, err := k.Digest()
+		switch {
+		case err != nil:
+			errs = append(errs, fmt.Errorf("API key #%d (%q): %w", i+1, k.Name, err))
+		case digests[digest]:
+			errs = append(errs, fmt.Errorf("API key %q duplicates another key", k.Name))
+		}
+		switch {
+		case k.Name == "":
+			errs = append(errs, fmt.Errorf("API key #%d has no name", i+1))
+		case names[k.Name]:
+			errs = append(errs, fmt.Errorf("API key name %q is used more than once", k.Name))
+		}
+		if len(k.Scopes) == 0 {
+			errs = append(errs, fmt.Errorf("API key %q has no scopes", k.Name))
+		}
+		names[k.Name] = true
+		digests[digest] = true
+	}
+
+	sources := 0
+	for _, set := range []bool{a.JWT.JWKSURL != "", a.JWT.HMACSecret != "", a.JWT.RSAPublicKeyFile != ""} {
+		if set {
+			sources++
+		}
+	}
+	if sources > 1 {
+		errs = append(errs, errors.New("only one of DIFYGATE_JWT_JWKS_URL, DIFYGATE_JWT_HMAC_SECRET and DIFYGATE_JWT_RSA_PUBLIC_KEY_FILE may be set"))
+	}
+	if a.JWT.JWKSURL != "" {
+		if err := validateURL(a.JWT.JWKSURL); err != nil {
+			errs = append(errs, fmt.Errorf("DIFYGATE_JWT_JWKS_URL: %w", err))
+		}
+	}
+	if a.JWT.RSAPublicKeyFile != "" {
+		if _, err := LoadRSAPublicKey(a.JWT.RSAPublicKeyFile); err != nil {
+			errs = append(errs, fmt.Errorf("DIFYGATE_JWT_RSA_PUBLIC_KEY_FILE: %w", err))
+		}
+	}
+	if a.JWT.Enabled() && a.JWT.IdentityClaim == "" {
+		errs = append(errs, errors.New("DIFYGATE_JWT_IDENTITY_CLAIM must not be empty"))
+	}
+	for name, cidrs := range map[string][]string{
+		"DIFYGATE_EMAIL_ALLOWED_CIDRS": a.EmailAllowedCIDRs,
+		"DIFYGATE_ADMIN_ALLOWED_CIDRS": a.AdminAllowedCIDRs,
+	} {
+		for _, cidr := range cidrs {
+			if !validIPOrCIDR(cidr) {
+				errs = append(errs, fmt.Errorf("%s: %q is not an IP address or CIDR", name, cidr))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// validateTokenBucket checks a rate and burst pair
+func validateTokenBucket(rate float64, burst int) error {
+	if rate < 0 {
+		return errors.New("rate must not be negative")
+	}
+	if rate > 0 && burst < 1 {
+		return errors.New("burst must be at least 1")
+	}
+	return nil
+}
+
+// validIPOrCIDR reports whether s is an IP address or a CIDR range
+func validIPOrCIDR(s string) bool {
+	if _, _, err := net.ParseCIDR(s); err == nil {
+		return true
+	}
+	return net.ParseIP(s) != nil
+}
+
+// Addr returns the host:port the server listens on
+func (s ServerConfig) Addr() string {
+	return net.JoinHostPort(s.BindAddr, strconv.Itoa(s.Port))
+}
+
+// Addr returns the host:port of the separate debug listener
+func (d DebugConfig) Addr() string {
+	return net.JoinHostPort(d.BindAddr, strconv.Itoa(d.Port))
+}
+
+// CriticalProblems describes missing settings without which the gateway
+// can't serve its main message path, for the enabled features
+func (c *Config) CriticalProblems() []string {
+	var problems []string
+	if c.Features.Dify() && c.Dify.APIKey == "" {
+		problems = append(problems, "DIFYGATE_DIFY_API_KEY is not set")
+	}
+	if (c.Features.WhatsApp || c.Features.Messenger) && c.WhatsApp.AppSecret == "" && !c.WhatsApp.SkipSignatureVerify {
+		problems = append(problems, "DIFYGATE_WHATSAPP_APP_SECRET is not set")
+	}
+	return problems
+}
+
+func validateURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("%q is not an absolute http(s) URL", raw)
+	}
+	return nil
+}
+
+// validateProxy checks an outbound proxy setting without repeating it, as
+// it may hold credentials
+func validateProxy(raw string) error {
+	if raw == "" || raw == ProxyDirect {
+		return nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return errors.New("is not a URL")
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return errors.New("must be an http, https or socks5 URL, or direct")
+	}
+	if u.Host == "" {
+		return errors.New("has no host")
+	}
+	return nil
+}
+
+// defaultLogLevel keeps the legacy DIFYGATE_DEBUG switch working
+func defaultLogLevel() string {
+	if os.Getenv("DIFYGATE_DEBUG") == "true" {
+		return "debug"
+	}
+	return "info"
+}
+
+// defaultGinMode honors Gin's own GIN_MODE, otherwise release
+func defaultGinMode() string {
+	if mode := os.Getenv("GIN_MODE"); mode != "" {
+		return mode
+	}
+	return "release"
+}
+
+// ConfigureLogger applies the configured level and format to log. Invalid
+// values leave the corresponding setting unchanged and are reported.
+func ConfigureLogger(log *logrus.Logger, cfg LogConfig) error {
+	switch strings.ToLower(cfg.Format) {
+	case "json", "":
+		log.SetFormatter(&logrus.JSONFormatter{})
+	case "text":
+		log.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
+	default:
+		return fmt.Errorf("invalid log format %q, expected json or text", cfg.Format)
+	}
+
+	level, err := logrus.ParseLevel(cfg.Level)
+	if err != nil {
+		return fmt.Errorf("invalid log level %q: %w", cfg.Level, err)
+	}
+	log.SetLevel(level)
+	return nil
 }
 
 // Helper functions to extract environment variables
@@ -39,6 +2029,41 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
+// getSecretEnv reads a secret from the file named by key_FILE (e.g. a
+// Docker or Kubernetes secret mount) with trailing newlines trimmed, or
+// from key. The file takes precedence when both are set, so a value left
+// in the environment can't shadow the mounted secret.
+func getSecretEnv(key, defaultValue string) (string, error) {
+	if path, exists := os.LookupEnv(key + "_FILE"); exists {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("%s_FILE: %w", key, err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	return getEnv(key, defaultValue), nil
+}
+
+// getEnvAsList reads a comma-separated list, dropping empty items
+func getEnvAsList(key string, defaultValue []string) []string {
+	valueStr, exists := os.LookupEnv(key)
+	if !exists {
+		return defaultValue
+	}
+	return splitList(valueStr)
+}
+
+// splitList splits a comma-separated list, dropping empty items
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
 func getEnvAsInt(key string, defaultValue int) int {
 	valueStr := getEnv(key, "")
 	if value, err := strconv.Atoi(valueStr); err == nil {
@@ -46,3 +2071,27 @@ func getEnvAsInt(key string, defaultValue int) int {
 	}
 	return defaultValue
 }
+
+func getEnvAsBool(key string, defaultValue bool) bool {
+	valueStr := getEnv(key, "")
+	if value, err := strconv.ParseBool(valueStr); err == nil {
+		return value
+	}
+	return defaultValue
+}
+
+func getEnvAsFloat(key string, defaultValue float64) float64 {
+	valueStr := getEnv(key, "")
+	if value, err := strconv.ParseFloat(valueStr, 64); err == nil {
+		return value
+	}
+	return defaultValue
+}
+
+func getEnvAsDuration(key string, defaultValue time.Duration) time.Duration {
+	valueStr := getEnv(key, "")
+	if value, err := time.ParseDuration(valueStr); err == nil {
+		return value
+	}
+	return defaultValue
+}
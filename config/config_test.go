@@ -0,0 +1,162 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeFile writes content to name in a temporary directory and returns
+// its path
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+	}{
+		{"YAML", "difygate.yaml", `
+server:
+  port: 7001
+  trusted_proxies: [10.0.0.0/8]
+dify:
+  base_url: https://dify.example.com/v1
+  stream_timeout: 90s
+`},
+		{"JSON", "difygate.json", `{
+  "server": {"port": 7001, "trusted_proxies": ["10.0.0.0/8"]},
+  "dify": {"base_url": "https://dify.example.com/v1", "stream_timeout": "90s"}
+}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("DIFYGATE_CONFIG_FILE", writeFile(t, tt.file, tt.content))
+			cfg, err := Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Server.Port != 7001 || cfg.Dify.BaseURL != "https://dify.example.com/v1" || cfg.Dify.StreamTimeout != 90*time.Second ||
+				len(cfg.Server.TrustedProxies) != 1 || cfg.Server.TrustedProxies[0] != "10.0.0.0/8" {
+				t.Errorf("loaded server %+v, dify %+v", cfg.Server, cfg.Dify)
+			}
+			// What the file leaves out keeps its default
+			if cfg.DIFYGATE.Port != 587 {
+				t.Errorf("SMTP port %d, want the default 587", cfg.DIFYGATE.Port)
+			}
+		})
+	}
+}
+
+func TestEnvironmentOverridesConfigFile(t *testing.T) {
+	t.Setenv("DIFYGATE_CONFIG_FILE", writeFile(t, "difygate.yaml", `
+server:
+  port: 7001
+dify:
+  base_url: https://dify.example.com/v1
+`))
+	t.Setenv("DIFYGATE_PORT", "8001")
+	cfg, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Server.Port != 8001 {
+		t.Errorf("port %d, want 8001 from the environment", cfg.Server.Port)
+	}
+	// Variables that aren't set leave the file alone
+	if cfg.Dify.BaseURL != "https://dify.example.com/v1" {
+		t.Errorf("Dify base URL %q, want the file's", cfg.Dify.BaseURL)
+	}
+}
+
+func TestConfigFileErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		// want are parts of the error
+		want []string
+	}{
+		{"unknown key", "difygate.yaml", "server:\n  port: 7001\n  prot: 7002\n", []string{"line 3", "prot", "not found"}},
+		{"wrong type", "difygate.yaml", "server:\n  port: 7001\ndify:\n  stream_timeout: soon\n", []string{"line 4", "soon"}},
+		{"bad YAML", "difygate.yaml", "server:\n  port: [7001\n", []string{"line"}},
+		{"unknown JSON key", "difygate.json", "{\n  \"server\": {\n    \"prot\": 7002\n  }\n}\n", []string{"line 3", "prot"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeFile(t, tt.file, tt.content)
+			t.Setenv("DIFYGATE_CONFIG_FILE", path)
+			_, err := Load()
+			if err == nil {
+				t.Fatal("loaded without an error")
+			}
+			for _, want := range append(tt.want, path) {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q doesn't mention %q", err, want)
+				}
+			}
+		})
+	}
+
+	t.Setenv("DIFYGATE_CONFIG_FILE", filepath.Join(t.TempDir(), "missing.yaml"))
+	if _, err := Load(); err == nil || !strings.Contains(err.Error(), "failed to read config file") {
+		t.Errorf("missing file: %v", err)
+	}
+}
+
+func TestSecretFiles(t *testing.T) {
+	t.Run("file beats the variable", func(t *testing.T) {
+		t.Setenv("DIFYGATE_DIFY_API_KEY", "from-env")
+		t.Setenv("DIFYGATE_DIFY_API_KEY_FILE", writeFile(t, "dify_key", "from-file"))
+		cfg, err := Load()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.Dify.APIKey != "from-file" {
+			t.Errorf("Dify API key %q, want the file's", cfg.Dify.APIKey)
+		}
+	})
+
+	t.Run("trailing newlines trimmed", func(t *testing.T) {
+		t.Setenv("DIFYGATE_SMTP_PASSWORD_FILE", writeFile(t, "smtp_password", "pass word \r\n\n"))
+		cfg, err := Load()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Only newlines; the rest may be part of the secret
+		if cfg.DIFYGATE.Password != "pass word " {
+			t.Errorf("SMTP password %q", cfg.DIFYGATE.Password)
+		}
+	})
+
+	t.Run("file overrides the config file", func(t *testing.T) {
+		t.Setenv("DIFYGATE_CONFIG_FILE", writeFile(t, "difygate.yaml", "auth:\n  api_key: from-config\n"))
+		t.Setenv("DIFYGATE_API_KEY_FILE", writeFile(t, "api_key", "from-file\n"))
+		cfg, err := Load()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.Auth.APIKey != "from-file" {
+			t.Errorf("API key %q, want the file's", cfg.Auth.APIKey)
+		}
+	})
+
+	t.Run("unreadable file", func(t *testing.T) {
+		missing := filepath.Join(t.TempDir(), "missing")
+		t.Setenv("DIFYGATE_GRAPH_API_TOKEN", "from-env")
+		t.Setenv("DIFYGATE_GRAPH_API_TOKEN_FILE", missing)
+		_, err := Load()
+		if err == nil || !strings.Contains(err.Error(), "DIFYGATE_GRAPH_API_TOKEN_FILE") || !strings.Contains(err.Error(), missing) {
+			t.Errorf("error %v, want it to name the variable and the file", err)
+		}
+	})
+}
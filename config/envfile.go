@@ -0,0 +1,50 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/joho/godotenv"
+)
+
+// envFileVars are the variables set from the env file rather than by the
+// process environment. Loading again updates them from the file, while
+// variables from the process environment keep winning, as at startup.
+var envFileVars = struct {
+	sync.Mutex
+	keys map[string]bool
+}{keys: make(map[string]bool)}
+
+// loadEnvFile sets the variables in envFile, or in .env when envFile is
+// empty and .env exists
+func loadEnvFile(envFile string) error {
+	path := envFile
+	if path == "" {
+		path = ".env"
+	}
+	vars, err := godotenv.Read(path)
+	if err != nil {
+		if envFile != "" {
+			return fmt.Errorf("failed to load env file %s: %w", envFile, err)
+		}
+		vars = nil
+	}
+
+	envFileVars.Lock()
+	defer envFileVars.Unlock()
+	for key := range envFileVars.keys {
+		if _, ok := vars[key]; !ok {
+			os.Unsetenv(key)
+			delete(envFileVars.keys, key)
+		}
+	}
+	for key, value := range vars {
+		if _, set := os.LookupEnv(key); set && !envFileVars.keys[key] {
+			continue
+		}
+		os.Setenv(key, value)
+		envFileVars.keys[key] = true
+	}
+	return nil
+}
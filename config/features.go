@@ -0,0 +1,123 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Feature names, as listed in DIFYGATE_FEATURES
+const (
+	FeatureWhatsApp  = "whatsapp"
+	FeatureMessenger = "messenger"
+	FeatureSMS       = "sms"
+	FeatureSlack     = "slack"
+	FeatureDiscord   = "discord"
+	FeatureEmail     = "email"
+	FeatureHooks     = "hooks"
+	FeatureChatAPI   = "chat_api"
+	FeatureAdmin     = "admin"
+)
+
+// FeaturesConfig turns parts of the gateway on and off, so an instance can
+// serve only some of them. A disabled feature's routes aren't registered,
+// its background work isn't started and its settings aren't checked.
+// Everything is enabled by default.
+type FeaturesConfig struct {
+	// WhatsApp is the webhook, proactive and scheduled messages,
+	// broadcasts and the WhatsApp admin endpoints
+	WhatsApp  bool `yaml:"whatsapp"`
+	Messenger bool `yaml:"messenger"`
+	SMS       bool `yaml:"sms"`
+	Slack     bool `yaml:"slack"`
+	Discord   bool `yaml:"discord"`
+	// Email is sending email and its suppression list
+	Email bool `yaml:"email"`
+	Hooks bool `yaml:"hooks"`
+	// ChatAPI is the chat jobs API
+	ChatAPI bool `yaml:"chat_api"`
+	// Admin is every endpoint needing the admin scope, and the dashboard
+	Admin bool `yaml:"admin"`
+}
+
+// flags returns the features by name, in the order they are listed
+func (f *FeaturesConfig) flags() []struct {
+	name    string
+	enabled *bool
+} {
+	return []struct {
+		name    string
+		enabled *bool
+	}{
+		{FeatureWhatsApp, &f.WhatsApp},
+		{FeatureMessenger, &f.Messenger},
+		{FeatureSMS, &f.SMS},
+		{FeatureSlack, &f.Slack},
+		{FeatureDiscord, &f.Discord},
+		{FeatureEmail, &f.Email},
+		{FeatureHooks, &f.Hooks},
+		{FeatureChatAPI, &f.ChatAPI},
+		{FeatureAdmin, &f.Admin},
+	}
+}
+
+// allFeatures has every feature enabled
+func allFeatures() FeaturesConfig {
+	var f FeaturesConfig
+	for _, flag := range f.flags() {
+		*flag.enabled = true
+	}
+	return f
+}
+
+// Enabled lists the names of the enabled features
+func (f FeaturesConfig) Enabled() []string {
+	names := []string{}
+	for _, flag := range f.flags() {
+		if *flag.enabled {
+			names = append(names, flag.name)
+		}
+	}
+	return names
+}
+
+// All reports whether every feature is enabled
+func (f FeaturesConfig) All() bool {
+	return len(f.Enabled()) == len(f.flags())
+}
+
+// Dify reports whether an enabled feature asks Dify
+func (f FeaturesConfig) Dify() bool {
+	return f.WhatsApp || f.Messenger || f.SMS || f.Slack || f.Discord || f.Hooks || f.ChatAPI
+}
+
+// applyEnv enables exactly the features listed in DIFYGATE_FEATURES, when
+// set, then applies the DIFYGATE_FEATURE_<NAME> switches on top
+func (f *FeaturesConfig) applyEnv() error {
+	flags := f.flags()
+	if list, ok := os.LookupEnv("DIFYGATE_FEATURES"); ok {
+		enabled := make(map[string]bool)
+		for _, name := range splitList(list) {
+			enabled[strings.ToLower(name)] = true
+		}
+		known := make([]string, 0, len(flags))
+		for _, flag := range flags {
+			*flag.enabled = enabled[flag.name]
+			delete(enabled, flag.name)
+			known = append(known, flag.name)
+		}
+		if len(enabled) > 0 {
+			unknown := make([]string, 0, len(enabled))
+			for name := range enabled {
+				unknown = append(unknown, name)
+			}
+			sort.Strings(unknown)
+			return fmt.Errorf("DIFYGATE_FEATURES: unknown features %s, expected some of %s", strings.Join(unknown, ", "), strings.Join(known, ", "))
+		}
+	}
+	for _, flag := range flags {
+		*flag.enabled = getEnvAsBool("DIFYGATE_FEATURE_"+strings.ToUpper(flag.name), *flag.enabled)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"text/template"
+)
+
+// Hook delivery targets
+const (
+	HookDeliverLog      = "log"
+	HookDeliverEmail    = "email"
+	HookDeliverWhatsApp = "whatsapp"
+)
+
+// hookNamePattern keeps hook names usable as a URL path segment
+var hookNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// HookTemplateFuncs are available in hook query templates
+var HookTemplateFuncs = template.FuncMap{
+	// json renders a value, e.g. a nested object, as JSON
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// HookConfig defines a named inbound webhook at /api/v1/hooks/<name> whose
+// posted JSON is turned into a Dify query
+type HookConfig struct {
+	Name string `yaml:"name" json:"name"`
+	// Query is a Go text/template executed with the posted JSON as data,
+	// e.g. "Summarize this alert: {{.alert.title}} ({{.alert.severity}})"
+	Query string `yaml:"query" json:"query"`
+	// User is the Dify user for every query, default "hook:<name>"
+	User string `yaml:"user" json:"user"`
+	// Inputs are passed unchanged as the Dify app's inputs
+	Inputs map[string]interface{} `yaml:"inputs" json:"inputs"`
+	// Secret, when set, requires X-Hook-Signature: sha256=<hex HMAC of the body>
+	Secret string `yaml:"secret" json:"secret" secret:"true"`
+	// Deliver says where the answer goes besides the HTTP response
+	Deliver HookDeliveryConfig `yaml:"deliver" json:"deliver"`
+}
+
+// HookDeliveryConfig routes a hook's answer to a log line, an email or a
+// WhatsApp message
+type HookDeliveryConfig struct {
+	// Type is log (default), email or whatsapp
+	Type string `yaml:"type" json:"type"`
+	// To lists email addresses or WhatsApp numbers
+	To []string `yaml:"to" json:"to"`
+	// Subject is the email subject, default "DifyGate hook: <name>"
+	Subject string `yaml:"subject" json:"subject"`
+	// PhoneNumberID sends WhatsApp messages from this business number,
+	// default DIFYGATE_WHATSAPP_PHONE_NUMBER_ID
+	PhoneNumberID string `yaml:"phone_number_id" json:"phone_number_id"`
+}
+
+// validateHooks checks names, templates and delivery targets
+func validateHooks(hooks []HookConfig, wa WhatsAppConfig) error {
+	var errs []error
+	names := make(map[string]bool)
+	for i, h := range hooks {
+		switch {
+		case !hookNamePattern.MatchString(h.Name):
+			errs = append(errs, fmt.Errorf("hook #%d: name %q must be lowercase letters, digits, - or _", i+1, h.Name))
+		case names[h.Name]:
+			errs = append(errs, fmt.Errorf("hook name %q is used more than once", h.Name))
+		}
+		names[h.Name] = true
+
+		if h.Query == "" {
+			errs = append(errs, fmt.Errorf("hook %q has no query template", h.Name))
+		} else if _, err := template.New(h.Name).Funcs(HookTemplateFuncs).Parse(h.Query); err != nil {
+			errs = append(errs, fmt.Errorf("hook %q: %w", h.Name, err))
+		}
+
+		switch h.Deliver.Type {
+		case "", HookDeliverLog:
+		case HookDeliverEmail:
+			if len(h.Deliver.To) == 0 {
+				errs = append(errs, fmt.Errorf("hook %q delivers by email but has no recipients", h.Name))
+			}
+		case HookDeliverWhatsApp:
+			if len(h.Deliver.To) == 0 {
+				errs = append(errs, fmt.Errorf("hook %q delivers by WhatsApp but has no recipients", h.Name))
+			}
+			if h.Deliver.PhoneNumberID == "" && wa.PhoneNumberID == "" {
+				errs = append(errs, fmt.Errorf("hook %q delivers by WhatsApp but no phone_number_id or DIFYGATE_WHATSAPP_PHONE_NUMBER_ID is set", h.Name))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("hook %q: unknown delivery type %q", h.Name, h.Deliver.Type))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,190 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Keys of the user-facing messages
+const (
+	// MsgError, MsgTimeout, MsgHighDemand and MsgUnavailable may quote the error reference
+	// as {ref}
+	MsgError   = "error"
+	MsgTimeout = "timeout"
+	// MsgHighDemand is sent while Dify is over its quota or rate limit
+	MsgHighDemand = "high_demand"
+	// MsgUnavailable is sent when the Dify app or its model can't answer
+	MsgUnavailable = "unavailable"
+	// MsgContentBlocked is sent when moderation blocked the question or
+	// the answer
+	MsgContentBlocked = "content_blocked"
+
+	// MsgAck reassures a user whose answer is slow; each line is a variant,
+	// sent in turn
+	MsgAck = "ack"
+	// MsgAnswerReplaced comes before an answer moderation rewrote after
+	// part of it was sent
+	MsgAnswerReplaced = "answer_replaced"
+
+	MsgConversationReset = "conversation_reset"
+	MsgHelp              = "help"
+	MsgAnswerTruncated   = "answer_truncated"
+	// MsgQueryTooLong may quote the length limit as {max}
+	MsgQueryTooLong = "query_too_long"
+	// MsgUnsupportedMessage may list the supported message types as {types}
+	MsgUnsupportedMessage = "unsupported_message"
+	// MsgLanguageSet quotes the language picked with /lang as {lang}
+	MsgLanguageSet     = "language_set"
+	MsgLanguageAuto    = "language_auto"
+	MsgLanguageInvalid = "language_invalid"
+	// MsgBusy is sent when too many messages wait for an answer
+	MsgBusy = "busy"
+	// MsgHandoff acknowledges a request for a person, and MsgBotResumed
+	// tells the user the bot answers again
+	MsgHandoff    = "handoff"
+	MsgBotResumed = "bot_resumed"
+	// MsgOptedOut and MsgOptedIn confirm a WhatsApp user stopped or
+	// resumed broadcasts
+	MsgOptedOut = "opted_out"
+	MsgOptedIn  = "opted_in"
+	// MsgMuted tells a user who sent too much that they are ignored for
+	// a while
+	MsgMuted = "muted"
+	// MsgDailyLimit tells a user over their daily budget to come back
+	// tomorrow
+	MsgDailyLimit = "daily_limit"
+	// MsgTranscriptSent quotes the address a transcript was emailed to as
+	// {email}; MsgTranscriptInvalid asks for one and MsgTranscriptWait
+	// refuses another transcript so soon
+	MsgTranscriptSent    = "transcript_sent"
+	MsgTranscriptInvalid = "transcript_invalid"
+	MsgTranscriptWait    = "transcript_wait"
+
+	MsgDiscordUnknownCommand  = "discord_unknown_command"
+	MsgDiscordUnsupported     = "discord_unsupported"
+	MsgDiscordMissingQuestion = "discord_missing_question"
+)
+
+// DefaultLocale is the locale of the built-in messages
+const DefaultLocale = "en"
+
+// DefaultMessages is the built-in English catalog; every key must be here
+var DefaultMessages = map[string]string{
+	MsgError:                  "Sorry, I couldn't get an answer right now. Please try again later. (Reference: {ref})",
+	MsgTimeout:                "Sorry, the response took too long. Please try again later. (Reference: {ref})",
+	MsgHighDemand:             "I'm getting a lot of questions right now. Please try again in a few minutes. (Reference: {ref})",
+	MsgUnavailable:            "The assistant is unavailable right now. Please try again later. (Reference: {ref})",
+	MsgContentBlocked:         "Sorry, I can't help with that request.",
+	MsgAck:                    "I'm working on your answer, it'll be with you shortly.\nStill on it, thanks for your patience.\nThis one needs a little longer, your answer is on its way.",
+	MsgAnswerReplaced:         "Please disregard my previous message, it has been corrected:",
+	MsgConversationReset:      "Started a new conversation.",
+	MsgHelp:                   "Send any message to chat. Commands:\n/new or /reset - start a new conversation\n/help - show this help",
+	MsgAnswerTruncated:        "(answer truncated)",
+	MsgQueryTooLong:           "Sorry, your message is too long for me to answer. Please shorten it to {max} characters or fewer and send it again.",
+	MsgUnsupportedMessage:     "Sorry, I can only handle {types} messages right now.",
+	MsgLanguageSet:            "I'll answer in {lang} from now on. Send /lang auto to go back to detecting your language.",
+	MsgLanguageAuto:           "I'll answer in the language you write in.",
+	MsgLanguageInvalid:        "Please give a language code, e.g. /lang de, or /lang auto to detect your language.",
+	MsgBusy:                   "Please wait for my answer to your previous messages before sending another.",
+	MsgHandoff:                "I've asked a member of our team to take over. They'll reply here as soon as they can. Send /bot to go back to the assistant.",
+	MsgBotResumed:             "You're chatting with the assistant again.",
+	MsgOptedOut:               "You won't get our announcements any more. Send START to get them again.",
+	MsgOptedIn:                "You'll get our announcements again. Send STOP to stop them.",
+	MsgMuted:                  "You've been temporarily limited for sending too many messages. Please try again later.",
+	MsgDailyLimit:             "You've reached today's limit for questions. Please come back tomorrow, when it resets.",
+	MsgTranscriptSent:         "I've emailed a transcript of our conversation to {email}.",
+	MsgTranscriptInvalid:      "Please give your email address, e.g. /transcript you@example.com",
+	MsgTranscriptWait:         "I've sent you a transcript recently. Please wait a few minutes before asking for another.",
+	MsgDiscordUnknownCommand:  "Unknown command.",
+	MsgDiscordUnsupported:     "This interaction isn't supported.",
+	MsgDiscordMissingQuestion: "Please include a question, e.g. `/ask question: What are your opening hours?`",
+}
+
+// MessagesConfig customizes and translates what users see
+type MessagesConfig struct {
+	// DefaultLocale is used when the user's language isn't known or has no
+	// translation, e.g. de
+	DefaultLocale string `yaml:"default_locale"`
+	// DetectLanguage picks a translation from the writing system of the
+	// user's message (e.g. Cyrillic, Han, Arabic) or, for longer ones, its
+	// common letter trigrams, when one is configured
+	DetectLanguage bool `yaml:"detect_language"`
+	// Catalog maps a locale to message overrides by key; missing keys fall
+	// back to the default locale, then to the built-in English
+	Catalog map[string]map[string]string `yaml:"catalog"`
+	// Dir holds a file of messages by key per locale, named after it, e.g.
+	// de.yaml or de.json; Catalog entries override the files'
+	Dir string `yaml:"dir"`
+}
+
+// loadDir adds the locales in Dir to Catalog
+func (m *MessagesConfig) loadDir() error {
+	if m.Dir == "" {
+		return nil
+	}
+	entries, err := os.ReadDir(m.Dir)
+	if err != nil {
+		return fmt.Errorf("DIFYGATE_MESSAGES_DIR: %w", err)
+	}
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if entry.IsDir() || (ext != ".yaml" && ext != ".yml" && ext != ".json") {
+			continue
+		}
+		path := filepath.Join(m.Dir, entry.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("DIFYGATE_MESSAGES_DIR: %w", err)
+		}
+		texts := make(map[string]string)
+		if err := yaml.Unmarshal(data, &texts); err != nil {
+			return fmt.Errorf("messages file %s: %w", path, err)
+		}
+		locale := strings.TrimSuffix(entry.Name(), ext)
+		for configured, overrides := range m.Catalog {
+			if strings.EqualFold(configured, locale) {
+				for key, text := range overrides {
+					texts[key] = text
+				}
+				delete(m.Catalog, configured)
+			}
+		}
+		if m.Catalog == nil {
+			m.Catalog = make(map[string]map[string]string)
+		}
+		m.Catalog[strings.ToLower(locale)] = texts
+	}
+	return nil
+}
+
+// validateMessages checks the catalog only uses known keys and that the
+// default locale exists
+func validateMessages(m MessagesConfig) error {
+	var errs []error
+	locales := make([]string, 0, len(m.Catalog))
+	known := make(map[string]bool)
+	for locale := range m.Catalog {
+		locales = append(locales, locale)
+		known[strings.ToLower(locale)] = true
+	}
+	sort.Strings(locales)
+
+	for _, locale := range locales {
+		for key := range m.Catalog[locale] {
+			if _, ok := DefaultMessages[key]; !ok {
+				errs = append(errs, fmt.Errorf("messages: locale %q has unknown message key %q", locale, key))
+			}
+		}
+	}
+
+	if locale := strings.ToLower(m.DefaultLocale); locale != DefaultLocale && !known[locale] {
+		errs = append(errs, fmt.Errorf("DIFYGATE_LOCALE: no messages are configured for %q", m.DefaultLocale))
+	}
+	return errors.Join(errs...)
+}
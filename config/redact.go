@@ -0,0 +1,119 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"reflect"
+
+	"gopkg.in/yaml.v3"
+)
+
+// redactedValue replaces secret settings in printed configuration
+const redactedValue = "[redacted]"
+
+// Redacted returns a copy of the configuration with every field tagged
+// `secret:"true"` masked, so it can be printed or logged safely
+func (c *Config) Redacted() *Config {
+	cp := *c
+	redact(reflect.ValueOf(&cp).Elem(), func(string) string { return redactedValue })
+	return &cp
+}
+
+// Fingerprinted returns a copy of the configuration with every field
+// tagged `secret:"true"` replaced by its MaskSecret form, so instances can
+// be compared without exposing their secrets
+func (c *Config) Fingerprinted() *Config {
+	cp := *c
+	redact(reflect.ValueOf(&cp).Elem(), MaskSecret)
+	return &cp
+}
+
+// maskRevealMin is the shortest secret whose last 4 characters are shown;
+// shorter ones would give away too much of themselves
+const maskRevealMin = 12
+
+// MaskSecret masks a secret as ****<last 4 characters> (sha256:<first 12
+// hex digits of its SHA-256>); secrets shorter than 12 characters show only
+// the fingerprint
+func MaskSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	fingerprint := "sha256:" + hex.EncodeToString(sum[:])[:12]
+	if len(secret) < maskRevealMin {
+		return "**** (" + fingerprint + ")"
+	}
+	return "****" + secret[len(secret)-4:] + " (" + fingerprint + ")"
+}
+
+// RedactedYAML renders the redacted configuration as YAML
+func (c *Config) RedactedYAML() ([]byte, error) {
+	return yaml.Marshal(c.Redacted())
+}
+
+// redact replaces the secret fields under v with mask of their value
+func redact(v reflect.Value, mask func(string) string) {
+	switch v.Kind() {
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Field(i)
+			if !field.CanSet() {
+				continue
+			}
+			if t.Field(i).Tag.Get("secret") == "true" {
+				redactSecret(field, mask)
+				continue
+			}
+			redact(field, mask)
+		}
+	case reflect.Slice:
+		if v.IsNil() {
+			return
+		}
+		// Copy so the original configuration's backing array is untouched
+		cp := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		reflect.Copy(cp, v)
+		v.Set(cp)
+		for i := 0; i < cp.Len(); i++ {
+			redact(cp.Index(i), mask)
+		}
+	case reflect.Map:
+		if v.IsNil() {
+			return
+		}
+		// Map values can't be set in place; fill a copy instead
+		cp := reflect.MakeMapWithSize(v.Type(), v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			value := reflect.New(v.Type().Elem()).Elem()
+			value.Set(iter.Value())
+			redact(value, mask)
+			cp.SetMapIndex(iter.Key(), value)
+		}
+		v.Set(cp)
+	case reflect.Ptr:
+		if v.IsNil() {
+			return
+		}
+		cp := reflect.New(v.Type().Elem())
+		cp.Elem().Set(v.Elem())
+		redact(cp.Elem(), mask)
+		v.Set(cp)
+	}
+}
+
+// redactSecret masks a secret string or every element of a secret []string
+func redactSecret(v reflect.Value, mask func(string) string) {
+	switch {
+	case v.Kind() == reflect.String:
+		if v.String() != "" {
+			v.SetString(mask(v.String()))
+		}
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.String && !v.IsNil():
+		cp := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		reflect.Copy(cp, v)
+		v.Set(cp)
+		for i := 0; i < cp.Len(); i++ {
+			redactSecret(cp.Index(i), mask)
+		}
+	}
+}
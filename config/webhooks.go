@@ -0,0 +1,98 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Outgoing webhook event types
+const (
+	EventMessageReceived = "message.received"
+	EventMessageAnswered = "message.answered"
+	EventMessageFailed   = "message.failed"
+	// EventMessageUndelivered is a reply given up after failing to send
+	// for DIFYGATE_SEND_RETRY_WINDOW
+	EventMessageUndelivered = "message.undelivered"
+	EventEmailSent          = "email.sent"
+	// EventEmailFailing is raised when email sends fail at the rate set by
+	// DIFYGATE_EMAIL_ALERT_FAILURE_RATE
+	EventEmailFailing = "email.failing"
+	// EventSignatureFailing is raised when a channel's webhooks fail
+	// signature verification DIFYGATE_SIGNATURE_ALERT_THRESHOLD times in a
+	// row
+	EventSignatureFailing = "webhook.signature_failing"
+	// EventHandoffRequested is a user asking for a person, and
+	// EventHandoffResumed the bot taking the chat back
+	EventHandoffRequested = "handoff.requested"
+	EventHandoffResumed   = "handoff.resumed"
+)
+
+// EventTypes lists every event an outgoing webhook can subscribe to
+var EventTypes = []string{EventMessageReceived, EventMessageAnswered, EventMessageFailed, EventMessageUndelivered, EventEmailSent, EventEmailFailing, EventSignatureFailing, EventHandoffRequested, EventHandoffResumed}
+
+// User ID masking modes for outgoing webhooks
+const (
+	MaskUserIDPartial = "partial" // keep the last four characters
+	MaskUserIDHash    = "hash"    // stable SHA-256 pseudonym
+)
+
+// OutgoingWebhooksConfig holds the targets notified about gateway activity
+type OutgoingWebhooksConfig struct {
+	Targets []OutgoingWebhookConfig `yaml:"targets"`
+	// MaxAttempts bounds delivery attempts per event and target
+	MaxAttempts int `yaml:"max_attempts"`
+	// QueueSize bounds pending deliveries; events beyond it are dropped
+	QueueSize int `yaml:"queue_size"`
+}
+
+// OutgoingWebhookConfig is one target of signed JSON event POSTs
+type OutgoingWebhookConfig struct {
+	URL string `yaml:"url" json:"url"`
+	// Secret signs each body as X-DifyGate-Signature-256: sha256=<hex HMAC>
+	Secret string `yaml:"secret" json:"secret" secret:"true"`
+	// Events to send; empty means all
+	Events []string `yaml:"events" json:"events"`
+	// MaskUserID is "", partial or hash
+	MaskUserID string `yaml:"mask_user_id" json:"mask_user_id"`
+	// MaskText replaces email addresses and phone numbers in the text
+	MaskText bool `yaml:"mask_text" json:"mask_text"`
+	// OmitText leaves message text out of the payload entirely
+	OmitText bool `yaml:"omit_text" json:"omit_text"`
+	// MaxTextLength truncates the text, default 500 characters
+	MaxTextLength int `yaml:"max_text_length" json:"max_text_length"`
+}
+
+// validate checks target URLs, event names and masking modes
+func (o OutgoingWebhooksConfig) validate() error {
+	var errs []error
+	if o.MaxAttempts < 1 {
+		errs = append(errs, errors.New("DIFYGATE_OUTGOING_WEBHOOK_MAX_ATTEMPTS must be at least 1"))
+	}
+	if o.QueueSize < 1 {
+		errs = append(errs, errors.New("DIFYGATE_OUTGOING_WEBHOOK_QUEUE_SIZE must be at least 1"))
+	}
+
+	known := make(map[string]bool)
+	for _, e := range EventTypes {
+		known[e] = true
+	}
+	for i, t := range o.Targets {
+		if err := validateURL(t.URL); err != nil {
+			errs = append(errs, fmt.Errorf("outgoing webhook #%d: %w", i+1, err))
+		}
+		for _, e := range t.Events {
+			if !known[e] {
+				errs = append(errs, fmt.Errorf("outgoing webhook %q: unknown event %q", t.URL, e))
+			}
+		}
+		switch t.MaskUserID {
+		case "", MaskUserIDPartial, MaskUserIDHash:
+		default:
+			errs = append(errs, fmt.Errorf("outgoing webhook %q: mask_user_id must be partial or hash", t.URL))
+		}
+		if t.MaxTextLength < 0 {
+			errs = append(errs, fmt.Errorf("outgoing webhook %q: max_text_length must not be negative", t.URL))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,315 @@
+// Package events notifies external systems about gateway activity through
+// signed outgoing webhooks
+package events
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/config"
+	"github.com/tracoco/DifyGate/metrics"
+)
+
+const (
+	// SignatureHeader carries the HMAC-SHA256 of the body, like Meta's X-Hub-Signature-256
+	SignatureHeader = "X-DifyGate-Signature-256"
+
+	defaultMaxTextLength = 500
+	deliveryWorkers      = 4
+	baseBackoff          = time.Second
+	maxBackoff           = time.Minute
+)
+
+var (
+	deliveries = metrics.NewCounter("difygate_outgoing_webhook_deliveries_total",
+		"Outgoing webhook deliveries by outcome (delivered, retried, failed, dropped)", "result")
+
+	emailPattern = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)
+	phonePattern = regexp.MustCompile(`\+?\d[\d\s().-]{6,}\d`)
+)
+
+// Event is the JSON body POSTed to outgoing webhook targets
+type Event struct {
+	ID             string    `json:"id"`
+	Type           string    `json:"type"`
+	Timestamp      time.Time `json:"timestamp"`
+	Channel        string    `json:"channel,omitempty"`
+	UserID         string    `json:"user_id,omitempty"`
+	ConversationID string    `json:"conversation_id,omitempty"`
+	MessageID      string    `json:"message_id,omitempty"`
+	Text           string    `json:"text,omitempty"`
+	Error          string    `json:"error,omitempty"`
+	RequestID      string    `json:"request_id,omitempty"`
+}
+
+// delivery is one event bound for one target
+type delivery struct {
+	event   Event
+	target  int
+	attempt int
+}
+
+// Dispatcher delivers events to the configured targets in the background.
+// A nil *Dispatcher accepts and discards events.
+type Dispatcher struct {
+	log         *logrus.Logger
+	targets     []config.OutgoingWebhookConfig
+	maxAttempts int
+	client      *http.Client
+
+	mu     sync.Mutex
+	closed bool
+	queue  chan delivery
+	wg     sync.WaitGroup
+}
+
+// NewDispatcher starts the delivery workers, or returns nil when no targets
+// are configured
+func NewDispatcher(cfg config.OutgoingWebhooksConfig, log *logrus.Logger) *Dispatcher {
+	if len(cfg.Targets) == 0 {
+		return nil
+	}
+
+	d := &Dispatcher{
+		log:         log,
+		targets:     cfg.Targets,
+		maxAttempts: cfg.MaxAttempts,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		queue:       make(chan delivery, cfg.QueueSize),
+	}
+	for i := 0; i < deliveryWorkers; i++ {
+		d.wg.Add(1)
+		go d.worker()
+	}
+	log.WithField("targets", len(cfg.Targets)).Info("Outgoing webhooks enabled")
+	return d
+}
+
+// Publish queues e for every subscribed target without blocking; events
+// are dropped when the queue is full or the dispatcher is closed
+func (d *Dispatcher) Publish(e Event) {
+	if d == nil {
+		return
+	}
+	if e.ID == "" {
+		e.ID = newEventID()
+	}
+	if e.Timestamp.IsZero() {
+		e.Timestamp = time.Now().UTC()
+	}
+
+	for i, t := range d.targets {
+		if subscribed(t, e.Type) {
+			d.enqueue(delivery{event: e, target: i, attempt: 1})
+		}
+	}
+}
+
+// UseTransport sends deliveries through rt, such as the shared transport
+// honoring the outbound proxy settings. Call it before publishing events.
+func (d *Dispatcher) UseTransport(rt http.RoundTripper) {
+	if d == nil {
+		return
+	}
+	d.client.Transport = rt
+}
+
+// Close stops accepting events and waits, until ctx is done, for queued
+// deliveries to finish; pending retries are abandoned
+func (d *Dispatcher) Close(ctx context.Context) {
+	if d == nil {
+		return
+	}
+
+	d.mu.Lock()
+	if !d.closed {
+		d.closed = true
+		close(d.queue)
+	}
+	d.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		d.log.Warn("Outgoing webhook queue not drained before shutdown")
+	}
+}
+
+// enqueue adds a delivery unless the queue is full or closed
+func (d *Dispatcher) enqueue(dl delivery) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		deliveries.Inc("dropped")
+		return
+	}
+	select {
+	case d.queue <- dl:
+	default:
+		deliveries.Inc("dropped")
+		d.log.WithFields(logrus.Fields{"event": dl.event.Type, "url": d.targets[dl.target].URL}).Warn("Outgoing webhook queue full, dropping event")
+	}
+}
+
+// worker delivers queued events, scheduling retries with backoff
+func (d *Dispatcher) worker() {
+	defer d.wg.Done()
+	for dl := range d.queue {
+		target := d.targets[dl.target]
+		log := d.log.WithFields(logrus.Fields{
+			"event":    dl.event.Type,
+			"event_id": dl.event.ID,
+			"url":      target.URL,
+			"attempt":  dl.attempt,
+		})
+
+		err := d.send(target, dl.event)
+		switch {
+		case err == nil:
+			deliveries.Inc("delivered")
+			log.Debug("Outgoing webhook delivered")
+		case dl.attempt >= d.maxAttempts:
+			deliveries.Inc("failed")
+			log.WithError(err).Error("Outgoing webhook failed, giving up")
+		default:
+			deliveries.Inc("retried")
+			backoff := retryBackoff(dl.attempt)
+			log.WithError(err).WithField("retry_in", backoff).Warn("Outgoing webhook failed, will retry")
+			dl.attempt++
+			time.AfterFunc(backoff, func() { d.enqueue(dl) })
+		}
+	}
+}
+
+// send POSTs the event, shaped for the target, and signs it
+func (d *Dispatcher) send(target config.OutgoingWebhookConfig, e Event) error {
+	body, err := json.Marshal(shape(target, e))
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %w", err)
+	}
+
+	req, err := http.NewRequest("POST", target.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-DifyGate-Event", e.Type)
+	req.Header.Set("X-DifyGate-Delivery", e.ID)
+	if target.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign(body, target.Secret))
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("target returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Sign returns the signature header value for body
+func Sign(body []byte, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// shape applies the target's masking and truncation options to a copy of e
+func shape(target config.OutgoingWebhookConfig, e Event) Event {
+	switch target.MaskUserID {
+	case config.MaskUserIDPartial:
+		e.UserID = maskPartial(e.UserID)
+	case config.MaskUserIDHash:
+		if e.UserID != "" {
+			sum := sha256.Sum256([]byte(e.UserID))
+			e.UserID = hex.EncodeToString(sum[:8])
+		}
+	}
+
+	if target.OmitText {
+		e.Text = ""
+		return e
+	}
+	if target.MaskText {
+		e.Text = emailPattern.ReplaceAllString(e.Text, "[email]")
+		e.Text = phonePattern.ReplaceAllString(e.Text, "[phone]")
+	}
+	limit := target.MaxTextLength
+	if limit == 0 {
+		limit = defaultMaxTextLength
+	}
+	e.Text = truncate(e.Text, limit)
+	return e
+}
+
+// subscribed reports whether target wants events of type eventType
+func subscribed(target config.OutgoingWebhookConfig, eventType string) bool {
+	if len(target.Events) == 0 {
+		return true
+	}
+	for _, e := range target.Events {
+		if e == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// maskPartial keeps only the last four characters
+func maskPartial(s string) string {
+	n := utf8.RuneCountInString(s)
+	if n <= 4 {
+		return s
+	}
+	runes := []rune(s)
+	return "****" + string(runes[n-4:])
+}
+
+// truncate cuts s to limit runes, marking the cut with an ellipsis
+func truncate(s string, limit int) string {
+	if utf8.RuneCountInString(s) <= limit {
+		return s
+	}
+	return string([]rune(s)[:limit]) + "…"
+}
+
+// retryBackoff doubles from one second per attempt, capped at a minute
+func retryBackoff(attempt int) time.Duration {
+	backoff := time.Duration(float64(baseBackoff) * math.Pow(2, float64(attempt-1)))
+	if backoff > maxBackoff {
+		return maxBackoff
+	}
+	return backoff
+}
+
+// newEventID returns a random 128-bit hex ID
+func newEventID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
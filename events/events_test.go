@@ -0,0 +1,190 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/config"
+)
+
+// received is a delivery a target got
+type received struct {
+	header http.Header
+	body   []byte
+}
+
+// target is a webhook target answering each delivery with the next of
+// statuses, then 200
+type target struct {
+	mu       sync.Mutex
+	got      []received
+	statuses []int
+}
+
+func newTarget(t *testing.T, statuses ...int) (*target, *httptest.Server) {
+	t.Helper()
+	tg := &target{statuses: statuses}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		tg.mu.Lock()
+		tg.got = append(tg.got, received{header: r.Header.Clone(), body: body})
+		status := http.StatusOK
+		if len(tg.statuses) > 0 {
+			status, tg.statuses = tg.statuses[0], tg.statuses[1:]
+		}
+		tg.mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return tg, srv
+}
+
+// wait returns the deliveries once there are n of them
+func (tg *target) wait(t *testing.T, n int, timeout time.Duration) []received {
+	t.Helper()
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		tg.mu.Lock()
+		got := append([]received(nil), tg.got...)
+		tg.mu.Unlock()
+		if len(got) >= n {
+			return got
+		}
+	}
+	t.Fatalf("target got fewer than %d deliveries", n)
+	return nil
+}
+
+func quietLogger() *logrus.Logger {
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	return log
+}
+
+func TestNilDispatcher(t *testing.T) {
+	if d := NewDispatcher(config.OutgoingWebhooksConfig{MaxAttempts: 1, QueueSize: 1}, quietLogger()); d != nil {
+		t.Fatal("dispatcher without targets, want nil")
+	}
+	var d *Dispatcher
+	d.Publish(Event{Type: config.EventMessageAnswered})
+	d.UseTransport(http.DefaultTransport)
+	d.Close(context.Background())
+}
+
+func TestDispatcherSignsAndFilters(t *testing.T) {
+	answered, answeredSrv := newTarget(t)
+	email, emailSrv := newTarget(t)
+	d := NewDispatcher(config.OutgoingWebhooksConfig{
+		MaxAttempts: 1,
+		QueueSize:   10,
+		Targets: []config.OutgoingWebhookConfig{
+			{URL: answeredSrv.URL, Secret: "s3cret", Events: []string{config.EventMessageAnswered}},
+			{URL: emailSrv.URL, Events: []string{config.EventEmailSent}},
+		},
+	}, quietLogger())
+
+	d.Publish(Event{Type: config.EventMessageAnswered, Channel: "whatsapp", UserID: "15550001", Text: "Opening hours are 9 to 5."})
+	d.Close(context.Background())
+
+	got := answered.wait(t, 1, time.Second)
+	if len(got) != 1 {
+		t.Fatalf("got %d deliveries, want 1", len(got))
+	}
+	if sig := got[0].header.Get(SignatureHeader); sig != Sign(got[0].body, "s3cret") {
+		t.Errorf("signature %q doesn't match the body", sig)
+	}
+	var e Event
+	if err := json.Unmarshal(got[0].body, &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Type != config.EventMessageAnswered || e.Channel != "whatsapp" || e.UserID != "15550001" || e.Text != "Opening hours are 9 to 5." {
+		t.Errorf("delivered %+v", e)
+	}
+	if e.ID == "" || e.Timestamp.IsZero() {
+		t.Errorf("delivered ID %q at %v, want both set", e.ID, e.Timestamp)
+	}
+	if h := got[0].header; h.Get("X-DifyGate-Event") != e.Type || h.Get("X-DifyGate-Delivery") != e.ID || h.Get("Content-Type") != "application/json" {
+		t.Errorf("headers %v", h)
+	}
+
+	email.mu.Lock()
+	defer email.mu.Unlock()
+	if len(email.got) != 0 {
+		t.Errorf("the email target got %d unsubscribed events", len(email.got))
+	}
+}
+
+func TestDispatcherRetriesFailedDeliveries(t *testing.T) {
+	flaky, flakySrv := newTarget(t, http.StatusInternalServerError)
+	down, downSrv := newTarget(t, http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway)
+	d := NewDispatcher(config.OutgoingWebhooksConfig{
+		MaxAttempts: 2,
+		QueueSize:   10,
+		Targets: []config.OutgoingWebhookConfig{
+			{URL: flakySrv.URL},
+			{URL: downSrv.URL},
+		},
+	}, quietLogger())
+	retried, failed := deliveries.Value("retried"), deliveries.Value("failed")
+
+	d.Publish(Event{ID: "evt-1", Type: config.EventMessageFailed})
+
+	// The retry comes after a second's backoff, with the same event
+	got := flaky.wait(t, 2, 3*time.Second)
+	if got[0].header.Get("X-DifyGate-Delivery") != "evt-1" || got[1].header.Get("X-DifyGate-Delivery") != "evt-1" {
+		t.Errorf("delivered %q then %q, want evt-1 twice", got[0].header.Get("X-DifyGate-Delivery"), got[1].header.Get("X-DifyGate-Delivery"))
+	}
+	down.wait(t, 2, time.Second)
+	d.Close(context.Background())
+
+	// The target still down is given up after MaxAttempts
+	time.Sleep(50 * time.Millisecond)
+	down.mu.Lock()
+	attempts := len(down.got)
+	down.mu.Unlock()
+	if attempts != 2 {
+		t.Errorf("the failing target got %d attempts, want 2", attempts)
+	}
+	if n := deliveries.Value("retried") - retried; n != 2 {
+		t.Errorf("counted %v retries, want 2", n)
+	}
+	if n := deliveries.Value("failed") - failed; n != 1 {
+		t.Errorf("counted %v failures, want 1", n)
+	}
+}
+
+func TestShape(t *testing.T) {
+	e := Event{UserID: "15550001234", Text: "Mail me at jane@example.com or call +1 555 000 1234"}
+
+	tests := []struct {
+		name     string
+		target   config.OutgoingWebhookConfig
+		wantUser string
+		wantText string
+	}{
+		{"unmasked", config.OutgoingWebhookConfig{}, e.UserID, e.Text},
+		{"partial", config.OutgoingWebhookConfig{MaskUserID: config.MaskUserIDPartial}, "****1234", e.Text},
+		{"masked text", config.OutgoingWebhookConfig{MaskText: true}, e.UserID, "Mail me at [email] or call [phone]"},
+		{"omitted text", config.OutgoingWebhookConfig{OmitText: true, MaxTextLength: 4}, e.UserID, ""},
+		{"truncated", config.OutgoingWebhookConfig{MaxTextLength: 7}, e.UserID, "Mail me…"},
+	}
+	for _, tt := range tests {
+		got := shape(tt.target, e)
+		if got.UserID != tt.wantUser || got.Text != tt.wantText {
+			t.Errorf("%s: shaped to %q, %q, want %q, %q", tt.name, got.UserID, got.Text, tt.wantUser, tt.wantText)
+		}
+	}
+
+	// Hashed IDs are stable pseudonyms
+	hashed := shape(config.OutgoingWebhookConfig{MaskUserID: config.MaskUserIDHash}, e).UserID
+	if len(hashed) != 16 || strings.Contains(hashed, "1234") || hashed != shape(config.OutgoingWebhookConfig{MaskUserID: config.MaskUserIDHash}, e).UserID {
+		t.Errorf("hashed the user ID to %q", hashed)
+	}
+}
@@ -2,12 +2,43 @@ package gate
 
 import (
 	"errors"
+	"fmt"
 	"io"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/metrics"
 	gomail "gopkg.in/mail.v2"
 )
 
+var (
+	emailSends = metrics.NewCounter("difygate_email_sends_total",
+		"Emails sent, by outcome (sent or failed) and error_class of failures", "outcome", "error_class")
+	emailSendDuration = metrics.NewHistogram("difygate_email_send_duration_seconds",
+		"Time taken to send an email over SMTP, by outcome", metrics.DefBuckets, "outcome")
+)
+
+var (
+	errNoRecipients  = errors.New("no recipients specified")
+	errNotConfigured = errors.New("SMTP credentials not configured")
+)
+
+// Email error classes, for metrics and alerts
+const (
+	ErrorClassNotConfigured = "not_configured"
+	ErrorClassInvalid       = "invalid_message"
+	ErrorClassTimeout       = "timeout"
+	ErrorClassConnection    = "connection"
+	ErrorClassAuth          = "auth"
+	ErrorClassTemporary     = "temporary"
+	ErrorClassRejected      = "rejected"
+	ErrorClassOther         = "other"
+)
+
 // Attachment represents an email attachment
 type Attachment struct {
 	Filename string
@@ -28,11 +59,11 @@ type Message struct {
 
 // DIFYGateConfig holds SMTP configuration
 type DIFYGateConfig struct {
-	Host     string
-	Port     int
-	Username string
-	Password string
-	FromName string
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password" secret:"true"`
+	FromName string `yaml:"from_name"`
 }
 
 // Service handles email operations
@@ -43,8 +74,22 @@ type Service struct {
 	smtpPassword string
 	fromName     string
 	log          *logrus.Logger
+
+	observersMu sync.Mutex
+	observers   []func(msg Message, err error)
+
+	pingMu      sync.Mutex
+	lastPing    time.Time
+	lastPingErr error
 }
 
+const (
+	// pingTimeout bounds each SMTP connectivity check
+	pingTimeout = 5 * time.Second
+	// pingCacheTTL is how long a Ping result is reused before dialing again
+	pingCacheTTL = 60 * time.Second
+)
+
 // NewService creates a new email service
 func NewService(config DIFYGateConfig, log *logrus.Logger) *Service {
 	return &Service{
@@ -57,14 +102,42 @@ func NewService(config DIFYGateConfig, log *logrus.Logger) *Service {
 	}
 }
 
+// OnSend registers f to be called with every message sent and the result,
+// nil on success
+func (s *Service) OnSend(f func(msg Message, err error)) {
+	s.observersMu.Lock()
+	defer s.observersMu.Unlock()
+	s.observers = append(s.observers, f)
+}
+
 // Send sends an email
 func (s *Service) Send(msg Message) error {
+	start := time.Now()
+	err := s.send(msg)
+
+	outcome, class := "sent", ""
+	if err != nil {
+		outcome, class = "failed", ErrorClass(err)
+	}
+	emailSends.Inc(outcome, class)
+	emailSendDuration.Observe(time.Since(start).Seconds(), outcome)
+
+	s.observersMu.Lock()
+	observers := s.observers
+	s.observersMu.Unlock()
+	for _, f := range observers {
+		f(msg, err)
+	}
+	return err
+}
+
+func (s *Service) send(msg Message) error {
 	if len(msg.To) == 0 {
-		return errors.New("no recipients specified")
+		return errNoRecipients
 	}
 
 	if s.smtpUsername == "" || s.smtpPassword == "" {
-		return errors.New("SMTP credentials not configured")
+		return errNotConfigured
 	}
 
 	m := gomail.NewMessage()
@@ -112,9 +185,76 @@ func (s *Service) Send(msg Message) error {
 
 	// Send the email
 	if err := d.DialAndSend(m); err != nil {
-		s.log.WithError(err).Error("Failed to send email")
+		s.log.WithError(err).WithField("error_class", ErrorClass(err)).Error("Failed to send email")
 		return err
 	}
 
 	return nil
 }
+
+// ErrorClass sorts a Send error into one of the ErrorClass constants
+func ErrorClass(err error) string {
+	var sendErr *gomail.SendError
+	if errors.As(err, &sendErr) {
+		// SendError doesn't unwrap to its cause
+		err = sendErr.Cause
+	}
+	var protoErr *textproto.Error
+	var netErr net.Error
+	var tlsErr gomail.StartTLSUnsupportedError
+	switch {
+	case errors.Is(err, errNotConfigured):
+		return ErrorClassNotConfigured
+	case errors.Is(err, errNoRecipients):
+		return ErrorClassInvalid
+	case errors.As(err, &protoErr):
+		switch {
+		case protoErr.Code == 530 || protoErr.Code == 534 || protoErr.Code == 535 || protoErr.Code == 538:
+			return ErrorClassAuth
+		case protoErr.Code >= 400 && protoErr.Code < 500:
+			return ErrorClassTemporary
+		case protoErr.Code >= 500:
+			return ErrorClassRejected
+		}
+		return ErrorClassOther
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return ErrorClassTimeout
+	case errors.As(err, &netErr), errors.As(err, &tlsErr), errors.Is(err, io.EOF):
+		return ErrorClassConnection
+	case err != nil && strings.HasPrefix(err.Error(), "gomail: invalid"):
+		return ErrorClassInvalid
+	default:
+		return ErrorClassOther
+	}
+}
+
+// Ping checks SMTP connectivity by dialing the server and authenticating
+// without sending anything. The result is cached for a minute so repeated
+// health probes don't hammer the relay.
+func (s *Service) Ping() error {
+	s.pingMu.Lock()
+	defer s.pingMu.Unlock()
+
+	if !s.lastPing.IsZero() && time.Since(s.lastPing) < pingCacheTTL {
+		return s.lastPingErr
+	}
+
+	s.lastPingErr = s.ping()
+	s.lastPing = time.Now()
+	return s.lastPingErr
+}
+
+func (s *Service) ping() error {
+	if s.smtpUsername == "" || s.smtpPassword == "" {
+		return errNotConfigured
+	}
+
+	d := gomail.NewDialer(s.smtpHost, s.smtpPort, s.smtpUsername, s.smtpPassword)
+	d.Timeout = pingTimeout
+
+	conn, err := d.Dial()
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s:%d: %w", s.smtpHost, s.smtpPort, err)
+	}
+	return conn.Close()
+}
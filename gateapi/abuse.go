@@ -0,0 +1,303 @@
+package gateapi
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/apierror"
+	"github.com/tracoco/DifyGate/config"
+	"github.com/tracoco/DifyGate/metrics"
+	"github.com/tracoco/DifyGate/store"
+)
+
+var (
+	// abuseMutes counts users muted, by reason: flood or identical
+	abuseMutes = metrics.NewCounter("difygate_abuse_mutes_total",
+		"Chat users muted for sending too much, by reason", "channel", "reason")
+	// abuseDropped counts the messages of muted or flooding users
+	abuseDropped = metrics.NewCounter("difygate_abuse_dropped_total",
+		"Chat messages dropped from muted users or over the per-user limit", "channel")
+)
+
+// Reasons a user is muted
+const (
+	// muteReasonFlood is too many windows over DIFYGATE_ABUSE_MAX_MESSAGES
+	muteReasonFlood = "flood"
+	// muteReasonIdentical is the same message sent over and over
+	muteReasonIdentical = "identical"
+)
+
+// Mute is a chat user whose messages are dropped until it expires
+type Mute struct {
+	Channel   string `json:"channel"`
+	ChannelID string `json:"channel_id"`
+	UserID    string `json:"user_id"`
+	Reason    string `json:"reason"`
+	// Offense counts the user's mutes within DIFYGATE_ABUSE_OFFENSE_MEMORY,
+	// this one included
+	Offense int64     `json:"offense"`
+	Since   time.Time `json:"since"`
+	Until   time.Time `json:"until"`
+}
+
+// abuseUser names a chat user in the abuse store keys
+func abuseUser(channel, channelID, userID string) string {
+	return channel + ":" + channelID + ":" + userID
+}
+
+// muteKey is the store key of a muted user, kept until the mute expires
+func muteKey(user string) string {
+	return "abuse:mute:" + user
+}
+
+// abuseStreak is a user's run of identical messages
+type abuseStreak struct {
+	Hash  string `json:"hash"`
+	Count int    `json:"count"`
+}
+
+// abuseGuard counts each chat user's messages and mutes those who flood
+// the bot or repeat themselves. Its state is in the shared store, so every
+// instance counts towards the same limits. Store failures let messages
+// through, as missing a spammer is the lesser harm.
+type abuseGuard struct {
+	cfg   config.AbuseConfig
+	store store.Store
+}
+
+// newAbuseGuard returns nil when DIFYGATE_ABUSE_ENABLED is off
+func newAbuseGuard(cfg config.AbuseConfig, kv store.Store) *abuseGuard {
+	if !cfg.Enabled {
+		return nil
+	}
+	return &abuseGuard{cfg: cfg, store: kv}
+}
+
+// check records msg and reports whether to drop it; mute is set when msg
+// got its sender muted
+func (g *abuseGuard) check(log *logrus.Entry, channel string, msg ChannelMessage) (drop bool, mute *Mute) {
+	user := abuseUser(channel, msg.ChannelID, msg.UserID)
+	_, err := g.store.Get(muteKey(user))
+	if err == nil {
+		return true, nil
+	}
+	if !errors.Is(err, store.ErrNotFound) {
+		log.WithError(err).Warn("Failed to check whether the user is muted, answering")
+		return false, nil
+	}
+
+	// The window starts with the user's first message
+	n, err := g.store.Incr("abuse:count:"+user, g.cfg.Window)
+	if err != nil {
+		log.WithError(err).Warn("Failed to count the user's messages")
+	} else if n > int64(g.cfg.MaxMessages) {
+		if n > int64(g.cfg.MaxMessages)+1 {
+			return true, nil
+		}
+		// The first message over the limit makes the window a strike
+		strikes, err := g.store.Incr("abuse:strikes:"+user, g.cfg.StrikeWindow)
+		if err != nil {
+			log.WithError(err).Warn("Failed to count the user's strikes")
+			return true, nil
+		}
+		log.WithFields(logrus.Fields{"max_messages": g.cfg.MaxMessages, "strikes": strikes}).Info("User over the message limit, dropping messages")
+		if strikes < int64(g.cfg.Strikes) {
+			return true, nil
+		}
+		return true, g.mute(log, channel, msg, muteReasonFlood)
+	}
+
+	if g.cfg.MaxIdentical == 0 || msg.Text == "" {
+		return false, nil
+	}
+	sum := sha256.Sum256([]byte(normalizeQuery(msg.Text)))
+	streak := abuseStreak{Hash: hex.EncodeToString(sum[:8]), Count: 1}
+	if b, err := g.store.Get("abuse:streak:" + user); err == nil {
+		var last abuseStreak
+		if json.Unmarshal(b, &last) == nil && last.Hash == streak.Hash {
+			streak.Count = last.Count + 1
+		}
+	}
+	if streak.Count >= g.cfg.MaxIdentical {
+		return true, g.mute(log, channel, msg, muteReasonIdentical)
+	}
+	b, _ := json.Marshal(streak)
+	if err := g.store.Set("abuse:streak:"+user, b, g.cfg.StrikeWindow); err != nil {
+		log.WithError(err).Warn("Failed to save the user's identical messages")
+	}
+	return false, nil
+}
+
+// mute mutes the sender of msg for DIFYGATE_ABUSE_MUTE_DURATION, doubled
+// for each earlier offense; it returns nil when the mute couldn't be saved
+func (g *abuseGuard) mute(log *logrus.Entry, channel string, msg ChannelMessage, reason string) *Mute {
+	user := abuseUser(channel, msg.ChannelID, msg.UserID)
+	offense, err := g.store.Incr("abuse:offenses:"+user, g.cfg.OffenseMemory)
+	if err != nil {
+		log.WithError(err).Warn("Failed to count the user's offenses")
+		offense = 1
+	}
+	d := g.cfg.MuteDuration
+	for i := int64(1); i < offense && d < g.cfg.MaxMuteDuration; i++ {
+		d *= 2
+	}
+	if d > g.cfg.MaxMuteDuration {
+		d = g.cfg.MaxMuteDuration
+	}
+
+	now := time.Now().UTC()
+	m := &Mute{
+		Channel:   channel,
+		ChannelID: msg.ChannelID,
+		UserID:    msg.UserID,
+		Reason:    reason,
+		Offense:   offense,
+		Since:     now,
+		Until:     now.Add(d),
+	}
+	b, err := json.Marshal(m)
+	if err == nil {
+		err = g.store.Set(muteKey(user), b, d)
+	}
+	if err != nil {
+		log.WithError(err).WithField("reason", reason).Error("Failed to mute the user")
+		return nil
+	}
+	clearAbuseCounts(g.store, user)
+	return m
+}
+
+// clearAbuseCounts forgets the messages, strikes and identical messages
+// leading to a mute, so the user starts afresh once it ends; offenses are
+// kept
+func clearAbuseCounts(kv store.Store, user string) {
+	kv.Delete("abuse:count:" + user)
+	kv.Delete("abuse:strikes:" + user)
+	kv.Delete("abuse:streak:" + user)
+}
+
+// handleAbuse drops the messages of muted users and of users over the
+// message limit, and tells a user once when they are muted; it returns
+// false for messages to answer
+func (p *MessagePipeline) handleAbuse(t *messageTrace, msg ChannelMessage) bool {
+	drop, mute := p.abuse.check(t.log, p.opts.Channel, msg)
+	if !drop {
+		return false
+	}
+	t.outcome = outcomeMuted
+	abuseDropped.Inc(p.opts.Channel)
+	if mute == nil {
+		t.log.Debug("Dropping message of a muted or flooding user")
+		return true
+	}
+	t.log.WithFields(logrus.Fields{
+		"reason":      mute.Reason,
+		"offense":     mute.Offense,
+		"muted_until": mute.Until,
+	}).Warn("User muted for abuse")
+	abuseMutes.Inc(p.opts.Channel, mute.Reason)
+	p.notify(t, msg, p.messages.Get(p.locale(msg), config.MsgMuted))
+	return true
+}
+
+// MutesHandler lists and lifts the mutes of chat users
+type MutesHandler struct {
+	store store.Store
+	log   *logrus.Logger
+}
+
+// NewMutesHandler creates the handler of the mutes API
+func NewMutesHandler(kv store.Store, log *logrus.Logger) *MutesHandler {
+	return &MutesHandler{store: kv, log: log}
+}
+
+// load returns the mutes with keys matching pattern, sorted by expiry
+func (h *MutesHandler) load(pattern string) ([]Mute, error) {
+	keys, err := h.store.Keys(muteKey(pattern))
+	if err != nil {
+		return nil, err
+	}
+	mutes := make([]Mute, 0, len(keys))
+	for _, key := range keys {
+		b, err := h.store.Get(key)
+		if errors.Is(err, store.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var m Mute
+		if err := json.Unmarshal(b, &m); err != nil {
+			return nil, err
+		}
+		mutes = append(mutes, m)
+	}
+	sort.Slice(mutes, func(i, j int) bool { return mutes[i].Until.Before(mutes[j].Until) })
+	return mutes, nil
+}
+
+// List handles GET /admin/mutes, listing the users muted now
+func (h *MutesHandler) List(c *gin.Context) {
+	mutes, err := h.load("*")
+	if err != nil {
+		requestLogger(c, h.log).WithError(err).Error("Failed to list muted users")
+		apierror.Respond(c, http.StatusInternalServerError, apierror.Internal, "Failed to list the muted users")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"mutes": mutes})
+}
+
+// Unmute handles DELETE /admin/mutes/:channel/:user: the user is answered
+// again on every business number or workspace of the channel. It answers
+// 204 when the user wasn't muted.
+func (h *MutesHandler) Unmute(c *gin.Context) {
+	log := requestLogger(c, h.log)
+	channel, userID := c.Param("channel"), c.Param("user")
+	if channel == "whatsapp" {
+		var ok bool
+		if userID, ok = apiNumber(c, "user", userID); !ok {
+			return
+		}
+	}
+	mutes, err := h.load(channel + ":*:" + userID)
+	if err != nil {
+		log.WithError(err).Error("Failed to look up the user's mutes")
+		apierror.Respond(c, http.StatusInternalServerError, apierror.Internal, "Failed to look up the user's mutes")
+		return
+	}
+	unmuted := []Mute{}
+	for _, m := range mutes {
+		// The pattern also matches user IDs ending in this one
+		if m.Channel != channel || m.UserID != userID {
+			continue
+		}
+		user := abuseUser(m.Channel, m.ChannelID, m.UserID)
+		if err := h.store.Delete(muteKey(user)); err != nil {
+			log.WithError(err).Error("Failed to unmute the user")
+			apierror.Respond(c, http.StatusInternalServerError, apierror.Internal, "Failed to unmute the user")
+			return
+		}
+		clearAbuseCounts(h.store, user)
+		log.WithFields(logrus.Fields{
+			"channel":      m.Channel,
+			"channel_id":   m.ChannelID,
+			"user_id":      m.UserID,
+			"reason":       "manual",
+			"muted_reason": m.Reason,
+			"key_name":     c.GetString(authKeyNameKey),
+		}).Info("User unmuted")
+		unmuted = append(unmuted, m)
+	}
+	if len(unmuted) == 0 {
+		c.Status(http.StatusNoContent)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"unmuted": unmuted})
+}
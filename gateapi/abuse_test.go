@@ -0,0 +1,99 @@
+package gateapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tracoco/DifyGate/config"
+)
+
+func TestPipelineMutesAbusers(t *testing.T) {
+	p, sender, dify, kv := newTestPipeline(t, PipelineOptions{Channel: "abuse"}, config.ChatConfig{},
+		func(req ChatMessageRequest) []StreamingChatResponse {
+			return difyAnswer("", "ok")
+		})
+	p.abuse = newAbuseGuard(config.AbuseConfig{
+		Enabled:         true,
+		MaxMessages:     3,
+		Window:          time.Hour,
+		Strikes:         1,
+		StrikeWindow:    time.Hour,
+		MaxIdentical:    3,
+		MuteDuration:    time.Hour,
+		MaxMuteDuration: 3 * time.Hour,
+		OffenseMemory:   time.Hour,
+	}, kv)
+	muted := p.messages.Get(config.DefaultLocale, config.MsgMuted)
+	asked := func() int {
+		dify.mu.Lock()
+		defer dify.mu.Unlock()
+		return len(dify.requests)
+	}
+	send := func(user string, texts ...string) []string {
+		for _, text := range texts {
+			p.Handle(testEntry(), ChannelMessage{ChannelID: "bot", UserID: user, Text: text})
+		}
+		return sender.sent()
+	}
+
+	// Over the limit, the user is muted and told once
+	if got := send("u1", "a", "b", "c", "d", "e"); len(got) != 4 || got[3] != muted {
+		t.Errorf("flooding user was sent %q, want 3 answers and the mute notice", got)
+	}
+	// The same message over and over mutes too
+	if got := send("u2", "spam", "spam", "SPAM "); len(got) != 3 || got[2] != muted {
+		t.Errorf("repeating user was sent %q, want 2 answers and the mute notice", got)
+	}
+	if got := asked(); got != 5 {
+		t.Errorf("Dify asked %d times, want only for the messages before the mutes", got)
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	h := NewMutesHandler(kv, quietLogger())
+	r.GET("/mutes", h.List)
+	r.DELETE("/mutes/:channel/:user", h.Unmute)
+	call := func(method, path string) (*httptest.ResponseRecorder, map[string][]Mute) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		var body map[string][]Mute
+		json.Unmarshal(w.Body.Bytes(), &body)
+		return w, body
+	}
+
+	_, list := call(http.MethodGet, "/mutes")
+	if mutes := list["mutes"]; len(mutes) != 2 || mutes[0].UserID != "u1" || mutes[0].Reason != muteReasonFlood ||
+		mutes[1].Reason != muteReasonIdentical || mutes[1].Until.Sub(mutes[1].Since) != time.Hour {
+		t.Errorf("mutes %+v, want u1 for flooding and u2 for repeating, for an hour", mutes)
+	}
+	if w, body := call(http.MethodDelete, "/mutes/abuse/u2"); w.Code != http.StatusOK || len(body["unmuted"]) != 1 {
+		t.Errorf("unmute: status %d: %s", w.Code, w.Body)
+	}
+	if w, _ := call(http.MethodDelete, "/mutes/abuse/u2"); w.Code != http.StatusNoContent {
+		t.Errorf("unmuting again: status %d, want 204", w.Code)
+	}
+	// WhatsApp users are phone numbers, which keeps patterns out of the
+	// store lookup
+	for path, want := range map[string]int{
+		"/mutes/whatsapp/+1%20555%20123%204567": http.StatusNoContent,
+		"/mutes/whatsapp/1555*":                 http.StatusBadRequest,
+		"/mutes/whatsapp/not-a-number":          http.StatusBadRequest,
+	} {
+		if w, _ := call(http.MethodDelete, path); w.Code != want {
+			t.Errorf("%s: status %d, want %d", path, w.Code, want)
+		}
+	}
+
+	// Unmuted, u2 starts afresh, but a second offense mutes for twice as long
+	if got := send("u2", "spam", "spam", "spam"); len(got) != 3 || got[2] != muted {
+		t.Errorf("unmuted user was sent %q, want 2 answers and the mute notice", got)
+	}
+	_, list = call(http.MethodGet, "/mutes")
+	if mutes := list["mutes"]; len(mutes) != 2 || mutes[1].Offense != 2 || mutes[1].Until.Sub(mutes[1].Since) != 2*time.Hour {
+		t.Errorf("mutes %+v, want u2's second mute doubled", mutes)
+	}
+}
@@ -0,0 +1,64 @@
+package gateapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/config"
+)
+
+func TestLoggingMiddlewareSkipsAndSamples(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	var out bytes.Buffer
+	log := logrus.New()
+	log.SetOutput(&out)
+	log.SetFormatter(&logrus.JSONFormatter{})
+
+	r := gin.New()
+	r.Use(LoggingMiddleware(log, config.LogConfig{
+		AccessSkipPaths:   []string{"/healthz"},
+		AccessSamplePaths: []string{"/hooks/:name"},
+		AccessSampleRate:  0,
+	}))
+	status := http.StatusOK
+	r.GET("/healthz", func(c *gin.Context) { c.Status(status) })
+	r.GET("/hooks/:name", func(c *gin.Context) { c.String(status, "hello") })
+	r.GET("/other", func(c *gin.Context) { c.String(status, "hello") })
+
+	logged := func(path string) map[string]interface{} {
+		out.Reset()
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+		if out.Len() == 0 {
+			return nil
+		}
+		var entry map[string]interface{}
+		if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+			t.Fatalf("log line %q: %v", out.String(), err)
+		}
+		return entry
+	}
+
+	if entry := logged("/healthz"); entry != nil {
+		t.Errorf("skipped path was logged: %v", entry)
+	}
+	if entry := logged("/hooks/a"); entry != nil {
+		t.Errorf("path sampled at 0 was logged: %v", entry)
+	}
+	entry := logged("/other")
+	if entry == nil || entry["response_size"] != float64(len("hello")) {
+		t.Errorf("other path logged %v, want it with its response size", entry)
+	}
+
+	// Failures are logged however the path is configured
+	status = http.StatusServiceUnavailable
+	for _, path := range []string{"/healthz", "/hooks/a"} {
+		if entry := logged(path); entry == nil || entry["path"] != path {
+			t.Errorf("failed request to %s wasn't logged", path)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package gateapi
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/config"
+	"github.com/tracoco/DifyGate/metrics"
+	"github.com/tracoco/DifyGate/store"
+)
+
+// answerCacheLookups counts answer cache lookups by channel and result: hit,
+// miss or bypass
+var answerCacheLookups = metrics.NewCounter("difygate_answer_cache_lookups_total",
+	"Answer cache lookups of questions asked outside a conversation, by result", "channel", "result")
+
+// answerCache keeps Dify's answers to questions asked outside a
+// conversation, where the answer only depends on the question, the inputs
+// and the app. It must never be asked for a question within a
+// conversation, as the context changes the right answer.
+type answerCache struct {
+	cfg   config.AnswerCacheConfig
+	store store.Store
+	// app identifies the Dify app and its default inputs, so answers of
+	// another app are never reused
+	app string
+}
+
+// newAnswerCache returns nil when the cache is disabled
+func newAnswerCache(cfg config.AnswerCacheConfig, difyCfg config.DifyConfig, kv store.Store) *answerCache {
+	if !cfg.Enabled {
+		return nil
+	}
+	defaults, _ := json.Marshal(difyCfg.DefaultInputs)
+	sum := sha256.Sum256([]byte(difyCfg.BaseURL + "\x00" + difyCfg.APIKey + "\x00" + string(defaults)))
+	return &answerCache{cfg: cfg, store: kv, app: hex.EncodeToString(sum[:8])}
+}
+
+// normalizeQuery lowercases query and collapses its whitespace, so
+// questions differing only in those share an answer
+func normalizeQuery(query string) string {
+	return strings.Join(strings.Fields(strings.ToLower(query)), " ")
+}
+
+// key is the store key of the answer to query with inputs
+func (c *answerCache) key(query string, inputs map[string]interface{}) string {
+	// Map keys are sorted, so equal inputs give equal bytes
+	b, _ := json.Marshal(inputs)
+	sum := sha256.Sum256([]byte(normalizeQuery(query) + "\x00" + string(b)))
+	return "answer-cache:" + c.app + ":" + hex.EncodeToString(sum[:])
+}
+
+// lookup returns the cached answer to query, counting the result; bypass
+// skips the cache for a caller that asked for a fresh answer
+func (c *answerCache) lookup(log *logrus.Entry, channel, query string, inputs map[string]interface{}, bypass bool) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	if bypass {
+		answerCacheLookups.Inc(channel, "bypass")
+		return "", false
+	}
+	answer, err := c.store.Get(c.key(query, inputs))
+	if err != nil {
+		if !errors.Is(err, store.ErrNotFound) {
+			log.WithError(err).Warn("Failed to read the answer cache")
+		}
+		answerCacheLookups.Inc(channel, "miss")
+		return "", false
+	}
+	answerCacheLookups.Inc(channel, "hit")
+	return string(answer), true
+}
+
+// add caches answer to query, unless the cache is full. Entries are
+// counted per TTL period; an entry outlives its period by at most one, so
+// the last two periods' counts bound the live entries.
+func (c *answerCache) add(log *logrus.Entry, query string, inputs map[string]interface{}, answer string) {
+	if c == nil || answer == "" {
+		return
+	}
+	period := time.Now().UnixNano() / int64(c.cfg.TTL)
+	var previous int64
+	if raw, err := c.store.Get(answerCacheCountKey(period - 1)); err == nil {
+		previous, _ = strconv.ParseInt(string(raw), 10, 64)
+	}
+	n, err := c.store.Incr(answerCacheCountKey(period), 2*c.cfg.TTL)
+	if err != nil {
+		log.WithError(err).Warn("Failed to count the answer cache entries")
+		return
+	}
+	if previous+n > int64(c.cfg.MaxEntries) {
+		log.WithField("max_entries", c.cfg.MaxEntries).Debug("Answer cache full, not caching the answer")
+		return
+	}
+	if err := c.store.Set(c.key(query, inputs), []byte(answer), c.cfg.TTL); err != nil {
+		log.WithError(err).Warn("Failed to cache the answer")
+	}
+}
+
+// answerCacheCountKey is the store key counting the answers cached in a
+// TTL period
+func answerCacheCountKey(period int64) string {
+	return "answer-cache-count:" + strconv.FormatInt(period, 10)
+}
+
+// answerCached replies with an answer from the answer cache
+func (p *MessagePipeline) answerCached(t *messageTrace, msg ChannelMessage, answer string) {
+	t.outcome = outcomeCached
+	t.log.WithField("answer_cache", "hit").Info("Answering from the answer cache")
+	p.reply(t, Reply{Message: msg, Text: answer, Answer: true, First: true, Last: true})
+	p.publish(t.log, config.EventMessageAnswered, msg, answer, "", "", "")
+}
@@ -0,0 +1,109 @@
+package gateapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tracoco/DifyGate/config"
+	"github.com/tracoco/DifyGate/store"
+)
+
+func TestPipelineCachesFirstAnswers(t *testing.T) {
+	p, sender, dify, kv := newTestPipeline(t, PipelineOptions{Channel: "cache"}, config.ChatConfig{},
+		func(req ChatMessageRequest) []StreamingChatResponse {
+			return difyAnswer("conv-"+req.User, "Dify: "+req.Query)
+		})
+	p.cache = newAnswerCache(config.AnswerCacheConfig{Enabled: true, TTL: time.Hour, MaxEntries: 1}, config.DifyConfig{}, kv)
+	asked := func() int {
+		dify.mu.Lock()
+		defer dify.mu.Unlock()
+		return len(dify.requests)
+	}
+	before := answerCacheLookups.Value("cache", "hit")
+
+	for _, tc := range []struct {
+		user, text, want string
+		asks             int
+	}{
+		{"u1", "What are your hours?", "Dify: What are your hours?", 1},
+		// Case and spacing don't matter
+		{"u2", "  what are your   HOURS? ", "Dify: What are your hours?", 1},
+		// u1 is in a conversation now, so its context counts
+		{"u1", "What are your hours?", "Dify: What are your hours?", 2},
+		// The cache is full, so this answer isn't kept
+		{"u3", "Where are you?", "Dify: Where are you?", 3},
+		{"u4", "Where are you?", "Dify: Where are you?", 4},
+	} {
+		p.Handle(testEntry(), ChannelMessage{ChannelID: "bot", UserID: tc.user, Text: tc.text})
+		if got := sender.sent(); len(got) != 1 || got[0] != tc.want {
+			t.Errorf("%s %q: sent %q, want %q", tc.user, tc.text, got, tc.want)
+		}
+		if got := asked(); got != tc.asks {
+			t.Errorf("%s %q: Dify asked %d times, want %d", tc.user, tc.text, got, tc.asks)
+		}
+	}
+	if got := answerCacheLookups.Value("cache", "hit") - before; got != 1 {
+		t.Errorf("%v cache hits counted, want 1", got)
+	}
+	if _, err := kv.Get(p.conversationKey(ChannelMessage{ChannelID: "bot", UserID: "u2"})); err == nil {
+		t.Error("a cached answer started a conversation")
+	}
+}
+
+func TestChatJobsUseAnswerCache(t *testing.T) {
+	dify, difyHandler := newFakeDify(t, func(req ChatMessageRequest) []StreamingChatResponse {
+		return difyAnswer("conv-1", "Answer to "+req.Query)
+	})
+	kv := store.New("", quietLogger())
+	jobs := NewChatJobsHandler(config.ChatJobsConfig{TTL: time.Hour, MaxConcurrent: 1, MaxQueued: 5},
+		config.ChatConfig{}, config.DifyConfig{StreamTimeout: 5 * time.Second}, difyHandler, kv, quietLogger())
+	jobs.cache = newAnswerCache(config.AnswerCacheConfig{Enabled: true, TTL: time.Hour, MaxEntries: 10}, config.DifyConfig{}, kv)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/jobs", jobs.Submit)
+	r.GET("/jobs/:id", jobs.Get)
+	run := func(body, cacheControl string) ChatJob {
+		t.Helper()
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/jobs", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Cache-Control", cacheControl)
+		r.ServeHTTP(w, req)
+		var job ChatJob
+		json.Unmarshal(w.Body.Bytes(), &job)
+		for deadline := time.Now().Add(5 * time.Second); !job.finished() && time.Now().Before(deadline); {
+			time.Sleep(10 * time.Millisecond)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/jobs/"+job.ID, nil))
+			json.Unmarshal(w.Body.Bytes(), &job)
+		}
+		return job
+	}
+
+	for _, tc := range []struct {
+		body, cacheControl string
+		cached             bool
+		asks               int
+	}{
+		{`{"query": "hi", "cacheable": true}`, "", false, 1},
+		{`{"query": "HI", "cacheable": true}`, "", true, 1},
+		// Not asked to be cached, in a conversation, or asked for fresh
+		{`{"query": "hi"}`, "", false, 2},
+		{`{"query": "hi", "cacheable": true, "conversation_id": "conv-1"}`, "", false, 3},
+		{`{"query": "hi", "cacheable": true}`, "no-cache", false, 4},
+	} {
+		job := run(tc.body, tc.cacheControl)
+		dify.mu.Lock()
+		asks := len(dify.requests)
+		dify.mu.Unlock()
+		if job.Status != chatJobDone || job.Answer != "Answer to hi" || job.Cached != tc.cached || asks != tc.asks {
+			t.Errorf("%s (%s): job %+v after %d Dify requests, want cached %v after %d", tc.body, tc.cacheControl, job, asks, tc.cached, tc.asks)
+		}
+	}
+}
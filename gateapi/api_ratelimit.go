@@ -0,0 +1,175 @@
+package gateapi
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/apierror"
+	"github.com/tracoco/DifyGate/config"
+	"github.com/tracoco/DifyGate/metrics"
+)
+
+// apiRateLimitSweepInterval is how often idle buckets are dropped
+const apiRateLimitSweepInterval = time.Minute
+
+var (
+	apiRateLimitAllowed = metrics.NewCounter("difygate_api_rate_limit_allowed_total",
+		"Protected API requests admitted by the rate limiter")
+	apiRateLimitRejected = metrics.NewCounter("difygate_api_rate_limit_rejected_total",
+		"Protected API requests rejected by the rate limiter")
+)
+
+// tokenBucket holds the tokens left for one caller
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	limit  config.TokenBucketConfig
+}
+
+// APIRateLimiter throttles the protected API with a token bucket per caller.
+// Buckets live in process memory, so each instance enforces its own limit.
+type APIRateLimiter struct {
+	// cfg is replaced when the configuration is reloaded
+	cfg atomic.Pointer[config.APIRateLimitConfig]
+	log *logrus.Logger
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// NewAPIRateLimiter creates a new API rate limiter
+func NewAPIRateLimiter(cfg config.APIRateLimitConfig, log *logrus.Logger) *APIRateLimiter {
+	l := &APIRateLimiter{
+		log:       log,
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+	l.reload(cfg)
+	return l
+}
+
+// reload applies new limits; buckets whose limit changed start full
+func (l *APIRateLimiter) reload(cfg config.APIRateLimitConfig) {
+	l.cfg.Store(&cfg)
+}
+
+// limitFor returns the limit for a caller, honoring per-key overrides
+func (l *APIRateLimiter) limitFor(keyName string) config.TokenBucketConfig {
+	cfg := l.cfg.Load()
+	if o, ok := cfg.Overrides[keyName]; ok && keyName != "" {
+		return o
+	}
+	return config.TokenBucketConfig{Rate: cfg.Rate, Burst: cfg.Burst}
+}
+
+// Allow takes a token from id's bucket and reports whether one was
+// available. When rejected, it also returns how long until the next token.
+func (l *APIRateLimiter) Allow(id, keyName string) (bool, time.Duration) {
+	return l.take(id, l.limitFor(keyName), true)
+}
+
+// take refills id's bucket and reports whether it holds a token, using it
+// up when consume is set
+func (l *APIRateLimiter) take(id string, limit config.TokenBucketConfig, consume bool) (bool, time.Duration) {
+	if limit.Rate <= 0 {
+		return true, 0
+	}
+
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) >= apiRateLimitSweepInterval {
+		l.sweep(now)
+	}
+
+	b, ok := l.buckets[id]
+	if !ok || b.limit != limit {
+		b = &tokenBucket{tokens: float64(limit.Burst), last: now, limit: limit}
+		l.buckets[id] = b
+	}
+
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		if consume {
+			b.tokens--
+		}
+		return true, 0
+	}
+
+	wait := time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+	return false, wait
+}
+
+// sweep drops buckets that have refilled completely, since a fresh bucket
+// is equivalent. Must be called with mu held.
+func (l *APIRateLimiter) sweep(now time.Time) {
+	for id, b := range l.buckets {
+		refill := time.Duration(float64(b.limit.Burst) / b.limit.Rate * float64(time.Second))
+		if now.Sub(b.last) >= refill {
+			delete(l.buckets, id)
+		}
+	}
+	l.lastSweep = now
+}
+
+// Middleware returns a Gin middleware enforcing the limit. It must run
+// after AuthMiddleware so callers are identified by their API key.
+func (l *APIRateLimiter) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := callerIdentity(c)
+		allowed, retryAfter := l.Allow(id, c.GetString(authKeyNameKey))
+		if !allowed {
+			apiRateLimitRejected.Inc()
+			requestLogger(c, l.log).WithField("caller", id).Warn("API rate limit exceeded")
+			abortRateLimited(c, retryAfter)
+			return
+		}
+
+		apiRateLimitAllowed.Inc()
+		c.Next()
+	}
+}
+
+// AuthFailureMiddleware throttles failed authentication per client IP. It
+// runs before AuthMiddleware, so an IP whose bucket was emptied by invalid
+// keys is turned away before its keys are looked up. Only 401 responses
+// take a token, so successful requests never count against the IP.
+func (l *APIRateLimiter) AuthFailureMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cfg := l.cfg.Load()
+		limit := config.TokenBucketConfig{Rate: cfg.Rate, Burst: cfg.Burst}
+		id := "auth_failure:ip:" + c.ClientIP()
+		if allowed, retryAfter := l.take(id, limit, false); !allowed {
+			apiRateLimitRejected.Inc()
+			requestLogger(c, l.log).WithField("caller", id).Warn("Too many failed authentication attempts")
+			abortRateLimited(c, retryAfter)
+			return
+		}
+
+		c.Next()
+
+		if c.Writer.Status() == http.StatusUnauthorized {
+			l.take(id, limit, true)
+		}
+	}
+}
+
+// abortRateLimited responds with 429 and a Retry-After of retryAfter
+func abortRateLimited(c *gin.Context, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	c.Header("Retry-After", strconv.Itoa(seconds))
+	apierror.Abort(c, http.StatusTooManyRequests, apierror.RateLimited,
+		fmt.Sprintf("Rate limit exceeded, retry in %d seconds", seconds))
+}
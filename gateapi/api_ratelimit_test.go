@@ -0,0 +1,143 @@
+package gateapi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/config"
+)
+
+func newTestAPIRateLimiter(cfg config.APIRateLimitConfig) *APIRateLimiter {
+	log := logrus.New()
+	log.SetLevel(logrus.PanicLevel)
+	return NewAPIRateLimiter(cfg, log)
+}
+
+func TestAPIRateLimiterBurstBoundary(t *testing.T) {
+	l := newTestAPIRateLimiter(config.APIRateLimitConfig{Rate: 1, Burst: 3})
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.Allow("key:a", "a"); !ok {
+			t.Fatalf("request %d within burst was rejected", i+1)
+		}
+	}
+	ok, wait := l.Allow("key:a", "a")
+	if ok {
+		t.Fatal("request past the burst was allowed")
+	}
+	if wait <= 0 || wait > time.Second {
+		t.Errorf("retry after = %v, want within (0, 1s]", wait)
+	}
+	if ok, _ := l.Allow("key:b", "b"); !ok {
+		t.Error("another caller shares the exhausted bucket")
+	}
+}
+
+func TestAPIRateLimiterRefill(t *testing.T) {
+	l := newTestAPIRateLimiter(config.APIRateLimitConfig{Rate: 100, Burst: 1})
+	if ok, _ := l.Allow("key:a", "a"); !ok {
+		t.Fatal("first request rejected")
+	}
+	if ok, _ := l.Allow("key:a", "a"); ok {
+		t.Fatal("second request allowed before refill")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if ok, _ := l.Allow("key:a", "a"); !ok {
+		t.Error("request rejected after refill")
+	}
+}
+
+func TestAPIRateLimiterOverridesAndDisable(t *testing.T) {
+	l := newTestAPIRateLimiter(config.APIRateLimitConfig{
+		Rate:  1,
+		Burst: 1,
+		Overrides: map[string]config.TokenBucketConfig{
+			"batch":     {Rate: 1, Burst: 5},
+			"unlimited": {Rate: 0},
+		},
+	})
+	allowed := 0
+	for i := 0; i < 10; i++ {
+		if ok, _ := l.Allow("key:batch", "batch"); ok {
+			allowed++
+		}
+	}
+	if allowed != 5 {
+		t.Errorf("override allowed %d requests, want 5", allowed)
+	}
+	for i := 0; i < 10; i++ {
+		if ok, _ := l.Allow("key:unlimited", "unlimited"); !ok {
+			t.Fatal("rate 0 should disable the limit")
+		}
+	}
+}
+
+func TestAPIRateLimiterConcurrent(t *testing.T) {
+	const burst = 50
+	l := newTestAPIRateLimiter(config.APIRateLimitConfig{Rate: 0.001, Burst: burst})
+	var allowed int64
+	var wg sync.WaitGroup
+	for i := 0; i < 4*burst; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if ok, _ := l.Allow("key:a", "a"); ok {
+				atomic.AddInt64(&allowed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if allowed != burst {
+		t.Errorf("allowed %d concurrent requests, want exactly %d", allowed, burst)
+	}
+}
+
+func TestAuthFailureMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	l := newTestAPIRateLimiter(config.APIRateLimitConfig{Rate: 0.001, Burst: 2})
+	var authChecks int
+	r := gin.New()
+	r.Use(l.AuthFailureMiddleware())
+	r.GET("/", func(c *gin.Context) {
+		authChecks++
+		if c.GetHeader("X-API-Key") != "good" {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		c.Status(http.StatusOK)
+	})
+	get := func(ip, key string) int {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = ip + ":1234"
+		req.Header.Set("X-API-Key", key)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	for i := 0; i < 5; i++ {
+		if code := get("192.0.2.1", "good"); code != http.StatusOK {
+			t.Fatalf("valid key got %d; successful requests must not drain the bucket", code)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if code := get("192.0.2.1", "bad"); code != http.StatusUnauthorized {
+			t.Fatalf("invalid key %d got %d, want 401", i+1, code)
+		}
+	}
+	checks := authChecks
+	if code := get("192.0.2.1", "bad"); code != http.StatusTooManyRequests {
+		t.Fatalf("invalid key past the burst got %d, want 429", code)
+	}
+	if authChecks != checks {
+		t.Error("throttled request still reached authentication")
+	}
+	if code := get("192.0.2.2", "bad"); code != http.StatusUnauthorized {
+		t.Errorf("another IP got %d, want 401", code)
+	}
+}
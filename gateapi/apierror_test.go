@@ -0,0 +1,89 @@
+package gateapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/tracoco/DifyGate/apierror"
+	"github.com/tracoco/DifyGate/config"
+)
+
+// TestErrorEnvelope checks errors from middleware, handlers and the router
+// share the envelope, with the request ID and field-level details
+func TestErrorEnvelope(t *testing.T) {
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Auth.APIKey = "test-key"
+	r := newTestRouter(t, cfg)
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		key        string
+		body       string
+		wantStatus int
+		wantCode   string
+		wantFields []apierror.FieldError
+	}{
+		{"missing key", http.MethodGet, "/api/v1/version", "", "", http.StatusUnauthorized, apierror.AuthRequired, nil},
+		{"unknown key", http.MethodGet, "/api/v1/version", "wrong", "", http.StatusUnauthorized, apierror.InvalidCredentials, nil},
+		{"unknown route", http.MethodGet, "/api/v1/nope", "test-key", "", http.StatusNotFound, apierror.NotFound, nil},
+		{"malformed body", http.MethodPost, "/api/v1/emails/send", "test-key", `{"to":`, http.StatusBadRequest, apierror.InvalidBody, nil},
+		{"missing fields", http.MethodPost, "/api/v1/emails/send", "test-key", `{"to": "a@example.com", "body": "hi"}`, http.StatusBadRequest, apierror.InvalidRequest,
+			[]apierror.FieldError{{Field: "subject", Rule: "required", Message: "subject is required"}}},
+		{"wrong type", http.MethodPost, "/api/v1/emails/send", "test-key", `{"to": "a@example.com", "subject": 1, "body": "hi"}`, http.StatusBadRequest, apierror.InvalidRequest,
+			[]apierror.FieldError{{Field: "subject", Rule: "type", Message: "subject must be a string"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-Request-ID", "req-1")
+			if tt.key != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.key)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			var env struct {
+				Error struct {
+					Code    string `json:"code"`
+					Message string `json:"message"`
+					Details struct {
+						Fields []apierror.FieldError `json:"fields"`
+					} `json:"details"`
+				} `json:"error"`
+				RequestID string `json:"request_id"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &env); err != nil {
+				t.Fatalf("body %s: %v", w.Body, err)
+			}
+			if env.Error.Code != tt.wantCode || env.Error.Message == "" {
+				t.Errorf("error = %+v, want code %s with a message", env.Error, tt.wantCode)
+			}
+			if _, ok := apierror.Codes[env.Error.Code]; !ok {
+				t.Errorf("code %s isn't in the registry", env.Error.Code)
+			}
+			if env.RequestID != "req-1" {
+				t.Errorf("request_id = %q, want req-1", env.RequestID)
+			}
+			if len(env.Error.Details.Fields) != len(tt.wantFields) {
+				t.Fatalf("fields = %+v, want %+v", env.Error.Details.Fields, tt.wantFields)
+			}
+			for i, f := range tt.wantFields {
+				if env.Error.Details.Fields[i] != f {
+					t.Errorf("field %d = %+v, want %+v", i, env.Error.Details.Fields[i], f)
+				}
+			}
+		})
+	}
+}
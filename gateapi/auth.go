@@ -1,48 +1,189 @@
 package gateapi
 
 import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
 	"net/http"
-	"os"
 	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/apierror"
+	"github.com/tracoco/DifyGate/config"
 )
 
-// AuthMiddleware creates a middleware that checks for a valid API key in the Authorization header
-func AuthMiddleware(log *logrus.Logger) gin.HandlerFunc {
+const (
+	// authKeyNameKey is the Gin context key holding the authenticated key's name
+	authKeyNameKey = "auth_key_name"
+	// authScopesKey is the Gin context key holding the authenticated key's scopes
+	authScopesKey = "auth_scopes"
+)
+
+// Scopes granted to API keys
+const (
+	ScopeEmailSend = "email:send"
+	ScopeChat      = "chat"
+	ScopeAdmin     = "admin"
+	ScopeHooks     = "hooks"
+	// ScopeWhatsAppSend allows proactive WhatsApp messages
+	ScopeWhatsAppSend = "whatsapp:send"
+)
+
+// authKey is a configured API key reduced to its digest
+type authKey struct {
+	digest     [sha256.Size]byte
+	name       string
+	scopes     []string
+	deprecated bool
+}
+
+// AuthMiddleware creates a middleware that checks for a valid API key in the
+// Authorization header and records the key's name and scopes in the context.
+// Presented keys are hashed and compared to the configured digests in
+// constant time, so plaintext keys need not be configured at all. Each use
+// is recorded in usage when it is non-nil. When JWT validation is
+// configured, a bearer token that isn't a known key is checked as a JWT.
+func AuthMiddleware(cfg config.AuthConfig, usage *KeyUsage, clients *HTTPClients, log *logrus.Logger) gin.HandlerFunc {
+	var keys []authKey
+	for _, k := range cfg.EffectiveKeys() {
+		digest, err := k.Digest()
+		if err != nil {
+			// Validate rejects these, so this only guards direct callers
+			log.WithError(err).WithField("key_name", k.Name).Error("Skipping unusable API key")
+			continue
+		}
+		keys = append(keys, authKey{digest: digest, name: k.Name, scopes: k.Scopes, deprecated: k.Deprecated})
+	}
+
+	var jwtVerifier *JWTVerifier
+	jwtBroken := false
+	if cfg.JWT.Enabled() {
+		var err error
+		if jwtVerifier, err = NewJWTVerifier(cfg.JWT, clients); err != nil {
+			// Validate rejects unusable keys, so this only guards direct
+			// callers; refuse everything rather than quietly drop JWT auth
+			log.WithError(err).Error("JWT authentication misconfigured, rejecting all requests")
+			jwtBroken = true
+		}
+	}
+
 	return func(c *gin.Context) {
-		apiKey := os.Getenv("DIFYGATE_API_KEY")
-		if apiKey == "" {
-			log.Error("API key not configured in environment variables")
-			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "API authentication not properly configured"})
+		if jwtBroken || (len(keys) == 0 && jwtVerifier == nil) {
+			requestLogger(c, log).Error("API key not configured")
+			apierror.Abort(c, http.StatusInternalServerError, apierror.AuthNotConfigured, "API authentication not properly configured")
 			return
 		}
 
 		// Get the Authorization header
 		authHeader := c.GetHeader("Authorization")
 		if authHeader == "" {
-			log.Warn("Attempted access without Authorization header")
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Authorization header required"})
+			requestLogger(c, log).Warn("Attempted access without Authorization header")
+			apierror.Abort(c, http.StatusUnauthorized, apierror.AuthRequired, "Authorization header required")
 			return
 		}
 
 		// Check if the Authorization header has the correct format
 		parts := strings.Split(authHeader, " ")
 		if len(parts) != 2 || strings.ToLower(parts[0]) != "bearer" {
-			log.Warn("Invalid Authorization header format")
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid authorization format, expected 'Bearer API_KEY'"})
+			requestLogger(c, log).Warn("Invalid Authorization header format")
+			apierror.Abort(c, http.StatusUnauthorized, apierror.InvalidCredentials, "Invalid authorization format, expected 'Bearer API_KEY'")
 			return
 		}
 
-		// Check if the API key is correct
-		if parts[1] != apiKey {
-			log.Warn("Invalid API key provided")
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid API key"})
+		// Check if the API key is known
+		key, ok := matchKey(keys, parts[1])
+		if !ok && jwtVerifier != nil {
+			identity, err := jwtVerifier.Verify(c.Request.Context(), parts[1])
+			if err != nil {
+				requestLogger(c, log).WithError(err).Warn("Invalid JWT provided")
+				apierror.Abort(c, http.StatusUnauthorized, apierror.InvalidToken, jwtErrorMessage(err))
+				return
+			}
+			if usage != nil {
+				usage.Record("jwt:" + identity.subject)
+			}
+			c.Set(authKeyNameKey, "jwt:"+identity.subject)
+			c.Set(authScopesKey, identity.scopes)
+			c.Next()
+			return
+		}
+		if !ok {
+			requestLogger(c, log).Warn("Invalid API key provided")
+			apierror.Abort(c, http.StatusUnauthorized, apierror.InvalidCredentials, "Invalid API key")
 			return
 		}
 
 		// API key is valid, proceed
+		if key.deprecated {
+			requestLogger(c, log).WithFields(logrus.Fields{
+				"key_name":  key.name,
+				"client_ip": c.ClientIP(),
+			}).Warn("Deprecated API key used, client should move to the current key")
+		}
+		if usage != nil {
+			usage.Record(key.name)
+		}
+		c.Set(authKeyNameKey, key.name)
+		c.Set(authScopesKey, key.scopes)
+		c.Next()
+	}
+}
+
+// jwtErrorMessage returns the client-facing message for a JWT failure;
+// anything other than a token error (e.g. a JWKS outage) stays generic
+func jwtErrorMessage(err error) string {
+	for _, known := range []error{
+		errTokenMalformed, errTokenAlgorithm, errTokenSignature, errTokenExpired,
+		errTokenNotYetValid, errTokenIssuer, errTokenAudience, errTokenIdentity, errTokenKeyUnknown,
+	} {
+		if errors.Is(err, known) {
+			return known.Error()
+		}
+	}
+	return "Unable to validate token"
+}
+
+// matchKey finds the key whose digest matches token. Every key is compared
+// so the time taken doesn't reveal which one matched.
+func matchKey(keys []authKey, token string) (authKey, bool) {
+	digest := sha256.Sum256([]byte(token))
+
+	var match authKey
+	found := false
+	for _, k := range keys {
+		if subtle.ConstantTimeCompare(digest[:], k.digest[:]) == 1 {
+			match, found = k, true
+		}
+	}
+	return match, found
+}
+
+// hasScope reports whether the authenticated key grants scope
+func hasScope(c *gin.Context, scope string) bool {
+	scopes, _ := c.Get(authScopesKey)
+	granted, _ := scopes.([]string)
+	for _, s := range granted {
+		if s == scope || s == config.ScopeAll {
+			return true
+		}
+	}
+	return false
+}
+
+// RequireScope returns a middleware rejecting keys without scope with 403.
+// It must run after AuthMiddleware.
+func RequireScope(scope string, log *logrus.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !hasScope(c, scope) {
+			requestLogger(c, log).WithFields(logrus.Fields{
+				"key_name": c.GetString(authKeyNameKey),
+				"scope":    scope,
+			}).Warn("API key lacks required scope")
+			apierror.AbortWithDetails(c, http.StatusForbidden, apierror.InsufficientScope, "API key lacks the '"+scope+"' scope",
+				map[string]interface{}{"scope": scope})
+			return
+		}
 		c.Next()
 	}
 }
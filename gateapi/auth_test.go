@@ -0,0 +1,175 @@
+package gateapi
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tracoco/DifyGate/config"
+	"github.com/tracoco/DifyGate/store"
+)
+
+// authRouter serves GET /chat, needing the chat scope, behind
+// AuthMiddleware, answering with the name of the key used
+func authRouter(cfg config.AuthConfig, usage *KeyUsage) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/chat", AuthMiddleware(cfg, usage, &HTTPClients{}, quietLogger()), RequireScope(ScopeChat, quietLogger()), func(c *gin.Context) {
+		c.String(http.StatusOK, c.GetString(authKeyNameKey))
+	})
+	return r
+}
+
+// authGet calls GET /chat with the Authorization header, if any
+func authGet(r *gin.Engine, authorization string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/chat", nil)
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	r := authRouter(config.AuthConfig{Keys: []config.APIKeyConfig{
+		{Key: "chat-key", Name: "support", Scopes: []string{ScopeChat}},
+		{Key: "email-key", Name: "reporting", Scopes: []string{ScopeEmailSend}},
+		{Key: "all-key", Name: "ops", Scopes: []string{config.ScopeAll}},
+	}}, nil)
+	tests := []struct {
+		name          string
+		authorization string
+		want          int
+		// code is the error code, or the key name the handler saw
+		code string
+	}{
+		{"missing key", "", http.StatusUnauthorized, "auth_required"},
+		{"not a bearer token", "Basic chat-key", http.StatusUnauthorized, "invalid_credentials"},
+		{"unknown key", "Bearer other-key", http.StatusUnauthorized, "invalid_credentials"},
+		{"wrong scope", "Bearer email-key", http.StatusForbidden, "insufficient_scope"},
+		{"right scope", "Bearer chat-key", http.StatusOK, "support"},
+		{"every scope", "Bearer all-key", http.StatusOK, "ops"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := authGet(r, tt.authorization)
+			if w.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if tt.want == http.StatusOK && w.Body.String() != tt.code {
+				t.Errorf("key name %q, want %q", w.Body, tt.code)
+			}
+			if tt.want != http.StatusOK && !strings.Contains(w.Body.String(), `"code":"`+tt.code+`"`) {
+				t.Errorf("body %s, want code %s", w.Body, tt.code)
+			}
+		})
+	}
+}
+
+func TestAuthMiddlewareHashedKeys(t *testing.T) {
+	sum := sha256.Sum256([]byte("s3cret-key"))
+	digest := hex.EncodeToString(sum[:])
+	r := authRouter(config.AuthConfig{
+		APIKeySHA256: digest,
+		Keys:         []config.APIKeyConfig{{KeySHA256: digest, Name: "hashed", Scopes: []string{ScopeChat}}},
+	}, nil)
+	tests := []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{"plaintext", "s3cret-key", http.StatusOK},
+		{"one character off", "s3cret-kez", http.StatusUnauthorized},
+		{"prefix", "s3cret-ke", http.StatusUnauthorized},
+		{"trailing space", "s3cret-key ", http.StatusUnauthorized},
+		// The digest is no password
+		{"the digest itself", digest, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := authGet(r, "Bearer "+tt.token); w.Code != tt.want {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+
+	// The hash takes precedence over a plaintext key alongside it
+	r = authRouter(config.AuthConfig{APIKey: "plain-key", APIKeySHA256: digest}, nil)
+	if w := authGet(r, "Bearer plain-key"); w.Code != http.StatusUnauthorized {
+		t.Errorf("plaintext beside the hash: status %d, want 401", w.Code)
+	}
+	if w := authGet(r, "Bearer s3cret-key"); w.Code != http.StatusOK || w.Body.String() != "default" {
+		t.Errorf("hashed default key: status %d: %s", w.Code, w.Body)
+	}
+}
+
+// hs256Token signs claims with secret
+func hs256Token(t *testing.T, secret string, claims map[string]interface{}) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": "HS256", "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestAuthMiddlewareKeyRotation(t *testing.T) {
+	usage := NewKeyUsage(store.New("", quietLogger()), quietLogger())
+	cfg := config.AuthConfig{
+		APIKey:          "new-key",
+		PreviousAPIKeys: []string{"old-key"},
+		JWT:             config.JWTConfig{HMACSecret: "jwt-secret", IdentityClaim: "sub", ScopesClaim: "scope"},
+	}
+	r := authRouter(cfg, usage)
+
+	// Both keys work while clients move over
+	for token, name := range map[string]string{"new-key": "default", "old-key": "default-previous-1"} {
+		if w := authGet(r, "Bearer "+token); w.Code != http.StatusOK || w.Body.String() != name {
+			t.Errorf("%s: status %d: %s", token, w.Code, w.Body)
+		}
+	}
+	token := hs256Token(t, "jwt-secret", map[string]interface{}{"sub": "billing", "scope": "chat", "exp": time.Now().Add(time.Hour).Unix()})
+	if w := authGet(r, "Bearer "+token); w.Code != http.StatusOK || w.Body.String() != "jwt:billing" {
+		t.Errorf("JWT: status %d: %s", w.Code, w.Body)
+	}
+
+	gin.SetMode(gin.TestMode)
+	report := gin.New()
+	report.GET("/usage", usage.UsageHandler(cfg))
+	w := httptest.NewRecorder()
+	report.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/usage", nil))
+	var resp struct {
+		Keys []KeyUsageEntry `json:"keys"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var used []string
+	for _, k := range resp.Keys {
+		if k.LastUsed == nil {
+			t.Errorf("%s has no last use", k.Name)
+			continue
+		}
+		if k.Deprecated {
+			used = append(used, k.Name+" (deprecated)")
+		} else {
+			used = append(used, k.Name)
+		}
+	}
+	if want := "default, default-previous-1 (deprecated), jwt:billing"; strings.Join(used, ", ") != want {
+		t.Errorf("usage lists %q, want %s", used, want)
+	}
+}
@@ -0,0 +1,57 @@
+package gateapi
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tracoco/DifyGate/apierror"
+)
+
+// bodyLimitKey holds the limit in force for the request
+const bodyLimitKey = "body_limit"
+
+// BodyLimitMiddleware caps the request body at limit bytes, or at the limit
+// of the longest route prefix in overrides that matches the route, so each
+// request gets exactly one limit. Bodies declared larger are rejected up
+// front with 413; others are cut off while reading, which handlers detect
+// with isBodyTooLarge.
+func BodyLimitMiddleware(limit int64, overrides map[string]int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limit := routeBodyLimit(c.FullPath(), limit, overrides)
+		c.Set(bodyLimitKey, limit)
+		if c.Request.ContentLength > limit {
+			abortBodyTooLarge(c)
+			return
+		}
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+		c.Next()
+	}
+}
+
+// routeBodyLimit returns the limit of the longest prefix in overrides that
+// route starts with, or limit when none does
+func routeBodyLimit(route string, limit int64, overrides map[string]int64) int64 {
+	matched := 0
+	for prefix, l := range overrides {
+		if len(prefix) > matched && strings.HasPrefix(route, prefix) {
+			limit, matched = l, len(prefix)
+		}
+	}
+	return limit
+}
+
+// isBodyTooLarge reports whether err came from reading past the body limit
+func isBodyTooLarge(err error) bool {
+	var maxErr *http.MaxBytesError
+	return errors.As(err, &maxErr)
+}
+
+// abortBodyTooLarge responds with 413 and a JSON error
+func abortBodyTooLarge(c *gin.Context) {
+	limit := c.GetInt64(bodyLimitKey)
+	apierror.AbortWithDetails(c, http.StatusRequestEntityTooLarge, apierror.BodyTooLarge,
+		fmt.Sprintf("Request body too large, limit is %d bytes", limit), map[string]interface{}{"limit": limit})
+}
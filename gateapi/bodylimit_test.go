@@ -0,0 +1,107 @@
+package gateapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tracoco/DifyGate/config"
+)
+
+// bodyLimitRouter mounts body-reading handlers the way RegisterRoutes
+// nests its groups
+func bodyLimitRouter() *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	v1 := r.Group("/api/v1")
+	v1.Use(BodyLimitMiddleware(1<<20, bodyLimits(config.ServerConfig{
+		MaxBodyBytes:        1 << 20,
+		WebhookMaxBodyBytes: 256 << 10,
+		EmailMaxBodyBytes:   25 << 20,
+	}, config.BroadcastConfig{MaxRecipients: 10000})))
+	read := func(c *gin.Context) {
+		if _, err := io.ReadAll(c.Request.Body); err != nil {
+			if isBodyTooLarge(err) {
+				abortBodyTooLarge(c)
+				return
+			}
+			c.Status(http.StatusBadRequest)
+			return
+		}
+		c.Status(http.StatusOK)
+	}
+	protected := v1.Group("")
+	protected.POST("/hooks/:name", read)
+	protected.Group("/emails").POST("/send", read)
+	protected.Group("/whatsapp").POST("/send", read)
+	v1.Group("").POST("/whatsapp/broadcast", read)
+	v1.Group("/whatsapp").POST("/webhook", read)
+	return r
+}
+
+func TestBodyLimitMiddleware(t *testing.T) {
+	tests := []struct {
+		name          string
+		path          string
+		size          int
+		contentLength bool
+		want          int
+	}{
+		{"email over API limit with Content-Length", "/api/v1/emails/send", 2 << 20, true, http.StatusOK},
+		{"email over API limit chunked", "/api/v1/emails/send", 2 << 20, false, http.StatusOK},
+		{"email over email limit", "/api/v1/emails/send", 26 << 20, true, http.StatusRequestEntityTooLarge},
+		{"hook within API limit", "/api/v1/hooks/x", 512 << 10, true, http.StatusOK},
+		{"hook over API limit", "/api/v1/hooks/x", 2 << 20, true, http.StatusRequestEntityTooLarge},
+		{"hook over API limit chunked", "/api/v1/hooks/x", 2 << 20, false, http.StatusRequestEntityTooLarge},
+		{"webhook over webhook limit", "/api/v1/whatsapp/webhook", 512 << 10, true, http.StatusRequestEntityTooLarge},
+		{"send next to the webhook over webhook limit", "/api/v1/whatsapp/send", 512 << 10, true, http.StatusOK},
+		{"broadcast over API limit", "/api/v1/whatsapp/broadcast", 2 << 20, true, http.StatusOK},
+	}
+	r := bodyLimitRouter()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body io.Reader = bytes.NewReader(make([]byte, tt.size))
+			if !tt.contentLength {
+				// Hide the length so only the reader's limit applies
+				body = io.MultiReader(body)
+			}
+			req := httptest.NewRequest(http.MethodPost, tt.path, body)
+			if !tt.contentLength {
+				req.ContentLength = -1
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestBodyLimitFitsLargestBroadcast(t *testing.T) {
+	recipients := make([]BroadcastRecipient, 10000)
+	for i := range recipients {
+		recipients[i] = BroadcastRecipient{
+			To: fmt.Sprintf("+1555%07d", i),
+			Components: []interface{}{map[string]interface{}{
+				"type":       "body",
+				"parameters": []interface{}{map[string]string{"type": "text", "text": fmt.Sprintf("Customer %d", i)}},
+			}},
+		}
+	}
+	body, _ := json.Marshal(BroadcastRequest{Recipients: recipients, Template: &WhatsAppTemplate{Name: "spring_sale"}})
+	if len(body) <= 1<<20 {
+		t.Fatalf("body of %d bytes doesn't test past the API limit", len(body))
+	}
+
+	w := httptest.NewRecorder()
+	bodyLimitRouter().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/whatsapp/broadcast", bytes.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Errorf("10,000-recipient broadcast of %d bytes answered %d", len(body), w.Code)
+	}
+}
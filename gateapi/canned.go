@@ -0,0 +1,264 @@
+package gateapi
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/apierror"
+	"github.com/tracoco/DifyGate/config"
+	"github.com/tracoco/DifyGate/metrics"
+	"github.com/tracoco/DifyGate/store"
+)
+
+// cannedAnswers counts messages answered with a canned response, by rule
+var cannedAnswers = metrics.NewCounter("difygate_canned_responses_total",
+	"Chat messages answered with a canned response instead of Dify", "channel", "rule")
+
+const (
+	// cannedResponsesKey holds the table once it is edited through the
+	// admin API; it then replaces the configured one
+	cannedResponsesKey = "canned-responses"
+	// cannedRefreshInterval is how soon edits made on another replica
+	// are picked up
+	cannedRefreshInterval = 10 * time.Second
+)
+
+// cannedRule is a canned response ready to match
+type cannedRule struct {
+	config.CannedResponseConfig
+	// pattern is the lowercased pattern of contains rules
+	pattern string
+	re      *regexp.Regexp
+}
+
+// matches reports whether the rule answers text
+func (r cannedRule) matches(text string) bool {
+	switch r.Match {
+	case config.CannedMatchExact:
+		return strings.TrimSpace(text) == strings.TrimSpace(r.Pattern)
+	case config.CannedMatchContains:
+		return strings.Contains(strings.ToLower(text), r.pattern)
+	case config.CannedMatchRegex:
+		return r.re.MatchString(text)
+	}
+	return false
+}
+
+// compileCanned prepares rules for matching; they have been validated
+func compileCanned(list []config.CannedResponseConfig) []cannedRule {
+	rules := make([]cannedRule, 0, len(list))
+	for _, r := range list {
+		rule := cannedRule{CannedResponseConfig: r, pattern: strings.ToLower(r.Pattern)}
+		if r.Match == config.CannedMatchRegex {
+			rule.re = regexp.MustCompile(r.Pattern)
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// cannedResponses is the table of canned responses shared by every
+// channel: the configured one until it is edited through the admin API,
+// then the one in the store
+type cannedResponses struct {
+	configured []config.CannedResponseConfig
+	store      store.Store
+
+	mu sync.Mutex
+	// rules are the table in use, stored says where it came from and
+	// loaded when
+	rules  []cannedRule
+	stored bool
+	loaded time.Time
+}
+
+func newCannedResponses(configured []config.CannedResponseConfig, kv store.Store) *cannedResponses {
+	return &cannedResponses{configured: configured, store: kv}
+}
+
+// reload replaces the configured table; it is in use at once unless the
+// table was edited through the admin API
+func (c *cannedResponses) reload(configured []config.CannedResponseConfig) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.configured, c.loaded = configured, time.Time{}
+}
+
+// load returns the table in use, reading the store at most every
+// cannedRefreshInterval. A store error keeps the table it had.
+func (c *cannedResponses) load(log *logrus.Entry) ([]cannedRule, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.loaded.IsZero() && time.Since(c.loaded) < cannedRefreshInterval {
+		return c.rules, c.stored
+	}
+	list, stored, err := c.read()
+	if err != nil {
+		log.WithError(err).Warn("Failed to load the canned responses")
+		if c.loaded.IsZero() {
+			c.rules = compileCanned(c.configured)
+		}
+	} else {
+		c.rules, c.stored = compileCanned(list), stored
+	}
+	c.loaded = time.Now()
+	return c.rules, c.stored
+}
+
+// read returns the stored table, or the configured one when none is
+// stored. Must be called with mu held.
+func (c *cannedResponses) read() (list []config.CannedResponseConfig, stored bool, err error) {
+	b, err := c.store.Get(cannedResponsesKey)
+	if errors.Is(err, store.ErrNotFound) {
+		return c.configured, false, nil
+	}
+	if err == nil {
+		err = json.Unmarshal(b, &list)
+	}
+	return list, err == nil, err
+}
+
+// save stores list as the table in use
+func (c *cannedResponses) save(list []config.CannedResponseConfig) error {
+	b, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	if err := c.store.Set(cannedResponsesKey, b, 0); err != nil {
+		return err
+	}
+	c.rules, c.stored, c.loaded = compileCanned(list), true, time.Now()
+	return nil
+}
+
+// match returns the first enabled rule answering text
+func (c *cannedResponses) match(log *logrus.Entry, text string) (config.CannedResponseConfig, bool) {
+	if c == nil {
+		return config.CannedResponseConfig{}, false
+	}
+	rules, _ := c.load(log)
+	for _, r := range rules {
+		if r.Enabled && r.matches(text) {
+			return r.CannedResponseConfig, true
+		}
+	}
+	return config.CannedResponseConfig{}, false
+}
+
+// answerCanned replies to msg with the canned response of rule
+func (p *MessagePipeline) answerCanned(t *messageTrace, msg ChannelMessage, rule config.CannedResponseConfig) {
+	t.outcome = outcomeCanned
+	cannedAnswers.Inc(p.opts.Channel, rule.Name)
+	t.log.WithField("canned_rule", rule.Name).Info("Answering with a canned response")
+	p.reply(t, Reply{Message: msg, Text: rule.Reply, Answer: true, First: true, Last: true})
+	p.publish(t.log, config.EventMessageAnswered, msg, rule.Reply, "", "", "")
+}
+
+// CannedResponsesHandler manages the canned response table at runtime
+type CannedResponsesHandler struct {
+	canned *cannedResponses
+	log    *logrus.Logger
+}
+
+// NewCannedResponsesHandler creates the handler of the canned response API
+func NewCannedResponsesHandler(canned *cannedResponses, log *logrus.Logger) *CannedResponsesHandler {
+	return &CannedResponsesHandler{canned: canned, log: log}
+}
+
+// List handles GET /admin/canned-responses. source is config until the
+// table is edited, then store.
+func (h *CannedResponsesHandler) List(c *gin.Context) {
+	h.canned.mu.Lock()
+	list, stored, err := h.canned.read()
+	h.canned.mu.Unlock()
+	if err != nil {
+		requestLogger(c, h.log).WithError(err).Error("Failed to load the canned responses")
+		apierror.Respond(c, http.StatusInternalServerError, apierror.Internal, "Failed to load the canned responses")
+		return
+	}
+	source := "config"
+	if stored {
+		source = "store"
+	}
+	if list == nil {
+		list = []config.CannedResponseConfig{}
+	}
+	c.JSON(http.StatusOK, gin.H{"source": source, "responses": list})
+}
+
+// Put handles PUT /admin/canned-responses/:name, replacing the rule of that
+// name or adding it at the end of the table
+func (h *CannedResponsesHandler) Put(c *gin.Context) {
+	var rule config.CannedResponseConfig
+	if err := c.ShouldBindJSON(&rule); err != nil {
+		apierror.RespondBinding(c, err)
+		return
+	}
+	rule.Name = c.Param("name")
+	if err := rule.Validate(); err != nil {
+		apierror.Respond(c, http.StatusBadRequest, apierror.InvalidRequest, err.Error())
+		return
+	}
+
+	h.edit(c, func(list []config.CannedResponseConfig) ([]config.CannedResponseConfig, bool) {
+		for i, r := range list {
+			if r.Name == rule.Name {
+				list[i] = rule
+				return list, true
+			}
+		}
+		return append(list, rule), true
+	}, func() {
+		requestLogger(c, h.log).WithField("canned_rule", rule.Name).Info("Canned response saved")
+		c.JSON(http.StatusOK, rule)
+	})
+}
+
+// Delete handles DELETE /admin/canned-responses/:name
+func (h *CannedResponsesHandler) Delete(c *gin.Context) {
+	name := c.Param("name")
+	h.edit(c, func(list []config.CannedResponseConfig) ([]config.CannedResponseConfig, bool) {
+		for i, r := range list {
+			if r.Name == name {
+				return append(list[:i], list[i+1:]...), true
+			}
+		}
+		return list, false
+	}, func() {
+		requestLogger(c, h.log).WithField("canned_rule", name).Info("Canned response deleted")
+		c.Status(http.StatusNoContent)
+	})
+}
+
+// edit applies change to a copy of the table and saves it, answering 404
+// when change reports nothing to change. Edits on one gateway are applied
+// in turn; with several replicas, the last write wins.
+func (h *CannedResponsesHandler) edit(c *gin.Context, change func([]config.CannedResponseConfig) ([]config.CannedResponseConfig, bool), done func()) {
+	h.canned.mu.Lock()
+	defer h.canned.mu.Unlock()
+
+	list, _, err := h.canned.read()
+	if err != nil {
+		requestLogger(c, h.log).WithError(err).Error("Failed to load the canned responses")
+		apierror.Respond(c, http.StatusInternalServerError, apierror.Internal, "Failed to load the canned responses")
+		return
+	}
+	list, ok := change(append([]config.CannedResponseConfig{}, list...))
+	if !ok {
+		apierror.Respond(c, http.StatusNotFound, apierror.NotFound, "Canned response not found")
+		return
+	}
+	if err := h.canned.save(list); err != nil {
+		requestLogger(c, h.log).WithError(err).Error("Failed to save the canned responses")
+		apierror.Respond(c, http.StatusInternalServerError, apierror.Internal, "Failed to save the canned responses")
+		return
+	}
+	done()
+}
@@ -0,0 +1,112 @@
+package gateapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tracoco/DifyGate/config"
+)
+
+func TestPipelineAnswersCannedResponses(t *testing.T) {
+	p, sender, dify, kv := newTestPipeline(t, PipelineOptions{Channel: "canned"}, config.ChatConfig{},
+		func(req ChatMessageRequest) []StreamingChatResponse {
+			return difyAnswer("conv-1", "Dify: "+req.Query)
+		})
+	p.canned = newCannedResponses([]config.CannedResponseConfig{
+		{Name: "hours", Match: config.CannedMatchContains, Pattern: "opening hours", Reply: "9 to 5", Enabled: true},
+		{Name: "where", Match: config.CannedMatchRegex, Pattern: `(?i)^where are you`, Reply: "Main St", Enabled: true},
+		{Name: "thanks", Match: config.CannedMatchExact, Pattern: "thanks", Reply: "You're welcome", Enabled: false},
+	}, kv)
+	before := cannedAnswers.Value("canned", "hours")
+
+	for _, tc := range []struct{ text, want string }{
+		{"What are your OPENING HOURS?", "9 to 5"},
+		{"Where are you located?", "Main St"},
+		{"thanks", "Dify: thanks"},
+		{"where do you ship?", "Dify: where do you ship?"},
+	} {
+		p.Handle(testEntry(), ChannelMessage{ChannelID: "bot", UserID: "u1", Text: tc.text})
+		if got := sender.sent(); len(got) != 1 || got[0] != tc.want {
+			t.Errorf("%q: sent %q, want %q", tc.text, got, tc.want)
+		}
+	}
+	dify.mu.Lock()
+	asked := len(dify.requests)
+	dify.mu.Unlock()
+	if asked != 2 {
+		t.Errorf("Dify was asked %d times, want only for the messages without a canned response", asked)
+	}
+	if got := cannedAnswers.Value("canned", "hours") - before; got != 1 {
+		t.Errorf("rule hours counted %v times, want 1", got)
+	}
+}
+
+func TestCannedResponsesAPI(t *testing.T) {
+	p, sender, _, kv := newTestPipeline(t, PipelineOptions{Channel: "canned"}, config.ChatConfig{},
+		func(req ChatMessageRequest) []StreamingChatResponse {
+			return difyAnswer("conv-1", "Dify: "+req.Query)
+		})
+	p.canned = newCannedResponses([]config.CannedResponseConfig{
+		{Name: "hours", Match: config.CannedMatchContains, Pattern: "hours", Reply: "9 to 5", Enabled: true},
+	}, kv)
+	h := NewCannedResponsesHandler(p.canned, quietLogger())
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/canned", h.List)
+	r.PUT("/canned/:name", h.Put)
+	r.DELETE("/canned/:name", h.Delete)
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+	list := func() (source string, names []string) {
+		w := do(http.MethodGet, "/canned", "")
+		var got struct {
+			Source    string                        `json:"source"`
+			Responses []config.CannedResponseConfig `json:"responses"`
+		}
+		if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &got) != nil {
+			t.Fatalf("list: status %d: %s", w.Code, w.Body)
+		}
+		for _, r := range got.Responses {
+			names = append(names, r.Name)
+		}
+		return got.Source, names
+	}
+
+	if source, names := list(); source != "config" || strings.Join(names, ",") != "hours" {
+		t.Errorf("before edits: source %q, rules %q", source, names)
+	}
+	if w := do(http.MethodPut, "/canned/where", `{"match": "regex", "pattern": "(", "reply": "Main St", "enabled": true}`); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid regex: status %d, want 400", w.Code)
+	}
+	if w := do(http.MethodPut, "/canned/where", `{"match": "exact", "pattern": "where?", "reply": "Main St", "enabled": true}`); w.Code != http.StatusOK {
+		t.Fatalf("put: status %d: %s", w.Code, w.Body)
+	}
+	if w := do(http.MethodDelete, "/canned/hours", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("delete: status %d: %s", w.Code, w.Body)
+	}
+	if w := do(http.MethodDelete, "/canned/hours", ""); w.Code != http.StatusNotFound {
+		t.Errorf("second delete: status %d, want 404", w.Code)
+	}
+	if source, names := list(); source != "store" || strings.Join(names, ",") != "where" {
+		t.Errorf("after edits: source %q, rules %q", source, names)
+	}
+
+	// The pipeline answers from the edited table at once
+	for _, tc := range []struct{ text, want string }{
+		{"where?", "Main St"},
+		{"hours?", "Dify: hours?"},
+	} {
+		p.Handle(testEntry(), ChannelMessage{ChannelID: "bot", UserID: "u1", Text: tc.text})
+		if got := sender.sent(); len(got) != 1 || got[0] != tc.want {
+			t.Errorf("%q: sent %q, want %q", tc.text, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,428 @@
+package gateapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/apierror"
+	"github.com/tracoco/DifyGate/config"
+	"github.com/tracoco/DifyGate/metrics"
+	"github.com/tracoco/DifyGate/store"
+)
+
+// chatJobsTotal counts finished chat jobs by outcome: done, failed or
+// cancelled
+var chatJobsTotal = metrics.NewCounter("difygate_chat_jobs_total",
+	"Chat jobs finished, by outcome", "outcome")
+
+// Chat job statuses
+const (
+	chatJobPending   = "pending"
+	chatJobRunning   = "running"
+	chatJobDone      = "done"
+	chatJobFailed    = "failed"
+	chatJobCancelled = "cancelled"
+)
+
+const (
+	// chatJobRetryAfter is suggested to a key with too many jobs
+	chatJobRetryAfter = 5 * time.Second
+	// chatJobStopTimeout bounds the call stopping a cancelled job's answer
+	chatJobStopTimeout = 10 * time.Second
+)
+
+// ChatJobRequest is a chat query to answer in the background
+type ChatJobRequest struct {
+	Query string `json:"query" binding:"required"`
+	// ConversationID continues a Dify conversation
+	ConversationID string `json:"conversation_id"`
+	// User is the Dify user; empty uses api:<key name>
+	User   string                 `json:"user"`
+	Inputs map[string]interface{} `json:"inputs"`
+	// Cacheable answers the query from the answer cache, and caches the
+	// answer, when it starts a conversation
+	Cacheable bool `json:"cacheable"`
+}
+
+// ChatJob is a chat query and its result, as stored and reported
+type ChatJob struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	// KeyName is the API key that submitted the job, the only one that
+	// may see it
+	KeyName        string        `json:"key_name"`
+	User           string        `json:"user"`
+	ConversationID string        `json:"conversation_id,omitempty"`
+	MessageID      string        `json:"message_id,omitempty"`
+	TaskID         string        `json:"task_id,omitempty"`
+	Answer         string        `json:"answer,omitempty"`
+	Usage          *DifyUsage    `json:"usage,omitempty"`
+	Error          *ChatJobError `json:"error,omitempty"`
+	CreatedAt      time.Time     `json:"created_at"`
+	StartedAt      *time.Time    `json:"started_at,omitempty"`
+	FinishedAt     *time.Time    `json:"finished_at,omitempty"`
+	// Cached is set when the answer came from the answer cache
+	Cached bool `json:"cached,omitempty"`
+}
+
+// ChatJobError says why a job failed, with the code the synchronous
+// endpoints would have answered
+type ChatJobError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// DifyCode is Dify's error code, when it gave one
+	DifyCode string `json:"dify_code,omitempty"`
+}
+
+// finished reports whether the job has come to an end
+func (j *ChatJob) finished() bool {
+	return j.Status == chatJobDone || j.Status == chatJobFailed || j.Status == chatJobCancelled
+}
+
+// chatJobKey is the store key of a chat job
+func chatJobKey(id string) string {
+	return "chat-job:" + id
+}
+
+// ChatJobsHandler answers chat queries in the background for callers that
+// can't hold a request open, e.g. behind a proxy with a short timeout.
+// Jobs run on the instance that accepted them; the per-key limits are
+// enforced by each instance on its own jobs.
+type ChatJobsHandler struct {
+	cfg         config.ChatJobsConfig
+	sanitize    config.SanitizeConfig
+	timeout     time.Duration
+	difyHandler *DifyHandler
+	store       store.Store
+	log         *logrus.Logger
+	// cache answers cacheable jobs asked before; nil always asks Dify
+	cache *answerCache
+
+	// mu guards the maps and orders the updates of a job on this instance
+	mu sync.Mutex
+	// slots hold a token for each running job, by key name
+	slots map[string]chan struct{}
+	// queued counts the unfinished jobs on this instance, by key name
+	queued map[string]int
+	// cancels stop the unfinished jobs on this instance, by ID
+	cancels map[string]context.CancelFunc
+}
+
+// NewChatJobsHandler creates a chat jobs handler; jobs call Dify with
+// DIFYGATE_DIFY_STREAM_TIMEOUT and are cleaned up like chat answers
+func NewChatJobsHandler(cfg config.ChatJobsConfig, chatCfg config.ChatConfig, difyCfg config.DifyConfig, difyHandler *DifyHandler, kv store.Store, log *logrus.Logger) *ChatJobsHandler {
+	return &ChatJobsHandler{
+		cfg:         cfg,
+		sanitize:    chatCfg.Sanitize,
+		timeout:     difyCfg.StreamTimeout,
+		difyHandler: difyHandler,
+		store:       kv,
+		log:         log,
+		slots:       make(map[string]chan struct{}),
+		queued:      make(map[string]int),
+		cancels:     make(map[string]context.CancelFunc),
+	}
+}
+
+// load returns the job id, or store.ErrNotFound
+func (h *ChatJobsHandler) load(id string) (*ChatJob, error) {
+	raw, err := h.store.Get(chatJobKey(id))
+	if err != nil {
+		return nil, err
+	}
+	var job ChatJob
+	if err := json.Unmarshal(raw, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// save stores job for DIFYGATE_CHAT_JOBS_TTL from now
+func (h *ChatJobsHandler) save(job *ChatJob) error {
+	raw, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return h.store.Set(chatJobKey(job.ID), raw, h.cfg.TTL)
+}
+
+// update applies change to the stored job and saves it, unless the job
+// has finished meanwhile, e.g. cancelled from another instance; it
+// returns the job as stored and whether it was changed
+func (h *ChatJobsHandler) update(id string, change func(*ChatJob)) (*ChatJob, bool, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	job, err := h.load(id)
+	if err != nil {
+		return nil, false, err
+	}
+	if job.finished() {
+		return job, false, nil
+	}
+	change(job)
+	return job, true, h.save(job)
+}
+
+// owned loads the job of the URL for the calling key, answering 404 for
+// jobs of other keys; ok is false when a response was sent
+func (h *ChatJobsHandler) owned(c *gin.Context) (*ChatJob, bool) {
+	job, err := h.load(c.Param("id"))
+	if errors.Is(err, store.ErrNotFound) || (err == nil && job.KeyName != c.GetString(authKeyNameKey)) {
+		apierror.Respond(c, http.StatusNotFound, apierror.NotFound, "Chat job not found")
+		return nil, false
+	}
+	if err != nil {
+		requestLogger(c, h.log).WithError(err).Error("Failed to load chat job")
+		apierror.Respond(c, http.StatusInternalServerError, apierror.Internal, "Failed to load the chat job")
+		return nil, false
+	}
+	return job, true
+}
+
+// Submit handles POST /chat/jobs: it checks and saves the job and answers
+// it in the background, answering 202 with the job for GET /chat/jobs/:id.
+// Cache-Control: no-cache asks Dify for a cacheable job even when its
+// answer is cached.
+func (h *ChatJobsHandler) Submit(c *gin.Context) {
+	reqLog := requestLogger(c, h.log)
+
+	var req ChatJobRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apierror.RespondBinding(c, err)
+		return
+	}
+	keyName := c.GetString(authKeyNameKey)
+	if req.User == "" {
+		req.User = "api:" + keyName
+	}
+
+	h.mu.Lock()
+	if h.queued[keyName] >= h.cfg.MaxQueued {
+		h.mu.Unlock()
+		c.Header("Retry-After", strconv.Itoa(int(chatJobRetryAfter.Seconds())))
+		apierror.Respond(c, http.StatusTooManyRequests, apierror.RateLimited, "Too many unfinished chat jobs for this API key")
+		return
+	}
+	h.queued[keyName]++
+	h.mu.Unlock()
+
+	job := &ChatJob{
+		ID:             newRequestID(),
+		Status:         chatJobPending,
+		KeyName:        keyName,
+		User:           req.User,
+		ConversationID: req.ConversationID,
+		CreatedAt:      time.Now().UTC(),
+	}
+	if err := h.save(job); err != nil {
+		h.release(job)
+		reqLog.WithError(err).Error("Failed to save chat job")
+		apierror.Respond(c, http.StatusInternalServerError, apierror.Internal, "Failed to save the chat job")
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	h.mu.Lock()
+	h.cancels[job.ID] = cancel
+	h.mu.Unlock()
+	fresh := strings.Contains(strings.ToLower(c.GetHeader("Cache-Control")), "no-cache")
+	go h.run(ctx, reqLog.WithField("chat_job_id", job.ID), job, req, fresh)
+	c.JSON(http.StatusAccepted, job)
+}
+
+// release forgets a job that no longer runs on this instance
+func (h *ChatJobsHandler) release(job *ChatJob) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.queued[job.KeyName]--
+	if h.queued[job.KeyName] <= 0 {
+		delete(h.queued, job.KeyName)
+	}
+	if cancel, ok := h.cancels[job.ID]; ok {
+		cancel()
+		delete(h.cancels, job.ID)
+	}
+}
+
+// slot returns the running-job tokens of a key
+func (h *ChatJobsHandler) slot(keyName string) chan struct{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.slots[keyName]
+	if !ok {
+		s = make(chan struct{}, h.cfg.MaxConcurrent)
+		h.slots[keyName] = s
+	}
+	return s
+}
+
+// run waits for a free slot of the job's key, asks Dify and stores the
+// answer or the error; a cancelled job is left as DELETE stored it. A
+// cacheable job answered from the cache takes no slot; fresh skips the
+// cache lookup.
+func (h *ChatJobsHandler) run(ctx context.Context, log *logrus.Entry, job *ChatJob, req ChatJobRequest, fresh bool) {
+	defer h.release(job)
+
+	// A query within a conversation is never stateless, whatever the
+	// caller says
+	cacheable := h.cache != nil && req.Cacheable && req.ConversationID == ""
+	if cacheable {
+		if answer, ok := h.cache.lookup(log, "api", req.Query, req.Inputs, fresh); ok {
+			h.finishCached(log, job, answer)
+			return
+		}
+	}
+
+	slot := h.slot(job.KeyName)
+	select {
+	case slot <- struct{}{}:
+		defer func() { <-slot }()
+	case <-ctx.Done():
+		return
+	}
+
+	if _, ok, err := h.update(job.ID, func(j *ChatJob) {
+		started := time.Now().UTC()
+		j.Status, j.StartedAt = chatJobRunning, &started
+	}); err != nil || !ok {
+		if err != nil {
+			log.WithError(err).Error("Failed to start chat job")
+		}
+		return
+	}
+
+	askCtx, cancel := context.WithTimeout(withLogger(ctx, log), h.timeout)
+	defer cancel()
+	answer, err := h.difyHandler.ask(askCtx, DifyChatMessageRequest{
+		Query:          req.Query,
+		ConversationID: req.ConversationID,
+		User:           job.User,
+		Inputs:         req.Inputs,
+	}, func(taskID string) {
+		// Saved so a DELETE, on any instance, can stop the answer
+		if _, _, err := h.update(job.ID, func(j *ChatJob) { j.TaskID = taskID }); err != nil {
+			log.WithError(err).Warn("Failed to save chat job task ID")
+		}
+	})
+
+	stored, ok, saveErr := h.update(job.ID, func(j *ChatJob) {
+		finished := time.Now().UTC()
+		j.FinishedAt = &finished
+		if err != nil {
+			j.Status, j.Error = chatJobFailed, chatJobError(err)
+			return
+		}
+		j.Status = chatJobDone
+		j.Answer = sanitizeAnswer(h.sanitize, answer.Answer, true)
+		j.ConversationID, j.MessageID, j.TaskID = answer.ConversationID, answer.MessageID, answer.TaskID
+		j.Usage = &answer.Usage
+	})
+	switch {
+	case saveErr != nil:
+		log.WithError(saveErr).Error("Failed to save chat job result")
+	case !ok:
+		log.Debug("Chat job finished after it was cancelled")
+	case err != nil:
+		chatJobsTotal.Inc(chatJobFailed)
+		log.WithError(err).Warn("Chat job failed")
+	default:
+		chatJobsTotal.Inc(chatJobDone)
+		log.WithFields(logrus.Fields{
+			"dify_conversation_id": stored.ConversationID,
+			"total_tokens":         stored.Usage.TotalTokens,
+		}).Info("Chat job done")
+		if cacheable {
+			h.cache.add(log, req.Query, req.Inputs, stored.Answer)
+		}
+	}
+}
+
+// finishCached stores the job as done with an answer from the answer
+// cache; no Dify conversation or message is started for it
+func (h *ChatJobsHandler) finishCached(log *logrus.Entry, job *ChatJob, answer string) {
+	_, ok, err := h.update(job.ID, func(j *ChatJob) {
+		finished := time.Now().UTC()
+		j.Status, j.StartedAt, j.FinishedAt = chatJobDone, &finished, &finished
+		j.Answer, j.Cached = answer, true
+	})
+	switch {
+	case err != nil:
+		log.WithError(err).Error("Failed to save chat job result")
+	case ok:
+		chatJobsTotal.Inc(chatJobDone)
+		log.WithField("answer_cache", "hit").Info("Chat job done from the answer cache")
+	}
+}
+
+// chatJobError describes err as the synchronous endpoints would answer it
+func chatJobError(err error) *ChatJobError {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return &ChatJobError{Code: apierror.DifyError, Message: "Dify didn't answer in time"}
+	}
+	apiErr, ok := asDifyAPIError(err)
+	if !ok {
+		return &ChatJobError{Code: apierror.DifyError, Message: "Failed to get an answer from Dify"}
+	}
+	if apiErr.Overloaded() {
+		return &ChatJobError{Code: apierror.DifyOverloaded, Message: "Dify is over its quota or rate limit", DifyCode: apiErr.Code}
+	}
+	return &ChatJobError{Code: apierror.DifyError, Message: "Failed to get an answer from Dify", DifyCode: apiErr.Code}
+}
+
+// Get handles GET /chat/jobs/:id, reporting the job with its result once
+// done
+func (h *ChatJobsHandler) Get(c *gin.Context) {
+	job, ok := h.owned(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, job)
+}
+
+// Cancel handles DELETE /chat/jobs/:id: an unfinished job is marked
+// cancelled, and its answer stopped in Dify once started. A finished job
+// is reported unchanged.
+func (h *ChatJobsHandler) Cancel(c *gin.Context) {
+	reqLog := requestLogger(c, h.log)
+	job, ok := h.owned(c)
+	if !ok {
+		return
+	}
+	job, ok, err := h.update(job.ID, func(j *ChatJob) {
+		finished := time.Now().UTC()
+		j.Status, j.FinishedAt = chatJobCancelled, &finished
+	})
+	if err != nil {
+		reqLog.WithError(err).Error("Failed to cancel chat job")
+		apierror.Respond(c, http.StatusInternalServerError, apierror.Internal, "Failed to cancel the chat job")
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusOK, job)
+		return
+	}
+	chatJobsTotal.Inc(chatJobCancelled)
+
+	if job.TaskID != "" {
+		ctx, cancel := context.WithTimeout(withLogger(c.Request.Context(), reqLog), chatJobStopTimeout)
+		defer cancel()
+		if err := h.difyHandler.StopMessage(ctx, job.TaskID, job.User); err != nil {
+			reqLog.WithError(err).WithField("dify_task_id", job.TaskID).Warn("Failed to stop the Dify answer of a cancelled chat job")
+		}
+	}
+	h.mu.Lock()
+	if cancel, ok := h.cancels[job.ID]; ok {
+		cancel()
+	}
+	h.mu.Unlock()
+	reqLog.WithField("chat_job_id", job.ID).Info("Chat job cancelled")
+	c.JSON(http.StatusOK, job)
+}
@@ -0,0 +1,130 @@
+package gateapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tracoco/DifyGate/config"
+	"github.com/tracoco/DifyGate/store"
+)
+
+func TestChatJobs(t *testing.T) {
+	// Dify answers at once, except "wait", which streams until stopped
+	var mu sync.Mutex
+	var stopped []string
+	stop := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/stop") {
+			mu.Lock()
+			stopped = append(stopped, r.URL.Path)
+			mu.Unlock()
+			close(stop)
+			w.Write([]byte(`{"result": "success"}`))
+			return
+		}
+		var req ChatMessageRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		w.Header().Set("Content-Type", "text/event-stream")
+		events := difyAnswer("conv-1", "Hello <think>hmm</think>there.")
+		events[len(events)-1].Metadata = map[string]interface{}{"usage": map[string]int{"total_tokens": 42}}
+		if req.Query == "wait" {
+			events = events[:1]
+		}
+		for _, event := range events {
+			data, _ := json.Marshal(event)
+			fmt.Fprintf(w, "data: %s\n\n", data)
+			w.(http.Flusher).Flush()
+		}
+		select {
+		case <-stop:
+		case <-r.Context().Done():
+		}
+	}))
+	t.Cleanup(srv.Close)
+	dify := NewDifyHandler(config.DifyConfig{BaseURL: srv.URL}, &HTTPClients{Dify: srv.Client(), DifyStream: srv.Client()}, quietLogger())
+	jobs := NewChatJobsHandler(config.ChatJobsConfig{TTL: time.Hour, MaxConcurrent: 1, MaxQueued: 2},
+		config.ChatConfig{Sanitize: config.SanitizeConfig{ThinkTags: true}}, config.DifyConfig{StreamTimeout: 5 * time.Second},
+		dify, store.New("", quietLogger()), quietLogger())
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(func(c *gin.Context) { c.Set(authKeyNameKey, c.GetHeader("X-Key")) })
+	r.POST("/jobs", jobs.Submit)
+	r.GET("/jobs/:id", jobs.Get)
+	r.DELETE("/jobs/:id", jobs.Cancel)
+	do := func(method, path, key, body string) (*httptest.ResponseRecorder, ChatJob) {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Key", key)
+		r.ServeHTTP(w, req)
+		var job ChatJob
+		json.Unmarshal(w.Body.Bytes(), &job)
+		return w, job
+	}
+	wait := func(id, status string) ChatJob {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			_, job := do(http.MethodGet, "/jobs/"+id, "crm", "")
+			if job.Status == status || time.Now().After(deadline) {
+				return job
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	if w, _ := do(http.MethodPost, "/jobs", "crm", `{"user": "u1"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("job without a query: status %d, want 400", w.Code)
+	}
+
+	w, slow := do(http.MethodPost, "/jobs", "crm", `{"query": "wait"}`)
+	if w.Code != http.StatusAccepted || slow.ID == "" || slow.User != "api:crm" {
+		t.Fatalf("submit: status %d: %s", w.Code, w.Body)
+	}
+	if job := wait(slow.ID, chatJobRunning); job.TaskID != "task-1" {
+		t.Fatalf("slow job %+v, want it running with Dify's task ID", job)
+	}
+
+	// The key's one slot is taken, so the next job waits, and a third is
+	// refused
+	_, queued := do(http.MethodPost, "/jobs", "crm", `{"query": "hi", "conversation_id": "conv-1"}`)
+	if w, _ := do(http.MethodPost, "/jobs", "crm", `{"query": "hi"}`); w.Code != http.StatusTooManyRequests {
+		t.Errorf("job over the queue limit: status %d, want 429", w.Code)
+	}
+	if job := wait(queued.ID, chatJobPending); job.Status != chatJobPending {
+		t.Errorf("queued job %q, want it pending behind the running one", job.Status)
+	}
+	if w, _ := do(http.MethodGet, "/jobs/"+slow.ID, "other", ""); w.Code != http.StatusNotFound {
+		t.Errorf("job of another key: status %d, want 404", w.Code)
+	}
+
+	w, cancelled := do(http.MethodDelete, "/jobs/"+slow.ID, "crm", "")
+	if w.Code != http.StatusOK || cancelled.Status != chatJobCancelled || cancelled.FinishedAt == nil {
+		t.Errorf("cancel: status %d: %s", w.Code, w.Body)
+	}
+	mu.Lock()
+	if len(stopped) != 1 || stopped[0] != "/chat-messages/task-1/stop" {
+		t.Errorf("stopped %q, want the running answer stopped in Dify", stopped)
+	}
+	mu.Unlock()
+
+	done := wait(queued.ID, chatJobDone)
+	if done.Status != chatJobDone || done.Answer != "Hello there." || done.ConversationID != "conv-1" ||
+		done.MessageID != "msg-1" || done.Usage == nil || done.Usage.TotalTokens != 42 {
+		t.Errorf("queued job %+v, want it done with the cleaned-up answer and usage", done)
+	}
+	if job := wait(slow.ID, chatJobCancelled); job.Status != chatJobCancelled || job.Answer != "" {
+		t.Errorf("cancelled job %+v, want it left cancelled", job)
+	}
+	if w, job := do(http.MethodDelete, "/jobs/"+done.ID, "crm", ""); w.Code != http.StatusOK || job.Status != chatJobDone {
+		t.Errorf("cancelling a finished job: status %d: %s, want it unchanged", w.Code, w.Body)
+	}
+}
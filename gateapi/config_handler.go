@@ -0,0 +1,58 @@
+package gateapi
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/apierror"
+	"github.com/tracoco/DifyGate/config"
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigHandler handles GET /admin/config, reporting the configuration the
+// gateway runs with under its YAML names. Fields tagged `secret:"true"`
+// show only their last characters and a fingerprint; fingerprint is the
+// SHA-256 of the whole response config, equal on instances configured alike.
+// restart_required lists reloaded settings that aren't in effect yet.
+func ConfigHandler(rl *Reloader, log *logrus.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		effective, err := effectiveConfig(rl.Config())
+		if err != nil {
+			requestLogger(c, log).WithError(err).Error("Failed to render the configuration")
+			apierror.Respond(c, http.StatusInternalServerError, apierror.Internal, "Failed to render the configuration")
+			return
+		}
+		// Map keys are sorted, so the same configuration always gives the
+		// same bytes
+		b, err := json.Marshal(effective)
+		if err != nil {
+			requestLogger(c, log).WithError(err).Error("Failed to render the configuration")
+			apierror.Respond(c, http.StatusInternalServerError, apierror.Internal, "Failed to render the configuration")
+			return
+		}
+		sum := sha256.Sum256(b)
+		c.JSON(http.StatusOK, gin.H{
+			"config":           json.RawMessage(b),
+			"fingerprint":      "sha256:" + hex.EncodeToString(sum[:]),
+			"restart_required": rl.RestartRequired(),
+		})
+	}
+}
+
+// effectiveConfig renders cfg with its secrets masked, going through YAML
+// so fields keep the names of the configuration file
+func effectiveConfig(cfg *config.Config) (map[string]interface{}, error) {
+	out, err := yaml.Marshal(cfg.Fingerprinted())
+	if err != nil {
+		return nil, err
+	}
+	var effective map[string]interface{}
+	if err := yaml.Unmarshal(out, &effective); err != nil {
+		return nil, err
+	}
+	return effective, nil
+}
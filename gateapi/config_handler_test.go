@@ -0,0 +1,62 @@
+package gateapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tracoco/DifyGate/config"
+	"github.com/tracoco/DifyGate/gate"
+)
+
+func TestConfigHandlerMasksSecrets(t *testing.T) {
+	cfg := &config.Config{
+		DIFYGATE: gate.DIFYGateConfig{Host: "smtp.example.com", Port: 587, Password: "smtp-password-1234"},
+		Dify:     config.DifyConfig{BaseURL: "https://dify.example.com/v1", APIKey: "app-abcdefghijklWXYZ", StreamTimeout: 30 * time.Second},
+		Auth:     config.AuthConfig{PreviousAPIKeys: []string{"short"}},
+		Hooks:    []config.HookConfig{{Name: "alerts", Secret: "hook-secret-value"}},
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/admin/config", ConfigHandler(NewReloader(cfg, nil, quietLogger()), quietLogger()))
+	get := func() (string, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/config", nil))
+		var got struct {
+			Config      map[string]interface{} `json:"config"`
+			Fingerprint string                 `json:"fingerprint"`
+		}
+		if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &got) != nil {
+			t.Fatalf("status %d: %s", w.Code, w.Body)
+		}
+		return w.Body.String(), got.Config
+	}
+
+	body, got := get()
+	for _, secret := range []string{"smtp-password", "app-abcdefghijkl", "short", "hook-secret"} {
+		if strings.Contains(body, secret) {
+			t.Errorf("the response shows %q", secret)
+		}
+	}
+	smtp := got["smtp"].(map[string]interface{})
+	if smtp["host"] != "smtp.example.com" || smtp["password"] != config.MaskSecret("smtp-password-1234") {
+		t.Errorf("smtp = %v, want the host and the masked password", smtp)
+	}
+	if !strings.HasPrefix(config.MaskSecret("smtp-password-1234"), "****1234 (sha256:") {
+		t.Errorf("mask %q, want the last 4 characters and a fingerprint", config.MaskSecret("smtp-password-1234"))
+	}
+	if dify := got["dify"].(map[string]interface{}); dify["stream_timeout"] != "30s" {
+		t.Errorf("dify.stream_timeout = %v, want 30s", dify["stream_timeout"])
+	}
+	if cfg.DIFYGATE.Password != "smtp-password-1234" || cfg.Hooks[0].Secret != "hook-secret-value" {
+		t.Error("masking changed the configuration in use")
+	}
+	if again, _ := get(); again != body {
+		t.Error("the same configuration gave a different response")
+	}
+}
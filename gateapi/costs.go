@@ -0,0 +1,275 @@
+package gateapi
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/apierror"
+	"github.com/tracoco/DifyGate/config"
+	"github.com/tracoco/DifyGate/metrics"
+	"github.com/tracoco/DifyGate/store"
+)
+
+var (
+	// chatCost adds up what Dify's answers cost, in DIFYGATE_COST_CURRENCY
+	chatCost = metrics.NewCounter("difygate_chat_cost_total",
+		"Cost of the answers Dify gave chat users, in the configured currency", "channel")
+	// budgetRefused counts the messages of users over their daily budget
+	budgetRefused = metrics.NewCounter("difygate_budget_refused_total",
+		"Chat messages not sent to Dify as their sender spent the daily budget", "channel")
+)
+
+const (
+	// costScale is the units of a currency the store counts in, so
+	// fractions of a cent add up exactly
+	costScale = 1e9
+	// defaultCostsLimit is the users listed when ?limit= is not given
+	defaultCostsLimit = 50
+	// maxCostsLimit caps ?limit=
+	maxCostsLimit = 500
+	// defaultCostsDays is the days reported when ?since= is not given,
+	// today included
+	defaultCostsDays = 7
+)
+
+// costKey is the store key of what a user spent on a day; the user comes
+// last so a user's keys can be found across days
+func costKey(day, channel, userID string) string {
+	return "cost:user:" + day + ":" + channel + ":" + userID
+}
+
+// costs prices Dify's answers to chat users and adds up what each user
+// spends a day in the shared store, so every instance counts towards the
+// same budget. Store failures let messages through.
+type costs struct {
+	cfg   config.CostConfig
+	loc   *time.Location
+	store store.Store
+}
+
+// newCosts returns nil when DIFYGATE_COST_ENABLED is off. The time zone is
+// checked by the configuration.
+func newCosts(cfg config.CostConfig, kv store.Store) *costs {
+	if !cfg.Enabled {
+		return nil
+	}
+	loc, err := time.LoadLocation(cfg.Timezone)
+	if err != nil {
+		return nil
+	}
+	return &costs{cfg: cfg, loc: loc, store: kv}
+}
+
+// today is the day costs are added to now
+func (c *costs) today() string {
+	return time.Now().In(c.loc).Format(digestDateLayout)
+}
+
+// price returns what an answer cost: Dify's price when it gives one in the
+// configured currency, else its tokens at the price of the model
+func (c *costs) price(u DifyUsage) float64 {
+	if u.TotalPrice != "" && (u.Currency == "" || strings.EqualFold(u.Currency, c.cfg.Currency)) {
+		if p, err := u.TotalPrice.Float64(); err == nil && p > 0 {
+			return p
+		}
+	}
+	prompt, completion := c.cfg.PromptPrice, c.cfg.CompletionPrice
+	if m, ok := c.cfg.Models[u.Model]; ok && u.Model != "" {
+		prompt, completion = m.PromptPrice, m.CompletionPrice
+	}
+	return float64(u.PromptTokens)/1000*prompt + float64(u.CompletionTokens)/1000*completion
+}
+
+// record adds the cost of the answer traced by t to what the user spent
+// today
+func (c *costs) record(channel, userID string, t *messageTrace) {
+	if c == nil {
+		return
+	}
+	cost := c.price(t.usage)
+	if cost <= 0 {
+		return
+	}
+	chatCost.Add(cost, channel)
+	if _, err := c.store.IncrBy(costKey(c.today(), channel, userID), int64(math.Round(cost*costScale)), c.cfg.Retention); err != nil {
+		t.log.WithError(err).Warn("Failed to add up the user's cost")
+	}
+}
+
+// overBudget reports whether the user spent their daily budget
+func (c *costs) overBudget(log *logrus.Entry, channel, userID string) bool {
+	if c.cfg.DailyBudget <= 0 {
+		return false
+	}
+	raw, err := c.store.Get(costKey(c.today(), channel, userID))
+	if errors.Is(err, store.ErrNotFound) {
+		return false
+	}
+	if err != nil {
+		log.WithError(err).Warn("Failed to check the user's spend, answering")
+		return false
+	}
+	spent, err := strconv.ParseInt(string(raw), 10, 64)
+	if err != nil {
+		return false
+	}
+	return float64(spent)/costScale >= c.cfg.DailyBudget
+}
+
+// handleBudget tells users who spent their daily budget to come back
+// tomorrow instead of asking Dify; it returns false for messages to answer
+func (p *MessagePipeline) handleBudget(t *messageTrace, msg ChannelMessage, locale string) bool {
+	if p.costs == nil || !p.costs.overBudget(t.log, p.opts.Channel, msg.UserID) {
+		return false
+	}
+	t.outcome = outcomeOverBudget
+	budgetRefused.Inc(p.opts.Channel)
+	t.log.WithField("daily_budget", p.costs.cfg.DailyBudget).Info("User spent the daily budget, not asking Dify")
+	p.notify(t, msg, p.messages.Get(locale, config.MsgDailyLimit))
+	return true
+}
+
+// DayCost is what was spent on one day
+type DayCost struct {
+	Date string  `json:"date"`
+	Cost float64 `json:"cost"`
+}
+
+// UserCost is what one chat user spent over the days reported
+type UserCost struct {
+	Channel string  `json:"channel"`
+	UserID  string  `json:"user_id"`
+	Cost    float64 `json:"cost"`
+}
+
+// CostReport is what chat users spent from a day until today
+type CostReport struct {
+	Since    string  `json:"since"`
+	Until    string  `json:"until"`
+	Timezone string  `json:"timezone"`
+	Currency string  `json:"currency"`
+	Total    float64 `json:"total"`
+	// Days are the days anything was spent, oldest first
+	Days []DayCost `json:"days"`
+	// Users are the users who spent the most, most first, and TotalUsers
+	// counts every user who spent anything
+	Users      []UserCost `json:"users"`
+	TotalUsers int        `json:"total_users"`
+}
+
+// CostsHandler reports what chat users spend
+type CostsHandler struct {
+	costs *costs
+	log   *logrus.Logger
+}
+
+// NewCostsHandler creates the handler of the costs API; nil costs answer
+// 404, as DIFYGATE_COST_ENABLED is off
+func NewCostsHandler(c *costs, log *logrus.Logger) *CostsHandler {
+	return &CostsHandler{costs: c, log: log}
+}
+
+// Costs handles GET /stats/costs: the spend by day and the top users from
+// ?since (a day such as 2024-05-01, by default a week ago) until today,
+// with at most ?limit users
+func (h *CostsHandler) Costs(c *gin.Context) {
+	if h.costs == nil {
+		apierror.Respond(c, http.StatusNotFound, apierror.FeatureDisabled, "Cost tracking is not enabled; set DIFYGATE_COST_ENABLED")
+		return
+	}
+	now := time.Now().In(h.costs.loc)
+	since := time.Date(now.Year(), now.Month(), now.Day()-(defaultCostsDays-1), 0, 0, 0, 0, h.costs.loc)
+	if s := c.Query("since"); s != "" {
+		var err error
+		if since, err = time.ParseInLocation(digestDateLayout, s, h.costs.loc); err != nil {
+			apierror.Respond(c, http.StatusBadRequest, apierror.InvalidRequest, "since must be a day such as 2024-05-01")
+			return
+		}
+	}
+	limit := defaultCostsLimit
+	if l := c.Query("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 || n > maxCostsLimit {
+			apierror.Respond(c, http.StatusBadRequest, apierror.InvalidRequest, "limit must be between 1 and "+strconv.Itoa(maxCostsLimit))
+			return
+		}
+		limit = n
+	}
+
+	report, err := h.costs.report(since.Format(digestDateLayout), now.Format(digestDateLayout), limit)
+	if err != nil {
+		requestLogger(c, h.log).WithError(err).Error("Failed to add up the costs")
+		apierror.Respond(c, http.StatusInternalServerError, apierror.Internal, "Failed to add up the costs")
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// report adds up what was spent from since until until, both days
+func (c *costs) report(since, until string, limit int) (*CostReport, error) {
+	keys, err := c.store.Keys("cost:user:*")
+	if err != nil {
+		return nil, err
+	}
+	days := make(map[string]int64)
+	users := make(map[UserCost]int64)
+	var total int64
+	for _, key := range keys {
+		// cost:user:<date>:<channel>:<user ID>
+		parts := strings.SplitN(key, ":", 5)
+		if len(parts) != 5 || parts[2] < since || parts[2] > until {
+			continue
+		}
+		raw, err := c.store.Get(key)
+		if errors.Is(err, store.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		spent, err := strconv.ParseInt(string(raw), 10, 64)
+		if err != nil {
+			continue
+		}
+		days[parts[2]] += spent
+		users[UserCost{Channel: parts[3], UserID: parts[4]}] += spent
+		total += spent
+	}
+
+	report := &CostReport{
+		Since:      since,
+		Until:      until,
+		Timezone:   c.loc.String(),
+		Currency:   c.cfg.Currency,
+		Total:      float64(total) / costScale,
+		Days:       make([]DayCost, 0, len(days)),
+		Users:      make([]UserCost, 0, len(users)),
+		TotalUsers: len(users),
+	}
+	for day, spent := range days {
+		report.Days = append(report.Days, DayCost{Date: day, Cost: float64(spent) / costScale})
+	}
+	sort.Slice(report.Days, func(i, j int) bool { return report.Days[i].Date < report.Days[j].Date })
+	for user, spent := range users {
+		user.Cost = float64(spent) / costScale
+		report.Users = append(report.Users, user)
+	}
+	sort.Slice(report.Users, func(i, j int) bool {
+		a, b := report.Users[i], report.Users[j]
+		if a.Cost != b.Cost {
+			return a.Cost > b.Cost
+		}
+		return a.Channel+":"+a.UserID < b.Channel+":"+b.UserID
+	})
+	if len(report.Users) > limit {
+		report.Users = report.Users[:limit]
+	}
+	return report, nil
+}
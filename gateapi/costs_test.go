@@ -0,0 +1,105 @@
+package gateapi
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tracoco/DifyGate/config"
+)
+
+func TestPipelineCostsAndDailyBudget(t *testing.T) {
+	p, sender, dify, kv := newTestPipeline(t, PipelineOptions{Channel: "costs"}, config.ChatConfig{},
+		func(req ChatMessageRequest) []StreamingChatResponse {
+			usage := map[string]interface{}{"prompt_tokens": 1000, "completion_tokens": 500, "total_tokens": 1500}
+			switch req.Query {
+			case "priced":
+				// Dify's own price wins over the table
+				usage["total_price"] = "0.6000000"
+				usage["currency"] = "USD"
+			case "model":
+				usage["model"] = "big"
+			case "euros":
+				usage["total_price"] = "9"
+				usage["currency"] = "EUR"
+			}
+			events := difyAnswer("", "ok")
+			events[len(events)-1].Metadata = map[string]interface{}{"usage": usage}
+			return events
+		})
+	p.costs = newCosts(config.CostConfig{
+		Enabled:         true,
+		Currency:        "USD",
+		PromptPrice:     0.1,
+		CompletionPrice: 0.2,
+		Models:          map[string]config.ModelPrice{"big": {PromptPrice: 1, CompletionPrice: 2}},
+		DailyBudget:     1,
+		Timezone:        "UTC",
+		Retention:       time.Hour,
+	}, kv)
+	limit := p.messages.Get(config.DefaultLocale, config.MsgDailyLimit)
+	asked := func() int {
+		dify.mu.Lock()
+		defer dify.mu.Unlock()
+		return len(dify.requests)
+	}
+	send := func(user, text string) {
+		p.Handle(testEntry(), ChannelMessage{ChannelID: "bot", UserID: user, Text: text})
+	}
+
+	// 0.6 from Dify, then 0.2 at the default prices, a price in another
+	// currency ignored for the table's, and the budget is spent
+	for _, text := range []string{"priced", "plain", "euros", "over", "again"} {
+		send("u1", text)
+	}
+	if got := sender.sent(); len(got) != 5 || got[2] != "ok" || got[3] != limit || got[4] != limit {
+		t.Errorf("sent %q, want 3 answers then the daily limit", got)
+	}
+	if got := asked(); got != 3 {
+		t.Errorf("Dify asked %d times, want only before the budget was spent", got)
+	}
+	// Other users have their own budget; the model's price applies
+	send("u2", "model")
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/stats/costs", NewCostsHandler(p.costs, quietLogger()).Costs)
+	call := func(query string) (*httptest.ResponseRecorder, CostReport) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/stats/costs"+query, nil))
+		var report CostReport
+		json.Unmarshal(w.Body.Bytes(), &report)
+		return w, report
+	}
+	near := func(a, b float64) bool { return math.Abs(a-b) < 1e-9 }
+
+	today := time.Now().UTC().Format(digestDateLayout)
+	w, report := call("")
+	if w.Code != http.StatusOK || !near(report.Total, 3) || report.Currency != "USD" || report.Until != today ||
+		len(report.Days) != 1 || report.Days[0].Date != today || !near(report.Days[0].Cost, 3) {
+		t.Fatalf("report: status %d: %s", w.Code, w.Body)
+	}
+	if users := report.Users; report.TotalUsers != 2 || len(users) != 2 || users[0].UserID != "u2" || !near(users[0].Cost, 2) ||
+		users[1].Channel != "costs" || !near(users[1].Cost, 1) {
+		t.Errorf("users %+v, want u2 spending 2 and u1 spending 1", users)
+	}
+	if _, report := call("?limit=1&since=" + today); len(report.Users) != 1 || report.TotalUsers != 2 {
+		t.Errorf("limited report %+v, want one of two users", report)
+	}
+	if _, report := call("?since=2999-01-01"); report.Total != 0 || len(report.Days) != 0 {
+		t.Errorf("report from the future %+v, want nothing spent", report)
+	}
+	if w, _ := call("?since=yesterday"); w.Code != http.StatusBadRequest {
+		t.Errorf("bad since: status %d, want 400", w.Code)
+	}
+
+	r = gin.New()
+	r.GET("/stats/costs", NewCostsHandler(nil, quietLogger()).Costs)
+	if w, _ := call(""); w.Code != http.StatusNotFound {
+		t.Errorf("disabled: status %d, want 404", w.Code)
+	}
+}
@@ -0,0 +1,517 @@
+package gateapi
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"embed"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/history"
+	"github.com/tracoco/DifyGate/phone"
+	"github.com/tracoco/DifyGate/store"
+)
+
+//go:embed dashboard/*.html
+var dashboardFiles embed.FS
+
+const (
+	// dashboardCookie holds the ID of the browser's session; the API key
+	// it signed in with stays in the store
+	dashboardCookie = "difygate_dashboard"
+	// dashboardFlashCookie carries the outcome of a button to the page
+	// shown next
+	dashboardFlashCookie = "difygate_dashboard_flash"
+	// dashboardSessionTTL is how long a session lasts
+	dashboardSessionTTL = 12 * time.Hour
+	// dashboardKeyKey is the Gin context key holding the session's API key
+	dashboardKeyKey = "dashboard_key"
+	// dashboardLimit is how many messages a dashboard page lists
+	dashboardLimit = 100
+)
+
+// dashboardChannels are offered in the message search
+var dashboardChannels = []string{"whatsapp", "messenger", "sms", "slack", "discord", "email"}
+
+// dashboardPages are the page templates, each rendered inside the layout
+var dashboardPages = func() map[string]*template.Template {
+	funcs := template.FuncMap{
+		"when": func(t time.Time) string { return t.UTC().Format("2006-01-02 15:04:05 UTC") },
+		"join": strings.Join,
+	}
+	pages := make(map[string]*template.Template)
+	for _, name := range []string{"login", "messages", "users", "emails", "config"} {
+		pages[name] = template.Must(template.New(name).Funcs(funcs).ParseFS(dashboardFiles, "dashboard/layout.html", "dashboard/"+name+".html"))
+	}
+	return pages
+}()
+
+// dashboardPage is what the layout renders
+type dashboardPage struct {
+	Title string
+	// Active is the navigation entry to highlight; the sign-in page has none
+	Active string
+	Notice string
+	Error  string
+	Data   interface{}
+}
+
+// dashboardAPIError is an error answer of the admin API
+type dashboardAPIError struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *dashboardAPIError) Error() string {
+	return e.message
+}
+
+// Dashboard serves the admin pages for people who'd rather not use curl.
+// It is a thin layer over the admin API: every page reads, and every button
+// acts, by running an API request through the router with the signed-in
+// key, so it can do no more than that key can, and the API's scope checks,
+// allowlists, rate limits and logs apply as they would to curl.
+type Dashboard struct {
+	router *gin.Engine
+	// store keeps the sessions, so every instance knows them
+	store store.Store
+	// trustedProxies may say the browser used HTTPS in X-Forwarded-Proto
+	trustedProxies []netip.Prefix
+	log            *logrus.Logger
+}
+
+// NewDashboard creates the dashboard, calling the API through router and
+// keeping sessions in kv. trustedProxies are the addresses of
+// DIFYGATE_TRUSTED_PROXIES.
+func NewDashboard(router *gin.Engine, kv store.Store, trustedProxies []string, log *logrus.Logger) *Dashboard {
+	d := &Dashboard{router: router, store: kv, log: log}
+	for _, proxy := range trustedProxies {
+		// Validate rejects bad entries
+		if prefix, err := parsePrefix(proxy); err == nil {
+			d.trustedProxies = append(d.trustedProxies, prefix)
+		}
+	}
+	return d
+}
+
+// call runs an admin API request with key and decodes its JSON answer into
+// out, which may be nil. An error answer is returned as a
+// *dashboardAPIError.
+func (d *Dashboard) call(c *gin.Context, key, method, path string, query url.Values, out interface{}) error {
+	// The clone keeps the client's address and forwarding headers, so the
+	// admin allowlist sees the browser rather than the gateway
+	req := c.Request.Clone(c.Request.Context())
+	req.Method = method
+	req.URL = &url.URL{Path: path, RawQuery: query.Encode()}
+	req.RequestURI = req.URL.RequestURI()
+	req.Body = http.NoBody
+	req.ContentLength = 0
+	req.Header.Del("Cookie")
+	req.Header.Del("Content-Type")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Authorization", "Bearer "+key)
+
+	w := &capturedResponse{header: make(http.Header)}
+	d.router.ServeHTTP(w, req)
+	if w.status >= 400 {
+		var envelope struct {
+			Error struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		json.Unmarshal(w.body.Bytes(), &envelope)
+		if envelope.Error.Message == "" {
+			envelope.Error.Message = http.StatusText(w.status)
+		}
+		return &dashboardAPIError{status: w.status, code: envelope.Error.Code, message: envelope.Error.Message}
+	}
+	if out == nil || w.status == http.StatusNoContent {
+		return nil
+	}
+	return json.Unmarshal(w.body.Bytes(), out)
+}
+
+// capturedResponse buffers an API answer for the dashboard
+type capturedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *capturedResponse) Header() http.Header {
+	return w.header
+}
+
+func (w *capturedResponse) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(b)
+}
+
+func (w *capturedResponse) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+// render writes a page, with the outcome of the last button, logging a
+// template failure
+func (d *Dashboard) render(c *gin.Context, status int, name string, page dashboardPage) {
+	if flash, err := c.Cookie(dashboardFlashCookie); err == nil && flash != "" {
+		kind, text, _ := strings.Cut(flash, ":")
+		if kind == "error" && page.Error == "" {
+			page.Error = text
+		} else if kind == "notice" && page.Notice == "" {
+			page.Notice = text
+		}
+		d.setCookie(c, dashboardFlashCookie, "", -1)
+	}
+	var b bytes.Buffer
+	if err := dashboardPages[name].ExecuteTemplate(&b, "layout", page); err != nil {
+		requestLogger(c, d.log).WithError(err).Error("Failed to render a dashboard page")
+		c.String(http.StatusInternalServerError, "Failed to render the page")
+		return
+	}
+	c.Data(status, "text/html; charset=utf-8", b.Bytes())
+}
+
+// sessionKey is the store key of the session with ID id. The ID is
+// hashed, so the store doesn't hold what the cookie does.
+func sessionKey(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return "dashboard:session:" + hex.EncodeToString(sum[:])
+}
+
+// startSession signs the browser in with the API key key
+func (d *Dashboard) startSession(c *gin.Context, key string) error {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	id := base64.RawURLEncoding.EncodeToString(b)
+	if err := d.store.Set(sessionKey(id), []byte(key), dashboardSessionTTL); err != nil {
+		return err
+	}
+	d.setCookie(c, dashboardCookie, id, int(dashboardSessionTTL/time.Second))
+	return nil
+}
+
+// endSession signs the browser out
+func (d *Dashboard) endSession(c *gin.Context) {
+	if id, err := c.Cookie(dashboardCookie); err == nil && id != "" {
+		if err := d.store.Delete(sessionKey(id)); err != nil {
+			requestLogger(c, d.log).WithError(err).Warn("Failed to remove a dashboard session")
+		}
+	}
+	d.setCookie(c, dashboardCookie, "", -1)
+}
+
+// setFlash shows text on the next page, as an error or a notice
+func (d *Dashboard) setFlash(c *gin.Context, kind, text string) {
+	d.setCookie(c, dashboardFlashCookie, kind+":"+text, 60)
+}
+
+// setCookie sets a dashboard cookie, or clears it with a negative maxAge.
+// The cookies are kept from scripts and from requests started by other
+// sites, which also keeps those from submitting the dashboard's forms.
+func (d *Dashboard) setCookie(c *gin.Context, name, value string, maxAge int) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     name,
+		Value:    url.QueryEscape(value),
+		Path:     "/admin",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   d.secure(c),
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// secure reports whether the browser reached the gateway over HTTPS: on
+// its own listener, or through a trusted proxy saying so. Anyone else
+// could send the header.
+func (d *Dashboard) secure(c *gin.Context) bool {
+	if c.Request.TLS != nil {
+		return true
+	}
+	if c.GetHeader("X-Forwarded-Proto") != "https" {
+		return false
+	}
+	peer, err := netip.ParseAddr(c.RemoteIP())
+	if err != nil {
+		return false
+	}
+	peer = peer.Unmap()
+	for _, prefix := range d.trustedProxies {
+		if prefix.Contains(peer) {
+			return true
+		}
+	}
+	return false
+}
+
+// RequireSession sends browsers without a session to the sign-in page
+func (d *Dashboard) RequireSession(c *gin.Context) {
+	var key []byte
+	id, err := c.Cookie(dashboardCookie)
+	if err == nil && id != "" {
+		key, err = d.store.Get(sessionKey(id))
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			requestLogger(c, d.log).WithError(err).Warn("Failed to look up a dashboard session")
+		}
+	}
+	if len(key) == 0 {
+		if id != "" {
+			d.setCookie(c, dashboardCookie, "", -1)
+		}
+		c.Redirect(http.StatusSeeOther, "/admin/login")
+		c.Abort()
+		return
+	}
+	c.Set(dashboardKeyKey, string(key))
+	c.Next()
+}
+
+// expired signs the browser out when err says the key stopped working,
+// e.g. because it was rotated
+func (d *Dashboard) expired(c *gin.Context, err error) bool {
+	apiErr, ok := err.(*dashboardAPIError)
+	if !ok || apiErr.status != http.StatusUnauthorized {
+		return false
+	}
+	d.endSession(c)
+	d.setFlash(c, "error", "Sign in again: "+apiErr.message)
+	c.Redirect(http.StatusSeeOther, "/admin/login")
+	return true
+}
+
+// fail shows err on the page, unless the key stopped working
+func (d *Dashboard) fail(c *gin.Context, name string, page dashboardPage, err error) {
+	if d.expired(c, err) {
+		return
+	}
+	page.Error = err.Error()
+	d.render(c, http.StatusOK, name, page)
+}
+
+// Home handles GET /admin
+func (d *Dashboard) Home(c *gin.Context) {
+	c.Redirect(http.StatusSeeOther, "/admin/messages")
+}
+
+// LoginPage handles GET /admin/login
+func (d *Dashboard) LoginPage(c *gin.Context) {
+	d.render(c, http.StatusOK, "login", dashboardPage{Title: "Sign in"})
+}
+
+// Login handles POST /admin/login, checking the pasted key against the
+// admin API before keeping it
+func (d *Dashboard) Login(c *gin.Context) {
+	key := strings.TrimSpace(c.PostForm("key"))
+	page := dashboardPage{Title: "Sign in"}
+	if key == "" {
+		page.Error = "Paste an API key"
+		d.render(c, http.StatusBadRequest, "login", page)
+		return
+	}
+	if err := d.call(c, key, http.MethodGet, "/api/v1/admin/config", nil, nil); err != nil {
+		page.Error = err.Error()
+		d.render(c, http.StatusOK, "login", page)
+		return
+	}
+	if err := d.startSession(c, key); err != nil {
+		requestLogger(c, d.log).WithError(err).Error("Failed to save a dashboard session")
+		page.Error = "Failed to sign in, try again"
+		d.render(c, http.StatusInternalServerError, "login", page)
+		return
+	}
+	requestLogger(c, d.log).Info("Signed in to the dashboard")
+	c.Redirect(http.StatusSeeOther, "/admin/messages")
+}
+
+// Logout handles POST /admin/logout
+func (d *Dashboard) Logout(c *gin.Context) {
+	d.endSession(c)
+	c.Redirect(http.StatusSeeOther, "/admin/login")
+}
+
+// messageSearch is the message history filter of a page
+type messageSearch struct {
+	User     string
+	Channel  string
+	Status   string
+	Since    string
+	Channels []string
+	Messages []history.Record
+}
+
+// search lists the messages matching the page's filters
+func (d *Dashboard) search(c *gin.Context, s *messageSearch) error {
+	if s.Since == "" {
+		s.Since = "24h"
+	}
+	query := url.Values{"since": {s.Since}, "limit": {strconv.Itoa(dashboardLimit)}}
+	for name, value := range map[string]string{"user": s.User, "channel": s.Channel, "status": s.Status} {
+		if value != "" {
+			query.Set(name, value)
+		}
+	}
+	var resp struct {
+		Messages []history.Record `json:"messages"`
+	}
+	err := d.call(c, c.GetString(dashboardKeyKey), http.MethodGet, "/api/v1/admin/messages", query, &resp)
+	s.Messages = resp.Messages
+	return err
+}
+
+// Messages handles GET /admin/messages, the recent message history
+func (d *Dashboard) Messages(c *gin.Context) {
+	s := &messageSearch{User: c.Query("user"), Channel: c.Query("channel"), Status: c.Query("status"), Since: c.Query("since"), Channels: dashboardChannels}
+	page := dashboardPage{Title: "Messages", Active: "messages", Data: s}
+	if err := d.search(c, s); err != nil {
+		d.fail(c, "messages", page, err)
+		return
+	}
+	d.render(c, http.StatusOK, "messages", page)
+}
+
+// Emails handles GET /admin/emails, the emails sent and failed
+func (d *Dashboard) Emails(c *gin.Context) {
+	s := &messageSearch{User: c.Query("user"), Channel: "email", Status: c.Query("status"), Since: c.Query("since")}
+	page := dashboardPage{Title: "Emails", Active: "emails", Data: s}
+	if err := d.search(c, s); err != nil {
+		d.fail(c, "emails", page, err)
+		return
+	}
+	d.render(c, http.StatusOK, "emails", page)
+}
+
+// userView is what the users page shows
+type userView struct {
+	Number   string
+	State    []UserStateEntry
+	Messages []history.Record
+	// HistoryError says why there are no recent messages, e.g. history
+	// being off
+	HistoryError string
+	Mutes        []Mute
+}
+
+// Users handles GET /admin/users: a WhatsApp number's stored state and
+// recent messages, and the muted users
+func (d *Dashboard) Users(c *gin.Context) {
+	key := c.GetString(dashboardKeyKey)
+	view := &userView{Number: phone.Lenient(c.Query("number"))}
+	page := dashboardPage{Title: "Users", Active: "users", Data: view}
+
+	var mutes struct {
+		Mutes []Mute `json:"mutes"`
+	}
+	if err := d.call(c, key, http.MethodGet, "/api/v1/admin/mutes", nil, &mutes); err != nil {
+		d.fail(c, "users", page, err)
+		return
+	}
+	view.Mutes = mutes.Mutes
+	if view.Number == "" {
+		d.render(c, http.StatusOK, "users", page)
+		return
+	}
+
+	var state struct {
+		State []UserStateEntry `json:"state"`
+	}
+	if err := d.call(c, key, http.MethodGet, "/api/v1/admin/users/"+url.PathEscape(view.Number), nil, &state); err != nil {
+		view.Number = ""
+		d.fail(c, "users", page, err)
+		return
+	}
+	view.State = state.State
+	s := &messageSearch{User: view.Number, Since: "720h"}
+	if err := d.search(c, s); err != nil {
+		view.HistoryError = err.Error()
+	}
+	view.Messages = s.Messages
+	d.render(c, http.StatusOK, "users", page)
+}
+
+// act runs an admin API request for a button, then shows redirect with
+// the outcome
+func (d *Dashboard) act(c *gin.Context, method, path, redirect, done string) {
+	err := d.call(c, c.GetString(dashboardKeyKey), method, path, nil, nil)
+	if d.expired(c, err) {
+		return
+	}
+	if err != nil {
+		d.setFlash(c, "error", err.Error())
+	} else {
+		d.setFlash(c, "notice", done)
+	}
+	c.Redirect(http.StatusSeeOther, redirect)
+}
+
+// ResetConversation handles POST /admin/users/reset
+func (d *Dashboard) ResetConversation(c *gin.Context) {
+	number := c.PostForm("number")
+	d.act(c, http.MethodDelete, "/api/v1/admin/users/"+url.PathEscape(number)+"/conversation",
+		"/admin/users?number="+url.QueryEscape(number), "The conversation was reset; the next message starts a new one")
+}
+
+// Unmute handles POST /admin/users/unmute
+func (d *Dashboard) Unmute(c *gin.Context) {
+	channel, user := c.PostForm("channel"), c.PostForm("user")
+	d.act(c, http.MethodDelete, "/api/v1/admin/mutes/"+url.PathEscape(channel)+"/"+url.PathEscape(user),
+		"/admin/users", user+" was unmuted")
+}
+
+// configView is what the configuration page shows
+type configView struct {
+	Fingerprint     string
+	RestartRequired []string
+	Config          string
+	Keys            []KeyUsageEntry
+}
+
+// Config handles GET /admin/config, the configuration in use with its
+// secrets masked, and when each API key was last used
+func (d *Dashboard) Config(c *gin.Context) {
+	key := c.GetString(dashboardKeyKey)
+	view := &configView{}
+	page := dashboardPage{Title: "Configuration", Active: "config", Data: view}
+
+	var cfg struct {
+		Config          json.RawMessage `json:"config"`
+		Fingerprint     string          `json:"fingerprint"`
+		RestartRequired []string        `json:"restart_required"`
+	}
+	if err := d.call(c, key, http.MethodGet, "/api/v1/admin/config", nil, &cfg); err != nil {
+		d.fail(c, "config", page, err)
+		return
+	}
+	var indented bytes.Buffer
+	json.Indent(&indented, cfg.Config, "", "  ")
+	view.Fingerprint, view.RestartRequired, view.Config = cfg.Fingerprint, cfg.RestartRequired, indented.String()
+
+	var usage struct {
+		Keys []KeyUsageEntry `json:"keys"`
+	}
+	if err := d.call(c, key, http.MethodGet, "/api/v1/admin/auth/usage", nil, &usage); err != nil {
+		d.fail(c, "config", page, err)
+		return
+	}
+	view.Keys = usage.Keys
+	d.render(c, http.StatusOK, "config", page)
+}
@@ -0,0 +1,156 @@
+package gateapi
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/config"
+	"github.com/tracoco/DifyGate/events"
+	"github.com/tracoco/DifyGate/gate"
+	"github.com/tracoco/DifyGate/store"
+)
+
+func TestDashboard(t *testing.T) {
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Auth.Keys = []config.APIKeyConfig{
+		{Key: "admin-key", Name: "ops", Scopes: []string{ScopeAdmin}},
+		{Key: "send-key", Name: "crm", Scopes: []string{ScopeEmailSend}},
+	}
+	gin.SetMode(gin.TestMode)
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	kv := store.New("", log)
+	t.Cleanup(func() { kv.Close() })
+	r := gin.New()
+	RegisterRoutes(r, NewReloader(cfg, nil, log), gate.NewService(cfg.DIFYGATE, log), kv, events.NewDispatcher(cfg.Webhooks, log), nil, NewReadiness(cfg, log), log)
+
+	var cookies []*http.Cookie
+	do := func(method, path string, form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		// Keep what the browser would
+		for _, set := range w.Result().Cookies() {
+			kept := cookies[:0]
+			for _, c := range cookies {
+				if c.Name != set.Name {
+					kept = append(kept, c)
+				}
+			}
+			cookies = kept
+			if set.MaxAge >= 0 {
+				cookies = append(cookies, set)
+			}
+		}
+		return w
+	}
+
+	if w := do(http.MethodGet, "/admin/users", nil); w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/admin/login" {
+		t.Fatalf("signed out: status %d to %q, want the sign-in page", w.Code, w.Header().Get("Location"))
+	}
+	if w := do(http.MethodPost, "/admin/login", url.Values{"key": {"send-key"}}); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "lacks the &#39;admin&#39; scope") {
+		t.Errorf("key without the admin scope: status %d: %s", w.Code, w.Body)
+	}
+	if w := do(http.MethodPost, "/admin/login", url.Values{"key": {"admin-key"}}); w.Code != http.StatusSeeOther || len(cookies) != 1 || !cookies[0].HttpOnly {
+		t.Fatalf("sign in: status %d with cookies %v", w.Code, cookies)
+	}
+	// The browser gets a session ID, not the key
+	if strings.Contains(cookies[0].Value, "admin-key") {
+		t.Errorf("cookie holds the key: %q", cookies[0].Value)
+	}
+	session := sessionKey(cookies[0].Value)
+	if key, err := kv.Get(session); err != nil || string(key) != "admin-key" {
+		t.Fatalf("session holds %q, %v", key, err)
+	}
+
+	kv.Set("whatsapp:conversation:123:15551234567", []byte("conv-1"), 0)
+	w := do(http.MethodGet, "/admin/users?number=%2B15551234567", nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "conv-1") {
+		t.Fatalf("user page: status %d: %s", w.Code, w.Body)
+	}
+	if w := do(http.MethodPost, "/admin/users/reset", url.Values{"number": {"15551234567"}}); w.Code != http.StatusSeeOther {
+		t.Fatalf("reset: status %d", w.Code)
+	}
+	if _, err := kv.Get("whatsapp:conversation:123:15551234567"); err != store.ErrNotFound {
+		t.Errorf("conversation still mapped after the reset: %v", err)
+	}
+	if w := do(http.MethodGet, "/admin/users?number=15551234567", nil); !strings.Contains(w.Body.String(), "The conversation was reset") ||
+		!strings.Contains(w.Body.String(), "Message history is not enabled") {
+		t.Errorf("user page after the reset: %s", w.Body)
+	}
+	if w := do(http.MethodGet, "/admin/config", nil); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "sha256:") ||
+		!strings.Contains(w.Body.String(), "crm") {
+		t.Errorf("config page: status %d: %s", w.Code, w.Body)
+	}
+
+	// A made-up session ID signs nobody in
+	id := cookies[0].Value
+	cookies[0].Value = "admin-key"
+	if w := do(http.MethodGet, "/admin/emails", nil); w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/admin/login" {
+		t.Errorf("unknown session: status %d to %q, want the sign-in page", w.Code, w.Header().Get("Location"))
+	}
+
+	// A key that stops working signs the browser out
+	cookies = []*http.Cookie{{Name: dashboardCookie, Value: id}}
+	kv.Set(session, []byte("rotated-key"), dashboardSessionTTL)
+	if w := do(http.MethodGet, "/admin/emails", nil); w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/admin/login" {
+		t.Errorf("rotated key: status %d to %q, want the sign-in page", w.Code, w.Header().Get("Location"))
+	}
+	if _, err := kv.Get(session); err != store.ErrNotFound {
+		t.Errorf("session kept after the key stopped working: %v", err)
+	}
+	if w := do(http.MethodGet, "/admin/login", nil); !strings.Contains(w.Body.String(), "Sign in again") {
+		t.Errorf("sign-in page doesn't say why: %s", w.Body)
+	}
+}
+
+func TestDashboardSecureCookie(t *testing.T) {
+	d := NewDashboard(gin.New(), store.New("", quietLogger()), []string{"10.0.0.0/8"}, quietLogger())
+	tests := []struct {
+		name   string
+		tls    bool
+		peer   string
+		header string
+		want   bool
+	}{
+		{"TLS", true, "203.0.113.7:1234", "", true},
+		{"plain HTTP", false, "203.0.113.7:1234", "", false},
+		{"trusted proxy", false, "10.1.2.3:1234", "https", true},
+		{"trusted proxy over HTTP", false, "10.1.2.3:1234", "http", false},
+		// Anyone can send the header
+		{"untrusted peer", false, "203.0.113.7:1234", "https", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodPost, "/admin/login", nil)
+			c.Request.RemoteAddr = tt.peer
+			if tt.tls {
+				c.Request.TLS = &tls.ConnectionState{}
+			}
+			if tt.header != "" {
+				c.Request.Header.Set("X-Forwarded-Proto", tt.header)
+			}
+			d.setFlash(c, "notice", "hi")
+			cookies := w.Result().Cookies()
+			if len(cookies) != 1 || cookies[0].Secure != tt.want {
+				t.Errorf("cookies %v, want Secure %v", cookies, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package gateapi
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/config"
+)
+
+// debouncer joins the messages a user sends in quick succession into one
+// Dify query, for users who type a question over several messages. A
+// message starts a group holding its place in the user's queue; messages
+// that come in within the window of the group's last one, before Dify is
+// asked, join it. With DebounceAppend, a group waiting behind the user's
+// answer in progress takes every message until its turn.
+type debouncer struct {
+	window time.Duration
+	// appendInFlight keeps a group open while it waits for its turn
+	appendInFlight bool
+	queues         *userQueues
+	// handle answers a message once its ticket's turn comes
+	handle func(log *logrus.Entry, msg ChannelMessage, ticket *queueTicket)
+
+	mu     sync.Mutex
+	groups map[string]*debounceGroup
+}
+
+// debounceGroup is the messages answered as one
+type debounceGroup struct {
+	// msg is the first message, answered with the text of all of them
+	msg   ChannelMessage
+	texts []string
+	// ids are the platform IDs of the messages, so a redelivery isn't
+	// added twice
+	ids  map[string]bool
+	last time.Time
+	// done is closed once the group is answered
+	done chan struct{}
+}
+
+func newDebouncer(cfg config.ChatConfig, queues *userQueues, handle func(log *logrus.Entry, msg ChannelMessage, ticket *queueTicket)) *debouncer {
+	return &debouncer{
+		window:         cfg.Debounce,
+		appendInFlight: cfg.DebounceInFlight == config.DebounceAppend,
+		queues:         queues,
+		handle:         handle,
+		groups:         make(map[string]*debounceGroup),
+	}
+}
+
+// add gives msg to the open group of the chat keyed by key, or starts one,
+// and returns the function answering it. For a message joining a group it
+// waits until the group is answered.
+func (d *debouncer) add(log *logrus.Entry, key string, msg ChannelMessage) (answer func()) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	g := d.groups[key]
+	if command(msg.Text) {
+		// Commands are answered on their own, after the messages before
+		// them and before those after
+		delete(d.groups, key)
+		ticket := d.queues.reserve(key)
+		return func() { d.handle(log, msg, ticket) }
+	}
+	if g != nil && (d.appendInFlight || time.Since(g.last) <= d.window) {
+		if msg.ReplyTo != "" && g.ids[msg.ReplyTo] {
+			log.Info("Ignoring redelivered message")
+			return func() {}
+		}
+		g.texts = append(g.texts, msg.Text)
+		g.msg.Attachments = append(g.msg.Attachments, msg.Attachments...)
+		g.ids[msg.ReplyTo] = true
+		g.last = time.Now()
+		return func() { <-g.done }
+	}
+
+	ticket := d.queues.reserve(key)
+	if ticket == nil {
+		return func() { d.handle(log, msg, nil) }
+	}
+	g = &debounceGroup{
+		msg:   msg,
+		texts: []string{msg.Text},
+		ids:   map[string]bool{msg.ReplyTo: true},
+		last:  time.Now(),
+		done:  make(chan struct{}),
+	}
+	d.groups[key] = g
+	return func() { d.answer(log, key, g, ticket) }
+}
+
+// answer waits out the window of g's last message and its turn, then asks
+// Dify about all of its messages
+func (d *debouncer) answer(log *logrus.Entry, key string, g *debounceGroup, ticket *queueTicket) {
+	defer close(g.done)
+	for {
+		d.mu.Lock()
+		wait := time.Until(g.last.Add(d.window))
+		d.mu.Unlock()
+		if wait <= 0 {
+			break
+		}
+		time.Sleep(wait)
+	}
+	ticket.wait()
+
+	d.mu.Lock()
+	if d.groups[key] == g {
+		delete(d.groups, key)
+	}
+	msg := g.msg
+	msg.Text = strings.Join(g.texts, "\n")
+	d.mu.Unlock()
+	if len(g.texts) > 1 {
+		log.WithField("messages", len(g.texts)).Debug("Answering messages as one")
+	}
+	d.handle(log, msg, ticket)
+}
+
+// command reports whether text is a slash command, which is never joined
+// with other messages
+func command(text string) bool {
+	return strings.HasPrefix(strings.TrimSpace(text), "/")
+}
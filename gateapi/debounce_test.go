@@ -0,0 +1,159 @@
+package gateapi
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tracoco/DifyGate/config"
+)
+
+// waitForAnswers collects what sender sent until it has n replies
+func waitForAnswers(t *testing.T, sender *fakeSender, n int) []string {
+	t.Helper()
+	var got []string
+	for deadline := time.Now().Add(5 * time.Second); len(got) < n && time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond)
+		got = append(got, sender.sent()...)
+	}
+	if len(got) != n {
+		t.Fatalf("sent %q, want %d answers", got, n)
+	}
+	return got
+}
+
+// queries are the queries Dify was asked, in order
+func (f *fakeDify) queries() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var queries []string
+	for _, req := range f.requests {
+		queries = append(queries, req.Query)
+	}
+	return queries
+}
+
+func equalQueries(got []string, want ...string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestPipelineDebouncesMessages(t *testing.T) {
+	p, sender, dify, _ := newTestPipeline(t, PipelineOptions{Channel: "test"}, config.ChatConfig{MaxQueuedMessages: 5, Debounce: 50 * time.Millisecond},
+		func(req ChatMessageRequest) []StreamingChatResponse {
+			return difyAnswer("conv-1", "re: "+req.Query)
+		})
+	p.Accept(testEntry(), ChannelMessage{ChannelID: "bot", UserID: "u1", Text: "Hi"})
+	p.Accept(testEntry(), ChannelMessage{ChannelID: "bot", UserID: "u1", Text: "I have a question"})
+	// Other users are not joined in
+	p.Accept(testEntry(), ChannelMessage{ChannelID: "bot", UserID: "u2", Text: "Hello"})
+	waitForAnswers(t, sender, 2)
+
+	// A command is answered on its own, between the messages around it
+	p.Accept(testEntry(), ChannelMessage{ChannelID: "bot", UserID: "u1", Text: "one"})
+	p.Accept(testEntry(), ChannelMessage{ChannelID: "bot", UserID: "u1", Text: "/help"})
+	p.Accept(testEntry(), ChannelMessage{ChannelID: "bot", UserID: "u1", Text: "two"})
+	got := waitForAnswers(t, sender, 3)
+	if got[0] != "re: one" || got[2] != "re: two" {
+		t.Errorf("sent %q, want the help between the answers", got)
+	}
+
+	queries := dify.queries()
+	if len(queries) != 4 || !(queries[0] == "Hi\nI have a question" && queries[1] == "Hello" || queries[0] == "Hello" && queries[1] == "Hi\nI have a question") {
+		t.Fatalf("Dify was asked %q, want the first two messages joined", queries)
+	}
+	if queries[2] != "one" || queries[3] != "two" {
+		t.Errorf("Dify was asked %q, want messages not joined across a command", queries[2:])
+	}
+}
+
+func TestPipelineDebounceWhileAnswering(t *testing.T) {
+	for _, tc := range []struct {
+		mode string
+		want []string
+	}{
+		// Messages more than the window apart are asked about in turn
+		{config.DebounceQueue, []string{"first", "second", "third"}},
+		// or all at once after the answer in progress
+		{config.DebounceAppend, []string{"first", "second\nthird"}},
+	} {
+		t.Run(tc.mode, func(t *testing.T) {
+			asked := make(chan struct{}, 3)
+			release := make(chan struct{})
+			p, sender, dify, _ := newTestPipeline(t, PipelineOptions{Channel: "test"},
+				config.ChatConfig{MaxQueuedMessages: 5, Debounce: 20 * time.Millisecond, DebounceInFlight: tc.mode},
+				func(req ChatMessageRequest) []StreamingChatResponse {
+					asked <- struct{}{}
+					if req.Query == "first" {
+						<-release
+					}
+					return difyAnswer("conv-1", "re: "+req.Query)
+				})
+			p.Accept(testEntry(), ChannelMessage{ChannelID: "bot", UserID: "u1", Text: "first"})
+			<-asked
+			p.Accept(testEntry(), ChannelMessage{ChannelID: "bot", UserID: "u1", Text: "second"})
+			time.Sleep(80 * time.Millisecond)
+			p.Accept(testEntry(), ChannelMessage{ChannelID: "bot", UserID: "u1", Text: "third"})
+			time.Sleep(80 * time.Millisecond)
+			close(release)
+
+			got := waitForAnswers(t, sender, len(tc.want))
+			if queries := dify.queries(); !equalQueries(queries, tc.want...) {
+				t.Fatalf("Dify was asked %q, want %q", queries, tc.want)
+			}
+			for i, query := range tc.want {
+				if got[i] != "re: "+query {
+					t.Errorf("sent %q, want the answers in order", got)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestPipelineDebounceDropsRedeliveries(t *testing.T) {
+	for _, durable := range []bool{false, true} {
+		p, sender, dify, kv := newTestPipeline(t, PipelineOptions{Channel: "test"},
+			config.ChatConfig{MaxQueuedMessages: 5, Debounce: 50 * time.Millisecond, DurableInbox: durable},
+			func(req ChatMessageRequest) []StreamingChatResponse {
+				return difyAnswer("conv-1", "re: "+req.Query)
+			})
+		first := ChannelMessage{ChannelID: "bot", UserID: "u1", Text: "Hi", ReplyTo: "m1"}
+		second := ChannelMessage{ChannelID: "bot", UserID: "u1", Text: "there", ReplyTo: "m2"}
+		// Dropped by the inbox when it is on, and by the group otherwise
+		p.Accept(testEntry(), first)
+		p.Accept(testEntry(), second)
+		p.Accept(testEntry(), first)
+		p.Accept(testEntry(), second)
+
+		waitForAnswers(t, sender, 1)
+		if queries := dify.queries(); !equalQueries(queries, "Hi\nthere") {
+			t.Errorf("durable inbox %v: Dify was asked %q, want each message once", durable, queries)
+		}
+		if !durable {
+			continue
+		}
+		// Both messages leave the inbox once answered together
+		for deadline := time.Now().Add(time.Second); ; time.Sleep(5 * time.Millisecond) {
+			keys, _ := kv.Keys("inbox:test:*")
+			if len(keys) == 0 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("left in the inbox: %q", keys)
+			}
+		}
+		// and a redelivery after the answer is still dropped
+		p.Accept(testEntry(), second)
+		time.Sleep(100 * time.Millisecond)
+		if queries := dify.queries(); len(queries) != 1 {
+			t.Errorf("Dify was asked %q after a late redelivery", queries)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package gateapi
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"runtime/debug"
+	runtimepprof "runtime/pprof"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/apierror"
+	"github.com/tracoco/DifyGate/config"
+)
+
+// processStart is when the gateway started, for the runtime snapshot
+var processStart = time.Now()
+
+// registerDebugRoutes mounts pprof, the runtime snapshot and the goroutine
+// dump under /debug on r
+func registerDebugRoutes(r gin.IRouter, log *logrus.Logger) {
+	r.GET("/debug/pprof/*profile", pprofHandler)
+	r.POST("/debug/pprof/symbol", gin.WrapF(pprof.Symbol))
+	r.GET("/debug/vars", DebugVarsHandler)
+	r.POST("/debug/goroutines", GoroutineDumpHandler(log))
+}
+
+// NewDebugRouter returns a router serving only the debug endpoints, for the
+// separate DIFYGATE_PPROF_PORT listener
+func NewDebugRouter(cfg config.ServerConfig, log *logrus.Logger) *gin.Engine {
+	r := NewRouter(cfg, log)
+	registerDebugRoutes(r, log)
+	return r
+}
+
+// pprofHandler dispatches /debug/pprof/<profile>; net/http/pprof's Index
+// derives the profile from the path, which breaks under a /api/v1 prefix
+func pprofHandler(c *gin.Context) {
+	switch profile := strings.TrimPrefix(c.Param("profile"), "/"); profile {
+	case "":
+		pprof.Index(c.Writer, c.Request)
+	case "cmdline":
+		pprof.Cmdline(c.Writer, c.Request)
+	case "profile":
+		pprof.Profile(c.Writer, c.Request)
+	case "symbol":
+		pprof.Symbol(c.Writer, c.Request)
+	case "trace":
+		pprof.Trace(c.Writer, c.Request)
+	default:
+		if runtimepprof.Lookup(profile) == nil {
+			apierror.Respond(c, http.StatusNotFound, apierror.NotFound, "Unknown profile '"+profile+"'")
+			return
+		}
+		pprof.Handler(profile).ServeHTTP(c.Writer, c.Request)
+	}
+}
+
+// DebugVarsHandler reports a snapshot of the Go runtime
+func DebugVarsHandler(c *gin.Context) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	var gc debug.GCStats
+	debug.ReadGCStats(&gc)
+
+	c.JSON(http.StatusOK, gin.H{
+		"uptime_seconds":    int64(time.Since(processStart).Seconds()),
+		"goroutines":        runtime.NumGoroutine(),
+		"dify_open_streams": int64(difyOpenStreams.Value()),
+		"heap": gin.H{
+			"alloc_bytes":    mem.HeapAlloc,
+			"sys_bytes":      mem.HeapSys,
+			"idle_bytes":     mem.HeapIdle,
+			"released_bytes": mem.HeapReleased,
+			"objects":        mem.HeapObjects,
+		},
+		"gc": gin.H{
+			"num_gc":          gc.NumGC,
+			"last_gc":         gc.LastGC,
+			"pause_total_ns":  gc.PauseTotal.Nanoseconds(),
+			"next_gc_bytes":   mem.NextGC,
+			"gc_cpu_fraction": mem.GCCPUFraction,
+		},
+	})
+}
+
+// GoroutineDumpHandler writes every goroutine's stack to the log, for when
+// the process is stuck but its log is the only thing you can reach
+func GoroutineDumpHandler(log *logrus.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var buf bytes.Buffer
+		if err := runtimepprof.Lookup("goroutine").WriteTo(&buf, 2); err != nil {
+			apierror.Respond(c, http.StatusInternalServerError, apierror.Internal, "Failed to dump goroutines")
+			return
+		}
+
+		goroutines := runtime.NumGoroutine()
+		requestLogger(c, log).WithFields(logrus.Fields{
+			"goroutines": goroutines,
+			"stacks":     buf.String(),
+		}).Warn("Goroutine dump requested")
+		c.JSON(http.StatusOK, gin.H{"goroutines": goroutines})
+	}
+}
@@ -0,0 +1,87 @@
+package gateapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// debugRouter mounts the debug endpoints under /api/v1, as the admin API
+// does, logging to logs
+func debugRouter(logs *bytes.Buffer) *gin.Engine {
+	log := logrus.New()
+	log.SetOutput(logs)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	registerDebugRoutes(r.Group("/api/v1"), log)
+	return r
+}
+
+func TestPprofUnderPrefix(t *testing.T) {
+	r := debugRouter(&bytes.Buffer{})
+
+	tests := []struct {
+		path     string
+		want     int
+		contains string
+	}{
+		{"/api/v1/debug/pprof/", http.StatusOK, "goroutine"},
+		{"/api/v1/debug/pprof/goroutine?debug=1", http.StatusOK, "goroutine profile:"},
+		{"/api/v1/debug/pprof/cmdline", http.StatusOK, ""},
+		{"/api/v1/debug/pprof/nonsense", http.StatusNotFound, "Unknown profile 'nonsense'"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if w.Code != tt.want || !strings.Contains(w.Body.String(), tt.contains) {
+			t.Errorf("GET %s: status %d, want %d containing %q", tt.path, w.Code, tt.want, tt.contains)
+		}
+	}
+}
+
+func TestDebugVars(t *testing.T) {
+	r := debugRouter(&bytes.Buffer{})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/debug/vars", nil))
+	var vars struct {
+		Goroutines int `json:"goroutines"`
+		Heap       struct {
+			AllocBytes uint64 `json:"alloc_bytes"`
+		} `json:"heap"`
+		GC map[string]interface{} `json:"gc"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &vars); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("status %d, body %s", w.Code, w.Body.String())
+	}
+	if vars.Goroutines == 0 || vars.Heap.AllocBytes == 0 {
+		t.Errorf("reported %d goroutines and %d heap bytes", vars.Goroutines, vars.Heap.AllocBytes)
+	}
+	if _, ok := vars.GC["num_gc"]; !ok {
+		t.Errorf("gc stats %v, want num_gc", vars.GC)
+	}
+}
+
+func TestGoroutineDumpIsLogged(t *testing.T) {
+	var logs bytes.Buffer
+	r := debugRouter(&logs)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/debug/goroutines", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"goroutines":`) {
+		t.Errorf("status %d, body %s, want the goroutine count", w.Code, w.Body.String())
+	}
+	// The stacks go to the log, not the response
+	if !strings.Contains(logs.String(), "Goroutine dump requested") || !strings.Contains(logs.String(), "TestGoroutineDumpIsLogged") {
+		t.Errorf("logged %q, want this test's stack", logs.String())
+	}
+	if strings.Contains(w.Body.String(), "TestGoroutineDumpIsLogged") {
+		t.Error("the response holds the stacks")
+	}
+}
@@ -0,0 +1,202 @@
+package gateapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/apierror"
+	"github.com/tracoco/DifyGate/metrics"
+	"github.com/tracoco/DifyGate/sentry"
+)
+
+// Error codes Dify returns that DifyGate treats specially
+const (
+	difyCodeConversationNotExists = "conversation_not_exists"
+	difyCodeQuotaExceeded         = "provider_quota_exceeded"
+	difyCodeRateLimited           = "too_many_requests"
+	difyCodeUnauthorized          = "unauthorized"
+)
+
+// difyUnavailableCodes mean the Dify app or its model is misconfigured or
+// down, which retrying the question won't fix
+var difyUnavailableCodes = map[string]bool{
+	"app_unavailable":             true,
+	"provider_not_initialize":     true,
+	"model_currently_not_support": true,
+}
+
+// difyBlockedCodes mean moderation, in Dify or at the model provider,
+// blocked the question or the answer
+var difyBlockedCodes = map[string]bool{
+	"content_moderation":       true,
+	"moderation_blocked":       true,
+	"content_filter":           true,
+	"content_policy_violation": true,
+}
+
+// difyErrors counts errors returned by Dify
+var difyErrors = metrics.NewCounter("difygate_dify_errors_total",
+	"Errors returned by the Dify API", "code")
+
+// difyConversationsRecovered counts requests retried as a new conversation
+// because Dify no longer had the stored one
+var difyConversationsRecovered = metrics.NewCounter("difygate_dify_conversations_recovered_total",
+	"Requests retried as a new conversation because Dify no longer had the stored one", "mode")
+
+// ErrConversationReset marks the error of a request that failed even after
+// starting over as a new conversation; the stored conversation should be
+// forgotten either way
+var ErrConversationReset = errors.New("stored Dify conversation no longer exists")
+
+// DifyAPIError is an error Dify returned, either as a non-200 response or
+// as an error event in a stream
+type DifyAPIError struct {
+	Status  int    `json:"status"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// RetryAfter is Dify's Retry-After, if it sent one
+	RetryAfter time.Duration `json:"-"`
+}
+
+// Error implements error
+func (e *DifyAPIError) Error() string {
+	return fmt.Sprintf("Dify API error (status %d, code %s): %s", e.Status, e.Code, e.Message)
+}
+
+// ConversationGone reports whether the conversation asked about no longer
+// exists; Dify reports it as conversation_not_exists or as a plain 404
+func (e *DifyAPIError) ConversationGone() bool {
+	return e.Code == difyCodeConversationNotExists ||
+		(e.Status == http.StatusNotFound && strings.Contains(strings.ToLower(e.Message), "conversation not exists"))
+}
+
+// Overloaded reports whether the error means Dify is out of quota or rate
+// limited, so calls should back off
+func (e *DifyAPIError) Overloaded() bool {
+	return e.Status == http.StatusTooManyRequests || e.Code == difyCodeQuotaExceeded || e.Code == difyCodeRateLimited
+}
+
+// Unauthorized reports whether Dify rejected the API key
+func (e *DifyAPIError) Unauthorized() bool {
+	return e.Status == http.StatusUnauthorized || e.Status == http.StatusForbidden || e.Code == difyCodeUnauthorized
+}
+
+// Unavailable reports whether the Dify app or its model can't answer at all
+func (e *DifyAPIError) Unavailable() bool {
+	return difyUnavailableCodes[e.Code]
+}
+
+// Blocked reports whether moderation refused the question or the answer
+func (e *DifyAPIError) Blocked() bool {
+	return difyBlockedCodes[e.Code]
+}
+
+// parseDifyError builds the error for a non-200 Dify response; bodies that
+// aren't Dify's JSON error keep their text as the message
+func parseDifyError(resp *http.Response, body []byte) *DifyAPIError {
+	apiErr := &DifyAPIError{}
+	if err := json.Unmarshal(body, apiErr); err != nil || apiErr.Code == "" {
+		apiErr.Message = strings.TrimSpace(string(body))
+	}
+	apiErr.Status = resp.StatusCode
+	if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs > 0 {
+		apiErr.RetryAfter = time.Duration(secs) * time.Second
+	}
+	return apiErr
+}
+
+// asDifyAPIError returns the DifyAPIError in err's chain, if any
+func asDifyAPIError(err error) (*DifyAPIError, bool) {
+	var apiErr *DifyAPIError
+	ok := errors.As(err, &apiErr)
+	return apiErr, ok
+}
+
+// difyErrorResponse answers an API caller whose Dify call failed, passing
+// Dify's error code through so callers can tell quota from bad requests
+func difyErrorResponse(c *gin.Context, err error) {
+	apiErr, ok := asDifyAPIError(err)
+	if !ok {
+		apierror.Respond(c, http.StatusBadGateway, apierror.DifyError, "Failed to get an answer from Dify")
+		return
+	}
+	var details map[string]interface{}
+	if apiErr.Code != "" {
+		details = map[string]interface{}{"dify_code": apiErr.Code}
+	}
+	if apiErr.Overloaded() {
+		if apiErr.RetryAfter > 0 {
+			c.Header("Retry-After", strconv.Itoa(int(apiErr.RetryAfter.Seconds())))
+		}
+		apierror.RespondWithDetails(c, http.StatusServiceUnavailable, apierror.DifyOverloaded, "Dify is over its quota or rate limit", details)
+		return
+	}
+	apierror.RespondWithDetails(c, http.StatusBadGateway, apierror.DifyError, "Failed to get an answer from Dify", details)
+}
+
+// difyBreaker holds Dify calls back after a quota or rate limit error, so
+// a burst of messages doesn't keep hitting a Dify that can't answer
+type difyBreaker struct {
+	mu       sync.Mutex
+	cooldown time.Duration
+	until    time.Time
+	cause    *DifyAPIError
+}
+
+// check returns the error that opened the breaker while it is open
+func (b *difyBreaker) check() *DifyAPIError {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if time.Now().Before(b.until) {
+		return b.cause
+	}
+	return nil
+}
+
+// trip opens the breaker for Retry-After, or the cooldown without one
+func (b *difyBreaker) trip(cause *DifyAPIError) time.Duration {
+	wait := cause.RetryAfter
+	if wait <= 0 {
+		wait = b.cooldown
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.until = time.Now().Add(wait)
+	b.cause = cause
+	return wait
+}
+
+// observeError logs and counts a Dify error, opening the breaker for quota
+// and rate limit errors
+func (h *DifyHandler) observeError(log *logrus.Entry, apiErr *DifyAPIError) {
+	difyErrors.Inc(apiErr.Code)
+	log = log.WithFields(logrus.Fields{
+		"dify_status": apiErr.Status,
+		"dify_code":   apiErr.Code,
+	})
+	switch {
+	case apiErr.Unauthorized():
+		log.WithError(apiErr).Error("Dify rejected the API key; check DIFYGATE_DIFY_API_KEY")
+		reportError(log, sentry.LevelError, "Dify rejected the API key; check DIFYGATE_DIFY_API_KEY", apiErr,
+			map[string]string{"upstream": "dify", "error_code": apiErr.Code, "dify_status": strconv.Itoa(apiErr.Status)})
+	case apiErr.Overloaded():
+		wait := h.breaker.trip(apiErr)
+		log.WithError(apiErr).WithField("cooldown", wait.String()).Warn("Dify is over quota or rate limited, holding back requests")
+	case apiErr.Blocked():
+		log.WithError(apiErr).Info("Moderation blocked the question or the answer")
+	case apiErr.Unavailable():
+		log.WithError(apiErr).Error("Dify API returned error")
+		reportError(log, sentry.LevelError, "The Dify app or its model can't answer", apiErr,
+			map[string]string{"upstream": "dify", "error_code": apiErr.Code, "dify_status": strconv.Itoa(apiErr.Status)})
+	default:
+		log.WithError(apiErr).Error("Dify API returned error")
+	}
+}
@@ -0,0 +1,214 @@
+package gateapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tracoco/DifyGate/apierror"
+	"github.com/tracoco/DifyGate/config"
+)
+
+func TestDifyAPIErrorKinds(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        *DifyAPIError
+		gone       bool
+		overloaded bool
+		unauth     bool
+		wantKey    string
+	}{
+		{"conversation code", &DifyAPIError{Status: 404, Code: "conversation_not_exists"}, true, false, false, config.MsgError},
+		{"conversation message", &DifyAPIError{Status: 404, Code: "not_found", Message: "Conversation Not Exists."}, true, false, false, config.MsgError},
+		{"other 404", &DifyAPIError{Status: 404, Code: "not_found", Message: "App not found"}, false, false, false, config.MsgError},
+		{"rate limited", &DifyAPIError{Status: 429}, false, true, false, config.MsgHighDemand},
+		{"quota", &DifyAPIError{Status: 400, Code: "provider_quota_exceeded"}, false, true, false, config.MsgHighDemand},
+		{"bad key", &DifyAPIError{Status: 401, Code: "unauthorized"}, false, false, true, config.MsgError},
+		{"unavailable", &DifyAPIError{Status: 400, Code: "app_unavailable"}, false, false, false, config.MsgUnavailable},
+		{"moderation", &DifyAPIError{Status: 400, Code: "content_filter"}, false, false, false, config.MsgContentBlocked},
+	}
+	for _, tt := range tests {
+		if got := tt.err.ConversationGone(); got != tt.gone {
+			t.Errorf("%s: ConversationGone = %v", tt.name, got)
+		}
+		if got := tt.err.Overloaded(); got != tt.overloaded {
+			t.Errorf("%s: Overloaded = %v", tt.name, got)
+		}
+		if got := tt.err.Unauthorized(); got != tt.unauth {
+			t.Errorf("%s: Unauthorized = %v", tt.name, got)
+		}
+		// The error reaches the pipeline wrapped
+		if got := errorMessageKey(fmt.Errorf("stream failed: %w", tt.err)); got != tt.wantKey {
+			t.Errorf("%s: message %q, want %q", tt.name, got, tt.wantKey)
+		}
+	}
+
+	if got := errorMessageKey(context.DeadlineExceeded); got != config.MsgTimeout {
+		t.Errorf("message %q for a timeout, want %q", got, config.MsgTimeout)
+	}
+	if got := errorMessageKey(errors.New("connection refused")); got != config.MsgError {
+		t.Errorf("message %q for a network error, want %q", got, config.MsgError)
+	}
+}
+
+func TestParseDifyError(t *testing.T) {
+	resp := &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{"Retry-After": {"30"}}}
+	apiErr := parseDifyError(resp, []byte(`{"status":429,"code":"too_many_requests","message":"Slow down"}`))
+	if apiErr.Status != 429 || apiErr.Code != "too_many_requests" || apiErr.Message != "Slow down" || apiErr.RetryAfter != 30*time.Second {
+		t.Errorf("parsed %+v", apiErr)
+	}
+
+	// A proxy's error page keeps its text, and the status of the response
+	resp = &http.Response{StatusCode: http.StatusBadGateway, Header: http.Header{"Retry-After": {"soon"}}}
+	apiErr = parseDifyError(resp, []byte("<html>502 Bad Gateway</html>\n"))
+	if apiErr.Status != 502 || apiErr.Code != "" || apiErr.Message != "<html>502 Bad Gateway</html>" || apiErr.RetryAfter != 0 {
+		t.Errorf("parsed %+v", apiErr)
+	}
+}
+
+// difyReply is one canned response of scriptedDify
+type difyReply struct {
+	status     int
+	retryAfter string
+	body       string
+}
+
+// scriptedDify answers chat-messages with replies in turn, recording the
+// conversation ID each request asked about
+type scriptedDify struct {
+	mu            sync.Mutex
+	replies       []difyReply
+	conversations []string
+}
+
+func newScriptedDify(t *testing.T, cfg config.DifyConfig, replies ...difyReply) (*scriptedDify, *DifyHandler) {
+	t.Helper()
+	f := &scriptedDify{replies: replies}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req ChatMessageRequest
+		body, _ := io.ReadAll(r.Body)
+		json.Unmarshal(body, &req)
+		f.mu.Lock()
+		f.conversations = append(f.conversations, req.ConversationID)
+		reply := difyReply{status: http.StatusInternalServerError, body: `{"code":"unexpected","message":"no reply left"}`}
+		if len(f.replies) > 0 {
+			reply, f.replies = f.replies[0], f.replies[1:]
+		}
+		f.mu.Unlock()
+
+		if reply.retryAfter != "" {
+			w.Header().Set("Retry-After", reply.retryAfter)
+		}
+		w.WriteHeader(reply.status)
+		w.Write([]byte(reply.body))
+	}))
+	t.Cleanup(srv.Close)
+
+	cfg.BaseURL = srv.URL
+	return f, NewDifyHandler(cfg, &HTTPClients{Dify: srv.Client(), DifyStream: srv.Client()}, quietLogger())
+}
+
+func (f *scriptedDify) asked() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.conversations...)
+}
+
+func TestDifyChatMessageRecoversGoneConversation(t *testing.T) {
+	f, h := newScriptedDify(t, config.DifyConfig{},
+		difyReply{status: http.StatusNotFound, body: `{"status":404,"code":"conversation_not_exists","message":"Conversation Not Exists."}`},
+		difyReply{status: http.StatusOK, body: `{"answer":"Hello","conversation_id":"conv-new"}`})
+
+	resp, err := h.DifyChatMessage(context.Background(), DifyChatMessageRequest{Query: "Hi", ConversationID: "conv-old"})
+	if err != nil || resp.ConversationID != "conv-new" {
+		t.Fatalf("DifyChatMessage = %+v, %v, want the new conversation's answer", resp, err)
+	}
+	if asked := f.asked(); len(asked) != 2 || asked[0] != "conv-old" || asked[1] != "" {
+		t.Errorf("asked about conversations %q, want conv-old then a new one", asked)
+	}
+
+	// Starting over is tried once, and failing marks the conversation reset
+	f, h = newScriptedDify(t, config.DifyConfig{},
+		difyReply{status: http.StatusNotFound, body: `{"code":"conversation_not_exists","message":"Conversation Not Exists."}`},
+		difyReply{status: http.StatusBadRequest, body: `{"code":"app_unavailable","message":"App unavailable"}`})
+	_, err = h.DifyChatMessage(context.Background(), DifyChatMessageRequest{Query: "Hi", ConversationID: "conv-old"})
+	if apiErr, ok := asDifyAPIError(err); !errors.Is(err, ErrConversationReset) || !ok || apiErr.Code != "app_unavailable" {
+		t.Errorf("error %v, want the retry's error marked as a reset", err)
+	}
+	if asked := f.asked(); len(asked) != 2 {
+		t.Errorf("asked %d times, want 2", len(asked))
+	}
+}
+
+func TestDifyBreakerHoldsBackOverloadedCalls(t *testing.T) {
+	f, h := newScriptedDify(t, config.DifyConfig{BreakerCooldown: time.Hour},
+		difyReply{status: http.StatusTooManyRequests, retryAfter: "60", body: `{"code":"too_many_requests","message":"Rate limited"}`})
+	before := difyErrors.Value("too_many_requests")
+
+	_, err := h.DifyChatMessage(context.Background(), DifyChatMessageRequest{Query: "Hi"})
+	apiErr, ok := asDifyAPIError(err)
+	if !ok || !apiErr.Overloaded() || apiErr.RetryAfter != time.Minute {
+		t.Fatalf("error %v, want Dify's rate limit", err)
+	}
+	if n := difyErrors.Value("too_many_requests") - before; n != 1 {
+		t.Errorf("counted %v errors, want 1", n)
+	}
+
+	// Until Retry-After passes, neither blocking nor streaming calls reach Dify
+	if _, err := h.DifyChatMessage(context.Background(), DifyChatMessageRequest{Query: "Hi"}); err != error(apiErr) {
+		t.Errorf("blocking error %v, want the breaker's cause", err)
+	}
+	_, errChan := h.DifyChatMessageStreaming(context.Background(), DifyChatMessageRequest{Query: "Hi"})
+	if err := <-errChan; err == nil || !strings.Contains(err.Error(), "too_many_requests") {
+		t.Errorf("streaming error %v, want the breaker's cause", err)
+	}
+	if asked := f.asked(); len(asked) != 1 {
+		t.Errorf("Dify was asked %d times, want once", len(asked))
+	}
+}
+
+func TestDifyErrorResponse(t *testing.T) {
+	tests := []struct {
+		name           string
+		err            error
+		wantStatus     int
+		wantCode       string
+		wantDifyCode   interface{}
+		wantRetryAfter string
+	}{
+		{"overloaded", &DifyAPIError{Status: 429, Code: "too_many_requests", RetryAfter: 30 * time.Second}, http.StatusServiceUnavailable, apierror.DifyOverloaded, "too_many_requests", "30"},
+		{"api error", fmt.Errorf("wrapped: %w", &DifyAPIError{Status: 400, Code: "invalid_param"}), http.StatusBadGateway, apierror.DifyError, "invalid_param", ""},
+		{"no code", &DifyAPIError{Status: 500}, http.StatusBadGateway, apierror.DifyError, nil, ""},
+		{"network", errors.New("connection refused"), http.StatusBadGateway, apierror.DifyError, nil, ""},
+	}
+	gin.SetMode(gin.TestMode)
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodPost, "/api/v1/chat-messages", nil)
+		difyErrorResponse(c, tt.err)
+
+		var env struct {
+			Error struct {
+				Code    string                 `json:"code"`
+				Details map[string]interface{} `json:"details"`
+			} `json:"error"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &env)
+		if w.Code != tt.wantStatus || env.Error.Code != tt.wantCode || env.Error.Details["dify_code"] != tt.wantDifyCode {
+			t.Errorf("%s: status %d, body %s", tt.name, w.Code, w.Body.String())
+		}
+		if got := w.Header().Get("Retry-After"); got != tt.wantRetryAfter {
+			t.Errorf("%s: Retry-After %q, want %q", tt.name, got, tt.wantRetryAfter)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package gateapi
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/metrics"
+)
+
+// maxReapInterval caps how long an orphaned stream can outlive its maximum
+// age before the reaper notices it
+const maxReapInterval = 30 * time.Second
+
+// difyStreamsReaped counts streams cancelled for exceeding their maximum age
+var difyStreamsReaped = metrics.NewCounter("difygate_dify_streams_reaped_total",
+	"Dify streams cancelled for exceeding DIFYGATE_DIFY_STREAM_MAX_AGE")
+
+// activeStream is a DifyChatMessageStreaming call in progress
+type activeStream struct {
+	started time.Time
+	cancel  context.CancelFunc
+	log     *logrus.Entry
+	reaped  bool
+}
+
+// streamTracker keeps the streams in progress so leaks show up in the
+// health check, and cancels those older than maxAge, whose consumer has
+// almost certainly stopped reading
+type streamTracker struct {
+	maxAge time.Duration
+
+	mu     sync.Mutex
+	nextID int64
+	active map[int64]*activeStream
+	reaper sync.Once
+}
+
+func newStreamTracker(maxAge time.Duration) *streamTracker {
+	return &streamTracker{
+		maxAge: maxAge,
+		active: make(map[int64]*activeStream),
+	}
+}
+
+// add registers a stream and returns the ID to remove it with
+func (t *streamTracker) add(cancel context.CancelFunc, log *logrus.Entry) int64 {
+	if t.maxAge > 0 {
+		t.reaper.Do(func() { go t.reap() })
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.nextID++
+	t.active[t.nextID] = &activeStream{started: time.Now(), cancel: cancel, log: log}
+	return t.nextID
+}
+
+// remove forgets a stream that has ended
+func (t *streamTracker) remove(id int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.active, id)
+}
+
+// stats returns how many streams are active and the age of the oldest
+func (t *streamTracker) stats() (int, time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var oldest time.Duration
+	for _, s := range t.active {
+		if age := time.Since(s.started); age > oldest {
+			oldest = age
+		}
+	}
+	return len(t.active), oldest
+}
+
+// reap periodically cancels streams older than maxAge; it runs for the
+// life of the process once the first stream starts
+func (t *streamTracker) reap() {
+	interval := t.maxAge / 2
+	if interval > maxReapInterval {
+		interval = maxReapInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		t.reapOnce()
+	}
+}
+
+// reapOnce cancels the streams older than maxAge
+func (t *streamTracker) reapOnce() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, s := range t.active {
+		age := time.Since(s.started)
+		if s.reaped || age <= t.maxAge {
+			continue
+		}
+		s.log.WithFields(logrus.Fields{"age": age.Round(time.Second).String(), "max_age": t.maxAge.String()}).
+			Warn("Dify stream exceeded its maximum age, cancelling it; its consumer probably stopped reading")
+		s.cancel()
+		difyStreamsReaped.Inc()
+		// The stream removes itself as it exits; one that doesn't stays
+		// in the stats, but is only reported once
+		s.reaped = true
+	}
+}
@@ -0,0 +1,40 @@
+package gateapi
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestStreamTrackerReapsOldStreams(t *testing.T) {
+	tracker := newStreamTracker(time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	oldID := tracker.add(cancel, testEntry())
+	tracker.active[oldID].started = time.Now().Add(-2 * time.Hour)
+	freshCtx, freshCancel := context.WithCancel(context.Background())
+	defer freshCancel()
+	tracker.add(freshCancel, testEntry())
+
+	if active, oldest := tracker.stats(); active != 2 || oldest < 2*time.Hour {
+		t.Errorf("stats = %d, %v; want 2 streams, the oldest 2h old", active, oldest)
+	}
+
+	before := difyStreamsReaped.Value()
+	tracker.reapOnce()
+	tracker.reapOnce()
+	if ctx.Err() == nil {
+		t.Error("the stream past its maximum age was not cancelled")
+	}
+	if freshCtx.Err() != nil {
+		t.Error("a fresh stream was cancelled")
+	}
+	if got := difyStreamsReaped.Value() - before; got != 1 {
+		t.Errorf("reaped %v streams, want 1 however often the reaper runs", got)
+	}
+
+	tracker.remove(oldID)
+	if active, _ := tracker.stats(); active != 1 {
+		t.Errorf("%d active streams after one ended, want 1", active)
+	}
+}
@@ -0,0 +1,134 @@
+package gateapi
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/config"
+	"github.com/tracoco/DifyGate/store"
+)
+
+// difyUserModeKey keeps the user ID mode of the last start, to notice a
+// change
+const difyUserModeKey = "difyuser:mode"
+
+// difyUsers names chat users to Dify the way DIFYGATE_DIFY_USER_ID_MODE
+// says. Hashed IDs are mapped back to their user in the store, so admin
+// tooling can tell who a Dify conversation belongs to.
+type difyUsers struct {
+	mode string
+	salt []byte
+}
+
+func newDifyUsers(cfg config.DifyConfig) *difyUsers {
+	return &difyUsers{mode: cfg.UserIDMode, salt: []byte(cfg.UserIDSalt)}
+}
+
+// name is the Dify user of userID on channel; fallback is the channel's
+// own name for it, used without a mode
+func (u *difyUsers) name(channel, userID, fallback string) string {
+	switch u.mode {
+	case config.UserIDRaw:
+		return userID
+	case config.UserIDPrefixed:
+		return channel + ":" + userID
+	case config.UserIDHashed:
+		return u.hashedName(channel, userID)
+	}
+	return fallback
+}
+
+// hashedName is the name of userID on channel in hashed mode
+func (u *difyUsers) hashedName(channel, userID string) string {
+	return channel + ":" + u.hash(channel+":"+userID)
+}
+
+// hash is the HMAC of s keyed by the salt; 128 bits are plenty to keep
+// users apart
+func (u *difyUsers) hash(s string) string {
+	mac := hmac.New(sha256.New, u.salt)
+	mac.Write([]byte(s))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// hashed reports whether names can't be told back without the store
+func (u *difyUsers) hashed() bool {
+	return u.mode == config.UserIDHashed
+}
+
+// remember maps the hashed name of userID on channel back to it, once.
+// A failure is logged; the name is still used.
+func (u *difyUsers) remember(log *logrus.Entry, kv store.Store, channel, userID, name string) {
+	if !u.hashed() {
+		return
+	}
+	if _, err := kv.Get(difyUserKey(name)); err == nil {
+		return
+	}
+	if err := kv.Set(difyUserKey(name), []byte(channel+":"+userID), 0); err != nil {
+		log.WithError(err).Warn("Failed to store the Dify user ID mapping")
+	}
+}
+
+// checkMode warns when the mode or salt changed since the last start, as
+// every user then starts a new Dify conversation. Gateways that kept no
+// mode used the default one.
+func (u *difyUsers) checkMode(kv store.Store, log *logrus.Logger) {
+	current := u.mode
+	if current == "" {
+		current = "default"
+	}
+	if u.hashed() {
+		// A change of salt renames everyone too, so it is kept as a
+		// fingerprint that doesn't give the salt away
+		current += ":" + u.hash("")[:8]
+	}
+	previous, err := kv.Get(difyUserModeKey)
+	if errors.Is(err, store.ErrNotFound) {
+		previous, err = []byte("default"), nil
+	}
+	if err != nil {
+		log.WithError(err).Warn("Failed to look up the previous Dify user ID mode")
+		return
+	}
+	if string(previous) == current {
+		return
+	}
+	log.WithFields(logrus.Fields{
+		"previous": strings.SplitN(string(previous), ":", 2)[0],
+		"mode":     strings.SplitN(current, ":", 2)[0],
+	}).Warn("The Dify user ID mode or salt changed: every user starts a new Dify conversation")
+	if err := kv.Set(difyUserModeKey, []byte(current), 0); err != nil {
+		log.WithError(err).Warn("Failed to store the Dify user ID mode")
+	}
+}
+
+// resolve returns the channel and user ID a Dify user stands for, looking
+// hashed ones up in the store. Other names are taken apart as the mode
+// makes them; raw ones are on no channel in particular.
+func (u *difyUsers) resolve(kv store.Store, name string) (channel, userID string, err error) {
+	if u.hashed() {
+		value, err := kv.Get(difyUserKey(name))
+		if err != nil {
+			return "", "", err
+		}
+		name = string(value)
+	} else if u.mode == config.UserIDRaw {
+		return "", name, nil
+	}
+	if channel, userID, ok := strings.Cut(name, ":"); ok {
+		return channel, userID, nil
+	}
+	// WhatsApp users are known by their bare number by default
+	return "whatsapp", name, nil
+}
+
+// difyUserKey holds the user a hashed Dify user ID stands for, as
+// "<channel>:<user ID>"
+func difyUserKey(name string) string {
+	return "difyuser:" + name
+}
@@ -0,0 +1,170 @@
+package gateapi
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/config"
+	"github.com/tracoco/DifyGate/store"
+)
+
+func TestDifyUserNames(t *testing.T) {
+	salt := "0123456789abcdef"
+	for _, tc := range []struct {
+		mode string
+		want string
+	}{
+		{"", "15551234567"},
+		{config.UserIDRaw, "15551234567"},
+		{config.UserIDPrefixed, "whatsapp:15551234567"},
+	} {
+		u := newDifyUsers(config.DifyConfig{UserIDMode: tc.mode, UserIDSalt: salt})
+		if got := u.name("whatsapp", "15551234567", "15551234567"); got != tc.want {
+			t.Errorf("mode %q named %q, want %q", tc.mode, got, tc.want)
+		}
+	}
+
+	u := newDifyUsers(config.DifyConfig{UserIDMode: config.UserIDHashed, UserIDSalt: salt})
+	hashed := u.name("whatsapp", "15551234567", "15551234567")
+	if !strings.HasPrefix(hashed, "whatsapp:") || strings.Contains(hashed, "15551234567") || len(hashed) != len("whatsapp:")+32 {
+		t.Fatalf("hashed name %q", hashed)
+	}
+	if again := u.name("whatsapp", "15551234567", ""); again != hashed {
+		t.Errorf("hashed name %q then %q, want it stable", hashed, again)
+	}
+	if other := u.name("sms", "15551234567", ""); other == "sms:"+hashed[len("whatsapp:"):] {
+		t.Error("the same number on another channel has the same hash")
+	}
+	resalted := newDifyUsers(config.DifyConfig{UserIDMode: config.UserIDHashed, UserIDSalt: salt + "!"})
+	if resalted.name("whatsapp", "15551234567", "") == hashed {
+		t.Error("another salt gives the same name")
+	}
+
+	kv := store.NewMemoryStore()
+	if _, _, err := u.resolve(kv, hashed); err != store.ErrNotFound {
+		t.Fatalf("resolved an unknown hash: %v", err)
+	}
+	u.remember(testEntry(), kv, "whatsapp", "15551234567", hashed)
+	if channel, userID, err := u.resolve(kv, hashed); err != nil || channel != "whatsapp" || userID != "15551234567" {
+		t.Fatalf("resolved %q, %q, %v", channel, userID, err)
+	}
+	if channel, userID, _ := newDifyUsers(config.DifyConfig{}).resolve(kv, "slack:U123"); channel != "slack" || userID != "U123" {
+		t.Errorf("resolved a default name to %q, %q", channel, userID)
+	}
+}
+
+func TestDifyUserModeChangeIsNoticed(t *testing.T) {
+	kv := store.NewMemoryStore()
+	var logs bytes.Buffer
+	log := logrus.New()
+	log.SetOutput(&logs)
+	check := func(mode, salt string) bool {
+		logs.Reset()
+		newDifyUsers(config.DifyConfig{UserIDMode: mode, UserIDSalt: salt}).checkMode(kv, log)
+		return strings.Contains(logs.String(), "mode or salt changed")
+	}
+	if check("", "") {
+		t.Error("warned on the default mode")
+	}
+	if !check(config.UserIDHashed, "0123456789abcdef") {
+		t.Error("no warning switching to hashed")
+	}
+	if check(config.UserIDHashed, "0123456789abcdef") {
+		t.Error("warned on an unchanged mode")
+	}
+	if strings.Contains(logs.String(), "0123456789abcdef") {
+		t.Error("the salt was logged")
+	}
+	if stored, _ := kv.Get(difyUserModeKey); strings.Contains(string(stored), "0123456789abcdef") {
+		t.Errorf("the salt was stored: %q", stored)
+	}
+	if !check(config.UserIDHashed, "fedcba9876543210") {
+		t.Error("no warning on a new salt")
+	}
+	if !check(config.UserIDPrefixed, "") {
+		t.Error("no warning switching to prefixed")
+	}
+}
+
+func TestPipelineHashesDifyUsers(t *testing.T) {
+	p, _, dify, kv := newTestPipeline(t, PipelineOptions{Channel: "whatsapp", DifyUser: func(msg ChannelMessage) string { return msg.UserID }}, config.ChatConfig{},
+		func(req ChatMessageRequest) []StreamingChatResponse {
+			return difyAnswer("conv-1", "Hello")
+		})
+	p.difyHandler.users = newDifyUsers(config.DifyConfig{UserIDMode: config.UserIDHashed, UserIDSalt: "0123456789abcdef"})
+	p.Handle(testEntry(), ChannelMessage{ChannelID: "bot", UserID: "15551234567", Text: "hi"})
+
+	dify.mu.Lock()
+	user := dify.requests[0].User
+	dify.mu.Unlock()
+	if user != p.difyHandler.users.name("whatsapp", "15551234567", "") || strings.Contains(user, "15551234567") {
+		t.Fatalf("Dify got user %q, want the hashed number", user)
+	}
+	if mapped, err := kv.Get(difyUserKey(user)); err != nil || string(mapped) != "whatsapp:15551234567" {
+		t.Fatalf("mapping %q, %v", mapped, err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	users := NewUserDataHandler(kv, nil, p.difyHandler, nil, quietLogger())
+	r.GET("/dify-users/:user", users.ResolveDifyUser)
+	r.GET("/users/:number", users.GetUser)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/dify-users/"+user, nil))
+	var resolved map[string]string
+	json.Unmarshal(w.Body.Bytes(), &resolved)
+	if w.Code != http.StatusOK || resolved["channel"] != "whatsapp" || resolved["user_id"] != "15551234567" {
+		t.Fatalf("resolve answered %d %s", w.Code, w.Body)
+	}
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/dify-users/whatsapp:unknown", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("resolving an unknown ID answered %d, want 404", w.Code)
+	}
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/users/+15551234567", nil))
+	if !bytes.Contains(w.Body.Bytes(), []byte(`"dify_user":"`+user+`"`)) || !bytes.Contains(w.Body.Bytes(), []byte(difyUserKey(user))) {
+		t.Errorf("user data %s, want the Dify user and its mapping", w.Body)
+	}
+}
+
+func TestDifyUserMappingIsSealedAndErased(t *testing.T) {
+	inner := store.NewMemoryStore()
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32))
+	kv, err := store.NewEncryptedStore(inner, []string{key}, sensitiveStoreKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.DifyConfig{UserIDMode: config.UserIDHashed, UserIDSalt: "0123456789abcdef"}
+	difyHandler := NewDifyHandler(cfg, &HTTPClients{Dify: http.DefaultClient}, quietLogger())
+	name := difyHandler.users.name("whatsapp", "15551234567", "")
+	difyHandler.users.remember(testEntry(), kv, "whatsapp", "15551234567", name)
+
+	if raw, _ := inner.Get(difyUserKey(name)); !strings.HasPrefix(string(raw), "enc1:") || strings.Contains(string(raw), "15551234567") {
+		t.Fatalf("mapping stored as %q, want it sealed", raw)
+	}
+	if mapped, err := kv.Get(difyUserKey(name)); err != nil || string(mapped) != "whatsapp:15551234567" {
+		t.Fatalf("mapping %q, %v", mapped, err)
+	}
+
+	// Erased even once the mode is no longer hashed
+	cfg.UserIDMode = config.UserIDPrefixed
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.DELETE("/users/:number", NewUserDataHandler(kv, nil, NewDifyHandler(cfg, &HTTPClients{Dify: http.DefaultClient}, quietLogger()), nil, quietLogger()).DeleteUser)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/users/+15551234567", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	if _, err := inner.Get(difyUserKey(name)); err != store.ErrNotFound {
+		t.Errorf("mapping left after erasure: %v", err)
+	}
+}
@@ -7,36 +7,96 @@ import (
 	"fmt"
 	"io"
 	"net/http"
-	"os"
 	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/config"
+	"github.com/tracoco/DifyGate/metrics"
 )
 
+// difyOpenStreams counts streaming requests to Dify in progress
+var difyOpenStreams = metrics.NewGauge("difygate_dify_open_streams",
+	"Streaming chat-message requests to Dify in progress")
+
+// difyChunksDropped counts answer chunks dropped for a slow consumer
+var difyChunksDropped = metrics.NewCounter("difygate_dify_stream_chunks_dropped_total",
+	"Dify answer chunks dropped because the stream buffer was full (DIFYGATE_DIFY_STREAM_BACKPRESSURE=drop)")
+
+// difyTTSChunksDropped counts speech events skipped without voice replies
+var difyTTSChunksDropped = metrics.NewCounter("difygate_dify_tts_chunks_dropped_total",
+	"Dify tts_message events skipped unparsed because voice replies are off")
+
+// defaultStreamBufferSize is used when no buffer size is configured
+const defaultStreamBufferSize = 100
+
 // DifyHandler handles Dify API integration
 type DifyHandler struct {
 	log          *logrus.Logger
 	difyBaseURL  string
 	difyAPIKey   string
 	difyClientID string
+	client       *http.Client
+	streamClient *http.Client
+	breaker      *difyBreaker
+	streams      *streamTracker
+	// requestTimeout bounds blocking calls whose context has no deadline
+	requestTimeout time.Duration
+	bufferSize     int
+	dropChunks     bool
+	// keepAudio passes on tts_message events for voice replies; without it
+	// they are dropped before being parsed
+	keepAudio bool
+	// defaultInputs are merged under the inputs of every request
+	defaultInputs map[string]interface{}
+	// users names chat users to Dify
+	users *difyUsers
 }
 
-// NewDifyHandler creates a new Dify API handler
-func NewDifyHandler(log *logrus.Logger) *DifyHandler {
+// NewDifyHandler creates a new Dify API handler using the shared clients
+func NewDifyHandler(cfg config.DifyConfig, clients *HTTPClients, log *logrus.Logger) *DifyHandler {
 	return &DifyHandler{
-		log:          log,
-		difyBaseURL:  getEnvOrDefault("DIFYGATE_DIFY_BASE_URL", "https://api.dify.ai/v1"),
-		difyAPIKey:   getEnvOrDefault("DIFYGATE_DIFY_API_KEY", ""),
-		difyClientID: getEnvOrDefault("DIFYGATE_DIFY_CLIENT_ID", ""),
+		log:            log,
+		difyBaseURL:    strings.TrimSuffix(cfg.BaseURL, "/"),
+		difyAPIKey:     cfg.APIKey,
+		difyClientID:   cfg.ClientID,
+		client:         clients.Dify,
+		streamClient:   clients.DifyStream,
+		breaker:        &difyBreaker{cooldown: cfg.BreakerCooldown},
+		requestTimeout: cfg.RequestTimeout,
+		streams:        newStreamTracker(streamMaxAge(cfg)),
+		bufferSize:     cfg.StreamBufferSize,
+		dropChunks:     cfg.StreamBackpressure == config.BackpressureDrop,
+		defaultInputs:  cfg.DefaultInputs,
+		users:          newDifyUsers(cfg),
+	}
+}
+
+// streamMaxAge is DIFYGATE_DIFY_STREAM_MAX_AGE, defaulting to twice the
+// stream timeout
+func streamMaxAge(cfg config.DifyConfig) time.Duration {
+	if cfg.StreamMaxAge > 0 {
+		return cfg.StreamMaxAge
 	}
+	return 2 * cfg.StreamTimeout
 }
 
-// Helper function to get environment variable with default value
-func getEnvOrDefault(key, defaultValue string) string {
-	if value, exists := os.LookupEnv(key); exists {
-		return value
+// mergeInputs combines Dify inputs, later layers overriding earlier ones key
+// by key; the result is never nil, as Dify requires inputs
+func mergeInputs(layers ...map[string]interface{}) map[string]interface{} {
+	merged := map[string]interface{}{}
+	for _, layer := range layers {
+		for k, v := range layer {
+			merged[k] = v
+		}
 	}
-	return defaultValue
+	return merged
+}
+
+// StreamStats returns how many streams are in progress and the age of the
+// oldest, for spotting leaked streams
+func (h *DifyHandler) StreamStats() (active int, oldest time.Duration) {
+	return h.streams.stats()
 }
 
 // ChatMessageRequest represents the request body for the Dify chat-message API
@@ -65,13 +125,70 @@ type ChatMessageResponse struct {
 
 // StreamingChatResponse represents a streaming response chunk from Dify
 type StreamingChatResponse struct {
-	Event        string      `json:"event"`
-	ID           string      `json:"id,omitempty"`
-	Answer       string      `json:"answer,omitempty"`
-	Metadata     interface{} `json:"metadata,omitempty"`
-	ErrorMsg     string      `json:"error,omitempty"`
-	Status       string      `json:"status,omitempty"`
-	FinishReason string      `json:"finish_reason,omitempty"`
+	Event          string      `json:"event"`
+	ID             string      `json:"id,omitempty"`
+	ConversationID string      `json:"conversation_id,omitempty"`
+	MessageID      string      `json:"message_id,omitempty"`
+	TaskID         string      `json:"task_id,omitempty"`
+	Answer         string      `json:"answer,omitempty"`
+	Metadata       interface{} `json:"metadata,omitempty"`
+	ErrorMsg       string      `json:"error,omitempty"`
+	// Status is a string on workflow events and the HTTP status on errors
+	Status       json.RawMessage `json:"status,omitempty"`
+	FinishReason string          `json:"finish_reason,omitempty"`
+	// Code and Message describe an error event
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+	// Type, URL and BelongsTo describe the file of a message_file event
+	Type      string `json:"type,omitempty"`
+	URL       string `json:"url,omitempty"`
+	BelongsTo string `json:"belongs_to,omitempty"`
+	// Audio is a base64 chunk of the answer's speech, in tts_message events
+	Audio string `json:"audio,omitempty"`
+	// Data describes the node of a chatflow's node_started and
+	// node_finished events
+	Data *StreamingNodeData `json:"data,omitempty"`
+}
+
+// StreamingNodeData is the part of a chatflow node event the gateway uses
+type StreamingNodeData struct {
+	NodeID   string `json:"node_id,omitempty"`
+	NodeType string `json:"node_type,omitempty"`
+	Title    string `json:"title,omitempty"`
+}
+
+// apiError returns the error an error event describes
+func (r StreamingChatResponse) apiError() *DifyAPIError {
+	apiErr := &DifyAPIError{Code: r.Code, Message: r.Message}
+	if apiErr.Message == "" {
+		apiErr.Message = r.ErrorMsg
+	}
+	_ = json.Unmarshal(r.Status, &apiErr.Status)
+	return apiErr
+}
+
+// DifyUsage is the token usage Dify reports in message_end metadata
+type DifyUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+	// TotalPrice is what the answer cost in Currency, for providers Dify
+	// has prices for; Dify sends it as a string
+	TotalPrice json.Number `json:"total_price,omitempty"`
+	Currency   string      `json:"currency,omitempty"`
+	// Model names the model that answered, when Dify reports it
+	Model string `json:"model,omitempty"`
+}
+
+// usage returns the token usage of a message_end event, or zero values
+func (r StreamingChatResponse) usage() DifyUsage {
+	var metadata struct {
+		Usage DifyUsage `json:"usage"`
+	}
+	if b, err := json.Marshal(r.Metadata); err == nil {
+		_ = json.Unmarshal(b, &metadata)
+	}
+	return metadata.Usage
 }
 
 // TextResponse represents a text response segment from Dify
@@ -97,13 +214,23 @@ type DifyChatMessageRequest struct {
 	ResponseMode   string                 `json:"response_mode,omitempty"`
 }
 
-// DifyChatMessage sends a message to Dify API and returns the response
-func (h *DifyHandler) DifyChatMessage(req DifyChatMessageRequest) (*ChatMessageResponse, error) {
+// DifyChatMessage sends a message to Dify API and returns the response.
+// It gives up when ctx ends, or after DIFYGATE_DIFY_REQUEST_TIMEOUT when
+// ctx has no deadline, so pass the caller's request context to stop the
+// upstream work when the caller goes away.
+func (h *DifyHandler) DifyChatMessage(ctx context.Context, req DifyChatMessageRequest) (*ChatMessageResponse, error) {
+	if _, ok := ctx.Deadline(); !ok && h.requestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.requestTimeout)
+		defer cancel()
+	}
+	log := loggerFromContext(ctx, h.log)
+
 	// Prepare request to Dify API
 	difyReq := ChatMessageRequest{
 		Query:          req.Query,
 		User:           req.User,
-		Inputs:         req.Inputs,
+		Inputs:         mergeInputs(h.defaultInputs, req.Inputs),
 		ConversationID: req.ConversationID,
 		ResponseMode:   req.ResponseMode,
 	}
@@ -118,18 +245,22 @@ func (h *DifyHandler) DifyChatMessage(req DifyChatMessageRequest) (*ChatMessageR
 		return nil, fmt.Errorf("streaming mode not supported in DifyChatMessage, use HandleDifyChatMessageStreaming instead")
 	}
 
+	if cause := h.breaker.check(); cause != nil {
+		return nil, cause
+	}
+
 	// Convert request to JSON
 	reqBody, err := json.Marshal(difyReq)
 	if err != nil {
-		h.log.WithError(err).Error("Failed to marshal Dify request")
+		log.WithError(err).Error("Failed to marshal Dify request")
 		return nil, fmt.Errorf("failed to prepare request: %w", err)
 	}
 
 	// Create HTTP request
 	url := fmt.Sprintf("%s/chat-messages", h.difyBaseURL)
-	httpReq, err := http.NewRequest("POST", url, bytes.NewBuffer(reqBody))
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(reqBody))
 	if err != nil {
-		h.log.WithError(err).Error("Failed to create HTTP request")
+		log.WithError(err).Error("Failed to create HTTP request")
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
@@ -143,10 +274,9 @@ func (h *DifyHandler) DifyChatMessage(req DifyChatMessageRequest) (*ChatMessageR
 	}
 
 	// Send request
-	client := &http.Client{}
-	resp, err := client.Do(httpReq)
+	resp, err := h.client.Do(httpReq)
 	if err != nil {
-		h.log.WithError(err).Error("Failed to send request to Dify API")
+		log.WithError(err).Error("Failed to send request to Dify API")
 		return nil, fmt.Errorf("failed to communicate with Dify API: %w", err)
 	}
 	defer resp.Body.Close()
@@ -154,139 +284,265 @@ func (h *DifyHandler) DifyChatMessage(req DifyChatMessageRequest) (*ChatMessageR
 	// Read response
 	respBody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		h.log.WithError(err).Error("Failed to read Dify API response")
+		log.WithError(err).Error("Failed to read Dify API response")
 		return nil, fmt.Errorf("failed to read API response: %w", err)
 	}
 
 	// Check if response is successful
 	if resp.StatusCode != http.StatusOK {
-		h.log.WithFields(logrus.Fields{
-			"status_code": resp.StatusCode,
-			"response":    string(respBody),
-		}).Error("Dify API returned error")
-		return nil, fmt.Errorf("Dify API error (status %d): %s", resp.StatusCode, string(respBody))
+		apiErr := parseDifyError(resp, respBody)
+		// A deleted or expired conversation starts over, once
+		if apiErr.ConversationGone() && req.ConversationID != "" {
+			log.WithField("conversation_id", req.ConversationID).Info("Dify conversation no longer exists, starting a new one")
+			difyConversationsRecovered.Inc("blocking")
+			req.ConversationID = ""
+			// The retry shares the deadline of the first attempt
+			retried, err := h.DifyChatMessage(ctx, req)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %w", ErrConversationReset, err)
+			}
+			return retried, nil
+		}
+		h.observeError(log, apiErr)
+		return nil, apiErr
 	}
 
 	// Parse Dify response
 	var difyResp ChatMessageResponse
 	if err := json.Unmarshal(respBody, &difyResp); err != nil {
-		h.log.WithError(err).Error("Failed to parse Dify API response")
+		log.WithError(err).Error("Failed to parse Dify API response")
 		return nil, fmt.Errorf("failed to parse API response: %w", err)
 	}
 
 	return &difyResp, nil
 }
 
+// Ping checks that the Dify API is reachable and accepts the configured key
+// by fetching the app parameters, which is cheap and has no side effects
+func (h *DifyHandler) Ping(ctx context.Context) error {
+	url := fmt.Sprintf("%s/parameters?user=difygate-health", h.difyBaseURL)
+	httpReq, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	if h.difyAPIKey != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+h.difyAPIKey)
+	}
+
+	resp, err := h.client.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("failed to communicate with Dify API: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("Dify API returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// DeleteConversation deletes a conversation of the given Dify user; one
+// that no longer exists counts as deleted
+func (h *DifyHandler) DeleteConversation(ctx context.Context, conversationID, user string) error {
+	reqBody, err := json.Marshal(map[string]string{"user": user})
+	if err != nil {
+		return fmt.Errorf("failed to prepare request: %w", err)
+	}
+	url := fmt.Sprintf("%s/conversations/%s", h.difyBaseURL, conversationID)
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodDelete, url, bytes.NewReader(reqBody))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if h.difyAPIKey != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+h.difyAPIKey)
+	}
+
+	resp, err := h.client.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("failed to communicate with Dify API: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		if apiErr := parseDifyError(resp, body); !apiErr.ConversationGone() {
+			return apiErr
+		}
+	}
+	return nil
+}
+
+// StopMessage stops the generation of a streamed answer by its task ID, for
+// the Dify user who asked
+func (h *DifyHandler) StopMessage(ctx context.Context, taskID, user string) error {
+	reqBody, err := json.Marshal(map[string]string{"user": user})
+	if err != nil {
+		return fmt.Errorf("failed to prepare request: %w", err)
+	}
+	url := fmt.Sprintf("%s/chat-messages/%s/stop", h.difyBaseURL, taskID)
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(reqBody))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if h.difyAPIKey != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+h.difyAPIKey)
+	}
+
+	resp, err := h.client.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("failed to communicate with Dify API: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return parseDifyError(resp, body)
+	}
+	return nil
+}
+
 // DifyChatMessageStreaming sends a message to Dify API and returns the response as a stream
 func (h *DifyHandler) DifyChatMessageStreaming(ctx context.Context, req DifyChatMessageRequest) (chan StreamingChatResponse, chan error) {
-	// Initialize channels for the stream
-	responseChan := make(chan StreamingChatResponse, 100) // Buffer to prevent blocking
-	errChan := make(chan error, 1)                        // Buffered to avoid blocking
+	// Initialize channels for the stream; a full buffer is handled by
+	// sendStreamEvent
+	bufferSize := h.bufferSize
+	if bufferSize < 1 {
+		bufferSize = defaultStreamBufferSize
+	}
+	responseChan := make(chan StreamingChatResponse, bufferSize)
+	errChan := make(chan error, 1) // Buffered to avoid blocking
 
 	// Enforce streaming mode
 	req.ResponseMode = "streaming"
 
-	// Create a context with cancel to allow forcing termination
-	_, cancelStream := context.WithCancel(ctx)
+	// Create a context with cancel so the reaper can end an orphaned stream
+	ctx, cancelStream := context.WithCancel(ctx)
 
 	// Start processing in a goroutine
 	go func() {
+		log := loggerFromContext(ctx, h.log)
+
 		defer close(responseChan)
 		defer close(errChan)
 		defer cancelStream()
 
+		difyOpenStreams.Inc()
+		defer difyOpenStreams.Dec()
+		defer h.streams.remove(h.streams.add(cancelStream, log))
+
 		// Prepare request to Dify API
 		difyReq := ChatMessageRequest{
 			Query:          req.Query,
 			User:           req.User,
-			Inputs:         req.Inputs,
+			Inputs:         mergeInputs(h.defaultInputs, req.Inputs),
 			ConversationID: req.ConversationID,
 			ResponseMode:   "streaming",
 		}
 
 		// Log beautified request for debugging
-		if os.Getenv("DIFYGATE_DEBUG") == "true" {
+		if log.Logger.IsLevelEnabled(logrus.DebugLevel) {
 			prettyJSON, err := json.MarshalIndent(difyReq, "", "  ")
 			if err == nil {
-				h.log.WithField("dify_request", string(prettyJSON)).Info("Dify streaming request")
+				log.WithField("dify_request", string(prettyJSON)).Debug("Dify streaming request")
 			}
 		}
 
-		// Convert request to JSON
-		reqBody, err := json.Marshal(difyReq)
-		if err != nil {
-			h.log.WithError(err).Error("Failed to marshal Dify streaming request")
-			errChan <- fmt.Errorf("failed to prepare streaming request: %w", err)
+		if cause := h.breaker.check(); cause != nil {
+			log.WithField("dify_code", cause.Code).Warn("Dify requests are held back after a quota or rate limit error")
+			errChan <- cause
 			return
 		}
 
-		// Create HTTP request
 		url := fmt.Sprintf("%s/chat-messages", h.difyBaseURL)
-		httpReq, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(reqBody))
-		if err != nil {
-			h.log.WithError(err).Error("Failed to create HTTP streaming request")
-			errChan <- fmt.Errorf("failed to create streaming request: %w", err)
-			return
+		var resp *http.Response
+		// recovered is set once the request starts over as a new
+		// conversation, so failures tell the caller to forget the old one
+		recovered := false
+		fail := func(err error) {
+			if recovered {
+				err = fmt.Errorf("%w: %w", ErrConversationReset, err)
+			}
+			errChan <- err
 		}
+		for {
+			// Convert request to JSON
+			reqBody, err := json.Marshal(difyReq)
+			if err != nil {
+				log.WithError(err).Error("Failed to marshal Dify streaming request")
+				fail(fmt.Errorf("failed to prepare streaming request: %w", err))
+				return
+			}
 
-		// Set headers
-		httpReq.Header.Set("Content-Type", "application/json")
-		httpReq.Header.Set("Accept", "text/event-stream")
-		if h.difyAPIKey != "" {
-			httpReq.Header.Set("Authorization", "Bearer "+h.difyAPIKey)
-		}
-		/* 		if h.difyClientID != "" {
-			httpReq.Header.Set("X-Client-Id", h.difyClientID)
-		} */
-
-		// Log detailed request info
-		h.log.WithFields(logrus.Fields{
-			"url":    url,
-			"method": "POST",
-		}).Info("Sending streaming request to Dify API")
-
-		// Send request
-		client := &http.Client{
-			Timeout: 0, // No timeout for streaming requests
-		}
-		resp, err := client.Do(httpReq)
-		if err != nil {
-			h.log.WithError(err).Error("Failed to send streaming request to Dify API")
-			errChan <- fmt.Errorf("failed to communicate with Dify API: %w", err)
-			return
-		}
-		defer resp.Body.Close()
+			// Create HTTP request
+			httpReq, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(reqBody))
+			if err != nil {
+				log.WithError(err).Error("Failed to create HTTP streaming request")
+				fail(fmt.Errorf("failed to create streaming request: %w", err))
+				return
+			}
+
+			// Set headers
+			httpReq.Header.Set("Content-Type", "application/json")
+			httpReq.Header.Set("Accept", "text/event-stream")
+			// Asks caching proxies to pass events on as they come
+			httpReq.Header.Set("Cache-Control", "no-cache")
+			if h.difyAPIKey != "" {
+				httpReq.Header.Set("Authorization", "Bearer "+h.difyAPIKey)
+			}
+
+			// Log detailed request info
+			log.WithFields(logrus.Fields{
+				"url":    url,
+				"method": "POST",
+			}).Info("Sending streaming request to Dify API")
+
+			// Send request; the stream client has no overall timeout
+			resp, err = h.streamClient.Do(httpReq)
+			if err != nil {
+				log.WithError(err).Error("Failed to send streaming request to Dify API")
+				fail(fmt.Errorf("failed to communicate with Dify API: %w", err))
+				return
+			}
+			if resp.StatusCode == http.StatusOK {
+				break
+			}
 
-		// Check response status
-		if resp.StatusCode != http.StatusOK {
 			body, _ := io.ReadAll(resp.Body)
-			h.log.WithFields(logrus.Fields{
-				"status_code": resp.StatusCode,
-				"response":    string(body),
-			}).Error("Dify API returned error for streaming request")
-			errChan <- fmt.Errorf("Dify API streaming error (status %d): %s", resp.StatusCode, string(body))
+			resp.Body.Close()
+			apiErr := parseDifyError(resp, body)
+			// A deleted or expired conversation starts over, once; the
+			// caller then stores the new conversation in its place
+			if apiErr.ConversationGone() && difyReq.ConversationID != "" {
+				log.WithField("conversation_id", difyReq.ConversationID).Info("Dify conversation no longer exists, starting a new one")
+				difyConversationsRecovered.Inc("streaming")
+				difyReq.ConversationID = ""
+				recovered = true
+				continue
+			}
+			h.observeError(log, apiErr)
+			fail(apiErr)
 			return
 		}
+		defer resp.Body.Close()
+		// Close the body as soon as ctx ends, so a read blocked on a
+		// connection Dify keeps open without sending returns at once
+		stopWatching := context.AfterFunc(ctx, func() { resp.Body.Close() })
+		defer stopWatching()
 
 		// Log that we're starting to process the stream
-		h.log.Info("Starting to process Dify SSE stream")
+		log.Info("Starting to process Dify SSE stream")
 
 		// Process the SSE stream using io.Reader
 		var eventData []byte
 
 		for {
 			buf := make([]byte, 10240)
+			// A read may return the last events along with its error, so
+			// they are processed before the error is
 			n, err := resp.Body.Read(buf)
-			if err != nil {
-				if err != io.EOF && !strings.Contains(err.Error(), "context canceled") {
-					h.log.WithError(err).Error("Error reading SSE stream")
-					errChan <- fmt.Errorf("error reading SSE stream: %w", err)
-				} else {
-					h.log.Info("SSE stream ended")
-				}
-				break
-			}
-
 			data := buf[:n]
 			eventData = append(eventData, data...)
 
@@ -300,29 +556,52 @@ func (h *DifyHandler) DifyChatMessageStreaming(ctx context.Context, req DifyChat
 				event := eventData[:idx]
 				eventData = eventData[idx+2:]
 
-				evtStr := string(event)
-				// Only process events that start with 'data:'
-				if strings.HasPrefix(evtStr, "data:") {
+				// Only process events that start with 'data:', without
+				// copying events as large as speech chunks
+				if bytes.HasPrefix(event, []byte("data:")) {
 					// Remove 'data:' prefix
 					event = event[5:]
+					if !h.keepAudio && isTTSEvent(event) {
+						difyTTSChunksDropped.Inc()
+						continue
+					}
 					// Process the event
-					processEvent(event, responseChan, h.log)
-					var response StreamingChatResponse
-					if err := json.Unmarshal(event, &response); err != nil {
-						h.log.WithError(err).WithField("data", string(event)).Error("Failed to parse SSE event data")
+					response, ok := processEvent(event, log)
+					if !ok {
 						return
 					}
+					if !sendStreamEvent(ctx, responseChan, response, h.dropChunks) {
+						log.Info("Context canceled while the consumer was behind, stopping SSE processing")
+						return
+					}
+					if response.Event == "error" {
+						h.observeError(log, response.apiError())
+					}
 					if response.Event == "message_end" {
-						h.log.Info("Parse SSE: Received message_end event, terminating stream")
+						log.Info("Parse SSE: Received message_end event, terminating stream")
 						return // Exit the processing goroutine
 					}
 				}
 			}
 
+			if err != nil {
+				// A read failing because ctx ended is a cancellation, not a
+				// stream failure, whatever error the closed body returns
+				if ctxErr := ctx.Err(); ctxErr != nil {
+					log.WithField("reason", ctxErr.Error()).Info("Context ended, stopping SSE processing")
+				} else if err != io.EOF {
+					log.WithError(err).Error("Error reading SSE stream")
+					errChan <- fmt.Errorf("error reading SSE stream: %w", err)
+				} else {
+					log.Info("SSE stream ended")
+				}
+				break
+			}
+
 			// Check context cancellation
 			select {
 			case <-ctx.Done():
-				h.log.Info("Context canceled, stopping SSE processing")
+				log.Info("Context canceled, stopping SSE processing")
 				return
 			default:
 				// Continue processing
@@ -342,7 +621,7 @@ func (h *DifyHandler) DifyChatMessageStreaming(ctx context.Context, req DifyChat
 
 	   				// Debug each line received in the SSE stream
 	   				if os.Getenv("DIFYGATE_DEBUG") == "true" {
-	   					h.log.WithField("sse_line", line).Info("Received SSE line")
+	   					log.WithField("sse_line", line).Info("Received SSE line")
 	   				}
 
 	   				// Empty line signals the end of an event
@@ -351,11 +630,11 @@ func (h *DifyHandler) DifyChatMessageStreaming(ctx context.Context, req DifyChat
 	   						// Parse the event
 	   						var response StreamingChatResponse
 	   						if err := json.Unmarshal(eventData, &response); err != nil {
-	   							h.log.WithError(err).WithField("data", string(eventData)).Error("Failed to parse SSE event data")
+	   							log.WithError(err).WithField("data", string(eventData)).Error("Failed to parse SSE event data")
 	   						} else {
 	   							// Check if this is a terminal event
 	   							if response.Event == "message_end" {
-	   								h.log.Info("Parse SSE: Received message_end event, terminating stream")
+	   								log.Info("Parse SSE: Received message_end event, terminating stream")
 	   								responseChan <- response
 	   								cancelStream() // This will trigger connection closure
 	   								return         // Exit the processing goroutine
@@ -379,7 +658,7 @@ func (h *DifyHandler) DifyChatMessageStreaming(ctx context.Context, req DifyChat
 	   				// Check context cancellation
 	   				select {
 	   				case <-ctx.Done():
-	   					h.log.Info("Context canceled, stopping SSE processing")
+	   					log.Info("Context canceled, stopping SSE processing")
 	   					return
 	   				default:
 	   					// Continue processing
@@ -390,10 +669,10 @@ func (h *DifyHandler) DifyChatMessageStreaming(ctx context.Context, req DifyChat
 	   		// Check for scanner errors
 	   		if err := scanner.Err(); err != nil {
 	   			if err != io.EOF && !strings.Contains(err.Error(), "context canceled") {
-	   				h.log.WithError(err).Error("Error reading SSE stream")
+	   				log.WithError(err).Error("Error reading SSE stream")
 	   				errChan <- fmt.Errorf("error reading SSE stream: %w", err)
 	   			} else {
-	   				h.log.Info("SSE stream ended")
+	   				log.Info("SSE stream ended")
 	   			}
 	   		}
 	   	}() */
@@ -401,22 +680,102 @@ func (h *DifyHandler) DifyChatMessageStreaming(ctx context.Context, req DifyChat
 	return responseChan, errChan
 }
 
-// Helper function to process SSE events
-func processEvent(data []byte, responseChan chan StreamingChatResponse, log *logrus.Logger) {
+// DifyAnswer is the complete answer to a streamed chat message
+type DifyAnswer struct {
+	Answer         string
+	ConversationID string
+	MessageID      string
+	// TaskID identifies the generation, for stopping it
+	TaskID string
+	Usage  DifyUsage
+}
+
+// Ask streams a chat message to Dify and waits for the complete answer,
+// for channels that reply with a single message
+func (h *DifyHandler) Ask(ctx context.Context, req DifyChatMessageRequest) (*DifyAnswer, error) {
+	return h.ask(ctx, req, nil)
+}
+
+// ask is Ask, calling started with the task ID once Dify has started the
+// answer, so it can be stopped
+func (h *DifyHandler) ask(ctx context.Context, req DifyChatMessageRequest, started func(taskID string)) (*DifyAnswer, error) {
+	respChan, errChan := h.DifyChatMessageStreaming(ctx, req)
+
+	var answer DifyAnswer
+	var text strings.Builder
+	for {
+		select {
+		case err, ok := <-errChan:
+			if !ok {
+				errChan = nil
+				continue
+			}
+			return nil, err
+
+		case resp, ok := <-respChan:
+			if !ok {
+				// errChan closes first, so a pending error is already queued
+				if errChan != nil {
+					if err, ok := <-errChan; ok {
+						return nil, err
+					}
+				}
+				answer.Answer = text.String()
+				return &answer, nil
+			}
+			if resp.ConversationID != "" {
+				answer.ConversationID = resp.ConversationID
+			}
+			if resp.MessageID != "" {
+				answer.MessageID = resp.MessageID
+			}
+			if resp.TaskID != "" && answer.TaskID == "" {
+				answer.TaskID = resp.TaskID
+				if started != nil {
+					started(resp.TaskID)
+				}
+			}
+
+			switch resp.Event {
+			case "message", "agent_message":
+				text.WriteString(resp.Answer)
+			case "message_replace":
+				// Output moderation rewrote the answer
+				text.Reset()
+				text.WriteString(resp.Answer)
+			case "message_end":
+				answer.Answer = text.String()
+				answer.Usage = resp.usage()
+				return &answer, nil
+			case "error":
+				return nil, resp.apiError()
+			}
+
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// processEvent parses the data of an SSE event; ok is false for data that
+// isn't an event
+func processEvent(data []byte, log *logrus.Entry) (StreamingChatResponse, bool) {
+	var response StreamingChatResponse
 	// Skip empty data
-	if len(data) == 0 || string(data) == "" {
-		return
+	if len(data) == 0 {
+		return response, false
 	}
 
-	// Debug the raw data
-	if os.Getenv("DIFYGATE_DEBUG") == "true" {
+	// Debug the raw data, but not the audio
+	if isTTSEvent(data) {
+		log.WithField("event_bytes", len(data)).Debug("Processing SSE speech event")
+	} else {
 		log.WithField("event_data", string(data)).Debug("Processing SSE event data")
 	}
 
-	var response StreamingChatResponse
 	if err := json.Unmarshal(data, &response); err != nil {
 		log.WithError(err).WithField("data", string(data)).Error("Failed to parse SSE event data")
-		return
+		return response, false
 	}
 
 	// Log the parsed response
@@ -424,8 +783,33 @@ func processEvent(data []byte, responseChan chan StreamingChatResponse, log *log
 		"event":  response.Event,
 		"id":     response.ID,
 		"answer": response.Answer,
-	}).Info("Parsed SSE event")
+	}).Debug("Parsed SSE event")
+	return response, true
+}
 
-	// Send to channel
-	responseChan <- response
+// isTTSEvent reports whether the data of an SSE event is a tts_message or
+// tts_message_end, looking only at its start, where Dify puts the event
+func isTTSEvent(data []byte) bool {
+	return bytes.Contains(data[:min(len(data), 48)], []byte(`"tts_message`))
+}
+
+// sendStreamEvent hands an event to the consumer. When the buffer is full
+// it waits for room, giving up when ctx ends; with dropChunks, answer
+// chunks are dropped instead, so only message_end, errors and the other
+// events wait. It returns false when ctx ended first.
+func sendStreamEvent(ctx context.Context, ch chan<- StreamingChatResponse, response StreamingChatResponse, dropChunks bool) bool {
+	if dropChunks && (response.Event == "message" || response.Event == "agent_message") {
+		select {
+		case ch <- response:
+		default:
+			difyChunksDropped.Inc()
+		}
+		return true
+	}
+	select {
+	case ch <- response:
+		return true
+	case <-ctx.Done():
+		return false
+	}
 }
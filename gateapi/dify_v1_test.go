@@ -0,0 +1,229 @@
+package gateapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tracoco/DifyGate/config"
+)
+
+func TestSendStreamEventBackpressure(t *testing.T) {
+	tests := []struct {
+		name       string
+		dropChunks bool
+		event      string
+		wantSent   bool
+		wantDrop   bool
+	}{
+		{"block waits for the consumer", false, "message", false, false},
+		{"drop discards answer chunks", true, "message", true, true},
+		{"drop discards agent chunks", true, "agent_message", true, true},
+		{"drop still waits for message_end", true, "message_end", false, false},
+		{"drop still waits for errors", true, "error", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// A full buffer, and a consumer that never reads
+			ch := make(chan StreamingChatResponse, 1)
+			ch <- StreamingChatResponse{Event: "message"}
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+
+			before := difyChunksDropped.Value()
+			start := time.Now()
+			sent := sendStreamEvent(ctx, ch, StreamingChatResponse{Event: tt.event}, tt.dropChunks)
+			if sent != tt.wantSent {
+				t.Errorf("sendStreamEvent = %v, want %v", sent, tt.wantSent)
+			}
+			if dropped := difyChunksDropped.Value() - before; (dropped == 1) != tt.wantDrop {
+				t.Errorf("dropped %v chunks, want drop %v", dropped, tt.wantDrop)
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("took %v; cancellation must end the wait", elapsed)
+			}
+		})
+	}
+}
+
+func TestProcessEvent(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want StreamingChatResponse
+	}{
+		{"answer chunk", `{"event": "message", "message_id": "m1", "answer": "Hel"}`,
+			StreamingChatResponse{Event: "message", MessageID: "m1", Answer: "Hel"}},
+		{"moderated answer", `{"event": "message_replace", "task_id": "t1", "message_id": "m1", "conversation_id": "c1", "answer": "Sorry, I can't say that.", "created_at": 1705395332}`,
+			StreamingChatResponse{Event: "message_replace", TaskID: "t1", MessageID: "m1", ConversationID: "c1", Answer: "Sorry, I can't say that."}},
+		{"speech", `{"event": "tts_message", "conversation_id": "c1", "message_id": "m1", "audio": "SUQzBAAAAAAAI1RTU0U="}`,
+			StreamingChatResponse{Event: "tts_message", ConversationID: "c1", MessageID: "m1", Audio: "SUQzBAAAAAAAI1RTU0U="}},
+		{"answer node", `{"event": "node_finished", "data": {"node_id": "n2", "node_type": "answer", "title": "Answer", "status": "succeeded"}}`,
+			StreamingChatResponse{Event: "node_finished", Data: &StreamingNodeData{NodeID: "n2", NodeType: "answer", Title: "Answer"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := processEvent([]byte(tt.data), testEntry())
+			if !ok || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("processEvent = %+v, %v; want %+v", got, ok, tt.want)
+			}
+		})
+	}
+	if _, ok := processEvent([]byte("{not json"), testEntry()); ok {
+		t.Error("processEvent accepted invalid data")
+	}
+}
+
+func TestSendStreamEventDeliversWhenRoom(t *testing.T) {
+	for _, dropChunks := range []bool{false, true} {
+		ch := make(chan StreamingChatResponse, 1)
+		if !sendStreamEvent(context.Background(), ch, StreamingChatResponse{Event: "message", Answer: "hi"}, dropChunks) {
+			t.Fatalf("dropChunks=%v: event not sent", dropChunks)
+		}
+		if got := <-ch; got.Answer != "hi" {
+			t.Errorf("dropChunks=%v: got %+v", dropChunks, got)
+		}
+	}
+}
+
+func TestStreamingStopsPromptlyWhenCancelled(t *testing.T) {
+	// Dify sends one chunk, then keeps the connection open without a word
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: {\"event\":\"message\",\"answer\":\"Hel\"}\n\n")
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+	h := NewDifyHandler(config.DifyConfig{BaseURL: srv.URL, StreamTimeout: time.Minute}, &HTTPClients{
+		Dify:       srv.Client(),
+		DifyStream: srv.Client(),
+	}, quietLogger())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	respChan, errChan := h.DifyChatMessageStreaming(ctx, DifyChatMessageRequest{Query: "hi", User: "u1"})
+	if first := <-respChan; first.Answer != "Hel" {
+		t.Fatalf("first event = %+v", first)
+	}
+
+	cancel()
+	deadline := time.After(time.Second)
+	for respChan != nil || errChan != nil {
+		select {
+		case _, ok := <-respChan:
+			if !ok {
+				respChan = nil
+			}
+		case err, ok := <-errChan:
+			if !ok {
+				errChan = nil
+			} else if err != nil {
+				t.Errorf("cancellation reported as a stream error: %v", err)
+			}
+		case <-deadline:
+			t.Fatal("stream goroutine still running a second after cancellation")
+		}
+	}
+	if active, _ := h.StreamStats(); active != 0 {
+		t.Errorf("%d streams still tracked after the goroutine exited", active)
+	}
+}
+
+func TestMergeInputs(t *testing.T) {
+	defaults := map[string]interface{}{"brand": "Acme", "region": "us", "support_email": "help@acme.test"}
+	number := map[string]interface{}{"region": "eu"}
+	request := map[string]interface{}{"region": "de", "topic": "billing"}
+
+	got := mergeInputs(defaults, number, request)
+	want := map[string]interface{}{"brand": "Acme", "region": "de", "support_email": "help@acme.test", "topic": "billing"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("mergeInputs = %v, want %v", got, want)
+	}
+	if defaults["region"] != "us" {
+		t.Error("mergeInputs changed the default inputs")
+	}
+	if got := mergeInputs(nil, nil); got == nil || len(got) != 0 {
+		t.Errorf("mergeInputs(nil, nil) = %#v, want an empty map", got)
+	}
+}
+
+func TestRequestInputsOverrideDefaults(t *testing.T) {
+	dify, h := newFakeDify(t, func(req ChatMessageRequest) []StreamingChatResponse {
+		return difyAnswer("conv-1", "answer")
+	})
+	h.defaultInputs = map[string]interface{}{"brand": "Acme", "region": "us"}
+
+	respChan, errChan := h.DifyChatMessageStreaming(context.Background(), DifyChatMessageRequest{
+		Query:  "hi",
+		User:   "u1",
+		Inputs: map[string]interface{}{"region": "eu"},
+	})
+	for range respChan {
+	}
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+	dify.mu.Lock()
+	defer dify.mu.Unlock()
+	if got := dify.requests[0].Inputs; got["brand"] != "Acme" || got["region"] != "eu" {
+		t.Errorf("inputs = %v, want the default brand and the request's region", got)
+	}
+}
+
+func TestDifyChatMessageHonorsContext(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req ChatMessageRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Query == "slow" {
+			time.Sleep(200 * time.Millisecond)
+			w.Write([]byte(`{"answer":"late but wanted","conversation_id":"conv-1"}`))
+			return
+		}
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+	// The shared clients, as the gateway builds them
+	h := NewDifyHandler(config.DifyConfig{BaseURL: srv.URL, RequestTimeout: 50 * time.Millisecond}, testHTTPClients(), quietLogger())
+
+	// Without a deadline, the request timeout applies
+	start := time.Now()
+	if _, err := h.DifyChatMessage(context.Background(), DifyChatMessageRequest{Query: "hi", User: "u1"}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want the request timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("gave up after %v", elapsed)
+	}
+
+	// A caller's deadline longer than the request timeout is kept
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	resp, err := h.DifyChatMessage(ctx, DifyChatMessageRequest{Query: "slow", User: "u1"})
+	cancel()
+	if err != nil || resp.Answer != "late but wanted" {
+		t.Fatalf("answer %+v, %v; want the caller's deadline to win over the request timeout", resp, err)
+	}
+
+	// A caller going away cancels the call, however long it may take
+	h.requestTimeout = time.Minute
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	start = time.Now()
+	if _, err := h.DifyChatMessage(ctx, DifyChatMessageRequest{Query: "hi", User: "u1"}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want cancelled", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("gave up after %v", elapsed)
+	}
+}
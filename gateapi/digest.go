@@ -0,0 +1,502 @@
+package gateapi
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/apierror"
+	"github.com/tracoco/DifyGate/config"
+	"github.com/tracoco/DifyGate/gate"
+	"github.com/tracoco/DifyGate/metrics"
+	"github.com/tracoco/DifyGate/store"
+)
+
+// digestsSent counts daily digests by trigger, schedule or manual, and
+// outcome: sent or failed
+var digestsSent = metrics.NewCounter("difygate_digests_total",
+	"Daily activity digests emailed, by trigger", "trigger", "outcome")
+
+const (
+	// activityFlushInterval is how often an instance saves its counts to
+	// the store
+	activityFlushInterval = time.Minute
+	// activityRetention is how long a day's counts are kept
+	activityRetention = 72 * time.Hour
+	// digestTopErrors is how many error codes the digest lists
+	digestTopErrors = 5
+	// digestDateLayout names the days of the store keys and the digest
+	digestDateLayout = "2006-01-02"
+)
+
+// dayActivity is what one instance handled on one day
+type dayActivity struct {
+	// Messages are the chat messages handled, by channel
+	Messages map[string]int64 `json:"messages"`
+	// DifyAnswers counts the answers Dify finished, and DifyLatencyMS
+	// adds up how long they took
+	DifyAnswers      int64 `json:"dify_answers"`
+	DifyLatencyMS    int64 `json:"dify_latency_ms"`
+	PromptTokens     int64 `json:"prompt_tokens"`
+	CompletionTokens int64 `json:"completion_tokens"`
+	TotalTokens      int64 `json:"total_tokens"`
+	// Errors are chat messages answered with an error message and failed
+	// email sends, by error code
+	Errors       map[string]int64 `json:"errors"`
+	EmailsSent   int64            `json:"emails_sent"`
+	EmailsFailed int64            `json:"emails_failed"`
+}
+
+func newDayActivity() *dayActivity {
+	return &dayActivity{Messages: make(map[string]int64), Errors: make(map[string]int64)}
+}
+
+// activityKey is the store key of an instance's counts for a day
+func activityKey(day, instance string) string {
+	return "digest:activity:" + day + ":" + instance
+}
+
+// activityUserKey is the store key marking that a user wrote on a day;
+// the user is hashed, as the key outlives deleting their data
+func activityUserKey(day, channel, userID string) string {
+	sum := sha256.Sum256([]byte(userID))
+	return "digest:user:" + day + ":" + channel + ":" + hex.EncodeToString(sum[:8])
+}
+
+// activity counts what the gateway handles each day, for the digest. Each
+// instance keeps its own counts in memory and saves them to the shared
+// store every minute, so the digest adds up every instance; users are
+// marked in the store as they first write, so each is counted once.
+type activity struct {
+	store store.Store
+	loc   *time.Location
+	// instance names this gateway's counts in the store
+	instance string
+
+	mu   sync.Mutex
+	days map[string]*dayActivity
+	// users are the users already marked, by their store key
+	users map[string]bool
+	start sync.Once
+}
+
+func newActivity(kv store.Store, loc *time.Location) *activity {
+	return &activity{
+		store:    kv,
+		loc:      loc,
+		instance: newRequestID(),
+		days:     make(map[string]*dayActivity),
+		users:    make(map[string]bool),
+	}
+}
+
+// today returns the counts of the current day; a.mu must be held
+func (a *activity) today() (string, *dayActivity) {
+	day := time.Now().In(a.loc).Format(digestDateLayout)
+	d, ok := a.days[day]
+	if !ok {
+		d = newDayActivity()
+		a.days[day] = d
+	}
+	return day, d
+}
+
+// message counts a chat message once it is handled
+func (a *activity) message(channel, userID string, t *messageTrace) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	day, d := a.today()
+	d.Messages[channel]++
+	if t.difyLatency > 0 {
+		d.DifyAnswers++
+		d.DifyLatencyMS += t.difyLatency.Milliseconds()
+	}
+	d.PromptTokens += int64(t.usage.PromptTokens)
+	d.CompletionTokens += int64(t.usage.CompletionTokens)
+	d.TotalTokens += int64(t.usage.TotalTokens)
+	if t.failure != "" {
+		d.Errors[t.failure]++
+	}
+	userKey := activityUserKey(day, channel, userID)
+	marked := a.users[userKey]
+	a.users[userKey] = true
+	a.mu.Unlock()
+
+	if !marked {
+		if _, err := a.store.Incr(userKey, activityRetention); err != nil {
+			t.log.WithError(err).Debug("Failed to mark the user as active today")
+		}
+	}
+}
+
+// email counts an email send; it is registered with the email service
+func (a *activity) email(_ gate.Message, err error) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, d := a.today()
+	if err != nil {
+		d.EmailsFailed++
+		d.Errors["email:"+gate.ErrorClass(err)]++
+		return
+	}
+	d.EmailsSent++
+}
+
+// flush saves the counts of every day held, then forgets those before
+// today, which are complete
+func (a *activity) flush() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	today := time.Now().In(a.loc).Format(digestDateLayout)
+	for day, d := range a.days {
+		raw, err := json.Marshal(d)
+		if err != nil {
+			return err
+		}
+		if err := a.store.Set(activityKey(day, a.instance), raw, activityRetention); err != nil {
+			return err
+		}
+		if day != today {
+			delete(a.days, day)
+		}
+	}
+	for key := range a.users {
+		if !strings.HasPrefix(key, "digest:user:"+today+":") {
+			delete(a.users, key)
+		}
+	}
+	return nil
+}
+
+// run saves the counts every activityFlushInterval
+func (a *activity) run(log *logrus.Logger) {
+	a.start.Do(func() {
+		go func() {
+			ticker := time.NewTicker(activityFlushInterval)
+			defer ticker.Stop()
+			for range ticker.C {
+				if err := a.flush(); err != nil {
+					log.WithError(err).Warn("Failed to save the activity counts")
+				}
+			}
+		}()
+	})
+}
+
+// DigestCount is an error code and how often it occurred
+type DigestCount struct {
+	Code  string `json:"code"`
+	Count int64  `json:"count"`
+}
+
+// DigestReport is one day of gateway activity, as emailed
+type DigestReport struct {
+	// Date is the day reported, in DIFYGATE_DIGEST_TIMEZONE
+	Date     string           `json:"date"`
+	Timezone string           `json:"timezone"`
+	Messages map[string]int64 `json:"messages"`
+	// UniqueUsers counts the users who wrote, by channel
+	UniqueUsers   map[string]int64 `json:"unique_users"`
+	TotalMessages int64            `json:"total_messages"`
+	TotalUsers    int64            `json:"total_users"`
+	DifyAnswers   int64            `json:"dify_answers"`
+	// AverageDifyLatencyMS is how long Dify took to finish an answer, on
+	// average
+	AverageDifyLatencyMS int64 `json:"average_dify_latency_ms"`
+	PromptTokens         int64 `json:"prompt_tokens"`
+	CompletionTokens     int64 `json:"completion_tokens"`
+	TotalTokens          int64 `json:"total_tokens"`
+	Errors               int64 `json:"errors"`
+	// TopErrors are the most frequent error codes, most frequent first
+	TopErrors    []DigestCount `json:"top_errors"`
+	EmailsSent   int64         `json:"emails_sent"`
+	EmailsFailed int64         `json:"emails_failed"`
+	// Instances counts the gateways whose counts were added up
+	Instances int `json:"instances"`
+}
+
+// digestTemplate renders the digest email; html/template escapes the
+// channel names and error codes
+var digestTemplate = template.Must(template.New("digest").Parse(`<!DOCTYPE html>
+<html>
+<body style="font-family: Arial, sans-serif; font-size: 14px; color: #222;">
+<h2 style="font-size: 18px;">DifyGate activity on {{.Date}}</h2>
+<p style="color: #666;">Times are in {{.Timezone}}; counted by {{.Instances}} gateway instance(s).</p>
+<table cellpadding="6" style="border-collapse: collapse;">
+<tr><td>Chat messages</td><td style="text-align: right; font-weight: bold;">{{.TotalMessages}}</td></tr>
+<tr><td>Unique users</td><td style="text-align: right; font-weight: bold;">{{.TotalUsers}}</td></tr>
+<tr><td>Dify answers</td><td style="text-align: right;">{{.DifyAnswers}}</td></tr>
+<tr><td>Average Dify latency</td><td style="text-align: right;">{{.AverageDifyLatencyMS}} ms</td></tr>
+<tr><td>Tokens (prompt / completion / total)</td><td style="text-align: right;">{{.PromptTokens}} / {{.CompletionTokens}} / {{.TotalTokens}}</td></tr>
+<tr><td>Errors</td><td style="text-align: right;">{{.Errors}}</td></tr>
+<tr><td>Emails sent / failed</td><td style="text-align: right;">{{.EmailsSent}} / {{.EmailsFailed}}</td></tr>
+</table>
+{{- if .Messages}}
+<h3 style="font-size: 16px;">By channel</h3>
+<table cellpadding="6" style="border-collapse: collapse;">
+<tr style="border-bottom: 1px solid #eee;"><th align="left">Channel</th><th align="right">Messages</th><th align="right">Users</th></tr>
+{{- range $channel, $n := .Messages}}
+<tr><td>{{$channel}}</td><td align="right">{{$n}}</td><td align="right">{{index $.UniqueUsers $channel}}</td></tr>
+{{- end}}
+</table>
+{{- end}}
+{{- if .TopErrors}}
+<h3 style="font-size: 16px;">Top errors</h3>
+<table cellpadding="6" style="border-collapse: collapse;">
+{{- range .TopErrors}}
+<tr><td style="font-family: monospace;">{{.Code}}</td><td align="right">{{.Count}}</td></tr>
+{{- end}}
+</table>
+{{- end}}
+</body>
+</html>
+`))
+
+// digest emails operators the previous day's activity every time
+// DIFYGATE_DIGEST_SCHEDULE comes round
+type digest struct {
+	cfg      config.DigestConfig
+	schedule *config.CronSchedule
+	loc      *time.Location
+	activity *activity
+	store    store.Store
+	// send delivers the email; tests replace it
+	send  func(gate.Message) error
+	start sync.Once
+}
+
+// newDigest returns nil when DIFYGATE_DIGEST_RECIPIENTS is empty. The
+// schedule and time zone are checked by the configuration.
+func newDigest(cfg config.DigestConfig, kv store.Store, mail *gate.Service) *digest {
+	if len(cfg.Recipients) == 0 {
+		return nil
+	}
+	schedule, err := config.ParseCron(cfg.Schedule)
+	if err != nil {
+		return nil
+	}
+	loc, err := time.LoadLocation(cfg.Timezone)
+	if err != nil {
+		return nil
+	}
+	d := &digest{cfg: cfg, schedule: schedule, loc: loc, activity: newActivity(kv, loc), store: kv, send: mail.Send}
+	mail.OnSend(d.activity.email)
+	return d
+}
+
+// run saves this instance's counts and sends the digest on schedule. Every
+// instance wakes up; a lock on the run's time lets one of them send it.
+func (d *digest) run(log *logrus.Logger) {
+	d.activity.run(log)
+	d.start.Do(func() {
+		go func() {
+			for {
+				next := d.schedule.Next(time.Now().In(d.loc))
+				if next.IsZero() {
+					log.WithField("schedule", d.cfg.Schedule).Error("The digest schedule never runs")
+					return
+				}
+				time.Sleep(time.Until(next))
+				d.scheduled(log, next)
+			}
+		}()
+	})
+}
+
+// scheduled sends the digest of the day before at, unless another instance
+// took the run
+func (d *digest) scheduled(log *logrus.Logger, at time.Time) {
+	entry := log.WithField("digest_run", at.Format(time.RFC3339))
+	if err := d.activity.flush(); err != nil {
+		entry.WithError(err).Warn("Failed to save the activity counts")
+	}
+	n, err := d.store.Incr("digest:lock:"+at.UTC().Format(time.RFC3339), activityRetention)
+	if err != nil {
+		entry.WithError(err).Error("Failed to lock the digest run, skipping it")
+		return
+	}
+	if n != 1 {
+		entry.Debug("Another instance sends this digest")
+		return
+	}
+	// Other instances save their counts within a minute of midnight
+	time.Sleep(d.settle(at))
+	day := time.Date(at.Year(), at.Month(), at.Day()-1, 0, 0, 0, 0, d.loc)
+	report, err := d.build(day)
+	if err != nil {
+		entry.WithError(err).Error("Failed to add up the activity for the digest")
+		return
+	}
+	if err := d.deliver("schedule", report); err != nil {
+		entry.WithError(err).Error("Failed to send the daily digest")
+		return
+	}
+	entry.WithField("date", report.Date).Info("Daily digest sent")
+}
+
+// settle is how long a run at at waits for the other instances to save the
+// counts of the day before, when it is just after midnight
+func (d *digest) settle(at time.Time) time.Duration {
+	midnight := time.Date(at.Year(), at.Month(), at.Day(), 0, 0, 0, 0, d.loc)
+	if wait := midnight.Add(activityFlushInterval + 5*time.Second).Sub(at); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// build adds up every instance's counts for day
+func (d *digest) build(day time.Time) (*DigestReport, error) {
+	date := day.Format(digestDateLayout)
+	report := &DigestReport{
+		Date:        date,
+		Timezone:    d.loc.String(),
+		Messages:    make(map[string]int64),
+		UniqueUsers: make(map[string]int64),
+	}
+	keys, err := d.store.Keys(activityKey(date, "*"))
+	if err != nil {
+		return nil, err
+	}
+	errorCounts := make(map[string]int64)
+	for _, key := range keys {
+		raw, err := d.store.Get(key)
+		if errors.Is(err, store.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var a dayActivity
+		if err := json.Unmarshal(raw, &a); err != nil {
+			return nil, err
+		}
+		report.Instances++
+		for channel, n := range a.Messages {
+			report.Messages[channel] += n
+			report.TotalMessages += n
+		}
+		report.DifyAnswers += a.DifyAnswers
+		report.AverageDifyLatencyMS += a.DifyLatencyMS
+		report.PromptTokens += a.PromptTokens
+		report.CompletionTokens += a.CompletionTokens
+		report.TotalTokens += a.TotalTokens
+		for code, n := range a.Errors {
+			errorCounts[code] += n
+			report.Errors += n
+		}
+		report.EmailsSent += a.EmailsSent
+		report.EmailsFailed += a.EmailsFailed
+	}
+	if report.DifyAnswers > 0 {
+		report.AverageDifyLatencyMS /= report.DifyAnswers
+	}
+
+	users, err := d.store.Keys("digest:user:" + date + ":*")
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range users {
+		// digest:user:<date>:<channel>:<hash>
+		parts := strings.Split(key, ":")
+		report.UniqueUsers[parts[len(parts)-2]]++
+		report.TotalUsers++
+	}
+
+	report.TopErrors = make([]DigestCount, 0, len(errorCounts))
+	for code, n := range errorCounts {
+		report.TopErrors = append(report.TopErrors, DigestCount{Code: code, Count: n})
+	}
+	sort.Slice(report.TopErrors, func(i, j int) bool {
+		a, b := report.TopErrors[i], report.TopErrors[j]
+		return a.Count > b.Count || (a.Count == b.Count && a.Code < b.Code)
+	})
+	if len(report.TopErrors) > digestTopErrors {
+		report.TopErrors = report.TopErrors[:digestTopErrors]
+	}
+	return report, nil
+}
+
+// deliver emails report, counting it under trigger
+func (d *digest) deliver(trigger string, report *DigestReport) error {
+	var b bytes.Buffer
+	if err := digestTemplate.Execute(&b, report); err != nil {
+		return err
+	}
+	err := d.send(gate.Message{
+		To:      d.cfg.Recipients,
+		Subject: fmt.Sprintf("DifyGate daily digest for %s", report.Date),
+		Body:    b.String(),
+		IsHTML:  true,
+	})
+	if err != nil {
+		digestsSent.Inc(trigger, "failed")
+		return err
+	}
+	digestsSent.Inc(trigger, "sent")
+	return nil
+}
+
+// DigestHandler sends the daily digest on demand
+type DigestHandler struct {
+	digest *digest
+	log    *logrus.Logger
+}
+
+// NewDigestHandler creates the handler of the digest API; a nil digest
+// answers 404, as DIFYGATE_DIGEST_RECIPIENTS is empty
+func NewDigestHandler(d *digest, log *logrus.Logger) *DigestHandler {
+	return &DigestHandler{digest: d, log: log}
+}
+
+// SendNow handles POST /admin/digest/send-now: the digest of ?date, by
+// default yesterday, is emailed at once, whichever instance sent the
+// scheduled one
+func (h *DigestHandler) SendNow(c *gin.Context) {
+	if h.digest == nil {
+		apierror.Respond(c, http.StatusNotFound, apierror.FeatureDisabled, "The digest is not enabled; set DIFYGATE_DIGEST_RECIPIENTS")
+		return
+	}
+	log := requestLogger(c, h.log)
+	now := time.Now().In(h.digest.loc)
+	day := time.Date(now.Year(), now.Month(), now.Day()-1, 0, 0, 0, 0, h.digest.loc)
+	if date := c.Query("date"); date != "" {
+		var err error
+		if day, err = time.ParseInLocation(digestDateLayout, date, h.digest.loc); err != nil {
+			apierror.Respond(c, http.StatusBadRequest, apierror.InvalidRequest, "date must be a day such as 2024-05-31")
+			return
+		}
+	}
+	if err := h.digest.activity.flush(); err != nil {
+		log.WithError(err).Warn("Failed to save the activity counts")
+	}
+
+	report, err := h.digest.build(day)
+	if err != nil {
+		log.WithError(err).Error("Failed to add up the activity for the digest")
+		apierror.Respond(c, http.StatusInternalServerError, apierror.Internal, "Failed to add up the activity")
+		return
+	}
+	if err := h.digest.deliver("manual", report); err != nil {
+		log.WithError(err).Error("Failed to send the digest")
+		apierror.Respond(c, http.StatusInternalServerError, apierror.EmailSendFailed, "Failed to send the digest: "+err.Error())
+		return
+	}
+	log.WithFields(logrus.Fields{"date": report.Date, "key_name": c.GetString(authKeyNameKey)}).Info("Digest sent on request")
+	c.JSON(http.StatusOK, gin.H{"to": h.digest.cfg.Recipients, "report": report})
+}
@@ -0,0 +1,129 @@
+package gateapi
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tracoco/DifyGate/config"
+	"github.com/tracoco/DifyGate/gate"
+)
+
+func TestDigest(t *testing.T) {
+	p, _, _, kv := newTestPipeline(t, PipelineOptions{Channel: "digest"}, config.ChatConfig{},
+		func(req ChatMessageRequest) []StreamingChatResponse {
+			if req.Query == "break" {
+				return []StreamingChatResponse{{Event: "error", Code: "provider_quota_exceeded", Message: "bad"}}
+			}
+			events := difyAnswer("", "ok")
+			events[len(events)-1].Metadata = map[string]interface{}{
+				"usage": map[string]int{"prompt_tokens": 10, "completion_tokens": 5, "total_tokens": 15},
+			}
+			return events
+		})
+	schedule, _ := config.ParseCron("@daily")
+	d := &digest{
+		cfg:      config.DigestConfig{Recipients: []string{"ops@example.com"}},
+		schedule: schedule,
+		loc:      time.UTC,
+		activity: newActivity(kv, time.UTC),
+		store:    kv,
+	}
+	var sent []gate.Message
+	d.send = func(msg gate.Message) error {
+		sent = append(sent, msg)
+		return nil
+	}
+	p.activity = d.activity
+
+	for _, m := range []struct{ user, text string }{{"u1", "hi"}, {"u1", "hello"}, {"u2", "break"}} {
+		p.Handle(testEntry(), ChannelMessage{ChannelID: "bot", UserID: m.user, Text: m.text})
+	}
+	d.activity.email(gate.Message{}, nil)
+	d.activity.email(gate.Message{}, errors.New("boom"))
+	// Another instance's counts add up with these
+	other := newActivity(kv, time.UTC)
+	other.message("sms", "u9", &messageTrace{log: testEntry(), failure: config.MsgTimeout})
+	if err := other.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/digest/send-now", NewDigestHandler(d, quietLogger()).SendNow)
+	r.POST("/disabled/send-now", NewDigestHandler(nil, quietLogger()).SendNow)
+	post := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, nil))
+		return w
+	}
+	if w := post("/disabled/send-now"); w.Code != http.StatusNotFound {
+		t.Errorf("disabled digest: status %d, want 404", w.Code)
+	}
+	if w := post("/digest/send-now?date=yesterday"); w.Code != http.StatusBadRequest {
+		t.Errorf("bad date: status %d, want 400", w.Code)
+	}
+
+	w := post("/digest/send-now?date=" + time.Now().UTC().Format(digestDateLayout))
+	var body struct {
+		Report DigestReport `json:"report"`
+	}
+	if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &body) != nil {
+		t.Fatalf("send now: status %d: %s", w.Code, w.Body)
+	}
+	report := body.Report
+	if report.Messages["digest"] != 3 || report.Messages["sms"] != 1 || report.UniqueUsers["digest"] != 2 || report.TotalUsers != 3 {
+		t.Errorf("messages %v and users %v, want 3+1 messages from 2+1 users", report.Messages, report.UniqueUsers)
+	}
+	if report.DifyAnswers != 2 || report.TotalTokens != 30 || report.Instances != 2 {
+		t.Errorf("report %+v, want 2 Dify answers of 15 tokens from 2 instances", report)
+	}
+	if report.Errors != 3 || report.EmailsSent != 1 || report.EmailsFailed != 1 || len(report.TopErrors) != 3 ||
+		report.TopErrors[0] != (DigestCount{Code: "dify:provider_quota_exceeded", Count: 1}) {
+		t.Errorf("errors %d %v, emails %d/%d, want the Dify, timeout and email errors", report.Errors, report.TopErrors, report.EmailsSent, report.EmailsFailed)
+	}
+	if len(sent) != 1 || sent[0].To[0] != "ops@example.com" || !sent[0].IsHTML ||
+		!strings.Contains(sent[0].Body, "dify:provider_quota_exceeded") || !strings.Contains(sent[0].Body, "<td>sms</td>") {
+		t.Errorf("sent %+v, want one HTML digest to the operators", sent)
+	}
+
+	// Every instance wakes up for a scheduled run, but one sends
+	run := time.Date(2024, 5, 31, 7, 0, 0, 0, time.UTC)
+	d.scheduled(quietLogger(), run)
+	d.scheduled(quietLogger(), run)
+	if len(sent) != 2 || !strings.Contains(sent[1].Subject, "2024-05-30") {
+		t.Errorf("scheduled runs sent %d digests, want one more for the day before", len(sent)-1)
+	}
+}
+
+func TestCronScheduleNext(t *testing.T) {
+	friday := time.Date(2024, 5, 31, 8, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		spec string
+		want time.Time
+	}{
+		{"0 7 * * *", time.Date(2024, 6, 1, 7, 0, 0, 0, time.UTC)},
+		{"30 7 * * 1-5", time.Date(2024, 6, 3, 7, 30, 0, 0, time.UTC)},
+		{"*/15 8 * * *", time.Date(2024, 5, 31, 8, 15, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 9 29 2 *", time.Date(2028, 2, 29, 9, 0, 0, 0, time.UTC)},
+	} {
+		s, err := config.ParseCron(tc.spec)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.spec, err)
+		}
+		if got := s.Next(friday); !got.Equal(tc.want) {
+			t.Errorf("%s: next %v, want %v", tc.spec, got, tc.want)
+		}
+	}
+	for _, spec := range []string{"0 7 * *", "60 * * * *", "0 7 * * mon", "*/0 * * * *"} {
+		if _, err := config.ParseCron(spec); err == nil {
+			t.Errorf("%q parsed, want an error", spec)
+		}
+	}
+}
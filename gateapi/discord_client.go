@@ -0,0 +1,99 @@
+package gateapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tracoco/DifyGate/config"
+)
+
+// discordMaxMessageLength is Discord's limit on message content
+const discordMaxMessageLength = 2000
+
+// DiscordClient answers interactions through Discord's webhook endpoints,
+// which are authorised by the interaction token rather than a bot token
+type DiscordClient struct {
+	baseURL string
+	client  *http.Client
+}
+
+// NewDiscordClient creates a new Discord REST client
+func NewDiscordClient(cfg config.DiscordConfig, clients *HTTPClients) *DiscordClient {
+	return &DiscordClient{
+		baseURL: strings.TrimSuffix(cfg.APIBaseURL, "/"),
+		client:  clients.Client("discord", 10*time.Second),
+	}
+}
+
+// EditOriginal replaces the deferred "thinking" response of the
+// interaction whose webhook is <application ID>/<token> with text
+func (dc *DiscordClient) EditOriginal(ctx context.Context, webhook, text string) (string, error) {
+	return dc.send(ctx, http.MethodPatch, dc.baseURL+"/webhooks/"+webhook+"/messages/@original", text)
+}
+
+// FollowUp posts text as another message answering the interaction
+func (dc *DiscordClient) FollowUp(ctx context.Context, webhook, text string) (string, error) {
+	return dc.send(ctx, http.MethodPost, dc.baseURL+"/webhooks/"+webhook+"?wait=true", text)
+}
+
+// DeleteOriginal removes the deferred response of an interaction that
+// ended without an answer, so it doesn't stay "thinking"
+func (dc *DiscordClient) DeleteOriginal(ctx context.Context, webhook string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, dc.baseURL+"/webhooks/"+webhook+"/messages/@original", nil)
+	if err != nil {
+		return fmt.Errorf("failed to create Discord request: %w", err)
+	}
+	resp, err := dc.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to delete Discord message: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("Discord API returned status %d: %s", resp.StatusCode, respBody)
+	}
+	return nil
+}
+
+// send writes one message, never pinging anyone mentioned in it, and
+// returns its ID
+func (dc *DiscordClient) send(ctx context.Context, method, url, content string) (string, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"content":          content,
+		"allowed_mentions": map[string]interface{}{"parse": []string{}},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal Discord message: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("failed to create Discord request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := dc.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to send Discord message: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return "", fmt.Errorf("Discord API returned status %d: %s", resp.StatusCode, respBody)
+	}
+
+	var message struct {
+		ID string `json:"id"`
+	}
+	// The message was sent even if its echo can't be parsed
+	_ = json.NewDecoder(resp.Body).Decode(&message)
+	return message.ID, nil
+}
@@ -0,0 +1,291 @@
+package gateapi
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/apierror"
+	"github.com/tracoco/DifyGate/config"
+	"github.com/tracoco/DifyGate/events"
+	"github.com/tracoco/DifyGate/store"
+)
+
+// Discord interaction and response types
+const (
+	discordInteractionPing         = 1
+	discordInteractionCommand      = 2
+	discordResponsePong            = 1
+	discordResponseMessage         = 4
+	discordResponseDeferredMessage = 5
+	discordMessageFlagEphemeral    = 1 << 6
+)
+
+const (
+	// discordAskCommand is the slash command, with one string option
+	discordAskCommand        = "ask"
+	discordAskQuestionOption = "question"
+
+	// discordMaxSignatureAge rejects replayed requests
+	discordMaxSignatureAge = 5 * time.Minute
+)
+
+// DiscordInteraction is the subset of an interaction payload we use
+type DiscordInteraction struct {
+	Type          int    `json:"type"`
+	ID            string `json:"id"`
+	ApplicationID string `json:"application_id"`
+	Token         string `json:"token"`
+	ChannelID     string `json:"channel_id"`
+	GuildID       string `json:"guild_id,omitempty"`
+	// Member is set for guild interactions, User for DMs
+	Member *struct {
+		User DiscordUser `json:"user"`
+	} `json:"member,omitempty"`
+	User *DiscordUser              `json:"user,omitempty"`
+	Data DiscordInteractionCommand `json:"data"`
+	// Locale is the invoking user's client language, e.g. en-US
+	Locale string `json:"locale,omitempty"`
+}
+
+// DiscordUser identifies the user behind an interaction
+type DiscordUser struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+}
+
+// DiscordInteractionCommand is a slash command invocation
+type DiscordInteractionCommand struct {
+	Name    string `json:"name"`
+	Options []struct {
+		Name  string          `json:"name"`
+		Value json.RawMessage `json:"value"`
+	} `json:"options"`
+}
+
+// userID returns the invoking user in both guilds and DMs
+func (i DiscordInteraction) userID() string {
+	if i.Member != nil {
+		return i.Member.User.ID
+	}
+	if i.User != nil {
+		return i.User.ID
+	}
+	return ""
+}
+
+// stringOption returns a string option of the command, or ""
+func (d DiscordInteractionCommand) stringOption(name string) string {
+	for _, opt := range d.Options {
+		if opt.Name == name {
+			var s string
+			if err := json.Unmarshal(opt.Value, &s); err == nil {
+				return s
+			}
+		}
+	}
+	return ""
+}
+
+// DiscordHandler answers the /ask slash command with Dify
+type DiscordHandler struct {
+	log       *logrus.Logger
+	publicKey ed25519.PublicKey
+	messages  *Messages
+	sender    *discordSender
+	pipeline  *MessagePipeline
+}
+
+// NewDiscordHandler creates a new Discord interactions handler
+func NewDiscordHandler(cfg config.DiscordConfig, chatCfg config.ChatConfig, difyCfg config.DifyConfig, clients *HTTPClients, difyHandler *DifyHandler, messages *Messages, kv store.Store, dispatcher *events.Dispatcher, log *logrus.Logger) *DiscordHandler {
+	// Validate has already checked the key, so a bad one just leaves it unset
+	publicKey, _ := hex.DecodeString(cfg.PublicKey)
+	if len(publicKey) != ed25519.PublicKeySize {
+		publicKey = nil
+	}
+
+	sender := &discordSender{client: NewDiscordClient(cfg, clients), answered: make(map[string]bool)}
+	return &DiscordHandler{
+		log:       log,
+		publicKey: publicKey,
+		messages:  messages,
+		sender:    sender,
+		// Each user keeps their own conversation per channel
+		pipeline: NewMessagePipeline(PipelineOptions{
+			Channel:          "discord",
+			MaxMessageLength: discordMaxMessageLength,
+			ConversationTTL:  cfg.ConversationTTL,
+		}, sender, chatCfg, messages, difyCfg, difyHandler, kv, dispatcher),
+	}
+}
+
+// Hooks returns the message hooks of the Discord pipeline, for adding
+// custom ones
+func (h *DiscordHandler) Hooks() *MessageHooks {
+	return h.pipeline.hooks
+}
+
+// discordSender answers interactions: the first reply replaces the
+// deferred response, later ones are follow-ups
+type discordSender struct {
+	client *DiscordClient
+
+	mu sync.Mutex
+	// answered holds the reply tokens whose deferred response was replaced
+	answered map[string]bool
+}
+
+// SendText replaces the deferred response, or follows it up
+func (s *discordSender) SendText(ctx context.Context, msg ChannelMessage, text string) (string, error) {
+	s.mu.Lock()
+	first := !s.answered[msg.ReplyToken]
+	s.answered[msg.ReplyToken] = true
+	s.mu.Unlock()
+
+	if first {
+		return s.client.EditOriginal(ctx, msg.ReplyToken, text)
+	}
+	return s.client.FollowUp(ctx, msg.ReplyToken, text)
+}
+
+// SendTyping does nothing; the deferred response already shows
+// "<bot> is thinking…"
+func (s *discordSender) SendTyping(ctx context.Context, msg ChannelMessage) error {
+	return nil
+}
+
+// SendMedia posts a link to the file, which Discord embeds
+func (s *discordSender) SendMedia(ctx context.Context, msg ChannelMessage, media ChannelAttachment) error {
+	_, err := s.SendText(ctx, msg, media.URL)
+	return err
+}
+
+// finish forgets msg's interaction, removing its deferred response if
+// nothing answered it, e.g. because a hook dropped the message
+func (s *discordSender) finish(log *logrus.Entry, msg ChannelMessage) {
+	s.mu.Lock()
+	answered := s.answered[msg.ReplyToken]
+	delete(s.answered, msg.ReplyToken)
+	s.mu.Unlock()
+
+	if !answered {
+		if err := s.client.DeleteOriginal(context.Background(), msg.ReplyToken); err != nil {
+			log.WithError(err).Error("Failed to remove unanswered Discord response")
+		}
+	}
+}
+
+// VerifyDiscordSignature checks the X-Signature-Ed25519 of an interaction
+// against the application's public key, rejecting stale timestamps
+func VerifyDiscordSignature(body []byte, timestamp, signature string, publicKey ed25519.PublicKey, now time.Time) bool {
+	sig, err := hex.DecodeString(signature)
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return false
+	}
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	if age := now.Sub(time.Unix(ts, 0)); age > discordMaxSignatureAge || age < -discordMaxSignatureAge {
+		return false
+	}
+
+	msg := make([]byte, 0, len(timestamp)+len(body))
+	msg = append(msg, timestamp...)
+	msg = append(msg, body...)
+	return ed25519.Verify(publicKey, msg, sig)
+}
+
+// HandleDiscordInteractions handles POST requests from Discord's interactions endpoint
+func (h *DiscordHandler) HandleDiscordInteractions(c *gin.Context) {
+	reqLog := requestLogger(c, h.log)
+
+	if h.publicKey == nil {
+		apierror.Respond(c, http.StatusServiceUnavailable, apierror.NotConfigured, "Discord integration is not configured")
+		return
+	}
+
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		if isBodyTooLarge(err) {
+			reqLog.WithField("limit", c.GetInt64(bodyLimitKey)).Warn("Discord interaction body exceeds size limit")
+			abortBodyTooLarge(c)
+			return
+		}
+		reqLog.WithError(err).Error("Failed to read Discord interaction body")
+		apierror.Respond(c, http.StatusBadRequest, apierror.InvalidBody, "Failed to read request body")
+		return
+	}
+
+	// Discord periodically sends badly signed requests and disables the
+	// endpoint unless they are rejected with 401
+	if !VerifyDiscordSignature(body, c.GetHeader("X-Signature-Timestamp"), c.GetHeader("X-Signature-Ed25519"), h.publicKey, time.Now()) {
+		reqLog.Warn("Discord signature verification failed")
+		signatureFailures.failed("discord")
+		apierror.Respond(c, http.StatusUnauthorized, apierror.InvalidSignature, "Invalid signature")
+		return
+	}
+	signatureFailures.verified("discord")
+
+	var interaction DiscordInteraction
+	if err := json.Unmarshal(body, &interaction); err != nil {
+		apierror.Respond(c, http.StatusBadRequest, apierror.InvalidBody, "Failed to parse request body")
+		return
+	}
+
+	locale := h.messages.Match(interaction.Locale)
+	switch interaction.Type {
+	case discordInteractionPing:
+		c.JSON(http.StatusOK, gin.H{"type": discordResponsePong})
+		return
+	case discordInteractionCommand:
+		if interaction.Data.Name != discordAskCommand {
+			discordEphemeral(c, h.messages.Get(locale, config.MsgDiscordUnknownCommand))
+			return
+		}
+	default:
+		reqLog.WithField("interaction_type", interaction.Type).Debug("Ignoring unsupported Discord interaction")
+		discordEphemeral(c, h.messages.Get(locale, config.MsgDiscordUnsupported))
+		return
+	}
+
+	question := strings.TrimSpace(interaction.Data.stringOption(discordAskQuestionOption))
+	if question == "" {
+		discordEphemeral(c, h.messages.Get(locale, config.MsgDiscordMissingQuestion))
+		return
+	}
+	// Discord needs a response within 3 seconds; a deferred response shows
+	// "<bot> is thinking…" until the answer replaces it
+	msg := ChannelMessage{
+		ChannelID:  interaction.ChannelID,
+		UserID:     interaction.userID(),
+		Text:       question,
+		ReplyTo:    interaction.ID,
+		ReplyToken: interaction.ApplicationID + "/" + interaction.Token,
+		Locale:     interaction.Locale,
+	}
+	log := reqLog.WithField("discord_channel", interaction.ChannelID)
+	answer := h.pipeline.Enqueue(log, msg)
+	go func() {
+		answer()
+		h.sender.finish(log, msg)
+	}()
+	c.JSON(http.StatusOK, gin.H{"type": discordResponseDeferredMessage})
+}
+
+// discordEphemeral responds with a message only the invoking user sees
+func discordEphemeral(c *gin.Context, text string) {
+	c.JSON(http.StatusOK, gin.H{
+		"type": discordResponseMessage,
+		"data": gin.H{"content": text, "flags": discordMessageFlagEphemeral},
+	})
+}
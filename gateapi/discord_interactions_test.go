@@ -0,0 +1,254 @@
+package gateapi
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tracoco/DifyGate/config"
+	"github.com/tracoco/DifyGate/store"
+)
+
+// discordCall is a request the fake Discord received
+type discordCall struct {
+	Method  string
+	URI     string
+	Content string
+	// Mentions is the allowed_mentions.parse list, nil when absent
+	Mentions []string
+}
+
+// fakeDiscord serves the interaction webhook endpoints, answering with
+// status
+type fakeDiscord struct {
+	mu     sync.Mutex
+	calls  []discordCall
+	status int
+}
+
+func newFakeDiscord(t *testing.T) (*fakeDiscord, *httptest.Server) {
+	t.Helper()
+	f := &fakeDiscord{status: http.StatusOK}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw, _ := io.ReadAll(r.Body)
+		var payload struct {
+			Content         string `json:"content"`
+			AllowedMentions *struct {
+				Parse []string `json:"parse"`
+			} `json:"allowed_mentions"`
+		}
+		json.Unmarshal(raw, &payload)
+		call := discordCall{Method: r.Method, URI: r.URL.RequestURI(), Content: payload.Content}
+		if payload.AllowedMentions != nil {
+			call.Mentions = payload.AllowedMentions.Parse
+		}
+		f.mu.Lock()
+		f.calls = append(f.calls, call)
+		status := f.status
+		f.mu.Unlock()
+
+		w.WriteHeader(status)
+		if status >= 300 {
+			w.Write([]byte(`{"message":"Unknown Webhook","code":10015}`))
+			return
+		}
+		w.Write([]byte(`{"id":"1100"}`))
+	}))
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+func (f *fakeDiscord) received() []discordCall {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]discordCall(nil), f.calls...)
+}
+
+func TestDiscordClient(t *testing.T) {
+	f, srv := newFakeDiscord(t)
+	client := NewDiscordClient(config.DiscordConfig{APIBaseURL: srv.URL + "/"}, testHTTPClients())
+	ctx := context.Background()
+
+	if id, err := client.EditOriginal(ctx, "app/token", "Hello @everyone"); err != nil || id != "1100" {
+		t.Fatalf("EditOriginal = %q, %v, want the message ID", id, err)
+	}
+	if _, err := client.FollowUp(ctx, "app/token", "More"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.DeleteOriginal(ctx, "app/token"); err != nil {
+		t.Fatal(err)
+	}
+
+	calls := f.received()
+	want := []discordCall{
+		{Method: http.MethodPatch, URI: "/webhooks/app/token/messages/@original", Content: "Hello @everyone"},
+		{Method: http.MethodPost, URI: "/webhooks/app/token?wait=true", Content: "More"},
+		{Method: http.MethodDelete, URI: "/webhooks/app/token/messages/@original"},
+	}
+	if len(calls) != len(want) {
+		t.Fatalf("received %+v, want %d calls", calls, len(want))
+	}
+	for i, call := range calls {
+		if call.Method != want[i].Method || call.URI != want[i].URI || call.Content != want[i].Content {
+			t.Errorf("call %d = %+v, want %+v", i, call, want[i])
+		}
+	}
+	// Messages never ping anyone they mention
+	for _, call := range calls[:2] {
+		if call.Mentions == nil || len(call.Mentions) != 0 {
+			t.Errorf("%s allowed mentions %v, want none", call.Method, call.Mentions)
+		}
+	}
+}
+
+func TestDiscordClientErrors(t *testing.T) {
+	f, srv := newFakeDiscord(t)
+	f.status = http.StatusNotFound
+	client := NewDiscordClient(config.DiscordConfig{APIBaseURL: srv.URL}, testHTTPClients())
+	ctx := context.Background()
+
+	want := `Discord API returned status 404: {"message":"Unknown Webhook","code":10015}`
+	if _, err := client.EditOriginal(ctx, "app/token", "hi"); err == nil || err.Error() != want {
+		t.Errorf("EditOriginal error %v, want %q", err, want)
+	}
+	if _, err := client.FollowUp(ctx, "app/token", "hi"); err == nil || err.Error() != want {
+		t.Errorf("FollowUp error %v, want %q", err, want)
+	}
+	if err := client.DeleteOriginal(ctx, "app/token"); err == nil || err.Error() != want {
+		t.Errorf("DeleteOriginal error %v, want %q", err, want)
+	}
+}
+
+func TestVerifyDiscordSignature(t *testing.T) {
+	public, private, _ := ed25519.GenerateKey(nil)
+	otherPublic, _, _ := ed25519.GenerateKey(nil)
+	now := time.Now()
+	body := []byte(`{"type":1}`)
+	sign := func(timestamp string) string {
+		return hex.EncodeToString(ed25519.Sign(private, append([]byte(timestamp), body...)))
+	}
+	ts := strconv.FormatInt(now.Unix(), 10)
+	stale := strconv.FormatInt(now.Add(-10*time.Minute).Unix(), 10)
+
+	tests := []struct {
+		name      string
+		timestamp string
+		signature string
+		key       ed25519.PublicKey
+		want      bool
+	}{
+		{"valid", ts, sign(ts), public, true},
+		{"other key", ts, sign(ts), otherPublic, false},
+		{"stale", stale, sign(stale), public, false},
+		{"not hex", ts, "zz", public, false},
+		{"short", ts, sign(ts)[:64], public, false},
+	}
+	for _, tt := range tests {
+		if got := VerifyDiscordSignature(body, tt.timestamp, tt.signature, tt.key, now); got != tt.want {
+			t.Errorf("%s: VerifyDiscordSignature = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// newTestDiscordHandler creates a Discord handler answering through a
+// fake Dify and replying to a fake Discord, and the key signing its
+// interactions
+func newTestDiscordHandler(t *testing.T) (*gin.Engine, *fakeDiscord, ed25519.PrivateKey) {
+	t.Helper()
+	_, difyHandler := newFakeDify(t, func(req ChatMessageRequest) []StreamingChatResponse {
+		return difyAnswer("conv-1", "**Opening** hours are 9 to 5.")
+	})
+	f, srv := newFakeDiscord(t)
+	public, private, _ := ed25519.GenerateKey(nil)
+	cfg := config.DiscordConfig{PublicKey: hex.EncodeToString(public), APIBaseURL: srv.URL}
+	h := NewDiscordHandler(cfg, config.ChatConfig{}, config.DifyConfig{StreamTimeout: 5 * time.Second}, testHTTPClients(),
+		difyHandler, NewMessages(config.MessagesConfig{}), store.New("", quietLogger()), nil, quietLogger())
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/api/v1/discord/interactions", h.HandleDiscordInteractions)
+	return r, f, private
+}
+
+// postInteraction sends body signed with key
+func postInteraction(r *gin.Engine, key ed25519.PrivateKey, body string) *httptest.ResponseRecorder {
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/discord/interactions", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Signature-Timestamp", ts)
+	req.Header.Set("X-Signature-Ed25519", hex.EncodeToString(ed25519.Sign(key, []byte(ts+body))))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// discordResponse is the part of an interaction response the tests check
+type discordResponse struct {
+	Type int `json:"type"`
+	Data struct {
+		Flags int `json:"flags"`
+	} `json:"data"`
+}
+
+func TestDiscordInteractions(t *testing.T) {
+	r, _, key := newTestDiscordHandler(t)
+	_, otherKey, _ := ed25519.GenerateKey(nil)
+
+	if w := postInteraction(r, otherKey, `{"type":1}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("status %d for a bad signature, want 401", w.Code)
+	}
+
+	tests := []struct {
+		name      string
+		body      string
+		wantType  int
+		wantFlags int
+	}{
+		{"ping", `{"type":1}`, discordResponsePong, 0},
+		{"unknown command", `{"type":2,"data":{"name":"other"}}`, discordResponseMessage, discordMessageFlagEphemeral},
+		{"no question", `{"type":2,"data":{"name":"ask","options":[{"name":"question","value":"  "}]}}`, discordResponseMessage, discordMessageFlagEphemeral},
+		{"component", `{"type":3}`, discordResponseMessage, discordMessageFlagEphemeral},
+	}
+	for _, tt := range tests {
+		w := postInteraction(r, key, tt.body)
+		var resp discordResponse
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		if w.Code != http.StatusOK || resp.Type != tt.wantType || resp.Data.Flags != tt.wantFlags {
+			t.Errorf("%s: status %d, body %s, want type %d with flags %d", tt.name, w.Code, w.Body.String(), tt.wantType, tt.wantFlags)
+		}
+	}
+}
+
+func TestDiscordAskReplacesDeferredResponse(t *testing.T) {
+	r, f, key := newTestDiscordHandler(t)
+
+	w := postInteraction(r, key, `{"type":2,"id":"i1","application_id":"app","token":"tok","channel_id":"C1",
+		"member":{"user":{"id":"U1"}},"data":{"name":"ask","options":[{"name":"question","value":"When are you open?"}]}}`)
+	var resp discordResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != http.StatusOK || resp.Type != discordResponseDeferredMessage {
+		t.Fatalf("status %d, body %s, want a deferred response", w.Code, w.Body.String())
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(f.received()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	calls := f.received()
+	if len(calls) != 1 {
+		t.Fatalf("received %+v, want the answer only", calls)
+	}
+	if call := calls[0]; call.Method != http.MethodPatch || call.URI != "/webhooks/app/tok/messages/@original" || call.Content != "**Opening** hours are 9 to 5." {
+		t.Errorf("received %+v, want the answer replacing the deferred response", call)
+	}
+}
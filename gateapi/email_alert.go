@@ -0,0 +1,128 @@
+package gateapi
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/config"
+	"github.com/tracoco/DifyGate/events"
+	"github.com/tracoco/DifyGate/gate"
+	"github.com/tracoco/DifyGate/metrics"
+)
+
+var emailAlerts = metrics.NewCounter("difygate_email_alerts_total",
+	"Alerts raised because email sends were failing")
+
+// emailAlertTimeout bounds sending an alert to the operator over WhatsApp
+const emailAlertTimeout = 10 * time.Second
+
+// sendResult is one email send in a failureWindow
+type sendResult struct {
+	at     time.Time
+	failed bool
+}
+
+// failureWindow keeps the results of sends over a sliding window and
+// decides when their failure rate warrants an alert
+type failureWindow struct {
+	cfg config.EmailAlertConfig
+
+	mu sync.Mutex
+	// results are oldest first
+	results   []sendResult
+	lastAlert time.Time
+}
+
+// record adds a send made at now and reports whether to raise an alert,
+// with the failures and sends counted in the window. An alert is raised by
+// a failure that brings the rate to the threshold, at most once per
+// cooldown.
+func (w *failureWindow) record(now time.Time, failed bool) (alert bool, failures, total int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.results = append(w.results, sendResult{at: now, failed: failed})
+	cutoff := now.Add(-w.cfg.Window)
+	drop := 0
+	for drop < len(w.results) && !w.results[drop].at.After(cutoff) {
+		drop++
+	}
+	w.results = w.results[drop:]
+
+	for _, r := range w.results {
+		if r.failed {
+			failures++
+		}
+	}
+	total = len(w.results)
+	if !failed || total < w.cfg.MinSends || float64(failures)/float64(total) < w.cfg.FailureRate {
+		return false, failures, total
+	}
+	if !w.lastAlert.IsZero() && now.Sub(w.lastAlert) < w.cfg.Cooldown {
+		return false, failures, total
+	}
+	w.lastAlert = now
+	return true, failures, total
+}
+
+// emailAlerter tells operators when email sends start failing, through
+// the email.failing outgoing webhook event and optionally over WhatsApp
+type emailAlerter struct {
+	cfg    config.EmailAlertConfig
+	window *failureWindow
+	events *events.Dispatcher
+	// client and phoneNumberID send the WhatsApp alert
+	client        *WhatsAppClient
+	phoneNumberID string
+	log           *logrus.Logger
+}
+
+// newEmailAlerter returns nil when DIFYGATE_EMAIL_ALERT_FAILURE_RATE is 0
+func newEmailAlerter(cfg config.EmailAlertConfig, dispatcher *events.Dispatcher, client *WhatsAppClient, phoneNumberID string, log *logrus.Logger) *emailAlerter {
+	if cfg.FailureRate <= 0 {
+		return nil
+	}
+	return &emailAlerter{
+		cfg:           cfg,
+		window:        &failureWindow{cfg: cfg},
+		events:        dispatcher,
+		client:        client,
+		phoneNumberID: phoneNumberID,
+		log:           log,
+	}
+}
+
+// observe records the result of a send, raising the alert when it's due
+func (a *emailAlerter) observe(_ gate.Message, err error) {
+	alert, failures, total := a.window.record(time.Now(), err != nil)
+	if !alert {
+		return
+	}
+	emailAlerts.Inc()
+	text := fmt.Sprintf("DifyGate email alert: %d of the last %d email sends failed in %s. Last error: %v", failures, total, a.cfg.Window, err)
+	a.log.WithError(err).WithFields(logrus.Fields{
+		"failures": failures,
+		"sends":    total,
+		"window":   a.cfg.Window,
+	}).Error("Email sends are failing, raising an alert")
+
+	a.events.Publish(events.Event{
+		Type:    config.EventEmailFailing,
+		Channel: "email",
+		Text:    text,
+		Error:   err.Error(),
+	})
+	if a.cfg.WhatsAppTo != "" {
+		// Sends run inline in the request, so the alert mustn't hold it up
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), emailAlertTimeout)
+			defer cancel()
+			if _, err := a.client.SendText(ctx, a.phoneNumberID, a.cfg.WhatsAppTo, text, ""); err != nil {
+				a.log.WithError(err).Error("Failed to send the email alert over WhatsApp")
+			}
+		}()
+	}
+}
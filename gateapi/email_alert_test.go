@@ -0,0 +1,53 @@
+package gateapi
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tracoco/DifyGate/config"
+)
+
+func TestFailureWindowAlerts(t *testing.T) {
+	cfg := config.EmailAlertConfig{FailureRate: 0.5, Window: 10 * time.Minute, MinSends: 4, Cooldown: time.Hour}
+
+	// send is one simulated send, `after` the previous one
+	type send struct {
+		after  time.Duration
+		failed bool
+		alert  bool
+	}
+	ok := func(after time.Duration) send { return send{after: after} }
+	fail := func(after time.Duration, alert bool) send { return send{after: after, failed: true, alert: alert} }
+
+	tests := []struct {
+		name  string
+		sends []send
+	}{
+		{"too few sends", []send{fail(0, false), fail(time.Second, false), fail(time.Second, false)}},
+		{"rate below threshold", []send{ok(0), ok(time.Second), ok(time.Second), fail(time.Second, false)}},
+		{"rate reaches threshold", []send{ok(0), ok(time.Second), fail(time.Second, false), fail(time.Second, true)}},
+		{"successes never alert", []send{fail(0, false), fail(time.Second, false), fail(time.Second, false), ok(time.Second), ok(time.Second)}},
+		{"cooldown holds back repeats", []send{
+			fail(0, false), fail(time.Second, false), fail(time.Second, false), fail(time.Second, true),
+			fail(time.Minute, false), fail(30*time.Minute, false),
+			// An hour after the alert, with failures still in the window
+			fail(30*time.Minute, false), fail(time.Second, false), fail(time.Second, false), fail(time.Second, true),
+		}},
+		{"old failures leave the window", []send{
+			fail(0, false), fail(time.Second, false), fail(time.Second, false),
+			ok(11 * time.Minute), ok(time.Second), ok(time.Second), fail(time.Second, false),
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &failureWindow{cfg: cfg}
+			now := time.Unix(1700000000, 0)
+			for i, s := range tt.sends {
+				now = now.Add(s.after)
+				if alert, failures, total := w.record(now, s.failed); alert != s.alert {
+					t.Errorf("send %d: alert = %v with %d of %d failed, want %v", i, alert, failures, total, s.alert)
+				}
+			}
+		})
+	}
+}
@@ -2,36 +2,81 @@ package gateapi
 
 import (
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/apierror"
+	"github.com/tracoco/DifyGate/config"
+	"github.com/tracoco/DifyGate/events"
 	"github.com/tracoco/DifyGate/gate"
+	"github.com/tracoco/DifyGate/history"
+	"github.com/tracoco/DifyGate/store"
 )
 
 // EmailHandler handles email-related requests
 type EmailHandler struct {
 	mailService *gate.Service
+	events      *events.Dispatcher
 	log         *logrus.Logger
+	// idempotency is nil when DIFYGATE_EMAIL_IDEMPOTENCY_TTL is 0
+	idempotency *idempotency
+	// suppressions are the addresses no email is sent to
+	suppressions *suppressions
 }
 
 // NewEmailHandler creates a new email handler
-func NewEmailHandler(mailService *gate.Service, log *logrus.Logger) *EmailHandler {
+func NewEmailHandler(mailService *gate.Service, idempotencyCfg config.IdempotencyConfig, kv store.Store, dispatcher *events.Dispatcher, log *logrus.Logger) *EmailHandler {
 	return &EmailHandler{
-		mailService: mailService,
-		log:         log,
+		mailService:  mailService,
+		events:       dispatcher,
+		log:          log,
+		idempotency:  newIdempotency(idempotencyCfg, kv, "email"),
+		suppressions: newSuppressions(kv),
 	}
 }
 
 // SendEmailRequest represents the request body for sending an email
 type SendEmailRequest struct {
-	To          []string            `json:"to" binding:"required,min=1"`
-	Cc          []string            `json:"cc,omitempty"`
-	Bcc         []string            `json:"bcc,omitempty"`
+	To          addressList         `json:"to" binding:"required,min=1"`
+	Cc          addressList         `json:"cc,omitempty"`
+	Bcc         addressList         `json:"bcc,omitempty"`
 	Subject     string              `json:"subject" binding:"required"`
 	Body        string              `json:"body" binding:"required"`
 	IsHTML      bool                `json:"is_html"`
 	Attachments []AttachmentRequest `json:"attachments,omitempty"`
+	// IdempotencyKey is used when the Idempotency-Key header is missing,
+	// for callers that can't set headers
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+}
+
+// addressList is a list of email addresses, given either as a JSON array or
+// as a comma-separated string (which is what tool callers like Dify send)
+type addressList []string
+
+// UnmarshalJSON accepts both forms
+func (l *addressList) UnmarshalJSON(data []byte) error {
+	var list []string
+	if err := json.Unmarshal(data, &list); err == nil {
+		*l = list
+		return nil
+	}
+
+	var joined string
+	if err := json.Unmarshal(data, &joined); err != nil {
+		return errors.New("expected an array of addresses or a comma-separated string")
+	}
+	*l = nil
+	for _, addr := range strings.Split(joined, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			*l = append(*l, addr)
+		}
+	}
+	return nil
 }
 
 // AttachmentRequest represents email attachment data
@@ -45,7 +90,11 @@ type AttachmentRequest struct {
 func (h *EmailHandler) SendEmail(c *gin.Context) {
 	var req SendEmailRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		if isBodyTooLarge(err) {
+			abortBodyTooLarge(c)
+			return
+		}
+		apierror.RespondBinding(c, err)
 		return
 	}
 
@@ -54,9 +103,8 @@ func (h *EmailHandler) SendEmail(c *gin.Context) {
 	for _, att := range req.Attachments {
 		data, err := base64.StdEncoding.DecodeString(att.Data)
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"error": "Invalid attachment data: " + err.Error(),
-			})
+			apierror.RespondWithDetails(c, http.StatusBadRequest, apierror.InvalidAttachment, "Invalid attachment data: "+err.Error(),
+				map[string]interface{}{"filename": att.Filename})
 			return
 		}
 
@@ -78,12 +126,79 @@ func (h *EmailHandler) SendEmail(c *gin.Context) {
 		Attachments: attachments,
 	}
 
-	// Send the email
+	// Retries with the same key get the first response instead of
+	// sending again
+	key := c.GetHeader("Idempotency-Key")
+	if key == "" {
+		key = req.IdempotencyKey
+	}
+	h.idempotency.run(c, requestLogger(c, h.log), key, func() (int, interface{}) {
+		return h.send(c, msg)
+	})
+}
+
+// send sends msg to its recipients that aren't suppressed and returns the
+// response to the request
+func (h *EmailHandler) send(c *gin.Context, msg gate.Message) (int, interface{}) {
+	var suppressed []string
+	for _, list := range []*[]string{&msg.To, &msg.Cc, &msg.Bcc} {
+		kept, dropped, err := h.suppressions.filter(*list)
+		if err != nil {
+			requestLogger(c, h.log).WithError(err).Error("Failed to check the email suppression list")
+			return http.StatusInternalServerError, apierror.New(c, apierror.Internal, "Failed to check the suppression list", nil)
+		}
+		*list = kept
+		suppressed = append(suppressed, dropped...)
+	}
+	if len(suppressed) > 0 {
+		emailSuppressed.Add(float64(len(suppressed)))
+		requestLogger(c, h.log).WithField("suppressed", len(suppressed)).Info("Dropped suppressed email recipients")
+	}
+	if len(msg.To) == 0 {
+		return http.StatusUnprocessableEntity, apierror.New(c, apierror.RecipientsSuppressed, "Every recipient is on the suppression list",
+			map[string]interface{}{"suppressed": suppressed})
+	}
+
 	if err := h.mailService.Send(msg); err != nil {
-		h.log.WithError(err).Error("Failed to send email")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send email: " + err.Error()})
-		return
+		requestLogger(c, h.log).WithError(err).Error("Failed to send email")
+		return http.StatusInternalServerError, apierror.New(c, apierror.EmailSendFailed, "Failed to send email: "+err.Error(), nil)
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Email sent successfully"})
+	h.events.Publish(events.Event{
+		Type:      config.EventEmailSent,
+		Channel:   "email",
+		UserID:    c.GetString(authKeyNameKey),
+		Text:      msg.Subject,
+		RequestID: c.GetString(requestIDKey),
+	})
+
+	resp := gin.H{"message": "Email sent successfully"}
+	if len(suppressed) > 0 {
+		resp["suppressed"] = suppressed
+	}
+	return http.StatusOK, resp
+}
+
+// recordEmails returns a send observer keeping each email in the message
+// history under the email channel, one record per To address, so sends can
+// be looked up like chat messages. Cc and Bcc addresses aren't recorded.
+func recordEmails(recorder *history.Recorder) func(gate.Message, error) {
+	return func(msg gate.Message, err error) {
+		status, errMsg := history.StatusSent, ""
+		if err != nil {
+			status, errMsg = history.StatusFailed, err.Error()
+		}
+		now := time.Now().UTC()
+		for _, to := range msg.To {
+			recorder.Record(history.Record{
+				Channel:   "email",
+				UserID:    to,
+				Direction: history.Outbound,
+				Text:      msg.Subject,
+				Status:    status,
+				Error:     errMsg,
+				Timestamp: now,
+			})
+		}
+	}
 }
@@ -0,0 +1,264 @@
+package gateapi
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/mail"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/apierror"
+	"github.com/tracoco/DifyGate/metrics"
+	"github.com/tracoco/DifyGate/store"
+)
+
+// emailSuppressed counts email recipients dropped for being on the
+// suppression list
+var emailSuppressed = metrics.NewCounter("difygate_email_suppressed_total",
+	"Email recipients dropped because they are on the suppression list")
+
+// Suppression is an address that must not be sent email
+type Suppression struct {
+	Address string    `json:"address"`
+	Reason  string    `json:"reason"`
+	AddedAt time.Time `json:"added_at"`
+}
+
+// suppressionKey is the store key of a suppressed address
+func suppressionKey(address string) string {
+	return "email-suppression:" + address
+}
+
+// normalizeAddress returns the bare, lowercased address of addr, which may
+// carry a display name
+func normalizeAddress(addr string) (string, bool) {
+	parsed, err := mail.ParseAddress(strings.TrimSpace(addr))
+	if err != nil {
+		return "", false
+	}
+	return strings.ToLower(parsed.Address), true
+}
+
+// suppressions is the list of addresses email isn't sent to, kept in the
+// shared store so every instance sees the same list
+type suppressions struct {
+	store store.Store
+}
+
+func newSuppressions(kv store.Store) *suppressions {
+	return &suppressions{store: kv}
+}
+
+// suppressed reports whether addr is on the list. Addresses that don't
+// parse are left for the mail service to reject.
+func (s *suppressions) suppressed(addr string) (bool, error) {
+	address, ok := normalizeAddress(addr)
+	if !ok {
+		return false, nil
+	}
+	_, err := s.store.Get(suppressionKey(address))
+	if errors.Is(err, store.ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// filter drops the suppressed addresses from list, returning what is left
+// and what was dropped
+func (s *suppressions) filter(list []string) (kept, dropped []string, err error) {
+	for _, addr := range list {
+		suppressed, err := s.suppressed(addr)
+		if err != nil {
+			return nil, nil, err
+		}
+		if suppressed {
+			dropped = append(dropped, addr)
+		} else {
+			kept = append(kept, addr)
+		}
+	}
+	return kept, dropped, nil
+}
+
+// add puts the addresses on the list, returning those that aren't valid
+// addresses
+func (s *suppressions) add(entries []Suppression) (added int, invalid []string, err error) {
+	now := time.Now().UTC()
+	for _, e := range entries {
+		address, ok := normalizeAddress(e.Address)
+		if !ok {
+			invalid = append(invalid, e.Address)
+			continue
+		}
+		b, err := json.Marshal(Suppression{Address: address, Reason: e.Reason, AddedAt: now})
+		if err != nil {
+			return added, invalid, err
+		}
+		if err := s.store.Set(suppressionKey(address), b, 0); err != nil {
+			return added, invalid, err
+		}
+		added++
+	}
+	return added, invalid, nil
+}
+
+// list returns the suppressed addresses, sorted
+func (s *suppressions) list() ([]Suppression, error) {
+	keys, err := s.store.Keys(suppressionKey("*"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+	list := make([]Suppression, 0, len(keys))
+	for _, key := range keys {
+		b, err := s.store.Get(key)
+		if errors.Is(err, store.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var e Suppression
+		if err := json.Unmarshal(b, &e); err != nil {
+			return nil, err
+		}
+		list = append(list, e)
+	}
+	return list, nil
+}
+
+// SuppressionsHandler manages the email suppression list
+type SuppressionsHandler struct {
+	suppressions *suppressions
+	log          *logrus.Logger
+}
+
+// NewSuppressionsHandler creates the handler of the suppression list API
+func NewSuppressionsHandler(kv store.Store, log *logrus.Logger) *SuppressionsHandler {
+	return &SuppressionsHandler{suppressions: newSuppressions(kv), log: log}
+}
+
+// AddSuppressionsRequest puts addresses on the suppression list
+type AddSuppressionsRequest struct {
+	Addresses []string `json:"addresses" binding:"required,min=1"`
+	// Reason is kept with every address; empty is manual
+	Reason string `json:"reason"`
+}
+
+// List handles GET /admin/emails/suppressions
+func (h *SuppressionsHandler) List(c *gin.Context) {
+	list, err := h.suppressions.list()
+	if err != nil {
+		requestLogger(c, h.log).WithError(err).Error("Failed to list email suppressions")
+		apierror.Respond(c, http.StatusInternalServerError, apierror.Internal, "Failed to list the suppressions")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"suppressions": list})
+}
+
+// Add handles POST /admin/emails/suppressions, taking either a JSON
+// request or, with Content-Type text/csv, rows of address and optional
+// reason, as exported by other mail systems
+func (h *SuppressionsHandler) Add(c *gin.Context) {
+	var entries []Suppression
+	if c.ContentType() == "text/csv" {
+		var ok bool
+		if entries, ok = readSuppressionsCSV(c); !ok {
+			return
+		}
+	} else {
+		var req AddSuppressionsRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			apierror.RespondBinding(c, err)
+			return
+		}
+		for _, addr := range req.Addresses {
+			entries = append(entries, Suppression{Address: addr, Reason: req.Reason})
+		}
+	}
+	for i := range entries {
+		if entries[i].Reason == "" {
+			entries[i].Reason = "manual"
+		}
+	}
+
+	added, invalid, err := h.suppressions.add(entries)
+	if err != nil {
+		requestLogger(c, h.log).WithError(err).Error("Failed to save email suppressions")
+		apierror.Respond(c, http.StatusInternalServerError, apierror.Internal, "Failed to save the suppressions")
+		return
+	}
+	if invalid == nil {
+		invalid = []string{}
+	}
+	requestLogger(c, h.log).WithFields(logrus.Fields{"added": added, "invalid": len(invalid)}).Info("Email suppressions added")
+	c.JSON(http.StatusOK, gin.H{"added": added, "invalid": invalid})
+}
+
+// readSuppressionsCSV reads the CSV body of c, skipping a header row and
+// blank lines; it responds itself when the body can't be read
+func readSuppressionsCSV(c *gin.Context) ([]Suppression, bool) {
+	r := csv.NewReader(c.Request.Body)
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	var entries []Suppression
+	for line := 1; ; line++ {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if isBodyTooLarge(err) {
+				abortBodyTooLarge(c)
+				return nil, false
+			}
+			apierror.Respond(c, http.StatusBadRequest, apierror.InvalidBody, "Failed to parse the CSV body: "+err.Error())
+			return nil, false
+		}
+		address := strings.TrimSpace(row[0])
+		if address == "" || (line == 1 && !strings.Contains(address, "@")) {
+			continue
+		}
+		e := Suppression{Address: address}
+		if len(row) > 1 {
+			e.Reason = strings.TrimSpace(row[1])
+		}
+		entries = append(entries, e)
+	}
+	if len(entries) == 0 {
+		apierror.Respond(c, http.StatusBadRequest, apierror.InvalidRequest, "The CSV body has no addresses")
+		return nil, false
+	}
+	return entries, true
+}
+
+// Remove handles DELETE /admin/emails/suppressions/:address
+func (h *SuppressionsHandler) Remove(c *gin.Context) {
+	address, ok := normalizeAddress(c.Param("address"))
+	if !ok {
+		apierror.Respond(c, http.StatusBadRequest, apierror.InvalidRequest, "address must be an email address")
+		return
+	}
+	key := suppressionKey(address)
+	_, err := h.suppressions.store.Get(key)
+	if err == nil {
+		err = h.suppressions.store.Delete(key)
+	}
+	if errors.Is(err, store.ErrNotFound) {
+		apierror.Respond(c, http.StatusNotFound, apierror.NotFound, "Address is not suppressed")
+		return
+	}
+	if err != nil {
+		requestLogger(c, h.log).WithError(err).Error("Failed to remove email suppression")
+		apierror.Respond(c, http.StatusInternalServerError, apierror.Internal, "Failed to remove the suppression")
+		return
+	}
+	requestLogger(c, h.log).WithField("address", address).Info("Email suppression removed")
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,70 @@
+package gateapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tracoco/DifyGate/config"
+	"github.com/tracoco/DifyGate/gate"
+	"github.com/tracoco/DifyGate/store"
+)
+
+func TestEmailSuppressions(t *testing.T) {
+	kv := store.New("", quietLogger())
+	admin := NewSuppressionsHandler(kv, quietLogger())
+	emails := NewEmailHandler(gate.NewService(gate.DIFYGateConfig{}, quietLogger()), config.IdempotencyConfig{}, kv, nil, quietLogger())
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/suppressions", admin.List)
+	r.POST("/suppressions", admin.Add)
+	r.DELETE("/suppressions/:address", admin.Remove)
+	r.POST("/send", emails.SendEmail)
+	do := func(method, path, contentType, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	csv := "email,reason\nBounced@Example.com, hard bounce\n\nnot-an-address\nOld Friend <gone@example.com>\n"
+	w := do(http.MethodPost, "/suppressions", "text/csv", csv)
+	if w.Code != http.StatusOK || w.Body.String() != `{"added":2,"invalid":["not-an-address"]}` {
+		t.Fatalf("CSV import: status %d: %s", w.Code, w.Body)
+	}
+	w = do(http.MethodGet, "/suppressions", "", "")
+	var listed struct{ Suppressions []Suppression }
+	if err := json.Unmarshal(w.Body.Bytes(), &listed); err != nil {
+		t.Fatal(err)
+	}
+	if len(listed.Suppressions) != 2 || listed.Suppressions[0].Address != "bounced@example.com" ||
+		listed.Suppressions[0].Reason != "hard bounce" || listed.Suppressions[1].Reason != "manual" {
+		t.Errorf("listed %+v, want both imported addresses, lowercased, with their reasons", listed.Suppressions)
+	}
+
+	kept, dropped, err := emails.suppressions.filter([]string{"BOUNCED@example.com", "ok@example.com"})
+	if err != nil || len(kept) != 1 || kept[0] != "ok@example.com" || len(dropped) != 1 {
+		t.Errorf("filter: kept %q, dropped %q, err %v; want only the suppressed address dropped", kept, dropped, err)
+	}
+
+	send := `{"to": "bounced@example.com", "bcc": ["ok@example.com"], "subject": "Hi", "body": "Hello"}`
+	w = do(http.MethodPost, "/send", "application/json", send)
+	if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), `"suppressed":["bounced@example.com"]`) {
+		t.Errorf("send to a suppressed address: status %d: %s, want 422", w.Code, w.Body)
+	}
+
+	if w := do(http.MethodDelete, "/suppressions/bounced@example.com", "", ""); w.Code != http.StatusNoContent {
+		t.Errorf("remove: status %d: %s", w.Code, w.Body)
+	}
+	if w := do(http.MethodDelete, "/suppressions/bounced@example.com", "", ""); w.Code != http.StatusNotFound {
+		t.Errorf("second remove: status %d, want 404", w.Code)
+	}
+	if suppressed, _ := emails.suppressions.suppressed("bounced@example.com"); suppressed {
+		t.Error("the removed address is still suppressed")
+	}
+}
@@ -0,0 +1,213 @@
+package gateapi
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/apierror"
+	"github.com/tracoco/DifyGate/config"
+	"github.com/tracoco/DifyGate/gate"
+	"github.com/tracoco/DifyGate/metrics"
+	"github.com/tracoco/DifyGate/sentry"
+)
+
+// errorReportedKey marks a request whose failure was already reported,
+// e.g. a panic, so its 500 isn't reported again
+const errorReportedKey = "error_reported"
+
+// reportedLogFields are the log fields copied to the tags of an event; they
+// name the integration at fault, never the user
+var reportedLogFields = []string{"channel", "phone_number_id"}
+
+// ErrorReportingMiddleware reports 5xx responses to Sentry, tagged with the
+// route and error code. Register it before RecoveryMiddleware, which
+// reports panics itself. Without DIFYGATE_SENTRY_DSN it only calls the next
+// handler.
+func ErrorReportingMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+		status := c.Writer.Status()
+		if status < http.StatusInternalServerError || !sentry.Enabled() || c.GetBool(errorReportedKey) {
+			return
+		}
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		code := c.GetString(apierror.CodeKey)
+		sentry.Capture(sentry.Event{
+			Message:     fmt.Sprintf("%s %s answered %d", c.Request.Method, route, status),
+			Tags:        requestTags(c, code),
+			Fingerprint: []string{"http", c.Request.Method, route, strconv.Itoa(status), code},
+			Request:     c.Request,
+		})
+	}
+}
+
+// requestTags are the tags of an event about the request c
+func requestTags(c *gin.Context, code string) map[string]string {
+	tags := map[string]string{
+		"method":     c.Request.Method,
+		"route":      c.FullPath(),
+		"status":     strconv.Itoa(c.Writer.Status()),
+		"request_id": c.GetString(requestIDKey),
+	}
+	if code != "" {
+		tags["error_code"] = code
+	}
+	if name := c.GetString(authKeyNameKey); name != "" {
+		tags["key_name"] = name
+	}
+	return tags
+}
+
+// reportPanic reports a panic recovered in the request c; call it from the
+// deferred function that recovered
+func reportPanic(c *gin.Context, rec interface{}) {
+	if !sentry.Enabled() {
+		return
+	}
+	c.Set(errorReportedKey, true)
+	sentry.CapturePanic(rec, sentry.Event{
+		Tags:    requestTags(c, apierror.Internal),
+		Request: c.Request,
+	})
+}
+
+// reportError reports a failure outside a request, tagged with the
+// integration named in log's fields and tags
+func reportError(log *logrus.Entry, level, message string, err error, tags map[string]string) {
+	if !sentry.Enabled() {
+		return
+	}
+	all := make(map[string]string, len(tags)+len(reportedLogFields))
+	for _, field := range reportedLogFields {
+		if v, ok := log.Data[field]; ok {
+			all[field] = fmt.Sprint(v)
+		}
+	}
+	keys := make([]string, 0, len(tags))
+	for k, v := range tags {
+		all[k] = v
+		keys = append(keys, k)
+	}
+	// Map order varies; the fingerprint mustn't
+	sort.Strings(keys)
+	fingerprint := []string{message}
+	for _, k := range keys {
+		fingerprint = append(fingerprint, k+"="+tags[k])
+	}
+	sentry.Capture(sentry.Event{Level: level, Message: message, Err: err, Tags: all, Fingerprint: fingerprint})
+}
+
+// reportEmailAuthFailures reports sends the SMTP server refused for the
+// credentials; it is registered with the email service
+func reportEmailAuthFailures(host string) func(gate.Message, error) {
+	return func(_ gate.Message, err error) {
+		if err == nil || gate.ErrorClass(err) != gate.ErrorClassAuth || !sentry.Enabled() {
+			return
+		}
+		sentry.Capture(sentry.Event{
+			Message:     "The SMTP server rejected the credentials; check DIFYGATE_SMTP_USERNAME and DIFYGATE_SMTP_PASSWORD",
+			Err:         err,
+			Tags:        map[string]string{"channel": "email", "smtp_host": host, "error_code": gate.ErrorClassAuth},
+			Fingerprint: []string{"smtp", gate.ErrorClassAuth},
+		})
+	}
+}
+
+// webhookSignatureFailures counts webhooks rejected for their signature; a
+// spike usually means a secret was rotated on the platform's side
+var webhookSignatureFailures = metrics.NewCounter("difygate_webhook_signature_failures_total",
+	"Webhooks rejected for an invalid signature, by channel", "channel")
+
+// signatureBursts reports webhook signature failures once a channel has
+// DIFYGATE_SENTRY_SIGNATURE_BURST of them within the window, which means a
+// rotated secret or someone probing the webhook rather than one bad request
+type signatureBursts struct {
+	mu      sync.Mutex
+	burst   int
+	window  time.Duration
+	windows map[string]*signatureWindow
+	// alert tells operators of failures in a row; nil raises none
+	alert *signatureAlert
+}
+
+// signatureWindow counts a channel's failures since start
+type signatureWindow struct {
+	start    time.Time
+	count    int
+	reported bool
+}
+
+// signatureFailures is shared by every webhook handler; RegisterRoutes
+// configures it
+var signatureFailures = &signatureBursts{windows: make(map[string]*signatureWindow)}
+
+// configure sets the burst reported and the alert raised
+func (b *signatureBursts) configure(cfg config.SentryConfig, alert *signatureAlert) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.burst, b.window = cfg.SignatureBurst, cfg.SignatureWindow
+	b.alert = alert
+}
+
+// alerter returns the alert raised on failures in a row
+func (b *signatureBursts) alerter() *signatureAlert {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.alert
+}
+
+// failed counts a signature failure on channel and reports the burst it
+// completes
+func (b *signatureBursts) failed(channel string) {
+	webhookSignatureFailures.Inc(channel)
+	b.alerter().failed(channel, time.Now())
+	if !sentry.Enabled() {
+		return
+	}
+	b.mu.Lock()
+	if b.burst <= 0 || b.window <= 0 {
+		b.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	w, ok := b.windows[channel]
+	if !ok || now.Sub(w.start) >= b.window {
+		w = &signatureWindow{start: now}
+		b.windows[channel] = w
+	}
+	w.count++
+	report := w.count >= b.burst && !w.reported
+	if report {
+		w.reported = true
+	}
+	count, window := w.count, b.window
+	b.mu.Unlock()
+
+	if report {
+		sentry.Capture(sentry.Event{
+			Level:       sentry.LevelWarning,
+			Message:     fmt.Sprintf("%d %s webhook signature failures within %s", count, channel, window),
+			Tags:        map[string]string{"channel": channel, "error_code": apierror.InvalidSignature},
+			Fingerprint: []string{"signature", channel},
+		})
+	}
+}
+
+// verified ends channel's failures in a row
+func (b *signatureBursts) verified(channel string) {
+	b.alerter().verified(channel)
+}
+
+// failing lists the channels whose signatures keep failing
+func (b *signatureBursts) failing() []string {
+	return b.alerter().failing()
+}
@@ -0,0 +1,82 @@
+package gateapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tracoco/DifyGate/apierror"
+	"github.com/tracoco/DifyGate/config"
+	"github.com/tracoco/DifyGate/sentry"
+)
+
+func TestErrorReporting(t *testing.T) {
+	var mu sync.Mutex
+	var reported []map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/42/envelope/" || !strings.Contains(r.Header.Get("X-Sentry-Auth"), "sentry_key=public") {
+			t.Errorf("envelope sent to %s with auth %q", r.URL.Path, r.Header.Get("X-Sentry-Auth"))
+		}
+		body, _ := io.ReadAll(r.Body)
+		// Header, item header, event
+		lines := bytes.Split(bytes.TrimSpace(body), []byte("\n"))
+		var event map[string]interface{}
+		if err := json.Unmarshal(lines[len(lines)-1], &event); err != nil {
+			t.Errorf("event %s: %v", body, err)
+		}
+		mu.Lock()
+		reported = append(reported, event)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+	dsn := strings.Replace(srv.URL, "://", "://public@", 1) + "/42"
+	if err := sentry.Init(config.SentryConfig{DSN: dsn, Environment: "test"}, quietLogger()); err != nil {
+		t.Fatal(err)
+	}
+	defer sentry.Init(config.SentryConfig{}, quietLogger())
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(ErrorReportingMiddleware(), RecoveryMiddleware(quietLogger()))
+	r.GET("/fails/:id", func(c *gin.Context) {
+		apierror.Respond(c, http.StatusBadGateway, apierror.DifyError, "Dify is down")
+	})
+	r.GET("/panics", func(c *gin.Context) {
+		panic("no reply for jane@example.com at +44 7700 900123")
+	})
+	r.GET("/refuses", func(c *gin.Context) {
+		apierror.Respond(c, http.StatusBadRequest, apierror.InvalidRequest, "bad")
+	})
+	for _, path := range []string{"/fails/1", "/fails/2?to=jane@example.com", "/panics", "/refuses"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	sentry.Flush(ctx)
+
+	mu.Lock()
+	defer mu.Unlock()
+	// The second failure of the route repeats the first, the panic's 500
+	// was reported as the panic and the 400 isn't reported
+	if len(reported) != 2 {
+		t.Fatalf("reported %d events, want the failure and the panic: %v", len(reported), reported)
+	}
+	failure, panicked := reported[0], reported[1]
+	if tags, _ := failure["tags"].(map[string]interface{}); tags["route"] != "/fails/:id" || tags["error_code"] != apierror.DifyError ||
+		tags["status"] != "502" || failure["environment"] != "test" {
+		t.Errorf("failure %v, want the route and error code tagged", failure)
+	}
+	encoded, _ := json.Marshal(panicked)
+	if s := string(encoded); !strings.Contains(s, "[email]") || !strings.Contains(s, "[phone]") ||
+		strings.Contains(s, "jane@") || strings.Contains(s, "7700") || !strings.Contains(s, "stacktrace") {
+		t.Errorf("panic %s, want a scrubbed message with a stack trace", s)
+	}
+}
@@ -0,0 +1,72 @@
+package gateapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/config"
+)
+
+// fakeDify serves Dify's streaming chat-messages API, answering each query
+// with the events answer returns
+type fakeDify struct {
+	mu       sync.Mutex
+	requests []ChatMessageRequest
+	answer   func(req ChatMessageRequest) []StreamingChatResponse
+}
+
+// newFakeDify starts a fake Dify and returns a handler talking to it
+func newFakeDify(t *testing.T, answer func(req ChatMessageRequest) []StreamingChatResponse) (*fakeDify, *DifyHandler) {
+	t.Helper()
+	f := &fakeDify{answer: answer}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req ChatMessageRequest
+		body, _ := io.ReadAll(r.Body)
+		json.Unmarshal(body, &req)
+		f.mu.Lock()
+		f.requests = append(f.requests, req)
+		f.mu.Unlock()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, event := range f.answer(req) {
+			data, _ := json.Marshal(event)
+			fmt.Fprintf(w, "data: %s\n\n", data)
+			w.(http.Flusher).Flush()
+		}
+		// Like Dify, leave closing to the client once it has message_end
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	return f, NewDifyHandler(config.DifyConfig{BaseURL: srv.URL, APIKey: "dify-key"}, &HTTPClients{
+		Dify:       srv.Client(),
+		DifyStream: srv.Client(),
+		Meta:       srv.Client(),
+	}, quietLogger())
+}
+
+// difyAnswer is a complete stream answering text in the given chunks
+func difyAnswer(conversationID string, chunks ...string) []StreamingChatResponse {
+	events := []StreamingChatResponse{{Event: "message_start", ConversationID: conversationID, MessageID: "msg-1", TaskID: "task-1"}}
+	for _, chunk := range chunks {
+		events = append(events, StreamingChatResponse{Event: "message", Answer: chunk, ConversationID: conversationID, MessageID: "msg-1"})
+	}
+	return append(events, StreamingChatResponse{Event: "message_end", ConversationID: conversationID, MessageID: "msg-1"})
+}
+
+// quietLogger discards everything logged
+func quietLogger() *logrus.Logger {
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	return log
+}
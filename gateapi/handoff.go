@@ -0,0 +1,369 @@
+package gateapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/apierror"
+	"github.com/tracoco/DifyGate/config"
+	"github.com/tracoco/DifyGate/gate"
+	"github.com/tracoco/DifyGate/history"
+	"github.com/tracoco/DifyGate/metrics"
+	"github.com/tracoco/DifyGate/store"
+)
+
+// handoffs counts chats handed to a person and back, by action: requested
+// or resumed
+var handoffs = metrics.NewCounter("difygate_handoffs_total",
+	"Chats handed to a person and given back to the bot", "channel", "action")
+
+const (
+	// handoffMaxHeld bounds the messages kept for a paused chat; older
+	// ones stay in the message history only
+	handoffMaxHeld = 100
+	// handoffNotifyTimeout bounds each operator notice
+	handoffNotifyTimeout = 30 * time.Second
+)
+
+// handoffState is stored while a chat is paused for a person
+type handoffState struct {
+	Since time.Time `json:"since"`
+	// Held are the messages received since, which Dify never saw
+	Held []HeldMessage `json:"held,omitempty"`
+}
+
+// HeldMessage is a message received while the bot was paused
+type HeldMessage struct {
+	ID         string    `json:"id,omitempty"`
+	Text       string    `json:"text"`
+	ReceivedAt time.Time `json:"received_at"`
+}
+
+// loadHandoff returns the state stored under key; paused is false when
+// there is none
+func loadHandoff(kv store.Store, key string) (state handoffState, paused bool, err error) {
+	b, err := kv.Get(key)
+	if errors.Is(err, store.ErrNotFound) {
+		return state, false, nil
+	}
+	if err == nil {
+		err = json.Unmarshal(b, &state)
+	}
+	return state, err == nil, err
+}
+
+// saveHandoff stores state under key until the chat is resumed
+func saveHandoff(kv store.Store, key string, state handoffState) error {
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return kv.Set(key, b, 0)
+}
+
+// handoff pauses the bot for users who ask for a person and tells the
+// operators, by email and over WhatsApp
+type handoff struct {
+	cfg      config.HandoffConfig
+	triggers []string
+	mail     *gate.Service
+	// client sends the WhatsApp notice
+	client  *WhatsAppClient
+	history *history.Recorder
+}
+
+// newHandoff returns nil when DIFYGATE_HANDOFF_ENABLED is off
+func newHandoff(cfg config.HandoffConfig, mail *gate.Service, client *WhatsAppClient, recorder *history.Recorder) *handoff {
+	if !cfg.Enabled {
+		return nil
+	}
+	h := &handoff{cfg: cfg, mail: mail, client: client, history: recorder}
+	for _, trigger := range cfg.Triggers {
+		if trigger = strings.ToLower(strings.TrimSpace(trigger)); trigger != "" {
+			h.triggers = append(h.triggers, trigger)
+		}
+	}
+	return h
+}
+
+// requested reports whether a message asks for a person
+func (h *handoff) requested(text string) bool {
+	text = strings.ToLower(strings.TrimSpace(text))
+	if text == "/human" {
+		return true
+	}
+	for _, trigger := range h.triggers {
+		if strings.Contains(text, trigger) {
+			return true
+		}
+	}
+	return false
+}
+
+// transcript is the chat leading up to msg, oldest first, from the message
+// history when it is enabled
+func (h *handoff) transcript(channel string, msg ChannelMessage) string {
+	var lines []string
+	if h.history != nil && h.cfg.TranscriptLength > 0 {
+		// msg itself may not be recorded yet, so it is added below
+		records := h.history.Find(history.Query{UserID: msg.UserID, Limit: h.cfg.TranscriptLength + 1})
+		for i := len(records) - 1; i >= 0; i-- {
+			rec := records[i]
+			if rec.Channel != channel || (msg.ReplyTo != "" && rec.ID == msg.ReplyTo) {
+				continue
+			}
+			who := "User"
+			if rec.Direction == history.Outbound {
+				who = "Bot"
+			}
+			lines = append(lines, fmt.Sprintf("[%s] %s: %s", rec.Timestamp.Format(time.RFC3339), who, rec.Text))
+		}
+		if len(lines) > h.cfg.TranscriptLength-1 {
+			lines = lines[len(lines)-(h.cfg.TranscriptLength-1):]
+		}
+	}
+	lines = append(lines, fmt.Sprintf("[%s] User: %s", time.Now().UTC().Format(time.RFC3339), msg.Text))
+	return strings.Join(lines, "\n")
+}
+
+// notify tells the operators that msg asked for a person, in the
+// background so the user's acknowledgement isn't held up
+func (h *handoff) notify(log *logrus.Entry, channel string, msg ChannelMessage) {
+	subject := fmt.Sprintf("DifyGate: %s user %s asked for a person", channel, msg.UserID)
+	body := fmt.Sprintf("%s\n\nRecent messages:\n%s\n\nThe bot stays silent in this chat until it is resumed with POST /api/v1/admin/users/%s/resume or the user sends /bot.",
+		subject, h.transcript(channel, msg), msg.UserID)
+
+	if len(h.cfg.NotifyEmail) > 0 {
+		go func() {
+			if err := h.mail.Send(gate.Message{To: h.cfg.NotifyEmail, Subject: subject, Body: body}); err != nil {
+				log.WithError(err).Error("Failed to email the handoff notice")
+			}
+		}()
+	}
+	// The notice comes from the number the user wrote to
+	if h.cfg.NotifyWhatsAppTo != "" {
+		go func() {
+			ctx, cancel := context.WithTimeout(withLogger(context.Background(), log), handoffNotifyTimeout)
+			defer cancel()
+			for _, chunk := range splitMessage(body, whatsAppMaxTextLength) {
+				if _, err := h.client.SendText(ctx, msg.ChannelID, h.cfg.NotifyWhatsAppTo, chunk, ""); err != nil {
+					log.WithError(err).Error("Failed to send the handoff notice over WhatsApp")
+					return
+				}
+			}
+		}()
+	}
+}
+
+// handoffKey is the store key of a chat paused for a person
+func (p *MessagePipeline) handoffKey(msg ChannelMessage) string {
+	return p.opts.Channel + ":handoff:" + msg.ChannelID + ":" + msg.UserID
+}
+
+// handleHandoff takes /bot, requests for a person and every message of a
+// paused chat; it returns false for messages the bot should answer
+func (p *MessagePipeline) handleHandoff(t *messageTrace, msg ChannelMessage) bool {
+	log := t.log
+	key := p.handoffKey(msg)
+	if strings.ToLower(strings.TrimSpace(msg.Text)) == "/bot" {
+		t.outcome = outcomeCommand
+		if err := p.store.Delete(key); err != nil {
+			ref := newErrorRef()
+			log.WithError(err).WithField("error_ref", ref).Error("Failed to resume the bot")
+			p.notify(t, msg, p.messages.Error(p.locale(msg), config.MsgError, ref))
+			return true
+		}
+		log.Info("Bot resumed by user")
+		handoffs.Inc(p.opts.Channel, "resumed")
+		p.publish(log, config.EventHandoffResumed, msg, msg.Text, "", msg.ReplyTo, "")
+		p.notify(t, msg, p.messages.Get(p.locale(msg), config.MsgBotResumed))
+		return true
+	}
+
+	state, paused, err := loadHandoff(p.store, key)
+	if err != nil {
+		// Answering is the lesser harm than silence
+		log.WithError(err).Warn("Failed to check whether the chat is handed off, answering it")
+		return false
+	}
+	if paused {
+		t.outcome = outcomeHandedOff
+		state.Held = append(state.Held, HeldMessage{ID: msg.ReplyTo, Text: msg.Text, ReceivedAt: time.Now().UTC()})
+		if len(state.Held) > handoffMaxHeld {
+			state.Held = state.Held[len(state.Held)-handoffMaxHeld:]
+		}
+		if err := saveHandoff(p.store, key, state); err != nil {
+			log.WithError(err).Warn("Failed to keep message for the operator")
+		}
+		log.Info("Chat is handed off, not answering")
+		return true
+	}
+	if !p.handoff.requested(msg.Text) {
+		return false
+	}
+
+	t.outcome = outcomeCommand
+	if err := saveHandoff(p.store, key, handoffState{Since: time.Now().UTC()}); err != nil {
+		ref := newErrorRef()
+		log.WithError(err).WithField("error_ref", ref).Error("Failed to hand the chat off")
+		p.notify(t, msg, p.messages.Error(p.locale(msg), config.MsgError, ref))
+		return true
+	}
+	log.Info("User asked for a person, handing the chat off")
+	handoffs.Inc(p.opts.Channel, "requested")
+	p.publish(log, config.EventHandoffRequested, msg, msg.Text, "", msg.ReplyTo, "")
+	p.notify(t, msg, p.messages.Get(p.locale(msg), config.MsgHandoff))
+	p.handoff.notify(log, p.opts.Channel, msg)
+	return true
+}
+
+// ResumedUser is what resuming the bot for a user found
+type ResumedUser struct {
+	// PhoneNumberIDs are the business numbers the user was handed off on
+	PhoneNumberIDs []string `json:"phone_number_ids"`
+	// Held are the messages received while handed off, oldest first
+	Held []HeldMessage `json:"held"`
+}
+
+// ResumeUser handles POST /admin/users/:number/resume: the bot answers a
+// handed-off WhatsApp user again, on every business number, and tells them
+// unless ?notify=false. It answers 204 when the user wasn't handed off.
+func (h *WhatsAppHandler) ResumeUser(c *gin.Context) {
+	log := requestLogger(c, h.log)
+	number, ok := userNumber(c)
+	if !ok {
+		return
+	}
+	notifyUser := c.Query("notify") != "false"
+
+	keys, err := h.store.Keys("whatsapp:handoff:*:" + number)
+	if err != nil {
+		log.WithError(err).Error("Failed to look up handed-off chats")
+		apierror.Respond(c, http.StatusInternalServerError, apierror.Internal, "Failed to look up handed-off chats")
+		return
+	}
+	resumed := ResumedUser{PhoneNumberIDs: []string{}, Held: []HeldMessage{}}
+	for _, key := range keys {
+		state, paused, err := loadHandoff(h.store, key)
+		if err != nil {
+			log.WithError(err).WithField("key", key).Warn("Failed to read handed-off chat, resuming it anyway")
+		} else if !paused {
+			continue
+		}
+		if err := h.store.Delete(key); err != nil {
+			log.WithError(err).Error("Failed to resume the bot")
+			apierror.Respond(c, http.StatusInternalServerError, apierror.Internal, "Failed to resume the bot")
+			return
+		}
+		msg := ChannelMessage{
+			ChannelID: strings.TrimSuffix(strings.TrimPrefix(key, "whatsapp:handoff:"), ":"+number),
+			UserID:    number,
+		}
+		resumed.PhoneNumberIDs = append(resumed.PhoneNumberIDs, msg.ChannelID)
+		resumed.Held = append(resumed.Held, state.Held...)
+
+		entryLog := log.WithFields(logrus.Fields{"user_id": number, "phone_number_id": msg.ChannelID})
+		entryLog.Info("Bot resumed by an operator")
+		handoffs.Inc("whatsapp", "resumed")
+		h.pipeline.publish(entryLog, config.EventHandoffResumed, msg, "", "", "", "")
+		if notifyUser {
+			text := h.messages.Get(h.pipeline.locale(msg), config.MsgBotResumed)
+			if _, err := h.client.SendText(withLogger(c.Request.Context(), entryLog), msg.ChannelID, number, text, ""); err != nil {
+				entryLog.WithError(err).Warn("Failed to tell the user the bot is back")
+			}
+		}
+	}
+	if len(resumed.PhoneNumberIDs) == 0 {
+		c.Status(http.StatusNoContent)
+		return
+	}
+	c.JSON(http.StatusOK, resumed)
+}
+
+// AgentReplyRequest is a message from a person to a WhatsApp user
+type AgentReplyRequest struct {
+	// PhoneNumberID is the business number to send from; empty uses
+	// DIFYGATE_WHATSAPP_PHONE_NUMBER_ID
+	PhoneNumberID string `json:"phone_number_id"`
+	// To is the user's number in international format
+	To   string `json:"to" binding:"required"`
+	Text string `json:"text" binding:"required"`
+	// AgentName is shown to the user through DIFYGATE_HANDOFF_AGENT_REPLY_PREFIX
+	// and kept in the message history
+	AgentName string `json:"agent_name"`
+}
+
+// AgentReply handles POST /admin/whatsapp/agent-reply: an operator answers
+// a user from the business number, as a person. The handoff is left as it
+// is; replying to a user who isn't handed off is logged, or refused with
+// DIFYGATE_HANDOFF_AGENT_REPLY_REQUIRES_HANDOFF.
+func (h *WhatsAppHandler) AgentReply(c *gin.Context) {
+	reqLog := requestLogger(c, h.log)
+	handoff := h.pipeline.handoff
+	if handoff == nil {
+		apierror.Respond(c, http.StatusNotFound, apierror.FeatureDisabled, "Human handoff is not enabled")
+		return
+	}
+
+	var req AgentReplyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apierror.RespondBinding(c, err)
+		return
+	}
+	to, phoneNumberID, ok := h.sendTarget(c, req.To, req.PhoneNumberID)
+	if !ok {
+		return
+	}
+	agent := strings.TrimSpace(req.AgentName)
+	text := req.Text
+	if agent != "" && handoff.cfg.AgentReplyPrefix != "" {
+		text = strings.ReplaceAll(handoff.cfg.AgentReplyPrefix, "{agent}", agent) + text
+	}
+	if utf8.RuneCountInString(text) > whatsAppMaxSendLength {
+		apierror.Respond(c, http.StatusBadRequest, apierror.InvalidRequest, "text must be at most 4096 characters, including the agent's name")
+		return
+	}
+
+	log := reqLog.WithFields(logrus.Fields{"phone_number_id": phoneNumberID, "to": to, "agent": agent})
+	_, handedOff, err := loadHandoff(h.store, "whatsapp:handoff:"+phoneNumberID+":"+to)
+	if err != nil {
+		log.WithError(err).Warn("Failed to check whether the user is handed off")
+	}
+	if !handedOff && err == nil {
+		if handoff.cfg.AgentReplyRequiresHandoff {
+			apierror.Respond(c, http.StatusConflict, apierror.NotHandedOff, "The user isn't handed off to a person; the bot is answering them")
+			return
+		}
+		log.Warn("Agent replying to a user who isn't handed off; the bot is answering them too")
+	}
+
+	wamid, err := h.client.SendText(withLogger(c.Request.Context(), log), phoneNumberID, to, text, "")
+	rec := history.Record{
+		ID:        wamid,
+		Channel:   "whatsapp",
+		UserID:    to,
+		Direction: history.Outbound,
+		Text:      text,
+		Status:    history.StatusSent,
+		Human:     true,
+		Agent:     agent,
+	}
+	if err != nil {
+		rec.Status, rec.Error = history.StatusFailed, err.Error()
+		h.history.Record(rec)
+		log.WithError(err).Warn("Failed to send agent reply")
+		whatsAppSendErrorResponse(c, err)
+		return
+	}
+	h.history.Record(rec)
+	log.WithField("wamid", wamid).Info("Agent reply sent")
+	c.JSON(http.StatusOK, gin.H{"wamid": wamid, "handed_off": handedOff})
+}
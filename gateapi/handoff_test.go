@@ -0,0 +1,151 @@
+package gateapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tracoco/DifyGate/config"
+	"github.com/tracoco/DifyGate/history"
+)
+
+func TestPipelineHandsOffToAPerson(t *testing.T) {
+	p, sender, dify, kv := newTestPipeline(t, PipelineOptions{Channel: "handoff"}, config.ChatConfig{},
+		func(req ChatMessageRequest) []StreamingChatResponse {
+			return difyAnswer("conv-1", "answer to "+req.Query)
+		})
+	p.handoff = newHandoff(config.HandoffConfig{Enabled: true, Triggers: []string{"Talk to a human"}}, nil, nil, nil)
+	msg := func(id, text string) ChannelMessage {
+		return ChannelMessage{ChannelID: "bot", UserID: "u1", Text: text, ReplyTo: id}
+	}
+
+	steps := []struct {
+		text string
+		want []string
+	}{
+		{"hi", []string{"answer to hi"}},
+		{"Can I TALK TO A HUMAN please?", []string{config.DefaultMessages[config.MsgHandoff]}},
+		{"hello?", nil},
+		{"/new", nil},
+		{"/bot", []string{config.DefaultMessages[config.MsgBotResumed]}},
+		{"back", []string{"answer to back"}},
+		{"/human", []string{config.DefaultMessages[config.MsgHandoff]}},
+	}
+	for i, step := range steps {
+		p.Handle(testEntry(), msg("m"+strconv.Itoa(i), step.text))
+		if got := sender.sent(); strings.Join(got, "|") != strings.Join(step.want, "|") {
+			t.Errorf("%q: sent %q, want %q", step.text, got, step.want)
+		}
+	}
+
+	dify.mu.Lock()
+	asked := len(dify.requests)
+	dify.mu.Unlock()
+	if asked != 2 {
+		t.Errorf("Dify was asked %d times, want only for the messages before and after the handoff", asked)
+	}
+	state, paused, err := loadHandoff(kv, "handoff:handoff:bot:u1")
+	if err != nil || !paused || len(state.Held) != 0 {
+		t.Errorf("after /human: state %+v, paused %v, err %v; want a new handoff", state, paused, err)
+	}
+}
+
+func TestResumeUser(t *testing.T) {
+	h, _ := newTestWhatsAppHandler(t)
+	held := []HeldMessage{{ID: "wamid.1", Text: "hello?", ReceivedAt: time.Now().UTC()}}
+	if err := saveHandoff(h.store, "whatsapp:handoff:123:15551234567", handoffState{Since: time.Now(), Held: held}); err != nil {
+		t.Fatal(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/admin/users/:number/resume", h.ResumeUser)
+	resume := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/admin/users/+15551234567/resume?notify=false", nil))
+		return w
+	}
+
+	w := resume()
+	var got ResumedUser
+	if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &got) != nil {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	if len(got.PhoneNumberIDs) != 1 || got.PhoneNumberIDs[0] != "123" || len(got.Held) != 1 || got.Held[0].Text != "hello?" {
+		t.Errorf("resumed %+v, want the handoff on 123 with its message", got)
+	}
+	if w := resume(); w.Code != http.StatusNoContent {
+		t.Errorf("second resume: status %d, want 204", w.Code)
+	}
+}
+
+func TestAgentReply(t *testing.T) {
+	h, graph := newTestWhatsAppHandler(t)
+	recorder, err := history.New(config.HistoryConfig{Enabled: true, Retention: time.Hour, PruneInterval: time.Hour}, quietLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(recorder.Close)
+	h.history = recorder
+	h.pipeline.handoff = newHandoff(config.HandoffConfig{Enabled: true, AgentReplyPrefix: "{agent}: "}, nil, nil, nil)
+	if err := saveHandoff(h.store, "whatsapp:handoff:123:15551234567", handoffState{Since: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/admin/whatsapp/agent-reply", h.AgentReply)
+	reply := func(to string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		body := `{"phone_number_id": "123", "to": "` + to + `", "text": "I can help", "agent_name": "Dana"}`
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/admin/whatsapp/agent-reply", strings.NewReader(body)))
+		return w
+	}
+
+	w := reply("+15551234567")
+	var got struct {
+		WAMID     string `json:"wamid"`
+		HandedOff bool   `json:"handed_off"`
+	}
+	if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &got) != nil {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	if got.WAMID != "wamid.test" || !got.HandedOff {
+		t.Errorf("response %+v, want the wamid of a handed-off user", got)
+	}
+	graph.mu.Lock()
+	sent := append([]string{}, graph.bodies...)
+	graph.mu.Unlock()
+	if len(sent) != 1 || sent[0] != "Dana: I can help" {
+		t.Errorf("sent %q, want the reply with the agent's name", sent)
+	}
+	if _, paused, _ := loadHandoff(h.store, "whatsapp:handoff:123:15551234567"); !paused {
+		t.Error("the reply ended the handoff")
+	}
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		rec, err := recorder.Get("wamid.test")
+		if err == nil {
+			if !rec.Human || rec.Agent != "Dana" || rec.Direction != history.Outbound {
+				t.Errorf("recorded %+v, want an outbound message by Dana", rec)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the reply never reached the history")
+		}
+	}
+
+	// Users the bot is answering get the reply too, unless handoff is required
+	if w := reply("15550000000"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"handed_off":false`) {
+		t.Errorf("user not handed off: status %d: %s", w.Code, w.Body)
+	}
+	h.pipeline.handoff.cfg.AgentReplyRequiresHandoff = true
+	if w := reply("15550000000"); w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "not_handed_off") {
+		t.Errorf("handoff required: status %d: %s, want 409", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,135 @@
+package gateapi
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/gate"
+)
+
+const (
+	// healthCheckTimeout bounds each individual dependency check
+	healthCheckTimeout = 4 * time.Second
+	// healthCacheTTL is how long a deep health result is served from cache
+	healthCacheTTL = 10 * time.Second
+)
+
+// healthCheck is a single named dependency check; a nil check marks a
+// dependency that isn't configured
+type healthCheck struct {
+	name     string
+	critical bool
+	check    func(ctx context.Context) error
+}
+
+// healthNotConfigured is reported for dependencies without a check
+const healthNotConfigured = "not configured"
+
+// HealthHandler reports the status of downstream dependencies
+type HealthHandler struct {
+	checks []healthCheck
+	dify   *DifyHandler
+	log    *logrus.Logger
+
+	mu         sync.Mutex
+	cachedAt   time.Time
+	cachedCode int
+	cachedBody gin.H
+}
+
+// NewHealthHandler creates a new health handler. Dify and, when a Graph
+// API token is set, WhatsApp are critical for the message path; SMTP
+// failures only degrade the service.
+func NewHealthHandler(mailService *gate.Service, difyHandler *DifyHandler, whatsAppHandler *WhatsAppHandler, log *logrus.Logger) *HealthHandler {
+	whatsApp := healthCheck{name: "whatsapp"}
+	if whatsAppHandler.Configured() {
+		whatsApp.critical = true
+		whatsApp.check = whatsAppHandler.CheckGraphToken
+	}
+	return &HealthHandler{
+		checks: []healthCheck{
+			{name: "dify", critical: true, check: difyHandler.Ping},
+			whatsApp,
+			{name: "smtp", critical: false, check: func(context.Context) error { return mailService.Ping() }},
+		},
+		dify: difyHandler,
+		log:  log,
+	}
+}
+
+// DeepHealthCheck concurrently checks every downstream dependency and reports
+// each one, along with the Dify streams in progress. It responds 503 when a
+// critical dependency is failing so load balancers and uptime monitors can
+// react.
+func (h *HealthHandler) DeepHealthCheck(c *gin.Context) {
+	h.mu.Lock()
+	if time.Since(h.cachedAt) > healthCacheTTL {
+		h.cachedCode, h.cachedBody = h.runChecks()
+		h.cachedAt = time.Now()
+	}
+	code := h.cachedCode
+	body := gin.H{}
+	for k, v := range h.cachedBody {
+		body[k] = v
+	}
+	h.mu.Unlock()
+
+	// Not cached, so a leak shows up as it happens
+	active, oldest := h.dify.StreamStats()
+	body["dify_streams"] = gin.H{
+		"active":             active,
+		"oldest_age_seconds": int(oldest.Seconds()),
+	}
+	c.JSON(code, body)
+}
+
+func (h *HealthHandler) runChecks() (int, gin.H) {
+	results := make([]string, len(h.checks))
+
+	var wg sync.WaitGroup
+	for i, hc := range h.checks {
+		if hc.check == nil {
+			results[i] = healthNotConfigured
+			continue
+		}
+		wg.Add(1)
+		go func(i int, hc healthCheck) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+			defer cancel()
+
+			if err := hc.check(ctx); err != nil {
+				h.log.WithError(err).WithField("dependency", hc.name).Warn("Health check failed")
+				results[i] = "error: " + err.Error()
+				return
+			}
+			results[i] = "ok"
+		}(i, hc)
+	}
+	wg.Wait()
+
+	checks := gin.H{}
+	status := "ok"
+	code := http.StatusOK
+	for i, hc := range h.checks {
+		checks[hc.name] = results[i]
+		if results[i] != "ok" && results[i] != healthNotConfigured {
+			status = "degraded"
+			if hc.critical {
+				code = http.StatusServiceUnavailable
+			}
+		}
+	}
+
+	return code, gin.H{
+		"status":    status,
+		"service":   "DifyGate",
+		"timestamp": time.Now().Format(time.RFC3339),
+		"checks":    checks,
+	}
+}
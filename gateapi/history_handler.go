@@ -0,0 +1,84 @@
+package gateapi
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tracoco/DifyGate/apierror"
+	"github.com/tracoco/DifyGate/history"
+	"github.com/tracoco/DifyGate/phone"
+)
+
+const (
+	// defaultHistoryLimit is the page size when ?limit= is not given
+	defaultHistoryLimit = 50
+	// maxHistoryLimit caps ?limit=
+	maxHistoryLimit = 500
+)
+
+// HistoryHandler serves the message history for support lookups
+type HistoryHandler struct {
+	history *history.Recorder
+}
+
+// NewHistoryHandler creates a new message history handler; a nil recorder
+// answers 404, as history is disabled
+func NewHistoryHandler(recorder *history.Recorder) *HistoryHandler {
+	return &HistoryHandler{history: recorder}
+}
+
+// ListMessages returns recorded messages, newest first, filtered by
+// ?user=, ?channel=, ?status=, ?since= (an RFC 3339 time or a duration back
+// from now) and ?limit=
+func (h *HistoryHandler) ListMessages(c *gin.Context) {
+	if h.history == nil {
+		apierror.Respond(c, http.StatusNotFound, apierror.FeatureDisabled, "Message history is not enabled")
+		return
+	}
+
+	q := history.Query{UserID: c.Query("user"), Channel: c.Query("channel"), Status: c.Query("status"), Limit: defaultHistoryLimit}
+	if q.Channel == "whatsapp" {
+		q.UserID = phone.Lenient(q.UserID)
+	}
+	if since := c.Query("since"); since != "" {
+		if t, err := time.Parse(time.RFC3339, since); err == nil {
+			q.Since = t
+		} else if d, err := time.ParseDuration(since); err == nil && d > 0 {
+			q.Since = time.Now().Add(-d)
+		} else {
+			apierror.Respond(c, http.StatusBadRequest, apierror.InvalidRequest, "since must be an RFC 3339 time or a positive duration such as 24h")
+			return
+		}
+	}
+	if limit := c.Query("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxHistoryLimit {
+			apierror.Respond(c, http.StatusBadRequest, apierror.InvalidRequest, "limit must be between 1 and "+strconv.Itoa(maxHistoryLimit))
+			return
+		}
+		q.Limit = n
+	}
+
+	messages := h.history.Find(q)
+	if messages == nil {
+		messages = []history.Record{}
+	}
+	c.JSON(http.StatusOK, gin.H{"messages": messages})
+}
+
+// GetMessage returns one recorded message by its platform ID, e.g. a wamid
+func (h *HistoryHandler) GetMessage(c *gin.Context) {
+	if h.history == nil {
+		apierror.Respond(c, http.StatusNotFound, apierror.FeatureDisabled, "Message history is not enabled")
+		return
+	}
+
+	rec, err := h.history.Get(c.Param("wamid"))
+	if err != nil {
+		apierror.Respond(c, http.StatusNotFound, apierror.NotFound, "Message not found")
+		return
+	}
+	c.JSON(http.StatusOK, rec)
+}
@@ -0,0 +1,201 @@
+package gateapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/apierror"
+	"github.com/tracoco/DifyGate/config"
+	"github.com/tracoco/DifyGate/gate"
+)
+
+// hook is a configured hook with its query template parsed
+type hook struct {
+	cfg   config.HookConfig
+	query *template.Template
+}
+
+// HookHandler turns events posted to named hooks into Dify queries
+type HookHandler struct {
+	log                  *logrus.Logger
+	hooks                map[string]*hook
+	streamTimeout        time.Duration
+	sanitize             config.SanitizeConfig
+	difyHandler          *DifyHandler
+	mailService          *gate.Service
+	waClient             *WhatsAppClient
+	defaultPhoneNumberID string
+}
+
+// NewHookHandler creates a new inbound hook handler
+func NewHookHandler(hooks []config.HookConfig, chatCfg config.ChatConfig, waCfg config.WhatsAppConfig, difyCfg config.DifyConfig, clients *HTTPClients, difyHandler *DifyHandler, mailService *gate.Service, log *logrus.Logger) *HookHandler {
+	h := &HookHandler{
+		log:                  log,
+		hooks:                make(map[string]*hook),
+		streamTimeout:        difyCfg.StreamTimeout,
+		sanitize:             chatCfg.Sanitize,
+		difyHandler:          difyHandler,
+		mailService:          mailService,
+		waClient:             NewWhatsAppClient(waCfg, clients.Meta),
+		defaultPhoneNumberID: waCfg.PhoneNumberID,
+	}
+	for _, hc := range hooks {
+		// Validate has already parsed every template
+		tmpl, err := template.New(hc.Name).Funcs(config.HookTemplateFuncs).Parse(hc.Query)
+		if err != nil {
+			log.WithError(err).WithField("hook", hc.Name).Error("Invalid hook query template, hook disabled")
+			continue
+		}
+		h.hooks[hc.Name] = &hook{cfg: hc, query: tmpl}
+	}
+	return h
+}
+
+// HandleHook handles POST /hooks/:name
+func (h *HookHandler) HandleHook(c *gin.Context) {
+	name := c.Param("name")
+	reqLog := requestLogger(c, h.log).WithField("hook", name)
+
+	hk, ok := h.hooks[name]
+	if !ok {
+		apierror.Respond(c, http.StatusNotFound, apierror.NotFound, "Unknown hook '"+name+"'")
+		return
+	}
+
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		if isBodyTooLarge(err) {
+			reqLog.WithField("limit", c.GetInt64(bodyLimitKey)).Warn("Hook body exceeds size limit")
+			abortBodyTooLarge(c)
+			return
+		}
+		apierror.Respond(c, http.StatusBadRequest, apierror.InvalidBody, "Failed to read request body")
+		return
+	}
+
+	if hk.cfg.Secret != "" && !VerifyWebhook(body, c.GetHeader("X-Hook-Signature"), hk.cfg.Secret) {
+		reqLog.Warn("Hook signature verification failed")
+		signatureFailures.failed("hooks")
+		apierror.Respond(c, http.StatusUnauthorized, apierror.InvalidSignature, "Invalid hook signature")
+		return
+	}
+	if hk.cfg.Secret != "" {
+		signatureFailures.verified("hooks")
+	}
+
+	var event interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&event); err != nil {
+		apierror.Respond(c, http.StatusBadRequest, apierror.InvalidBody, "Request body must be JSON")
+		return
+	}
+
+	var query strings.Builder
+	if err := hk.query.Execute(&query, event); err != nil {
+		reqLog.WithError(err).Warn("Failed to render hook query")
+		apierror.Respond(c, http.StatusBadRequest, apierror.InvalidRequest, "Failed to render hook query: "+err.Error())
+		return
+	}
+	if strings.TrimSpace(query.String()) == "" {
+		apierror.Respond(c, http.StatusBadRequest, apierror.InvalidRequest, "Hook query is empty for this event")
+		return
+	}
+
+	user := hk.cfg.User
+	if user == "" {
+		user = "hook:" + name
+	}
+	inputs := hk.cfg.Inputs
+	if inputs == nil {
+		inputs = map[string]interface{}{}
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), h.streamTimeout)
+	defer cancel()
+	answer, err := h.difyHandler.Ask(withLogger(ctx, reqLog), DifyChatMessageRequest{
+		Inputs: inputs,
+		Query:  query.String(),
+		User:   user,
+	})
+	if err != nil {
+		reqLog.WithError(err).Error("Error getting Dify answer for hook")
+		difyErrorResponse(c, err)
+		return
+	}
+
+	// Callers and delivery targets get the answer without reasoning blocks
+	// or citations, like chat users
+	text := sanitizeAnswer(h.sanitize, answer.Answer, true)
+
+	// Deliver in the background so synchronous callers aren't held up by SMTP
+	go h.deliver(reqLog, hk.cfg, text)
+
+	c.JSON(http.StatusOK, gin.H{
+		"hook":            name,
+		"answer":          text,
+		"conversation_id": answer.ConversationID,
+	})
+}
+
+// deliver sends the answer to the hook's configured target
+func (h *HookHandler) deliver(log *logrus.Entry, hc config.HookConfig, answer string) {
+	if answer == "" {
+		return
+	}
+
+	switch hc.Deliver.Type {
+	case config.HookDeliverEmail:
+		subject := hc.Deliver.Subject
+		if subject == "" {
+			subject = "DifyGate hook: " + hc.Name
+		}
+		if err := h.mailService.Send(gate.Message{To: hc.Deliver.To, Subject: subject, Body: answer}); err != nil {
+			log.WithError(err).Error("Failed to email hook answer")
+			return
+		}
+		log.WithField("recipients", len(hc.Deliver.To)).Info("Hook answer emailed")
+
+	case config.HookDeliverWhatsApp:
+		phoneNumberID := hc.Deliver.PhoneNumberID
+		if phoneNumberID == "" {
+			phoneNumberID = h.defaultPhoneNumberID
+		}
+		for _, to := range hc.Deliver.To {
+			h.deliverWhatsApp(log.WithField("to", to), phoneNumberID, to, answer)
+		}
+
+	default:
+		log.WithField("answer", answer).Info("Hook answer")
+	}
+}
+
+// hookRetryDelay is the wait before a failed WhatsApp delivery of a hook
+// answer is tried again
+var hookRetryDelay = 5 * time.Second
+
+// deliverWhatsApp sends the answer to one WhatsApp user, trying once more
+// when nothing went out; a retry after part of a long answer was sent
+// would repeat that part
+func (h *HookHandler) deliverWhatsApp(log *logrus.Entry, phoneNumberID, to, answer string) {
+	ctx := withLogger(context.Background(), log)
+	wamids, err := h.waClient.SendReplyMessage(ctx, phoneNumberID, to, answer, "")
+	if err != nil && len(wamids) == 0 {
+		log.WithError(err).Warn("Failed to send hook answer over WhatsApp, retrying")
+		time.Sleep(hookRetryDelay)
+		wamids, err = h.waClient.SendReplyMessage(ctx, phoneNumberID, to, answer, "")
+	}
+	if err != nil {
+		log.WithError(err).WithField("wamids", wamids).Error("Failed to send hook answer over WhatsApp")
+		return
+	}
+	log.WithField("wamids", wamids).Info("Hook answer sent over WhatsApp")
+}
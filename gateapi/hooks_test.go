@@ -0,0 +1,64 @@
+package gateapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tracoco/DifyGate/config"
+)
+
+// TestHookAnswerIsSanitized checks reasoning and citations are removed both
+// from the synchronous response and from the WhatsApp delivery
+func TestHookAnswerIsSanitized(t *testing.T) {
+	_, difyHandler := newFakeDify(t, func(req ChatMessageRequest) []StreamingChatResponse {
+		return difyAnswer("conv-1", "<think>Checking the alert.</think>", "Disk is full on db-1 [1].")
+	})
+	graph, waClient := newFakeGraphAPI(t)
+
+	h := NewHookHandler([]config.HookConfig{{
+		Name:    "alert",
+		Query:   "{{.summary}}",
+		Deliver: config.HookDeliveryConfig{Type: config.HookDeliverWhatsApp, To: []string{"123"}, PhoneNumberID: "555"},
+	}}, config.ChatConfig{Sanitize: config.SanitizeConfig{ThinkTags: true, Citations: true}},
+		config.WhatsAppConfig{}, config.DifyConfig{StreamTimeout: 5 * time.Second}, &HTTPClients{}, difyHandler, nil, quietLogger())
+	h.waClient = waClient
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/hooks/:name", h.HandleHook)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/hooks/alert", strings.NewReader(`{"summary":"disk alert"}`)))
+
+	var resp struct {
+		Answer string `json:"answer"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("status %d, body %s", w.Code, w.Body.String())
+	}
+	const want = "Disk is full on db-1."
+	if resp.Answer != want {
+		t.Errorf("response answer = %q, want %q", resp.Answer, want)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		graph.mu.Lock()
+		bodies := append([]string(nil), graph.bodies...)
+		graph.mu.Unlock()
+		if len(bodies) > 0 {
+			if bodies[0] != want {
+				t.Errorf("delivered %q, want %q", bodies[0], want)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("answer was not delivered to WhatsApp")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,137 @@
+package gateapi
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/tracoco/DifyGate/config"
+)
+
+// metaRequestTimeout bounds a single Graph API call
+const metaRequestTimeout = 10 * time.Second
+
+// HTTPClients are the long-lived outbound clients, so connections to Dify
+// and Meta are reused instead of re-dialed for every message. Each
+// destination goes through its DIFYGATE_OUTBOUND_PROXY setting.
+type HTTPClients struct {
+	// Dify makes blocking calls. It has no overall timeout, so a caller's
+	// deadline can be longer than DIFYGATE_DIFY_REQUEST_TIMEOUT, which
+	// DifyHandler applies to calls without one.
+	Dify *http.Client
+	// DifyStream reads SSE answers; it has no overall timeout, only one on
+	// the response headers, and callers bound the stream with a context
+	DifyStream *http.Client
+	// Meta calls the Graph API for WhatsApp and Messenger
+	Meta *http.Client
+	// Webhooks carries outgoing webhook deliveries, which keep their own
+	// timeout
+	Webhooks http.RoundTripper
+	// other carries the calls to every other service, e.g. Slack, Twilio
+	// or Sentry, through DIFYGATE_OUTBOUND_PROXY
+	other *http.Transport
+}
+
+// NewHTTPClients creates the shared clients
+func NewHTTPClients(cfg config.HTTPClientConfig) *HTTPClients {
+	// A blocking Dify call only sends headers once the whole answer is
+	// ready, so its transport must not time out waiting for them
+	difyTransport := newTransport(cfg, "dify")
+	difyTransport.ResponseHeaderTimeout = 0
+
+	// A compressed answer can't be decoded until enough of it arrived, and
+	// proxies may hold compressed responses back, so events would come in
+	// bursts rather than as Dify sends them
+	streamTransport := newTransport(cfg, "dify")
+	streamTransport.DisableCompression = true
+
+	return &HTTPClients{
+		Dify:       &http.Client{Transport: proxyErrors(difyTransport, "dify")},
+		DifyStream: &http.Client{Transport: proxyErrors(streamTransport, "dify")},
+		Meta:       &http.Client{Transport: proxyErrors(newTransport(cfg, "meta"), "meta"), Timeout: metaRequestTimeout},
+		Webhooks:   proxyErrors(newTransport(cfg, "webhooks"), "webhooks"),
+		other:      newTransport(cfg, "other"),
+	}
+}
+
+// Transport carries calls to service, one without a proxy setting of its
+// own, sharing a connection pool with the other such services. Without
+// clients, as in tests, it is nil, which http.Client takes for the default
+// transport.
+func (c *HTTPClients) Transport(service string) http.RoundTripper {
+	if c == nil || c.other == nil {
+		return nil
+	}
+	return proxyErrors(c.other, service)
+}
+
+// Client is a client of service bounded by timeout, using Transport
+func (c *HTTPClients) Client(service string, timeout time.Duration) *http.Client {
+	return &http.Client{Transport: c.Transport(service), Timeout: timeout}
+}
+
+// newTransport builds a pooled transport from cfg for calls to destination
+func newTransport(cfg config.HTTPClientConfig, destination string) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   cfg.DialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	return &http.Transport{
+		Proxy:                 proxyFunc(cfg.ProxyFor(destination)),
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     cfg.HTTP2,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+		IdleConnTimeout:       cfg.IdleConnTimeout,
+		TLSHandshakeTimeout:   cfg.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: cfg.ResponseHeaderTimeout,
+		ExpectContinueTimeout: time.Second,
+	}
+}
+
+// proxyFunc picks the proxy of each request: the environment's without a
+// setting, none for config.ProxyDirect, or the one set
+func proxyFunc(proxy string) func(*http.Request) (*url.URL, error) {
+	switch proxy {
+	case "":
+		return http.ProxyFromEnvironment
+	case config.ProxyDirect:
+		return nil
+	}
+	u, err := url.Parse(proxy)
+	if err != nil {
+		// Validated at startup; never fall back to connecting directly
+		err = errors.New("invalid outbound proxy URL")
+		return func(*http.Request) (*url.URL, error) { return nil, err }
+	}
+	return http.ProxyURL(u)
+}
+
+// proxiedTransport names the destination and proxy in the errors of calls
+// through a proxy, so a failing proxy isn't taken for a failing Dify or
+// Meta
+type proxiedTransport struct {
+	*http.Transport
+	destination string
+}
+
+// proxyErrors wraps t to name the proxy in its errors
+func proxyErrors(t *http.Transport, destination string) http.RoundTripper {
+	return proxiedTransport{Transport: t, destination: destination}
+}
+
+// RoundTrip implements http.RoundTripper
+func (t proxiedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.Transport.RoundTrip(req)
+	if err == nil || t.Proxy == nil {
+		return resp, err
+	}
+	if proxy, perr := t.Proxy(req); perr == nil && proxy != nil {
+		// Redacted keeps the proxy's password out of logs
+		return resp, fmt.Errorf("%s call through proxy %s: %w", t.destination, proxy.Redacted(), err)
+	}
+	return resp, err
+}
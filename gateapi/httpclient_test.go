@@ -0,0 +1,219 @@
+package gateapi
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tracoco/DifyGate/config"
+)
+
+// countingServer answers every request with a small JSON body and counts
+// the connections it accepts
+func countingServer(t *testing.T) (*httptest.Server, *int32) {
+	t.Helper()
+	var conns int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"messages":[{"id":"wamid.test"}]}`))
+	}))
+	srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv, &conns
+}
+
+func testHTTPClients() *HTTPClients {
+	return NewHTTPClients(config.HTTPClientConfig{
+		MaxIdleConnsPerHost:   10,
+		DialTimeout:           5 * time.Second,
+		TLSHandshakeTimeout:   5 * time.Second,
+		IdleConnTimeout:       time.Minute,
+		ResponseHeaderTimeout: 5 * time.Second,
+	})
+}
+
+func TestHTTPClientsReuseConnections(t *testing.T) {
+	clients := testHTTPClients()
+	for name, client := range map[string]*http.Client{"Dify": clients.Dify, "DifyStream": clients.DifyStream, "Meta": clients.Meta} {
+		srv, conns := countingServer(t)
+		for i := 0; i < 5; i++ {
+			resp, err := client.Get(srv.URL)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		if n := atomic.LoadInt32(conns); n != 1 {
+			t.Errorf("%s client opened %d connections for 5 sequential requests, want 1", name, n)
+		}
+	}
+}
+
+func TestWhatsAppClientReusesConnections(t *testing.T) {
+	srv, conns := countingServer(t)
+	client := NewWhatsAppClient(config.WhatsAppConfig{
+		GraphAPIToken:   "token",
+		GraphAPIBaseURL: srv.URL,
+		APIVersion:      "v22.0",
+	}, testHTTPClients().Meta)
+
+	for i := 0; i < 5; i++ {
+		if _, err := client.SendText(context.Background(), "555", "123", "hello", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(conns); n != 1 {
+		t.Errorf("opened %d connections for 5 sends, want 1", n)
+	}
+}
+
+// forwardProxy is an HTTP proxy for plain http:// destinations that passes
+// responses on as they come, and records the requests it forwarded
+func forwardProxy(t *testing.T) (*httptest.Server, func() []*http.Request) {
+	t.Helper()
+	var mu sync.Mutex
+	var seen []*http.Request
+	proxy := &httputil.ReverseProxy{
+		Director:      func(r *http.Request) {},
+		FlushInterval: -1,
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		seen = append(seen, r.Clone(context.Background()))
+		mu.Unlock()
+		proxy.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, func() []*http.Request {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]*http.Request(nil), seen...)
+	}
+}
+
+func TestDifyStreamThroughProxyIsNotBuffered(t *testing.T) {
+	release := make(chan struct{})
+	dify := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: {\"event\":\"message\",\"answer\":\"Hel\"}\n\n")
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer dify.Close()
+	defer close(release)
+	proxy, seen := forwardProxy(t)
+
+	clients := NewHTTPClients(config.HTTPClientConfig{
+		MaxIdleConnsPerHost:   10,
+		DialTimeout:           5 * time.Second,
+		TLSHandshakeTimeout:   5 * time.Second,
+		IdleConnTimeout:       time.Minute,
+		ResponseHeaderTimeout: 5 * time.Second,
+		OutboundProxy:         config.ProxyDirect,
+		OutboundProxyDify:     proxy.URL,
+	})
+	h := NewDifyHandler(config.DifyConfig{BaseURL: dify.URL, StreamTimeout: time.Minute}, clients, quietLogger())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	respChan, _ := h.DifyChatMessageStreaming(ctx, DifyChatMessageRequest{Query: "hi", User: "u1"})
+	select {
+	case first := <-respChan:
+		if first.Answer != "Hel" {
+			t.Fatalf("first event = %+v", first)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the first event was held back until the answer ended")
+	}
+	forwarded := seen()
+	if len(forwarded) != 1 {
+		t.Fatalf("the proxy forwarded %d requests, want 1", len(forwarded))
+	}
+	if enc := forwarded[0].Header.Get("Accept-Encoding"); enc != "" {
+		t.Errorf("stream asked for Accept-Encoding %q, want none", enc)
+	}
+
+	// Meta goes direct, past the Dify proxy
+	srv, _ := countingServer(t)
+	resp, err := clients.Meta.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if len(seen()) != 1 {
+		t.Errorf("a direct call went through the proxy")
+	}
+}
+
+func TestProxyErrorsNameTheProxy(t *testing.T) {
+	// A port nothing listens on
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	clients := NewHTTPClients(config.HTTPClientConfig{
+		MaxIdleConnsPerHost: 10,
+		DialTimeout:         time.Second,
+		OutboundProxy:       "http://gate:s3cret@" + addr,
+	})
+	_, err = clients.Meta.Get("http://graph.example.com/v22.0/me")
+	if err == nil {
+		t.Fatal("call through a dead proxy succeeded")
+	}
+	if msg := err.Error(); !strings.Contains(msg, "meta call through proxy http://gate:xxxxx@"+addr) || strings.Contains(msg, "s3cret") {
+		t.Errorf("error %q, want it to name the destination and the proxy without its password", msg)
+	}
+}
+
+func TestOtherServicesUseTheOutboundProxy(t *testing.T) {
+	slack, _ := countingServer(t)
+	proxy, seen := forwardProxy(t)
+	clients := NewHTTPClients(config.HTTPClientConfig{
+		MaxIdleConnsPerHost: 10,
+		DialTimeout:         time.Second,
+		OutboundProxy:       proxy.URL,
+	})
+	// The answer isn't Slack's, only where it came from matters
+	NewSlackClient(config.SlackConfig{BotToken: "xoxb-1", APIBaseURL: slack.URL}, clients).PostMessage(context.Background(), "C1", "", "hi")
+	if forwarded := seen(); len(forwarded) != 1 || forwarded[0].URL.Path != "/chat.postMessage" {
+		t.Fatalf("the proxy forwarded %d requests, want the Slack call", len(forwarded))
+	}
+
+	// and failures through it name the service
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	clients = NewHTTPClients(config.HTTPClientConfig{
+		MaxIdleConnsPerHost: 10,
+		DialTimeout:         time.Second,
+		OutboundProxy:       "http://" + addr,
+	})
+	tc := NewTwilioClient(config.TwilioConfig{AccountSID: "AC1", AuthToken: "token", APIBaseURL: "http://api.twilio.example.com"}, clients)
+	err = tc.SendSMS(context.Background(), "+15550001", "+15550002", "hi")
+	if err == nil || !strings.Contains(err.Error(), "twilio call through proxy http://"+addr) {
+		t.Errorf("error %v, want it to name Twilio and the proxy", err)
+	}
+}
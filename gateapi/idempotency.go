@@ -0,0 +1,143 @@
+package gateapi
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/apierror"
+	"github.com/tracoco/DifyGate/config"
+	"github.com/tracoco/DifyGate/store"
+)
+
+const (
+	// idempotencyLockTTL frees a key whose first request never finished,
+	// e.g. because the process stopped, so a retry can run it again
+	idempotencyLockTTL = 5 * time.Minute
+	// idempotencyWaitTimeout bounds the wait for a request in flight
+	idempotencyWaitTimeout = 30 * time.Second
+	// idempotencyPollInterval is how often a waiting request checks for
+	// the first one's response
+	idempotencyPollInterval = 100 * time.Millisecond
+	// maxIdempotencyKeyLength keeps keys to what clients reasonably send
+	maxIdempotencyKeyLength = 255
+)
+
+// idempotentResponse is a response kept for replay
+type idempotentResponse struct {
+	Status int             `json:"status"`
+	Body   json.RawMessage `json:"body"`
+}
+
+// idempotency replays the successful response to a request for later
+// requests with the same Idempotency-Key and caller, so a client retrying
+// after a timeout doesn't act twice. Failed requests aren't kept, so they
+// can be retried.
+type idempotency struct {
+	cfg   config.IdempotencyConfig
+	store store.Store
+	// scope separates the keys of different endpoints
+	scope string
+}
+
+func newIdempotency(cfg config.IdempotencyConfig, kv store.Store, scope string) *idempotency {
+	if cfg.TTL <= 0 {
+		return nil
+	}
+	return &idempotency{cfg: cfg, store: kv, scope: scope}
+}
+
+// storeKey scopes key to the authenticated caller, so callers can't see
+// each other's responses; the key is hashed to bound its length
+func (i *idempotency) storeKey(c *gin.Context, key string) string {
+	sum := sha256.Sum256([]byte(c.GetString(authKeyNameKey) + "\x00" + key))
+	return "idempotency:" + i.scope + ":" + hex.EncodeToString(sum[:])
+}
+
+// run answers c with the response handle returns, or with the response
+// kept for key when a request with the same key already succeeded. An
+// empty key, or a nil idempotency, always runs handle.
+func (i *idempotency) run(c *gin.Context, log *logrus.Entry, key string, handle func() (int, interface{})) {
+	if i == nil || key == "" {
+		c.JSON(handle())
+		return
+	}
+	if len(key) > maxIdempotencyKeyLength {
+		apierror.Respond(c, http.StatusBadRequest, apierror.InvalidRequest, "Idempotency-Key is too long")
+		return
+	}
+	storeKey := i.storeKey(c, key)
+	log = log.WithField("idempotency_key", key)
+
+	deadline := time.Now().Add(idempotencyWaitTimeout)
+	for {
+		if resp, ok := i.response(log, storeKey); ok {
+			log.Info("Replaying response to a repeated request")
+			c.Header("Idempotent-Replayed", "true")
+			c.Data(resp.Status, "application/json; charset=utf-8", resp.Body)
+			return
+		}
+		// The first request to take the lock runs; it is released when
+		// the request fails, so a retry runs again
+		n, err := i.store.Incr(storeKey+":lock", idempotencyLockTTL)
+		if err != nil {
+			log.WithError(err).Warn("Failed to lock idempotency key, handling the request without it")
+			c.JSON(handle())
+			return
+		}
+		if n == 1 {
+			break
+		}
+		if i.cfg.InFlight != config.IdempotencyWait || time.Now().After(deadline) {
+			apierror.Respond(c, http.StatusConflict, apierror.IdempotencyConflict, "A request with this Idempotency-Key is still being processed")
+			return
+		}
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-time.After(idempotencyPollInterval):
+		}
+	}
+
+	status, body := handle()
+	defer c.JSON(status, body)
+	if status >= 300 {
+		if err := i.store.Delete(storeKey + ":lock"); err != nil {
+			log.WithError(err).Warn("Failed to release idempotency key")
+		}
+		return
+	}
+	// Kept before answering, so a retry that follows at once replays it
+	raw, err := json.Marshal(body)
+	if err == nil {
+		var b []byte
+		if b, err = json.Marshal(idempotentResponse{Status: status, Body: raw}); err == nil {
+			err = i.store.Set(storeKey, b, i.cfg.TTL)
+		}
+	}
+	if err != nil {
+		log.WithError(err).Warn("Failed to keep response for the idempotency key")
+	}
+}
+
+// response returns the response kept for storeKey
+func (i *idempotency) response(log *logrus.Entry, storeKey string) (idempotentResponse, bool) {
+	var resp idempotentResponse
+	b, err := i.store.Get(storeKey)
+	if err != nil {
+		if !errors.Is(err, store.ErrNotFound) {
+			log.WithError(err).Warn("Failed to look up idempotency key")
+		}
+		return resp, false
+	}
+	if err := json.Unmarshal(b, &resp); err != nil {
+		log.WithError(err).Warn("Failed to read response kept for idempotency key")
+		return resp, false
+	}
+	return resp, true
+}
@@ -0,0 +1,109 @@
+package gateapi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tracoco/DifyGate/config"
+	"github.com/tracoco/DifyGate/store"
+)
+
+// newIdempotentRouter serves /send, answering with status for each call it
+// counts; the caller is named by the X-Key header
+func newIdempotentRouter(cfg config.IdempotencyConfig, status *int, calls *int, block chan struct{}) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	i := newIdempotency(cfg, store.NewMemoryStore(), "test")
+	r := gin.New()
+	r.POST("/send", func(c *gin.Context) {
+		c.Set(authKeyNameKey, c.GetHeader("X-Key"))
+		i.run(c, testEntry(), c.GetHeader("Idempotency-Key"), func() (int, interface{}) {
+			*calls++
+			if block != nil {
+				<-block
+			}
+			return *status, gin.H{"call": *calls}
+		})
+	})
+	return r
+}
+
+func idempotentSend(r *gin.Engine, caller, key string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/send", nil)
+	req.Header.Set("X-Key", caller)
+	req.Header.Set("Idempotency-Key", key)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestIdempotencyReplaysSuccess(t *testing.T) {
+	status, calls := http.StatusOK, 0
+	r := newIdempotentRouter(config.IdempotencyConfig{TTL: time.Hour, InFlight: config.IdempotencyConflict}, &status, &calls, nil)
+
+	first := idempotentSend(r, "a", "invoice-1")
+	second := idempotentSend(r, "a", "invoice-1")
+	if calls != 1 {
+		t.Fatalf("handled %d times, want once", calls)
+	}
+	if second.Code != http.StatusOK || second.Body.String() != first.Body.String() || second.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("retry got %d %s, want the first response replayed", second.Code, second.Body)
+	}
+
+	// Keys are scoped to the caller, and requests without one always run
+	idempotentSend(r, "b", "invoice-1")
+	idempotentSend(r, "a", "")
+	if calls != 3 {
+		t.Errorf("handled %d times, want another caller's key and a missing key to run", calls)
+	}
+}
+
+func TestIdempotencyRetriesFailures(t *testing.T) {
+	status, calls := http.StatusInternalServerError, 0
+	r := newIdempotentRouter(config.IdempotencyConfig{TTL: time.Hour, InFlight: config.IdempotencyConflict}, &status, &calls, nil)
+
+	if w := idempotentSend(r, "a", "invoice-1"); w.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want the failure", w.Code)
+	}
+	status = http.StatusOK
+	if w := idempotentSend(r, "a", "invoice-1"); w.Code != http.StatusOK || calls != 2 {
+		t.Errorf("retry after a failure got %d after %d calls, want it to run again", w.Code, calls)
+	}
+}
+
+func TestIdempotencyInFlight(t *testing.T) {
+	for _, mode := range []string{config.IdempotencyConflict, config.IdempotencyWait} {
+		t.Run(mode, func(t *testing.T) {
+			status, calls := http.StatusOK, 0
+			block := make(chan struct{})
+			r := newIdempotentRouter(config.IdempotencyConfig{TTL: time.Hour, InFlight: mode}, &status, &calls, block)
+
+			done := make(chan *httptest.ResponseRecorder)
+			go func() { done <- idempotentSend(r, "a", "invoice-1") }()
+			// Let the first request take the key before the retry
+			time.Sleep(50 * time.Millisecond)
+			retried := make(chan *httptest.ResponseRecorder)
+			go func() { retried <- idempotentSend(r, "a", "invoice-1") }()
+
+			if mode == config.IdempotencyConflict {
+				if w := <-retried; w.Code != http.StatusConflict {
+					t.Errorf("retry in flight got %d, want 409", w.Code)
+				}
+				close(block)
+				<-done
+				return
+			}
+			time.Sleep(50 * time.Millisecond)
+			close(block)
+			first := <-done
+			if w := <-retried; w.Code != http.StatusOK || w.Body.String() != first.Body.String() {
+				t.Errorf("waiting retry got %d %s, want the first response", w.Code, w.Body)
+			}
+			if calls != 1 {
+				t.Errorf("handled %d times, want once", calls)
+			}
+		})
+	}
+}
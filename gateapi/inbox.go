@@ -0,0 +1,243 @@
+package gateapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/metrics"
+	"github.com/tracoco/DifyGate/store"
+)
+
+// inboxMessages counts webhook messages the durable inbox didn't answer
+// straight away, by outcome: duplicate or recovered
+var inboxMessages = metrics.NewCounter("difygate_inbox_messages_total",
+	"Webhook messages dropped as redeliveries or answered after a restart, by outcome", "channel", "outcome")
+
+const (
+	// inboxSeenTTL is how long a message ID is remembered, so redeliveries
+	// of it are dropped
+	inboxSeenTTL = 24 * time.Hour
+	// inboxRecoverInterval is how often unfinished messages are looked for
+	inboxRecoverInterval = 30 * time.Second
+	// inboxHeartbeatInterval is how often an instance says it is alive;
+	// its messages are taken over once it has been silent for
+	// inboxInstanceTTL
+	inboxHeartbeatInterval = 10 * time.Second
+	inboxInstanceTTL       = 30 * time.Second
+)
+
+// inboxInstance names this process to the other instances. It stays the
+// same when a container restarts, so the messages the process held when it
+// stopped are taken over as soon as it is back, without waiting for its
+// heartbeat to expire.
+var inboxInstance = func() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s:%d", host, os.Getpid())
+}()
+
+// inboxEntry is a message acknowledged to the platform but not yet answered
+type inboxEntry struct {
+	Message    ChannelMessage `json:"message"`
+	ReceivedAt time.Time      `json:"received_at"`
+}
+
+// inbox is the write-ahead queue of DIFYGATE_DURABLE_INBOX: webhook
+// messages are saved before the platform gets its 200 and removed once
+// answered, so a message left behind by a crashed or frozen process is
+// answered by the next one to look. Every message is owned by the
+// instance answering it, which keeps a heartbeat in the store while it
+// runs; a message whose owner has stopped is answered again, however long
+// it was queued.
+type inbox struct {
+	channel string
+	store   store.Store
+	// instance is the name messages are owned under
+	instance string
+	// handle answers a message, blocking until it is sent
+	handle func(log *logrus.Entry, msg ChannelMessage)
+
+	start sync.Once
+	mu    sync.Mutex
+	// active are the keys of the messages this process is answering
+	active map[string]bool
+}
+
+func (in *inbox) key(messageID string) string {
+	return "inbox:" + in.channel + ":" + messageID
+}
+
+// seenKey counts the deliveries of a message ID
+func (in *inbox) seenKey(messageID string) string {
+	return "inbox-seen:" + in.channel + ":" + messageID
+}
+
+// markSeen remembers a message ID answered outside the inbox, e.g. by a
+// replay, so redeliveries of it are dropped
+func (in *inbox) markSeen(log *logrus.Entry, messageID string) {
+	if in == nil || messageID == "" {
+		return
+	}
+	if _, err := in.store.Incr(in.seenKey(messageID), inboxSeenTTL); err != nil {
+		log.WithError(err).Warn("Failed to remember replayed message")
+	}
+}
+
+// ownerKey holds the instance answering the message saved under key
+func ownerKey(key string) string {
+	return "inbox-owner:" + key
+}
+
+// instanceKey is kept alive by the heartbeat of instance
+func instanceKey(instance string) string {
+	return "inbox-instance:" + instance
+}
+
+// own makes this instance the owner of the message saved under key
+func (in *inbox) own(log *logrus.Entry, key string) {
+	// Owning a message without a heartbeat would hand it to every other
+	// instance
+	in.run(log.Logger)
+	in.mu.Lock()
+	in.active[key] = true
+	in.mu.Unlock()
+	if err := in.store.Set(ownerKey(key), []byte(in.instance), inboxSeenTTL); err != nil {
+		log.WithError(err).Warn("Failed to claim inbox message")
+	}
+}
+
+// heartbeat tells other instances this one is alive
+func (in *inbox) heartbeat(log *logrus.Logger) {
+	if err := in.store.Set(instanceKey(in.instance), []byte(time.Now().UTC().Format(time.RFC3339)), inboxInstanceTTL); err != nil {
+		log.WithError(err).Warn("Failed to renew inbox heartbeat")
+	}
+}
+
+// abandoned reports whether the message saved under key is owned by no
+// live instance: by none at all, by one whose heartbeat has stopped, or by
+// an earlier run of this one
+func (in *inbox) abandoned(key string) bool {
+	owner, err := in.store.Get(ownerKey(key))
+	if err != nil {
+		return errors.Is(err, store.ErrNotFound)
+	}
+	if string(owner) == in.instance {
+		in.mu.Lock()
+		defer in.mu.Unlock()
+		return !in.active[key]
+	}
+	_, err = in.store.Get(instanceKey(string(owner)))
+	return errors.Is(err, store.ErrNotFound)
+}
+
+// claim reports whether the caller may take over the abandoned message
+// saved under key. The claim is keyed by the owner it is taken from, so
+// one instance takes over each time a message is abandoned.
+func (in *inbox) claim(key string) bool {
+	owner, _ := in.store.Get(ownerKey(key))
+	n, err := in.store.Incr("inbox-claim:"+key+":"+string(owner), inboxSeenTTL)
+	return err == nil && n == 1
+}
+
+// add saves msg before it is acknowledged. ok is false when msg was seen
+// before and must not be answered again.
+func (in *inbox) add(log *logrus.Entry, msg ChannelMessage) (key string, ok bool) {
+	seen, err := in.store.Incr(in.seenKey(msg.ReplyTo), inboxSeenTTL)
+	if err != nil {
+		log.WithError(err).Warn("Failed to check for a redelivered message")
+	} else if seen > 1 {
+		inboxMessages.Inc(in.channel, "duplicate")
+		log.Info("Ignoring redelivered message")
+		return "", false
+	}
+
+	key = in.key(msg.ReplyTo)
+	in.own(log, key)
+	b, err := json.Marshal(inboxEntry{Message: msg, ReceivedAt: time.Now()})
+	if err == nil {
+		err = in.store.Set(key, b, inboxSeenTTL)
+	}
+	if err != nil {
+		log.WithError(err).Warn("Failed to save message to the inbox, it won't be recovered after a restart")
+	}
+	return key, true
+}
+
+// done removes an answered message
+func (in *inbox) done(log *logrus.Entry, key string) {
+	if err := in.store.Delete(key); err != nil {
+		log.WithError(err).Warn("Failed to remove answered message from the inbox")
+	}
+	if err := in.store.Delete(ownerKey(key)); err != nil {
+		log.WithError(err).Debug("Failed to release inbox message")
+	}
+	in.mu.Lock()
+	delete(in.active, key)
+	in.mu.Unlock()
+}
+
+// run starts answering messages left unanswered, at once and then every
+// inboxRecoverInterval for the life of the process, and keeps the
+// instance's heartbeat
+func (in *inbox) run(log *logrus.Logger) {
+	if in == nil {
+		return
+	}
+	in.start.Do(func() {
+		in.heartbeat(log)
+		go func() {
+			ticker := time.NewTicker(inboxHeartbeatInterval)
+			defer ticker.Stop()
+			for range ticker.C {
+				in.heartbeat(log)
+			}
+		}()
+		go func() {
+			in.recover(log)
+			ticker := time.NewTicker(inboxRecoverInterval)
+			defer ticker.Stop()
+			for range ticker.C {
+				in.recover(log)
+			}
+		}()
+	})
+}
+
+// recover answers the saved messages no live instance owns
+func (in *inbox) recover(log *logrus.Logger) {
+	keys, err := in.store.Keys(in.key("*"))
+	if err != nil {
+		log.WithError(err).Warn("Failed to list inbox messages")
+		return
+	}
+	for _, key := range keys {
+		b, err := in.store.Get(key)
+		if errors.Is(err, store.ErrNotFound) {
+			continue
+		}
+		var entry inboxEntry
+		if err == nil {
+			err = json.Unmarshal(b, &entry)
+		}
+		if err != nil {
+			log.WithError(err).WithField("key", key).Warn("Failed to read inbox message")
+			continue
+		}
+		if !in.abandoned(key) || !in.claim(key) {
+			continue
+		}
+
+		entryLog := log.WithFields(logrus.Fields{"channel": in.channel, "message_id": entry.Message.ReplyTo})
+		inboxMessages.Inc(in.channel, "recovered")
+		entryLog.WithField("received_at", entry.ReceivedAt).Warn("Answering message left unanswered")
+		in.own(entryLog, key)
+		go func(key string, msg ChannelMessage) {
+			in.handle(entryLog, msg)
+			in.done(entryLog, key)
+		}(key, entry.Message)
+	}
+}
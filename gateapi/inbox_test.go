@@ -0,0 +1,112 @@
+package gateapi
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/config"
+)
+
+// waitSent waits for the fake sender to send n messages
+func waitSent(t *testing.T, sender *fakeSender, n int) []string {
+	t.Helper()
+	var got []string
+	for deadline := time.Now().Add(5 * time.Second); len(got) < n && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		got = append(got, sender.sent()...)
+	}
+	return got
+}
+
+func TestInboxDropsRedeliveries(t *testing.T) {
+	p, sender, _, kv := newTestPipeline(t, PipelineOptions{Channel: "inbox-dup"}, config.ChatConfig{DurableInbox: true},
+		func(req ChatMessageRequest) []StreamingChatResponse {
+			return difyAnswer("conv-1", "answer")
+		})
+	msg := ChannelMessage{ChannelID: "bot", UserID: "u1", Text: "hi", ReplyTo: "wamid.1"}
+
+	p.Accept(testEntry(), msg)
+	p.Accept(testEntry(), msg)
+	if got := waitSent(t, sender, 1); len(got) != 1 {
+		t.Fatalf("sent %q, want one answer", got)
+	}
+	if n := inboxMessages.Value("inbox-dup", "duplicate"); n != 1 {
+		t.Errorf("duplicate counter = %v, want 1", n)
+	}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if keys, _ := kv.Keys("inbox:inbox-dup:*"); len(keys) == 0 {
+			return
+		}
+	}
+	t.Error("answered message left in the inbox")
+}
+
+func TestInboxRecoversUnansweredMessages(t *testing.T) {
+	p, sender, _, kv := newTestPipeline(t, PipelineOptions{Channel: "inbox-recover"}, config.ChatConfig{DurableInbox: true},
+		func(req ChatMessageRequest) []StreamingChatResponse {
+			return difyAnswer("conv-1", "answer")
+		})
+	save := func(id, owner string) {
+		b, _ := json.Marshal(inboxEntry{Message: ChannelMessage{ChannelID: "bot", UserID: "u-" + id, Text: "hi", ReplyTo: id}, ReceivedAt: time.Now()})
+		kv.Set("inbox:inbox-recover:"+id, b, 0)
+		if owner != "" {
+			kv.Set(ownerKey("inbox:inbox-recover:"+id), []byte(owner), 0)
+		}
+	}
+	// Left without an owner
+	save("wamid.2", "")
+	// Another instance is still answering this one
+	save("wamid.3", "other:1")
+	kv.Set(instanceKey("other:1"), []byte("alive"), time.Hour)
+	// Its owner's heartbeat has stopped
+	save("wamid.4", "stopped:1")
+	// Left by this instance before it restarted
+	save("wamid.5", p.inbox.instance)
+
+	p.inbox.recover(quietLogger())
+	if got := waitSent(t, sender, 3); len(got) != 3 {
+		t.Fatalf("sent %q, want the three abandoned messages answered", got)
+	}
+	if n := inboxMessages.Value("inbox-recover", "recovered"); n != 3 {
+		t.Errorf("recovered counter = %v, want 3", n)
+	}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if keys, _ := kv.Keys("inbox:inbox-recover:*"); len(keys) == 1 && keys[0] == "inbox:inbox-recover:wamid.3" {
+			return
+		}
+	}
+	keys, _ := kv.Keys("inbox:inbox-recover:*")
+	t.Errorf("inbox holds %q, want only the owned message", keys)
+}
+
+func TestInboxKeepsMessagesOfLiveInstances(t *testing.T) {
+	release := make(chan struct{})
+	p, sender, _, kv := newTestPipeline(t, PipelineOptions{Channel: "inbox-live"}, config.ChatConfig{DurableInbox: true, MaxQueuedMessages: 3},
+		func(req ChatMessageRequest) []StreamingChatResponse {
+			<-release
+			return difyAnswer("conv-1", "answer")
+		})
+	// A slow answer and one queued behind it, however long they take
+	p.Accept(testEntry(), ChannelMessage{ChannelID: "bot", UserID: "u1", Text: "hi", ReplyTo: "wamid.1"})
+	p.Accept(testEntry(), ChannelMessage{ChannelID: "bot", UserID: "u1", Text: "again", ReplyTo: "wamid.2"})
+	time.Sleep(20 * time.Millisecond)
+
+	// are neither taken by this instance nor by another one sharing the
+	// store
+	other := &inbox{channel: "inbox-live", store: kv, instance: "other:1", active: make(map[string]bool),
+		handle: func(log *logrus.Entry, msg ChannelMessage) { t.Errorf("another instance answered %q", msg.Text) }}
+	p.inbox.recover(quietLogger())
+	other.recover(quietLogger())
+	if n := inboxMessages.Value("inbox-live", "recovered"); n != 0 {
+		t.Errorf("recovered counter = %v, want 0", n)
+	}
+	if heartbeat, err := kv.Get(instanceKey(p.inbox.instance)); err != nil || len(heartbeat) == 0 {
+		t.Errorf("no heartbeat: %v", err)
+	}
+
+	close(release)
+	if got := waitSent(t, sender, 2); len(got) != 2 {
+		t.Fatalf("sent %q, want both answered once", got)
+	}
+}
@@ -0,0 +1,62 @@
+package gateapi
+
+import (
+	"net/http"
+	"net/netip"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/apierror"
+)
+
+// IPAllowlistMiddleware only admits clients whose IP (as resolved through
+// the trusted proxies) falls in one of cidrs, rejecting others with 403.
+// Plain IPs are accepted as single-address ranges; an empty list admits all.
+func IPAllowlistMiddleware(cidrs []string, log *logrus.Logger) gin.HandlerFunc {
+	var prefixes []netip.Prefix
+	for _, cidr := range cidrs {
+		prefix, err := parsePrefix(cidr)
+		if err != nil {
+			// Validate rejects these, so this only guards direct callers
+			log.WithError(err).WithField("cidr", cidr).Error("Ignoring invalid allowlist entry")
+			continue
+		}
+		prefixes = append(prefixes, prefix)
+	}
+
+	return func(c *gin.Context) {
+		if len(cidrs) == 0 {
+			c.Next()
+			return
+		}
+
+		if addr, err := netip.ParseAddr(c.ClientIP()); err == nil {
+			addr = addr.Unmap()
+			for _, prefix := range prefixes {
+				if prefix.Contains(addr) {
+					c.Next()
+					return
+				}
+			}
+		}
+
+		requestLogger(c, log).WithFields(logrus.Fields{
+			"client_ip": c.ClientIP(),
+			"path":      c.Request.URL.Path,
+		}).Warn("Client IP not in allowlist")
+		apierror.Abort(c, http.StatusForbidden, apierror.IPNotAllowed, "Access from this IP address is not allowed")
+	}
+}
+
+// parsePrefix parses a CIDR range or a single IP address
+func parsePrefix(s string) (netip.Prefix, error) {
+	if prefix, err := netip.ParsePrefix(s); err == nil {
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
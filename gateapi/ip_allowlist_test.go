@@ -0,0 +1,56 @@
+package gateapi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tracoco/DifyGate/config"
+)
+
+func TestIPAllowlistMiddleware(t *testing.T) {
+	allowlist := []string{"203.0.113.0/24", "2001:db8::/32", "198.51.100.7"}
+	tests := []struct {
+		name      string
+		allowlist []string
+		// proxies are DIFYGATE_TRUSTED_PROXIES
+		proxies   []string
+		peer      string
+		forwarded string
+		want      int
+	}{
+		{"IPv4 in range", allowlist, nil, "203.0.113.9:1234", "", http.StatusOK},
+		{"IPv4 out of range", allowlist, nil, "192.0.2.1:1234", "", http.StatusForbidden},
+		{"single address", allowlist, nil, "198.51.100.7:1234", "", http.StatusOK},
+		{"IPv6 in range", allowlist, nil, "[2001:db8::1]:1234", "", http.StatusOK},
+		{"IPv6 out of range", allowlist, nil, "[2001:db9::1]:1234", "", http.StatusForbidden},
+		{"IPv4-mapped IPv6", allowlist, nil, "[::ffff:203.0.113.9]:1234", "", http.StatusOK},
+		{"empty list allows all", nil, nil, "192.0.2.1:1234", "", http.StatusOK},
+		{"trusted proxy forwarding an allowed client", allowlist, []string{"10.0.0.0/8"}, "10.0.0.2:1234", "203.0.113.9", http.StatusOK},
+		{"trusted proxy forwarding another client", allowlist, []string{"10.0.0.0/8"}, "10.0.0.2:1234", "192.0.2.1", http.StatusForbidden},
+		// Anyone can send the header; only a trusted proxy is believed
+		{"spoofed header from an untrusted peer", allowlist, []string{"10.0.0.0/8"}, "192.0.2.1:1234", "203.0.113.9", http.StatusForbidden},
+		{"spoofed header without trusted proxies", allowlist, nil, "192.0.2.1:1234", "203.0.113.9", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gin.SetMode(gin.TestMode)
+			r := gin.New()
+			configureClientIP(r, config.ServerConfig{TrustedProxies: tt.proxies}, quietLogger())
+			r.GET("/admin", IPAllowlistMiddleware(tt.allowlist, quietLogger()), func(c *gin.Context) {
+				c.Status(http.StatusOK)
+			})
+			req := httptest.NewRequest(http.MethodGet, "/admin", nil)
+			req.RemoteAddr = tt.peer
+			if tt.forwarded != "" {
+				req.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
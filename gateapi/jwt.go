@@ -0,0 +1,327 @@
+package gateapi
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha512" // SHA-384/512 for HS/RS384 and HS/RS512
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tracoco/DifyGate/config"
+)
+
+const (
+	// jwksRefreshInterval is how long fetched signing keys are trusted
+	jwksRefreshInterval = time.Hour
+	// jwksMinRefetch limits refetches triggered by unknown key IDs
+	jwksMinRefetch   = time.Minute
+	jwksFetchTimeout = 5 * time.Second
+)
+
+// Token errors; their messages are returned to the client
+var (
+	errTokenMalformed   = errors.New("Malformed token")
+	errTokenAlgorithm   = errors.New("Unsupported token algorithm")
+	errTokenSignature   = errors.New("Invalid token signature")
+	errTokenExpired     = errors.New("Token expired")
+	errTokenNotYetValid = errors.New("Token not yet valid")
+	errTokenIssuer      = errors.New("Invalid token issuer")
+	errTokenAudience    = errors.New("Invalid token audience")
+	errTokenIdentity    = errors.New("Token has no identity claim")
+	errTokenKeyUnknown  = errors.New("Token signed with an unknown key")
+)
+
+// jwtAlgorithms maps supported JWT algorithms to their hash
+var jwtAlgorithms = map[string]crypto.Hash{
+	"HS256": crypto.SHA256, "HS384": crypto.SHA384, "HS512": crypto.SHA512,
+	"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+}
+
+// jwtIdentity is the caller a valid token describes
+type jwtIdentity struct {
+	subject string
+	scopes  []string
+}
+
+// JWTVerifier validates bearer JWTs signed with an HMAC secret, a static
+// RSA public key, or RSA keys published at a JWKS URL
+type JWTVerifier struct {
+	cfg       config.JWTConfig
+	hmacKey   []byte
+	staticKey *rsa.PublicKey
+	client    *http.Client
+
+	mu          sync.Mutex
+	jwks        map[string]*rsa.PublicKey
+	jwksFetched time.Time
+	// jwksFetching is closed when the fetch in flight, if any, finishes
+	jwksFetching chan struct{}
+}
+
+// NewJWTVerifier creates a verifier, loading the RSA public key file if set
+func NewJWTVerifier(cfg config.JWTConfig, clients *HTTPClients) (*JWTVerifier, error) {
+	v := &JWTVerifier{cfg: cfg}
+
+	switch {
+	case cfg.HMACSecret != "":
+		v.hmacKey = []byte(cfg.HMACSecret)
+	case cfg.RSAPublicKeyFile != "":
+		key, err := config.LoadRSAPublicKey(cfg.RSAPublicKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load JWT public key %s: %w", cfg.RSAPublicKeyFile, err)
+		}
+		v.staticKey = key
+	case cfg.JWKSURL != "":
+		v.client = clients.Client("jwks", jwksFetchTimeout)
+	default:
+		return nil, errors.New("no JWT signing key configured")
+	}
+
+	return v, nil
+}
+
+// Verify checks token's signature and claims and returns the caller it names
+func (v *JWTVerifier) Verify(ctx context.Context, token string) (jwtIdentity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return jwtIdentity{}, errTokenMalformed
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTSegment(parts[0], &header); err != nil {
+		return jwtIdentity{}, errTokenMalformed
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return jwtIdentity{}, errTokenMalformed
+	}
+
+	if err := v.verifySignature(ctx, header.Alg, header.Kid, parts[0]+"."+parts[1], signature); err != nil {
+		return jwtIdentity{}, err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTSegment(parts[1], &claims); err != nil {
+		return jwtIdentity{}, errTokenMalformed
+	}
+	return v.checkClaims(claims)
+}
+
+func decodeJWTSegment(segment string, dst interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, dst)
+}
+
+func (v *JWTVerifier) verifySignature(ctx context.Context, alg, kid, signingInput string, signature []byte) error {
+	hash, ok := jwtAlgorithms[alg]
+	if !ok {
+		return errTokenAlgorithm
+	}
+
+	// The configured key decides the algorithm family, so a token can't pick
+	// HMAC and have an RSA public key used as its secret
+	if v.hmacKey != nil {
+		if !strings.HasPrefix(alg, "HS") {
+			return errTokenAlgorithm
+		}
+		mac := hmac.New(hash.New, v.hmacKey)
+		mac.Write([]byte(signingInput))
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return errTokenSignature
+		}
+		return nil
+	}
+
+	if !strings.HasPrefix(alg, "RS") {
+		return errTokenAlgorithm
+	}
+	key := v.staticKey
+	if key == nil {
+		var err error
+		if key, err = v.jwksKey(ctx, kid); err != nil {
+			return err
+		}
+	}
+	h := hash.New()
+	h.Write([]byte(signingInput))
+	if err := rsa.VerifyPKCS1v15(key, hash, h.Sum(nil), signature); err != nil {
+		return errTokenSignature
+	}
+	return nil
+}
+
+// jwksKey returns the JWKS key with the given ID, fetching the key set when
+// it is stale or doesn't contain the key yet. The fetch runs without the
+// lock, so requests with known keys aren't held up by a slow JWKS endpoint;
+// concurrent misses wait for the one fetch in flight.
+func (v *JWTVerifier) jwksKey(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	for {
+		v.mu.Lock()
+		age := time.Since(v.jwksFetched)
+		key, ok := v.jwks[kid]
+		if ok && age < jwksRefreshInterval {
+			v.mu.Unlock()
+			return key, nil
+		}
+		if !ok && v.jwks != nil && age < jwksMinRefetch {
+			v.mu.Unlock()
+			return nil, errTokenKeyUnknown
+		}
+		if ok && v.jwksFetching != nil {
+			// Keep using the stale key while another request refreshes
+			v.mu.Unlock()
+			return key, nil
+		}
+		if wait := v.jwksFetching; wait != nil {
+			v.mu.Unlock()
+			select {
+			case <-wait:
+				continue
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		done := make(chan struct{})
+		v.jwksFetching = done
+		v.mu.Unlock()
+
+		keys, err := v.fetchJWKS(ctx)
+
+		v.mu.Lock()
+		v.jwksFetching = nil
+		if err == nil {
+			v.jwks = keys
+			v.jwksFetched = time.Now()
+		}
+		v.mu.Unlock()
+		close(done)
+
+		if err != nil {
+			if ok {
+				// Keep using the stale key rather than failing every request
+				return key, nil
+			}
+			return nil, fmt.Errorf("failed to fetch JWKS: %w", err)
+		}
+		if key, ok = keys[kid]; !ok {
+			return nil, errTokenKeyUnknown
+		}
+		return key, nil
+	}
+}
+
+func (v *JWTVerifier) fetchJWKS(ctx context.Context) (map[string]*rsa.PublicKey, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", v.cfg.JWKSURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("JWKS endpoint returned status %d", resp.StatusCode)
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	return keys, nil
+}
+
+func (v *JWTVerifier) checkClaims(claims map[string]interface{}) (jwtIdentity, error) {
+	now := time.Now()
+
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return jwtIdentity{}, errTokenMalformed
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(v.cfg.Leeway)) {
+		return jwtIdentity{}, errTokenExpired
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Before(time.Unix(int64(nbf), 0).Add(-v.cfg.Leeway)) {
+		return jwtIdentity{}, errTokenNotYetValid
+	}
+
+	if v.cfg.Issuer != "" && claims["iss"] != v.cfg.Issuer {
+		return jwtIdentity{}, errTokenIssuer
+	}
+	if v.cfg.Audience != "" && !containsClaim(claims["aud"], v.cfg.Audience) {
+		return jwtIdentity{}, errTokenAudience
+	}
+
+	subject, _ := claims[v.cfg.IdentityClaim].(string)
+	if subject == "" {
+		return jwtIdentity{}, errTokenIdentity
+	}
+
+	return jwtIdentity{subject: subject, scopes: claimStrings(claims[v.cfg.ScopesClaim])}, nil
+}
+
+// containsClaim reports whether a string or array claim contains want
+func containsClaim(claim interface{}, want string) bool {
+	for _, s := range claimStrings(claim) {
+		if s == want {
+			return true
+		}
+	}
+	return false
+}
+
+// claimStrings reads a space-separated string or an array of strings
+func claimStrings(claim interface{}) []string {
+	switch c := claim.(type) {
+	case string:
+		return strings.Fields(c)
+	case []interface{}:
+		var out []string
+		for _, item := range c {
+			if s, ok := item.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package gateapi
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/tracoco/DifyGate/config"
+)
+
+// TestJWKSFetchDoesNotBlockKnownKeys checks a slow JWKS refetch for an
+// unknown key ID leaves requests with cached keys unaffected
+func TestJWKSFetchDoesNotBlockKnownKeys(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwk := map[string]string{
+		"kty": "RSA",
+		"kid": "known",
+		"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+
+	release := make(chan struct{})
+	fetches := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		if fetches > 1 {
+			<-release
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []interface{}{jwk}})
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	v, err := NewJWTVerifier(config.JWTConfig{JWKSURL: srv.URL}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if _, err := v.jwksKey(ctx, "known"); err != nil {
+		t.Fatalf("initial fetch: %v", err)
+	}
+	// Let the unknown key refetch past the minimum interval
+	v.mu.Lock()
+	v.jwksFetched = time.Now().Add(-2 * jwksMinRefetch)
+	v.mu.Unlock()
+
+	go v.jwksKey(ctx, "unknown")
+	for {
+		v.mu.Lock()
+		fetching := v.jwksFetching != nil
+		v.mu.Unlock()
+		if fetching {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := v.jwksKey(ctx, "known")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("known key lookup failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("known key lookup blocked behind the JWKS fetch")
+	}
+}
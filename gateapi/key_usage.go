@@ -0,0 +1,134 @@
+package gateapi
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/apierror"
+	"github.com/tracoco/DifyGate/config"
+	"github.com/tracoco/DifyGate/store"
+)
+
+// keyUsageResolution is how often a key's last-used time is written to the
+// store, so busy keys don't cost a store write on every request
+const keyUsageResolution = time.Minute
+
+// jwtUsageRetention is how long a JWT caller's last use is kept; unlike
+// keys they aren't configured, so one not seen for this long is dropped
+const jwtUsageRetention = 30 * 24 * time.Hour
+
+// KeyUsage records when each API key was last used. Timestamps live in the
+// shared store, so they cover every instance when the store does.
+type KeyUsage struct {
+	store store.Store
+	log   *logrus.Logger
+
+	mu      sync.Mutex
+	written map[string]time.Time
+}
+
+// NewKeyUsage creates a new key usage tracker
+func NewKeyUsage(kv store.Store, log *logrus.Logger) *KeyUsage {
+	return &KeyUsage{
+		store:   kv,
+		log:     log,
+		written: make(map[string]time.Time),
+	}
+}
+
+func keyUsageStoreKey(name string) string {
+	return "auth:last_used:" + name
+}
+
+// Record notes that the named key, or the JWT caller "jwt:<identity>", was
+// just used
+func (u *KeyUsage) Record(name string) {
+	now := time.Now()
+
+	u.mu.Lock()
+	if now.Sub(u.written[name]) < keyUsageResolution {
+		u.mu.Unlock()
+		return
+	}
+	u.written[name] = now
+	u.mu.Unlock()
+
+	var ttl time.Duration
+	if strings.HasPrefix(name, "jwt:") {
+		ttl = jwtUsageRetention
+	}
+	if err := u.store.Set(keyUsageStoreKey(name), []byte(strconv.FormatInt(now.Unix(), 10)), ttl); err != nil {
+		u.log.WithError(err).WithField("key_name", name).Error("Failed to record API key usage")
+	}
+}
+
+// LastUsed returns when the named key was last used, or the zero time
+func (u *KeyUsage) LastUsed(name string) (time.Time, error) {
+	b, err := u.store.Get(keyUsageStoreKey(name))
+	if err == store.ErrNotFound {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	sec, err := strconv.ParseInt(string(b), 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(sec, 0), nil
+}
+
+// KeyUsageEntry is one key in the usage report
+type KeyUsageEntry struct {
+	Name       string  `json:"name"`
+	Deprecated bool    `json:"deprecated"`
+	LastUsed   *string `json:"last_used"`
+}
+
+// UsageHandler reports the last-used time of every configured key, so it's
+// clear when a rotated-out key can be dropped, and of the JWT callers seen
+// in the last 30 days
+func (u *KeyUsage) UsageHandler(cfg config.AuthConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var keys []KeyUsageEntry
+		for _, k := range cfg.EffectiveKeys() {
+			keys = append(keys, KeyUsageEntry{Name: k.Name, Deprecated: k.Deprecated})
+		}
+		callers, err := u.store.Keys(keyUsageStoreKey("jwt:*"))
+		if err != nil {
+			requestLogger(c, u.log).WithError(err).Error("Failed to list JWT callers")
+			apierror.Respond(c, http.StatusInternalServerError, apierror.Internal, "Failed to read API key usage")
+			return
+		}
+		sort.Strings(callers)
+		for _, key := range callers {
+			keys = append(keys, KeyUsageEntry{Name: strings.TrimPrefix(key, keyUsageStoreKey(""))})
+		}
+
+		entries := make([]KeyUsageEntry, 0, len(keys))
+		for _, entry := range keys {
+			lastUsed, err := u.LastUsed(entry.Name)
+			if err != nil {
+				requestLogger(c, u.log).WithError(err).Error("Failed to read API key usage")
+				apierror.Respond(c, http.StatusInternalServerError, apierror.Internal, "Failed to read API key usage")
+				return
+			}
+			if !lastUsed.IsZero() {
+				ts := lastUsed.UTC().Format(time.RFC3339)
+				entry.LastUsed = &ts
+			}
+			entries = append(entries, entry)
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"keys":       entries,
+			"resolution": keyUsageResolution.String(),
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package gateapi
+
+import (
+	"strings"
+	"unicode"
+)
+
+// minDetectLetters is the fewest letters a message needs for its language
+// to be detected; shorter ones ("ok", "danke!") are too easy to misjudge
+const minDetectLetters = 20
+
+// minTrigramHits is the fewest profile trigrams the best guess must match
+const minTrigramHits = 4
+
+// trigramProfiles are the most common trigrams of the Latin-script
+// languages told apart, in order of frequency; a space marks a word edge
+var trigramProfiles = map[string][]string{
+	"en": {" th", "the", "he ", "and", " an", "nd ", " to", "ing", "ng ", " of", "of ", " yo", "you", "ou ", "is ", " is", "hat", "tha", "at ", " in", " wh", "for", " fo", "or ", "ed ", " be", "ion", "wha", "ow ", "can", "ve ", "ave", "hav", " ha", " my", "my ", "it ", " it", "her", "ere", "thi", "his", "are", "was", "not", " no", "ot ", "me ", "ll ", "all", "ter", " ca", " ho", "how", "ly ", "ill", "wil", " we", "we ", "ast", "uld", "oul", "hen", "ght", "igh", "ay ", "ey ", "th ", "ith", "wit"},
+	"de": {"en ", "er ", " de", "der", "ie ", "ich", "ch ", "die", " di", "ein", " ei", "und", " un", "nd ", "sch", "che", "ine", " ge", "gen", " ic", "cht", "ist", " da", "das", "den", "nic", " ni", "ben", " wi", "ber", "ier", "ste", "auf", " au", "mit", " mi", "sie", " si", "ter", "ung", "ng ", "wie", "ann", "kan", " ka", "mei", " me", "ht ", "ese", "abe", "hab", " ha", "zu ", " zu"},
+	"fr": {" de", "es ", "de ", "le ", " le", "ent", "nt ", " la", "la ", "ion", "les", " et", "et ", "que", " qu", "ue ", "ous", " vo", "vou", " pa", "our", "ai ", "est", " es", "eur", " co", "ne ", "pas", " je", "je ", "ant", "men", " ce", "ce ", " mo", "mon", "ons", "ell", "tre", "ur ", "re ", " un", "une", "ais", "e l", "dan", " da", "ans", "com", "omm", "mme", "eux", "peu", "pou", " po"},
+	"es": {" de", "de ", "os ", "la ", " la", "el ", " el", "es ", " qu", "que", "ue ", "en ", " en", "as ", "ent", "del", " co", "los", " lo", "ar ", "ado", "do ", " se", "con", "por", " po", "est", "ien", "ión", " es", "ion", "ció", " mi", "mi ", "ara", " pa", "par", "ra ", "pue", "ued", "ede", "ida", "nta", "ta ", "to ", "una", " un", "ero", "ame", "cuá", " có", "cóm", "ómo", "mo ", "fav", "avo", "vor", "or "},
+	"it": {" di", "di ", "la ", " la", "to ", "che", " ch", "he ", "il ", " il", "ne ", "per", " pe", "ell", " de", "del", "lla", "ion", "one", "no ", "non", " no", "son", " co", "con", "zio", "ent", "ato", "sta", " un", "are", "re ", "mio", " mi", "io ", "sso", "oss", "ore", "ere", "gli", " gl", "ano", "tti", "ett", "tto", "ia ", "e d", "ome", "com", " po", "pos", "le ", "ché", "voi", "sia", "ggi", "fav", "avo", "vor", "ri "},
+	"pt": {" de", "de ", "os ", "da ", " da", "do ", " do", "ão ", "que", " qu", "ue ", " co", "com", "ent", "as ", " pa", "par", "ra ", "ção", "não", " nã", "em ", " em", "um ", " um", "ado", "est", "ara", "nte", "voc", "ocê", "cê ", "meu", " me", "eu ", "ca ", "nha", "inh", "min", " mi", "or ", "fav", "avo", "vor", "obr", "bri", " ob", "ida", "ar ", "sso", "pos", "oss", "ter", "tem", "uma", "ma ", " se", "se "},
+	"nl": {"en ", " de", "de ", "het", " he", "et ", "an ", "van", " va", " ee", "een", "ijk", " ij", "ik ", "aar", " is", "is ", "oor", "ver", " ve", "cht", "nie", " ni", "iet", "jn ", "zij", " zi", "gen", " te", "wat", "ach", "wij", " wi", "mij", " mi", "ijn", "kan", " ka", "oe ", "hoe", " ho", "ord", "erd", "ren", "nde", "lij", "ook", " oo", "dat", " da", "at ", "er ", "ee ", "te ", "ten", "sch", "ch ", "ens", "ste"},
+}
+
+// callingCodeLanguages maps country calling codes to the language most of
+// their numbers speak, as a hint when a message can't be detected
+var callingCodeLanguages = map[string]string{
+	"1": "en", "44": "en", "61": "en", "64": "en", "353": "en",
+	"49": "de", "43": "de",
+	"33": "fr",
+	"34": "es", "52": "es", "54": "es", "56": "es", "57": "es", "51": "es",
+	"39":  "it",
+	"351": "pt", "55": "pt",
+	"31": "nl",
+	"7":  "ru",
+	"81": "ja",
+	"82": "ko",
+	"86": "zh",
+}
+
+// detectLanguage guesses the language of text, returning "" when the text
+// is too short or too ambiguous to tell
+func detectLanguage(text string) string {
+	letters := 0
+	for _, r := range text {
+		if unicode.IsLetter(r) {
+			letters++
+		}
+	}
+	if letters < minDetectLetters {
+		return ""
+	}
+	if lang := scriptLanguage(text); lang != "" {
+		return lang
+	}
+	return trigramLanguage(text)
+}
+
+// scriptLanguage picks the language of text from its writing system, for
+// the scripts that have one; Latin script returns ""
+func scriptLanguage(text string) string {
+	best, bestCount := "", 0
+	for lang, n := range scriptCounts(text) {
+		if n > bestCount {
+			best, bestCount = lang, n
+		}
+	}
+	return best
+}
+
+// scriptCounts counts the letters of text in each of scriptLocales
+func scriptCounts(text string) map[string]int {
+	counts := make(map[string]int)
+	for _, r := range text {
+		for _, sl := range scriptLocales {
+			if unicode.Is(sl.script, r) {
+				counts[sl.locale]++
+				break
+			}
+		}
+	}
+	// Kana marks Japanese even when Han characters outnumber it
+	if counts["ja"] > 0 {
+		counts["ja"] += counts["zh"]
+		delete(counts, "zh")
+	}
+	return counts
+}
+
+// trigramLanguage scores text against the trigram profiles, weighting the
+// more common trigrams higher; a tie or too few hits returns ""
+func trigramLanguage(text string) string {
+	var b strings.Builder
+	b.WriteByte(' ')
+	for _, r := range strings.ToLower(text) {
+		if unicode.IsLetter(r) {
+			b.WriteRune(r)
+		} else {
+			b.WriteByte(' ')
+		}
+	}
+	b.WriteByte(' ')
+	runes := []rune(b.String())
+
+	scores := make(map[string]int)
+	hits := make(map[string]int)
+	for i := 0; i+3 <= len(runes); i++ {
+		tri := string(runes[i : i+3])
+		if runes[i] == ' ' && runes[i+2] == ' ' {
+			continue
+		}
+		for lang, profile := range trigramProfiles {
+			for rank, p := range profile {
+				if p == tri {
+					scores[lang] += 1 + (len(profile)-rank)/20
+					hits[lang]++
+					break
+				}
+			}
+		}
+	}
+
+	best, bestScore, tie := "", 0, false
+	for lang, score := range scores {
+		switch {
+		case score > bestScore:
+			best, bestScore, tie = lang, score, false
+		case score == bestScore:
+			tie = true
+		}
+	}
+	if tie || hits[best] < minTrigramHits {
+		return ""
+	}
+	return best
+}
+
+// numberLanguage returns the language hinted by the calling code of an
+// international phone number, e.g. 4915123456789 gives de
+func numberLanguage(number string) string {
+	number = strings.TrimPrefix(number, "+")
+	for n := 3; n >= 1; n-- {
+		if len(number) > n {
+			if lang, ok := callingCodeLanguages[number[:n]]; ok {
+				return lang
+			}
+		}
+	}
+	return ""
+}
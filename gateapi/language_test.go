@@ -0,0 +1,40 @@
+package gateapi
+
+import "testing"
+
+func TestDetectLanguage(t *testing.T) {
+	tests := []struct {
+		text, want string
+	}{
+		{"Wie kann ich mein Passwort zurücksetzen, ich habe es vergessen?", "de"},
+		{"How can I reset my password, I have forgotten it?", "en"},
+		{"Comment est-ce que je peux changer le mot de passe de mon compte?", "fr"},
+		{"¿Cómo puedo cambiar la contraseña de mi cuenta, por favor?", "es"},
+		{"Come posso cambiare la password del mio account, per favore?", "it"},
+		{"Hoe kan ik het wachtwoord van mijn account veranderen?", "nl"},
+		{"Как мне изменить пароль от моей учётной записи?", "ru"},
+		// Too short to tell
+		{"Danke!", ""},
+		{"ok", ""},
+	}
+	for _, tt := range tests {
+		if got := detectLanguage(tt.text); got != tt.want {
+			t.Errorf("detectLanguage(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestNumberLanguage(t *testing.T) {
+	tests := map[string]string{
+		"4915123456789":  "de",
+		"+14155550100":   "en",
+		"351912345678":   "pt",
+		"35312345678":    "en",
+		"97150123456789": "",
+	}
+	for number, want := range tests {
+		if got := numberLanguage(number); got != want {
+			t.Errorf("numberLanguage(%q) = %q, want %q", number, got, want)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package gateapi
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/tracoco/DifyGate/config"
+)
+
+// ErrDropMessage is returned by a hook to drop the message or reply; the
+// pipeline logs it and sends nothing further
+var ErrDropMessage = errors.New("dropped by message hook")
+
+// Reply is a message about to be sent to a user
+type Reply struct {
+	// Message is the user's message being replied to
+	Message ChannelMessage
+	Text    string
+	// Answer is set for Dify's answer, not for gateway messages such as
+	// errors and command replies
+	Answer bool
+	// First and Last mark the ends of an answer sent in several parts; a
+	// single reply is both
+	First, Last bool
+}
+
+// InboundHook may rewrite or drop a message before it reaches Dify
+type InboundHook func(ctx context.Context, msg *ChannelMessage) error
+
+// OutboundHook may rewrite or drop a reply before it is sent
+type OutboundHook func(ctx context.Context, reply *Reply) error
+
+// MessageHooks runs hooks in the order they were added, the built-ins
+// first; the first error stops the rest. Add hooks before serving requests.
+type MessageHooks struct {
+	inbound  []InboundHook
+	outbound []OutboundHook
+}
+
+// NewMessageHooks creates the hooks enabled in configuration
+func NewMessageHooks(cfg config.MessageHooksConfig) *MessageHooks {
+	h := &MessageHooks{}
+	if len(cfg.StripPatterns) > 0 {
+		h.AddInbound(stripHook(cfg.StripPatterns))
+	}
+	if len(cfg.ProfanityWords) > 0 {
+		mask := profanityMasker(cfg.ProfanityWords)
+		h.AddInbound(func(ctx context.Context, msg *ChannelMessage) error {
+			msg.Text = mask(msg.Text)
+			return nil
+		})
+		h.AddOutbound(func(ctx context.Context, reply *Reply) error {
+			reply.Text = mask(reply.Text)
+			return nil
+		})
+	}
+	if cfg.ReplyPrefix != "" || cfg.ReplySuffix != "" {
+		h.AddOutbound(affixHook(cfg.ReplyPrefix, cfg.ReplySuffix))
+	}
+	return h
+}
+
+// AddInbound appends a hook run on every inbound message
+func (h *MessageHooks) AddInbound(hook InboundHook) {
+	h.inbound = append(h.inbound, hook)
+}
+
+// AddOutbound appends a hook run on every reply
+func (h *MessageHooks) AddOutbound(hook OutboundHook) {
+	h.outbound = append(h.outbound, hook)
+}
+
+// runInbound runs the inbound hooks on msg until one fails
+func (h *MessageHooks) runInbound(ctx context.Context, msg *ChannelMessage) error {
+	for _, hook := range h.inbound {
+		if err := hook(ctx, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runOutbound runs the outbound hooks on reply until one fails
+func (h *MessageHooks) runOutbound(ctx context.Context, reply *Reply) error {
+	for _, hook := range h.outbound {
+		if err := hook(ctx, reply); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stripHook removes the patterns from messages, dropping those left empty;
+// Validate has already checked the patterns compile
+func stripHook(patterns []string) InboundHook {
+	res := make([]*regexp.Regexp, len(patterns))
+	for i, pattern := range patterns {
+		res[i] = regexp.MustCompile(pattern)
+	}
+	return func(ctx context.Context, msg *ChannelMessage) error {
+		for _, re := range res {
+			msg.Text = re.ReplaceAllString(msg.Text, "")
+		}
+		msg.Text = strings.TrimSpace(msg.Text)
+		if msg.Text == "" && len(msg.Attachments) == 0 {
+			return ErrDropMessage
+		}
+		return nil
+	}
+}
+
+// profanityMasker returns a function replacing the whole words, in any
+// case, with as many asterisks
+func profanityMasker(words []string) func(string) string {
+	quoted := make([]string, len(words))
+	for i, word := range words {
+		quoted[i] = regexp.QuoteMeta(word)
+	}
+	re := regexp.MustCompile(`(?i)\b(?:` + strings.Join(quoted, "|") + `)\b`)
+	return func(s string) string {
+		return re.ReplaceAllStringFunc(s, func(word string) string {
+			return strings.Repeat("*", utf8.RuneCountInString(word))
+		})
+	}
+}
+
+// affixHook adds prefix to the first part of each answer and suffix to the
+// last; \n in either stands for a newline, since env vars can't easily
+// hold one
+func affixHook(prefix, suffix string) OutboundHook {
+	prefix = strings.ReplaceAll(prefix, `\n`, "\n")
+	suffix = strings.ReplaceAll(suffix, `\n`, "\n")
+	return func(ctx context.Context, reply *Reply) error {
+		if !reply.Answer {
+			return nil
+		}
+		if reply.First {
+			reply.Text = prefix + reply.Text
+		}
+		if reply.Last {
+			reply.Text += suffix
+		}
+		return nil
+	}
+}
@@ -0,0 +1,123 @@
+package gateapi
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/tracoco/DifyGate/config"
+)
+
+func TestMessageHooksRunInOrder(t *testing.T) {
+	h := NewMessageHooks(config.MessageHooksConfig{StripPatterns: []string{`(?m)^--.*$`}})
+	var order []string
+	h.AddInbound(func(ctx context.Context, msg *ChannelMessage) error {
+		order = append(order, "first:"+msg.Text)
+		msg.Text += " one"
+		return nil
+	})
+	h.AddInbound(func(ctx context.Context, msg *ChannelMessage) error {
+		order = append(order, "second:"+msg.Text)
+		msg.Text += " two"
+		return nil
+	})
+
+	msg := ChannelMessage{Text: "hello\n-- sent from my phone"}
+	if err := h.runInbound(context.Background(), &msg); err != nil {
+		t.Fatal(err)
+	}
+	// The built-in strip runs before the hooks added in code
+	if want := []string{"first:hello", "second:hello one"}; strings.Join(order, "|") != strings.Join(want, "|") {
+		t.Errorf("hooks saw %q, want %q", order, want)
+	}
+	if msg.Text != "hello one two" {
+		t.Errorf("text = %q, want both hooks applied in order", msg.Text)
+	}
+}
+
+func TestMessageHooksStopAtFirstError(t *testing.T) {
+	for _, stop := range []error{ErrDropMessage, errors.New("hook failed")} {
+		h := &MessageHooks{}
+		ran := 0
+		h.AddOutbound(func(ctx context.Context, reply *Reply) error {
+			ran++
+			return stop
+		})
+		h.AddOutbound(func(ctx context.Context, reply *Reply) error {
+			ran++
+			return nil
+		})
+
+		if err := h.runOutbound(context.Background(), &Reply{Text: "answer"}); !errors.Is(err, stop) {
+			t.Errorf("runOutbound() = %v, want %v", err, stop)
+		}
+		if ran != 1 {
+			t.Errorf("%d hooks ran after %v, want the rest skipped", ran, stop)
+		}
+	}
+}
+
+func TestBuiltinHooks(t *testing.T) {
+	h := NewMessageHooks(config.MessageHooksConfig{
+		StripPatterns:  []string{`https?://\S+`},
+		ReplyPrefix:    "[bot] ",
+		ReplySuffix:    `\n-- automated answer`,
+		ProfanityWords: []string{"darn"},
+	})
+
+	msg := ChannelMessage{Text: "Darn, see https://example.com/x"}
+	if err := h.runInbound(context.Background(), &msg); err != nil || msg.Text != "****, see" {
+		t.Errorf("inbound = %q, %v; want the link stripped and the word masked", msg.Text, err)
+	}
+	if err := h.runInbound(context.Background(), &ChannelMessage{Text: "https://example.com"}); !errors.Is(err, ErrDropMessage) {
+		t.Errorf("a message left empty by stripping gave %v, want ErrDropMessage", err)
+	}
+
+	tests := []struct {
+		reply Reply
+		want  string
+	}{
+		{Reply{Text: "darn right", Answer: true, First: true, Last: true}, "[bot] **** right\n-- automated answer"},
+		{Reply{Text: "middle", Answer: true}, "middle"},
+		{Reply{Text: "end", Answer: true, Last: true}, "end\n-- automated answer"},
+		{Reply{Text: "Sorry, try again", First: true, Last: true}, "Sorry, try again"},
+	}
+	for _, tt := range tests {
+		reply := tt.reply
+		if err := h.runOutbound(context.Background(), &reply); err != nil || reply.Text != tt.want {
+			t.Errorf("outbound %+v = %q, %v; want %q", tt.reply, reply.Text, err, tt.want)
+		}
+	}
+}
+
+func TestPipelineDroppedByHook(t *testing.T) {
+	p, sender, dify, _ := newTestPipeline(t, PipelineOptions{Channel: "test"}, config.ChatConfig{}, func(req ChatMessageRequest) []StreamingChatResponse {
+		return difyAnswer("conv-1", "answer")
+	})
+	p.hooks.AddInbound(func(ctx context.Context, msg *ChannelMessage) error {
+		if msg.Text == "spam" {
+			return ErrDropMessage
+		}
+		return nil
+	})
+	p.hooks.AddOutbound(func(ctx context.Context, reply *Reply) error {
+		if reply.Answer {
+			return ErrDropMessage
+		}
+		return nil
+	})
+
+	p.Handle(testEntry(), ChannelMessage{ChannelID: "bot", UserID: "u1", Text: "spam"})
+	dify.mu.Lock()
+	asked := len(dify.requests)
+	dify.mu.Unlock()
+	if asked != 0 {
+		t.Errorf("a dropped message reached Dify")
+	}
+
+	p.Handle(testEntry(), ChannelMessage{ChannelID: "bot", UserID: "u1", Text: "hi"})
+	if got := sender.sent(); len(got) != 0 {
+		t.Errorf("sent %q, want the answer dropped", got)
+	}
+}
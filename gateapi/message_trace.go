@@ -0,0 +1,108 @@
+package gateapi
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Outcomes of handling a chat message, as logged in its summary line
+const (
+	outcomeAnswered = "answered"
+	outcomeFailed   = "failed"
+	outcomeTimeout  = "timeout"
+	outcomeBlocked  = "blocked"
+	outcomeDropped  = "dropped"
+	outcomeRejected = "rejected"
+	outcomeCommand  = "command"
+	outcomeBusy     = "busy"
+	// outcomeHandedOff is a message kept for a person, not answered
+	outcomeHandedOff = "handed_off"
+	// outcomeCanned is a message answered by a canned response, not Dify
+	outcomeCanned = "canned"
+	// outcomeCached is a message answered from the answer cache, not Dify
+	outcomeCached = "cached"
+	// outcomeMuted is a message dropped because its sender sends too much
+	outcomeMuted = "muted"
+	// outcomeOverBudget is a message not sent to Dify as its sender spent
+	// the daily budget
+	outcomeOverBudget = "over_budget"
+)
+
+// messageTrace correlates one inbound message with the Dify IDs it produced
+// and the IDs of the replies sent, so a single log query on the inbound
+// message ID finds the whole exchange
+type messageTrace struct {
+	// log carries every ID known so far; use it for all logs of the message
+	log     *logrus.Entry
+	start   time.Time
+	outcome string
+	sentIDs []string
+	usage   DifyUsage
+	// queued is set once a reply is queued for retry
+	queued bool
+	// difyStart is when Dify was asked, and difyLatency how long its
+	// answer took to finish
+	difyStart   time.Time
+	difyLatency time.Duration
+	// failure is the error code of a message answered with an error
+	// message: Dify's code when it gave one, else the message key
+	failure string
+
+	conversationID, messageID, taskID string
+}
+
+// newMessageTrace starts tracing a message logged with log
+func newMessageTrace(log *logrus.Entry) *messageTrace {
+	return &messageTrace{log: log, start: time.Now(), outcome: outcomeAnswered}
+}
+
+// setIDs adds the Dify IDs that are new to the log entry
+func (t *messageTrace) setIDs(conversationID, messageID, taskID string) {
+	fields := logrus.Fields{}
+	if conversationID != "" && conversationID != t.conversationID {
+		t.conversationID = conversationID
+		fields["dify_conversation_id"] = conversationID
+	}
+	if messageID != "" && messageID != t.messageID {
+		t.messageID = messageID
+		fields["dify_message_id"] = messageID
+	}
+	if taskID != "" && taskID != t.taskID {
+		t.taskID = taskID
+		fields["dify_task_id"] = taskID
+	}
+	if len(fields) > 0 {
+		t.log = t.log.WithFields(fields)
+	}
+}
+
+// observe records what a Dify stream event says about the message
+func (t *messageTrace) observe(resp StreamingChatResponse) {
+	t.setIDs(resp.ConversationID, resp.MessageID, resp.TaskID)
+	if resp.Event == "message_end" {
+		t.usage = resp.usage()
+		if !t.difyStart.IsZero() {
+			t.difyLatency = time.Since(t.difyStart)
+		}
+	}
+}
+
+// sent records the platform ID of a reply, when the channel reports one
+func (t *messageTrace) sent(id string) {
+	if id != "" {
+		t.sentIDs = append(t.sentIDs, id)
+	}
+}
+
+// summarize logs the one line that ties the exchange together
+func (t *messageTrace) summarize() {
+	t.log.WithFields(logrus.Fields{
+		"outcome":           t.outcome,
+		"duration":          time.Since(t.start),
+		"sent_message_ids":  t.sentIDs,
+		"prompt_tokens":     t.usage.PromptTokens,
+		"completion_tokens": t.usage.CompletionTokens,
+		"total_tokens":      t.usage.TotalTokens,
+	}).Info("Message handled")
+}
@@ -0,0 +1,169 @@
+package gateapi
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"unicode"
+
+	"github.com/tracoco/DifyGate/config"
+)
+
+// scriptLocales maps writing systems to the locale assumed for them when
+// detecting the user's language; Latin script is too ambiguous to guess
+var scriptLocales = []struct {
+	script *unicode.RangeTable
+	locale string
+}{
+	{unicode.Hiragana, "ja"},
+	{unicode.Katakana, "ja"},
+	{unicode.Hangul, "ko"},
+	{unicode.Han, "zh"},
+	{unicode.Cyrillic, "ru"},
+	{unicode.Arabic, "ar"},
+	{unicode.Hebrew, "he"},
+	{unicode.Greek, "el"},
+	{unicode.Thai, "th"},
+	{unicode.Devanagari, "hi"},
+}
+
+// Messages is the catalog of user-facing text. A reloaded configuration
+// replaces the whole catalog at once.
+type Messages struct {
+	catalog atomic.Pointer[messageCatalog]
+}
+
+// messageCatalog is one configuration's messages
+type messageCatalog struct {
+	defaultLocale string
+	detect        bool
+	texts         map[string]map[string]string
+}
+
+// NewMessages creates the catalog from configuration
+func NewMessages(cfg config.MessagesConfig) *Messages {
+	m := &Messages{}
+	m.reload(cfg)
+	return m
+}
+
+// reload replaces the catalog with the one configured in cfg
+func (m *Messages) reload(cfg config.MessagesConfig) {
+	texts := make(map[string]map[string]string, len(cfg.Catalog))
+	for locale, t := range cfg.Catalog {
+		texts[strings.ToLower(locale)] = t
+	}
+	m.catalog.Store(&messageCatalog{
+		defaultLocale: strings.ToLower(cfg.DefaultLocale),
+		detect:        cfg.DetectLanguage,
+		texts:         texts,
+	})
+}
+
+// Locale picks the locale to answer text in
+func (m *Messages) Locale(text string) string {
+	c := m.catalog.Load()
+	if !c.detect {
+		return c.defaultLocale
+	}
+	best, bestCount := "", 0
+	for locale, n := range scriptCounts(text) {
+		if n > bestCount && c.has(locale) {
+			best, bestCount = locale, n
+		}
+	}
+	// Latin-script languages need a longer message to be told apart
+	if best == "" {
+		if lang := detectLanguage(text); c.has(lang) {
+			best = lang
+		}
+	}
+	if best == "" {
+		return c.defaultLocale
+	}
+	return best
+}
+
+// Match picks the locale for a language tag a platform reports, e.g. pt-BR
+func (m *Messages) Match(tag string) string {
+	c := m.catalog.Load()
+	tag = strings.ToLower(strings.ReplaceAll(tag, "_", "-"))
+	if c.has(tag) {
+		return tag
+	}
+	if lang, _, ok := strings.Cut(tag, "-"); ok && c.has(lang) {
+		return lang
+	}
+	return c.defaultLocale
+}
+
+// Has reports whether messages are translated for a language tag, or its
+// language without the region
+func (m *Messages) Has(tag string) bool {
+	c := m.catalog.Load()
+	tag = strings.ToLower(strings.ReplaceAll(tag, "_", "-"))
+	lang, _, _ := strings.Cut(tag, "-")
+	return c.has(tag) || c.has(lang)
+}
+
+// Get returns the message for key in locale, falling back to the default
+// locale and then the built-in English
+func (m *Messages) Get(locale, key string) string {
+	c := m.catalog.Load()
+	for _, l := range []string{locale, c.defaultLocale} {
+		if text, ok := c.texts[l][key]; ok {
+			return text
+		}
+	}
+	return config.DefaultMessages[key]
+}
+
+// Error returns the message for key quoting ref, the reference users can
+// give support to find the logged error
+func (m *Messages) Error(locale, key, ref string) string {
+	return strings.ReplaceAll(m.Get(locale, key), "{ref}", ref)
+}
+
+// QueryTooLong returns the reply to a message over the max characters limit
+func (m *Messages) QueryTooLong(locale string, max int) string {
+	return strings.ReplaceAll(m.Get(locale, config.MsgQueryTooLong), "{max}", strconv.Itoa(max))
+}
+
+// has reports whether any message is configured for locale
+func (c *messageCatalog) has(locale string) bool {
+	if locale == config.DefaultLocale {
+		return true
+	}
+	_, ok := c.texts[locale]
+	return ok
+}
+
+// errorMessageKey picks the message for a failed Dify call
+func errorMessageKey(err error) string {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return config.MsgTimeout
+	}
+	apiErr, ok := asDifyAPIError(err)
+	switch {
+	case !ok:
+		return config.MsgError
+	case apiErr.Overloaded():
+		return config.MsgHighDemand
+	case apiErr.Blocked():
+		return config.MsgContentBlocked
+	case apiErr.Unavailable():
+		return config.MsgUnavailable
+	}
+	return config.MsgError
+}
+
+// newErrorRef returns a short random reference for an error shown to a user
+func newErrorRef() string {
+	b := make([]byte, 4)
+	_, _ = rand.Read(b)
+	return strings.ToUpper(hex.EncodeToString(b))
+}
@@ -0,0 +1,105 @@
+package gateapi
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/tracoco/DifyGate/config"
+)
+
+func testMessages(detect bool) *Messages {
+	return NewMessages(config.MessagesConfig{
+		DefaultLocale:  "de",
+		DetectLanguage: detect,
+		Catalog: map[string]map[string]string{
+			"de":    {config.MsgError: "Fehler (Referenz: {ref})", config.MsgQueryTooLong: "Höchstens {max} Zeichen."},
+			"RU":    {config.MsgError: "Ошибка ({ref})"},
+			"pt-br": {config.MsgError: "Erro ({ref})"},
+		},
+	})
+}
+
+func TestMessagesGet(t *testing.T) {
+	m := testMessages(false)
+
+	tests := []struct {
+		locale, key, want string
+	}{
+		{"ru", config.MsgError, "Ошибка ({ref})"},
+		// A key the locale lacks comes from the default locale, then English
+		{"ru", config.MsgQueryTooLong, "Höchstens {max} Zeichen."},
+		{"ru", config.MsgTimeout, config.DefaultMessages[config.MsgTimeout]},
+		{"fr", config.MsgError, "Fehler (Referenz: {ref})"},
+	}
+	for _, tt := range tests {
+		if got := m.Get(tt.locale, tt.key); got != tt.want {
+			t.Errorf("Get(%q, %q) = %q, want %q", tt.locale, tt.key, got, tt.want)
+		}
+	}
+
+	if got := m.Error("de", config.MsgError, "AB12CD34"); got != "Fehler (Referenz: AB12CD34)" {
+		t.Errorf("Error = %q", got)
+	}
+	if got := m.QueryTooLong("de", 500); got != "Höchstens 500 Zeichen." {
+		t.Errorf("QueryTooLong = %q", got)
+	}
+}
+
+func TestMessagesMatch(t *testing.T) {
+	m := testMessages(false)
+
+	tests := []struct {
+		tag, want string
+	}{
+		{"pt-BR", "pt-br"},
+		{"pt_BR", "pt-br"},
+		{"ru-RU", "ru"},
+		{"en-US", "en"},
+		{"fr-FR", "de"},
+		{"", "de"},
+	}
+	for _, tt := range tests {
+		if got := m.Match(tt.tag); got != tt.want {
+			t.Errorf("Match(%q) = %q, want %q", tt.tag, got, tt.want)
+		}
+	}
+	if !m.Has("ru-UA") || m.Has("fr") {
+		t.Error("Has doesn't match the configured languages")
+	}
+}
+
+func TestMessagesLocale(t *testing.T) {
+	if got := testMessages(false).Locale("Привет, когда вы открыты?"); got != "de" {
+		t.Errorf("Locale without detection = %q, want the default", got)
+	}
+
+	m := testMessages(true)
+	tests := []struct {
+		text, want string
+	}{
+		{"Привет, когда вы открыты?", "ru"},
+		// Japanese has no translation
+		{"営業時間を教えてください", "de"},
+		{"ok", "de"},
+	}
+	for _, tt := range tests {
+		if got := m.Locale(tt.text); got != tt.want {
+			t.Errorf("Locale(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestMessagesReload(t *testing.T) {
+	m := testMessages(false)
+	m.reload(config.MessagesConfig{DefaultLocale: config.DefaultLocale})
+
+	if got := m.Get("de", config.MsgError); got != config.DefaultMessages[config.MsgError] {
+		t.Errorf("Get after reload = %q, want the built-in message", got)
+	}
+}
+
+func TestNewErrorRef(t *testing.T) {
+	if ref := newErrorRef(); len(ref) != 8 || strings.ToUpper(ref) != ref {
+		t.Errorf("error reference %q, want 8 upper-case hex digits", ref)
+	}
+}
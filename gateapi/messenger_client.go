@@ -0,0 +1,100 @@
+package gateapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/tracoco/DifyGate/config"
+)
+
+// messengerMaxTextLength is the Send API's limit on message text
+const messengerMaxTextLength = 2000
+
+// MessengerClient calls the Messenger Send API with a page access token
+type MessengerClient struct {
+	pageAccessToken string
+	baseURL         string
+	apiVersion      string
+	client          *http.Client
+}
+
+// NewMessengerClient creates a new Messenger Send API client, sharing the
+// Graph API host, version and HTTP client with WhatsApp
+func NewMessengerClient(cfg config.MessengerConfig, waCfg config.WhatsAppConfig, httpClient *http.Client) *MessengerClient {
+	return &MessengerClient{
+		pageAccessToken: cfg.PageAccessToken,
+		baseURL:         strings.TrimSuffix(waCfg.GraphAPIBaseURL, "/"),
+		apiVersion:      waCfg.APIVersion,
+		client:          httpClient,
+	}
+}
+
+// SendText replies to a user, split into as many messages as needed
+func (mc *MessengerClient) SendText(ctx context.Context, psid, text string) error {
+	for _, chunk := range splitMessage(text, messengerMaxTextLength) {
+		err := mc.send(ctx, map[string]interface{}{
+			"recipient":      map[string]string{"id": psid},
+			"messaging_type": "RESPONSE",
+			"message":        map[string]string{"text": chunk},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SendAttachment sends an image, audio, video or file by URL
+func (mc *MessengerClient) SendAttachment(ctx context.Context, psid, attachmentType, url string) error {
+	return mc.send(ctx, map[string]interface{}{
+		"recipient":      map[string]string{"id": psid},
+		"messaging_type": "RESPONSE",
+		"message": map[string]interface{}{
+			"attachment": map[string]interface{}{
+				"type":    attachmentType,
+				"payload": map[string]interface{}{"url": url, "is_reusable": false},
+			},
+		},
+	})
+}
+
+// SendAction shows a sender action such as typing_on or mark_seen
+func (mc *MessengerClient) SendAction(ctx context.Context, psid, action string) error {
+	return mc.send(ctx, map[string]interface{}{
+		"recipient":     map[string]string{"id": psid},
+		"sender_action": action,
+	})
+}
+
+// send posts one payload to /me/messages
+func (mc *MessengerClient) send(ctx context.Context, payload map[string]interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal Messenger payload: %w", err)
+	}
+
+	url := fmt.Sprintf("%s/%s/me/messages", mc.baseURL, mc.apiVersion)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create Messenger request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+mc.pageAccessToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := mc.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send Messenger request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("Send API returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+	return nil
+}
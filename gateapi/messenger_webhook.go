@@ -0,0 +1,148 @@
+package gateapi
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/apierror"
+	"github.com/tracoco/DifyGate/config"
+	"github.com/tracoco/DifyGate/events"
+	"github.com/tracoco/DifyGate/store"
+)
+
+// MessengerWebhookRequest represents an incoming Messenger Platform webhook
+type MessengerWebhookRequest struct {
+	Object string `json:"object"`
+	Entry  []struct {
+		ID        string           `json:"id"`
+		Messaging []MessengerEvent `json:"messaging"`
+	} `json:"entry"`
+}
+
+// MessengerEvent is one messaging event sent to the page
+type MessengerEvent struct {
+	Sender struct {
+		ID string `json:"id"`
+	} `json:"sender"`
+	Recipient struct {
+		ID string `json:"id"`
+	} `json:"recipient"`
+	Message *struct {
+		MID    string `json:"mid"`
+		Text   string `json:"text"`
+		IsEcho bool   `json:"is_echo"`
+	} `json:"message,omitempty"`
+}
+
+// MessengerHandler answers Facebook page messages with Dify
+type MessengerHandler struct {
+	log             *logrus.Logger
+	signatures      *metaSignatures
+	verifyToken     string
+	pageAccessToken string
+	pipeline        *MessagePipeline
+}
+
+// NewMessengerHandler creates a new Messenger webhook handler
+func NewMessengerHandler(cfg config.MessengerConfig, waCfg config.WhatsAppConfig, chatCfg config.ChatConfig, difyCfg config.DifyConfig, clients *HTTPClients, difyHandler *DifyHandler, messages *Messages, kv store.Store, dispatcher *events.Dispatcher, log *logrus.Logger) *MessengerHandler {
+	h := &MessengerHandler{
+		log:             log,
+		signatures:      newMetaSignatures("messenger", waCfg, log),
+		verifyToken:     waCfg.VerifyToken,
+		pageAccessToken: cfg.PageAccessToken,
+		pipeline: NewMessagePipeline(PipelineOptions{
+			Channel:          "messenger",
+			MaxMessageLength: messengerMaxTextLength,
+			ConversationTTL:  cfg.ConversationTTL,
+			// PSIDs are unique to the page, so conversations are keyed by
+			// them alone, as they have been since Messenger was added
+			ConversationKey: func(msg ChannelMessage) string { return "messenger:conversation:" + msg.UserID },
+		}, &messengerSender{client: NewMessengerClient(cfg, waCfg, clients.Meta)}, chatCfg, messages, difyCfg, difyHandler, kv, dispatcher),
+	}
+	h.pipeline.resume(log)
+	return h
+}
+
+// Hooks returns the message hooks of the Messenger pipeline, for adding
+// custom ones
+func (h *MessengerHandler) Hooks() *MessageHooks {
+	return h.pipeline.hooks
+}
+
+// messengerSender replies to the page-scoped ID of the sender
+type messengerSender struct {
+	client *MessengerClient
+}
+
+// SendText sends a text reply
+func (s *messengerSender) SendText(ctx context.Context, msg ChannelMessage, text string) (string, error) {
+	return "", s.client.SendText(ctx, msg.UserID, text)
+}
+
+// SendTyping shows the typing indicator, which clears when the reply arrives
+func (s *messengerSender) SendTyping(ctx context.Context, msg ChannelMessage) error {
+	return s.client.SendAction(ctx, msg.UserID, "typing_on")
+}
+
+// SendMedia sends a file as an attachment
+func (s *messengerSender) SendMedia(ctx context.Context, msg ChannelMessage, media ChannelAttachment) error {
+	attachmentType := media.Type
+	if attachmentType == "document" || attachmentType == "" {
+		attachmentType = "file"
+	}
+	return s.client.SendAttachment(ctx, msg.UserID, attachmentType, media.URL)
+}
+
+// HandleMessengerWebhookGet handles Meta's subscription verification
+func (h *MessengerHandler) HandleMessengerWebhookGet(c *gin.Context) {
+	verifyMetaSubscription(c, h.verifyToken, h.log)
+}
+
+// HandleMessengerWebhookPost handles page messaging events
+func (h *MessengerHandler) HandleMessengerWebhookPost(c *gin.Context) {
+	reqLog := requestLogger(c, h.log)
+
+	if h.pageAccessToken == "" {
+		apierror.Respond(c, http.StatusServiceUnavailable, apierror.NotConfigured, "Messenger integration is not configured")
+		return
+	}
+
+	body, ok := h.signatures.read(c, reqLog)
+	if !ok {
+		return
+	}
+
+	var webhookRequest MessengerWebhookRequest
+	if err := json.Unmarshal(body, &webhookRequest); err != nil {
+		apierror.Respond(c, http.StatusBadRequest, apierror.InvalidBody, "Failed to parse request body")
+		return
+	}
+
+	if webhookRequest.Object != "page" {
+		reqLog.WithField("object", webhookRequest.Object).Debug("Ignoring non-page webhook")
+		c.Status(http.StatusOK)
+		return
+	}
+
+	// Meta may batch several events into one delivery
+	for _, entry := range webhookRequest.Entry {
+		for _, event := range entry.Messaging {
+			// Skip echoes of our own replies, and non-text messages
+			if event.Message == nil || event.Message.IsEcho || event.Message.Text == "" {
+				continue
+			}
+			h.pipeline.Accept(reqLog, ChannelMessage{
+				ChannelID: entry.ID,
+				UserID:    event.Sender.ID,
+				Text:      event.Message.Text,
+				ReplyTo:   event.Message.MID,
+			})
+		}
+	}
+
+	// Return 200 OK (must respond quickly to webhook)
+	c.Status(http.StatusOK)
+}
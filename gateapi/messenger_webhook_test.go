@@ -0,0 +1,241 @@
+package gateapi
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tracoco/DifyGate/config"
+	"github.com/tracoco/DifyGate/store"
+)
+
+// messengerCall is a Send API request the fake Graph API received
+type messengerCall struct {
+	Path          string
+	Authorization string
+	Recipient     struct {
+		ID string `json:"id"`
+	} `json:"recipient"`
+	MessagingType string `json:"messaging_type"`
+	SenderAction  string `json:"sender_action"`
+	Message       struct {
+		Text       string `json:"text"`
+		Attachment struct {
+			Type    string `json:"type"`
+			Payload struct {
+				URL string `json:"url"`
+			} `json:"payload"`
+		} `json:"attachment"`
+	} `json:"message"`
+}
+
+// fakeSendAPI serves the Messenger Send API, answering with status
+type fakeSendAPI struct {
+	mu     sync.Mutex
+	calls  []messengerCall
+	status int
+}
+
+func newFakeSendAPI(t *testing.T) (*fakeSendAPI, *httptest.Server) {
+	t.Helper()
+	f := &fakeSendAPI{status: http.StatusOK}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw, _ := io.ReadAll(r.Body)
+		call := messengerCall{Path: r.URL.Path, Authorization: r.Header.Get("Authorization")}
+		json.Unmarshal(raw, &call)
+		f.mu.Lock()
+		f.calls = append(f.calls, call)
+		status := f.status
+		f.mu.Unlock()
+
+		w.WriteHeader(status)
+		if status != http.StatusOK {
+			w.Write([]byte(`{"error":{"message":"No matching user found","code":100}}` + "\n"))
+			return
+		}
+		w.Write([]byte(`{"recipient_id":"psid-1","message_id":"m_1"}`))
+	}))
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+func (f *fakeSendAPI) received() []messengerCall {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]messengerCall(nil), f.calls...)
+}
+
+func testMessengerClient(srv *httptest.Server) *MessengerClient {
+	return NewMessengerClient(config.MessengerConfig{PageAccessToken: "page-token"},
+		config.WhatsAppConfig{GraphAPIBaseURL: srv.URL + "/", APIVersion: "v22.0"}, srv.Client())
+}
+
+func TestMessengerClient(t *testing.T) {
+	f, srv := newFakeSendAPI(t)
+	client := testMessengerClient(srv)
+	ctx := context.Background()
+
+	long := strings.Repeat("word ", messengerMaxTextLength/5+10)
+	if err := client.SendText(ctx, "psid-1", long); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SendAttachment(ctx, "psid-1", "image", "https://example.com/a.png"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SendAction(ctx, "psid-1", "typing_on"); err != nil {
+		t.Fatal(err)
+	}
+
+	calls := f.received()
+	if len(calls) != 4 {
+		t.Fatalf("received %d requests, want the text in two parts, the attachment and the action", len(calls))
+	}
+	for _, call := range calls {
+		if call.Path != "/v22.0/me/messages" || call.Authorization != "Bearer page-token" || call.Recipient.ID != "psid-1" {
+			t.Errorf("sent %s with %q to %q", call.Path, call.Authorization, call.Recipient.ID)
+		}
+	}
+	for _, call := range calls[:2] {
+		if call.MessagingType != "RESPONSE" || call.Message.Text == "" || len(call.Message.Text) > messengerMaxTextLength {
+			t.Errorf("sent a %q message of %d bytes", call.MessagingType, len(call.Message.Text))
+		}
+	}
+	if got := strings.Fields(calls[0].Message.Text + " " + calls[1].Message.Text); len(got) != len(strings.Fields(long)) {
+		t.Errorf("the parts hold %d words, want %d", len(got), len(strings.Fields(long)))
+	}
+	if a := calls[2].Message.Attachment; a.Type != "image" || a.Payload.URL != "https://example.com/a.png" {
+		t.Errorf("sent attachment %+v", a)
+	}
+	if calls[3].SenderAction != "typing_on" || calls[3].MessagingType != "" {
+		t.Errorf("sent action %q as %q", calls[3].SenderAction, calls[3].MessagingType)
+	}
+}
+
+func TestMessengerClientErrors(t *testing.T) {
+	f, srv := newFakeSendAPI(t)
+	f.status = http.StatusBadRequest
+	client := testMessengerClient(srv)
+
+	want := `Send API returned status 400: {"error":{"message":"No matching user found","code":100}}`
+	if err := client.SendText(context.Background(), "psid-1", "hi"); err == nil || err.Error() != want {
+		t.Errorf("error %v, want %q", err, want)
+	}
+	// A failed part stops the rest of the text
+	client.SendText(context.Background(), "psid-1", strings.Repeat("word ", messengerMaxTextLength/5+10))
+	if n := len(f.received()); n != 2 {
+		t.Errorf("received %d requests, want the text to stop at the failed part", n)
+	}
+}
+
+func TestMessengerSenderMediaTypes(t *testing.T) {
+	f, srv := newFakeSendAPI(t)
+	sender := &messengerSender{client: testMessengerClient(srv)}
+	msg := ChannelMessage{UserID: "psid-1"}
+
+	for _, media := range []ChannelAttachment{{Type: "document", URL: "a"}, {URL: "b"}, {Type: "video", URL: "c"}} {
+		if err := sender.SendMedia(context.Background(), msg, media); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var types []string
+	for _, call := range f.received() {
+		types = append(types, call.Message.Attachment.Type)
+	}
+	if got := strings.Join(types, ","); got != "file,file,video" {
+		t.Errorf("sent attachment types %s, want file,file,video", got)
+	}
+}
+
+// newTestMessengerHandler creates a Messenger handler answering through a
+// fake Dify and replying through a fake Send API
+func newTestMessengerHandler(t *testing.T, pageAccessToken string) (*gin.Engine, *fakeSendAPI) {
+	t.Helper()
+	_, difyHandler := newFakeDify(t, func(req ChatMessageRequest) []StreamingChatResponse {
+		return difyAnswer("conv-1", "Opening hours are 9 to 5.")
+	})
+	f, srv := newFakeSendAPI(t)
+	h := NewMessengerHandler(config.MessengerConfig{PageAccessToken: pageAccessToken},
+		config.WhatsAppConfig{AppSecret: "secret", GraphAPIBaseURL: srv.URL, APIVersion: "v22.0"},
+		config.ChatConfig{}, config.DifyConfig{StreamTimeout: 5 * time.Second}, &HTTPClients{Meta: srv.Client()},
+		difyHandler, NewMessages(config.MessagesConfig{}), store.New("", quietLogger()), nil, quietLogger())
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/webhook/messenger", h.HandleMessengerWebhookPost)
+	return r, f
+}
+
+// postMessengerEvent sends body signed with the test app secret
+func postMessengerEvent(r *gin.Engine, body string) *httptest.ResponseRecorder {
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(body))
+	req := httptest.NewRequest(http.MethodPost, "/webhook/messenger", strings.NewReader(body))
+	req.Header.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestMessengerWebhookAnswersSender(t *testing.T) {
+	r, f := newTestMessengerHandler(t, "page-token")
+
+	w := postMessengerEvent(r, `{"object":"page","entry":[{"id":"page-1","messaging":[
+		{"sender":{"id":"psid-1"},"recipient":{"id":"page-1"},"message":{"mid":"m_echo","text":"An earlier reply","is_echo":true}},
+		{"sender":{"id":"psid-1"},"recipient":{"id":"page-1"},"message":{"mid":"m_1","text":"When are you open?"}}]}]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200", w.Code)
+	}
+
+	var texts []string
+	deadline := time.Now().Add(2 * time.Second)
+	for len(texts) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		texts = nil
+		for _, call := range f.received() {
+			if call.Message.Text != "" {
+				texts = append(texts, call.Recipient.ID+": "+call.Message.Text)
+			}
+		}
+	}
+	if len(texts) != 1 || texts[0] != "psid-1: Opening hours are 9 to 5." {
+		t.Errorf("sent %q, want the answer to the sender only", texts)
+	}
+	if calls := f.received(); calls[0].SenderAction != "typing_on" {
+		t.Errorf("first sent %+v, want the typing indicator", calls[0])
+	}
+}
+
+func TestMessengerWebhookRejected(t *testing.T) {
+	r, f := newTestMessengerHandler(t, "page-token")
+
+	req := httptest.NewRequest(http.MethodPost, "/webhook/messenger", strings.NewReader(`{"object":"page"}`))
+	req.Header.Set("X-Hub-Signature-256", "sha256=00")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("status %d for a bad signature, want 403", w.Code)
+	}
+
+	if w := postMessengerEvent(r, `{"object":"instagram","entry":[{"id":"1","messaging":[{"sender":{"id":"u"},"message":{"mid":"m","text":"hi"}}]}]}`); w.Code != http.StatusOK {
+		t.Errorf("status %d for another object, want 200", w.Code)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if calls := f.received(); len(calls) != 0 {
+		t.Errorf("sent %+v, want nothing", calls)
+	}
+
+	unconfigured, _ := newTestMessengerHandler(t, "")
+	if w := postMessengerEvent(unconfigured, `{"object":"page"}`); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status %d without a page access token, want 503", w.Code)
+	}
+}
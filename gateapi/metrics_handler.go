@@ -0,0 +1,16 @@
+package gateapi
+
+import (
+	"bytes"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tracoco/DifyGate/metrics"
+)
+
+// MetricsHandler exposes all registered metrics in the Prometheus text format
+func MetricsHandler(c *gin.Context) {
+	var buf bytes.Buffer
+	metrics.WritePrometheus(&buf)
+	c.Data(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", buf.Bytes())
+}
@@ -0,0 +1,24 @@
+package gateapi
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tracoco/DifyGate/mock"
+)
+
+// RegisterMockRoutes adds the endpoints of mock mode, which show what the
+// fake Graph API was sent. They need no key: mock mode never talks to real
+// users, so there is nothing to protect.
+func RegisterMockRoutes(r *gin.Engine, mocks *mock.Servers) {
+	sent := r.Group("/api/v1/_mock")
+	{
+		sent.GET("/sent", func(c *gin.Context) {
+			c.JSON(http.StatusOK, gin.H{"messages": mocks.Graph.Sent()})
+		})
+		sent.DELETE("/sent", func(c *gin.Context) {
+			mocks.Graph.Reset()
+			c.Status(http.StatusNoContent)
+		})
+	}
+}
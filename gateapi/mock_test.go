@@ -0,0 +1,76 @@
+package gateapi
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tracoco/DifyGate/config"
+	"github.com/tracoco/DifyGate/mock"
+)
+
+// TestMockModeAnswersWhatsApp runs a WhatsApp message through the real
+// handlers against the fakes, as an integration test would
+func TestMockModeAnswersWhatsApp(t *testing.T) {
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Mock = config.MockConfig{Enabled: true, Answer: "You said: {query}"}
+	mocks := mock.Start(cfg, quietLogger())
+	t.Cleanup(mocks.Close)
+	r := newTestRouter(t, cfg)
+	RegisterMockRoutes(r, mocks)
+
+	body := `{"object": "whatsapp_business_account", "entry": [{"id": "1", "changes": [{"field": "messages", "value": {
+		"messaging_product": "whatsapp",
+		"metadata": {"display_phone_number": "15550783881", "phone_number_id": "` + mock.PhoneNumberID + `"},
+		"contacts": [{"profile": {"name": "Sheena"}, "wa_id": "16505551234"}],
+		"messages": [{"from": "16505551234", "id": "wamid.in-1", "timestamp": "1749854575", "type": "text", "text": {"body": "hello there"}}]
+	}}]}]}`
+	mac := hmac.New(sha256.New, []byte(mock.AppSecret))
+	mac.Write([]byte(body))
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/whatsapp/webhook", strings.NewReader(body))
+	req.Header.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("webhook status %d: %s", w.Code, w.Body)
+	}
+
+	var reply *mock.SentMessage
+	for deadline := time.Now().Add(5 * time.Second); reply == nil; {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/_mock/sent", nil))
+		var resp struct {
+			Messages []mock.SentMessage `json:"messages"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("sent messages %s: %v", w.Body, err)
+		}
+		for i, m := range resp.Messages {
+			if m.Type == "text" {
+				reply = &resp.Messages[i]
+			}
+		}
+		if reply == nil && time.Now().After(deadline) {
+			t.Fatalf("no reply was sent, got %+v", resp.Messages)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if reply.Text != "You said: hello there" || reply.To != "16505551234" || reply.From != mock.PhoneNumberID || !strings.HasPrefix(reply.ID, "wamid.") {
+		t.Errorf("reply = %+v, want the echo from the mock number", reply)
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/api/v1/_mock/sent", nil))
+	if w.Code != http.StatusNoContent || len(mocks.Graph.Sent()) != 0 {
+		t.Errorf("reset got %d leaving %d messages, want 204 and none", w.Code, len(mocks.Graph.Sent()))
+	}
+}
@@ -0,0 +1,91 @@
+package gateapi
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+//go:embed openapi.json
+var openAPISpec []byte
+
+//go:embed docs.html
+var docsTemplate []byte
+
+// docsPage is the Swagger UI page with the spec inlined
+var docsPage = bytes.Replace(docsTemplate, []byte("/*SPEC*/"), openAPISpec, 1)
+
+// OpenAPIHandler serves the OpenAPI document describing the gateway API
+func OpenAPIHandler(c *gin.Context) {
+	c.Data(http.StatusOK, "application/json; charset=utf-8", openAPISpec)
+}
+
+// DocsHandler serves Swagger UI for the OpenAPI document
+func DocsHandler(c *gin.Context) {
+	c.Data(http.StatusOK, "text/html; charset=utf-8", docsPage)
+}
+
+// ginParamPattern matches path parameters in Gin's :name and *name forms
+var ginParamPattern = regexp.MustCompile(`[:*]([A-Za-z0-9_]+)`)
+
+// openAPIOperation is the part of an operation the coverage check reads
+type openAPIOperation struct {
+	// Optional marks routes that are only registered when enabled
+	Optional bool `json:"x-difygate-optional"`
+}
+
+// checkOpenAPICoverage warns about registered routes the spec doesn't
+// describe and, unless partial is set because features are disabled,
+// documented routes that aren't registered, so the embedded spec doesn't
+// silently drift from the router
+func checkOpenAPICoverage(r *gin.Engine, partial bool, log *logrus.Logger) {
+	undocumented, unregistered, err := openAPIDrift(r)
+	if err != nil {
+		log.WithError(err).Error("Embedded OpenAPI spec is invalid")
+		return
+	}
+	for _, route := range undocumented {
+		log.WithFields(logrus.Fields{"method": route.Method, "path": route.Path}).Warn("Route missing from OpenAPI spec")
+	}
+	if partial {
+		return
+	}
+	for _, route := range unregistered {
+		log.WithFields(logrus.Fields{"method": route.Method, "path": route.Path}).Warn("OpenAPI spec documents an unregistered route")
+	}
+}
+
+// openAPIDrift compares the router with the embedded spec, returning the
+// routes the spec lacks and the required operations the router lacks
+func openAPIDrift(r *gin.Engine) (undocumented, unregistered []gin.RouteInfo, err error) {
+	var spec struct {
+		Paths map[string]map[string]openAPIOperation `json:"paths"`
+	}
+	if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+		return nil, nil, err
+	}
+
+	registered := make(map[string]bool)
+	for _, route := range r.Routes() {
+		path := ginParamPattern.ReplaceAllString(route.Path, "{$1}")
+		method := strings.ToLower(route.Method)
+		registered[method+" "+path] = true
+		if _, ok := spec.Paths[path][method]; !ok {
+			undocumented = append(undocumented, route)
+		}
+	}
+	for path, ops := range spec.Paths {
+		for method, op := range ops {
+			if !registered[method+" "+path] && !op.Optional {
+				unregistered = append(unregistered, gin.RouteInfo{Method: strings.ToUpper(method), Path: path})
+			}
+		}
+	}
+	return undocumented, unregistered, nil
+}
@@ -0,0 +1,116 @@
+package gateapi
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/config"
+	"github.com/tracoco/DifyGate/events"
+	"github.com/tracoco/DifyGate/gate"
+	"github.com/tracoco/DifyGate/store"
+)
+
+// newTestRouter registers every route with cfg, as main does
+func newTestRouter(t *testing.T, cfg *config.Config) *gin.Engine {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+
+	kv := store.New("", log)
+	t.Cleanup(func() { kv.Close() })
+	r := gin.New()
+	RegisterRoutes(r, NewReloader(cfg, nil, log), gate.NewService(cfg.DIFYGATE, log), kv, events.NewDispatcher(cfg.Webhooks, log), nil, NewReadiness(cfg, log), log)
+	return r
+}
+
+// TestOpenAPISpecMatchesRoutes keeps the embedded spec in sync with the
+// router: every route is documented and every documented route exists
+func TestOpenAPISpecMatchesRoutes(t *testing.T) {
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	undocumented, unregistered, err := openAPIDrift(newTestRouter(t, cfg))
+	if err != nil {
+		t.Fatalf("embedded spec is invalid: %v", err)
+	}
+	for _, route := range undocumented {
+		t.Errorf("route %s %s is missing from openapi.json", route.Method, route.Path)
+	}
+	for _, route := range unregistered {
+		t.Errorf("openapi.json documents %s %s, which isn't registered", route.Method, route.Path)
+	}
+}
+
+// TestOpenAPISpecDescribesAuth checks each operation's security matches
+// the router: operations without an opt-out answer 401 without a key, and
+// opted-out ones don't
+func TestOpenAPISpecDescribesAuth(t *testing.T) {
+	var spec struct {
+		OpenAPI    string                `json:"openapi"`
+		Security   []map[string][]string `json:"security"`
+		Components struct {
+			SecuritySchemes map[string]struct {
+				Type   string `json:"type"`
+				Scheme string `json:"scheme"`
+			} `json:"securitySchemes"`
+			Schemas map[string]json.RawMessage `json:"schemas"`
+		} `json:"components"`
+		Paths map[string]map[string]struct {
+			Security *[]map[string][]string `json:"security"`
+		} `json:"paths"`
+	}
+	if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(spec.OpenAPI, "3.") {
+		t.Errorf("openapi = %q, want 3.x", spec.OpenAPI)
+	}
+	bearer := spec.Components.SecuritySchemes["bearerAuth"]
+	if bearer.Type != "http" || bearer.Scheme != "bearer" {
+		t.Errorf("bearerAuth = %+v, want http bearer", bearer)
+	}
+	if len(spec.Security) != 1 || spec.Security[0]["bearerAuth"] == nil {
+		t.Errorf("global security = %v, want bearerAuth", spec.Security)
+	}
+	if _, ok := spec.Components.Schemas["Error"]; !ok {
+		t.Error("Error envelope schema missing")
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Auth.APIKey = "test-key"
+	// Every protected operation fails authentication once; none may be
+	// throttled for the ones before it
+	cfg.APIRateLimit.Burst = 1000
+	r := newTestRouter(t, cfg)
+	for path, ops := range spec.Paths {
+		for method, op := range ops {
+			url := specParamPattern.ReplaceAllString(path, "x")
+			req := httptest.NewRequest(strings.ToUpper(method), url, nil)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code == http.StatusNotFound {
+				// Optional routes that aren't enabled
+				continue
+			}
+			public := op.Security != nil && len(*op.Security) == 0
+			if public == (w.Code == http.StatusUnauthorized) {
+				t.Errorf("%s %s: documented public=%v but got status %d without a key", strings.ToUpper(method), path, public, w.Code)
+			}
+		}
+	}
+}
+
+// specParamPattern matches OpenAPI {name} path parameters
+var specParamPattern = regexp.MustCompile(`\{[^}]+\}`)
@@ -0,0 +1,242 @@
+package gateapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/config"
+	"github.com/tracoco/DifyGate/events"
+	"github.com/tracoco/DifyGate/metrics"
+	"github.com/tracoco/DifyGate/store"
+)
+
+// replyRetries counts replies that failed to send, by what became of them:
+// queued, delivered or given_up
+var replyRetries = metrics.NewCounter("difygate_reply_retries_total",
+	"Replies that failed to send and were queued for retry, by outcome", "channel", "outcome")
+
+const (
+	// outboxPollInterval is how often the outbox looks for replies due
+	outboxPollInterval = 10 * time.Second
+	// outboxFirstRetry is the wait before the first retry, doubling with
+	// each failure up to outboxMaxBackoff
+	outboxFirstRetry = 30 * time.Second
+	outboxMaxBackoff = 10 * time.Minute
+	// outboxClaimTTL keeps other instances off an attempt while one sends it
+	outboxClaimTTL = 5 * time.Minute
+	// outboxSendTimeout bounds each retried message
+	outboxSendTimeout = 30 * time.Second
+)
+
+// outboxEntry is a reply waiting to be sent again, with the chunks that
+// didn't go out
+type outboxEntry struct {
+	Message  ChannelMessage `json:"message"`
+	Chunks   []string       `json:"chunks"`
+	QueuedAt time.Time      `json:"queued_at"`
+	Attempts int            `json:"attempts"`
+	NextAt   time.Time      `json:"next_at"`
+	Error    string         `json:"error"`
+}
+
+// outbox keeps replies that failed to send in the store and retries them
+// with backoff until DIFYGATE_SEND_RETRY_WINDOW has passed. Entries are
+// keyed by user and queue time, so a user's replies go out in order.
+type outbox struct {
+	channel string
+	sender  ChannelSender
+	store   store.Store
+	window  time.Duration
+	events  *events.Dispatcher
+	// record adds a retried reply to the message history
+	record func(msg ChannelMessage, id, text string, err error)
+
+	start sync.Once
+}
+
+// retryableSend reports whether a failed send can be retried without the
+// user getting the message twice: the platform refused it with a
+// temporary error, or was never reached. A timeout after the request went
+// out may hide a late success, so it isn't retried.
+func retryableSend(err error) bool {
+	var waErr *WhatsAppAPIError
+	if errors.As(err, &waErr) {
+		// 401 is usually a token that has just expired and is being rotated
+		return waErr.Status >= 500 || waErr.Status == http.StatusUnauthorized || waErr.RateLimited()
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr)
+}
+
+// outboxBackoff is the wait after a reply's nth failed retry
+func outboxBackoff(attempts int) time.Duration {
+	d := outboxFirstRetry
+	for i := 1; i < attempts && d < outboxMaxBackoff; i++ {
+		d *= 2
+	}
+	if d > outboxMaxBackoff {
+		d = outboxMaxBackoff
+	}
+	return d
+}
+
+func (o *outbox) keyPrefix() string {
+	return "outbox:" + o.channel + ":"
+}
+
+// run starts retrying queued replies, including those left by an earlier
+// run of the gateway; it keeps running for the life of the process
+func (o *outbox) run(log *logrus.Logger) {
+	if o == nil {
+		return
+	}
+	o.start.Do(func() {
+		go func() {
+			ticker := time.NewTicker(outboxPollInterval)
+			defer ticker.Stop()
+			for now := range ticker.C {
+				o.retryDue(log, now)
+			}
+		}()
+	})
+}
+
+// enqueue stores the chunks of a reply that couldn't be sent
+func (o *outbox) enqueue(log *logrus.Entry, msg ChannelMessage, chunks []string, err error) {
+	now := time.Now()
+	// The ReplyToken authorises one reply and shouldn't outlive it
+	msg.ReplyToken = ""
+	entry := outboxEntry{Message: msg, Chunks: chunks, QueuedAt: now, NextAt: now.Add(outboxFirstRetry), Error: err.Error()}
+	// Zero-padded nanoseconds sort the user's entries by queue time
+	key := fmt.Sprintf("%s%s:%019d-%s", o.keyPrefix(), msg.UserID, now.UnixNano(), newErrorRef())
+	if err := o.save(key, entry); err != nil {
+		log.WithError(err).Error("Failed to queue reply for retry, dropping it")
+		return
+	}
+	replyRetries.Inc(o.channel, "queued")
+	log.WithField("retry_at", entry.NextAt).Warn("Reply queued for retry")
+	o.run(log.Logger)
+}
+
+// save writes an entry, expiring it shortly after it would be given up
+func (o *outbox) save(key string, entry outboxEntry) error {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return o.store.Set(key, b, o.window+outboxClaimTTL)
+}
+
+// retryDue sends the replies whose retry is due at now. After a failure the
+// user's later replies wait, so they don't overtake it.
+func (o *outbox) retryDue(log *logrus.Logger, now time.Time) {
+	keys, err := o.store.Keys(o.keyPrefix() + "*")
+	if err != nil {
+		log.WithError(err).Warn("Failed to list queued replies")
+		return
+	}
+	sort.Strings(keys)
+
+	blocked := make(map[string]bool)
+	for _, key := range keys {
+		user := strings.TrimPrefix(key[:strings.LastIndex(key, ":")], o.keyPrefix())
+		if blocked[user] {
+			continue
+		}
+		if !o.retry(log, key, now) {
+			blocked[user] = true
+		}
+	}
+}
+
+// retry sends one queued reply if it is due, returning false when it is
+// still waiting to be sent
+func (o *outbox) retry(log *logrus.Logger, key string, now time.Time) bool {
+	b, err := o.store.Get(key)
+	if errors.Is(err, store.ErrNotFound) {
+		return true
+	}
+	var entry outboxEntry
+	if err == nil {
+		err = json.Unmarshal(b, &entry)
+	}
+	if err != nil {
+		log.WithError(err).WithField("key", key).Warn("Failed to read queued reply")
+		return false
+	}
+	entryLog := log.WithFields(logrus.Fields{"channel": o.channel, "user_id": entry.Message.UserID, "attempt": entry.Attempts + 1})
+	if now.Before(entry.NextAt) {
+		return false
+	}
+
+	// Only one instance sends each attempt; the others skip it
+	claimed, err := o.store.Incr(fmt.Sprintf("outbox-claim:%s:%d", strings.TrimPrefix(key, "outbox:"), entry.Attempts), outboxClaimTTL)
+	if err != nil || claimed != 1 {
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(withLogger(context.Background(), entryLog), outboxSendTimeout)
+	defer cancel()
+	for len(entry.Chunks) > 0 {
+		id, err := o.sender.SendText(ctx, entry.Message, entry.Chunks[0])
+		o.record(entry.Message, id, entry.Chunks[0], err)
+		if err != nil {
+			return o.failed(entryLog, key, entry, err, now)
+		}
+		entry.Chunks = entry.Chunks[1:]
+		// Sent chunks must not be sent again if a later one fails
+		if len(entry.Chunks) > 0 {
+			if err := o.save(key, entry); err != nil {
+				entryLog.WithError(err).Warn("Failed to update queued reply")
+			}
+		}
+	}
+	if err := o.store.Delete(key); err != nil {
+		entryLog.WithError(err).Warn("Failed to remove delivered reply from the queue")
+	}
+	replyRetries.Inc(o.channel, "delivered")
+	entryLog.WithField("queued_for", now.Sub(entry.QueuedAt).Round(time.Second).String()).Info("Queued reply delivered")
+	return true
+}
+
+// failed schedules the next retry of an entry, or gives it up once the
+// error is permanent or the retry window has passed
+func (o *outbox) failed(log *logrus.Entry, key string, entry outboxEntry, err error, now time.Time) bool {
+	entry.Attempts++
+	entry.Error = err.Error()
+	entry.NextAt = now.Add(outboxBackoff(entry.Attempts))
+	if retryableSend(err) && entry.NextAt.Sub(entry.QueuedAt) <= o.window {
+		log.WithError(err).WithField("retry_at", entry.NextAt).Warn("Queued reply failed to send again")
+		if err := o.save(key, entry); err != nil {
+			log.WithError(err).Error("Failed to requeue reply, dropping it")
+		}
+		return false
+	}
+
+	if err := o.store.Delete(key); err != nil {
+		log.WithError(err).Warn("Failed to remove undeliverable reply from the queue")
+	}
+	replyRetries.Inc(o.channel, "given_up")
+	log.WithError(err).WithField("queued_for", now.Sub(entry.QueuedAt).Round(time.Second).String()).Error("Giving up on queued reply")
+	o.events.Publish(events.Event{
+		Type:    config.EventMessageUndelivered,
+		Channel: o.channel,
+		UserID:  entry.Message.UserID,
+		Text:    strings.Join(entry.Chunks, "\n"),
+		Error:   err.Error(),
+	})
+	return true
+}
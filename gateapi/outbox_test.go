@@ -0,0 +1,141 @@
+package gateapi
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tracoco/DifyGate/config"
+	"github.com/tracoco/DifyGate/store"
+)
+
+// flakySender fails each send with err until it is cleared
+type flakySender struct {
+	fakeSender
+	mu  sync.Mutex
+	err error
+}
+
+func (s *flakySender) SendText(ctx context.Context, msg ChannelMessage, text string) (string, error) {
+	s.mu.Lock()
+	err := s.err
+	s.mu.Unlock()
+	if err != nil {
+		return "", err
+	}
+	return s.fakeSender.SendText(ctx, msg, text)
+}
+
+func (s *flakySender) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
+
+// newTestOutbox creates a pipeline queueing replies it fails to send
+func newTestOutbox(t *testing.T, channel string, answer string) (*MessagePipeline, *flakySender, store.Store) {
+	t.Helper()
+	_, difyHandler := newFakeDify(t, func(req ChatMessageRequest) []StreamingChatResponse {
+		return difyAnswer("conv-1", answer)
+	})
+	kv := store.New("", quietLogger())
+	sender := &flakySender{}
+	p := NewMessagePipeline(PipelineOptions{Channel: channel, MaxMessageLength: 10}, sender, config.ChatConfig{SendRetryWindow: time.Hour},
+		NewMessages(config.MessagesConfig{}), config.DifyConfig{StreamTimeout: 5 * time.Second}, difyHandler, kv, nil)
+	return p, sender, kv
+}
+
+func TestRetryableSend(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"server error", &WhatsAppAPIError{Status: http.StatusBadGateway}, true},
+		{"expired token", &WhatsAppAPIError{Status: http.StatusUnauthorized, Code: 190}, true},
+		{"rate limited", &WhatsAppAPIError{Status: http.StatusTooManyRequests}, true},
+		{"bad request", &WhatsAppAPIError{Status: http.StatusBadRequest, Code: 131026}, false},
+		{"timeout", context.DeadlineExceeded, false},
+		{"other", errors.New("boom"), false},
+	}
+	for _, tt := range tests {
+		if got := retryableSend(tt.err); got != tt.want {
+			t.Errorf("%s: retryableSend = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestOutboxBackoff(t *testing.T) {
+	for attempts, want := range map[int]time.Duration{1: 30 * time.Second, 2: time.Minute, 3: 2 * time.Minute, 10: outboxMaxBackoff} {
+		if got := outboxBackoff(attempts); got != want {
+			t.Errorf("outboxBackoff(%d) = %v, want %v", attempts, got, want)
+		}
+	}
+}
+
+func TestOutboxRetriesFailedReply(t *testing.T) {
+	p, sender, kv := newTestOutbox(t, "outbox-retry", "one two three four")
+	sender.fail(&WhatsAppAPIError{Status: http.StatusServiceUnavailable})
+
+	p.Handle(testEntry(), ChannelMessage{ChannelID: "bot", UserID: "u1", Text: "hi"})
+	keys, _ := kv.Keys("outbox:outbox-retry:u1:*")
+	if len(keys) != 1 {
+		t.Fatalf("queued %d replies, want 1", len(keys))
+	}
+	if n := replyRetries.Value("outbox-retry", "queued"); n != 1 {
+		t.Errorf("queued counter = %v, want 1", n)
+	}
+
+	// Not due yet, then due but still failing
+	p.outbox.retryDue(quietLogger(), time.Now())
+	p.outbox.retryDue(quietLogger(), time.Now().Add(time.Minute))
+	if got := sender.sent(); len(got) != 0 {
+		t.Fatalf("sent %q while the platform was down", got)
+	}
+
+	sender.fail(nil)
+	p.outbox.retryDue(quietLogger(), time.Now().Add(5*time.Minute))
+	if got := sender.sent(); strings.Join(got, "|") != "one two|three four" {
+		t.Errorf("sent %q, want the whole queued answer", got)
+	}
+	if keys, _ := kv.Keys("outbox:outbox-retry:*"); len(keys) != 0 {
+		t.Errorf("delivered reply left in the queue: %q", keys)
+	}
+	if n := replyRetries.Value("outbox-retry", "delivered"); n != 1 {
+		t.Errorf("delivered counter = %v, want 1", n)
+	}
+
+	// Retrying again sends nothing twice
+	p.outbox.retryDue(quietLogger(), time.Now().Add(time.Hour))
+	if got := sender.sent(); len(got) != 0 {
+		t.Errorf("sent %q again", got)
+	}
+}
+
+func TestOutboxGivesUpAfterWindow(t *testing.T) {
+	p, sender, kv := newTestOutbox(t, "outbox-giveup", "answer")
+	sender.fail(&WhatsAppAPIError{Status: http.StatusInternalServerError})
+
+	p.Handle(testEntry(), ChannelMessage{ChannelID: "bot", UserID: "u1", Text: "hi"})
+	p.outbox.retryDue(quietLogger(), time.Now().Add(2*time.Hour))
+	if keys, _ := kv.Keys("outbox:outbox-giveup:*"); len(keys) != 0 {
+		t.Errorf("reply past the retry window left in the queue: %q", keys)
+	}
+	if n := replyRetries.Value("outbox-giveup", "given_up"); n != 1 {
+		t.Errorf("given_up counter = %v, want 1", n)
+	}
+}
+
+func TestOutboxDropsPermanentFailures(t *testing.T) {
+	p, sender, kv := newTestOutbox(t, "outbox-permanent", "answer")
+	sender.fail(&WhatsAppAPIError{Status: http.StatusBadRequest, Code: 131026})
+
+	p.Handle(testEntry(), ChannelMessage{ChannelID: "bot", UserID: "u1", Text: "hi"})
+	if keys, _ := kv.Keys("outbox:outbox-permanent:*"); len(keys) != 0 {
+		t.Errorf("queued %q for an undeliverable message", keys)
+	}
+}
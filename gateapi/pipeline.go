@@ -0,0 +1,1032 @@
+package gateapi
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/config"
+	"github.com/tracoco/DifyGate/events"
+	"github.com/tracoco/DifyGate/history"
+	"github.com/tracoco/DifyGate/metrics"
+	"github.com/tracoco/DifyGate/store"
+)
+
+// chatFailures counts chat messages answered with an error message, by the
+// message sent, e.g. timeout or content_blocked
+var chatFailures = metrics.NewCounter("difygate_chat_failures_total",
+	"Chat messages answered with an error message", "channel", "reason")
+
+// chatAcks counts the ack messages sent while Dify was slow to answer
+var chatAcks = metrics.NewCounter("difygate_chat_acks_total",
+	"Ack messages sent to chat users while Dify was slow to start answering", "channel")
+
+// chatVoiceReplies counts answers whose speech was sent as audio
+var chatVoiceReplies = metrics.NewCounter("difygate_chat_voice_replies_total",
+	"Answers whose speech Dify streamed was sent as audio", "channel")
+
+// maxVoiceReplyBytes is the most audio WhatsApp accepts in a message
+const maxVoiceReplyBytes = 16 << 20
+
+// chatAnswersReplaced counts answers Dify's output moderation rewrote
+var chatAnswersReplaced = metrics.NewCounter("difygate_chat_answers_replaced_total",
+	"Chat answers Dify's output moderation replaced while they streamed", "channel")
+
+const (
+	// ackRotationTTL is how long a user's place in the ack variants is
+	// kept, so they see a different one each time
+	ackRotationTTL = 24 * time.Hour
+	// idleFlushInterval sends what has accumulated when Dify goes quiet
+	// mid-answer (e.g. during a slow tool call) ...
+	idleFlushInterval = 15 * time.Second
+	// ... as long as there is at least this much of it
+	idleFlushMinChunk = 100
+)
+
+// ChannelMessage is an inbound message from any messaging channel
+type ChannelMessage struct {
+	// ChannelID identifies our side of the chat, e.g. the WhatsApp business
+	// number or the Facebook page
+	ChannelID string
+	// UserID identifies the sender within the channel
+	UserID string
+	Text   string
+	// ReplyTo is the platform ID of the message being answered, if any
+	ReplyTo string
+	// ThreadID is the thread the message was posted in, where the channel
+	// has threads
+	ThreadID string
+	// ReplyToken authorises the reply on channels that issue one per
+	// message, e.g. a Discord interaction token; it is never logged
+	ReplyToken string
+	// Locale is the language the platform reports for the user; empty
+	// detects it from Text
+	Locale      string
+	Attachments []ChannelAttachment
+}
+
+// ChannelAttachment is media sent to or from a channel
+type ChannelAttachment struct {
+	// Type is image, audio, video or document
+	Type     string
+	URL      string
+	MimeType string
+	Caption  string
+}
+
+// ChannelSender delivers replies on one messaging channel
+type ChannelSender interface {
+	// SendText sends a reply of at most the pipeline's MaxMessageLength and
+	// returns its platform ID, or "" when the channel doesn't report one
+	SendText(ctx context.Context, msg ChannelMessage, text string) (string, error)
+	// SendTyping shows that an answer is being generated, where supported
+	SendTyping(ctx context.Context, msg ChannelMessage) error
+	// SendMedia sends a file Dify attached to its answer
+	SendMedia(ctx context.Context, msg ChannelMessage, media ChannelAttachment) error
+}
+
+// PipelineOptions are the per-channel settings of a MessagePipeline
+type PipelineOptions struct {
+	// Channel names the channel in logs, store keys, Dify users and events
+	Channel string
+	// MaxMessageLength splits longer replies into several messages
+	MaxMessageLength int
+	// ConversationTTL is how long a user keeps their Dify conversation
+	ConversationTTL time.Duration
+	// Format converts Dify's Markdown for the channel; nil sends it as is
+	Format func(msg ChannelMessage, text string) string
+	// ConversationKey names the store key of the chat's Dify conversation;
+	// nil keys it by channel, ChannelID and UserID
+	ConversationKey func(msg ChannelMessage) string
+	// DifyUser names the sender to Dify without DIFYGATE_DIFY_USER_ID_MODE;
+	// nil uses "<channel>:<UserID>"
+	DifyUser func(msg ChannelMessage) string
+	// History records the messages in and out; nil records nothing
+	History *history.Recorder
+	// Inputs returns the Dify inputs for a chat, e.g. per business number,
+	// overriding the Dify default inputs; nil adds none
+	Inputs func(msg ChannelMessage) map[string]interface{}
+	// LanguageHint guesses the sender's language when their message is too
+	// short to detect, e.g. from a phone number; nil gives no hint
+	LanguageHint func(msg ChannelMessage) string
+	// Acknowledge marks a message on the platform when it is taken up and,
+	// with done, once it has been answered, e.g. with a reaction; it must
+	// not take long. nil marks nothing.
+	Acknowledge func(ctx context.Context, msg ChannelMessage, done bool)
+	// SendVoice sends the speech Dify streamed for an answer, after its
+	// text; nil ignores the speech
+	SendVoice func(ctx context.Context, msg ChannelMessage, audio []byte) error
+}
+
+// MessagePipeline takes channel messages through commands, the Dify
+// conversation and the reply, so channels only parse and send
+type MessagePipeline struct {
+	opts          PipelineOptions
+	chat          config.ChatConfig
+	messages      *Messages
+	hooks         *MessageHooks
+	sender        ChannelSender
+	difyHandler   *DifyHandler
+	store         store.Store
+	events        *events.Dispatcher
+	streamTimeout time.Duration
+	// outbox retries replies that failed to send; nil drops them
+	outbox *outbox
+	// queues answers each chat's messages one at a time
+	queues *userQueues
+	// debounce joins a user's quick successive messages into one query;
+	// nil answers each on its own
+	debounce *debouncer
+	// inbox saves webhook messages until they are answered; nil answers
+	// them from memory only
+	inbox *inbox
+	// handoff lets users ask for a person; nil always answers
+	handoff *handoff
+	// canned answers common questions without Dify; nil asks Dify
+	canned *cannedResponses
+	// optOut lets users stop broadcasts with a keyword; nil has no
+	// keywords
+	optOut *optOut
+	// transcripts lets users email themselves their conversation with
+	// /transcript; nil has no such command
+	transcripts *transcripts
+	// abuse drops the messages of users who send too much; nil answers
+	// everyone
+	abuse *abuseGuard
+	// cache answers the first question of a conversation when it was
+	// asked before; nil always asks Dify
+	cache *answerCache
+	// activity counts the messages handled for the daily digest; nil
+	// counts nothing
+	activity *activity
+	// costs adds up what each user's answers cost and refuses users over
+	// their daily budget; nil counts nothing
+	costs *costs
+}
+
+// NewMessagePipeline creates a pipeline replying through sender
+func NewMessagePipeline(opts PipelineOptions, sender ChannelSender, chatCfg config.ChatConfig, messages *Messages, difyCfg config.DifyConfig, difyHandler *DifyHandler, kv store.Store, dispatcher *events.Dispatcher) *MessagePipeline {
+	p := &MessagePipeline{
+		opts:          opts,
+		chat:          chatCfg,
+		messages:      messages,
+		hooks:         NewMessageHooks(chatCfg.Hooks),
+		sender:        sender,
+		difyHandler:   difyHandler,
+		store:         kv,
+		events:        dispatcher,
+		streamTimeout: difyCfg.StreamTimeout,
+		queues:        newUserQueues(chatCfg.MaxQueuedMessages),
+	}
+	if chatCfg.Debounce > 0 {
+		p.debounce = newDebouncer(chatCfg, p.queues, p.handle)
+	}
+	if chatCfg.SendRetryWindow > 0 {
+		p.outbox = &outbox{
+			channel: opts.Channel,
+			sender:  sender,
+			store:   kv,
+			window:  chatCfg.SendRetryWindow,
+			events:  dispatcher,
+			record:  p.recordReply,
+		}
+	}
+	if chatCfg.DurableInbox {
+		p.inbox = &inbox{
+			channel:  opts.Channel,
+			store:    kv,
+			instance: inboxInstance,
+			handle:   p.Handle,
+			active:   make(map[string]bool),
+		}
+	}
+	return p
+}
+
+// resume starts the background work of the pipeline: retrying queued
+// replies and answering messages left by an earlier run of the gateway
+func (p *MessagePipeline) resume(log *logrus.Logger) {
+	p.outbox.run(log)
+	p.inbox.run(log)
+}
+
+// Accept answers msg in the background. Its place in the user's queue is
+// taken before returning, so a user's messages are answered in the order
+// they were accepted. With DIFYGATE_DURABLE_INBOX, msg is saved first, so
+// it is answered even if the process stops before the reply, and
+// redeliveries of it are dropped; call Accept before acknowledging the
+// webhook.
+func (p *MessagePipeline) Accept(log *logrus.Entry, msg ChannelMessage) {
+	if p.inbox == nil || msg.ReplyTo == "" {
+		go p.Enqueue(log, msg)()
+		return
+	}
+	key, ok := p.inbox.add(log, msg)
+	if !ok {
+		return
+	}
+	answer := p.Enqueue(log, msg)
+	go func() {
+		answer()
+		p.inbox.done(log, key)
+	}()
+}
+
+// replaying returns a copy of p answering replayed messages through sender,
+// one at a time with p's own messages. A dry run records no history,
+// publishes no events, queues no retries and acknowledges nothing.
+func (p *MessagePipeline) replaying(sender ChannelSender, dryRun bool) *MessagePipeline {
+	r := *p
+	r.sender = sender
+	// Replays are answered as they come, not saved for recovery
+	r.inbox = nil
+	r.debounce = nil
+	if dryRun {
+		r.opts.History = nil
+		r.opts.Acknowledge = nil
+		r.events = nil
+		r.outbox = nil
+	}
+	return &r
+}
+
+// queryTruncatedNotice ends queries cut to DIFYGATE_MAX_QUERY_LENGTH, so the
+// Dify app knows it only has the start of the message
+const queryTruncatedNotice = "\n\n[message truncated]"
+
+// limitQuery applies the query length limit to text, counting runes; ok is
+// false when the message should be rejected rather than sent
+func limitQuery(cfg config.ChatConfig, text string) (query string, ok bool) {
+	if cfg.MaxQueryLength <= 0 || utf8.RuneCountInString(text) <= cfg.MaxQueryLength {
+		return text, true
+	}
+	if cfg.QueryLengthMode == config.QueryLengthReject {
+		return "", false
+	}
+	return string([]rune(text)[:cfg.MaxQueryLength]) + queryTruncatedNotice, true
+}
+
+// languageInput is the Dify input the sender's language is passed in
+const languageInput = "detected_language"
+
+// languageTagPattern matches the language codes /lang accepts, e.g. de or
+// pt-br
+var languageTagPattern = regexp.MustCompile(`^[a-z]{2,3}(-[a-z0-9]{2,8})?$`)
+
+// languageCommand returns the argument of a /lang command
+func languageCommand(text string) (string, bool) {
+	return commandArg(text, "/lang")
+}
+
+// commandArg returns the argument of the command name when text is one
+func commandArg(text, name string) (string, bool) {
+	fields := strings.Fields(text)
+	if len(fields) == 0 || strings.ToLower(fields[0]) != name {
+		return "", false
+	}
+	return strings.Join(fields[1:], " "), true
+}
+
+// pipelineCommand handles a slash command instead of asking Dify
+type pipelineCommand func(p *MessagePipeline, ctx context.Context, t *messageTrace, msg ChannelMessage)
+
+// pipelineCommands are the commands users can send on any channel
+var pipelineCommands = map[string]pipelineCommand{
+	"/reset": (*MessagePipeline).resetConversation,
+	"/new":   (*MessagePipeline).resetConversation,
+	"/help":  (*MessagePipeline).help,
+}
+
+// Enqueue takes msg's place in its user's queue and returns the function
+// answering it, for callers to run in the background. Taking the place
+// first keeps a user's messages in the order they came in. With
+// DIFYGATE_MESSAGE_DEBOUNCE, the answer of a message joined with earlier
+// ones returns once they are answered together.
+func (p *MessagePipeline) Enqueue(log *logrus.Entry, msg ChannelMessage) (answer func()) {
+	if p.debounce != nil {
+		return p.debounce.add(log, p.conversationKey(msg), msg)
+	}
+	ticket := p.queues.reserve(p.conversationKey(msg))
+	return func() { p.handle(log, msg, ticket) }
+}
+
+// Handle answers msg; it blocks until the reply is sent. Callers running
+// it in a goroutine use Enqueue or Accept instead, to keep the order of a
+// user's messages.
+func (p *MessagePipeline) Handle(log *logrus.Entry, msg ChannelMessage) {
+	p.Enqueue(log, msg)()
+}
+
+// handle answers msg once ticket's turn comes; a nil ticket means the
+// user's queue was full
+func (p *MessagePipeline) handle(log *logrus.Entry, msg ChannelMessage, ticket *queueTicket) {
+	if ticket != nil {
+		defer ticket.release()
+	}
+	t := newMessageTrace(log.WithFields(logrus.Fields{"channel": p.opts.Channel, "user_id": msg.UserID}))
+	defer t.summarize()
+	defer p.activity.message(p.opts.Channel, msg.UserID, t)
+	defer p.costs.record(p.opts.Channel, msg.UserID, t)
+	log = t.log
+	// Work left before a restart resumes with the first message
+	p.resume(log.Logger)
+
+	// A spammer's messages are neither acknowledged nor queued
+	if p.abuse != nil && p.handleAbuse(t, msg) {
+		return
+	}
+
+	if ticket == nil {
+		t.outcome = outcomeBusy
+		log.WithField("max_queued", p.chat.MaxQueuedMessages).Info("Rejecting message while earlier ones are answered")
+		p.notify(t, msg, p.messages.Get(p.locale(msg), config.MsgBusy))
+		return
+	}
+	// The timeout starts once the user's earlier messages are answered
+	ticket.wait()
+
+	// Acknowledged once taken up, so a slow acknowledgment can't hold up
+	// the user's queue
+	if p.opts.Acknowledge != nil {
+		ackCtx := withLogger(context.Background(), log)
+		p.opts.Acknowledge(ackCtx, msg, false)
+		defer func() {
+			if (t.outcome == outcomeAnswered || t.outcome == outcomeCommand || t.outcome == outcomeCanned || t.outcome == outcomeCached) && !t.queued {
+				p.opts.Acknowledge(ackCtx, msg, true)
+			}
+		}()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.streamTimeout)
+	defer cancel()
+	ctx = withLogger(ctx, log)
+
+	p.publish(log, config.EventMessageReceived, msg, msg.Text, "", msg.ReplyTo, "")
+	p.opts.History.Record(history.Record{
+		ID:        msg.ReplyTo,
+		Channel:   p.opts.Channel,
+		UserID:    msg.UserID,
+		Direction: history.Inbound,
+		Text:      msg.Text,
+		Status:    history.StatusReceived,
+	})
+
+	if err := p.hooks.runInbound(ctx, &msg); err != nil {
+		if errors.Is(err, ErrDropMessage) {
+			t.outcome = outcomeDropped
+			log.Info("Message dropped by inbound hook")
+			return
+		}
+		t.outcome = outcomeFailed
+		ref := newErrorRef()
+		log.WithError(err).WithField("error_ref", ref).Error("Inbound message hook failed")
+		p.notify(t, msg, p.messages.Error(p.locale(msg), config.MsgError, ref))
+		return
+	}
+
+	if p.optOut != nil && p.handleOptOut(t, msg) {
+		return
+	}
+
+	if p.handoff != nil && p.handleHandoff(t, msg) {
+		return
+	}
+
+	if cmd, ok := pipelineCommands[strings.ToLower(strings.TrimSpace(msg.Text))]; ok {
+		t.outcome = outcomeCommand
+		cmd(p, ctx, t, msg)
+		return
+	}
+	if p.transcripts != nil {
+		if arg, ok := commandArg(msg.Text, "/transcript"); ok {
+			t.outcome = outcomeCommand
+			p.emailTranscript(t, msg, arg)
+			return
+		}
+	}
+
+	locale := p.locale(msg)
+	inputs := map[string]interface{}{}
+	if p.opts.Inputs != nil {
+		inputs = mergeInputs(p.opts.Inputs(msg))
+	}
+	if arg, ok := languageCommand(msg.Text); ok {
+		t.outcome = outcomeCommand
+		p.setLanguage(t, msg, arg)
+		return
+	}
+	if p.chat.LanguageHints {
+		if lang := p.language(log, msg); lang != "" {
+			inputs[languageInput] = lang
+		}
+	}
+
+	query, ok := limitQuery(p.chat, msg.Text)
+	if !ok {
+		t.outcome = outcomeRejected
+		log.WithField("length", utf8.RuneCountInString(msg.Text)).Info("Rejecting message over the query length limit")
+		p.notify(t, msg, p.messages.QueryTooLong(locale, p.chat.MaxQueryLength))
+		return
+	}
+	if query != msg.Text {
+		log.WithField("length", utf8.RuneCountInString(msg.Text)).Info("Truncating message to the query length limit")
+	}
+
+	if rule, ok := p.canned.match(log, msg.Text); ok {
+		p.answerCanned(t, msg, rule)
+		return
+	}
+
+	if err := p.sender.SendTyping(ctx, msg); err != nil {
+		log.WithError(err).Debug("Failed to send typing indicator")
+	}
+
+	conversationKey := p.conversationKey(msg)
+	conversationID, err := p.store.Get(conversationKey)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		log.WithError(err).Warn("Failed to load conversation, starting a new one")
+	}
+	t.setIDs(string(conversationID), "", "")
+	log = t.log
+
+	// Only a question starting a conversation has an answer independent of
+	// the chat; failing to load the conversation doesn't mean there is none
+	stateless := p.cache != nil && errors.Is(err, store.ErrNotFound)
+	if stateless {
+		if answer, ok := p.cache.lookup(log, p.opts.Channel, query, inputs, false); ok {
+			p.answerCached(t, msg, answer)
+			return
+		}
+	}
+
+	if p.handleBudget(t, msg, locale) {
+		return
+	}
+
+	log.WithField("query", query).Info("Sending request to Dify")
+	t.difyStart = time.Now()
+	respChan, errChan := p.difyHandler.DifyChatMessageStreaming(ctx, DifyChatMessageRequest{
+		Inputs:         inputs,
+		Query:          query,
+		User:           p.difyUser(log, msg),
+		ConversationID: string(conversationID),
+	})
+
+	// pending is accumulated but not yet sent; full is the whole answer
+	var pending, full strings.Builder
+	difyConversationID, difyMessageID := string(conversationID), ""
+	// An answer with files isn't cached, as the files aren't
+	withFiles := false
+	// speech is the audio of the answer, for SendVoice
+	var speech []byte
+	speechTooLong := false
+
+	// sent counts partial replies, lastSent paces incremental ones
+	sent, lastSent := 0, time.Now()
+	sendPartial := func(text string) {
+		text = sanitizeAnswer(p.chat.Sanitize, text, false)
+		if text == "" {
+			return
+		}
+		p.reply(t, Reply{Message: msg, Text: text, Answer: true, First: sent == 0})
+		sent++
+		lastSent = time.Now()
+	}
+	// endSegment sends a finished chatflow segment as a message of its own;
+	// past the message cap it is kept, a paragraph apart, for the final
+	// reply
+	endSegment := func() {
+		text := strings.TrimSpace(pending.String())
+		if p.chat.Segments != config.SegmentsSplit || text == "" {
+			return
+		}
+		pending.Reset()
+		if sent >= p.chat.ReplyMaxMessages-1 {
+			pending.WriteString(text + "\n\n")
+			return
+		}
+		log.WithField("length", len(text)).Debug("Sending answer segment")
+		sendPartial(text)
+	}
+
+	// ack fires once if Dify is slow to start answering; it is stopped by
+	// the first part of the answer
+	var ack <-chan time.Time
+	if p.chat.AckDelay > 0 {
+		timer := time.NewTimer(p.chat.AckDelay)
+		defer timer.Stop()
+		ack = timer.C
+	}
+
+	// Users get the catalog message and a reference; the details are logged
+	fail := func(key string, err error) {
+		chatFailures.Inc(p.opts.Channel, key)
+		t.failure = key
+		var apiErr *DifyAPIError
+		if errors.As(err, &apiErr) && apiErr.Code != "" {
+			t.failure = "dify:" + apiErr.Code
+		}
+		ref := newErrorRef()
+		switch key {
+		case config.MsgContentBlocked:
+			t.outcome = outcomeBlocked
+			log.WithError(err).WithField("error_ref", ref).Info("Dify refused to answer")
+		case config.MsgTimeout:
+			t.outcome = outcomeTimeout
+			log.WithError(err).WithField("error_ref", ref).Error("Error in Dify streaming response")
+		default:
+			t.outcome = outcomeFailed
+			log.WithError(err).WithField("error_ref", ref).Error("Error in Dify streaming response")
+		}
+		// Starting over failed too; the next message shouldn't try the
+		// conversation Dify no longer has
+		if errors.Is(err, ErrConversationReset) {
+			if err := p.store.Delete(conversationKey); err != nil {
+				log.WithError(err).Warn("Failed to forget the stale conversation")
+			}
+		}
+		p.publish(log, config.EventMessageFailed, msg, msg.Text, difyConversationID, difyMessageID, err.Error())
+		p.notify(t, msg, p.messages.Error(locale, key, ref))
+	}
+	finish := func() {
+		log.Info("Dify response stream completed")
+		if difyConversationID != "" && difyConversationID != string(conversationID) {
+			if err := p.store.Set(conversationKey, []byte(difyConversationID), p.opts.ConversationTTL); err != nil {
+				log.WithError(err).Warn("Failed to save conversation")
+			}
+		}
+		// Hooks may still add to the end of an answer already sent in full
+		if text := sanitizeAnswer(p.chat.Sanitize, pending.String(), true); text != "" || sent > 0 {
+			log.WithField("final_response", text).Info("Sending final response")
+			p.reply(t, Reply{Message: msg, Text: text, Answer: true, First: sent == 0, Last: true})
+		}
+		if full.Len() > 0 {
+			answer := sanitizeAnswer(p.chat.Sanitize, full.String(), true)
+			if stateless && !withFiles {
+				p.cache.add(log, query, inputs, answer)
+			}
+			p.publish(log, config.EventMessageAnswered, msg, answer, difyConversationID, difyMessageID, "")
+		}
+		if len(speech) > 0 && !speechTooLong {
+			p.sendVoice(t, msg, speech)
+		}
+	}
+
+	// idle flushes the pending text when Dify pauses; it is reset on every
+	// pass of the loop
+	idle := time.NewTimer(idleFlushInterval)
+	defer idle.Stop()
+
+	for {
+		if !idle.Stop() {
+			select {
+			case <-idle.C:
+			default:
+			}
+		}
+		idle.Reset(idleFlushInterval)
+
+		select {
+		case err, ok := <-errChan:
+			if !ok {
+				errChan = nil
+				continue
+			}
+			fail(errorMessageKey(err), err)
+			return
+
+		case resp, ok := <-respChan:
+			if !ok {
+				// errChan closes first, so a pending error is already queued
+				if errChan != nil {
+					if err, ok := <-errChan; ok {
+						fail(errorMessageKey(err), err)
+						return
+					}
+				}
+				finish()
+				return
+			}
+
+			log.WithFields(logrus.Fields{
+				"event":  resp.Event,
+				"answer": resp.Answer,
+				"id":     resp.ID,
+			}).Debug("Received Dify response chunk")
+
+			if resp.ConversationID != "" {
+				difyConversationID = resp.ConversationID
+			}
+			if resp.MessageID != "" {
+				difyMessageID = resp.MessageID
+			}
+			t.observe(resp)
+			log = t.log
+
+			switch resp.Event {
+			case "message_start":
+				pending.Reset()
+				full.Reset()
+			case "message", "agent_message":
+				if resp.Answer != "" {
+					ack = nil
+				}
+				pending.WriteString(resp.Answer)
+				full.WriteString(resp.Answer)
+				p.splitSegments(&pending, &full, endSegment)
+
+				// Reasoning goes as soon as its block closes, so the cut
+				// below can't land inside it
+				if text, stripped := pending.String(), stripThinkBlocks(p.chat.Sanitize, pending.String()); stripped != text {
+					pending.Reset()
+					pending.WriteString(stripped)
+				}
+
+				if p.sendIncrementally(sent, lastSent, pending.Len()) {
+					text := pending.String()
+					stable := text[:p.stableLength(text)]
+					if cut := sentenceBoundary(stable); cut >= p.chat.ReplyMinChunk {
+						log.WithField("length", cut).Debug("Sending incremental response")
+						sendPartial(text[:cut])
+						pending.Reset()
+						pending.WriteString(strings.TrimLeft(text[cut:], " \n"))
+					}
+				}
+			case "message_replace":
+				// Output moderation rewrote the answer: the replacement is
+				// all of it. Parts already sent can't be taken back, so a
+				// correction comes before it.
+				ack = nil
+				pending.Reset()
+				full.Reset()
+				pending.WriteString(resp.Answer)
+				full.WriteString(resp.Answer)
+				chatAnswersReplaced.Inc(p.opts.Channel)
+				log.WithField("sent_parts", sent).Warn("Dify moderation replaced the answer")
+				if sent > 0 {
+					p.notify(t, msg, p.messages.Get(locale, config.MsgAnswerReplaced))
+				}
+			case "tts_message":
+				if p.opts.SendVoice == nil || resp.Audio == "" || speechTooLong {
+					break
+				}
+				chunk, err := base64.StdEncoding.DecodeString(resp.Audio)
+				if err != nil {
+					log.WithError(err).Warn("Skipping an undecodable Dify speech chunk")
+					break
+				}
+				if len(speech)+len(chunk) > maxVoiceReplyBytes {
+					log.WithField("max_bytes", maxVoiceReplyBytes).Warn("Dify speech is too long to send, sending the text only")
+					speechTooLong, speech = true, nil
+					break
+				}
+				speech = append(speech, chunk...)
+			case "node_finished":
+				// Each Answer node of a chatflow streams a segment
+				if resp.Data != nil && resp.Data.NodeType == "answer" {
+					endSegment()
+				}
+			case "message_file":
+				if resp.URL != "" && resp.BelongsTo != "user" {
+					ack = nil
+					withFiles = true
+					media := ChannelAttachment{Type: resp.Type, URL: resp.URL}
+					if err := p.sender.SendMedia(ctx, msg, media); err != nil {
+						log.WithError(err).Error("Failed to send Dify file")
+					}
+				}
+			case "message_end":
+				finish()
+				return
+			case "error":
+				apiErr := resp.apiError()
+				fail(errorMessageKey(apiErr), apiErr)
+				return
+			}
+
+		case <-ctx.Done():
+			log.Warn("Context canceled or timed out while processing Dify response")
+			fail(config.MsgTimeout, ctx.Err())
+			return
+
+		case <-ack:
+			ack = nil
+			// An incremental reply already told the user the answer is coming
+			if sent == 0 {
+				p.acknowledge(t, msg, locale)
+			}
+
+		case <-idle.C:
+			text := pending.String()
+			if stable := p.stableLength(text); stable >= idleFlushMinChunk {
+				log.WithField("timeout_response", text[:stable]).Info("Sending response after timeout")
+				sendPartial(text[:stable])
+				pending.Reset()
+				pending.WriteString(text[stable:])
+			}
+		}
+	}
+}
+
+// sendVoice sends the speech of an answer after its text
+func (p *MessagePipeline) sendVoice(t *messageTrace, msg ChannelMessage, audio []byte) {
+	if err := p.opts.SendVoice(context.Background(), msg, audio); err != nil {
+		t.log.WithError(err).Error("Failed to send the voice reply")
+		return
+	}
+	chatVoiceReplies.Inc(p.opts.Channel)
+	t.log.WithField("audio_bytes", len(audio)).Info("Voice reply sent")
+}
+
+// acknowledge tells the user their answer is coming, with the next of the
+// ack message's variants
+func (p *MessagePipeline) acknowledge(t *messageTrace, msg ChannelMessage, locale string) {
+	var variants []string
+	for _, line := range strings.Split(p.messages.Get(locale, config.MsgAck), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			variants = append(variants, line)
+		}
+	}
+	if len(variants) == 0 {
+		return
+	}
+	n, err := p.store.Incr(p.ackKey(msg), ackRotationTTL)
+	if err != nil {
+		t.log.WithError(err).Warn("Failed to pick the ack variant")
+		n = 1
+	}
+	chatAcks.Inc(p.opts.Channel)
+	t.log.WithField("ack_delay", p.chat.AckDelay.String()).Info("Dify is slow to answer, sending an ack")
+	p.notify(t, msg, variants[(n-1)%int64(len(variants))])
+}
+
+// splitSegments ends a segment at each SegmentDelimiter in pending, leaving
+// the text after the last one; in full the delimiter becomes a paragraph
+// break. A delimiter still arriving stays in pending until it is whole.
+func (p *MessagePipeline) splitSegments(pending, full *strings.Builder, endSegment func()) {
+	delim := p.chat.SegmentDelimiter
+	if p.chat.Segments != config.SegmentsSplit || delim == "" {
+		return
+	}
+	if text := full.String(); strings.Contains(text, delim) {
+		full.Reset()
+		full.WriteString(strings.ReplaceAll(text, delim, "\n\n"))
+	}
+	for {
+		text := pending.String()
+		i := strings.Index(text, delim)
+		if i < 0 {
+			return
+		}
+		pending.Reset()
+		pending.WriteString(text[:i])
+		endSegment()
+		// A segment kept for the final reply is still in pending
+		rest := pending.String()
+		pending.Reset()
+		pending.WriteString(rest + text[i+len(delim):])
+	}
+}
+
+// stableLength is how much of a partly streamed answer can be sent: its
+// stableAnswerLength, short of the start of a SegmentDelimiter still
+// arriving
+func (p *MessagePipeline) stableLength(text string) int {
+	stable := stableAnswerLength(p.chat.Sanitize, text)
+	if delim := p.chat.SegmentDelimiter; p.chat.Segments == config.SegmentsSplit {
+		for n := len(delim) - 1; n > 0; n-- {
+			if strings.HasSuffix(text, delim[:n]) {
+				return min(stable, len(text)-n)
+			}
+		}
+	}
+	return stable
+}
+
+// sendIncrementally reports whether enough has accumulated, for long
+// enough, to send part of the answer now; the last allowed message is kept
+// for the final reply
+func (p *MessagePipeline) sendIncrementally(sent int, lastSent time.Time, pending int) bool {
+	return p.chat.ReplyMode == config.ReplyModeIncremental &&
+		sent < p.chat.ReplyMaxMessages-1 &&
+		pending >= p.chat.ReplyMinChunk &&
+		time.Since(lastSent) >= p.chat.ReplyMinInterval
+}
+
+// sentenceBoundary returns the byte offset just past the last paragraph,
+// line or sentence end in s, or 0 if there is none
+func sentenceBoundary(s string) int {
+	cut := 0
+	for i, r := range s {
+		size := utf8.RuneLen(r)
+		switch r {
+		case '\n', '。', '！', '？':
+			cut = i + size
+		case '.', '!', '?':
+			// Only at the end of a sentence, not in 3.5 or example.com
+			if next := i + size; next < len(s) && (s[next] == ' ' || s[next] == '\n') {
+				cut = next
+			}
+		}
+	}
+	return cut
+}
+
+// reply runs the outbound hooks, formats the text for the channel and sends
+// it in as many messages as needed, independently of the (possibly expired)
+// Dify context
+func (p *MessagePipeline) reply(t *messageTrace, r Reply) {
+	log := t.log
+	ctx := withLogger(context.Background(), log)
+	if err := p.hooks.runOutbound(ctx, &r); err != nil {
+		if errors.Is(err, ErrDropMessage) {
+			log.Info("Reply dropped by outbound hook")
+		} else {
+			log.WithError(err).Error("Outbound message hook failed, reply not sent")
+		}
+		return
+	}
+	if strings.TrimSpace(r.Text) == "" {
+		return
+	}
+
+	text := r.Text
+	if p.opts.Format != nil {
+		text = p.opts.Format(r.Message, text)
+	}
+	chunks := splitMessage(text, p.opts.MaxMessageLength)
+	// Once a reply is queued, the rest of the answer queues behind it
+	if t.queued {
+		p.outbox.enqueue(log, r.Message, chunks, errors.New("an earlier reply is queued"))
+		return
+	}
+	for i, chunk := range chunks {
+		id, err := p.sender.SendText(ctx, r.Message, chunk)
+		p.recordReply(r.Message, id, chunk, err)
+		if err != nil {
+			if p.outbox != nil && retryableSend(err) {
+				log.WithError(err).Warn("Failed to send reply")
+				p.outbox.enqueue(log, r.Message, chunks[i:], err)
+				t.queued = true
+				return
+			}
+			log.WithError(err).Error("Failed to send reply")
+			return
+		}
+		t.sent(id)
+	}
+}
+
+// recordReply adds a sent (or failed) reply to the message history
+func (p *MessagePipeline) recordReply(msg ChannelMessage, id, text string, err error) {
+	rec := history.Record{
+		ID:        id,
+		Channel:   p.opts.Channel,
+		UserID:    msg.UserID,
+		Direction: history.Outbound,
+		Text:      text,
+		ReplyTo:   msg.ReplyTo,
+		Status:    history.StatusSent,
+	}
+	if err != nil {
+		rec.Status = history.StatusFailed
+		rec.Error = err.Error()
+	}
+	p.opts.History.Record(rec)
+}
+
+// notify sends a gateway message, e.g. an error or a command reply
+func (p *MessagePipeline) notify(t *messageTrace, msg ChannelMessage, text string) {
+	p.reply(t, Reply{Message: msg, Text: text})
+}
+
+// conversationKey is the store key mapping a chat to its Dify conversation
+func (p *MessagePipeline) conversationKey(msg ChannelMessage) string {
+	if p.opts.ConversationKey != nil {
+		return p.opts.ConversationKey(msg)
+	}
+	return p.opts.Channel + ":conversation:" + msg.ChannelID + ":" + msg.UserID
+}
+
+// languageKey is the store key of the language a user picked with /lang
+func (p *MessagePipeline) languageKey(msg ChannelMessage) string {
+	return p.opts.Channel + ":language:" + msg.ChannelID + ":" + msg.UserID
+}
+
+// ackKey is the store key of the ack variant a user was sent last
+func (p *MessagePipeline) ackKey(msg ChannelMessage) string {
+	return p.opts.Channel + ":ack:" + msg.ChannelID + ":" + msg.UserID
+}
+
+// language returns the language to tell Dify the sender writes in: the one
+// they picked with /lang, the one their message is detected as, or the
+// channel's hint, in that order
+func (p *MessagePipeline) language(log *logrus.Entry, msg ChannelMessage) string {
+	picked, err := p.store.Get(p.languageKey(msg))
+	if err == nil {
+		return string(picked)
+	}
+	if !errors.Is(err, store.ErrNotFound) {
+		log.WithError(err).Warn("Failed to load the user's language")
+	}
+	if lang := detectLanguage(msg.Text); lang != "" {
+		return lang
+	}
+	if p.opts.LanguageHint != nil {
+		return p.opts.LanguageHint(msg)
+	}
+	return ""
+}
+
+// difyUser is the user Dify keeps the chat's conversations under
+func (p *MessagePipeline) difyUser(log *logrus.Entry, msg ChannelMessage) string {
+	fallback := p.opts.Channel + ":" + msg.UserID
+	if p.opts.DifyUser != nil {
+		fallback = p.opts.DifyUser(msg)
+	}
+	name := p.difyHandler.users.name(p.opts.Channel, msg.UserID, fallback)
+	p.difyHandler.users.remember(log, p.store, p.opts.Channel, msg.UserID, name)
+	return name
+}
+
+// locale picks the language of gateway messages to the sender of msg: the
+// one they picked with /lang, the one the platform reports, the one their
+// message is detected as or the default, in that order. The pick is looked
+// up in the store each time, so it holds on every instance; if the store
+// fails, the next one applies.
+func (p *MessagePipeline) locale(msg ChannelMessage) string {
+	if picked, err := p.store.Get(p.languageKey(msg)); err == nil {
+		return p.messages.Match(string(picked))
+	}
+	if msg.Locale != "" {
+		return p.messages.Match(msg.Locale)
+	}
+	return p.messages.Locale(msg.Text)
+}
+
+// resetConversation makes the user's next message start a new conversation
+func (p *MessagePipeline) resetConversation(ctx context.Context, t *messageTrace, msg ChannelMessage) {
+	locale := p.locale(msg)
+	if err := p.store.Delete(p.conversationKey(msg)); err != nil {
+		ref := newErrorRef()
+		t.log.WithError(err).WithField("error_ref", ref).Error("Failed to reset conversation")
+		p.notify(t, msg, p.messages.Error(locale, config.MsgError, ref))
+		return
+	}
+	t.log.Info("Conversation reset by user")
+	p.notify(t, msg, p.messages.Get(locale, config.MsgConversationReset))
+}
+
+// setLanguage handles /lang: a language code fixes the language of gateway
+// messages and, with language hints, the one Dify is told; auto goes back
+// to detecting it. Without hints only languages with translated messages
+// can be picked, as nothing else would change.
+func (p *MessagePipeline) setLanguage(t *messageTrace, msg ChannelMessage, arg string) {
+	locale := p.locale(msg)
+	lang := strings.ToLower(arg)
+	var err error
+	var text string
+	switch {
+	case lang == "auto":
+		err = p.store.Delete(p.languageKey(msg))
+		text = p.messages.Get(p.locale(msg), config.MsgLanguageAuto)
+	case languageTagPattern.MatchString(lang) && (p.chat.LanguageHints || p.messages.Has(lang)):
+		err = p.store.Set(p.languageKey(msg), []byte(lang), 0)
+		locale = p.messages.Match(lang)
+		text = strings.ReplaceAll(p.messages.Get(locale, config.MsgLanguageSet), "{lang}", lang)
+	default:
+		text = p.messages.Get(locale, config.MsgLanguageInvalid)
+	}
+	if err != nil {
+		ref := newErrorRef()
+		t.log.WithError(err).WithField("error_ref", ref).Error("Failed to save the user's language")
+		p.notify(t, msg, p.messages.Error(locale, config.MsgError, ref))
+		return
+	}
+	t.log.WithField("language", lang).Info("Language set by user")
+	p.notify(t, msg, text)
+}
+
+// help lists the commands
+func (p *MessagePipeline) help(ctx context.Context, t *messageTrace, msg ChannelMessage) {
+	p.notify(t, msg, p.messages.Get(p.locale(msg), config.MsgHelp))
+}
+
+// publish notifies outgoing webhooks about a message on this channel
+func (p *MessagePipeline) publish(log *logrus.Entry, eventType string, msg ChannelMessage, text, conversationID, messageID, errMsg string) {
+	p.events.Publish(events.Event{
+		Type:           eventType,
+		Channel:        p.opts.Channel,
+		UserID:         msg.UserID,
+		ConversationID: conversationID,
+		MessageID:      messageID,
+		Text:           text,
+		Error:          errMsg,
+		RequestID:      requestIDFromLogger(log),
+	})
+}
@@ -0,0 +1,698 @@
+package gateapi
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/config"
+	"github.com/tracoco/DifyGate/history"
+	"github.com/tracoco/DifyGate/store"
+)
+
+// fakeSender records what a pipeline sends
+type fakeSender struct {
+	mu    sync.Mutex
+	texts []string
+}
+
+func (s *fakeSender) SendText(ctx context.Context, msg ChannelMessage, text string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.texts = append(s.texts, text)
+	return "sent-" + text, nil
+}
+
+func (s *fakeSender) SendTyping(ctx context.Context, msg ChannelMessage) error {
+	return nil
+}
+
+func (s *fakeSender) SendMedia(ctx context.Context, msg ChannelMessage, media ChannelAttachment) error {
+	return nil
+}
+
+// sent returns the texts sent so far and forgets them
+func (s *fakeSender) sent() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	texts := s.texts
+	s.texts = nil
+	return texts
+}
+
+// newTestPipeline creates a pipeline answering through a fake Dify
+func newTestPipeline(t *testing.T, opts PipelineOptions, chatCfg config.ChatConfig, answer func(ChatMessageRequest) []StreamingChatResponse) (*MessagePipeline, *fakeSender, *fakeDify, store.Store) {
+	t.Helper()
+	dify, difyHandler := newFakeDify(t, answer)
+	kv := store.New("", quietLogger())
+	sender := &fakeSender{}
+	if opts.MaxMessageLength == 0 {
+		opts.MaxMessageLength = 1000
+	}
+	p := NewMessagePipeline(opts, sender, chatCfg, NewMessages(config.MessagesConfig{}), config.DifyConfig{StreamTimeout: 5 * time.Second}, difyHandler, kv, nil)
+	return p, sender, dify, kv
+}
+
+func testEntry() *logrus.Entry {
+	return logrus.NewEntry(quietLogger())
+}
+
+func TestPipelineAnswersAndContinuesConversation(t *testing.T) {
+	p, sender, dify, kv := newTestPipeline(t, PipelineOptions{Channel: "test", ConversationTTL: time.Hour}, config.ChatConfig{},
+		func(req ChatMessageRequest) []StreamingChatResponse {
+			return difyAnswer("conv-1", "Hello ", "there.")
+		})
+	msg := ChannelMessage{ChannelID: "bot", UserID: "u1", Text: "hi"}
+
+	p.Handle(testEntry(), msg)
+	if got := sender.sent(); len(got) != 1 || got[0] != "Hello there." {
+		t.Fatalf("sent %q, want one answer", got)
+	}
+	if id, err := kv.Get("test:conversation:bot:u1"); err != nil || string(id) != "conv-1" {
+		t.Fatalf("stored conversation %q, %v", id, err)
+	}
+
+	p.Handle(testEntry(), msg)
+	dify.mu.Lock()
+	defer dify.mu.Unlock()
+	if len(dify.requests) != 2 {
+		t.Fatalf("Dify got %d requests, want 2", len(dify.requests))
+	}
+	if first, second := dify.requests[0], dify.requests[1]; first.User != "test:u1" || first.ConversationID != "" || second.ConversationID != "conv-1" {
+		t.Errorf("requests = %+v, want user test:u1 continuing conv-1", dify.requests)
+	}
+}
+
+func TestPipelineChannelOptions(t *testing.T) {
+	opts := PipelineOptions{
+		Channel:         "test",
+		ConversationKey: func(msg ChannelMessage) string { return "legacy:" + msg.UserID },
+		DifyUser:        func(msg ChannelMessage) string { return msg.UserID },
+		Format:          func(msg ChannelMessage, text string) string { return strings.ToUpper(text) },
+	}
+	p, sender, dify, kv := newTestPipeline(t, opts, config.ChatConfig{}, func(req ChatMessageRequest) []StreamingChatResponse {
+		return difyAnswer("conv-2", "answer")
+	})
+
+	p.Handle(testEntry(), ChannelMessage{ChannelID: "bot", UserID: "u1", Text: "hi"})
+	if got := sender.sent(); len(got) != 1 || got[0] != "ANSWER" {
+		t.Errorf("sent %q, want the formatted answer", got)
+	}
+	if id, err := kv.Get("legacy:u1"); err != nil || string(id) != "conv-2" {
+		t.Errorf("stored conversation %q, %v under the custom key", id, err)
+	}
+	dify.mu.Lock()
+	if user := dify.requests[0].User; user != "u1" {
+		t.Errorf("Dify user = %q, want u1", user)
+	}
+	dify.mu.Unlock()
+
+	p.Handle(testEntry(), ChannelMessage{ChannelID: "bot", UserID: "u1", Text: "/reset"})
+	if _, err := kv.Get("legacy:u1"); err != store.ErrNotFound {
+		t.Errorf("/reset left the custom conversation key: %v", err)
+	}
+}
+
+func TestPipelineReportsDifyErrors(t *testing.T) {
+	tests := []struct {
+		code, reason, want string
+	}{
+		{"invalid_param", config.MsgError, "Sorry, I couldn't get an answer"},
+		{"content_policy_violation", config.MsgContentBlocked, "Sorry, I can't help with that request."},
+		{"app_unavailable", config.MsgUnavailable, "The assistant is unavailable"},
+		{"provider_quota_exceeded", config.MsgHighDemand, "I'm getting a lot of questions"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.code, func(t *testing.T) {
+			p, sender, _, _ := newTestPipeline(t, PipelineOptions{Channel: "errors-" + tt.code}, config.ChatConfig{}, func(req ChatMessageRequest) []StreamingChatResponse {
+				return []StreamingChatResponse{{Event: "error", Code: tt.code, Message: "bad"}}
+			})
+
+			p.Handle(testEntry(), ChannelMessage{ChannelID: "bot", UserID: "u1", Text: "hi"})
+			if got := sender.sent(); len(got) != 1 || !strings.HasPrefix(got[0], tt.want) {
+				t.Errorf("sent %q, want %q...", got, tt.want)
+			}
+			if n := chatFailures.Value("errors-"+tt.code, tt.reason); n != 1 {
+				t.Errorf("difygate_chat_failures_total{reason=%q} = %v, want 1", tt.reason, n)
+			}
+		})
+	}
+}
+
+func TestPipelineErrorPaths(t *testing.T) {
+	t.Run("Dify unavailable", func(t *testing.T) {
+		dify := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, `{"code":"internal_server_error"}`, http.StatusInternalServerError)
+		}))
+		defer dify.Close()
+		sender := &fakeSender{}
+		p := NewMessagePipeline(PipelineOptions{Channel: "test", MaxMessageLength: 1000}, sender, config.ChatConfig{}, NewMessages(config.MessagesConfig{}),
+			config.DifyConfig{StreamTimeout: 5 * time.Second}, NewDifyHandler(config.DifyConfig{BaseURL: dify.URL}, &HTTPClients{Dify: dify.Client(), DifyStream: dify.Client()}, quietLogger()), store.New("", quietLogger()), nil)
+
+		p.Handle(testEntry(), ChannelMessage{ChannelID: "bot", UserID: "u1", Text: "hi"})
+		if got := sender.sent(); len(got) != 1 || !strings.HasPrefix(got[0], "Sorry") {
+			t.Errorf("sent %q, want the error message", got)
+		}
+	})
+
+	t.Run("answer never ends", func(t *testing.T) {
+		_, difyHandler := newFakeDify(t, func(req ChatMessageRequest) []StreamingChatResponse {
+			return []StreamingChatResponse{{Event: "message_start", ConversationID: "conv-1"}, {Event: "message", Answer: "Hel", ConversationID: "conv-1"}}
+		})
+		sender := &fakeSender{}
+		kv := store.New("", quietLogger())
+		p := NewMessagePipeline(PipelineOptions{Channel: "test", MaxMessageLength: 1000}, sender, config.ChatConfig{}, NewMessages(config.MessagesConfig{}),
+			config.DifyConfig{StreamTimeout: 100 * time.Millisecond}, difyHandler, kv, nil)
+
+		p.Handle(testEntry(), ChannelMessage{ChannelID: "bot", UserID: "u1", Text: "hi"})
+		if got := sender.sent(); len(got) != 1 || !strings.Contains(got[0], "too long") {
+			t.Errorf("sent %q, want only the timeout message", got)
+		}
+		if _, err := kv.Get("test:conversation:bot:u1"); err != store.ErrNotFound {
+			t.Errorf("an unfinished answer stored its conversation: %v", err)
+		}
+	})
+}
+
+func TestPipelineKeepsChannelsApart(t *testing.T) {
+	dify, difyHandler := newFakeDify(t, func(req ChatMessageRequest) []StreamingChatResponse {
+		return difyAnswer("conv-"+req.User, "re: "+req.Query)
+	})
+	kv := store.New("", quietLogger())
+	senders := map[string]*fakeSender{"whatsapp": {}, "messenger": {}}
+	pipelines := map[string]*MessagePipeline{}
+	for channel, sender := range senders {
+		pipelines[channel] = NewMessagePipeline(PipelineOptions{Channel: channel, MaxMessageLength: 1000}, sender, config.ChatConfig{}, NewMessages(config.MessagesConfig{}),
+			config.DifyConfig{StreamTimeout: 5 * time.Second}, difyHandler, kv, nil)
+	}
+
+	// The same user ID on two channels is two users, each answered on
+	// their own channel
+	var wg sync.WaitGroup
+	for channel, p := range pipelines {
+		wg.Add(1)
+		go func(channel string, p *MessagePipeline) {
+			defer wg.Done()
+			p.Handle(testEntry(), ChannelMessage{ChannelID: "bot", UserID: "u1", Text: "hi from " + channel})
+		}(channel, p)
+	}
+	wg.Wait()
+	for channel, sender := range senders {
+		if got := sender.sent(); len(got) != 1 || got[0] != "re: hi from "+channel {
+			t.Errorf("%s sent %q, want only its own answer", channel, got)
+		}
+		if id, err := kv.Get(channel + ":conversation:bot:u1"); err != nil || string(id) != "conv-"+channel+":u1" {
+			t.Errorf("%s conversation %q, %v", channel, id, err)
+		}
+	}
+	dify.mu.Lock()
+	defer dify.mu.Unlock()
+	if len(dify.requests) != 2 || dify.requests[0].User == dify.requests[1].User {
+		t.Errorf("requests = %+v, want one per channel user", dify.requests)
+	}
+}
+
+func TestPipelineRepliesInOrder(t *testing.T) {
+	words := strings.Fields("one two three four five six seven eight nine ten eleven twelve")
+	p, sender, _, _ := newTestPipeline(t, PipelineOptions{Channel: "test", MaxMessageLength: 14}, config.ChatConfig{}, func(req ChatMessageRequest) []StreamingChatResponse {
+		var chunks []string
+		for _, word := range words {
+			chunks = append(chunks, word+" ")
+		}
+		return difyAnswer("conv-1", chunks...)
+	})
+
+	p.Handle(testEntry(), ChannelMessage{ChannelID: "bot", UserID: "u1", Text: "count"})
+	got := sender.sent()
+	if len(got) < 2 {
+		t.Fatalf("sent %q, want the answer split", got)
+	}
+	if joined := strings.Fields(strings.Join(got, " ")); strings.Join(joined, " ") != strings.Join(words, " ") {
+		t.Errorf("sent %q, want the words in order", got)
+	}
+}
+
+func TestPipelineSplitsLongReplies(t *testing.T) {
+	p, sender, _, _ := newTestPipeline(t, PipelineOptions{Channel: "test", MaxMessageLength: 10}, config.ChatConfig{}, func(req ChatMessageRequest) []StreamingChatResponse {
+		return difyAnswer("conv-1", "one two three four")
+	})
+
+	p.Handle(testEntry(), ChannelMessage{ChannelID: "bot", UserID: "u1", Text: "hi"})
+	if got := sender.sent(); strings.Join(got, "|") != "one two|three four" {
+		t.Errorf("sent %q, want two messages", got)
+	}
+}
+
+func TestPipelineRejectsLongQueries(t *testing.T) {
+	p, sender, dify, _ := newTestPipeline(t, PipelineOptions{Channel: "test"},
+		config.ChatConfig{MaxQueryLength: 5, QueryLengthMode: config.QueryLengthReject},
+		func(req ChatMessageRequest) []StreamingChatResponse {
+			return difyAnswer("conv-1", "answer")
+		})
+
+	p.Handle(testEntry(), ChannelMessage{ChannelID: "bot", UserID: "u1", Text: "far too long"})
+	if got := sender.sent(); len(got) != 1 || !strings.Contains(got[0], "5") {
+		t.Errorf("sent %q, want the query-too-long message", got)
+	}
+	dify.mu.Lock()
+	defer dify.mu.Unlock()
+	if len(dify.requests) != 0 {
+		t.Errorf("Dify got %d requests for a rejected query", len(dify.requests))
+	}
+}
+
+func TestLimitQuery(t *testing.T) {
+	truncate := config.ChatConfig{MaxQueryLength: 5, QueryLengthMode: config.QueryLengthTruncate}
+	reject := config.ChatConfig{MaxQueryLength: 5, QueryLengthMode: config.QueryLengthReject}
+	tests := []struct {
+		name   string
+		cfg    config.ChatConfig
+		text   string
+		want   string
+		wantOK bool
+	}{
+		{"under the limit", truncate, "abcd", "abcd", true},
+		{"at the limit", truncate, "abcde", "abcde", true},
+		{"one over, truncated", truncate, "abcdef", "abcde" + queryTruncatedNotice, true},
+		{"at the limit in multibyte runes", truncate, "日本語です", "日本語です", true},
+		{"one rune over in multibyte runes", truncate, "日本語ですね", "日本語です" + queryTruncatedNotice, true},
+		{"emoji count as one rune", truncate, "😀😀😀😀😀", "😀😀😀😀😀", true},
+		{"at the limit, reject mode", reject, "abcde", "abcde", true},
+		{"one over, rejected", reject, "abcdef", "", false},
+		{"one rune over, rejected", reject, "日本語ですね", "", false},
+		{"no limit", config.ChatConfig{QueryLengthMode: config.QueryLengthReject}, strings.Repeat("a", 100000), strings.Repeat("a", 100000), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := limitQuery(tt.cfg, tt.text)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("limitQuery(%q) = %q, %v; want %q, %v", tt.text, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestSentenceBoundary(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int
+	}{
+		{"", 0},
+		{"no boundary yet", 0},
+		{"Hello. World", 6},
+		{"A! B? C", 5},
+		{"Version 3.5 is out", 0},
+		{"See example.com for more", 0},
+		{"Ends here.", 0},
+		{"Line one\nline two", 9},
+		{"First.\n\nSecond", 8},
+		{"你好。再见", len("你好。")},
+		{"真的吗？好", len("真的吗？")},
+	}
+	for _, tt := range tests {
+		if got := sentenceBoundary(tt.in); got != tt.want {
+			t.Errorf("sentenceBoundary(%q) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestPipelineIncrementalReplies(t *testing.T) {
+	chatCfg := config.ChatConfig{
+		ReplyMode:        config.ReplyModeIncremental,
+		ReplyMinChunk:    10,
+		ReplyMaxMessages: 3,
+	}
+	p, sender, _, _ := newTestPipeline(t, PipelineOptions{Channel: "test"}, chatCfg, func(req ChatMessageRequest) []StreamingChatResponse {
+		return difyAnswer("conv-1", "First sentence here. ", "Second sentence", " here. ", "Third one. ", "Tail")
+	})
+
+	p.Handle(testEntry(), ChannelMessage{ChannelID: "bot", UserID: "u1", Text: "hi"})
+	want := []string{"First sentence here.", "Second sentence here.", "Third one. Tail"}
+	if got := sender.sent(); strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("sent %q, want %q: each sentence once, capped at 3 messages", got, want)
+	}
+}
+
+func TestPipelineFinalReplyMode(t *testing.T) {
+	p, sender, _, _ := newTestPipeline(t, PipelineOptions{Channel: "test"}, config.ChatConfig{ReplyMode: config.ReplyModeFinal, ReplyMinChunk: 1, ReplyMaxMessages: 5},
+		func(req ChatMessageRequest) []StreamingChatResponse {
+			return difyAnswer("conv-1", "First sentence here. ", "Second sentence here.")
+		})
+
+	p.Handle(testEntry(), ChannelMessage{ChannelID: "bot", UserID: "u1", Text: "hi"})
+	if got := sender.sent(); len(got) != 1 || got[0] != "First sentence here. Second sentence here." {
+		t.Errorf("sent %q, want one final reply", got)
+	}
+}
+
+func TestPipelineRecordsHistory(t *testing.T) {
+	recorder, err := history.New(config.HistoryConfig{Enabled: true, Retention: time.Hour, PruneInterval: time.Hour}, quietLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _, _, _ := newTestPipeline(t, PipelineOptions{Channel: "test", History: recorder}, config.ChatConfig{}, func(req ChatMessageRequest) []StreamingChatResponse {
+		return difyAnswer("conv-1", "answer")
+	})
+
+	p.Handle(testEntry(), ChannelMessage{ChannelID: "bot", UserID: "u1", Text: "hi", ReplyTo: "in-1"})
+	recorder.Close()
+
+	if in, err := recorder.Get("in-1"); err != nil || in.Direction != history.Inbound || in.Text != "hi" {
+		t.Errorf("inbound record = %+v, %v", in, err)
+	}
+	out, err := recorder.Get("sent-answer")
+	if err != nil || out.Direction != history.Outbound || out.ReplyTo != "in-1" || out.Status != history.StatusSent {
+		t.Errorf("outbound record = %+v, %v", out, err)
+	}
+}
+
+func TestPipelineRecoversLostConversation(t *testing.T) {
+	// Dify has lost conv-old; new conversations fail when failNew is set
+	var failNew bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req ChatMessageRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		switch {
+		case req.ConversationID == "conv-old":
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"status":404,"code":"conversation_not_exists","message":"Conversation Not Exists."}`)
+		case failNew:
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"status":400,"code":"invalid_param","message":"bad"}`)
+		default:
+			w.Header().Set("Content-Type", "text/event-stream")
+			for _, event := range difyAnswer("conv-new", "answer") {
+				data, _ := json.Marshal(event)
+				fmt.Fprintf(w, "data: %s\n\n", data)
+			}
+		}
+	}))
+	defer srv.Close()
+	difyHandler := NewDifyHandler(config.DifyConfig{BaseURL: srv.URL}, &HTTPClients{Dify: srv.Client(), DifyStream: srv.Client()}, quietLogger())
+	kv := store.New("", quietLogger())
+	sender := &fakeSender{}
+	p := NewMessagePipeline(PipelineOptions{Channel: "test", MaxMessageLength: 1000}, sender, config.ChatConfig{}, NewMessages(config.MessagesConfig{}),
+		config.DifyConfig{StreamTimeout: 5 * time.Second}, difyHandler, kv, nil)
+	msg := ChannelMessage{ChannelID: "bot", UserID: "u1", Text: "hi"}
+	recovered := difyConversationsRecovered.Value("streaming")
+
+	kv.Set("test:conversation:bot:u1", []byte("conv-old"), 0)
+	p.Handle(testEntry(), msg)
+	if got := sender.sent(); len(got) != 1 || got[0] != "answer" {
+		t.Errorf("sent %q, want the answer from the new conversation", got)
+	}
+	if id, _ := kv.Get("test:conversation:bot:u1"); string(id) != "conv-new" {
+		t.Errorf("stored conversation = %q, want conv-new", id)
+	}
+	if n := difyConversationsRecovered.Value("streaming") - recovered; n != 1 {
+		t.Errorf("recoveries counted = %v, want 1", n)
+	}
+
+	// When starting over fails too, the stale conversation is forgotten
+	failNew = true
+	kv.Set("test:conversation:bot:u1", []byte("conv-old"), 0)
+	p.Handle(testEntry(), msg)
+	if got := sender.sent(); len(got) != 1 || !strings.HasPrefix(got[0], "Sorry") {
+		t.Errorf("sent %q, want the error message", got)
+	}
+	if _, err := kv.Get("test:conversation:bot:u1"); err != store.ErrNotFound {
+		t.Errorf("stale conversation kept after the retry failed: %v", err)
+	}
+}
+
+func TestPipelinePassesLanguageHints(t *testing.T) {
+	opts := PipelineOptions{Channel: "test", LanguageHint: func(msg ChannelMessage) string { return "de" }}
+	p, sender, dify, _ := newTestPipeline(t, opts, config.ChatConfig{LanguageHints: true}, func(req ChatMessageRequest) []StreamingChatResponse {
+		return difyAnswer("conv-1", "answer")
+	})
+	msg := func(text string) ChannelMessage { return ChannelMessage{ChannelID: "bot", UserID: "u1", Text: text} }
+	language := func() interface{} {
+		dify.mu.Lock()
+		defer dify.mu.Unlock()
+		return dify.requests[len(dify.requests)-1].Inputs[languageInput]
+	}
+
+	p.Handle(testEntry(), msg("Comment est-ce que je peux changer le mot de passe?"))
+	if got := language(); got != "fr" {
+		t.Errorf("detected_language = %v, want fr from the text", got)
+	}
+	p.Handle(testEntry(), msg("hi"))
+	if got := language(); got != "de" {
+		t.Errorf("detected_language = %v, want the de hint for a short message", got)
+	}
+
+	sender.sent()
+	p.Handle(testEntry(), msg("/lang it"))
+	if got := sender.sent(); len(got) != 1 || !strings.Contains(got[0], "it") {
+		t.Errorf("/lang replied %q", got)
+	}
+	p.Handle(testEntry(), msg("Comment est-ce que je peux changer le mot de passe?"))
+	if got := language(); got != "it" {
+		t.Errorf("detected_language = %v, want it as picked with /lang", got)
+	}
+
+	p.Handle(testEntry(), msg("/lang auto"))
+	p.Handle(testEntry(), msg("hi"))
+	if got := language(); got != "de" {
+		t.Errorf("detected_language = %v after /lang auto, want the hint again", got)
+	}
+}
+
+func TestPipelineLanguagePickedForMessages(t *testing.T) {
+	p, sender, dify, _ := newTestPipeline(t, PipelineOptions{Channel: "test"}, config.ChatConfig{}, func(req ChatMessageRequest) []StreamingChatResponse {
+		return []StreamingChatResponse{{Event: "error", Status: json.RawMessage("500"), Code: "internal_server_error", Message: "boom"}}
+	})
+	p.messages = NewMessages(config.MessagesConfig{DefaultLocale: config.DefaultLocale, DetectLanguage: true, Catalog: map[string]map[string]string{
+		"de": {config.MsgError: "Fehler ({ref})", config.MsgLanguageSet: "Sprache: {lang}"},
+		"fr": {config.MsgError: "Erreur ({ref})", config.MsgLanguageAuto: "Langue automatique"},
+	}})
+	msg := func(text string) ChannelMessage { return ChannelMessage{ChannelID: "bot", UserID: "u1", Text: text} }
+	reply := func(text string) string {
+		t.Helper()
+		p.Handle(testEntry(), msg(text))
+		got := sender.sent()
+		if len(got) != 1 {
+			t.Fatalf("%q got %q, want one reply", text, got)
+		}
+		return got[0]
+	}
+
+	// Detected from the message, then pinned whatever the user writes in
+	if got := reply("Comment est-ce que je peux changer le mot de passe?"); !strings.HasPrefix(got, "Erreur") {
+		t.Errorf("error %q, want French detected", got)
+	}
+	if got := reply("/lang de"); got != "Sprache: de" {
+		t.Errorf("/lang de replied %q", got)
+	}
+	if got := reply("Comment est-ce que je peux changer le mot de passe?"); !strings.HasPrefix(got, "Fehler") {
+		t.Errorf("error %q, want the German picked", got)
+	}
+	// Missing keys fall back to the default locale
+	if got := reply("/help"); got != config.DefaultMessages[config.MsgHelp] {
+		t.Errorf("help %q, want the English fallback", got)
+	}
+	// Without language hints, only translated languages can be picked
+	if got := reply("/lang it"); got != config.DefaultMessages[config.MsgLanguageInvalid] {
+		t.Errorf("/lang it replied %q, want it refused", got)
+	}
+	if got := reply("/lang auto"); got != config.DefaultMessages[config.MsgLanguageAuto] {
+		t.Errorf("/lang auto replied %q", got)
+	}
+	if got := reply("hi"); !strings.HasPrefix(got, "Sorry") {
+		t.Errorf("error %q, want the default locale again", got)
+	}
+	dify.mu.Lock()
+	defer dify.mu.Unlock()
+	for _, req := range dify.requests {
+		if _, ok := req.Inputs[languageInput]; ok {
+			t.Errorf("Dify told the language %v without language hints", req.Inputs)
+		}
+	}
+}
+
+func TestPipelineMergesInputs(t *testing.T) {
+	opts := PipelineOptions{
+		Channel: "test",
+		Inputs: func(msg ChannelMessage) map[string]interface{} {
+			return map[string]interface{}{"region": "eu-" + msg.ChannelID}
+		},
+	}
+	p, _, dify, _ := newTestPipeline(t, opts, config.ChatConfig{}, func(req ChatMessageRequest) []StreamingChatResponse {
+		return difyAnswer("conv-1", "answer")
+	})
+	p.difyHandler.defaultInputs = map[string]interface{}{"brand": "Acme", "region": "us"}
+
+	p.Handle(testEntry(), ChannelMessage{ChannelID: "bot", UserID: "u1", Text: "hi"})
+	dify.mu.Lock()
+	defer dify.mu.Unlock()
+	if got := dify.requests[0].Inputs; got["brand"] != "Acme" || got["region"] != "eu-bot" {
+		t.Errorf("inputs = %v, want the default brand and the channel's region", got)
+	}
+}
+
+// chatflowStream loads a captured chatflow stream from testdata
+func chatflowStream(t *testing.T, name string) []StreamingChatResponse {
+	t.Helper()
+	data, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []StreamingChatResponse
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var event StreamingChatResponse
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestPipelineAnswerSegments(t *testing.T) {
+	stream := chatflowStream(t, "dify_chatflow_segments.jsonl")
+	msg := ChannelMessage{ChannelID: "bot", UserID: "u1", Text: "where is my parcel?"}
+	for _, tc := range []struct {
+		name  string
+		chat  config.ChatConfig
+		chunk []string
+		want  []string
+	}{
+		{
+			name: "concatenated",
+			chat: config.ChatConfig{Segments: config.SegmentsConcatenate, ReplyMaxMessages: 5},
+			want: []string{"Your parcel arrives on Tuesday.Delivery dates are estimates."},
+		},
+		{
+			name: "split at answer nodes",
+			chat: config.ChatConfig{Segments: config.SegmentsSplit, ReplyMaxMessages: 5},
+			want: []string{"Your parcel arrives on Tuesday.", "Delivery dates are estimates."},
+		},
+		{
+			name: "over the message cap",
+			chat: config.ChatConfig{Segments: config.SegmentsSplit, ReplyMaxMessages: 1},
+			want: []string{"Your parcel arrives on Tuesday.\n\nDelivery dates are estimates."},
+		},
+		{
+			name:  "split at a delimiter arriving in parts",
+			chat:  config.ChatConfig{Segments: config.SegmentsSplit, SegmentDelimiter: "<<<SPLIT>>>", ReplyMaxMessages: 5},
+			chunk: []string{"Hi!<<<SP", "LIT>>>Here is ", "your answer.<<<SPLIT>>>", "Bye."},
+			want:  []string{"Hi!", "Here is your answer.", "Bye."},
+		},
+		{
+			name:  "delimiter ignored when concatenating",
+			chat:  config.ChatConfig{Segments: config.SegmentsConcatenate, SegmentDelimiter: "|", ReplyMaxMessages: 5},
+			chunk: []string{"a|b"},
+			want:  []string{"a|b"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p, sender, _, _ := newTestPipeline(t, PipelineOptions{Channel: "test"}, tc.chat,
+				func(req ChatMessageRequest) []StreamingChatResponse {
+					if tc.chunk != nil {
+						return difyAnswer("", tc.chunk...)
+					}
+					return stream
+				})
+			p.Handle(testEntry(), msg)
+			if got := sender.sent(); fmt.Sprint(got) != fmt.Sprint(tc.want) || len(got) != len(tc.want) {
+				t.Errorf("sent %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPipelineReplacesModeratedAnswers(t *testing.T) {
+	moderated := func(req ChatMessageRequest) []StreamingChatResponse {
+		events := difyAnswer("", "Something unsafe.\n", "More of it")
+		replaced := StreamingChatResponse{Event: "message_replace", MessageID: "msg-1", Answer: "Let's talk about something else."}
+		return append(events[:len(events)-1], replaced, events[len(events)-1])
+	}
+	msg := ChannelMessage{ChannelID: "bot", UserID: "u1", Text: "hi"}
+
+	p, sender, _, _ := newTestPipeline(t, PipelineOptions{Channel: "test"}, config.ChatConfig{ReplyMode: config.ReplyModeFinal, ReplyMaxMessages: 5}, moderated)
+	p.Handle(testEntry(), msg)
+	if got := sender.sent(); len(got) != 1 || got[0] != "Let's talk about something else." {
+		t.Errorf("sent %q, want only the replacement", got)
+	}
+
+	// Incremental replies already sent part of the original
+	p, sender, _, _ = newTestPipeline(t, PipelineOptions{Channel: "test"}, config.ChatConfig{ReplyMode: config.ReplyModeIncremental, ReplyMinChunk: 1, ReplyMaxMessages: 5}, moderated)
+	p.Handle(testEntry(), msg)
+	want := []string{"Something unsafe.", config.DefaultMessages[config.MsgAnswerReplaced], "Let's talk about something else."}
+	if got := sender.sent(); fmt.Sprint(got) != fmt.Sprint(want) || len(got) != len(want) {
+		t.Errorf("sent %q, want %q", got, want)
+	}
+}
+
+func TestPipelineVoiceReplies(t *testing.T) {
+	spoken := func(req ChatMessageRequest) []StreamingChatResponse {
+		events := difyAnswer("", "Hello.")
+		return append(events[:len(events)-1],
+			StreamingChatResponse{Event: "tts_message", MessageID: "msg-1", Audio: base64.StdEncoding.EncodeToString([]byte("ID3-part1"))},
+			StreamingChatResponse{Event: "tts_message", MessageID: "msg-1", Audio: base64.StdEncoding.EncodeToString([]byte("-part2"))},
+			StreamingChatResponse{Event: "tts_message_end", MessageID: "msg-1"},
+			events[len(events)-1])
+	}
+	msg := ChannelMessage{ChannelID: "bot", UserID: "u1", Text: "hi"}
+
+	var voices []string
+	p, sender, _, _ := newTestPipeline(t, PipelineOptions{Channel: "test", SendVoice: func(ctx context.Context, msg ChannelMessage, audio []byte) error {
+		voices = append(voices, string(audio))
+		return nil
+	}}, config.ChatConfig{}, spoken)
+	p.difyHandler.keepAudio = true
+	p.Handle(testEntry(), msg)
+	if got := sender.sent(); len(got) != 1 || got[0] != "Hello." {
+		t.Errorf("sent %q, want the text answer", got)
+	}
+	if len(voices) != 1 || voices[0] != "ID3-part1-part2" {
+		t.Errorf("voice replies %q, want the speech assembled", voices)
+	}
+
+	// Without voice replies, speech is dropped before it is parsed
+	p, sender, _, _ = newTestPipeline(t, PipelineOptions{Channel: "test"}, config.ChatConfig{}, spoken)
+	before := difyTTSChunksDropped.Value()
+	p.Handle(testEntry(), msg)
+	if got := sender.sent(); len(got) != 1 || got[0] != "Hello." {
+		t.Errorf("sent %q, want the text answer", got)
+	}
+	if dropped := difyTTSChunksDropped.Value() - before; dropped != 3 {
+		t.Errorf("dropped %v speech events, want 3", dropped)
+	}
+}
+
+func TestPipelineAcksSlowAnswers(t *testing.T) {
+	p, sender, _, _ := newTestPipeline(t, PipelineOptions{Channel: "test"}, config.ChatConfig{AckDelay: 50 * time.Millisecond},
+		func(req ChatMessageRequest) []StreamingChatResponse {
+			if req.Query == "slow" {
+				time.Sleep(300 * time.Millisecond)
+			}
+			return difyAnswer("", "answer")
+		})
+	p.messages = NewMessages(config.MessagesConfig{DefaultLocale: config.DefaultLocale, Catalog: map[string]map[string]string{
+		"en": {config.MsgAck: "On it.\n\nAlmost there."},
+	}})
+	msg := ChannelMessage{ChannelID: "bot", UserID: "u1", Text: "quick"}
+
+	p.Handle(testEntry(), msg)
+	if got := sender.sent(); len(got) != 1 || got[0] != "answer" {
+		t.Errorf("sent %q, want a fast answer without an ack", got)
+	}
+	// The variants take turns
+	msg.Text = "slow"
+	for _, want := range []string{"On it.", "Almost there.", "On it."} {
+		p.Handle(testEntry(), msg)
+		if got := sender.sent(); len(got) != 2 || got[0] != want || got[1] != "answer" {
+			t.Errorf("sent %q, want %q then the answer", got, want)
+		}
+	}
+}
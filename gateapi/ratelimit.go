@@ -0,0 +1,116 @@
+package gateapi
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/apierror"
+	"github.com/tracoco/DifyGate/config"
+	"github.com/tracoco/DifyGate/metrics"
+	"github.com/tracoco/DifyGate/store"
+)
+
+var (
+	emailRateLimitAllowed = metrics.NewCounter("difygate_email_rate_limit_allowed_total",
+		"Email requests admitted by the rate limiter")
+	emailRateLimitRejected = metrics.NewCounter("difygate_email_rate_limit_rejected_total",
+		"Email requests rejected by the rate limiter", "window")
+	emailRateLimitErrors = metrics.NewCounter("difygate_email_rate_limit_errors_total",
+		"Rate limiter store errors (requests are admitted when the store fails)")
+)
+
+// rateWindow is a single fixed-window limit
+type rateWindow struct {
+	name   string
+	limit  int
+	period time.Duration
+}
+
+// EmailRateLimiter limits email sends per caller using fixed windows kept in
+// the shared store, so limits hold across instances when the store does
+type EmailRateLimiter struct {
+	store   store.Store
+	windows []rateWindow
+	log     *logrus.Logger
+}
+
+// NewEmailRateLimiter creates a new email rate limiter
+func NewEmailRateLimiter(cfg config.RateLimitConfig, kv store.Store, log *logrus.Logger) *EmailRateLimiter {
+	l := &EmailRateLimiter{store: kv, log: log}
+	if cfg.PerMinute > 0 {
+		l.windows = append(l.windows, rateWindow{name: "minute", limit: cfg.PerMinute, period: time.Minute})
+	}
+	if cfg.PerHour > 0 {
+		l.windows = append(l.windows, rateWindow{name: "hour", limit: cfg.PerHour, period: time.Hour})
+	}
+	return l
+}
+
+// Allow records a request for id and reports whether it is within every
+// window. When rejected, it also returns how long until the caller may retry.
+func (l *EmailRateLimiter) Allow(id string) (bool, string, time.Duration) {
+	now := time.Now()
+
+	for _, w := range l.windows {
+		slot := now.UnixNano() / int64(w.period)
+		key := fmt.Sprintf("ratelimit:email:%s:%s:%d", id, w.name, slot)
+
+		count, err := l.store.Incr(key, w.period)
+		if err != nil {
+			// Fail open: a store outage shouldn't take email down with it
+			l.log.WithError(err).Error("Rate limiter store error")
+			emailRateLimitErrors.Inc()
+			continue
+		}
+
+		if count > int64(w.limit) {
+			windowEnd := time.Unix(0, (slot+1)*int64(w.period))
+			return false, w.name, windowEnd.Sub(now)
+		}
+	}
+
+	return true, "", 0
+}
+
+// Middleware returns a Gin middleware enforcing the limits
+func (l *EmailRateLimiter) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if len(l.windows) == 0 {
+			c.Next()
+			return
+		}
+
+		id := callerIdentity(c)
+		allowed, window, retryAfter := l.Allow(id)
+		if !allowed {
+			emailRateLimitRejected.Inc(window)
+			l.log.WithFields(logrus.Fields{
+				"caller": id,
+				"window": window,
+			}).Warn("Email rate limit exceeded")
+
+			seconds := int(retryAfter.Seconds()) + 1
+			c.Header("Retry-After", strconv.Itoa(seconds))
+			apierror.Abort(c, http.StatusTooManyRequests, apierror.RateLimited,
+				fmt.Sprintf("Email rate limit exceeded, retry in %d seconds", seconds))
+			return
+		}
+
+		emailRateLimitAllowed.Inc()
+		c.Next()
+	}
+}
+
+// callerIdentity returns the key used to attribute a request to a caller:
+// the authenticated API key's name, or the client IP (as resolved through
+// the trusted proxies) when there is none
+func callerIdentity(c *gin.Context) string {
+	if name := c.GetString(authKeyNameKey); name != "" {
+		return "key:" + name
+	}
+	return "ip:" + c.ClientIP()
+}
@@ -0,0 +1,56 @@
+package gateapi
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/config"
+)
+
+// Readiness tracks whether this instance should receive traffic. It is not
+// ready while critical configuration is missing or once shutdown has begun.
+type Readiness struct {
+	draining atomic.Bool
+	problems []string
+	log      *logrus.Logger
+}
+
+// NewReadiness creates a readiness tracker, checking critical configuration once
+func NewReadiness(cfg *config.Config, log *logrus.Logger) *Readiness {
+	r := &Readiness{
+		problems: cfg.CriticalProblems(),
+		log:      log,
+	}
+	for _, problem := range r.problems {
+		log.WithField("problem", problem).Error("Critical configuration missing - instance will report not ready")
+	}
+	return r
+}
+
+// StartDraining marks the instance as shutting down so readiness fails
+func (r *Readiness) StartDraining() {
+	r.draining.Store(true)
+	r.log.Info("Readiness set to draining")
+}
+
+// Liveness reports that the process is alive and serving HTTP
+func (r *Readiness) Liveness(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "alive"})
+}
+
+// Readiness reports whether the instance can serve traffic
+func (r *Readiness) Readiness(c *gin.Context) {
+	var reasons []string
+	if r.draining.Load() {
+		reasons = append(reasons, "shutting down")
+	}
+	reasons = append(reasons, r.problems...)
+
+	if len(reasons) > 0 {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "not_ready", "reasons": reasons})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ready"})
+}
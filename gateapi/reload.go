@@ -0,0 +1,268 @@
+package gateapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/apierror"
+	"github.com/tracoco/DifyGate/config"
+)
+
+// hotSettings are the configuration sections a reload applies at once,
+// under their YAML names; changes elsewhere wait for a restart
+var hotSettings = []string{
+	"auth",
+	"api_rate_limit",
+	"email_rate_limit",
+	"chat.canned_responses",
+	"messages",
+	"hooks",
+	"log",
+}
+
+// isHot reports whether a reload applies the setting at path
+func isHot(path string) bool {
+	for _, prefix := range hotSettings {
+		if settingUnder(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// settingUnder reports whether path is prefix or a setting within it
+func settingUnder(path, prefix string) bool {
+	return path == prefix || strings.HasPrefix(path, prefix+".")
+}
+
+// ReloadResult reports what a reload changed
+type ReloadResult struct {
+	// Changed are the settings that differ from the configuration before
+	Changed []string `json:"changed"`
+	// Applied are the changed settings now in effect
+	Applied []string `json:"applied"`
+	// RestartRequired are the settings that differ from the configuration
+	// the gateway started with and only take effect on a restart
+	RestartRequired []string `json:"restart_required"`
+}
+
+// reloadHook rebuilds the parts of the gateway depending on a section
+type reloadHook struct {
+	section string
+	apply   func(*config.Config)
+}
+
+// Reloader holds the configuration in use and swaps it for a newly loaded
+// one on SIGHUP or POST /admin/reload, applying the hotSettings
+type Reloader struct {
+	load func() (*config.Config, error)
+	log  *logrus.Logger
+	// started is the configuration the gateway started with
+	started *config.Config
+	current atomic.Pointer[config.Config]
+
+	// mu runs one reload at a time
+	mu              sync.Mutex
+	hooks           []reloadHook
+	restartRequired []string
+}
+
+// NewReloader creates a reloader starting from cfg; load reads and
+// returns the configuration again
+func NewReloader(cfg *config.Config, load func() (*config.Config, error), log *logrus.Logger) *Reloader {
+	rl := &Reloader{load: load, log: log, started: cfg}
+	rl.current.Store(cfg)
+	return rl
+}
+
+// Config returns the configuration in use
+func (rl *Reloader) Config() *config.Config {
+	return rl.current.Load()
+}
+
+// RestartRequired lists the changed settings waiting for a restart
+func (rl *Reloader) RestartRequired() []string {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return append([]string{}, rl.restartRequired...)
+}
+
+// onReload calls apply with the new configuration whenever a reload
+// changes a setting in section, which must be one of the hotSettings
+func (rl *Reloader) onReload(section string, apply func(*config.Config)) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.hooks = append(rl.hooks, reloadHook{section: section, apply: apply})
+}
+
+// handler returns a handler built by build from the configuration in use,
+// and built again when a reload changes a setting in section
+func (rl *Reloader) handler(section string, build func(*config.Config) gin.HandlerFunc) gin.HandlerFunc {
+	var h atomic.Pointer[gin.HandlerFunc]
+	store := func(cfg *config.Config) {
+		f := build(cfg)
+		h.Store(&f)
+	}
+	store(rl.Config())
+	rl.onReload(section, store)
+	return func(c *gin.Context) {
+		(*h.Load())(c)
+	}
+}
+
+// Reload loads and validates the configuration, applies the changed
+// hotSettings and makes it the configuration in use. An invalid
+// configuration is rejected, keeping the one in use.
+func (rl *Reloader) Reload() (ReloadResult, error) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	var res ReloadResult
+	if rl.load == nil {
+		return res, errReloadUnsupported
+	}
+	cfg, err := rl.load()
+	if err == nil {
+		err = cfg.Validate()
+	}
+	if err != nil {
+		rl.log.WithError(err).Error("Configuration reload failed, keeping the configuration in use")
+		return res, err
+	}
+
+	changes, err := configChanges(rl.Config(), cfg)
+	if err != nil {
+		return res, err
+	}
+	pending, err := configChanges(rl.started, cfg)
+	if err != nil {
+		return res, err
+	}
+
+	res.Changed, res.Applied, res.RestartRequired = []string{}, []string{}, []string{}
+	for _, change := range changes {
+		res.Changed = append(res.Changed, change.path)
+		log := rl.log.WithFields(logrus.Fields{"setting": change.path, "old": change.old, "new": change.new})
+		if isHot(change.path) {
+			res.Applied = append(res.Applied, change.path)
+			log.Info("Setting changed")
+		} else {
+			log.Warn("Setting changed, but only takes effect on a restart")
+		}
+	}
+	for _, change := range pending {
+		if !isHot(change.path) {
+			res.RestartRequired = append(res.RestartRequired, change.path)
+		}
+	}
+
+	for _, hook := range rl.hooks {
+		for _, path := range res.Applied {
+			if settingUnder(path, hook.section) {
+				hook.apply(cfg)
+				break
+			}
+		}
+	}
+	rl.current.Store(cfg)
+	rl.restartRequired = res.RestartRequired
+	rl.log.WithFields(logrus.Fields{
+		"changed":          len(res.Changed),
+		"applied":          len(res.Applied),
+		"restart_required": res.RestartRequired,
+	}).Info("Configuration reloaded")
+	return res, nil
+}
+
+// errReloadUnsupported is returned by a Reloader without a way to load
+// the configuration, as on serverless deployments
+var errReloadUnsupported = errors.New("reloading is not supported")
+
+// Handle handles POST /admin/reload
+func (rl *Reloader) Handle(c *gin.Context) {
+	res, err := rl.Reload()
+	if errors.Is(err, errReloadUnsupported) {
+		apierror.Respond(c, http.StatusNotFound, apierror.FeatureDisabled, "Reloading is not supported on this deployment")
+		return
+	}
+	if err != nil {
+		apierror.Respond(c, http.StatusUnprocessableEntity, apierror.ConfigInvalid, "Configuration not reloaded: "+err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+// configChange is a setting that differs between two configurations, with
+// its values as the admin config endpoint shows them
+type configChange struct {
+	path     string
+	old, new string
+}
+
+// configChanges lists the settings that differ from old to new, by path
+func configChanges(old, new *config.Config) ([]configChange, error) {
+	before, err := effectiveConfig(old)
+	if err != nil {
+		return nil, err
+	}
+	after, err := effectiveConfig(new)
+	if err != nil {
+		return nil, err
+	}
+	a, b := make(map[string]string), make(map[string]string)
+	if err := flattenConfig("", before, a); err != nil {
+		return nil, err
+	}
+	if err := flattenConfig("", after, b); err != nil {
+		return nil, err
+	}
+
+	var changes []configChange
+	for path, value := range a {
+		if b[path] != value {
+			changes = append(changes, configChange{path: path, old: value, new: b[path]})
+		}
+	}
+	for path, value := range b {
+		if _, ok := a[path]; !ok {
+			changes = append(changes, configChange{path: path, new: value})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].path < changes[j].path })
+	return changes, nil
+}
+
+// flattenConfig puts the settings under value into out by dotted path,
+// each rendered as JSON; lists count as one setting. Unset and empty
+// sections are left out, so filling one in reports only what was added.
+func flattenConfig(path string, value interface{}, out map[string]string) error {
+	if value == nil {
+		return nil
+	}
+	if m, ok := value.(map[string]interface{}); ok {
+		for key, v := range m {
+			sub := key
+			if path != "" {
+				sub = path + "." + key
+			}
+			if err := flattenConfig(sub, v, out); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	b, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("setting %s: %w", path, err)
+	}
+	out[path] = string(b)
+	return nil
+}
@@ -0,0 +1,86 @@
+package gateapi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tracoco/DifyGate/config"
+)
+
+func TestReloadAppliesHotSettings(t *testing.T) {
+	load := func(t *testing.T, change func(*config.Config)) *config.Config {
+		t.Helper()
+		cfg, err := config.Load()
+		if err != nil {
+			t.Fatal(err)
+		}
+		change(cfg)
+		return cfg
+	}
+	started := load(t, func(cfg *config.Config) {
+		cfg.Auth.AdminAllowedCIDRs = []string{"10.0.0.0/8"}
+	})
+	next := started
+	rl := NewReloader(started, func() (*config.Config, error) { return next, nil }, quietLogger())
+	messages := NewMessages(started.Messages)
+	rl.onReload("messages", func(cfg *config.Config) { messages.reload(cfg.Messages) })
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(rl.handler("auth.admin_allowed_cidrs", func(cfg *config.Config) gin.HandlerFunc {
+		return IPAllowlistMiddleware(cfg.Auth.AdminAllowedCIDRs, quietLogger())
+	}))
+	r.GET("/admin", func(c *gin.Context) { c.Status(http.StatusNoContent) })
+	r.POST("/reload", rl.Handle)
+	call := func() int {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/admin", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	if code := call(); code != http.StatusForbidden {
+		t.Fatalf("before the reload: status %d, want 403", code)
+	}
+
+	next = load(t, func(cfg *config.Config) {
+		cfg.Auth.AdminAllowedCIDRs = []string{"192.0.2.0/24"}
+		cfg.Messages.Catalog = map[string]map[string]string{"en": {config.MsgError: "Oops"}}
+		cfg.Server.Port = started.Server.Port + 1
+	})
+	res, err := rl.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(res.Applied, ",") != "auth.admin_allowed_cidrs,messages.catalog.en.error" ||
+		strings.Join(res.RestartRequired, ",") != "server.port" {
+		t.Errorf("reload = %+v, want the allowlist and message applied and the port waiting for a restart", res)
+	}
+	if code := call(); code != http.StatusNoContent {
+		t.Errorf("after the reload: status %d, want the new allowlist to let the client in", code)
+	}
+	if got := messages.Get("en", config.MsgError); got != "Oops" {
+		t.Errorf("error message %q, want the reloaded one", got)
+	}
+	if rl.Config() != next {
+		t.Error("the reloaded configuration isn't the one in use")
+	}
+
+	// An invalid configuration is refused and the one in use kept
+	in := next
+	next = load(t, func(cfg *config.Config) { cfg.Auth.AdminAllowedCIDRs = []string{"not a range"} })
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/reload", nil))
+	if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), "config_invalid") {
+		t.Errorf("invalid reload: status %d: %s, want 422", w.Code, w.Body)
+	}
+	if rl.Config() != in || call() != http.StatusNoContent {
+		t.Error("an invalid reload changed the configuration in use")
+	}
+	if got := rl.RestartRequired(); strings.Join(got, ",") != "server.port" {
+		t.Errorf("restart required %q, want the port still", got)
+	}
+}
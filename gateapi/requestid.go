@@ -0,0 +1,88 @@
+package gateapi
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/apierror"
+)
+
+const (
+	// RequestIDHeader is the header carrying the request correlation ID
+	RequestIDHeader = "X-Request-ID"
+	// requestIDKey is the Gin context key holding the request ID
+	requestIDKey = apierror.RequestIDKey
+	// maxRequestIDLength caps client-supplied IDs so they can't bloat logs
+	maxRequestIDLength = 128
+)
+
+// RequestIDMiddleware reuses the caller's X-Request-ID (or generates one),
+// echoes it on the response and stores it in the Gin context
+func RequestIDMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+
+		c.Set(requestIDKey, id)
+		c.Header(RequestIDHeader, id)
+		c.Next()
+	}
+}
+
+// validRequestID accepts short IDs made of printable ASCII only
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, r := range id {
+		if r < 0x21 || r > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID generates a random (version 4) UUID
+func newRequestID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// requestLogger returns a log entry tagged with the request's ID
+func requestLogger(c *gin.Context, log *logrus.Logger) *logrus.Entry {
+	return log.WithField(requestIDKey, c.GetString(requestIDKey))
+}
+
+type logEntryKey struct{}
+
+// withLogger returns a context carrying the given log entry, so work that
+// outlives the request (or happens deeper in the call chain) keeps its fields
+func withLogger(ctx context.Context, log *logrus.Entry) context.Context {
+	return context.WithValue(ctx, logEntryKey{}, log)
+}
+
+// loggerFromContext returns the log entry stored in ctx, or a bare entry
+// from fallback if there is none
+func loggerFromContext(ctx context.Context, fallback *logrus.Logger) *logrus.Entry {
+	if log, ok := ctx.Value(logEntryKey{}).(*logrus.Entry); ok {
+		return log
+	}
+	return logrus.NewEntry(fallback)
+}
+
+// requestIDFromLogger returns the request ID carried by a request logger
+func requestIDFromLogger(log *logrus.Entry) string {
+	id, _ := log.Data[requestIDKey].(string)
+	return id
+}
@@ -1,48 +1,402 @@
 package gateapi
 
 import (
+	"math/rand"
 	"net/http"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/apierror"
+	"github.com/tracoco/DifyGate/config"
+	"github.com/tracoco/DifyGate/events"
 	"github.com/tracoco/DifyGate/gate"
+	"github.com/tracoco/DifyGate/history"
+	"github.com/tracoco/DifyGate/sentry"
+	"github.com/tracoco/DifyGate/store"
+	"github.com/tracoco/DifyGate/version"
 )
 
-// RegisterRoutes sets up all API routes
-func RegisterRoutes(r *gin.Engine, mailService *gate.Service, log *logrus.Logger) {
-	// Add request logging middleware
-	r.Use(LoggingMiddleware(log))
+// RegisterRoutes sets up all API routes, on the configuration reloader
+// holds; the parts depending on hot settings are rebuilt on reload
+func RegisterRoutes(r *gin.Engine, reloader *Reloader, mailService *gate.Service, kv store.Store, dispatcher *events.Dispatcher, recorder *history.Recorder, readiness *Readiness, log *logrus.Logger) {
+	cfg := reloader.Config()
+	configureClientIP(r, cfg.Server, log)
+
+	// Add request ID and request logging middleware
+	r.Use(RequestIDMiddleware())
+	r.Use(reloader.handler("log", func(cfg *config.Config) gin.HandlerFunc {
+		return LoggingMiddleware(log, cfg.Log)
+	}))
+	reloader.onReload("log", func(cfg *config.Config) {
+		if err := config.ConfigureLogger(log, cfg.Log); err != nil {
+			log.WithError(err).Warn("Invalid logging configuration, keeping the current one")
+		}
+	})
+
+	// Kubernetes probes - NOT protected by auth
+	r.GET("/healthz", readiness.Liveness)
+	r.GET("/readyz", readiness.Readiness)
 
 	// API versioning
 	v1 := r.Group("/api/v1")
+	v1.Use(BodyLimitMiddleware(int64(cfg.Server.MaxBodyBytes), bodyLimits(cfg.Server, cfg.Broadcast)))
+
+	clients := NewHTTPClients(cfg.HTTPClient)
+	dispatcher.UseTransport(clients.Webhooks)
+	sentry.UseTransport(clients.Transport("sentry"))
+	difyHandler := NewDifyHandler(cfg.Dify, clients, log)
+	difyHandler.keepAudio = cfg.Features.WhatsApp && cfg.WhatsApp.VoiceReplies
+	difyHandler.users.checkMode(kv, log)
+	if cfg.Chat.DurableInbox && store.InMemory(kv) {
+		log.Warn("DIFYGATE_DURABLE_INBOX is on but the store is in memory: unanswered messages are lost with the process and not shared with other instances; set DIFYGATE_STORE_URL to Redis")
+	}
+	messages := NewMessages(cfg.Messages)
+	reloader.onReload("messages", func(cfg *config.Config) { messages.reload(cfg.Messages) })
+	// The WhatsApp client also sends email alerts and is checked by the
+	// deep health check, so the handler exists even with WhatsApp disabled
+	features := cfg.Features
+	handler := NewWhatsAppHandler(cfg.WhatsApp, cfg.Chat, cfg.Dify, clients, difyHandler, messages, kv, dispatcher, recorder, log)
+	handler.signatures.bodyLimit = int64(cfg.Server.WebhookMaxBodyBytes)
+	handler.pipeline.handoff = newHandoff(cfg.Handoff, mailService, handler.client, recorder)
+	handler.pipeline.optOut = newOptOut(cfg.Broadcast)
+	handler.broadcasts = newBroadcaster(cfg.Broadcast, cfg.Chat.DurableInbox, handler)
+	handler.schedule = newScheduler(cfg.Schedule, handler)
+	transcripts := newTranscripts(cfg.Transcript, recorder, mailService)
+	if features.Email && cfg.Transcript.UserCommand {
+		handler.pipeline.transcripts = transcripts
+	}
+	if features.Email {
+		if alerter := newEmailAlerter(cfg.EmailAlert, dispatcher, handler.client, cfg.WhatsApp.PhoneNumberID, log); alerter != nil {
+			mailService.OnSend(alerter.observe)
+		}
+		if recorder != nil {
+			mailService.OnSend(recordEmails(recorder))
+		}
+		mailService.OnSend(reportEmailAuthFailures(cfg.DIFYGATE.Host))
+	}
+	var alertMail *gate.Service
+	if features.Email {
+		alertMail = mailService
+	}
+	signatureFailures.configure(cfg.Sentry, newSignatureAlert(cfg.SignatureAlert, dispatcher, alertMail, log))
+	var pipelines []*MessagePipeline
+	if features.WhatsApp {
+		handler.pipeline.resume(log)
+		handler.broadcasts.resume(log)
+		handler.schedule.resume(log)
+		pipelines = append(pipelines, handler.pipeline)
+
+		// WhatsApp webhook endpoints - NOT protected by auth (needed for Meta verification)
+		whatsapp := v1.Group("/whatsapp")
+		{
+			// Handler for WhatsApp webhook verification (GET) and messages (POST)
+			whatsapp.GET("/webhook", handler.HandleWhatsAppWebhookGet)
+			whatsapp.POST("/webhook", handler.HandleWhatsAppWebhookPost)
+		}
+	}
+
+	// Messenger webhook endpoints - NOT protected by auth (verified like WhatsApp)
+	if features.Messenger {
+		messengerHandler := NewMessengerHandler(cfg.Messenger, cfg.WhatsApp, cfg.Chat, cfg.Dify, clients, difyHandler, messages, kv, dispatcher, log)
+		messengerHandler.signatures.bodyLimit = int64(cfg.Server.WebhookMaxBodyBytes)
+		pipelines = append(pipelines, messengerHandler.pipeline)
+		messenger := v1.Group("/messenger")
+		{
+			messenger.GET("/webhook", messengerHandler.HandleMessengerWebhookGet)
+			messenger.POST("/webhook", messengerHandler.HandleMessengerWebhookPost)
+		}
+	}
+
+	// Twilio SMS webhook - NOT protected by auth (verified by X-Twilio-Signature)
+	if features.SMS {
+		smsHandler := NewTwilioSMSHandler(cfg.Twilio, cfg.Chat, cfg.Server, cfg.Dify, clients, difyHandler, messages, kv, dispatcher, log)
+		pipelines = append(pipelines, smsHandler.pipeline)
+		sms := v1.Group("/sms")
+		{
+			sms.POST("/twilio", smsHandler.HandleTwilioSMS)
+		}
+	}
+
+	// Slack Events API endpoint - NOT protected by auth (verified by signing secret)
+	if features.Slack {
+		slackHandler := NewSlackHandler(cfg.Slack, cfg.Chat, cfg.Dify, clients, difyHandler, messages, kv, dispatcher, log)
+		pipelines = append(pipelines, slackHandler.pipeline)
+		slack := v1.Group("/slack")
+		{
+			slack.POST("/events", slackHandler.HandleSlackEvents)
+		}
+	}
+
+	// Discord interactions endpoint - NOT protected by auth (verified by Ed25519 signature)
+	if features.Discord {
+		discordHandler := NewDiscordHandler(cfg.Discord, cfg.Chat, cfg.Dify, clients, difyHandler, messages, kv, dispatcher, log)
+		pipelines = append(pipelines, discordHandler.pipeline)
+		discord := v1.Group("/discord")
+		{
+			discord.POST("/interactions", discordHandler.HandleDiscordInteractions)
+		}
+	}
 
-	handler := NewWhatsAppHandler(log)
-	// WhatsApp webhook endpoints - NOT protected by auth (needed for Meta verification)
-	whatsapp := v1.Group("/whatsapp")
-	{
-		// Handler for WhatsApp webhook verification (GET) and messages (POST)
-		whatsapp.GET("/webhook", handler.HandleWhatsAppWebhookGet)
-		whatsapp.POST("/webhook", handler.HandleWhatsAppWebhookPost)
+	// Canned responses, cached answers, mutes, the digest's counts and
+	// costs are shared by every channel
+	canned := newCannedResponses(cfg.Chat.CannedResponses, kv)
+	answers := newAnswerCache(cfg.AnswerCache, cfg.Dify, kv)
+	abuse := newAbuseGuard(cfg.Abuse, kv)
+	spend := newCosts(cfg.Cost, kv)
+	var dailyDigest *digest
+	var counts *activity
+	if features.Email {
+		if dailyDigest = newDigest(cfg.Digest, kv, mailService); dailyDigest != nil {
+			counts = dailyDigest.activity
+			dailyDigest.run(log)
+		}
+	}
+	for _, p := range pipelines {
+		p.canned = canned
+		p.cache = answers
+		p.abuse = abuse
+		p.activity = counts
+		p.costs = spend
+	}
+	reloader.onReload("chat.canned_responses", func(cfg *config.Config) { canned.reload(cfg.Chat.CannedResponses) })
+
+	// Dify custom-tool schema - NOT protected, so Dify can import it by URL.
+	// It only describes endpoints, which still require a key to call.
+	if features.Email {
+		v1.GET("/tools/openapi.json", ToolSchemaHandler(cfg.Server.ExternalURL))
 	}
 
-	// Protected routes - require API key
+	// Protected routes - require API key. Groups with an IP allowlist check
+	// it before these, so blocked addresses can't probe keys.
+	keyUsage := NewKeyUsage(kv, log)
+	apiRateLimiter := NewAPIRateLimiter(cfg.APIRateLimit, log)
+	reloader.onReload("api_rate_limit", func(cfg *config.Config) { apiRateLimiter.reload(cfg.APIRateLimit) })
+	authenticated := []gin.HandlerFunc{
+		apiRateLimiter.AuthFailureMiddleware(),
+		reloader.handler("auth", func(cfg *config.Config) gin.HandlerFunc {
+			return AuthMiddleware(cfg.Auth, keyUsage, clients, log)
+		}),
+		apiRateLimiter.Middleware(),
+	}
 	protected := v1.Group("")
-	protected.Use(AuthMiddleware(log))
+	protected.Use(authenticated...)
+
+	// Health check and build info endpoints - any valid key
+	protected.GET("/health", HealthCheck(features))
+	protected.GET("/version", VersionHandler)
+
+	// API documentation
+	protected.GET("/openapi.json", OpenAPIHandler)
+	protected.GET("/docs", DocsHandler)
+
+	// Operational endpoints
+	if features.Admin {
+		admin := v1.Group("")
+		admin.Use(reloader.handler("auth.admin_allowed_cidrs", func(cfg *config.Config) gin.HandlerFunc {
+			return IPAllowlistMiddleware(cfg.Auth.AdminAllowedCIDRs, log)
+		}))
+		admin.Use(authenticated...)
+		admin.Use(RequireScope(ScopeAdmin, log))
+
+		admin.GET("/health/deep", NewHealthHandler(mailService, difyHandler, handler, log).DeepHealthCheck)
+
+		// Metrics endpoint (Prometheus text format)
+		admin.GET("/metrics", MetricsHandler)
+
+		// Last use of each API key, for deciding when a rotated key can go
+		admin.GET("/admin/auth/usage", reloader.handler("auth", func(cfg *config.Config) gin.HandlerFunc {
+			return keyUsage.UsageHandler(cfg.Auth)
+		}))
+
+		// The configuration in use, secrets masked, for incidents
+		admin.GET("/admin/config", ConfigHandler(reloader, log))
+		admin.POST("/admin/reload", reloader.Handle)
+
+		// Message history for support lookups
+		historyHandler := NewHistoryHandler(recorder)
+		admin.GET("/admin/messages", historyHandler.ListMessages)
+		admin.GET("/admin/messages/:wamid", historyHandler.GetMessage)
+
+		// Erasing a user's data on request
+		userDataHandler := NewUserDataHandler(kv, recorder, difyHandler, handler.schedule, log)
+		admin.DELETE("/admin/users/:number", userDataHandler.DeleteUser)
+
+		// A user's stored state, and starting their conversation over
+		admin.GET("/admin/users/:number", userDataHandler.GetUser)
+		admin.DELETE("/admin/users/:number/conversation", userDataHandler.ResetConversation)
+		admin.GET("/admin/dify-users/:user", userDataHandler.ResolveDifyUser)
+
+		// Managing the canned responses
+		cannedHandler := NewCannedResponsesHandler(canned, log)
+		admin.GET("/admin/canned-responses", cannedHandler.List)
+		admin.PUT("/admin/canned-responses/:name", cannedHandler.Put)
+		admin.DELETE("/admin/canned-responses/:name", cannedHandler.Delete)
+
+		// What chat users' answers cost
+		admin.GET("/stats/costs", NewCostsHandler(spend, log).Costs)
+
+		// Users muted for sending too much
+		mutesHandler := NewMutesHandler(kv, log)
+		admin.GET("/admin/mutes", mutesHandler.List)
+		admin.DELETE("/admin/mutes/:channel/:user", mutesHandler.Unmute)
+
+		// Managing the email suppression list
+		if features.Email {
+			suppressionsHandler := NewSuppressionsHandler(kv, log)
+			admin.GET("/admin/emails/suppressions", suppressionsHandler.List)
+			admin.POST("/admin/emails/suppressions", suppressionsHandler.Add)
+			admin.DELETE("/admin/emails/suppressions/:address", suppressionsHandler.Remove)
 
-	// Health check endpoint
-	protected.GET("/health", HealthCheck)
+			// Sending the daily digest without waiting for its schedule
+			admin.POST("/admin/digest/send-now", NewDigestHandler(dailyDigest, log).SendNow)
+		}
+
+		if features.WhatsApp {
+			// Giving a handed-off user back to the bot
+			admin.POST("/admin/users/:number/resume", handler.ResumeUser)
+			admin.POST("/admin/whatsapp/agent-reply", handler.AgentReply)
+
+			// Messaging many WhatsApp users at once
+			admin.POST("/whatsapp/broadcast", handler.StartBroadcast)
+			admin.GET("/whatsapp/broadcast/:id", handler.GetBroadcast)
+
+			// Reprocessing a stored or captured WhatsApp webhook
+			admin.POST("/admin/whatsapp/replay", handler.ReplayWebhook)
+
+			// Emailing a conversation for escalation
+			if features.Email {
+				admin.POST("/admin/conversations/:user/email", NewTranscriptsHandler(transcripts, log).Email)
+			}
+		}
+
+		// The dashboard, pages over the admin API for people without curl,
+		// signed in once with a key kept in a session
+		dashboard := NewDashboard(r, kv, cfg.Server.TrustedProxies, log)
+		pages := r.Group("/admin")
+		pages.Use(reloader.handler("auth.admin_allowed_cidrs", func(cfg *config.Config) gin.HandlerFunc {
+			return IPAllowlistMiddleware(cfg.Auth.AdminAllowedCIDRs, log)
+		}))
+		pages.Use(BodyLimitMiddleware(int64(cfg.Server.MaxBodyBytes), nil))
+		pages.GET("/login", dashboard.LoginPage)
+		pages.POST("/login", dashboard.Login)
+		pages.POST("/logout", dashboard.Logout)
+		pages.Use(dashboard.RequireSession)
+		pages.GET("", dashboard.Home)
+		pages.GET("/messages", dashboard.Messages)
+		pages.GET("/users", dashboard.Users)
+		pages.POST("/users/reset", dashboard.ResetConversation)
+		pages.POST("/users/unmute", dashboard.Unmute)
+		pages.GET("/emails", dashboard.Emails)
+		pages.GET("/config", dashboard.Config)
+
+		// Profiling, unless it has its own listener
+		if cfg.Debug.EnablePprof && cfg.Debug.Port == 0 {
+			registerDebugRoutes(admin, log)
+		}
+	}
+
+	// Inbound hooks forwarding arbitrary events to Dify
+	if features.Hooks {
+		hooks := protected.Group("/hooks")
+		hooks.Use(RequireScope(ScopeHooks, log))
+		hooks.POST("/:name", reloader.handler("hooks", func(reloaded *config.Config) gin.HandlerFunc {
+			return NewHookHandler(reloaded.Hooks, cfg.Chat, cfg.WhatsApp, cfg.Dify, clients, difyHandler, mailService, log).HandleHook
+		}))
+	}
+
+	// Chat queries answered in the background, for callers that poll
+	if features.ChatAPI {
+		chat := protected.Group("/chat")
+		chat.Use(RequireScope(ScopeChat, log))
+		chatJobs := NewChatJobsHandler(cfg.ChatJobs, cfg.Chat, cfg.Dify, difyHandler, kv, log)
+		chatJobs.cache = answers
+		chat.POST("/jobs", chatJobs.Submit)
+		chat.GET("/jobs/:id", chatJobs.Get)
+		chat.DELETE("/jobs/:id", chatJobs.Cancel)
+	}
+
+	// Proactive WhatsApp messages from backend systems
+	if features.WhatsApp {
+		whatsappSend := protected.Group("/whatsapp")
+		whatsappSend.Use(RequireScope(ScopeWhatsAppSend, log))
+		whatsappSend.POST("/send", handler.SendMessage)
+		whatsappSend.POST("/media", handler.SendMediaMessage)
+		whatsappSend.GET("/messages/:wamid/status", handler.GetMessageStatus)
+		whatsappSend.POST("/schedule", handler.ScheduleMessage)
+		whatsappSend.GET("/schedule", handler.ListScheduled)
+		whatsappSend.GET("/schedule/:id", handler.GetScheduled)
+		whatsappSend.DELETE("/schedule/:id", handler.CancelScheduled)
+	}
 
 	// Email endpoints
-	emails := protected.Group("/emails")
-	{
-		handler := NewEmailHandler(mailService, log)
+	if features.Email {
+		emails := v1.Group("/emails")
+		emails.Use(reloader.handler("auth.email_allowed_cidrs", func(cfg *config.Config) gin.HandlerFunc {
+			return IPAllowlistMiddleware(cfg.Auth.EmailAllowedCIDRs, log)
+		}))
+		emails.Use(authenticated...)
+		emails.Use(RequireScope(ScopeEmailSend, log))
+		emails.Use(reloader.handler("email_rate_limit", func(cfg *config.Config) gin.HandlerFunc {
+			return NewEmailRateLimiter(cfg.EmailRateLimit, kv, log).Middleware()
+		}))
+
+		handler := NewEmailHandler(mailService, cfg.EmailIdempotency, kv, dispatcher, log)
 		emails.POST("/send", handler.SendEmail)
 	}
+
+	// Unknown routes answer with the error envelope too
+	r.NoRoute(func(c *gin.Context) {
+		apierror.Respond(c, http.StatusNotFound, apierror.NotFound, "Route not found")
+	})
+
+	// Routes of disabled features are documented but left out on purpose
+	checkOpenAPICoverage(r, !features.All(), log)
+}
+
+// bodyLimits are the routes whose bodies get a limit other than
+// DIFYGATE_MAX_BODY_BYTES: small ones for the webhooks, a large one for
+// email attachments and one for broadcasts to as many recipients as they
+// may have. Only the webhooks themselves get the webhook limit; the API
+// routes next to them, such as /whatsapp/send, keep the default.
+func bodyLimits(cfg config.ServerConfig, broadcast config.BroadcastConfig) map[string]int64 {
+	webhook, email := int64(cfg.WebhookMaxBodyBytes), int64(cfg.EmailMaxBodyBytes)
+	return map[string]int64{
+		"/api/v1/whatsapp/webhook":     webhook,
+		"/api/v1/whatsapp/media":       int64(cfg.MediaMaxBodyBytes),
+		"/api/v1/whatsapp/broadcast":   max(int64(cfg.MaxBodyBytes), int64(broadcast.MaxRecipients)*broadcastRecipientBytes),
+		"/api/v1/messenger/webhook":    webhook,
+		"/api/v1/sms/twilio":           webhook,
+		"/api/v1/slack/events":         webhook,
+		"/api/v1/discord/interactions": webhook,
+		"/api/v1/emails":               email,
+	}
 }
 
-// LoggingMiddleware adds request logging
-func LoggingMiddleware(log *logrus.Logger) gin.HandlerFunc {
+// broadcastRecipientBytes is the room given to each recipient of a
+// broadcast, enough for a number and its own template parameters
+const broadcastRecipientBytes = 1 << 10
+
+// configureClientIP sets which proxies Gin trusts when resolving
+// c.ClientIP(), which feeds access logs and IP-keyed rate limiting. With no
+// trusted proxies, forwarding headers are ignored and the peer address is used.
+func configureClientIP(r *gin.Engine, cfg config.ServerConfig, log *logrus.Logger) {
+	if err := r.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		// Validate rejects bad entries, so only fall back to trusting nobody
+		log.WithError(err).Error("Invalid trusted proxies, forwarding headers will be ignored")
+		_ = r.SetTrustedProxies(nil)
+	}
+	if cfg.RealIPHeader != "" {
+		r.RemoteIPHeaders = []string{cfg.RealIPHeader}
+	}
+}
+
+// LoggingMiddleware adds request logging. Successful requests to the
+// configured skip paths aren't logged, and those to sample paths are logged
+// at the sample rate; failures are always logged.
+func LoggingMiddleware(log *logrus.Logger, cfg config.LogConfig) gin.HandlerFunc {
+	skip := pathSet(cfg.AccessSkipPaths)
+	sample := pathSet(cfg.AccessSamplePaths)
 	return func(c *gin.Context) {
 		// Start timer
 		start := time.Now()
@@ -50,24 +404,82 @@ func LoggingMiddleware(log *logrus.Logger) gin.HandlerFunc {
 		// Process request
 		c.Next()
 
+		status := c.Writer.Status()
+		sampled := false
+		if status < 400 {
+			if matchesPath(skip, c) {
+				return
+			}
+			if matchesPath(sample, c) && cfg.AccessSampleRate < 1 {
+				if rand.Float64() >= cfg.AccessSampleRate {
+					return
+				}
+				sampled = true
+			}
+		}
+
 		// Log request details
 		latency := time.Since(start)
-		log.WithFields(logrus.Fields{
-			"status":     c.Writer.Status(),
-			"method":     c.Request.Method,
-			"path":       c.Request.URL.Path,
-			"latency":    latency,
-			"client_ip":  c.ClientIP(),
-			"user_agent": c.Request.UserAgent(),
-		}).Info("API request")
+		size := c.Writer.Size()
+		if size < 0 {
+			size = 0
+		}
+		fields := logrus.Fields{
+			"request_id":    c.GetString(requestIDKey),
+			"key_name":      c.GetString(authKeyNameKey),
+			"status":        status,
+			"method":        c.Request.Method,
+			"path":          c.Request.URL.Path,
+			"latency":       latency,
+			"response_size": size,
+			"client_ip":     c.ClientIP(),
+			"user_agent":    c.Request.UserAgent(),
+		}
+		if sampled {
+			// Lets log queries scale counts back up
+			fields["sample_rate"] = cfg.AccessSampleRate
+		}
+		log.WithFields(fields).Info("API request")
 	}
 }
 
-// HealthCheck provides a simple health check endpoint
-func HealthCheck(c *gin.Context) {
-	c.JSON(http.StatusOK, gin.H{
-		"status":    "ok",
-		"service":   "DifyGate",
-		"timestamp": time.Now().Format(time.RFC3339),
-	})
+// pathSet indexes paths for matchesPath
+func pathSet(paths []string) map[string]bool {
+	set := make(map[string]bool, len(paths))
+	for _, p := range paths {
+		set[p] = true
+	}
+	return set
+}
+
+// matchesPath reports whether the request's path, or the route it matched
+// such as /api/v1/hooks/:name, is in set
+func matchesPath(set map[string]bool, c *gin.Context) bool {
+	return set[c.Request.URL.Path] || (c.FullPath() != "" && set[c.FullPath()])
+}
+
+// HealthCheck provides a simple health check endpoint, listing the enabled
+// features
+func HealthCheck(features config.FeaturesConfig) gin.HandlerFunc {
+	enabled := features.Enabled()
+	return func(c *gin.Context) {
+		body := gin.H{
+			"status":                    "ok",
+			"service":                   "DifyGate",
+			"timestamp":                 time.Now().Format(time.RFC3339),
+			"version":                   version.Get(),
+			"features":                  enabled,
+			"webhook_signature_failing": false,
+		}
+		if failing := signatureFailures.failing(); len(failing) > 0 {
+			body["webhook_signature_failing"] = true
+			body["webhook_signature_failing_channels"] = failing
+		}
+		c.JSON(http.StatusOK, body)
+	}
+}
+
+// VersionHandler reports which build is running
+func VersionHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, version.Get())
 }
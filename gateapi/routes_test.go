@@ -0,0 +1,48 @@
+package gateapi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/tracoco/DifyGate/config"
+)
+
+func TestDisabledFeaturesAreNotRouted(t *testing.T) {
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Auth.APIKey = "test-key"
+	cfg.Features = config.FeaturesConfig{Email: true, Admin: true}
+	// Settings of disabled features aren't checked
+	cfg.Twilio.MaxSegments = 0
+	cfg.WhatsApp.AppSecret, cfg.Dify.APIKey = "", ""
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("validate: %v, want the SMS settings ignored", err)
+	}
+	if problems := cfg.CriticalProblems(); len(problems) != 0 {
+		t.Errorf("critical problems %q, want none without WhatsApp and Dify", problems)
+	}
+	r := newTestRouter(t, cfg)
+
+	call := func(method, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, strings.NewReader("{}"))
+		req.Header.Set("Authorization", "Bearer test-key")
+		r.ServeHTTP(w, req)
+		return w
+	}
+	for _, route := range []string{"/api/v1/whatsapp/webhook", "/api/v1/whatsapp/send", "/api/v1/hooks/alerts", "/api/v1/chat/jobs", "/api/v1/whatsapp/broadcast"} {
+		if w := call(http.MethodPost, route); w.Code != http.StatusNotFound {
+			t.Errorf("POST %s: status %d, want 404 for a disabled feature", route, w.Code)
+		}
+	}
+	if w := call(http.MethodPost, "/api/v1/emails/send"); w.Code != http.StatusBadRequest {
+		t.Errorf("POST /api/v1/emails/send: status %d, want the enabled route to check the body", w.Code)
+	}
+	if w := call(http.MethodGet, "/api/v1/health"); !strings.Contains(w.Body.String(), `"features":["email","admin"]`) {
+		t.Errorf("health: %s, want the enabled features listed", w.Body)
+	}
+}
@@ -0,0 +1,79 @@
+package gateapi
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/tracoco/DifyGate/config"
+)
+
+const (
+	thinkOpenTag  = "<think>"
+	thinkCloseTag = "</think>"
+)
+
+var (
+	// thinkBlockPattern matches a complete reasoning block
+	thinkBlockPattern = regexp.MustCompile(`(?s)<think>.*?</think>\s*`)
+	// citationPattern matches RAG citation markers such as [1], [2, 3], [^4]
+	// or [[5]]
+	citationPattern = regexp.MustCompile(`[ \t]?\[(?:\^?\d+|\[\^?\d+\])(?:\s*,\s*(?:\^?\d+|\[\^?\d+\]))*\]`)
+	// sourcesPattern matches a Sources or References section and everything
+	// after it, as a "Sources:" line or a Markdown heading
+	sourcesPattern = regexp.MustCompile(`(?is)(?:^|\n)[ \t]*(?:#{1,6}[ \t]*)?[*_]{0,2}(?:sources|references)[*_]{0,2}[ \t]*(?::|\n|$).*$`)
+)
+
+// stripThinkBlocks removes the reasoning blocks that are complete in text
+func stripThinkBlocks(cfg config.SanitizeConfig, text string) string {
+	if !cfg.ThinkTags || !strings.Contains(text, thinkCloseTag) {
+		return text
+	}
+	return thinkBlockPattern.ReplaceAllString(text, "")
+}
+
+// stableAnswerLength returns how much of a partly streamed answer can be
+// sent now: nothing from an unclosed <think>, a Sources section (which is
+// only known to be trailing once the answer ends) or what may be the start
+// of a tag split across chunks
+func stableAnswerLength(cfg config.SanitizeConfig, text string) int {
+	stable := len(text)
+	if cfg.ThinkTags {
+		if open := strings.LastIndex(text, thinkOpenTag); open >= 0 && !strings.Contains(text[open:], thinkCloseTag) {
+			stable = open
+		} else {
+			for i := len(thinkOpenTag) - 1; i > 0; i-- {
+				if strings.HasSuffix(text, thinkOpenTag[:i]) {
+					stable = len(text) - i
+					break
+				}
+			}
+		}
+	}
+	if cfg.Sources {
+		if loc := sourcesPattern.FindStringIndex(text[:stable]); loc != nil {
+			stable = loc[0]
+		}
+	}
+	return stable
+}
+
+// sanitizeAnswer removes what cfg selects from text about to be sent; final
+// is set for the end of the answer, where unclosed reasoning and a trailing
+// Sources section are dropped too, unless the sources are the whole answer
+func sanitizeAnswer(cfg config.SanitizeConfig, text string, final bool) string {
+	text = stripThinkBlocks(cfg, text)
+	if cfg.ThinkTags && final {
+		if open := strings.Index(text, thinkOpenTag); open >= 0 {
+			text = text[:open]
+		}
+	}
+	if cfg.Citations {
+		text = citationPattern.ReplaceAllString(text, "")
+	}
+	if cfg.Sources && final {
+		if stripped := sourcesPattern.ReplaceAllString(text, ""); strings.TrimSpace(stripped) != "" {
+			text = stripped
+		}
+	}
+	return strings.TrimSpace(text)
+}
@@ -0,0 +1,79 @@
+package gateapi
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/tracoco/DifyGate/config"
+)
+
+var sanitizeAll = config.SanitizeConfig{ThinkTags: true, Citations: true, Sources: true}
+
+func TestSanitizeAnswer(t *testing.T) {
+	tests := []struct {
+		name  string
+		cfg   config.SanitizeConfig
+		text  string
+		final bool
+		want  string
+	}{
+		{"think block", sanitizeAll, "<think>Let me check.</think>\nIt is 5pm.", true, "It is 5pm."},
+		{"several think blocks", sanitizeAll, "<think>a</think>One. <think>b</think>Two.", true, "One. Two."},
+		{"unterminated think at the end", sanitizeAll, "It is 5pm. <think>Should I add", true, "It is 5pm."},
+		{"unterminated think is the whole answer", sanitizeAll, "<think>Still reasoning when cut off", true, ""},
+		{"unterminated think kept while streaming", sanitizeAll, "It is 5pm. <think>Should", false, "It is 5pm. <think>Should"},
+		{"think tags kept when disabled", config.SanitizeConfig{}, "<think>a</think>b", true, "<think>a</think>b"},
+		{"citations", sanitizeAll, "Paris [1] is the capital [2, 3].", true, "Paris is the capital."},
+		{"footnote citations", sanitizeAll, "Paris[^1] is the capital.", true, "Paris is the capital."},
+		{"nested citations", sanitizeAll, "Paris [[1]] is the capital [[2], [3]].", true, "Paris is the capital."},
+		{"adjacent citations", sanitizeAll, "Paris is the capital [1][2].", true, "Paris is the capital."},
+		{"links are not citations", sanitizeAll, "See [the docs](https://example.com) or [note].", true, "See [the docs](https://example.com) or [note]."},
+		{"citations kept when disabled", config.SanitizeConfig{}, "Paris [1].", true, "Paris [1]."},
+		{"trailing sources", sanitizeAll, "Paris is the capital.\n\nSources:\n- Wikipedia\n- Britannica", true, "Paris is the capital."},
+		{"trailing references heading", sanitizeAll, "Paris is the capital.\n\n## References\n1. Wikipedia", true, "Paris is the capital."},
+		{"sources kept while streaming", sanitizeAll, "Paris.\n\nSources:\n- Wikipedia", false, "Paris.\n\nSources:\n- Wikipedia"},
+		{"sources that are the whole answer", sanitizeAll, "Sources:\n- Wikipedia\n- Britannica", true, "Sources:\n- Wikipedia\n- Britannica"},
+		{"sources mentioned mid-sentence", sanitizeAll, "Good sources: Wikipedia and Britannica.", true, "Good sources: Wikipedia and Britannica."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sanitizeAnswer(tt.cfg, tt.text, tt.final); got != tt.want {
+				t.Errorf("sanitizeAnswer(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStableAnswerLength(t *testing.T) {
+	tests := []struct {
+		text string
+		want int
+	}{
+		{"Plain text.", len("Plain text.")},
+		{"Answer <think>reasoning", len("Answer ")},
+		{"Answer <thi", len("Answer ")},
+		{"Answer <", len("Answer ")},
+		{"<think>done</think>Answer", len("<think>done</think>Answer")},
+		{"Answer.\nSources:\n- a", len("Answer.")},
+	}
+	for _, tt := range tests {
+		if got := stableAnswerLength(sanitizeAll, tt.text); got != tt.want {
+			t.Errorf("stableAnswerLength(%q) = %d, want %d", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestPipelineStripsThinkTagsSplitAcrossChunks(t *testing.T) {
+	for _, mode := range []string{config.ReplyModeFinal, config.ReplyModeIncremental} {
+		chatCfg := config.ChatConfig{ReplyMode: mode, ReplyMinChunk: 5, ReplyMaxMessages: 5, Sanitize: sanitizeAll}
+		p, sender, _, _ := newTestPipeline(t, PipelineOptions{Channel: "test"}, chatCfg, func(req ChatMessageRequest) []StreamingChatResponse {
+			return difyAnswer("conv-1", "<thi", "nk>The user wants. Hours. ", "Done.</th", "ink>\nWe open at 9. ", "We close at 5 [1].")
+		})
+
+		p.Handle(testEntry(), ChannelMessage{ChannelID: "bot", UserID: "u1", Text: "hours?"})
+		got := strings.Join(sender.sent(), " ")
+		if got != "We open at 9. We close at 5." {
+			t.Errorf("%s mode sent %q, want the answer without reasoning or citations", mode, got)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package gateapi
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"syscall"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/apierror"
+	"github.com/tracoco/DifyGate/config"
+	"github.com/tracoco/DifyGate/store"
+)
+
+// NewRouter returns a Gin engine in the configured mode whose only output
+// goes through log, shared by the server and the Vercel entrypoint
+func NewRouter(cfg config.ServerConfig, log *logrus.Logger) *gin.Engine {
+	gin.SetMode(cfg.GinMode)
+
+	// Debug mode prints the route table and warnings; keep them structured
+	gin.DefaultWriter = log.WriterLevel(logrus.DebugLevel)
+	gin.DefaultErrorWriter = log.WriterLevel(logrus.ErrorLevel)
+	gin.DebugPrintRouteFunc = func(method, path, handler string, handlers int) {
+		log.WithFields(logrus.Fields{
+			"method":   method,
+			"path":     path,
+			"handler":  handler,
+			"handlers": handlers,
+		}).Debug("Route registered")
+	}
+
+	r := gin.New()
+	r.Use(ErrorReportingMiddleware(), RecoveryMiddleware(log))
+	return r
+}
+
+// sensitiveStoreKeys are the store keys whose values hold customer data:
+// conversation mappings, held, queued, scheduled and broadcast messages,
+// chat job queries and answers, cached answers and responses, delivery
+// records, mutes, suppressed addresses, who hashed Dify user IDs stand
+// for, and the API keys of dashboard sessions
+var sensitiveStoreKeys = []string{
+	"*:conversation:*",
+	"*:handoff:*",
+	"outbox:*",
+	"inbox:*",
+	"chat-job:*",
+	"answer-cache:*",
+	"idempotency:*",
+	"whatsapp:schedule:*",
+	"whatsapp:broadcast:*",
+	"whatsapp:status:*",
+	"abuse:mute:*",
+	"email-suppression:*",
+	"difyuser:*",
+	"dashboard:session:*",
+}
+
+// NewStore opens the shared store, sealing the values of sensitive keys
+// when DIFYGATE_STORE_ENCRYPTION_KEY is set, for the server and the
+// Vercel entrypoint
+func NewStore(cfg config.StoreConfig, log *logrus.Logger) (store.Store, error) {
+	kv := store.New(cfg.URL, log)
+	encrypted, err := store.NewEncryptedStore(kv, cfg.EncryptionKeys, sensitiveStoreKeys)
+	if err != nil {
+		kv.Close()
+		return nil, err
+	}
+	if len(cfg.EncryptionKeys) > 0 {
+		log.WithField("keys", len(cfg.EncryptionKeys)).Info("Encrypting customer data in the store")
+	}
+	return encrypted, nil
+}
+
+// RecoveryMiddleware turns a handler panic into a 500 and logs it with its
+// stack trace, replacing Gin's plain-text recovery output
+func RecoveryMiddleware(log *logrus.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				return
+			}
+
+			reqLog := requestLogger(c, log).WithFields(logrus.Fields{
+				"method": c.Request.Method,
+				"path":   c.Request.URL.Path,
+				"panic":  rec,
+			})
+
+			// A client that hung up can't be answered; that's not a bug
+			if err, ok := rec.(error); ok && isBrokenPipe(err) {
+				reqLog.Warn("Client connection closed while writing response")
+				c.Abort()
+				return
+			}
+
+			reqLog.WithField("stack", string(debug.Stack())).Error("Recovered from panic")
+			reportPanic(c, rec)
+			if c.Writer.Written() {
+				c.Abort()
+				return
+			}
+			apierror.Abort(c, http.StatusInternalServerError, apierror.Internal, "Internal server error")
+		}()
+		c.Next()
+	}
+}
+
+// isBrokenPipe reports whether err means the client went away mid-response
+func isBrokenPipe(err error) bool {
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) {
+		return false
+	}
+	var syscallErr *os.SyscallError
+	if errors.As(opErr.Err, &syscallErr) {
+		return errors.Is(syscallErr.Err, syscall.EPIPE) || errors.Is(syscallErr.Err, syscall.ECONNRESET)
+	}
+	return false
+}
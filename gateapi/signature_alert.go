@@ -0,0 +1,146 @@
+package gateapi
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/config"
+	"github.com/tracoco/DifyGate/events"
+	"github.com/tracoco/DifyGate/gate"
+	"github.com/tracoco/DifyGate/metrics"
+)
+
+var signatureAlerts = metrics.NewCounter("difygate_signature_alerts_total",
+	"Alerts raised because a channel's webhooks kept failing signature verification", "channel")
+
+// signatureStreak is a channel's failed signatures since the last one that
+// verified
+type signatureStreak struct {
+	first   time.Time
+	count   int
+	failing bool
+}
+
+// signatureAlert tells operators when a channel's webhooks fail signature
+// verification DIFYGATE_SIGNATURE_ALERT_THRESHOLD times in a row, which
+// usually means the secret was rotated on the platform's side and every
+// user is being ignored. The channel is failing, as the health check shows,
+// until a webhook verifies again.
+type signatureAlert struct {
+	cfg    config.SignatureAlertConfig
+	events *events.Dispatcher
+	// send emails DIFYGATE_SIGNATURE_ALERT_NOTIFY_EMAIL; nil emails
+	// nobody
+	send func(gate.Message) error
+	log  *logrus.Logger
+
+	mu        sync.Mutex
+	streaks   map[string]*signatureStreak
+	lastAlert map[string]time.Time
+}
+
+// newSignatureAlert returns nil when DIFYGATE_SIGNATURE_ALERT_THRESHOLD is
+// 0; mail is nil without the email feature
+func newSignatureAlert(cfg config.SignatureAlertConfig, dispatcher *events.Dispatcher, mail *gate.Service, log *logrus.Logger) *signatureAlert {
+	if cfg.Threshold <= 0 {
+		return nil
+	}
+	a := &signatureAlert{
+		cfg:       cfg,
+		events:    dispatcher,
+		log:       log,
+		streaks:   make(map[string]*signatureStreak),
+		lastAlert: make(map[string]time.Time),
+	}
+	if mail != nil && len(cfg.NotifyEmail) > 0 {
+		a.send = mail.Send
+	}
+	return a
+}
+
+// failed counts a failed signature on channel at now, raising the alert
+// when it completes the streak
+func (a *signatureAlert) failed(channel string, now time.Time) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	s, ok := a.streaks[channel]
+	// Failures too far apart start over, unless the channel already fails
+	if !ok || (!s.failing && now.Sub(s.first) > a.cfg.Window) {
+		s = &signatureStreak{first: now}
+		a.streaks[channel] = s
+	}
+	s.count++
+	raise := s.count >= a.cfg.Threshold && !s.failing
+	if raise {
+		s.failing = true
+	}
+	notify := raise && (a.lastAlert[channel].IsZero() || now.Sub(a.lastAlert[channel]) >= a.cfg.Cooldown)
+	if notify {
+		a.lastAlert[channel] = now
+	}
+	count, since := s.count, now.Sub(s.first).Round(time.Second)
+	a.mu.Unlock()
+
+	if !raise {
+		return
+	}
+	text := fmt.Sprintf("DifyGate alert: the last %d %s webhooks, over %s, failed signature verification, so their messages are being dropped. Check that the secret DifyGate is configured with matches the platform's.", count, channel, since)
+	a.log.WithFields(logrus.Fields{
+		"channel":  channel,
+		"failures": count,
+		"since":    since.String(),
+	}).Error("Webhook signatures keep failing: every message on the channel is dropped. Was the secret rotated?")
+	if !notify {
+		return
+	}
+	signatureAlerts.Inc(channel)
+	a.events.Publish(events.Event{
+		Type:    config.EventSignatureFailing,
+		Channel: channel,
+		Text:    text,
+	})
+	if a.send != nil {
+		// Webhooks are answered inline, so the email mustn't hold them up
+		go func() {
+			if err := a.send(gate.Message{To: a.cfg.NotifyEmail, Subject: "DifyGate: " + channel + " webhook signatures are failing", Body: text}); err != nil {
+				a.log.WithError(err).Error("Failed to email the signature alert")
+			}
+		}()
+	}
+}
+
+// verified ends channel's streak of failures
+func (a *signatureAlert) verified(channel string) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	s, ok := a.streaks[channel]
+	delete(a.streaks, channel)
+	a.mu.Unlock()
+	if ok && s.failing {
+		a.log.WithFields(logrus.Fields{"channel": channel, "failures": s.count}).Info("Webhook signatures verify again")
+	}
+}
+
+// failing lists the channels whose signatures keep failing, sorted
+func (a *signatureAlert) failing() []string {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var channels []string
+	for channel, s := range a.streaks {
+		if s.failing {
+			channels = append(channels, channel)
+		}
+	}
+	sort.Strings(channels)
+	return channels
+}
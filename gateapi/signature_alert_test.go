@@ -0,0 +1,122 @@
+package gateapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tracoco/DifyGate/config"
+	"github.com/tracoco/DifyGate/gate"
+)
+
+func TestSignatureAlert(t *testing.T) {
+	if newSignatureAlert(config.SignatureAlertConfig{}, nil, nil, quietLogger()) != nil {
+		t.Fatal("alert without a threshold, want none")
+	}
+	alert := newSignatureAlert(config.SignatureAlertConfig{
+		Threshold:   3,
+		Window:      time.Minute,
+		Cooldown:    time.Hour,
+		NotifyEmail: []string{"ops@example.com"},
+	}, nil, nil, quietLogger())
+	var mu sync.Mutex
+	var sent []gate.Message
+	alert.send = func(msg gate.Message) error {
+		mu.Lock()
+		defer mu.Unlock()
+		sent = append(sent, msg)
+		return nil
+	}
+	emails := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(sent)
+	}
+	waitEmails := func(want int) {
+		t.Helper()
+		for deadline := time.Now().Add(time.Second); emails() < want && time.Now().Before(deadline); {
+			time.Sleep(5 * time.Millisecond)
+		}
+		if n := emails(); n != want {
+			t.Fatalf("sent %d emails, want %d", n, want)
+		}
+	}
+
+	now := time.Now()
+	// Failures further apart than the window start over
+	alert.failed("whatsapp", now)
+	alert.failed("whatsapp", now.Add(30*time.Second))
+	alert.failed("whatsapp", now.Add(2*time.Minute))
+	if failing := alert.failing(); len(failing) != 0 {
+		t.Fatalf("failing %v after a restarted streak, want none", failing)
+	}
+	alert.failed("whatsapp", now.Add(2*time.Minute+10*time.Second))
+	alert.failed("whatsapp", now.Add(2*time.Minute+20*time.Second))
+	if failing := alert.failing(); len(failing) != 1 || failing[0] != "whatsapp" {
+		t.Fatalf("failing %v, want whatsapp", failing)
+	}
+	waitEmails(1)
+	if msg := sent[0]; len(msg.To) != 1 || msg.To[0] != "ops@example.com" {
+		t.Errorf("alert sent to %v", msg.To)
+	}
+	// Further failures don't alert again
+	alert.failed("whatsapp", now.Add(3*time.Minute))
+	alert.failed("slack", now.Add(3*time.Minute))
+
+	// A verified webhook ends the streak, and another one within the
+	// cooldown is flagged but not notified
+	alert.verified("whatsapp")
+	if failing := alert.failing(); len(failing) != 0 {
+		t.Fatalf("failing %v after a verified webhook, want none", failing)
+	}
+	for i := 0; i < 3; i++ {
+		alert.failed("whatsapp", now.Add(10*time.Minute))
+	}
+	if failing := alert.failing(); len(failing) != 1 {
+		t.Fatalf("failing %v, want whatsapp again", failing)
+	}
+	time.Sleep(20 * time.Millisecond)
+	waitEmails(1)
+
+	alert.verified("whatsapp")
+	for i := 0; i < 3; i++ {
+		alert.failed("whatsapp", now.Add(2*time.Hour))
+	}
+	waitEmails(2)
+}
+
+func TestHealthCheckReportsFailingSignatures(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/health", HealthCheck(config.FeaturesConfig{}))
+	health := func() map[string]interface{} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+		var body map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		return body
+	}
+
+	signatureFailures.configure(config.SentryConfig{}, newSignatureAlert(config.SignatureAlertConfig{Threshold: 2, Window: time.Minute}, nil, nil, quietLogger()))
+	defer signatureFailures.configure(config.SentryConfig{}, nil)
+	if body := health(); body["webhook_signature_failing"] != false || body["webhook_signature_failing_channels"] != nil {
+		t.Fatalf("health %v, want no failing signatures", body)
+	}
+	signatureFailures.failed("messenger")
+	signatureFailures.failed("messenger")
+	body := health()
+	channels, _ := body["webhook_signature_failing_channels"].([]interface{})
+	if body["webhook_signature_failing"] != true || len(channels) != 1 || channels[0] != "messenger" {
+		t.Fatalf("health %v, want messenger failing", body)
+	}
+	signatureFailures.verified("messenger")
+	if body := health(); body["webhook_signature_failing"] != false {
+		t.Fatalf("health %v after a verified webhook, want none failing", body)
+	}
+}
@@ -0,0 +1,86 @@
+package gateapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tracoco/DifyGate/config"
+)
+
+const (
+	// slackMaxTextLength keeps replies under Slack's 40,000 character limit
+	slackMaxTextLength = 39000
+	// slackMaxMessageLength splits replies where Slack advises, at 4,000
+	// characters, well before they would be truncated
+	slackMaxMessageLength = 4000
+)
+
+// SlackClient calls the Slack Web API with a bot token
+type SlackClient struct {
+	botToken string
+	baseURL  string
+	client   *http.Client
+}
+
+// NewSlackClient creates a new Slack Web API client
+func NewSlackClient(cfg config.SlackConfig, clients *HTTPClients) *SlackClient {
+	return &SlackClient{
+		botToken: cfg.BotToken,
+		baseURL:  strings.TrimSuffix(cfg.APIBaseURL, "/"),
+		client:   clients.Client("slack", 10*time.Second),
+	}
+}
+
+// PostMessage posts text to a channel, inside threadTS's thread when set,
+// and returns the new message's timestamp
+func (sc *SlackClient) PostMessage(ctx context.Context, channel, threadTS, text string) (string, error) {
+	if len(text) > slackMaxTextLength {
+		text = text[:slackMaxTextLength-3] + "..."
+	}
+
+	payload := map[string]interface{}{
+		"channel": channel,
+		"text":    text,
+		"mrkdwn":  true,
+	}
+	if threadTS != "" {
+		payload["thread_ts"] = threadTS
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal Slack message: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", sc.baseURL+"/chat.postMessage", bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("failed to create Slack request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set("Authorization", "Bearer "+sc.botToken)
+
+	resp, err := sc.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to send Slack message: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// The Web API reports most failures as 200 with ok=false
+	var result struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error"`
+		TS    string `json:"ts"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("failed to parse Slack response (status %d): %w", resp.StatusCode, err)
+	}
+	if !result.OK {
+		return "", fmt.Errorf("Slack API error: %s", result.Error)
+	}
+	return result.TS, nil
+}
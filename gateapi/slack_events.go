@@ -0,0 +1,214 @@
+package gateapi
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/apierror"
+	"github.com/tracoco/DifyGate/config"
+	"github.com/tracoco/DifyGate/events"
+	"github.com/tracoco/DifyGate/store"
+)
+
+// slackMaxSignatureAge rejects replayed requests, as Slack recommends
+const slackMaxSignatureAge = 5 * time.Minute
+
+// slackMentionPattern matches user mentions such as <@U123ABC>
+var slackMentionPattern = regexp.MustCompile(`<@[A-Z0-9]+>`)
+
+// SlackEventEnvelope is the outer body of a Slack Events API request
+type SlackEventEnvelope struct {
+	Type      string     `json:"type"`
+	Challenge string     `json:"challenge,omitempty"`
+	TeamID    string     `json:"team_id,omitempty"`
+	Event     SlackEvent `json:"event"`
+}
+
+// SlackEvent is the subset of message and app_mention events we use
+type SlackEvent struct {
+	Type        string `json:"type"`
+	Subtype     string `json:"subtype,omitempty"`
+	ChannelType string `json:"channel_type,omitempty"`
+	Channel     string `json:"channel"`
+	User        string `json:"user"`
+	BotID       string `json:"bot_id,omitempty"`
+	Text        string `json:"text"`
+	TS          string `json:"ts"`
+	ThreadTS    string `json:"thread_ts,omitempty"`
+}
+
+// SlackHandler answers Slack DMs and mentions with Dify
+type SlackHandler struct {
+	log      *logrus.Logger
+	cfg      config.SlackConfig
+	pipeline *MessagePipeline
+}
+
+// NewSlackHandler creates a new Slack events handler
+func NewSlackHandler(cfg config.SlackConfig, chatCfg config.ChatConfig, difyCfg config.DifyConfig, clients *HTTPClients, difyHandler *DifyHandler, messages *Messages, kv store.Store, dispatcher *events.Dispatcher, log *logrus.Logger) *SlackHandler {
+	return &SlackHandler{
+		log: log,
+		cfg: cfg,
+		pipeline: NewMessagePipeline(PipelineOptions{
+			Channel:          "slack",
+			MaxMessageLength: slackMaxMessageLength,
+			ConversationTTL:  cfg.ConversationTTL,
+			Format:           func(_ ChannelMessage, text string) string { return markdownToMrkdwn(text) },
+			// Each thread is its own conversation, shared by everyone in it
+			ConversationKey: func(msg ChannelMessage) string {
+				return "slack:conversation:" + msg.ChannelID + ":" + msg.ThreadID
+			},
+		}, &slackSender{client: NewSlackClient(cfg, clients)}, chatCfg, messages, difyCfg, difyHandler, kv, dispatcher),
+	}
+}
+
+// Hooks returns the message hooks of the Slack pipeline, for adding
+// custom ones
+func (h *SlackHandler) Hooks() *MessageHooks {
+	return h.pipeline.hooks
+}
+
+// slackSender posts pipeline replies in the thread of the message
+type slackSender struct {
+	client *SlackClient
+}
+
+// SendText posts a reply in the message's thread
+func (s *slackSender) SendText(ctx context.Context, msg ChannelMessage, text string) (string, error) {
+	return s.client.PostMessage(ctx, msg.ChannelID, msg.ThreadID, text)
+}
+
+// SendTyping does nothing; bots can't show typing through the Events API
+func (s *slackSender) SendTyping(ctx context.Context, msg ChannelMessage) error {
+	return nil
+}
+
+// SendMedia posts a link to the file, as bots can't attach remote files
+func (s *slackSender) SendMedia(ctx context.Context, msg ChannelMessage, media ChannelAttachment) error {
+	_, err := s.client.PostMessage(ctx, msg.ChannelID, msg.ThreadID, media.URL)
+	return err
+}
+
+// VerifySlackSignature checks the X-Slack-Signature of a request body
+// against the signing secret, rejecting stale timestamps
+func VerifySlackSignature(body []byte, timestamp, signature, signingSecret string, now time.Time) bool {
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	if age := now.Sub(time.Unix(ts, 0)); age > slackMaxSignatureAge || age < -slackMaxSignatureAge {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(signingSecret))
+	mac.Write([]byte("v0:" + timestamp + ":"))
+	mac.Write(body)
+	expected := "v0=" + hex.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
+
+// HandleSlackEvents handles POST requests from the Slack Events API
+func (h *SlackHandler) HandleSlackEvents(c *gin.Context) {
+	reqLog := requestLogger(c, h.log)
+
+	if !h.cfg.Enabled() {
+		apierror.Respond(c, http.StatusServiceUnavailable, apierror.NotConfigured, "Slack integration is not configured")
+		return
+	}
+
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		if isBodyTooLarge(err) {
+			reqLog.WithField("limit", c.GetInt64(bodyLimitKey)).Warn("Slack event body exceeds size limit")
+			abortBodyTooLarge(c)
+			return
+		}
+		reqLog.WithError(err).Error("Failed to read Slack event body")
+		apierror.Respond(c, http.StatusBadRequest, apierror.InvalidBody, "Failed to read request body")
+		return
+	}
+
+	if !VerifySlackSignature(body, c.GetHeader("X-Slack-Request-Timestamp"), c.GetHeader("X-Slack-Signature"), h.cfg.SigningSecret, time.Now()) {
+		reqLog.Warn("Slack signature verification failed")
+		signatureFailures.failed("slack")
+		apierror.Respond(c, http.StatusUnauthorized, apierror.InvalidSignature, "Invalid signature")
+		return
+	}
+	signatureFailures.verified("slack")
+
+	var envelope SlackEventEnvelope
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		apierror.Respond(c, http.StatusBadRequest, apierror.InvalidBody, "Failed to parse request body")
+		return
+	}
+
+	// Answer the one-off URL verification handshake
+	if envelope.Type == "url_verification" {
+		c.JSON(http.StatusOK, gin.H{"challenge": envelope.Challenge})
+		return
+	}
+
+	// Slack retries when we're slow to ack; the first delivery is already
+	// being processed, so don't answer twice
+	if retry := c.GetHeader("X-Slack-Retry-Num"); retry != "" {
+		reqLog.WithField("retry", retry).Debug("Ignoring Slack event retry")
+		c.Status(http.StatusOK)
+		return
+	}
+
+	if envelope.Type == "event_callback" && h.shouldAnswer(envelope.Event) {
+		// Slack expects an ack within 3 seconds, so answer asynchronously
+		h.processSlackEvent(reqLog, envelope.Event)
+	}
+
+	c.Status(http.StatusOK)
+}
+
+// shouldAnswer accepts direct messages and mentions from people, skipping
+// bot messages (including our own replies) and edits/joins/etc.
+func (h *SlackHandler) shouldAnswer(ev SlackEvent) bool {
+	if ev.BotID != "" || ev.Subtype != "" || ev.User == "" {
+		return false
+	}
+	switch ev.Type {
+	case "app_mention":
+		return true
+	case "message":
+		return ev.ChannelType == "im"
+	}
+	return false
+}
+
+// processSlackEvent answers the message in its thread, in the background
+func (h *SlackHandler) processSlackEvent(log *logrus.Entry, ev SlackEvent) {
+	// Mentions start (or continue) a thread under the message; DMs stay in
+	// the main conversation unless the user replied in a thread
+	threadTS := ev.ThreadTS
+	if threadTS == "" && ev.Type == "app_mention" {
+		threadTS = ev.TS
+	}
+
+	query := strings.TrimSpace(slackMentionPattern.ReplaceAllString(ev.Text, ""))
+	if query == "" {
+		return
+	}
+
+	go h.pipeline.Enqueue(log.WithField("slack_channel", ev.Channel), ChannelMessage{
+		ChannelID: ev.Channel,
+		UserID:    ev.User,
+		Text:      query,
+		ReplyTo:   ev.TS,
+		ThreadID:  threadTS,
+	})()
+}
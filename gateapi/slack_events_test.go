@@ -0,0 +1,265 @@
+package gateapi
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tracoco/DifyGate/config"
+	"github.com/tracoco/DifyGate/store"
+)
+
+// slackPost is a chat.postMessage call the fake Slack received
+type slackPost struct {
+	Authorization string
+	Channel       string  `json:"channel"`
+	Text          string  `json:"text"`
+	Mrkdwn        bool    `json:"mrkdwn"`
+	ThreadTS      *string `json:"thread_ts"`
+}
+
+// fakeSlack serves chat.postMessage, answering with respond
+type fakeSlack struct {
+	mu      sync.Mutex
+	posts   []slackPost
+	respond func(w http.ResponseWriter)
+}
+
+func newFakeSlack(t *testing.T) (*fakeSlack, *httptest.Server) {
+	t.Helper()
+	f := &fakeSlack{respond: func(w http.ResponseWriter) {
+		w.Write([]byte(`{"ok":true,"ts":"1700000000.000200"}`))
+	}}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/chat.postMessage" {
+			http.NotFound(w, r)
+			return
+		}
+		raw, _ := io.ReadAll(r.Body)
+		post := slackPost{Authorization: r.Header.Get("Authorization")}
+		json.Unmarshal(raw, &post)
+		f.mu.Lock()
+		f.posts = append(f.posts, post)
+		respond := f.respond
+		f.mu.Unlock()
+		respond(w)
+	}))
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+func (f *fakeSlack) sent() []slackPost {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]slackPost(nil), f.posts...)
+}
+
+func TestSlackPostMessage(t *testing.T) {
+	f, srv := newFakeSlack(t)
+	client := NewSlackClient(config.SlackConfig{BotToken: "xoxb-1", APIBaseURL: srv.URL + "/"}, testHTTPClients())
+
+	ts, err := client.PostMessage(context.Background(), "C1", "1700000000.000100", "*hi*")
+	if err != nil || ts != "1700000000.000200" {
+		t.Fatalf("PostMessage = %q, %v, want the new message's ts", ts, err)
+	}
+	post := f.sent()[0]
+	if post.Authorization != "Bearer xoxb-1" || post.Channel != "C1" || post.Text != "*hi*" || !post.Mrkdwn {
+		t.Errorf("posted %+v", post)
+	}
+	if post.ThreadTS == nil || *post.ThreadTS != "1700000000.000100" {
+		t.Errorf("thread_ts %v, want the thread", post.ThreadTS)
+	}
+
+	// Outside a thread there is no thread_ts at all
+	client.PostMessage(context.Background(), "C1", "", "hi")
+	if post := f.sent()[1]; post.ThreadTS != nil {
+		t.Errorf("thread_ts %q for a message outside a thread", *post.ThreadTS)
+	}
+
+	client.PostMessage(context.Background(), "C1", "", strings.Repeat("a", slackMaxTextLength+100))
+	if text := f.sent()[2].Text; len(text) != slackMaxTextLength || !strings.HasSuffix(text, "...") {
+		t.Errorf("posted %d characters, want a text cut to %d", len(text), slackMaxTextLength)
+	}
+}
+
+func TestSlackPostMessageErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		respond func(w http.ResponseWriter)
+		want    string
+	}{
+		{"api error", func(w http.ResponseWriter) {
+			w.Write([]byte(`{"ok":false,"error":"channel_not_found"}`))
+		}, "Slack API error: channel_not_found"},
+		{"unparseable", func(w http.ResponseWriter) {
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte("<html>Bad Gateway</html>"))
+		}, "status 502"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, srv := newFakeSlack(t)
+			f.respond = tt.respond
+			client := NewSlackClient(config.SlackConfig{BotToken: "xoxb-1", APIBaseURL: srv.URL}, testHTTPClients())
+			_, err := client.PostMessage(context.Background(), "C1", "", "hi")
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// slackSignature signs body the way Slack does
+func slackSignature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("v0:" + timestamp + ":"))
+	mac.Write(body)
+	return "v0=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifySlackSignature(t *testing.T) {
+	now := time.Now()
+	body := []byte(`{"type":"event_callback"}`)
+	ts := strconv.FormatInt(now.Unix(), 10)
+	stale := strconv.FormatInt(now.Add(-10*time.Minute).Unix(), 10)
+
+	tests := []struct {
+		name      string
+		timestamp string
+		signature string
+		want      bool
+	}{
+		{"valid", ts, slackSignature("signing", ts, body), true},
+		{"wrong secret", ts, slackSignature("other", ts, body), false},
+		{"stale", stale, slackSignature("signing", stale, body), false},
+		{"bad timestamp", "yesterday", slackSignature("signing", "yesterday", body), false},
+		{"missing", ts, "", false},
+	}
+	for _, tt := range tests {
+		if got := VerifySlackSignature(body, tt.timestamp, tt.signature, "signing", now); got != tt.want {
+			t.Errorf("%s: VerifySlackSignature = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// newTestSlackHandler creates a Slack handler answering through a fake
+// Dify and posting to a fake Slack
+func newTestSlackHandler(t *testing.T) (*gin.Engine, *fakeSlack) {
+	t.Helper()
+	_, difyHandler := newFakeDify(t, func(req ChatMessageRequest) []StreamingChatResponse {
+		return difyAnswer("conv-1", "**Opening** hours are 9 to 5.")
+	})
+	f, srv := newFakeSlack(t)
+	cfg := config.SlackConfig{SigningSecret: "signing", BotToken: "xoxb-1", APIBaseURL: srv.URL}
+	h := NewSlackHandler(cfg, config.ChatConfig{}, config.DifyConfig{StreamTimeout: 5 * time.Second}, testHTTPClients(),
+		difyHandler, NewMessages(config.MessagesConfig{}), store.New("", quietLogger()), nil, quietLogger())
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/api/v1/slack/events", h.HandleSlackEvents)
+	return r, f
+}
+
+// postSlackEvent sends body signed with the test signing secret
+func postSlackEvent(r *gin.Engine, body string, header http.Header) *httptest.ResponseRecorder {
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/slack/events", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Slack-Request-Timestamp", ts)
+	req.Header.Set("X-Slack-Signature", slackSignature("signing", ts, []byte(body)))
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestSlackEventsURLVerification(t *testing.T) {
+	r, _ := newTestSlackHandler(t)
+
+	w := postSlackEvent(r, `{"type":"url_verification","challenge":"abc123"}`, nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"challenge":"abc123"`) {
+		t.Errorf("status %d, body %s, want the challenge echoed", w.Code, w.Body.String())
+	}
+
+	w = postSlackEvent(r, `{"type":"url_verification","challenge":"abc123"}`, http.Header{"X-Slack-Signature": {"v0=bad"}})
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("status %d for a bad signature, want 401", w.Code)
+	}
+}
+
+func TestSlackEventsAnswersMentionInThread(t *testing.T) {
+	r, f := newTestSlackHandler(t)
+
+	w := postSlackEvent(r, `{"type":"event_callback","event":{"type":"app_mention","channel":"C1","user":"U1","text":"<@UBOT> When are you open?","ts":"1700000000.000100"}}`, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200", w.Code)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(f.sent()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	posts := f.sent()
+	if len(posts) != 1 {
+		t.Fatalf("posted %d messages, want the answer", len(posts))
+	}
+	if post := posts[0]; post.Channel != "C1" || post.Text != "*Opening* hours are 9 to 5." || post.ThreadTS == nil || *post.ThreadTS != "1700000000.000100" {
+		t.Errorf("posted %+v, want the answer in mrkdwn under the mention", post)
+	}
+}
+
+func TestSlackEventsIgnored(t *testing.T) {
+	r, f := newTestSlackHandler(t)
+
+	tests := []struct {
+		name   string
+		body   string
+		header http.Header
+	}{
+		{"bot message", `{"type":"event_callback","event":{"type":"message","channel_type":"im","channel":"D1","user":"U1","bot_id":"B1","text":"hi","ts":"1"}}`, nil},
+		{"edit", `{"type":"event_callback","event":{"type":"message","subtype":"message_changed","channel_type":"im","channel":"D1","user":"U1","text":"hi","ts":"2"}}`, nil},
+		{"channel message", `{"type":"event_callback","event":{"type":"message","channel_type":"channel","channel":"C1","user":"U1","text":"hi","ts":"3"}}`, nil},
+		{"retry", `{"type":"event_callback","event":{"type":"message","channel_type":"im","channel":"D1","user":"U1","text":"hi","ts":"4"}}`, http.Header{"X-Slack-Retry-Num": {"1"}}},
+		{"mention only", `{"type":"event_callback","event":{"type":"app_mention","channel":"C1","user":"U1","text":"<@UBOT>","ts":"5"}}`, nil},
+	}
+	for _, tt := range tests {
+		if w := postSlackEvent(r, tt.body, tt.header); w.Code != http.StatusOK {
+			t.Errorf("%s: status %d, want 200", tt.name, w.Code)
+		}
+	}
+	time.Sleep(200 * time.Millisecond)
+	if posts := f.sent(); len(posts) != 0 {
+		t.Errorf("posted %+v, want nothing answered", posts)
+	}
+}
+
+func TestMarkdownToMrkdwn(t *testing.T) {
+	tests := []struct {
+		md, want string
+	}{
+		{"**bold** and *italic*", "*bold* and _italic_"},
+		{"# Hours", "*Hours*"},
+		{"- one\n- two", "• one\n• two"},
+		{"~~old~~ [docs](https://example.com/a)", "~old~ <https://example.com/a|docs>"},
+		{"a < b & c", "a &lt; b &amp; c"},
+		{"`**kept**` and ```\n**kept**\n```", "`**kept**` and ```\n**kept**\n```"},
+	}
+	for _, tt := range tests {
+		if got := markdownToMrkdwn(tt.md); got != tt.want {
+			t.Errorf("markdownToMrkdwn(%q) = %q, want %q", tt.md, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package gateapi
+
+import (
+	"regexp"
+	"strings"
+)
+
+var (
+	// slackCodePattern matches fenced and inline code, left untouched
+	slackCodePattern = regexp.MustCompile("(?s)```.*?```|`[^`\n]+`")
+
+	mdBoldPattern    = regexp.MustCompile(`\*\*(.+?)\*\*|__(.+?)__`)
+	mdItalicPattern  = regexp.MustCompile(`(^|[^*\w])\*([^*\s][^*]*?)\*`)
+	mdStrikePattern  = regexp.MustCompile(`~~(.+?)~~`)
+	mdLinkPattern    = regexp.MustCompile(`\[([^\]]+)\]\((https?://[^\s)]+)\)`)
+	mdHeadingPattern = regexp.MustCompile(`(?m)^#{1,6}\s+(.+?)\s*#*$`)
+	mdBulletPattern  = regexp.MustCompile(`(?m)^(\s*)[*-]\s+`)
+)
+
+// markdownToMrkdwn converts the Markdown Dify produces into Slack's mrkdwn:
+// **bold** becomes *bold*, *italic* becomes _italic_, [text](url) becomes
+// <url|text>, headings become bold lines and &, < and > are escaped. Code
+// spans and blocks are passed through unchanged.
+func markdownToMrkdwn(md string) string {
+	var out strings.Builder
+	last := 0
+	for _, loc := range slackCodePattern.FindAllStringIndex(md, -1) {
+		out.WriteString(convertMarkdownText(md[last:loc[0]]))
+		out.WriteString(md[loc[0]:loc[1]])
+		last = loc[1]
+	}
+	out.WriteString(convertMarkdownText(md[last:]))
+	return out.String()
+}
+
+// convertMarkdownText converts a span of Markdown containing no code
+func convertMarkdownText(s string) string {
+	s = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+
+	// Bullets first so a leading "* " isn't mistaken for italics
+	s = mdBulletPattern.ReplaceAllString(s, "$1• ")
+	s = mdItalicPattern.ReplaceAllString(s, "${1}_${2}_")
+	s = mdBoldPattern.ReplaceAllStringFunc(s, func(m string) string {
+		return "*" + m[2:len(m)-2] + "*"
+	})
+	s = mdHeadingPattern.ReplaceAllString(s, "*$1*")
+	s = mdStrikePattern.ReplaceAllString(s, "~$1~")
+	s = mdLinkPattern.ReplaceAllString(s, "<$2|$1>")
+	return s
+}
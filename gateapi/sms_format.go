@@ -0,0 +1,97 @@
+package gateapi
+
+import (
+	"strings"
+)
+
+// GSM 03.38 characters; anything else forces UCS-2 encoding
+const (
+	gsm7Basic     = "@£$¥èéùìòÇ\nØø\rÅåΔ_ΦΓΛΩΠΨΣΘΞÆæßÉ !\"#¤%&'()*+,-./0123456789:;<=>?¡ABCDEFGHIJKLMNOPQRSTUVWXYZÄÖÑÜ§¿abcdefghijklmnopqrstuvwxyzäöñüà"
+	gsm7Extension = "^{}\\[~]|€\f"
+)
+
+// smsPlainText strips the Markdown Dify produces, which SMS can't render
+func smsPlainText(md string) string {
+	s := mdBoldPattern.ReplaceAllStringFunc(md, func(m string) string {
+		return m[2 : len(m)-2]
+	})
+	s = mdHeadingPattern.ReplaceAllString(s, "$1")
+	s = mdStrikePattern.ReplaceAllString(s, "$1")
+	s = mdLinkPattern.ReplaceAllString(s, "$1 ($2)")
+	s = mdBulletPattern.ReplaceAllString(s, "$1- ")
+	return strings.TrimSpace(s)
+}
+
+// smsUnits returns the length of s in encoding units (GSM-7 septets or
+// UCS-2 code units) and whether it can be sent as GSM-7
+func smsUnits(s string) (int, bool) {
+	units := 0
+	for _, r := range s {
+		switch {
+		case strings.ContainsRune(gsm7Basic, r):
+			units++
+		case strings.ContainsRune(gsm7Extension, r):
+			units += 2
+		default:
+			return ucs2Units(s), false
+		}
+	}
+	return units, true
+}
+
+// ucs2Units counts UTF-16 code units, as characters outside the BMP take two
+func ucs2Units(s string) int {
+	units := 0
+	for _, r := range s {
+		if r > 0xFFFF {
+			units += 2
+		} else {
+			units++
+		}
+	}
+	return units
+}
+
+// smsCapacity returns how many units fit in maxSegments segments
+func smsCapacity(gsm7 bool, maxSegments int) int {
+	single, multi := 70, 67
+	if gsm7 {
+		single, multi = 160, 153
+	}
+	if maxSegments <= 1 {
+		return single
+	}
+	return multi * maxSegments
+}
+
+// fitSMSSegments truncates text, ending it with notice, so it fits in
+// maxSegments concatenated segments, which Twilio sends as one message
+func fitSMSSegments(text, notice string, maxSegments int) string {
+	units, gsm7 := smsUnits(text)
+	if units <= smsCapacity(gsm7, maxSegments) {
+		return text
+	}
+
+	// A translated notice may itself need UCS-2, which then applies to all
+	noticeUnits, noticeGSM7 := smsUnits(notice)
+	gsm7 = gsm7 && noticeGSM7
+	if !gsm7 {
+		noticeUnits = ucs2Units(notice)
+	}
+	budget := smsCapacity(gsm7, maxSegments) - noticeUnits
+
+	var out strings.Builder
+	used := 0
+	for _, r := range text {
+		n := ucs2Units(string(r))
+		if gsm7 {
+			n, _ = smsUnits(string(r))
+		}
+		if used+n > budget {
+			break
+		}
+		out.WriteRune(r)
+		used += n
+	}
+	return strings.TrimSpace(out.String()) + notice
+}
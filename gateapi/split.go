@@ -0,0 +1,37 @@
+package gateapi
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// splitMessage breaks text into chunks of at most limit runes, preferring
+// to cut at a newline, then a space, in the second half of each chunk
+func splitMessage(text string, limit int) []string {
+	var chunks []string
+	for {
+		text = strings.TrimSpace(text)
+		if text == "" {
+			return chunks
+		}
+		if utf8.RuneCountInString(text) <= limit {
+			return append(chunks, text)
+		}
+
+		// Byte offset of the rune just past the limit
+		cut := 0
+		for i := 0; i < limit; i++ {
+			_, size := utf8.DecodeRuneInString(text[cut:])
+			cut += size
+		}
+
+		head := text[:cut]
+		if i := strings.LastIndex(head, "\n"); i > len(head)/2 {
+			cut = i
+		} else if i := strings.LastIndex(head, " "); i > len(head)/2 {
+			cut = i
+		}
+		chunks = append(chunks, text[:cut])
+		text = text[cut:]
+	}
+}
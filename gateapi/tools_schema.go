@@ -0,0 +1,79 @@
+package gateapi
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ToolSchemaHandler serves a minimal OpenAPI document that can be imported
+// as a Dify custom tool, letting Dify apps send email through the gateway.
+// Parameters are kept flat (strings and booleans) since that's what Dify
+// maps reliably.
+func ToolSchemaHandler(externalURL string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{
+			"openapi": "3.1.0",
+			"info": gin.H{
+				"title":       "DifyGate",
+				"description": "Send email through DifyGate",
+				"version":     "v1",
+			},
+			"servers": []gin.H{{"url": baseURL(c, externalURL)}},
+			"paths": gin.H{
+				"/api/v1/emails/send": gin.H{
+					"post": gin.H{
+						"operationId": "sendEmail",
+						"summary":     "Send an email",
+						"description": "Send an email to one or more recipients",
+						"requestBody": gin.H{
+							"required": true,
+							"content": gin.H{
+								"application/json": gin.H{
+									"schema": gin.H{
+										"type":     "object",
+										"required": []string{"to", "subject", "body"},
+										"properties": gin.H{
+											"to":      gin.H{"type": "string", "description": "Recipient email addresses, comma-separated"},
+											"cc":      gin.H{"type": "string", "description": "CC email addresses, comma-separated"},
+											"bcc":     gin.H{"type": "string", "description": "BCC email addresses, comma-separated"},
+											"subject": gin.H{"type": "string", "description": "Email subject"},
+											"body":    gin.H{"type": "string", "description": "Email body"},
+											"is_html": gin.H{"type": "boolean", "description": "Whether the body is HTML"},
+										},
+									},
+								},
+							},
+						},
+						"responses": gin.H{
+							"200": gin.H{"description": "Email sent"},
+						},
+					},
+				},
+			},
+			"components": gin.H{
+				"securitySchemes": gin.H{
+					"bearerAuth": gin.H{"type": "http", "scheme": "bearer"},
+				},
+			},
+			"security": []gin.H{{"bearerAuth": []string{}}},
+		})
+	}
+}
+
+// baseURL returns the configured external URL, or one derived from the
+// request when none is configured
+func baseURL(c *gin.Context, externalURL string) string {
+	if externalURL != "" {
+		return strings.TrimSuffix(externalURL, "/")
+	}
+
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	} else if proto := c.GetHeader("X-Forwarded-Proto"); proto == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + c.Request.Host
+}
@@ -0,0 +1,237 @@
+package gateapi
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/apierror"
+	"github.com/tracoco/DifyGate/config"
+	"github.com/tracoco/DifyGate/gate"
+	"github.com/tracoco/DifyGate/history"
+	"github.com/tracoco/DifyGate/metrics"
+)
+
+// transcriptsSent counts emailed transcripts by who asked, admin or user,
+// and outcome: sent or failed
+var transcriptsSent = metrics.NewCounter("difygate_transcripts_total",
+	"Conversation transcripts emailed, by who asked for them", "source", "outcome")
+
+// errNoTranscript is returned for a user with no recorded messages
+var errNoTranscript = errors.New("no messages recorded for the user")
+
+// transcriptTemplate renders a transcript; html/template escapes the
+// messages
+var transcriptTemplate = template.Must(template.New("transcript").Parse(`<!DOCTYPE html>
+<html>
+<body style="font-family: Arial, sans-serif; font-size: 14px; color: #222;">
+<h2 style="font-size: 18px;">WhatsApp conversation with {{.UserID}}</h2>
+<p style="color: #666;">{{len .Lines}} messages from {{.From}} to {{.To}}{{if .Truncated}}. Long messages are shortened to {{.MaxLength}} characters{{end}}.</p>
+<table cellpadding="6" style="border-collapse: collapse; width: 100%;">
+{{- range .Lines}}
+<tr style="vertical-align: top; border-bottom: 1px solid #eee;{{if .Inbound}} background: #f6f8fa;{{end}}">
+<td style="white-space: nowrap; color: #666;">{{.Time}}</td>
+<td style="white-space: nowrap; font-weight: bold;">{{.Who}}</td>
+<td style="white-space: pre-wrap;">{{.Text}}</td>
+</tr>
+{{- end}}
+</table>
+</body>
+</html>
+`))
+
+// transcriptLine is one message of a rendered transcript
+type transcriptLine struct {
+	Time, Who, Text string
+	Inbound         bool
+}
+
+// transcripts emails a WhatsApp user's conversation, as recorded in the
+// message history
+type transcripts struct {
+	cfg     config.TranscriptConfig
+	history *history.Recorder
+	// send delivers the email; tests replace it
+	send func(gate.Message) error
+}
+
+// newTranscripts returns nil when the message history is disabled, as
+// there is nothing to send
+func newTranscripts(cfg config.TranscriptConfig, recorder *history.Recorder, mail *gate.Service) *transcripts {
+	if recorder == nil {
+		return nil
+	}
+	return &transcripts{cfg: cfg, history: recorder, send: mail.Send}
+}
+
+// render returns the HTML transcript of the user's latest messages, or
+// errNoTranscript
+func (tr *transcripts) render(userID string) (string, int, error) {
+	var records []history.Record
+	for _, rec := range tr.history.Find(history.Query{UserID: userID}) {
+		if rec.Channel == "whatsapp" {
+			records = append(records, rec)
+		}
+	}
+	if len(records) == 0 {
+		return "", 0, errNoTranscript
+	}
+	if len(records) > tr.cfg.MaxMessages {
+		records = records[:tr.cfg.MaxMessages]
+	}
+
+	data := struct {
+		UserID, From, To string
+		Lines            []transcriptLine
+		Truncated        bool
+		MaxLength        int
+	}{UserID: userID, MaxLength: tr.cfg.MaxMessageLength}
+	// Newest first, so read backwards
+	for i := len(records) - 1; i >= 0; i-- {
+		rec := records[i]
+		line := transcriptLine{
+			Time:    rec.Timestamp.UTC().Format("2006-01-02 15:04 UTC"),
+			Who:     "Bot",
+			Text:    rec.Text,
+			Inbound: rec.Direction == history.Inbound,
+		}
+		switch {
+		case line.Inbound:
+			line.Who = "User"
+		case rec.Human && rec.Agent != "":
+			line.Who = "Agent " + rec.Agent
+		case rec.Human:
+			line.Who = "Agent"
+		}
+		if utf8.RuneCountInString(line.Text) > tr.cfg.MaxMessageLength {
+			line.Text = string([]rune(line.Text)[:tr.cfg.MaxMessageLength]) + "…"
+			data.Truncated = true
+		}
+		data.Lines = append(data.Lines, line)
+	}
+	data.From, data.To = data.Lines[0].Time, data.Lines[len(data.Lines)-1].Time
+
+	var b bytes.Buffer
+	if err := transcriptTemplate.Execute(&b, data); err != nil {
+		return "", 0, err
+	}
+	return b.String(), len(data.Lines), nil
+}
+
+// email sends the user's transcript to address, counting it under source
+func (tr *transcripts) email(source, userID, address string) (int, error) {
+	body, n, err := tr.render(userID)
+	if err != nil {
+		return 0, err
+	}
+	err = tr.send(gate.Message{
+		To:      []string{address},
+		Subject: fmt.Sprintf("Transcript of the WhatsApp conversation with %s", userID),
+		Body:    body,
+		IsHTML:  true,
+	})
+	if err != nil {
+		transcriptsSent.Inc(source, "failed")
+		return 0, err
+	}
+	transcriptsSent.Inc(source, "sent")
+	return n, nil
+}
+
+// transcriptKey is the store key limiting a user's /transcript requests
+func (p *MessagePipeline) transcriptKey(msg ChannelMessage) string {
+	return p.opts.Channel + ":transcript:" + msg.ChannelID + ":" + msg.UserID
+}
+
+// emailTranscript handles /transcript <address>: the user's conversation
+// is emailed to the address they typed, and never anywhere else
+func (p *MessagePipeline) emailTranscript(t *messageTrace, msg ChannelMessage, arg string) {
+	locale := p.locale(msg)
+	address, ok := normalizeAddress(arg)
+	if !ok {
+		p.notify(t, msg, p.messages.Get(locale, config.MsgTranscriptInvalid))
+		return
+	}
+	log := t.log.WithField("to", address)
+	if cooldown := p.transcripts.cfg.UserCooldown; cooldown > 0 {
+		n, err := p.store.Incr(p.transcriptKey(msg), cooldown)
+		if err != nil {
+			log.WithError(err).Warn("Failed to check the user's last transcript, sending it")
+		} else if n > 1 {
+			log.Info("Refusing a transcript so soon after the last")
+			p.notify(t, msg, p.messages.Get(locale, config.MsgTranscriptWait))
+			return
+		}
+	}
+
+	n, err := p.transcripts.email("user", msg.UserID, address)
+	if err != nil && !errors.Is(err, errNoTranscript) {
+		ref := newErrorRef()
+		log.WithError(err).WithField("error_ref", ref).Error("Failed to email the transcript")
+		p.notify(t, msg, p.messages.Error(locale, config.MsgError, ref))
+		return
+	}
+	log.WithField("messages", n).Info("Transcript emailed at the user's request")
+	p.notify(t, msg, strings.ReplaceAll(p.messages.Get(locale, config.MsgTranscriptSent), "{email}", address))
+}
+
+// TranscriptsHandler emails conversations to support staff
+type TranscriptsHandler struct {
+	transcripts *transcripts
+	log         *logrus.Logger
+}
+
+// NewTranscriptsHandler creates the handler of the transcript API; a nil
+// transcripts answers 404, as the message history is disabled
+func NewTranscriptsHandler(tr *transcripts, log *logrus.Logger) *TranscriptsHandler {
+	return &TranscriptsHandler{transcripts: tr, log: log}
+}
+
+// EmailTranscriptRequest names who gets a transcript
+type EmailTranscriptRequest struct {
+	To string `json:"to" binding:"required"`
+}
+
+// Email handles POST /admin/conversations/:user/email, emailing the
+// recorded WhatsApp conversation of a number to the given address
+func (h *TranscriptsHandler) Email(c *gin.Context) {
+	if h.transcripts == nil {
+		apierror.Respond(c, http.StatusNotFound, apierror.FeatureDisabled, "Message history is not enabled")
+		return
+	}
+	number, ok := apiNumber(c, "user", c.Param("user"))
+	if !ok {
+		return
+	}
+	var req EmailTranscriptRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apierror.RespondBinding(c, err)
+		return
+	}
+	address, ok := normalizeAddress(req.To)
+	if !ok {
+		apierror.Respond(c, http.StatusBadRequest, apierror.InvalidRequest, "to must be an email address")
+		return
+	}
+
+	log := requestLogger(c, h.log).WithFields(logrus.Fields{"user_id": number, "to": address})
+	n, err := h.transcripts.email("admin", number, address)
+	if errors.Is(err, errNoTranscript) {
+		apierror.Respond(c, http.StatusNotFound, apierror.NotFound, "No messages are recorded for this user")
+		return
+	}
+	if err != nil {
+		log.WithError(err).Error("Failed to email the transcript")
+		apierror.Respond(c, http.StatusInternalServerError, apierror.EmailSendFailed, "Failed to send the transcript: "+err.Error())
+		return
+	}
+	log.WithField("messages", n).Info("Transcript emailed")
+	c.JSON(http.StatusOK, gin.H{"to": address, "messages": n, "sent_at": time.Now().UTC()})
+}
@@ -0,0 +1,91 @@
+package gateapi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tracoco/DifyGate/config"
+	"github.com/tracoco/DifyGate/gate"
+	"github.com/tracoco/DifyGate/history"
+)
+
+func TestTranscripts(t *testing.T) {
+	recorder, err := history.New(config.HistoryConfig{Enabled: true, Retention: time.Hour, PruneInterval: time.Hour}, quietLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now().UTC().Add(-time.Minute)
+	for i, rec := range []history.Record{
+		{Channel: "whatsapp", UserID: "15551234567", Direction: history.Inbound, Text: "Where is <my> order?"},
+		{Channel: "whatsapp", UserID: "15551234567", Direction: history.Outbound, Text: strings.Repeat("a", 30)},
+		{Channel: "whatsapp", UserID: "15551234567", Direction: history.Outbound, Text: "On its way", Human: true, Agent: "Dana"},
+		{Channel: "email", UserID: "15551234567", Direction: history.Outbound, Text: "not a chat"},
+	} {
+		rec.Timestamp = start.Add(time.Duration(i) * time.Second)
+		recorder.Record(rec)
+	}
+	recorder.Close()
+
+	var sent []gate.Message
+	tr := newTranscripts(config.TranscriptConfig{MaxMessages: 10, MaxMessageLength: 20, UserCooldown: time.Hour}, recorder, nil)
+	tr.send = func(msg gate.Message) error {
+		sent = append(sent, msg)
+		return nil
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/conversations/:user/email", NewTranscriptsHandler(tr, quietLogger()).Email)
+	post := func(user, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/conversations/"+user+"/email", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := post("+15551234567", `{"to": "Lead <Lead@Example.com>"}`); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"messages":3`) {
+		t.Fatalf("email transcript: status %d: %s", w.Code, w.Body)
+	}
+	if len(sent) != 1 || sent[0].To[0] != "lead@example.com" || !sent[0].IsHTML {
+		t.Fatalf("sent %+v, want one HTML email to the lead", sent)
+	}
+	body := sent[0].Body
+	for _, want := range []string{"Where is &lt;my&gt; order?", strings.Repeat("a", 20) + "…", "Agent Dana", "shortened to 20 characters"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("transcript lacks %q:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, "not a chat") || strings.Index(body, "Where is") > strings.Index(body, "On its way") {
+		t.Errorf("transcript should hold the WhatsApp messages, oldest first:\n%s", body)
+	}
+	if w := post("15559999999", `{"to": "lead@example.com"}`); w.Code != http.StatusNotFound {
+		t.Errorf("user without messages: status %d, want 404", w.Code)
+	}
+	if w := post("15551234567", `{"to": "not an address"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("bad address: status %d, want 400", w.Code)
+	}
+
+	// Users only ever get it at the address they typed, and not too often
+	p, sender, _, _ := newTestPipeline(t, PipelineOptions{Channel: "whatsapp"}, config.ChatConfig{},
+		func(req ChatMessageRequest) []StreamingChatResponse { return difyAnswer("", "ok") })
+	p.transcripts = tr
+	sent = nil
+	for _, tc := range []struct{ text, reply string }{
+		{"/transcript", "Please give your email address"},
+		{"/transcript me@example.com", "I've emailed a transcript of our conversation to me@example.com."},
+		{"/transcript other@example.com", "I've sent you a transcript recently"},
+	} {
+		p.Handle(testEntry(), ChannelMessage{ChannelID: "bot", UserID: "15551234567", Text: tc.text})
+		if got := sender.sent(); len(got) != 1 || !strings.HasPrefix(got[0], tc.reply) {
+			t.Errorf("%q: sent %q, want %q", tc.text, got, tc.reply)
+		}
+	}
+	if len(sent) != 1 || sent[0].To[0] != "me@example.com" {
+		t.Errorf("user transcripts sent %+v, want one to the typed address", sent)
+	}
+}
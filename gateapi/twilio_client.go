@@ -0,0 +1,84 @@
+package gateapi
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tracoco/DifyGate/config"
+)
+
+// twilioMaxBodyLength is Twilio's limit on the body of one message
+const twilioMaxBodyLength = 1600
+
+// TwilioClient sends SMS through the Twilio REST API
+type TwilioClient struct {
+	accountSID string
+	authToken  string
+	baseURL    string
+	client     *http.Client
+}
+
+// NewTwilioClient creates a new Twilio REST client
+func NewTwilioClient(cfg config.TwilioConfig, clients *HTTPClients) *TwilioClient {
+	return &TwilioClient{
+		accountSID: cfg.AccountSID,
+		authToken:  cfg.AuthToken,
+		baseURL:    strings.TrimSuffix(cfg.APIBaseURL, "/"),
+		client:     clients.Client("twilio", 10*time.Second),
+	}
+}
+
+// SendSMS sends body from one of our numbers to a recipient
+func (tc *TwilioClient) SendSMS(ctx context.Context, from, to, body string) error {
+	form := url.Values{"From": {from}, "To": {to}, "Body": {body}}
+	endpoint := fmt.Sprintf("%s/2010-04-01/Accounts/%s/Messages.json", tc.baseURL, tc.accountSID)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return fmt.Errorf("failed to create Twilio request: %w", err)
+	}
+	req.SetBasicAuth(tc.accountSID, tc.authToken)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := tc.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send SMS: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("Twilio API returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+	return nil
+}
+
+// VerifyTwilioSignature checks X-Twilio-Signature: the base64 HMAC-SHA1 of
+// the full request URL followed by each POST parameter name and value,
+// sorted by name
+func VerifyTwilioSignature(requestURL string, params url.Values, signature, authToken string) bool {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	mac := hmac.New(sha1.New, []byte(authToken))
+	mac.Write([]byte(requestURL))
+	for _, k := range keys {
+		for _, v := range params[k] {
+			mac.Write([]byte(k + v))
+		}
+	}
+	expected := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
@@ -0,0 +1,251 @@
+package gateapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/apierror"
+	"github.com/tracoco/DifyGate/config"
+	"github.com/tracoco/DifyGate/events"
+	"github.com/tracoco/DifyGate/store"
+)
+
+// Keywords Twilio treats as opt-out and opt-in by default
+var (
+	smsStopKeywords  = map[string]bool{"STOP": true, "STOPALL": true, "UNSUBSCRIBE": true, "CANCEL": true, "END": true, "QUIT": true}
+	smsStartKeywords = map[string]bool{"START": true, "YES": true, "UNSTOP": true}
+)
+
+// TwilioSMSHandler answers SMS with Dify
+type TwilioSMSHandler struct {
+	log              *logrus.Logger
+	cfg              config.TwilioConfig
+	externalURL      string
+	store            store.Store
+	syncReplyTimeout time.Duration
+	sender           *twilioSender
+	pipeline         *MessagePipeline
+}
+
+// NewTwilioSMSHandler creates a new Twilio SMS webhook handler
+func NewTwilioSMSHandler(cfg config.TwilioConfig, chatCfg config.ChatConfig, serverCfg config.ServerConfig, difyCfg config.DifyConfig, clients *HTTPClients, difyHandler *DifyHandler, messages *Messages, kv store.Store, dispatcher *events.Dispatcher, log *logrus.Logger) *TwilioSMSHandler {
+	sender := &twilioSender{log: log, client: NewTwilioClient(cfg, clients), store: kv, waiting: make(map[string]chan string)}
+	// An answer is one SMS, so it is never sent in parts, and an ack
+	// would take the place of the answer in the webhook's TwiML
+	chatCfg.ReplyMode = config.ReplyModeFinal
+	chatCfg.Segments = config.SegmentsConcatenate
+	chatCfg.AckDelay = 0
+	return &TwilioSMSHandler{
+		log:              log,
+		cfg:              cfg,
+		externalURL:      serverCfg.ExternalURL,
+		store:            kv,
+		syncReplyTimeout: cfg.SyncReplyTimeout,
+		sender:           sender,
+		pipeline: NewMessagePipeline(PipelineOptions{
+			Channel:          "sms",
+			MaxMessageLength: twilioMaxBodyLength,
+			ConversationTTL:  cfg.ConversationTTL,
+			// Replies are cut to DIFYGATE_SMS_MAX_SEGMENTS, well under
+			// twilioMaxBodyLength, so they are never split
+			Format: func(msg ChannelMessage, text string) string {
+				notice := "\n" + messages.Get(messages.Locale(msg.Text), config.MsgAnswerTruncated)
+				return fitSMSSegments(smsPlainText(text), notice, cfg.MaxSegments)
+			},
+			ConversationKey: func(msg ChannelMessage) string { return "sms:conversation:" + msg.UserID },
+		}, sender, chatCfg, messages, difyCfg, difyHandler, kv, dispatcher),
+	}
+}
+
+// Hooks returns the message hooks of the SMS pipeline, for adding custom
+// ones
+func (h *TwilioSMSHandler) Hooks() *MessageHooks {
+	return h.pipeline.hooks
+}
+
+// twilioSender replies in the webhook response while Twilio still waits
+// for it, and through the REST API after
+type twilioSender struct {
+	log    *logrus.Logger
+	client *TwilioClient
+	store  store.Store
+
+	mu sync.Mutex
+	// waiting holds, by MessageSid, the webhooks still waiting for a reply
+	waiting map[string]chan string
+}
+
+// SendText hands text to the waiting webhook, or sends it as an SMS
+// unless the number opted out meanwhile
+func (s *twilioSender) SendText(ctx context.Context, msg ChannelMessage, text string) (string, error) {
+	if wait, ok := s.release(msg.ReplyTo); ok {
+		wait <- text
+		return "", nil
+	}
+	if smsOptedOut(loggerFromContext(ctx, s.log), s.store, msg.UserID) {
+		return "", nil
+	}
+	return "", s.client.SendSMS(ctx, msg.ChannelID, msg.UserID, text)
+}
+
+// SendTyping does nothing; SMS has no typing indicator
+func (s *twilioSender) SendTyping(ctx context.Context, msg ChannelMessage) error {
+	return nil
+}
+
+// SendMedia drops Dify's files, as before; MMS isn't supported
+func (s *twilioSender) SendMedia(ctx context.Context, msg ChannelMessage, media ChannelAttachment) error {
+	return nil
+}
+
+// await makes the next reply to messageSID go to the returned channel
+func (s *twilioSender) await(messageSID string) chan string {
+	wait := make(chan string, 1)
+	s.mu.Lock()
+	s.waiting[messageSID] = wait
+	s.mu.Unlock()
+	return wait
+}
+
+// release stops waiting for a reply to messageSID; ok is false if a reply
+// has already been handed over
+func (s *twilioSender) release(messageSID string) (wait chan string, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	wait, ok = s.waiting[messageSID]
+	delete(s.waiting, messageSID)
+	return wait, ok
+}
+
+// HandleTwilioSMS handles Twilio's incoming message webhook
+func (h *TwilioSMSHandler) HandleTwilioSMS(c *gin.Context) {
+	reqLog := requestLogger(c, h.log)
+
+	if !h.cfg.Enabled() {
+		apierror.Respond(c, http.StatusServiceUnavailable, apierror.NotConfigured, "Twilio integration is not configured")
+		return
+	}
+
+	if err := c.Request.ParseForm(); err != nil {
+		if isBodyTooLarge(err) {
+			reqLog.WithField("limit", c.GetInt64(bodyLimitKey)).Warn("Twilio webhook body exceeds size limit")
+			abortBodyTooLarge(c)
+			return
+		}
+		apierror.Respond(c, http.StatusBadRequest, apierror.InvalidBody, "Failed to parse request body")
+		return
+	}
+
+	// Twilio signs the URL it was configured with, so behind a proxy
+	// DIFYGATE_EXTERNAL_URL must match it
+	requestURL := baseURL(c, h.externalURL) + c.Request.URL.RequestURI()
+	if !VerifyTwilioSignature(requestURL, c.Request.PostForm, c.GetHeader("X-Twilio-Signature"), h.cfg.AuthToken) {
+		reqLog.WithField("url", requestURL).Warn("Twilio signature verification failed")
+		signatureFailures.failed("sms")
+		apierror.Respond(c, http.StatusForbidden, apierror.InvalidSignature, "Invalid signature")
+		return
+	}
+	signatureFailures.verified("sms")
+
+	from := c.PostForm("From")
+	to := c.PostForm("To")
+	body := strings.TrimSpace(c.PostForm("Body"))
+	reqLog = reqLog.WithFields(logrus.Fields{"sms_from": from, "message_sid": c.PostForm("MessageSid")})
+
+	// Twilio confirms opt-out and opt-in itself; we only track them so
+	// replies are never sent to a number that has opted out
+	keyword := strings.ToUpper(body)
+	switch {
+	case smsStopKeywords[keyword]:
+		if err := h.store.Set(smsOptOutKey(from), []byte(time.Now().UTC().Format(time.RFC3339)), 0); err != nil {
+			reqLog.WithError(err).Error("Failed to record SMS opt-out")
+		}
+		reqLog.Info("SMS number opted out")
+		twimlResponse(c, "")
+		return
+	case smsStartKeywords[keyword]:
+		if err := h.store.Delete(smsOptOutKey(from)); err != nil {
+			reqLog.WithError(err).Error("Failed to clear SMS opt-out")
+		}
+		reqLog.Info("SMS number opted back in")
+		twimlResponse(c, "")
+		return
+	}
+
+	if smsOptedOut(reqLog, h.store, from) {
+		reqLog.Info("Ignoring SMS from opted-out number")
+		twimlResponse(c, "")
+		return
+	}
+	if body == "" {
+		twimlResponse(c, "")
+		return
+	}
+
+	// Answer inline when Dify is quick; otherwise release the webhook before
+	// Twilio gives up and send the answer through the REST API
+	msg := ChannelMessage{ChannelID: to, UserID: from, Text: body, ReplyTo: c.PostForm("MessageSid")}
+	wait := h.sender.await(msg.ReplyTo)
+	done := make(chan struct{})
+	answer := h.pipeline.Enqueue(reqLog, msg)
+	go func() {
+		answer()
+		close(done)
+	}()
+
+	select {
+	case reply := <-wait:
+		twimlResponse(c, reply)
+		return
+	case <-done:
+	case <-time.After(h.syncReplyTimeout):
+		reqLog.Debug("Dify answer exceeds the sync reply timeout, replying asynchronously")
+	}
+	if _, ok := h.sender.release(msg.ReplyTo); ok {
+		twimlResponse(c, "")
+		return
+	}
+	// The reply was handed over just now
+	twimlResponse(c, <-wait)
+}
+
+// smsOptedOut reports whether number has opted out; store errors fail closed
+func smsOptedOut(log *logrus.Entry, kv store.Store, number string) bool {
+	_, err := kv.Get(smsOptOutKey(number))
+	if err == nil {
+		return true
+	}
+	if !errors.Is(err, store.ErrNotFound) {
+		log.WithError(err).Error("Failed to check SMS opt-out, suppressing reply")
+		return true
+	}
+	return false
+}
+
+// smsOptOutKey is the store key marking an opted-out number
+func smsOptOutKey(number string) string {
+	return "sms:optout:" + number
+}
+
+// twimlResponse answers the webhook with TwiML, with a <Message> unless
+// text is empty
+func twimlResponse(c *gin.Context, text string) {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	buf.WriteString("<Response>")
+	if text != "" {
+		buf.WriteString("<Message>")
+		_ = xml.EscapeText(&buf, []byte(text))
+		buf.WriteString("</Message>")
+	}
+	buf.WriteString("</Response>")
+	c.Data(http.StatusOK, "text/xml; charset=utf-8", buf.Bytes())
+}
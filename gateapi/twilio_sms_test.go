@@ -0,0 +1,146 @@
+package gateapi
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tracoco/DifyGate/config"
+	"github.com/tracoco/DifyGate/store"
+)
+
+const testSMSURL = "https://gate.example.com/api/v1/sms/twilio"
+
+// newTestSMSHandler creates an SMS handler answering through a fake Dify
+// that waits delay before answering, and a fake Twilio REST API recording
+// the bodies sent
+func newTestSMSHandler(t *testing.T, syncTimeout, delay time.Duration) (*gin.Engine, func() []string) {
+	t.Helper()
+	_, difyHandler := newFakeDify(t, func(req ChatMessageRequest) []StreamingChatResponse {
+		time.Sleep(delay)
+		return difyAnswer("conv-1", "**Opening** hours are 9 to 5.")
+	})
+
+	var mu sync.Mutex
+	var sent []string
+	twilio := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		mu.Lock()
+		sent = append(sent, r.PostForm.Get("Body"))
+		mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+	}))
+	t.Cleanup(twilio.Close)
+
+	cfg := config.TwilioConfig{AccountSID: "AC1", AuthToken: "token", APIBaseURL: twilio.URL, SyncReplyTimeout: syncTimeout, MaxSegments: 4}
+	h := NewTwilioSMSHandler(cfg, config.ChatConfig{}, config.ServerConfig{ExternalURL: "https://gate.example.com"},
+		config.DifyConfig{StreamTimeout: 5 * time.Second}, nil, difyHandler, NewMessages(config.MessagesConfig{}), store.New("", quietLogger()), nil, quietLogger())
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/api/v1/sms/twilio", h.HandleTwilioSMS)
+	return r, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), sent...)
+	}
+}
+
+// postSMS sends a signed Twilio webhook with body as the message
+func postSMS(r *gin.Engine, body string) *httptest.ResponseRecorder {
+	form := url.Values{"From": {"+15550001"}, "To": {"+15550002"}, "Body": {body}, "MessageSid": {"SM1"}}
+	keys := make([]string, 0, len(form))
+	for k := range form {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	mac := hmac.New(sha1.New, []byte("token"))
+	mac.Write([]byte(testSMSURL))
+	for _, k := range keys {
+		mac.Write([]byte(k + form.Get(k)))
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/sms/twilio", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Twilio-Signature", base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestTwilioSMSRepliesInline(t *testing.T) {
+	r, sent := newTestSMSHandler(t, 2*time.Second, 0)
+
+	w := postSMS(r, "When are you open?")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "<Message>Opening hours are 9 to 5.</Message>") {
+		t.Errorf("status %d, body %s, want the answer as plain text in TwiML", w.Code, w.Body.String())
+	}
+	if got := sent(); len(got) != 0 {
+		t.Errorf("also sent %q through the REST API", got)
+	}
+}
+
+func TestTwilioSMSRepliesLate(t *testing.T) {
+	r, sent := newTestSMSHandler(t, 50*time.Millisecond, 300*time.Millisecond)
+
+	w := postSMS(r, "When are you open?")
+	if strings.Contains(w.Body.String(), "<Message>") {
+		t.Errorf("body %s, want empty TwiML once the sync timeout passed", w.Body.String())
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(sent()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := sent(); len(got) != 1 || got[0] != "Opening hours are 9 to 5." {
+		t.Errorf("sent %q through the REST API, want the answer once", got)
+	}
+}
+
+func TestTwilioSendSMS(t *testing.T) {
+	var mu sync.Mutex
+	var path, user, pass string
+	var form url.Values
+	status := http.StatusCreated
+	twilio := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		mu.Lock()
+		defer mu.Unlock()
+		path, form = r.URL.Path, r.PostForm
+		user, pass, _ = r.BasicAuth()
+		w.WriteHeader(status)
+		if status != http.StatusCreated {
+			w.Write([]byte(`{"code":21211,"message":"The 'To' number is not a valid phone number."}` + "\n"))
+		}
+	}))
+	t.Cleanup(twilio.Close)
+	client := NewTwilioClient(config.TwilioConfig{AccountSID: "AC1", AuthToken: "token", APIBaseURL: twilio.URL + "/"}, testHTTPClients())
+
+	if err := client.SendSMS(context.Background(), "+15550002", "+15550001", "Hi there"); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	if path != "/2010-04-01/Accounts/AC1/Messages.json" || user != "AC1" || pass != "token" {
+		t.Errorf("sent to %s as %s:%s", path, user, pass)
+	}
+	if form.Get("From") != "+15550002" || form.Get("To") != "+15550001" || form.Get("Body") != "Hi there" {
+		t.Errorf("sent form %v", form)
+	}
+	status = http.StatusBadRequest
+	mu.Unlock()
+
+	want := `Twilio API returned status 400: {"code":21211,"message":"The 'To' number is not a valid phone number."}`
+	if err := client.SendSMS(context.Background(), "+15550002", "nope", "Hi"); err == nil || err.Error() != want {
+		t.Errorf("error %v, want %q", err, want)
+	}
+}
@@ -0,0 +1,267 @@
+package gateapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/apierror"
+	"github.com/tracoco/DifyGate/history"
+	"github.com/tracoco/DifyGate/phone"
+	"github.com/tracoco/DifyGate/store"
+)
+
+// UserDataHandler erases what the gateway knows about a user on request,
+// e.g. for a GDPR erasure request
+type UserDataHandler struct {
+	store       store.Store
+	history     *history.Recorder
+	difyHandler *DifyHandler
+	// schedule holds the messages scheduled for the user
+	schedule *scheduler
+	log      *logrus.Logger
+}
+
+// NewUserDataHandler creates a new user data handler
+func NewUserDataHandler(kv store.Store, recorder *history.Recorder, difyHandler *DifyHandler, schedule *scheduler, log *logrus.Logger) *UserDataHandler {
+	return &UserDataHandler{
+		store:       kv,
+		history:     recorder,
+		difyHandler: difyHandler,
+		schedule:    schedule,
+		log:         log,
+	}
+}
+
+// DeletedUserData lists what a deletion removed from each store
+type DeletedUserData struct {
+	// Store is the shared store keys removed
+	Store []string `json:"store"`
+	// History is the number of message history records removed
+	History int `json:"history"`
+	// Dify is the Dify conversations deleted, with ?dify=true
+	Dify []string `json:"dify"`
+}
+
+// DeleteUser erases the conversation mappings, reply limits, mutes,
+// delivery statuses, scheduled messages and message history of a WhatsApp
+// number, and with ?dify=true its Dify conversations
+// too. It answers 204 when there was nothing to delete, so it can be
+// retried safely.
+func (h *UserDataHandler) DeleteUser(c *gin.Context) {
+	log := requestLogger(c, h.log)
+	number, ok := userNumber(c)
+	if !ok {
+		return
+	}
+	deleteDify := c.Query("dify") == "true"
+	difyUser := h.difyUser(number)
+
+	deleted := DeletedUserData{Store: []string{}, Dify: []string{}}
+	var errs []error
+	for _, pattern := range h.userKeys(number) {
+		keys, err := h.store.Keys(pattern)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, key := range keys {
+			if deleteDify && strings.HasPrefix(key, "whatsapp:conversation:") {
+				conversationID, err := h.store.Get(key)
+				if err != nil && !errors.Is(err, store.ErrNotFound) {
+					errs = append(errs, err)
+					continue
+				}
+				if len(conversationID) > 0 {
+					ctx, cancel := context.WithTimeout(c.Request.Context(), 10*time.Second)
+					err = h.difyHandler.DeleteConversation(ctx, string(conversationID), difyUser)
+					cancel()
+					if err != nil {
+						// Keep the mapping so a retry can still find the conversation
+						errs = append(errs, err)
+						continue
+					}
+					deleted.Dify = append(deleted.Dify, string(conversationID))
+				}
+			}
+			if wamid, ok := strings.CutPrefix(key, deliveryRecipientKey(number, "")); ok {
+				// The status itself is keyed by the message alone
+				if err := h.store.Delete(deliveryStoreKey(wamid)); err != nil {
+					errs = append(errs, err)
+					continue
+				}
+				deleted.Store = append(deleted.Store, deliveryStoreKey(wamid))
+			}
+			if err := h.store.Delete(key); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			deleted.Store = append(deleted.Store, key)
+		}
+	}
+
+	// Scheduled messages are keyed by ID, and pending ones are cancelled
+	scheduled, err := h.schedule.erase(log, number)
+	deleted.Store = append(deleted.Store, scheduled...)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	n, err := h.history.DeleteUser(number)
+	deleted.History = n
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	log = log.WithFields(logrus.Fields{
+		"store_keys":         len(deleted.Store),
+		"history_records":    deleted.History,
+		"dify_conversations": len(deleted.Dify),
+	})
+	if err := errors.Join(errs...); err != nil {
+		log.WithError(err).Error("User data deletion incomplete")
+		apierror.RespondWithDetails(c, http.StatusInternalServerError, apierror.Internal, "Failed to delete all user data; retry the request",
+			map[string]interface{}{"deleted": deleted})
+		return
+	}
+	log.Info("User data deleted")
+
+	if len(deleted.Store) == 0 && deleted.History == 0 && len(deleted.Dify) == 0 {
+		c.Status(http.StatusNoContent)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"deleted": deleted})
+}
+
+// difyUser is the Dify user of a WhatsApp number
+func (h *UserDataHandler) difyUser(number string) string {
+	return h.difyHandler.users.name("whatsapp", number, number)
+}
+
+// userKeys are whatsAppUserKeys and, with a Dify user ID salt, the key
+// mapping the user's hashed Dify user ID back to them, which is left
+// behind when the mode changes from hashed
+func (h *UserDataHandler) userKeys(number string) []string {
+	keys := whatsAppUserKeys(number)
+	if users := h.difyHandler.users; len(users.salt) > 0 {
+		keys = append(keys, difyUserKey(users.hashedName("whatsapp", number)))
+	}
+	return keys
+}
+
+// userNumber returns the :number path parameter in canonical form,
+// answering 400 when it isn't a phone number
+func userNumber(c *gin.Context) (string, bool) {
+	return apiNumber(c, "number", c.Param("number"))
+}
+
+// apiNumber returns a user's phone number given to an API as field in
+// canonical form, answering 400 with the reason when it isn't one. Being
+// only digits, it also keeps glob characters out of store key patterns.
+func apiNumber(c *gin.Context, field, number string) (string, bool) {
+	n, err := phone.Normalize(number)
+	if err != nil {
+		apierror.Respond(c, http.StatusBadRequest, apierror.InvalidRequest, fmt.Sprintf("%s must be a phone number in international format: %v", field, err))
+		return "", false
+	}
+	return n, true
+}
+
+// ResolveDifyUser tells which user a Dify user ID stands for, e.g. one
+// seen in Dify's logs with hashed user IDs. It answers 404 for a hashed
+// ID no user has written with.
+func (h *UserDataHandler) ResolveDifyUser(c *gin.Context) {
+	name := c.Param("user")
+	channel, userID, err := h.difyHandler.users.resolve(h.store, name)
+	if errors.Is(err, store.ErrNotFound) {
+		apierror.Respond(c, http.StatusNotFound, apierror.NotFound, "No user is known by this Dify user ID")
+		return
+	}
+	if err != nil {
+		requestLogger(c, h.log).WithError(err).Error("Failed to look up the Dify user")
+		apierror.Respond(c, http.StatusInternalServerError, apierror.Internal, "Failed to look up the Dify user")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"dify_user": name, "channel": channel, "user_id": userID})
+}
+
+// UserStateEntry is a shared store key kept about a user, with its value
+type UserStateEntry struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// GetUser lists what the shared store keeps about a WhatsApp number on
+// every business number, such as its conversation mappings, handoffs and
+// mutes, sorted by key
+func (h *UserDataHandler) GetUser(c *gin.Context) {
+	number, ok := userNumber(c)
+	if !ok {
+		return
+	}
+	state := []UserStateEntry{}
+	for _, pattern := range h.userKeys(number) {
+		keys, err := h.store.Keys(pattern)
+		if err != nil {
+			requestLogger(c, h.log).WithError(err).Error("Failed to look up the user's data")
+			apierror.Respond(c, http.StatusInternalServerError, apierror.Internal, "Failed to look up the user's data")
+			return
+		}
+		for _, key := range keys {
+			value, err := h.store.Get(key)
+			if errors.Is(err, store.ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				requestLogger(c, h.log).WithError(err).Error("Failed to look up the user's data")
+				apierror.Respond(c, http.StatusInternalServerError, apierror.Internal, "Failed to look up the user's data")
+				return
+			}
+			state = append(state, UserStateEntry{Key: key, Value: string(value)})
+		}
+	}
+	sort.Slice(state, func(i, j int) bool { return state[i].Key < state[j].Key })
+	c.JSON(http.StatusOK, gin.H{"number": number, "dify_user": h.difyUser(number), "state": state})
+}
+
+// ResetConversation makes the next message of a WhatsApp number start a
+// new Dify conversation on every business number, as the user's /reset
+// does. The old conversations stay in Dify. It answers 204 when the user
+// had none.
+func (h *UserDataHandler) ResetConversation(c *gin.Context) {
+	log := requestLogger(c, h.log)
+	number, ok := userNumber(c)
+	if !ok {
+		return
+	}
+	keys, err := h.store.Keys("whatsapp:conversation:*:" + number)
+	if err != nil {
+		log.WithError(err).Error("Failed to look up the user's conversations")
+		apierror.Respond(c, http.StatusInternalServerError, apierror.Internal, "Failed to look up the user's conversations")
+		return
+	}
+	reset := []string{}
+	for _, key := range keys {
+		if err := h.store.Delete(key); err != nil {
+			log.WithError(err).Error("Failed to reset the user's conversation")
+			apierror.Respond(c, http.StatusInternalServerError, apierror.Internal, "Failed to reset the user's conversation")
+			return
+		}
+		reset = append(reset, key)
+	}
+	if len(reset) == 0 {
+		c.Status(http.StatusNoContent)
+		return
+	}
+	log.WithFields(logrus.Fields{
+		"conversations": len(reset),
+		"key_name":      c.GetString(authKeyNameKey),
+	}).Info("Conversation reset by an operator")
+	c.JSON(http.StatusOK, gin.H{"reset": reset})
+}
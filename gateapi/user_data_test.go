@@ -0,0 +1,160 @@
+package gateapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tracoco/DifyGate/config"
+	"github.com/tracoco/DifyGate/history"
+	"github.com/tracoco/DifyGate/store"
+)
+
+func TestDeleteUserData(t *testing.T) {
+	var mu sync.Mutex
+	var difyDeletes []string
+	dify := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			User string `json:"user"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		mu.Lock()
+		difyDeletes = append(difyDeletes, r.Method+" "+r.URL.Path+" "+body.User)
+		mu.Unlock()
+		w.Write([]byte(`{"result":"success"}`))
+	}))
+	defer dify.Close()
+	difyHandler := NewDifyHandler(config.DifyConfig{BaseURL: dify.URL}, &HTTPClients{Dify: dify.Client()}, quietLogger())
+
+	kv := store.New("", quietLogger())
+	defer kv.Close()
+	kv.Set("whatsapp:conversation:555:15551234567", []byte("conv-1"), 0)
+	kv.Set("whatsapp:unsupported:555:15551234567:sticker", []byte("1"), time.Hour)
+	kv.Set("whatsapp:conversation:555:15559999999", []byte("conv-other"), 0)
+
+	recorder, err := history.New(config.HistoryConfig{Enabled: true, Retention: time.Hour, PruneInterval: time.Hour}, quietLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder.Record(history.Record{ID: "wamid.1", UserID: "15551234567", Text: "hi"})
+	recorder.Record(history.Record{ID: "wamid.2", UserID: "15559999999", Text: "hi"})
+	recorder.Close()
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.DELETE("/users/:number", NewUserDataHandler(kv, recorder, difyHandler, nil, quietLogger()).DeleteUser)
+	del := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, path, nil))
+		return w
+	}
+
+	w := del("/users/+15551234567?dify=true")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var resp struct {
+		Deleted DeletedUserData `json:"deleted"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if len(resp.Deleted.Store) != 2 || resp.Deleted.History != 1 || len(resp.Deleted.Dify) != 1 || resp.Deleted.Dify[0] != "conv-1" {
+		t.Errorf("deleted = %+v", resp.Deleted)
+	}
+	if len(difyDeletes) != 1 || difyDeletes[0] != "DELETE /conversations/conv-1 15551234567" {
+		t.Errorf("Dify calls = %q", difyDeletes)
+	}
+	if _, err := kv.Get("whatsapp:conversation:555:15559999999"); err != nil {
+		t.Errorf("another user's conversation was deleted: %v", err)
+	}
+	if _, err := recorder.Get("wamid.2"); err != nil {
+		t.Errorf("another user's history was deleted: %v", err)
+	}
+
+	// Nothing is left, and deleting again still succeeds
+	if w := del("/users/15551234567?dify=true"); w.Code != http.StatusNoContent {
+		t.Errorf("repeat deletion status %d, want 204", w.Code)
+	}
+	if w := del("/users/1555*"); w.Code != http.StatusBadRequest {
+		t.Errorf("pattern as number status %d, want 400", w.Code)
+	}
+}
+
+func TestDeleteUserDataErasesDeliveryStatuses(t *testing.T) {
+	kv := store.New("", quietLogger())
+	defer kv.Close()
+	deliveries := newDeliveryTracker(kv, 7*24*time.Hour, quietLogger())
+	deliveries.sent("555", "15551234567", "wamid.sent")
+	// A status webhook names the recipient of a message sent elsewhere
+	deliveries.report("555", "15551234567", "wamid.reported", "delivered", "", nil)
+	deliveries.sent("555", "15559999999", "wamid.other")
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	difyHandler := NewDifyHandler(config.DifyConfig{}, &HTTPClients{}, quietLogger())
+	r.DELETE("/users/:number", NewUserDataHandler(kv, nil, difyHandler, nil, quietLogger()).DeleteUser)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/users/15551234567", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+
+	for _, wamid := range []string{"wamid.sent", "wamid.reported"} {
+		if _, err := deliveries.get(wamid); err != store.ErrNotFound {
+			t.Errorf("status of %s kept: %v", wamid, err)
+		}
+	}
+	if keys, _ := kv.Keys("whatsapp:status-recipient:15551234567:*"); len(keys) != 0 {
+		t.Errorf("index kept: %q", keys)
+	}
+	if d, err := deliveries.get("wamid.other"); err != nil || d.Recipient != "15559999999" {
+		t.Errorf("another user's status = %+v, %v", d, err)
+	}
+}
+
+func TestDeleteUserDataCancelsScheduledMessages(t *testing.T) {
+	h, graph := newTestWhatsAppHandler(t)
+	h.schedule = newScheduler(config.ScheduleConfig{Interval: time.Hour, MaxAhead: 72 * time.Hour, MaxAttempts: 3, Retention: time.Hour}, h)
+	schedule := func(id, to, status string, sendAt time.Time) {
+		if err := h.schedule.save(&ScheduledMessage{ID: id, Status: status, PhoneNumberID: "123", To: to, Text: "Your table is ready", SendAt: sendAt}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	schedule("pending", "15551234567", schedulePending, time.Now().Add(time.Hour))
+	// Sent messages keep the text for the retention period
+	schedule("sent", "15551234567", scheduleSent, time.Now().Add(-time.Minute))
+	schedule("other", "15559999999", schedulePending, time.Now().Add(time.Hour))
+	before := scheduledMessages.Value(scheduleCancelled)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.DELETE("/users/:number", NewUserDataHandler(h.store, nil, NewDifyHandler(config.DifyConfig{}, &HTTPClients{}, quietLogger()), h.schedule, quietLogger()).DeleteUser)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/users/15551234567", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+
+	for _, id := range []string{"pending", "sent"} {
+		if _, err := h.schedule.load(id); err != store.ErrNotFound {
+			t.Errorf("scheduled message %s kept: %v", id, err)
+		}
+	}
+	if _, err := h.schedule.load("other"); err != nil {
+		t.Errorf("another user's scheduled message was deleted: %v", err)
+	}
+	if n := scheduledMessages.Value(scheduleCancelled) - before; n != 1 {
+		t.Errorf("cancelled counter grew by %v, want 1", n)
+	}
+
+	// Nothing is sent once it is due
+	h.schedule.send(testEntry(), "pending")
+	graph.mu.Lock()
+	defer graph.mu.Unlock()
+	if len(graph.payloads) != 0 {
+		t.Errorf("sent %d messages to the deleted user", len(graph.payloads))
+	}
+}
@@ -0,0 +1,79 @@
+package gateapi
+
+import "sync"
+
+// userQueues lets one message per chat through the pipeline at a time, so
+// a user's second question can't reach Dify before the first has stored
+// its conversation, and their answers don't interleave. Other chats are
+// not held up. Each chat is an explicit FIFO: a message takes its place
+// when it arrives, before anything slow is done for it, and is let
+// through strictly in that order.
+type userQueues struct {
+	// max caps the messages waiting behind the one being answered
+	max int
+
+	mu    sync.Mutex
+	chats map[string][]*queueTicket
+}
+
+// queueTicket is a message's place in its chat's queue
+type queueTicket struct {
+	queues *userQueues
+	key    string
+	// turn is closed once the message is first in line
+	turn chan struct{}
+	once sync.Once
+}
+
+func newUserQueues(max int) *userQueues {
+	return &userQueues{max: max, chats: make(map[string][]*queueTicket)}
+}
+
+// reserve puts a message at the end of the queue of the chat keyed by key,
+// without waiting. It returns nil when max messages are already waiting.
+func (q *userQueues) reserve(key string) *queueTicket {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	line := q.chats[key]
+	if len(line) > q.max {
+		return nil
+	}
+	ticket := &queueTicket{queues: q, key: key, turn: make(chan struct{})}
+	if len(line) == 0 {
+		close(ticket.turn)
+	}
+	q.chats[key] = append(line, ticket)
+	return ticket
+}
+
+// wait blocks until every message ahead of t has released its place
+func (t *queueTicket) wait() {
+	<-t.turn
+}
+
+// release gives up t's place, letting the next message through when t was
+// first in line. It may be called before t's turn, e.g. for a message
+// that is dropped, and more than once.
+func (t *queueTicket) release() {
+	t.once.Do(func() {
+		q := t.queues
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		line := q.chats[t.key]
+		for i, queued := range line {
+			if queued != t {
+				continue
+			}
+			line = append(line[:i:i], line[i+1:]...)
+			if i == 0 && len(line) > 0 {
+				close(line[0].turn)
+			}
+			break
+		}
+		if len(line) == 0 {
+			delete(q.chats, t.key)
+			return
+		}
+		q.chats[t.key] = line
+	})
+}
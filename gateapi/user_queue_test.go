@@ -0,0 +1,126 @@
+package gateapi
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tracoco/DifyGate/config"
+)
+
+func TestUserQueuesSerializeChats(t *testing.T) {
+	q := newUserQueues(1)
+	first := q.reserve("u1")
+	if first == nil {
+		t.Fatal("first message was turned away")
+	}
+	first.wait()
+	// Other chats don't wait
+	other := q.reserve("u2")
+	if other == nil {
+		t.Fatal("another chat's message was turned away")
+	}
+	other.wait()
+	other.release()
+
+	second := q.reserve("u1")
+	if second == nil {
+		t.Fatal("the queued message was turned away")
+	}
+	if q.reserve("u1") != nil {
+		t.Fatal("a message over the queue limit was let in")
+	}
+
+	var mu sync.Mutex
+	var order []string
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		second.wait()
+		mu.Lock()
+		order = append(order, "second")
+		mu.Unlock()
+		second.release()
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	mu.Lock()
+	order = append(order, "first")
+	mu.Unlock()
+	first.release()
+	<-done
+	if len(order) != 2 || order[0] != "first" {
+		t.Errorf("answered in order %q, want first then second", order)
+	}
+	if len(q.chats) != 0 {
+		t.Errorf("%d chats left after every message was answered", len(q.chats))
+	}
+}
+
+func TestUserQueuesKeepArrivalOrder(t *testing.T) {
+	q := newUserQueues(10)
+	tickets := make([]*queueTicket, 5)
+	for i := range tickets {
+		tickets[i] = q.reserve("u1")
+	}
+	// A message given up before its turn doesn't hold up the rest
+	tickets[2].release()
+
+	var mu sync.Mutex
+	var order []int
+	var wg sync.WaitGroup
+	// Started in reverse, so only the queue can put them in order
+	for i := len(tickets) - 1; i >= 0; i-- {
+		if i == 2 {
+			continue
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tickets[i].wait()
+			mu.Lock()
+			order = append(order, i)
+			mu.Unlock()
+			tickets[i].release()
+		}(i)
+	}
+	wg.Wait()
+	if want := []int{0, 1, 3, 4}; len(order) != len(want) || order[0] != 0 || order[1] != 1 || order[2] != 3 || order[3] != 4 {
+		t.Errorf("let through %v, want %v", order, want)
+	}
+	tickets[0].release()
+	if len(q.chats) != 0 {
+		t.Errorf("%d chats left after every message was answered", len(q.chats))
+	}
+}
+
+func TestPipelineAnswersBackToBackMessagesInOrder(t *testing.T) {
+	p, sender, dify, _ := newTestPipeline(t, PipelineOptions{Channel: "test"}, config.ChatConfig{MaxQueuedMessages: 5},
+		func(req ChatMessageRequest) []StreamingChatResponse {
+			return difyAnswer("conv-1", "re: "+req.Query)
+		})
+	// A slow acknowledgment of the first message must not let the second
+	// overtake it
+	p.opts.Acknowledge = func(ctx context.Context, msg ChannelMessage, done bool) {
+		if msg.Text == "first" && !done {
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	p.Accept(testEntry(), ChannelMessage{ChannelID: "bot", UserID: "u1", Text: "first"})
+	p.Accept(testEntry(), ChannelMessage{ChannelID: "bot", UserID: "u1", Text: "second"})
+
+	var got []string
+	for deadline := time.Now().Add(5 * time.Second); len(got) < 2 && time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond)
+		got = append(got, sender.sent()...)
+	}
+	if len(got) != 2 || got[0] != "re: first" || got[1] != "re: second" {
+		t.Fatalf("sent %q, want the answers in order", got)
+	}
+	dify.mu.Lock()
+	defer dify.mu.Unlock()
+	if dify.requests[0].Query != "first" || dify.requests[1].ConversationID != "conv-1" {
+		t.Errorf("requests %+v, want the second continuing the first's conversation", dify.requests)
+	}
+}
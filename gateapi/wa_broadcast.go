@@ -0,0 +1,529 @@
+package gateapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/apierror"
+	"github.com/tracoco/DifyGate/config"
+	"github.com/tracoco/DifyGate/history"
+	"github.com/tracoco/DifyGate/metrics"
+	"github.com/tracoco/DifyGate/phone"
+	"github.com/tracoco/DifyGate/store"
+)
+
+// broadcastMessages counts broadcast recipients by outcome: sent, failed
+// or skipped
+var broadcastMessages = metrics.NewCounter("difygate_broadcast_messages_total",
+	"WhatsApp broadcast recipients, by outcome", "outcome")
+
+const (
+	// broadcastSaveInterval is how often a running broadcast saves its
+	// progress, which is also its heartbeat
+	broadcastSaveInterval = 2 * time.Second
+	// broadcastStaleAfter is how long a running broadcast may go without a
+	// heartbeat before it is taken for abandoned
+	broadcastStaleAfter = time.Minute
+	// broadcastRecoverInterval is how often abandoned broadcasts are
+	// looked for
+	broadcastRecoverInterval = 30 * time.Second
+	// broadcastSendTimeout bounds each message
+	broadcastSendTimeout = 15 * time.Second
+	// broadcastMaxAttempts is how often a recipient is tried while WhatsApp
+	// throttles the business number
+	broadcastMaxAttempts = 3
+)
+
+// Broadcast statuses
+const (
+	broadcastRunning = "running"
+	broadcastDone    = "done"
+	// broadcastInterrupted is reported for a broadcast whose gateway
+	// stopped without DIFYGATE_DURABLE_INBOX to resume it
+	broadcastInterrupted = "interrupted"
+)
+
+// Recipient statuses
+const (
+	recipientPending = "pending"
+	recipientSent    = "sent"
+	recipientFailed  = "failed"
+	recipientSkipped = "skipped"
+)
+
+// BroadcastRequest sends one text or template message to many WhatsApp
+// users
+type BroadcastRequest struct {
+	// PhoneNumberID is the business number to send from; empty uses
+	// DIFYGATE_WHATSAPP_PHONE_NUMBER_ID
+	PhoneNumberID string `json:"phone_number_id"`
+	// Recipients are the users to message, unless AllKnownUsers is set
+	Recipients []BroadcastRecipient `json:"recipients"`
+	// AllKnownUsers messages every user with a conversation on the
+	// business number
+	AllKnownUsers bool              `json:"all_known_users"`
+	Text          string            `json:"text"`
+	Template      *WhatsAppTemplate `json:"template"`
+	// Rate is messages per second; 0 uses DIFYGATE_BROADCAST_RATE
+	Rate float64 `json:"rate"`
+}
+
+// BroadcastRecipient is a user to broadcast to
+type BroadcastRecipient struct {
+	To string `json:"to"`
+	// Components fill the template's parameters for this user, replacing
+	// the template's own
+	Components []interface{} `json:"components,omitempty"`
+}
+
+// Broadcast is the progress of a broadcast, as stored and reported
+type Broadcast struct {
+	ID            string            `json:"id"`
+	Status        string            `json:"status"`
+	PhoneNumberID string            `json:"phone_number_id"`
+	Text          string            `json:"text,omitempty"`
+	Template      *WhatsAppTemplate `json:"template,omitempty"`
+	Rate          float64           `json:"rate"`
+	CreatedAt     time.Time         `json:"created_at"`
+	FinishedAt    *time.Time        `json:"finished_at,omitempty"`
+	// HeartbeatAt is when the gateway sending it last saved its progress
+	HeartbeatAt time.Time `json:"heartbeat_at"`
+	// Counts are the recipients by status
+	Counts     map[string]int      `json:"counts"`
+	Recipients []BroadcastDelivery `json:"recipients,omitempty"`
+}
+
+// BroadcastDelivery is what became of one recipient of a broadcast
+type BroadcastDelivery struct {
+	BroadcastRecipient
+	Status string `json:"status"`
+	// Reason says why a recipient was skipped: blocklisted or opted_out
+	Reason string `json:"reason,omitempty"`
+	WAMID  string `json:"wamid,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// payload builds the message for d, and the text it is recorded as
+func (bc *Broadcast) payload(d BroadcastDelivery, previewURL bool) (map[string]interface{}, string) {
+	if bc.Template == nil {
+		return textPayload(d.To, bc.Text, "", previewURL), bc.Text
+	}
+	tmpl := *bc.Template
+	if d.Components != nil {
+		tmpl.Components = d.Components
+	}
+	return templatePayload(d.To, tmpl), "[template " + tmpl.Name + "]"
+}
+
+// count updates Counts from the recipients
+func (bc *Broadcast) count() {
+	bc.Counts = map[string]int{recipientPending: 0, recipientSent: 0, recipientFailed: 0, recipientSkipped: 0}
+	for _, d := range bc.Recipients {
+		bc.Counts[d.Status]++
+	}
+}
+
+// broadcastKey is the store key of a broadcast's progress
+func broadcastKey(id string) string {
+	return "whatsapp:broadcast:" + id
+}
+
+// optOutKey is the store key present while a user has opted out of
+// broadcasts on the channel
+func optOutKey(channel, userID string) string {
+	return channel + ":optout:" + userID
+}
+
+// broadcaster sends WhatsApp broadcasts in the background, one message at
+// a time at the broadcast's rate. With DIFYGATE_DURABLE_INBOX, a broadcast
+// left running by a stopped gateway is resumed by the next one to look.
+type broadcaster struct {
+	cfg config.BroadcastConfig
+	// durable resumes abandoned broadcasts
+	durable bool
+	// h sends the messages and keeps the state
+	h       *WhatsAppHandler
+	blocked map[string]bool
+	// rateLimitWait is the pause when WhatsApp throttles a broadcast
+	rateLimitWait time.Duration
+
+	start sync.Once
+}
+
+func newBroadcaster(cfg config.BroadcastConfig, durable bool, h *WhatsAppHandler) *broadcaster {
+	b := &broadcaster{cfg: cfg, durable: durable, h: h, blocked: make(map[string]bool), rateLimitWait: 10 * time.Second}
+	for _, number := range cfg.Blocklist {
+		b.blocked[phone.Lenient(number)] = true
+	}
+	return b
+}
+
+// load returns the broadcast id, or store.ErrNotFound
+func (b *broadcaster) load(id string) (*Broadcast, error) {
+	raw, err := b.h.store.Get(broadcastKey(id))
+	if err != nil {
+		return nil, err
+	}
+	var bc Broadcast
+	if err := json.Unmarshal(raw, &bc); err != nil {
+		return nil, err
+	}
+	return &bc, nil
+}
+
+// save stores the progress of bc, with a new heartbeat
+func (b *broadcaster) save(bc *Broadcast) error {
+	bc.HeartbeatAt = time.Now().UTC()
+	bc.count()
+	raw, err := json.Marshal(bc)
+	if err != nil {
+		return err
+	}
+	return b.h.store.Set(broadcastKey(bc.ID), raw, b.cfg.Retention)
+}
+
+// run sends bc to its pending recipients, blocking until it is done
+func (b *broadcaster) run(log *logrus.Entry, bc *Broadcast) {
+	log = log.WithFields(logrus.Fields{"broadcast_id": bc.ID, "phone_number_id": bc.PhoneNumberID})
+	log.WithField("recipients", len(bc.Recipients)).Info("Broadcast started")
+	interval := time.Duration(float64(time.Second) / bc.Rate)
+	next, saved := time.Now(), time.Now()
+	for i := range bc.Recipients {
+		d := &bc.Recipients[i]
+		if d.Status != recipientPending {
+			continue
+		}
+		// Opt-outs are checked as late as possible, as they may come in
+		// while the broadcast runs
+		if reason := b.skipReason(log, d.To); reason != "" {
+			d.Status, d.Reason = recipientSkipped, reason
+			broadcastMessages.Inc(recipientSkipped)
+		} else {
+			time.Sleep(time.Until(next))
+			next = time.Now().Add(interval)
+			b.send(log, bc, d)
+		}
+		if time.Since(saved) >= broadcastSaveInterval {
+			if err := b.save(bc); err != nil {
+				log.WithError(err).Warn("Failed to save broadcast progress")
+			}
+			saved = time.Now()
+		}
+	}
+
+	finished := time.Now().UTC()
+	bc.Status, bc.FinishedAt = broadcastDone, &finished
+	if err := b.save(bc); err != nil {
+		log.WithError(err).Error("Failed to save finished broadcast")
+	}
+	log.WithFields(logrus.Fields{
+		"sent":    bc.Counts[recipientSent],
+		"failed":  bc.Counts[recipientFailed],
+		"skipped": bc.Counts[recipientSkipped],
+	}).Info("Broadcast finished")
+}
+
+// skipReason says why a recipient must not get broadcasts, or "" when
+// they may. A failed opt-out check skips them, as a message they asked
+// not to get is the greater harm.
+func (b *broadcaster) skipReason(log *logrus.Entry, to string) string {
+	if b.blocked[to] {
+		return "blocklisted"
+	}
+	_, err := b.h.store.Get(optOutKey("whatsapp", to))
+	if errors.Is(err, store.ErrNotFound) {
+		return ""
+	}
+	if err != nil {
+		log.WithError(err).WithField("to", to).Warn("Failed to check opt-out, skipping recipient")
+	}
+	return "opted_out"
+}
+
+// send sends bc to d, waiting and trying again while WhatsApp throttles
+// the business number
+func (b *broadcaster) send(log *logrus.Entry, bc *Broadcast, d *BroadcastDelivery) {
+	log = log.WithField("to", d.To)
+	payload, recorded := bc.payload(*d, b.h.client.linkPreviews)
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(withLogger(context.Background(), log), broadcastSendTimeout)
+		wamid, err := b.h.client.send(ctx, bc.PhoneNumberID, payload)
+		cancel()
+		var apiErr *WhatsAppAPIError
+		if errors.As(err, &apiErr) && apiErr.RateLimited() && attempt < broadcastMaxAttempts {
+			log.WithError(err).Warn("WhatsApp is throttling the broadcast, waiting")
+			time.Sleep(b.rateLimitWait)
+			continue
+		}
+
+		rec := history.Record{
+			ID:        wamid,
+			Channel:   "whatsapp",
+			UserID:    d.To,
+			Direction: history.Outbound,
+			Text:      recorded,
+			Status:    history.StatusSent,
+		}
+		if err != nil {
+			rec.Status, rec.Error = history.StatusFailed, err.Error()
+			d.Status, d.Error = recipientFailed, err.Error()
+			broadcastMessages.Inc(recipientFailed)
+			log.WithError(err).Warn("Failed to send broadcast message")
+		} else {
+			d.Status, d.WAMID = recipientSent, wamid
+			broadcastMessages.Inc(recipientSent)
+		}
+		b.h.history.Record(rec)
+		return
+	}
+}
+
+// resume starts looking for abandoned broadcasts, at once and then every
+// broadcastRecoverInterval, when DIFYGATE_DURABLE_INBOX is on
+func (b *broadcaster) resume(log *logrus.Logger) {
+	if !b.durable {
+		return
+	}
+	b.start.Do(func() {
+		go func() {
+			b.recover(log)
+			ticker := time.NewTicker(broadcastRecoverInterval)
+			defer ticker.Stop()
+			for range ticker.C {
+				b.recover(log)
+			}
+		}()
+	})
+}
+
+// recover resumes the running broadcasts whose heartbeat has stopped. The
+// claim is keyed by the last heartbeat, so one instance takes over each
+// time a broadcast is abandoned.
+func (b *broadcaster) recover(log *logrus.Logger) {
+	keys, err := b.h.store.Keys(broadcastKey("*"))
+	if err != nil {
+		log.WithError(err).Warn("Failed to list broadcasts")
+		return
+	}
+	for _, key := range keys {
+		bc, err := b.load(strings.TrimPrefix(key, broadcastKey("")))
+		if errors.Is(err, store.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			log.WithError(err).WithField("key", key).Warn("Failed to read broadcast")
+			continue
+		}
+		if bc.Status != broadcastRunning || time.Since(bc.HeartbeatAt) < broadcastStaleAfter {
+			continue
+		}
+		claim := "whatsapp:broadcast-claim:" + bc.ID + ":" + strconv.FormatInt(bc.HeartbeatAt.UnixNano(), 10)
+		if n, err := b.h.store.Incr(claim, broadcastStaleAfter); err != nil || n != 1 {
+			continue
+		}
+		entry := logrus.NewEntry(log)
+		bc.count()
+		entry.WithFields(logrus.Fields{"broadcast_id": bc.ID, "pending": bc.Counts[recipientPending]}).Warn("Resuming broadcast left unfinished")
+		go b.run(entry, bc)
+	}
+}
+
+// knownUsers lists the users with a conversation on the business number
+func (b *broadcaster) knownUsers(phoneNumberID string) ([]BroadcastRecipient, error) {
+	prefix := "whatsapp:conversation:" + phoneNumberID + ":"
+	keys, err := b.h.store.Keys(prefix + "*")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+	recipients := make([]BroadcastRecipient, 0, len(keys))
+	for _, key := range keys {
+		recipients = append(recipients, BroadcastRecipient{To: strings.TrimPrefix(key, prefix)})
+	}
+	return recipients, nil
+}
+
+// broadcastDeliveries checks the recipients and drops repeated numbers, so
+// nobody gets a broadcast twice
+func broadcastDeliveries(recipients []BroadcastRecipient, template bool) ([]BroadcastDelivery, error) {
+	seen := make(map[string]bool)
+	deliveries := make([]BroadcastDelivery, 0, len(recipients))
+	for _, r := range recipients {
+		to, err := phone.Normalize(r.To)
+		if err != nil {
+			return nil, fmt.Errorf("recipient must be a phone number in international format: %w", err)
+		}
+		r.To = to
+		if r.Components != nil && !template {
+			return nil, fmt.Errorf("recipient %s has components, which only templates take", r.To)
+		}
+		if seen[r.To] {
+			continue
+		}
+		seen[r.To] = true
+		deliveries = append(deliveries, BroadcastDelivery{BroadcastRecipient: r, Status: recipientPending})
+	}
+	return deliveries, nil
+}
+
+// StartBroadcast handles POST /whatsapp/broadcast: it checks the request,
+// saves the broadcast and sends it in the background, answering 202 with
+// its ID for GET /whatsapp/broadcast/:id
+func (h *WhatsAppHandler) StartBroadcast(c *gin.Context) {
+	reqLog := requestLogger(c, h.log)
+	b := h.broadcasts
+
+	var req BroadcastRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apierror.RespondBinding(c, err)
+		return
+	}
+	phoneNumberID, ok := h.sendFrom(c, req.PhoneNumberID)
+	if !ok {
+		return
+	}
+	switch {
+	case (req.Text == "") == (req.Template == nil):
+		apierror.Respond(c, http.StatusBadRequest, apierror.InvalidRequest, "Exactly one of text and template is required")
+		return
+	case utf8.RuneCountInString(req.Text) > whatsAppMaxSendLength:
+		apierror.Respond(c, http.StatusBadRequest, apierror.InvalidRequest, "text must be at most 4096 characters")
+		return
+	case req.Template != nil && (req.Template.Name == "" || req.Template.Language == ""):
+		apierror.Respond(c, http.StatusBadRequest, apierror.InvalidRequest, "template needs a name and a language")
+		return
+	case (len(req.Recipients) == 0) == !req.AllKnownUsers:
+		apierror.Respond(c, http.StatusBadRequest, apierror.InvalidRequest, "Exactly one of recipients and all_known_users is required")
+		return
+	case req.Rate < 0 || req.Rate > b.cfg.MaxRate:
+		apierror.Respond(c, http.StatusBadRequest, apierror.InvalidRequest, fmt.Sprintf("rate must be between 0 and %g messages per second", b.cfg.MaxRate))
+		return
+	}
+
+	recipients := req.Recipients
+	if req.AllKnownUsers {
+		var err error
+		if recipients, err = b.knownUsers(phoneNumberID); err != nil {
+			reqLog.WithError(err).Error("Failed to list known WhatsApp users")
+			apierror.Respond(c, http.StatusInternalServerError, apierror.Internal, "Failed to list known users")
+			return
+		}
+	}
+	deliveries, err := broadcastDeliveries(recipients, req.Template != nil)
+	switch {
+	case err != nil:
+		apierror.Respond(c, http.StatusBadRequest, apierror.InvalidRequest, err.Error())
+		return
+	case len(deliveries) == 0:
+		apierror.Respond(c, http.StatusBadRequest, apierror.InvalidRequest, "The broadcast has no recipients")
+		return
+	case len(deliveries) > b.cfg.MaxRecipients:
+		apierror.Respond(c, http.StatusBadRequest, apierror.InvalidRequest, fmt.Sprintf("A broadcast may have at most %d recipients", b.cfg.MaxRecipients))
+		return
+	}
+
+	rate := req.Rate
+	if rate == 0 {
+		rate = b.cfg.Rate
+	}
+	bc := &Broadcast{
+		ID:            newRequestID(),
+		Status:        broadcastRunning,
+		PhoneNumberID: phoneNumberID,
+		Text:          req.Text,
+		Template:      req.Template,
+		Rate:          rate,
+		CreatedAt:     time.Now().UTC(),
+		Recipients:    deliveries,
+	}
+	if err := b.save(bc); err != nil {
+		reqLog.WithError(err).Error("Failed to save broadcast")
+		apierror.Respond(c, http.StatusInternalServerError, apierror.Internal, "Failed to save the broadcast")
+		return
+	}
+	summary := *bc
+	summary.Recipients = nil
+	go b.run(reqLog, bc)
+	c.JSON(http.StatusAccepted, summary)
+}
+
+// GetBroadcast handles GET /whatsapp/broadcast/:id, reporting a broadcast's
+// progress with what became of each recipient
+func (h *WhatsAppHandler) GetBroadcast(c *gin.Context) {
+	bc, err := h.broadcasts.load(c.Param("id"))
+	if errors.Is(err, store.ErrNotFound) {
+		apierror.Respond(c, http.StatusNotFound, apierror.NotFound, "Broadcast not found")
+		return
+	}
+	if err != nil {
+		requestLogger(c, h.log).WithError(err).Error("Failed to load broadcast")
+		apierror.Respond(c, http.StatusInternalServerError, apierror.Internal, "Failed to load the broadcast")
+		return
+	}
+	if bc.Status == broadcastRunning && !h.broadcasts.durable && time.Since(bc.HeartbeatAt) >= broadcastStaleAfter {
+		bc.Status = broadcastInterrupted
+	}
+	c.JSON(http.StatusOK, bc)
+}
+
+// optOut lets WhatsApp users stop and resume broadcasts to them with a
+// keyword; chats are answered either way
+type optOut struct {
+	out, in map[string]bool
+}
+
+// newOptOut returns nil when no keywords are configured
+func newOptOut(cfg config.BroadcastConfig) *optOut {
+	if len(cfg.OptOutKeywords) == 0 && len(cfg.OptInKeywords) == 0 {
+		return nil
+	}
+	o := &optOut{out: make(map[string]bool), in: make(map[string]bool)}
+	for _, word := range cfg.OptOutKeywords {
+		o.out[strings.ToLower(strings.TrimSpace(word))] = true
+	}
+	for _, word := range cfg.OptInKeywords {
+		o.in[strings.ToLower(strings.TrimSpace(word))] = true
+	}
+	return o
+}
+
+// handleOptOut records a message that is an opt-out or opt-in keyword and
+// confirms it; it returns false for other messages
+func (p *MessagePipeline) handleOptOut(t *messageTrace, msg ChannelMessage) bool {
+	word := strings.ToLower(strings.TrimSpace(msg.Text))
+	key := optOutKey(p.opts.Channel, msg.UserID)
+	var err error
+	var reply string
+	switch {
+	case p.optOut.out[word]:
+		err = p.store.Set(key, []byte(time.Now().UTC().Format(time.RFC3339)), 0)
+		reply = config.MsgOptedOut
+	case p.optOut.in[word]:
+		err = p.store.Delete(key)
+		reply = config.MsgOptedIn
+	default:
+		return false
+	}
+
+	t.outcome = outcomeCommand
+	if err != nil {
+		ref := newErrorRef()
+		t.log.WithError(err).WithField("error_ref", ref).Error("Failed to record broadcast opt-out")
+		p.notify(t, msg, p.messages.Error(p.locale(msg), config.MsgError, ref))
+		return true
+	}
+	t.log.WithField("opted_out", reply == config.MsgOptedOut).Info("User changed their broadcast opt-out")
+	p.notify(t, msg, p.messages.Get(p.locale(msg), reply))
+	return true
+}
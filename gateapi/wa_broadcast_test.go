@@ -0,0 +1,178 @@
+package gateapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tracoco/DifyGate/config"
+)
+
+func newTestBroadcaster(t *testing.T, durable bool) (*WhatsAppHandler, *fakeGraphAPI) {
+	t.Helper()
+	h, graph := newTestWhatsAppHandler(t)
+	h.cfg.PhoneNumberID = "123"
+	h.broadcasts = newBroadcaster(config.BroadcastConfig{
+		Rate:          100,
+		MaxRate:       1000,
+		MaxRecipients: 10,
+		Retention:     time.Hour,
+		Blocklist:     []string{"+15550000002"},
+	}, durable, h)
+	return h, graph
+}
+
+// waitForBroadcast polls the broadcast until it is done
+func waitForBroadcast(t *testing.T, h *WhatsAppHandler, id string) *Broadcast {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		bc, err := h.broadcasts.load(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bc.Status == broadcastDone {
+			return bc
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("broadcast still %s: %+v", bc.Status, bc.Counts)
+		}
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	h, graph := newTestBroadcaster(t, false)
+	if err := h.store.Set(optOutKey("whatsapp", "15550000003"), []byte("now"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/broadcast", h.StartBroadcast)
+	r.GET("/broadcast/:id", h.GetBroadcast)
+	post := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/broadcast", strings.NewReader(body)))
+		return w
+	}
+
+	for _, body := range []string{
+		`{"recipients": [{"to": "15550000001"}]}`,
+		`{"recipients": [{"to": "15550000001"}], "text": "hi", "rate": 5000}`,
+		`{"recipients": [{"to": "not a number"}], "text": "hi"}`,
+		`{"recipients": [{"to": "15550000001", "components": []}], "text": "hi"}`,
+		`{"all_known_users": true, "text": "hi"}`,
+	} {
+		if w := post(body); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", body, w.Code)
+		}
+	}
+
+	w := post(`{"template": {"name": "news", "language": "en"}, "recipients": [
+		{"to": "+15550000001", "components": [{"type": "body", "parameters": [{"type": "text", "text": "Ada"}]}]},
+		{"to": "15550000001"},
+		{"to": "15550000002"},
+		{"to": "15550000003"},
+		{"to": "15550000004"}
+	]}`)
+	var started Broadcast
+	if w.Code != http.StatusAccepted || json.Unmarshal(w.Body.Bytes(), &started) != nil || started.ID == "" {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	waitForBroadcast(t, h, started.ID)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/broadcast/"+started.ID, nil))
+	var bc Broadcast
+	if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &bc) != nil {
+		t.Fatalf("get: status %d: %s", w.Code, w.Body)
+	}
+	want := map[string]string{"15550000001": "sent", "15550000002": "skipped blocklisted", "15550000003": "skipped opted_out", "15550000004": "sent"}
+	if len(bc.Recipients) != len(want) {
+		t.Fatalf("recipients %+v, want the four distinct numbers", bc.Recipients)
+	}
+	for _, d := range bc.Recipients {
+		if got := strings.TrimSpace(d.Status + " " + d.Reason); got != want[d.To] {
+			t.Errorf("%s: %s, want %s", d.To, got, want[d.To])
+		}
+	}
+	if bc.Counts[recipientSent] != 2 || bc.Counts[recipientSkipped] != 2 {
+		t.Errorf("counts %v, want 2 sent and 2 skipped", bc.Counts)
+	}
+
+	graph.mu.Lock()
+	defer graph.mu.Unlock()
+	if len(graph.payloads) != 2 {
+		t.Fatalf("sent %d messages, want 2", len(graph.payloads))
+	}
+	if !strings.Contains(string(graph.payloads[0]), `"Ada"`) || strings.Contains(string(graph.payloads[1]), `"Ada"`) {
+		t.Errorf("payloads %s and %s, want the parameters for the first recipient only", graph.payloads[0], graph.payloads[1])
+	}
+}
+
+func TestBroadcastResumesAfterRestart(t *testing.T) {
+	h, graph := newTestBroadcaster(t, true)
+	// A broadcast whose gateway stopped a while ago, halfway through
+	abandoned := &Broadcast{
+		ID:            "abandoned",
+		Status:        broadcastRunning,
+		PhoneNumberID: "123",
+		Text:          "hello",
+		Rate:          100,
+		CreatedAt:     time.Now().Add(-time.Hour),
+		Recipients: []BroadcastDelivery{
+			{BroadcastRecipient: BroadcastRecipient{To: "15550000001"}, Status: recipientSent, WAMID: "wamid.before"},
+			{BroadcastRecipient: BroadcastRecipient{To: "15550000004"}, Status: recipientPending},
+		},
+	}
+	if err := h.broadcasts.save(abandoned); err != nil {
+		t.Fatal(err)
+	}
+	h.broadcasts.recover(quietLogger())
+	if bc, _ := h.broadcasts.load("abandoned"); bc.Recipients[1].Status != recipientPending {
+		t.Error("resumed a broadcast with a fresh heartbeat")
+	}
+
+	abandoned.HeartbeatAt = time.Now().Add(-2 * broadcastStaleAfter)
+	raw, _ := json.Marshal(abandoned)
+	if err := h.store.Set(broadcastKey("abandoned"), raw, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	h.broadcasts.recover(quietLogger())
+	bc := waitForBroadcast(t, h, "abandoned")
+	if bc.Recipients[1].Status != recipientSent {
+		t.Errorf("recipients %+v, want the pending one sent", bc.Recipients)
+	}
+	graph.mu.Lock()
+	defer graph.mu.Unlock()
+	if len(graph.bodies) != 1 || graph.bodies[0] != "hello" {
+		t.Errorf("sent %q, want the message to the pending recipient only", graph.bodies)
+	}
+}
+
+func TestPipelineRecordsBroadcastOptOut(t *testing.T) {
+	p, sender, _, kv := newTestPipeline(t, PipelineOptions{Channel: "whatsapp"}, config.ChatConfig{},
+		func(req ChatMessageRequest) []StreamingChatResponse {
+			return difyAnswer("conv-1", "answer")
+		})
+	p.optOut = newOptOut(config.BroadcastConfig{OptOutKeywords: []string{"STOP"}, OptInKeywords: []string{"start"}})
+
+	p.Handle(testEntry(), ChannelMessage{ChannelID: "123", UserID: "15551234567", Text: " Stop "})
+	if _, err := kv.Get(optOutKey("whatsapp", "15551234567")); err != nil {
+		t.Errorf("STOP didn't opt out: %v", err)
+	}
+	if got := sender.sent(); len(got) != 1 || got[0] != config.DefaultMessages[config.MsgOptedOut] {
+		t.Errorf("sent %q, want the opt-out confirmation", got)
+	}
+	p.Handle(testEntry(), ChannelMessage{ChannelID: "123", UserID: "15551234567", Text: "START"})
+	if _, err := kv.Get(optOutKey("whatsapp", "15551234567")); err == nil {
+		t.Error("START didn't opt back in")
+	}
+	p.Handle(testEntry(), ChannelMessage{ChannelID: "123", UserID: "15551234567", Text: "stop the music"})
+	if got := sender.sent(); len(got) != 2 || got[1] != "answer" {
+		t.Errorf("sent %q, want other messages answered", got)
+	}
+}
@@ -0,0 +1,456 @@
+package gateapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/config"
+	"github.com/tracoco/DifyGate/metrics"
+	"github.com/tracoco/DifyGate/sentry"
+)
+
+// WhatsAppClient sends messages through the WhatsApp Cloud (Graph) API
+type WhatsAppClient struct {
+	graphAPIToken string
+	baseURL       string
+	apiVersion    string
+	linkPreviews  bool
+	readTimeout   time.Duration
+	client        *http.Client
+	// deliveries tracks the status of sent messages; nil doesn't
+	deliveries *deliveryTracker
+
+	// readFailures counts read receipts failed in a row
+	readFailures atomic.Int64
+}
+
+// NewWhatsAppClient creates a new WhatsApp Cloud API client on a shared
+// HTTP client
+func NewWhatsAppClient(cfg config.WhatsAppConfig, httpClient *http.Client) *WhatsAppClient {
+	return &WhatsAppClient{
+		graphAPIToken: cfg.GraphAPIToken,
+		baseURL:       strings.TrimSuffix(cfg.GraphAPIBaseURL, "/"),
+		apiVersion:    cfg.APIVersion,
+		linkPreviews:  cfg.LinkPreviews,
+		readTimeout:   cfg.ReadReceiptTimeout,
+		client:        httpClient,
+	}
+}
+
+// messagesURL returns the messages endpoint for a business phone number
+func (w *WhatsAppClient) messagesURL(phoneNumberID string) string {
+	return fmt.Sprintf("%s/%s/%s/messages", w.baseURL, w.apiVersion, phoneNumberID)
+}
+
+// whatsAppMaxTextLength keeps text messages under the Cloud API's 4096
+// character limit
+const whatsAppMaxTextLength = 4000
+
+// SendReplyMessage sends a text reply to a WhatsApp message, or a
+// standalone message when messageID is empty, in as many messages as the
+// text needs. It returns the wamids of the messages sent, stopping at the
+// first that fails.
+func (w *WhatsAppClient) SendReplyMessage(ctx context.Context, phoneNumberID, to, messageBody, messageID string) ([]string, error) {
+	if strings.TrimSpace(messageBody) == "" {
+		return nil, errors.New("message is empty")
+	}
+
+	var wamids []string
+	for _, chunk := range splitMessage(messageBody, whatsAppMaxTextLength) {
+		wamid, err := w.SendText(ctx, phoneNumberID, to, chunk, messageID)
+		if err != nil {
+			return wamids, err
+		}
+		wamids = append(wamids, wamid)
+	}
+	return wamids, nil
+}
+
+// SendText sends a text message, quoting replyTo when it is set, and
+// returns the wamid WhatsApp assigned it
+func (w *WhatsAppClient) SendText(ctx context.Context, phoneNumberID, to, text, replyTo string) (string, error) {
+	return w.send(ctx, phoneNumberID, textPayload(to, text, replyTo, w.linkPreviews))
+}
+
+// textPayload builds the Cloud API payload for a text message
+func textPayload(to, text, replyTo string, previewURL bool) map[string]interface{} {
+	body := map[string]interface{}{"body": text}
+	// Only turning previews off changes the payload
+	if !previewURL {
+		body["preview_url"] = false
+	}
+	payload := map[string]interface{}{
+		"messaging_product": "whatsapp",
+		"recipient_type":    "individual",
+		"to":                to,
+		"text":              body,
+	}
+	// Quote the message being answered, when there is one
+	if replyTo != "" {
+		payload["context"] = map[string]string{
+			"message_id": replyTo,
+		}
+	}
+	return payload
+}
+
+// SendReaction reacts to the message messageID from to with emoji; an
+// empty emoji removes the reaction
+func (w *WhatsAppClient) SendReaction(ctx context.Context, phoneNumberID, to, messageID, emoji string) error {
+	_, err := w.send(ctx, phoneNumberID, map[string]interface{}{
+		"messaging_product": "whatsapp",
+		"recipient_type":    "individual",
+		"to":                to,
+		"type":              "reaction",
+		"reaction": map[string]string{
+			"message_id": messageID,
+			"emoji":      emoji,
+		},
+	})
+	return err
+}
+
+// SendMedia sends an image, audio, video or document by link and returns
+// its wamid
+func (w *WhatsAppClient) SendMedia(ctx context.Context, phoneNumberID, to, mediaType, link, caption string) (string, error) {
+	return w.sendMedia(ctx, phoneNumberID, to, mediaType, map[string]string{"link": link}, caption)
+}
+
+// sendMedia sends a media message, where media holds its link or uploaded
+// id and optionally a document's filename, and returns its wamid
+func (w *WhatsAppClient) sendMedia(ctx context.Context, phoneNumberID, to, mediaType string, media map[string]string, caption string) (string, error) {
+	// WhatsApp rejects captions on audio
+	if caption != "" && mediaType != "audio" {
+		media["caption"] = caption
+	}
+	return w.send(ctx, phoneNumberID, map[string]interface{}{
+		"messaging_product": "whatsapp",
+		"to":                to,
+		"type":              mediaType,
+		mediaType:           media,
+	})
+}
+
+// UploadMedia uploads a file to the Graph API for sending by ID, streaming
+// it rather than holding it in memory, and returns the media ID
+func (w *WhatsAppClient) UploadMedia(ctx context.Context, phoneNumberID, mimeType, filename string, file io.Reader) (string, error) {
+	if w.graphAPIToken == "" {
+		return "", fmt.Errorf("DIFYGATE_GRAPH_API_TOKEN is not set")
+	}
+
+	body, pw := io.Pipe()
+	form := multipart.NewWriter(pw)
+	go func() {
+		_ = form.WriteField("messaging_product", "whatsapp")
+		_ = form.WriteField("type", mimeType)
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename=%q`, filename))
+		header.Set("Content-Type", mimeType)
+		part, err := form.CreatePart(header)
+		if err == nil {
+			_, err = io.Copy(part, file)
+		}
+		if err == nil {
+			err = form.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	url := fmt.Sprintf("%s/%s/%s/media", w.baseURL, w.apiVersion, phoneNumberID)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, body)
+	if err != nil {
+		body.Close()
+		return "", fmt.Errorf("failed to create media upload request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+w.graphAPIToken)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to upload media: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode != http.StatusOK {
+		return "", parseWhatsAppError(resp.StatusCode, respBody)
+	}
+	var uploaded struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(respBody, &uploaded); err != nil || uploaded.ID == "" {
+		return "", fmt.Errorf("media upload returned no ID: %s", strings.TrimSpace(string(respBody)))
+	}
+	return uploaded.ID, nil
+}
+
+// WhatsAppAPIError is an error the Graph API returned for a sent message,
+// e.g. code 131047 when the 24-hour window to message a user freely has
+// passed and only a template can be sent
+type WhatsAppAPIError struct {
+	Status    int    `json:"-"`
+	Code      int    `json:"code"`
+	Subcode   int    `json:"error_subcode,omitempty"`
+	Message   string `json:"message"`
+	Details   string `json:"details,omitempty"`
+	FBTraceID string `json:"fbtrace_id,omitempty"`
+}
+
+// Error implements error
+func (e *WhatsAppAPIError) Error() string {
+	msg := fmt.Sprintf("WhatsApp API returned status %d (code %d): %s", e.Status, e.Code, e.Message)
+	if e.Details != "" {
+		msg += ": " + e.Details
+	}
+	return msg
+}
+
+// whatsAppCodeReengagement is the Graph API error for a free-form message
+// to a user who hasn't written in the last 24 hours
+const whatsAppCodeReengagement = 131047
+
+// whatsAppRateLimitCodes are the Graph API errors for sending too much
+var whatsAppRateLimitCodes = map[int]bool{
+	4:      true,
+	80007:  true,
+	130429: true,
+	131048: true,
+	131056: true,
+}
+
+// OutsideWindow reports whether the message failed because the user's
+// 24-hour customer service window is closed
+func (e *WhatsAppAPIError) OutsideWindow() bool {
+	return e.Code == whatsAppCodeReengagement
+}
+
+// RateLimited reports whether the message failed for sending too much
+func (e *WhatsAppAPIError) RateLimited() bool {
+	return e.Status == http.StatusTooManyRequests || whatsAppRateLimitCodes[e.Code]
+}
+
+// whatsAppCodeInvalidToken is the Graph API error for an expired or
+// revoked access token
+const whatsAppCodeInvalidToken = 190
+
+// Unauthorized reports whether the Graph API rejected the access token
+func (e *WhatsAppAPIError) Unauthorized() bool {
+	return e.Status == http.StatusUnauthorized || e.Code == whatsAppCodeInvalidToken
+}
+
+// parseWhatsAppError builds the error for a non-200 Graph API response;
+// bodies that aren't Graph's JSON error keep their text as the message
+func parseWhatsAppError(status int, body []byte) *WhatsAppAPIError {
+	var parsed struct {
+		Error struct {
+			Message      string `json:"message"`
+			Code         int    `json:"code"`
+			ErrorSubcode int    `json:"error_subcode"`
+			ErrorData    struct {
+				Details string `json:"details"`
+			} `json:"error_data"`
+			FBTraceID string `json:"fbtrace_id"`
+		} `json:"error"`
+	}
+	apiErr := &WhatsAppAPIError{Status: status}
+	if err := json.Unmarshal(body, &parsed); err != nil || parsed.Error.Message == "" {
+		apiErr.Message = strings.TrimSpace(string(body))
+		return apiErr
+	}
+	apiErr.Code = parsed.Error.Code
+	apiErr.Subcode = parsed.Error.ErrorSubcode
+	apiErr.Message = parsed.Error.Message
+	apiErr.Details = parsed.Error.ErrorData.Details
+	apiErr.FBTraceID = parsed.Error.FBTraceID
+	return apiErr
+}
+
+// sendResponse is the part of the Cloud API's reply to a sent message
+// DifyGate uses
+type sendResponse struct {
+	Messages []struct {
+		ID string `json:"id"`
+	} `json:"messages"`
+}
+
+// send posts one message payload for a business phone number and returns
+// the wamid of the message sent
+func (w *WhatsAppClient) send(ctx context.Context, phoneNumberID string, payload map[string]interface{}) (string, error) {
+	if w.graphAPIToken == "" {
+		return "", fmt.Errorf("DIFYGATE_GRAPH_API_TOKEN is not set")
+	}
+
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal message payload: %w", err)
+	}
+
+	// Log what we're about to send
+	log := loggerFromContext(ctx, logrus.StandardLogger())
+	if log.Logger.IsLevelEnabled(logrus.DebugLevel) {
+		var prettyJSON bytes.Buffer
+		if err := json.Indent(&prettyJSON, payloadBytes, "", "  "); err == nil {
+			log.WithField("payload", prettyJSON.String()).Debug("WhatsApp API request payload")
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", w.messagesURL(phoneNumberID), bytes.NewBuffer(payloadBytes))
+	if err != nil {
+		return "", fmt.Errorf("failed to create message request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+w.graphAPIToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to send message: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode != http.StatusOK {
+		apiErr := parseWhatsAppError(resp.StatusCode, respBody)
+		if apiErr.Unauthorized() {
+			reportError(log.WithFields(logrus.Fields{"channel": "whatsapp", "phone_number_id": phoneNumberID}), sentry.LevelError,
+				"The Graph API rejected the access token; check DIFYGATE_GRAPH_API_TOKEN", apiErr,
+				map[string]string{"upstream": "whatsapp", "error_code": strconv.Itoa(apiErr.Code)})
+		}
+		return "", apiErr
+	}
+
+	// Log response for debugging
+	log.WithField("response", string(respBody)).Debug("WhatsApp API response")
+
+	// The message went out even if its ID can't be read
+	var sent sendResponse
+	if err := json.Unmarshal(respBody, &sent); err != nil || len(sent.Messages) == 0 {
+		return "", nil
+	}
+	to, _ := payload["to"].(string)
+	w.deliveries.sent(phoneNumberID, to, sent.Messages[0].ID)
+	return sent.Messages[0].ID, nil
+}
+
+const (
+	// markReadRetryDelay is the wait before retrying a failed read receipt,
+	// plus up to as much again of jitter
+	markReadRetryDelay = 500 * time.Millisecond
+	// markReadAlertAfter consecutive failed read receipts are reported as a
+	// likely Graph API token problem
+	markReadAlertAfter = 5
+)
+
+// whatsAppMarkReadFailures counts failed read receipt attempts
+var whatsAppMarkReadFailures = metrics.NewCounter("difygate_whatsapp_mark_read_failures_total",
+	"Failed attempts to mark WhatsApp messages as read, by HTTP status (0 for network errors)", "status")
+
+// MarkMessageAsRead marks an incoming message as read, retrying once on
+// transient errors; it can take a while, so callers run it in a goroutine
+func (w *WhatsAppClient) MarkMessageAsRead(log *logrus.Entry, phoneNumberID, messageID string) {
+	payloadBytes, err := json.Marshal(map[string]interface{}{
+		"messaging_product": "whatsapp",
+		"status":            "read",
+		"message_id":        messageID,
+	})
+	if err != nil {
+		log.WithError(err).Error("Failed to marshal read status payload")
+		return
+	}
+
+	for attempt := 1; ; attempt++ {
+		status, err := w.markRead(phoneNumberID, payloadBytes)
+		if err == nil {
+			if failures := w.readFailures.Swap(0); failures >= markReadAlertAfter {
+				log.WithField("consecutive_failures", failures).Info("Marking messages as read works again")
+			}
+			return
+		}
+		whatsAppMarkReadFailures.Inc(strconv.Itoa(status))
+
+		if attempt == 1 && (status == 0 || status == http.StatusTooManyRequests || status >= 500) {
+			log.WithError(err).Debug("Retrying to mark message as read")
+			time.Sleep(markReadRetryDelay + time.Duration(rand.Int63n(int64(markReadRetryDelay))))
+			continue
+		}
+
+		log.WithError(err).Warn("Failed to mark message as read")
+		if failures := w.readFailures.Add(1); failures == markReadAlertAfter {
+			log.WithField("consecutive_failures", failures).Error("Marking messages as read keeps failing, check DIFYGATE_GRAPH_API_TOKEN")
+			reportError(log.WithFields(logrus.Fields{"channel": "whatsapp", "phone_number_id": phoneNumberID}), sentry.LevelWarning,
+				"Marking WhatsApp messages as read keeps failing; check DIFYGATE_GRAPH_API_TOKEN", err,
+				map[string]string{"upstream": "whatsapp", "status": strconv.Itoa(status)})
+		}
+		return
+	}
+}
+
+// markRead sends one read receipt, returning the HTTP status, or 0 when
+// there was no response
+func (w *WhatsAppClient) markRead(phoneNumberID string, payload []byte) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), w.readTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", w.messagesURL(phoneNumberID), bytes.NewReader(payload))
+	if err != nil {
+		return 0, fmt.Errorf("failed to create read status request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+w.graphAPIToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, fmt.Errorf("WhatsApp API returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+	return resp.StatusCode, nil
+}
+
+// CheckToken verifies the Graph API token by fetching the given phone
+// number resource, or the token's own identity if none is given
+func (w *WhatsAppClient) CheckToken(ctx context.Context, phoneNumberID string) error {
+	if w.graphAPIToken == "" {
+		return fmt.Errorf("DIFYGATE_GRAPH_API_TOKEN is not set")
+	}
+
+	resource := phoneNumberID
+	if resource == "" {
+		resource = "me"
+	}
+	url := fmt.Sprintf("%s/%s/%s", w.baseURL, w.apiVersion, resource)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+w.graphAPIToken)
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to communicate with Graph API: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("Graph API returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package gateapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/config"
+)
+
+// fakeGraphAPI records the text bodies sent to the messages endpoint
+type fakeGraphAPI struct {
+	mu       sync.Mutex
+	payloads []json.RawMessage
+	bodies   []string
+}
+
+func newFakeGraphAPI(t *testing.T) (*fakeGraphAPI, *WhatsAppClient) {
+	t.Helper()
+	f := &fakeGraphAPI{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw, _ := io.ReadAll(r.Body)
+		var payload struct {
+			Text struct {
+				Body string `json:"body"`
+			} `json:"text"`
+		}
+		json.Unmarshal(raw, &payload)
+		f.mu.Lock()
+		f.payloads = append(f.payloads, raw)
+		f.bodies = append(f.bodies, payload.Text.Body)
+		f.mu.Unlock()
+		w.Write([]byte(`{"messages":[{"id":"wamid.test"}]}`))
+	}))
+	t.Cleanup(srv.Close)
+	client := NewWhatsAppClient(config.WhatsAppConfig{
+		GraphAPIToken:      "token",
+		GraphAPIBaseURL:    srv.URL,
+		APIVersion:         "v22.0",
+		LinkPreviews:       true,
+		ReadReceiptTimeout: time.Second,
+	}, srv.Client())
+	return f, client
+}
+
+func TestSendReplyMessageSplitsOnRuneBoundaries(t *testing.T) {
+	f, client := newFakeGraphAPI(t)
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+
+	// 3-byte runes, so a byte-based cut would land mid-character
+	text := strings.Repeat("日本語のテキスト", 1000)
+	wamids, err := client.SendReplyMessage(withLogger(context.Background(), logrus.NewEntry(log)), "555", "123", text, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(f.bodies) < 2 {
+		t.Fatalf("sent %d messages, want the text split", len(f.bodies))
+	}
+	if len(wamids) != len(f.bodies) || wamids[0] != "wamid.test" {
+		t.Errorf("returned wamids %q for %d messages", wamids, len(f.bodies))
+	}
+	var joined strings.Builder
+	for i, body := range f.bodies {
+		if !utf8.ValidString(body) {
+			t.Errorf("message %d is not valid UTF-8", i)
+		}
+		if n := utf8.RuneCountInString(body); n > whatsAppMaxTextLength {
+			t.Errorf("message %d has %d characters, limit %d", i, n, whatsAppMaxTextLength)
+		}
+		joined.WriteString(body)
+	}
+	if joined.String() != text {
+		t.Error("split messages don't add up to the original text")
+	}
+}
+
+func TestTextPayloadJSON(t *testing.T) {
+	tests := []struct {
+		name       string
+		replyTo    string
+		previewURL bool
+		want       string
+	}{
+		{"previews on", "", true,
+			`{"messaging_product":"whatsapp","recipient_type":"individual","text":{"body":"See https://example.com"},"to":"123"}`},
+		{"previews off", "", false,
+			`{"messaging_product":"whatsapp","recipient_type":"individual","text":{"body":"See https://example.com","preview_url":false},"to":"123"}`},
+		{"reply with previews off", "wamid.IN", false,
+			`{"context":{"message_id":"wamid.IN"},"messaging_product":"whatsapp","recipient_type":"individual","text":{"body":"See https://example.com","preview_url":false},"to":"123"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := json.Marshal(textPayload("123", "See https://example.com", tt.replyTo, tt.previewURL))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("payload\n got %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMarkMessageAsReadRetriesTransientErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		want     int32
+	}{
+		{"success", []int{http.StatusOK}, 1},
+		{"server error retried", []int{http.StatusBadGateway, http.StatusOK}, 2},
+		{"rate limit retried once", []int{http.StatusTooManyRequests, http.StatusTooManyRequests, http.StatusOK}, 2},
+		{"invalid token not retried", []int{http.StatusUnauthorized, http.StatusOK}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := atomic.AddInt32(&calls, 1)
+				w.WriteHeader(tt.statuses[n-1])
+				w.Write([]byte(`{"success":true}`))
+			}))
+			defer srv.Close()
+			client := NewWhatsAppClient(config.WhatsAppConfig{
+				GraphAPIToken:      "token",
+				GraphAPIBaseURL:    srv.URL,
+				APIVersion:         "v22.0",
+				ReadReceiptTimeout: time.Second,
+			}, srv.Client())
+
+			before := whatsAppMarkReadFailures.Value("401")
+			client.MarkMessageAsRead(logrus.NewEntry(quietLogger()), "555", "wamid.IN")
+			if got := atomic.LoadInt32(&calls); got != tt.want {
+				t.Errorf("%d attempts, want %d", got, tt.want)
+			}
+			if tt.statuses[0] == http.StatusUnauthorized && whatsAppMarkReadFailures.Value("401")-before != 1 {
+				t.Error("the 401 was not counted")
+			}
+		})
+	}
+}
+
+func TestSendReplyMessageReturnsErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":{"message":"Re-engagement message","code":131047}}`))
+	}))
+	defer srv.Close()
+	client := NewWhatsAppClient(config.WhatsAppConfig{GraphAPIToken: "token", GraphAPIBaseURL: srv.URL, APIVersion: "v22.0"}, srv.Client())
+
+	wamids, err := client.SendReplyMessage(context.Background(), "555", "123", "hello", "")
+	var apiErr *WhatsAppAPIError
+	if !errors.As(err, &apiErr) || !apiErr.OutsideWindow() || len(wamids) != 0 {
+		t.Errorf("SendReplyMessage = %q, %v; want Meta's error and no wamids", wamids, err)
+	}
+	if _, err := client.SendReplyMessage(context.Background(), "555", "123", " ", ""); err == nil {
+		t.Error("an empty message was sent")
+	}
+}
+
+func TestMarkMessageAsReadTimesOut(t *testing.T) {
+	// The handler hangs until the test ends, like a stuck Graph API
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+	client := NewWhatsAppClient(config.WhatsAppConfig{
+		GraphAPIToken:      "token",
+		GraphAPIBaseURL:    srv.URL,
+		APIVersion:         "v22.0",
+		ReadReceiptTimeout: 50 * time.Millisecond,
+	}, srv.Client())
+
+	start := time.Now()
+	client.MarkMessageAsRead(logrus.NewEntry(quietLogger()), "555", "wamid.IN")
+	// Two timed out attempts and the jittered wait between them
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("took %v, want each attempt bounded by the timeout", elapsed)
+	}
+}
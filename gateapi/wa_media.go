@@ -0,0 +1,197 @@
+package gateapi
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/apierror"
+	"github.com/tracoco/DifyGate/history"
+)
+
+// whatsAppMediaLimit is what WhatsApp accepts for one media message type
+type whatsAppMediaLimit struct {
+	maxBytes int64
+	types    []string
+}
+
+// whatsAppMediaLimits are the Cloud API's supported MIME types and sizes
+// per media message type
+var whatsAppMediaLimits = map[string]whatsAppMediaLimit{
+	"image": {5 << 20, []string{"image/jpeg", "image/png"}},
+	"audio": {16 << 20, []string{"audio/aac", "audio/amr", "audio/mpeg", "audio/mp4", "audio/ogg"}},
+	"video": {16 << 20, []string{"video/mp4", "video/3gpp"}},
+	"document": {100 << 20, []string{
+		"application/pdf",
+		"text/plain",
+		"application/msword",
+		"application/vnd.ms-excel",
+		"application/vnd.ms-powerpoint",
+		"application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+		"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+		"application/vnd.openxmlformats-officedocument.presentationml.presentation",
+	}},
+}
+
+// mediaTypeFor returns the media message type a MIME type is sent as
+func mediaTypeFor(mimeType string) (string, bool) {
+	for mediaType, limit := range whatsAppMediaLimits {
+		for _, t := range limit.types {
+			if t == mimeType {
+				return mediaType, true
+			}
+		}
+	}
+	return "", false
+}
+
+// WhatsAppMediaRequest is a media message to a WhatsApp user, by link or
+// as a multipart upload with the same fields plus file
+type WhatsAppMediaRequest struct {
+	// PhoneNumberID is the business number to send from; empty uses
+	// DIFYGATE_WHATSAPP_PHONE_NUMBER_ID
+	PhoneNumberID string `json:"phone_number_id" form:"phone_number_id"`
+	To            string `json:"to" form:"to" binding:"required"`
+	// Type is image, audio, video or document; uploads default to the type
+	// of the file
+	Type string `json:"type" form:"type"`
+	// Link is a public HTTPS URL WhatsApp fetches the media from
+	Link    string `json:"link" form:"-"`
+	Caption string `json:"caption" form:"caption"`
+	// Filename names a document for the user
+	Filename string `json:"filename" form:"filename"`
+}
+
+// SendMediaMessage sends an image, audio, video or document to a WhatsApp
+// user, uploading it to the Graph API first when it is posted as a file,
+// and returns the media ID and wamid
+func (h *WhatsAppHandler) SendMediaMessage(c *gin.Context) {
+	reqLog := requestLogger(c, h.log)
+
+	var req WhatsAppMediaRequest
+	upload := strings.HasPrefix(c.ContentType(), "multipart/form-data")
+	var err error
+	if upload {
+		err = c.ShouldBind(&req)
+	} else {
+		err = c.ShouldBindJSON(&req)
+	}
+	if err != nil {
+		if isBodyTooLarge(err) {
+			abortBodyTooLarge(c)
+			return
+		}
+		apierror.RespondBinding(c, err)
+		return
+	}
+	to, phoneNumberID, ok := h.sendTarget(c, req.To, req.PhoneNumberID)
+	if !ok {
+		return
+	}
+	if req.Caption != "" && len([]rune(req.Caption)) > 1024 {
+		apierror.Respond(c, http.StatusBadRequest, apierror.InvalidRequest, "caption must be at most 1024 characters")
+		return
+	}
+
+	log := reqLog.WithFields(logrus.Fields{"phone_number_id": phoneNumberID, "to": to})
+	ctx := withLogger(c.Request.Context(), log)
+	media := map[string]string{}
+	var mediaID string
+	if upload {
+		fileHeader, err := c.FormFile("file")
+		if err != nil {
+			if isBodyTooLarge(err) {
+				abortBodyTooLarge(c)
+				return
+			}
+			apierror.Respond(c, http.StatusBadRequest, apierror.InvalidRequest, "Uploads need the media as the file field")
+			return
+		}
+		mimeType, _, _ := mime.ParseMediaType(fileHeader.Header.Get("Content-Type"))
+		if req.Type == "" {
+			req.Type, _ = mediaTypeFor(mimeType)
+		}
+		if msg := validateMedia(req.Type, mimeType, fileHeader.Size); msg != "" {
+			apierror.Respond(c, http.StatusBadRequest, apierror.InvalidRequest, msg)
+			return
+		}
+		file, err := fileHeader.Open()
+		if err != nil {
+			log.WithError(err).Error("Failed to open uploaded media")
+			apierror.Respond(c, http.StatusInternalServerError, apierror.Internal, "Failed to read the uploaded file")
+			return
+		}
+		defer file.Close()
+		mediaID, err = h.client.UploadMedia(ctx, phoneNumberID, mimeType, path.Base(fileHeader.Filename), file)
+		if err != nil {
+			log.WithError(err).Warn("Failed to upload WhatsApp media")
+			whatsAppSendErrorResponse(c, err)
+			return
+		}
+		media["id"] = mediaID
+		if req.Type == "document" && req.Filename == "" {
+			req.Filename = path.Base(fileHeader.Filename)
+		}
+	} else {
+		if _, ok := whatsAppMediaLimits[req.Type]; !ok {
+			apierror.Respond(c, http.StatusBadRequest, apierror.InvalidRequest, "type must be image, audio, video or document")
+			return
+		}
+		if u, err := url.Parse(req.Link); err != nil || u.Scheme != "https" || u.Host == "" {
+			apierror.Respond(c, http.StatusBadRequest, apierror.InvalidRequest, "link must be an https URL, or post the file as multipart/form-data")
+			return
+		}
+		media["link"] = req.Link
+	}
+	if req.Type == "document" && req.Filename != "" {
+		media["filename"] = req.Filename
+	}
+
+	wamid, err := h.client.sendMedia(ctx, phoneNumberID, to, req.Type, media, req.Caption)
+	rec := history.Record{
+		ID:        wamid,
+		Channel:   "whatsapp",
+		UserID:    to,
+		Direction: history.Outbound,
+		Text:      strings.TrimSpace("[" + req.Type + "] " + req.Caption),
+		Status:    history.StatusSent,
+	}
+	if err != nil {
+		rec.Status, rec.Error = history.StatusFailed, err.Error()
+		h.history.Record(rec)
+		log.WithError(err).Warn("Failed to send WhatsApp media message")
+		whatsAppSendErrorResponse(c, err)
+		return
+	}
+	h.history.Record(rec)
+	log.WithFields(logrus.Fields{"wamid": wamid, "media_id": mediaID, "type": req.Type}).Info("WhatsApp media message sent")
+	c.JSON(http.StatusOK, gin.H{"media_id": mediaID, "wamid": wamid})
+}
+
+// validateMedia checks an upload against WhatsApp's limits for its media
+// type, returning what is wrong or ""
+func validateMedia(mediaType, mimeType string, size int64) string {
+	limit, ok := whatsAppMediaLimits[mediaType]
+	if !ok {
+		if mediaType == "" {
+			return fmt.Sprintf("WhatsApp can't send files of type %q", mimeType)
+		}
+		return "type must be image, audio, video or document"
+	}
+	supported := false
+	for _, t := range limit.types {
+		supported = supported || t == mimeType
+	}
+	if !supported {
+		return fmt.Sprintf("WhatsApp can't send %q as %s; supported types are %s", mimeType, mediaType, strings.Join(limit.types, ", "))
+	}
+	if size > limit.maxBytes {
+		return fmt.Sprintf("%s files must be at most %d MB", mediaType, limit.maxBytes>>20)
+	}
+	return ""
+}
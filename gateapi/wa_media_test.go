@@ -0,0 +1,169 @@
+package gateapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tracoco/DifyGate/config"
+)
+
+// fakeGraphMedia accepts uploads and messages like the Graph API
+type fakeGraphMedia struct {
+	mu       sync.Mutex
+	uploaded []byte
+	mimeType string
+	messages []map[string]interface{}
+}
+
+func newTestMediaHandler(t *testing.T) (*WhatsAppHandler, *fakeGraphMedia) {
+	t.Helper()
+	f := &fakeGraphMedia{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if strings.HasSuffix(r.URL.Path, "/media") {
+			file, header, err := r.FormFile("file")
+			if err != nil || r.FormValue("messaging_product") != "whatsapp" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			f.uploaded, _ = io.ReadAll(file)
+			f.mimeType = header.Header.Get("Content-Type")
+			w.Write([]byte(`{"id":"media-1"}`))
+			return
+		}
+		var msg map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&msg)
+		f.messages = append(f.messages, msg)
+		w.Write([]byte(`{"messages":[{"id":"wamid.media"}]}`))
+	}))
+	t.Cleanup(srv.Close)
+	h, _ := newTestWhatsAppHandler(t)
+	h.cfg.PhoneNumberID = "555"
+	h.client = NewWhatsAppClient(config.WhatsAppConfig{GraphAPIToken: "token", GraphAPIBaseURL: srv.URL, APIVersion: "v22.0"}, srv.Client())
+	return h, f
+}
+
+// postMedia posts body with contentType to the media endpoint of h
+func postMedia(h *WhatsAppHandler, contentType string, body io.Reader) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/media", h.SendMediaMessage)
+	req := httptest.NewRequest(http.MethodPost, "/media", body)
+	req.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// mediaForm builds a multipart upload of content as filename with mimeType
+func mediaForm(t *testing.T, fields map[string]string, filename, mimeType string, content []byte) (string, io.Reader) {
+	t.Helper()
+	var buf bytes.Buffer
+	form := multipart.NewWriter(&buf)
+	for k, v := range fields {
+		form.WriteField(k, v)
+	}
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", `form-data; name="file"; filename="`+filename+`"`)
+	header.Set("Content-Type", mimeType)
+	part, _ := form.CreatePart(header)
+	part.Write(content)
+	form.Close()
+	return form.FormDataContentType(), &buf
+}
+
+func TestWhatsAppMediaUpload(t *testing.T) {
+	h, graph := newTestMediaHandler(t)
+	pdf := []byte("%PDF-1.4 invoice")
+	contentType, body := mediaForm(t, map[string]string{"to": "15551234567", "caption": "Your invoice"}, "invoice-42.pdf", "application/pdf", pdf)
+
+	w := postMedia(h, contentType, body)
+	if w.Code != http.StatusOK {
+		t.Fatalf("upload = %d %s", w.Code, w.Body)
+	}
+	var resp map[string]string
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp["media_id"] != "media-1" || resp["wamid"] != "wamid.media" {
+		t.Errorf("response = %v", resp)
+	}
+
+	graph.mu.Lock()
+	defer graph.mu.Unlock()
+	if !bytes.Equal(graph.uploaded, pdf) || graph.mimeType != "application/pdf" {
+		t.Errorf("uploaded %q as %q", graph.uploaded, graph.mimeType)
+	}
+	doc, _ := graph.messages[0]["document"].(map[string]interface{})
+	if graph.messages[0]["type"] != "document" || doc["id"] != "media-1" || doc["filename"] != "invoice-42.pdf" || doc["caption"] != "Your invoice" {
+		t.Errorf("message = %v", graph.messages[0])
+	}
+}
+
+func TestWhatsAppMediaLink(t *testing.T) {
+	h, graph := newTestMediaHandler(t)
+
+	w := postMedia(h, "application/json", strings.NewReader(`{"to": "15551234567", "type": "image", "link": "https://example.com/qr.png"}`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("link = %d %s", w.Code, w.Body)
+	}
+	graph.mu.Lock()
+	defer graph.mu.Unlock()
+	if image, _ := graph.messages[0]["image"].(map[string]interface{}); image["link"] != "https://example.com/qr.png" {
+		t.Errorf("message = %v", graph.messages[0])
+	}
+}
+
+func TestWhatsAppMediaRejectsUnsupportedFiles(t *testing.T) {
+	h, graph := newTestMediaHandler(t)
+	tests := []struct {
+		name        string
+		contentType string
+		body        io.Reader
+	}{
+		{"gif", "", nil},
+		{"png as audio", "", nil},
+		{"http link", "application/json", strings.NewReader(`{"to": "15551234567", "type": "image", "link": "http://example.com/qr.png"}`)},
+		{"link without type", "application/json", strings.NewReader(`{"to": "15551234567", "link": "https://example.com/qr.png"}`)},
+	}
+	tests[0].contentType, tests[0].body = mediaForm(t, map[string]string{"to": "15551234567"}, "a.gif", "image/gif", []byte("GIF89a"))
+	tests[1].contentType, tests[1].body = mediaForm(t, map[string]string{"to": "15551234567", "type": "audio"}, "a.png", "image/png", []byte("png"))
+	for _, tt := range tests {
+		if w := postMedia(h, tt.contentType, tt.body); w.Code != http.StatusBadRequest {
+			t.Errorf("%s = %d %s, want 400", tt.name, w.Code, w.Body)
+		}
+	}
+	if len(graph.messages) != 0 || graph.uploaded != nil {
+		t.Error("rejected media reached the Graph API")
+	}
+}
+
+func TestValidateMediaSizes(t *testing.T) {
+	tests := []struct {
+		mediaType, mimeType string
+		size                int64
+		ok                  bool
+	}{
+		{"image", "image/jpeg", 5 << 20, true},
+		{"image", "image/jpeg", 5<<20 + 1, false},
+		{"audio", "audio/ogg", 16 << 20, true},
+		{"video", "video/mp4", 16<<20 + 1, false},
+		{"document", "application/pdf", 100 << 20, true},
+		{"document", "application/pdf", 100<<20 + 1, false},
+		{"document", "image/png", 10, false},
+		{"", "application/zip", 10, false},
+	}
+	for _, tt := range tests {
+		if msg := validateMedia(tt.mediaType, tt.mimeType, tt.size); (msg == "") != tt.ok {
+			t.Errorf("validateMedia(%s, %s, %d) = %q", tt.mediaType, tt.mimeType, tt.size, msg)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package gateapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/apierror"
+	"github.com/tracoco/DifyGate/history"
+)
+
+// ReplayedReply is a reply to a replayed message, sent or, in a dry run,
+// only captured
+type ReplayedReply struct {
+	// Type is text, or the media type of a file Dify attached
+	Type string `json:"type"`
+	// ID is the WhatsApp message ID; empty in a dry run
+	ID      string `json:"id,omitempty"`
+	Text    string `json:"text,omitempty"`
+	URL     string `json:"url,omitempty"`
+	Caption string `json:"caption,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// replaySender captures the replies to a replay, passing them on to next
+// unless the replay is a dry run
+type replaySender struct {
+	// next sends the replies; nil in a dry run
+	next ChannelSender
+
+	mu      sync.Mutex
+	replies []ReplayedReply
+}
+
+func (s *replaySender) add(r ReplayedReply, err error) {
+	if err != nil {
+		r.Error = err.Error()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.replies = append(s.replies, r)
+}
+
+// SendText captures a text reply
+func (s *replaySender) SendText(ctx context.Context, msg ChannelMessage, text string) (string, error) {
+	var id string
+	var err error
+	if s.next != nil {
+		id, err = s.next.SendText(ctx, msg, text)
+	}
+	s.add(ReplayedReply{Type: "text", ID: id, Text: text}, err)
+	return id, err
+}
+
+// SendTyping passes the typing indicator on, outside dry runs
+func (s *replaySender) SendTyping(ctx context.Context, msg ChannelMessage) error {
+	if s.next == nil {
+		return nil
+	}
+	return s.next.SendTyping(ctx, msg)
+}
+
+// SendMedia captures a file reply
+func (s *replaySender) SendMedia(ctx context.Context, msg ChannelMessage, media ChannelAttachment) error {
+	var err error
+	if s.next != nil {
+		err = s.next.SendMedia(ctx, msg, media)
+	}
+	s.add(ReplayedReply{Type: media.Type, URL: media.URL, Caption: media.Caption}, err)
+	return err
+}
+
+// ReplayWebhook handles POST /admin/whatsapp/replay: it runs a webhook
+// payload, or an inbound message from the history, through the webhook
+// processing again without a signature, answering it before responding.
+// dry_run=true captures the replies instead of sending them; dedup=true
+// remembers the message ID so Meta's redeliveries of it are dropped.
+func (h *WhatsAppHandler) ReplayWebhook(c *gin.Context) {
+	dryRun, err := strconv.ParseBool(c.DefaultQuery("dry_run", "false"))
+	if err != nil {
+		apierror.Respond(c, http.StatusBadRequest, apierror.InvalidRequest, "dry_run must be true or false")
+		return
+	}
+	dedup, err := strconv.ParseBool(c.DefaultQuery("dedup", "false"))
+	if err != nil {
+		apierror.Respond(c, http.StatusBadRequest, apierror.InvalidRequest, "dedup must be true or false")
+		return
+	}
+	reqLog := requestLogger(c, h.log).WithFields(logrus.Fields{"replay": true, "dry_run": dryRun})
+
+	var webhookRequest WebhookRequest
+	if id := c.Query("history_id"); id != "" {
+		webhookRequest, err = h.storedWebhook(id, c.DefaultQuery("phone_number_id", h.cfg.PhoneNumberID))
+		switch {
+		case errors.Is(err, errHistoryDisabled):
+			apierror.Respond(c, http.StatusNotFound, apierror.FeatureDisabled, "Message history is not enabled")
+			return
+		case errors.Is(err, history.ErrNotFound):
+			apierror.Respond(c, http.StatusNotFound, apierror.NotFound, "Message not found")
+			return
+		case err != nil:
+			apierror.Respond(c, http.StatusBadRequest, apierror.InvalidRequest, err.Error())
+			return
+		}
+	} else {
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			if isBodyTooLarge(err) {
+				abortBodyTooLarge(c)
+				return
+			}
+			apierror.Respond(c, http.StatusBadRequest, apierror.InvalidBody, "Failed to read request body")
+			return
+		}
+		if err := json.Unmarshal(body, &webhookRequest); err != nil {
+			apierror.Respond(c, http.StatusBadRequest, apierror.InvalidBody, "Failed to parse request body")
+			return
+		}
+	}
+
+	sender := &replaySender{}
+	if !dryRun {
+		sender.next = h.pipeline.sender
+	}
+	pipeline := h.pipeline.replaying(sender, dryRun)
+	var message *ChannelMessage
+	reqLog.Info("Replaying WhatsApp webhook")
+	outcome := h.processWebhook(reqLog, webhookRequest, func(log *logrus.Entry, msg ChannelMessage) {
+		if message == nil {
+			message = &msg
+		}
+		pipeline.Handle(log, msg)
+		if dedup {
+			h.pipeline.inbox.markSeen(log, msg.ReplyTo)
+		}
+	}, dryRun)
+
+	resp := gin.H{
+		"dry_run": dryRun,
+		"outcome": outcome,
+		"replies": sender.replies,
+	}
+	if message != nil {
+		resp["message"] = gin.H{
+			"id":              message.ReplyTo,
+			"from":            message.UserID,
+			"phone_number_id": message.ChannelID,
+			"text":            message.Text,
+		}
+	}
+	if sender.replies == nil {
+		resp["replies"] = []ReplayedReply{}
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// errHistoryDisabled is returned when a replay names a history record but
+// DIFYGATE_HISTORY_ENABLED is off
+var errHistoryDisabled = errors.New("message history is not enabled")
+
+// storedWebhook rebuilds the webhook of an inbound WhatsApp message from
+// its history record, as sent to phoneNumberID
+func (h *WhatsAppHandler) storedWebhook(id, phoneNumberID string) (WebhookRequest, error) {
+	var req WebhookRequest
+	if h.history == nil {
+		return req, errHistoryDisabled
+	}
+	rec, err := h.history.Get(id)
+	if err != nil {
+		return req, err
+	}
+	if rec.Channel != "whatsapp" || rec.Direction != history.Inbound {
+		return req, errors.New("only inbound WhatsApp messages can be replayed")
+	}
+
+	// The history keeps the text, not the payload; rebuild the part of it
+	// the webhook reads
+	payload := map[string]interface{}{"entry": []interface{}{map[string]interface{}{
+		"changes": []interface{}{map[string]interface{}{"value": map[string]interface{}{
+			"metadata": map[string]string{"phone_number_id": phoneNumberID},
+			"messages": []interface{}{map[string]interface{}{
+				"from": rec.UserID,
+				"id":   rec.ID,
+				"type": "text",
+				"text": map[string]string{"body": rec.Text},
+			}},
+		}}},
+	}}}
+	b, err := json.Marshal(payload)
+	if err == nil {
+		err = json.Unmarshal(b, &req)
+	}
+	return req, err
+}
@@ -0,0 +1,133 @@
+package gateapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tracoco/DifyGate/config"
+	"github.com/tracoco/DifyGate/history"
+	"github.com/tracoco/DifyGate/store"
+)
+
+const replayPayload = `{"entry": [{"changes": [{"value": {
+	"metadata": {"phone_number_id": "123"},
+	"messages": [{"from": "15551234567", "id": "wamid.replayed", "type": "text", "text": {"body": "hello again"}}]
+}}]}]}`
+
+type replayResult struct {
+	DryRun  bool            `json:"dry_run"`
+	Outcome string          `json:"outcome"`
+	Replies []ReplayedReply `json:"replies"`
+}
+
+func TestReplayWebhook(t *testing.T) {
+	graph, client := newFakeGraphAPI(t)
+	_, difyHandler := newFakeDify(t, func(req ChatMessageRequest) []StreamingChatResponse {
+		return difyAnswer("conv-1", "You said ", req.Query)
+	})
+	recorder, err := history.New(config.HistoryConfig{Enabled: true, Retention: time.Hour, PruneInterval: time.Hour}, quietLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(recorder.Close)
+	kv := store.New("", quietLogger())
+	h := NewWhatsAppHandler(config.WhatsAppConfig{PhoneNumberID: "123"}, config.ChatConfig{DurableInbox: true},
+		config.DifyConfig{StreamTimeout: 5 * time.Second}, &HTTPClients{}, difyHandler,
+		NewMessages(config.MessagesConfig{}), kv, nil, recorder, quietLogger())
+	h.client = client
+	h.pipeline.sender = &whatsAppSender{client: client}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/replay", h.ReplayWebhook)
+	replay := func(t *testing.T, query, body string) replayResult {
+		t.Helper()
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/replay?"+query, strings.NewReader(body)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", w.Code, w.Body)
+		}
+		var res replayResult
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	seen := func() bool {
+		_, err := kv.Get("inbox-seen:whatsapp:wamid.replayed")
+		return err == nil
+	}
+	// sent lists the texts sent, leaving out read receipts
+	sent := func() []string {
+		graph.mu.Lock()
+		defer graph.mu.Unlock()
+		var texts []string
+		for _, b := range graph.bodies {
+			if b != "" {
+				texts = append(texts, b)
+			}
+		}
+		return texts
+	}
+
+	t.Run("dry run", func(t *testing.T) {
+		res := replay(t, "dry_run=true", replayPayload)
+		if !res.DryRun || res.Outcome != webhookAnswered || len(res.Replies) != 1 || res.Replies[0].Text != "You said hello again" || res.Replies[0].ID != "" {
+			t.Errorf("replay = %+v, want the unsent echo", res)
+		}
+		if got := sent(); len(got) != 0 {
+			t.Errorf("dry run sent %q", got)
+		}
+		if _, err := recorder.Get("wamid.replayed"); err == nil {
+			t.Error("dry run recorded the message in the history")
+		}
+		if seen() {
+			t.Error("dry run marked the message as seen")
+		}
+	})
+
+	t.Run("live", func(t *testing.T) {
+		res := replay(t, "", replayPayload)
+		if res.DryRun || len(res.Replies) != 1 || res.Replies[0].ID != "wamid.test" {
+			t.Errorf("replay = %+v, want the echo sent", res)
+		}
+		if got := sent(); len(got) == 0 || got[0] != "You said hello again" {
+			t.Errorf("sent %q, want the echo", got)
+		}
+		if seen() {
+			t.Error("replay marked the message as seen without dedup")
+		}
+	})
+
+	t.Run("from history with dedup", func(t *testing.T) {
+		// The live replay recorded the message in the background
+		for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+			if _, err := recorder.Get("wamid.replayed"); err == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("replayed message never reached the history")
+			}
+		}
+		res := replay(t, "history_id=wamid.replayed&dry_run=true&dedup=true", "")
+		if res.Outcome != webhookAnswered || len(res.Replies) != 1 || res.Replies[0].Text != "You said hello again" {
+			t.Errorf("replay = %+v, want the echo of the stored text", res)
+		}
+		if !seen() {
+			t.Error("dedup didn't mark the message as seen")
+		}
+	})
+
+	t.Run("unknown history record", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/replay?history_id=wamid.unknown", nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("status %d, want 404", w.Code)
+		}
+	})
+}
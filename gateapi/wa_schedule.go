@@ -0,0 +1,525 @@
+package gateapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/apierror"
+	"github.com/tracoco/DifyGate/config"
+	"github.com/tracoco/DifyGate/history"
+	"github.com/tracoco/DifyGate/metrics"
+	"github.com/tracoco/DifyGate/phone"
+	"github.com/tracoco/DifyGate/store"
+)
+
+// scheduledMessages counts scheduled messages by outcome: sent, failed,
+// retried or cancelled
+var scheduledMessages = metrics.NewCounter("difygate_scheduled_messages_total",
+	"Scheduled WhatsApp messages, by outcome", "outcome")
+
+const (
+	// scheduleRetryDelay is the wait before trying a message again, doubled
+	// for each later attempt
+	scheduleRetryDelay = 30 * time.Second
+	// scheduleStaleAfter is how long a message may stay sending before it
+	// is taken for abandoned by a stopped gateway and sent again
+	scheduleStaleAfter = time.Minute
+	// whatsAppWindow is how long after a user's last message they may be
+	// sent free-form text
+	whatsAppWindow = 24 * time.Hour
+)
+
+// Scheduled message statuses
+const (
+	schedulePending   = "pending"
+	scheduleSending   = "sending"
+	scheduleSent      = "sent"
+	scheduleFailed    = "failed"
+	scheduleCancelled = "cancelled"
+)
+
+// ScheduleRequest is a proactive WhatsApp message to send later; exactly
+// one of Text and Template is set
+type ScheduleRequest struct {
+	WhatsAppSendRequest
+	// SendAt is when to send the message, in RFC 3339
+	SendAt time.Time `json:"send_at" binding:"required"`
+}
+
+// ScheduledMessage is a message waiting to be sent, or what became of it
+type ScheduledMessage struct {
+	ID            string            `json:"id"`
+	Status        string            `json:"status"`
+	PhoneNumberID string            `json:"phone_number_id"`
+	To            string            `json:"to"`
+	Text          string            `json:"text,omitempty"`
+	Template      *WhatsAppTemplate `json:"template,omitempty"`
+	PreviewURL    *bool             `json:"preview_url,omitempty"`
+	SendAt        time.Time         `json:"send_at"`
+	CreatedAt     time.Time         `json:"created_at"`
+	// UpdatedAt is when the message last changed; a message sending is
+	// taken for abandoned once it is scheduleStaleAfter old
+	UpdatedAt time.Time `json:"updated_at"`
+	// Attempts counts the tries so far, and NextAttemptAt is when the next
+	// is due after a failed one
+	Attempts      int        `json:"attempts"`
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"`
+	SentAt        *time.Time `json:"sent_at,omitempty"`
+	WAMID         string     `json:"wamid,omitempty"`
+	Error         string     `json:"error,omitempty"`
+}
+
+// finished reports whether the message will not be sent (again)
+func (m *ScheduledMessage) finished() bool {
+	return m.Status == scheduleSent || m.Status == scheduleFailed || m.Status == scheduleCancelled
+}
+
+// due reports whether the message should be tried now
+func (m *ScheduledMessage) due(now time.Time) bool {
+	switch m.Status {
+	case schedulePending:
+		if m.NextAttemptAt != nil {
+			return !now.Before(*m.NextAttemptAt)
+		}
+		return !now.Before(m.SendAt)
+	case scheduleSending:
+		return now.Sub(m.UpdatedAt) >= scheduleStaleAfter
+	}
+	return false
+}
+
+// scheduleKey is the store key of a scheduled message
+func scheduleKey(id string) string {
+	return "whatsapp:schedule:" + id
+}
+
+// lastInboundKey is the store key holding when a user last wrote to a
+// business number, kept for as long as the 24-hour window is open
+func lastInboundKey(phoneNumberID, userID string) string {
+	return "whatsapp:last-inbound:" + phoneNumberID + ":" + userID
+}
+
+// noteInbound records that the user wrote to the business number, opening
+// the 24-hour window for free-form messages
+func (h *WhatsAppHandler) noteInbound(log *logrus.Entry, phoneNumberID, userID string) {
+	now := time.Now().UTC().Format(time.RFC3339)
+	if err := h.store.Set(lastInboundKey(phoneNumberID, userID), []byte(now), whatsAppWindow); err != nil {
+		log.WithError(err).Warn("Failed to record the user's last message")
+	}
+}
+
+// windowClosesAt returns when the user's 24-hour window on the business
+// number closes, and false when they haven't written within it
+func (h *WhatsAppHandler) windowClosesAt(phoneNumberID, userID string) (time.Time, bool, error) {
+	raw, err := h.store.Get(lastInboundKey(phoneNumberID, userID))
+	if errors.Is(err, store.ErrNotFound) {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	last, err := time.Parse(time.RFC3339, string(raw))
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return last.Add(whatsAppWindow), true, nil
+}
+
+// scheduler sends scheduled WhatsApp messages when they are due. One
+// goroutine scans the store every DIFYGATE_SCHEDULE_INTERVAL, so messages
+// outlive a restart when the store is Redis, and each due message is
+// claimed so only one instance sends it.
+type scheduler struct {
+	cfg config.ScheduleConfig
+	// h sends the messages and keeps the state
+	h *WhatsAppHandler
+	// mu orders the updates of this instance, e.g. a cancel and a send
+	mu    sync.Mutex
+	start sync.Once
+}
+
+func newScheduler(cfg config.ScheduleConfig, h *WhatsAppHandler) *scheduler {
+	return &scheduler{cfg: cfg, h: h}
+}
+
+// load returns the scheduled message id, or store.ErrNotFound
+func (s *scheduler) load(id string) (*ScheduledMessage, error) {
+	raw, err := s.h.store.Get(scheduleKey(id))
+	if err != nil {
+		return nil, err
+	}
+	var m ScheduledMessage
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// save stores m until DIFYGATE_SCHEDULE_RETENTION after it is sent, or
+// after it is due while it waits
+func (s *scheduler) save(m *ScheduledMessage) error {
+	m.UpdatedAt = time.Now().UTC()
+	raw, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	ttl := s.cfg.Retention
+	if !m.finished() {
+		ttl += time.Until(m.SendAt)
+	}
+	return s.h.store.Set(scheduleKey(m.ID), raw, ttl)
+}
+
+// update applies change to the stored message and saves it, unless the
+// message has finished meanwhile; it returns the message as stored and
+// whether it was changed
+func (s *scheduler) update(id string, change func(*ScheduledMessage)) (*ScheduledMessage, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, err := s.load(id)
+	if err != nil {
+		return nil, false, err
+	}
+	if m.finished() {
+		return m, false, nil
+	}
+	change(m)
+	return m, true, s.save(m)
+}
+
+// list returns the scheduled messages, soonest first
+func (s *scheduler) list() ([]*ScheduledMessage, error) {
+	keys, err := s.h.store.Keys(scheduleKey("*"))
+	if err != nil {
+		return nil, err
+	}
+	messages := make([]*ScheduledMessage, 0, len(keys))
+	for _, key := range keys {
+		m, err := s.load(strings.TrimPrefix(key, scheduleKey("")))
+		if errors.Is(err, store.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+	sort.Slice(messages, func(i, j int) bool { return messages[i].SendAt.Before(messages[j].SendAt) })
+	return messages, nil
+}
+
+// erase cancels the messages to number that are waiting to be sent and
+// deletes every message to it, returning the store keys removed
+func (s *scheduler) erase(log *logrus.Entry, number string) ([]string, error) {
+	if s == nil {
+		return nil, nil
+	}
+	messages, err := s.list()
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var deleted []string
+	var errs []error
+	for _, m := range messages {
+		// Messages scheduled before numbers were normalized may not be
+		if phone.Lenient(m.To) != number {
+			continue
+		}
+		// Read again, now that no send on this instance can start it
+		current, err := s.load(m.ID)
+		if errors.Is(err, store.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err := s.h.store.Delete(scheduleKey(m.ID)); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if current.Status == schedulePending {
+			scheduledMessages.Inc(scheduleCancelled)
+			log.WithField("schedule_id", m.ID).Info("Scheduled WhatsApp message cancelled")
+		}
+		deleted = append(deleted, scheduleKey(m.ID))
+	}
+	return deleted, errors.Join(errs...)
+}
+
+// resume starts sending the messages due, at once and then every
+// DIFYGATE_SCHEDULE_INTERVAL
+func (s *scheduler) resume(log *logrus.Logger) {
+	s.start.Do(func() {
+		go func() {
+			s.dispatch(log)
+			ticker := time.NewTicker(s.cfg.Interval)
+			defer ticker.Stop()
+			for range ticker.C {
+				s.dispatch(log)
+			}
+		}()
+	})
+}
+
+// dispatch sends the messages due, one at a time. The claim is keyed by
+// the attempt, so one instance makes each.
+func (s *scheduler) dispatch(log *logrus.Logger) {
+	messages, err := s.list()
+	if err != nil {
+		log.WithError(err).Warn("Failed to list scheduled WhatsApp messages")
+		return
+	}
+	now := time.Now()
+	for _, m := range messages {
+		if !m.due(now) {
+			continue
+		}
+		claim := "whatsapp:schedule-claim:" + m.ID + ":" + strconv.Itoa(m.Attempts)
+		if n, err := s.h.store.Incr(claim, scheduleStaleAfter); err != nil || n != 1 {
+			continue
+		}
+		entry := logrus.NewEntry(log).WithFields(logrus.Fields{"schedule_id": m.ID, "phone_number_id": m.PhoneNumberID, "to": m.To})
+		if m.Status == scheduleSending {
+			entry.Warn("Sending scheduled message left unfinished again")
+		}
+		s.send(entry, m.ID)
+	}
+}
+
+// send makes one attempt at the message id, unless it was cancelled
+// meanwhile. Throttling and failures of Meta or the network are tried
+// again later, up to DIFYGATE_SCHEDULE_MAX_ATTEMPTS; a refused message
+// fails at once.
+func (s *scheduler) send(log *logrus.Entry, id string) {
+	m, ok, err := s.update(id, func(m *ScheduledMessage) {
+		m.Status = scheduleSending
+		m.Attempts++
+	})
+	if errors.Is(err, store.ErrNotFound) {
+		// Deleted with the user's data
+		return
+	}
+	if err != nil {
+		log.WithError(err).Error("Failed to claim scheduled message")
+		return
+	}
+	if !ok {
+		return
+	}
+
+	var payload map[string]interface{}
+	var recorded string
+	if m.Template != nil {
+		payload, recorded = templatePayload(m.To, *m.Template), "[template "+m.Template.Name+"]"
+	} else {
+		previewURL := s.h.client.linkPreviews
+		if m.PreviewURL != nil {
+			previewURL = *m.PreviewURL
+		}
+		payload, recorded = textPayload(m.To, m.Text, "", previewURL), m.Text
+	}
+	ctx, cancel := context.WithTimeout(withLogger(context.Background(), log), broadcastSendTimeout)
+	wamid, sendErr := s.h.client.send(ctx, m.PhoneNumberID, payload)
+	cancel()
+
+	retry := sendErr != nil && m.Attempts < s.cfg.MaxAttempts && scheduleRetryable(sendErr)
+	_, _, err = s.update(id, func(m *ScheduledMessage) {
+		now := time.Now().UTC()
+		switch {
+		case sendErr == nil:
+			m.Status, m.SentAt, m.WAMID, m.Error, m.NextAttemptAt = scheduleSent, &now, wamid, "", nil
+		case retry:
+			next := now.Add(scheduleRetryDelay << (m.Attempts - 1))
+			m.Status, m.Error, m.NextAttemptAt = schedulePending, sendErr.Error(), &next
+		default:
+			m.Status, m.Error, m.NextAttemptAt = scheduleFailed, sendErr.Error(), nil
+		}
+	})
+	if err != nil {
+		log.WithError(err).Error("Failed to save scheduled message")
+	}
+
+	log = log.WithField("attempt", m.Attempts)
+	switch {
+	case sendErr == nil:
+		scheduledMessages.Inc(scheduleSent)
+		log.WithField("wamid", wamid).Info("Scheduled WhatsApp message sent")
+	case retry:
+		scheduledMessages.Inc("retried")
+		log.WithError(sendErr).Warn("Failed to send scheduled WhatsApp message, trying again later")
+		return
+	default:
+		scheduledMessages.Inc(scheduleFailed)
+		log.WithError(sendErr).Error("Failed to send scheduled WhatsApp message")
+	}
+
+	rec := history.Record{
+		ID:        wamid,
+		Channel:   "whatsapp",
+		UserID:    m.To,
+		Direction: history.Outbound,
+		Text:      recorded,
+		Status:    history.StatusSent,
+	}
+	if sendErr != nil {
+		rec.Status, rec.Error = history.StatusFailed, sendErr.Error()
+	}
+	s.h.history.Record(rec)
+}
+
+// scheduleRetryable reports whether a failed send may succeed later: when
+// WhatsApp throttles, Meta fails or can't be reached
+func scheduleRetryable(err error) bool {
+	var apiErr *WhatsAppAPIError
+	if !errors.As(err, &apiErr) {
+		return true
+	}
+	return apiErr.RateLimited() || apiErr.Status >= 500
+}
+
+// ScheduleMessage handles POST /whatsapp/schedule: it checks the message
+// and saves it to be sent at send_at, answering 201 with it. Text is
+// refused when the user's 24-hour window will have closed by then.
+func (h *WhatsAppHandler) ScheduleMessage(c *gin.Context) {
+	reqLog := requestLogger(c, h.log)
+	s := h.schedule
+
+	var req ScheduleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apierror.RespondBinding(c, err)
+		return
+	}
+	to, phoneNumberID, ok := h.sendTarget(c, req.To, req.PhoneNumberID)
+	if !ok {
+		return
+	}
+	now := time.Now()
+	switch {
+	case (req.Text == "") == (req.Template == nil):
+		apierror.Respond(c, http.StatusBadRequest, apierror.InvalidRequest, "Exactly one of text and template is required")
+		return
+	case utf8.RuneCountInString(req.Text) > whatsAppMaxSendLength:
+		apierror.Respond(c, http.StatusBadRequest, apierror.InvalidRequest, "text must be at most 4096 characters")
+		return
+	case req.Template != nil && (req.Template.Name == "" || req.Template.Language == ""):
+		apierror.Respond(c, http.StatusBadRequest, apierror.InvalidRequest, "template needs a name and a language")
+		return
+	case req.SendAt.Before(now.Add(-time.Minute)):
+		apierror.Respond(c, http.StatusBadRequest, apierror.InvalidRequest, "send_at must not be in the past")
+		return
+	case req.SendAt.After(now.Add(s.cfg.MaxAhead)):
+		apierror.Respond(c, http.StatusBadRequest, apierror.InvalidRequest, fmt.Sprintf("send_at must be within %s", s.cfg.MaxAhead))
+		return
+	}
+
+	if req.Text != "" {
+		closes, open, err := h.windowClosesAt(phoneNumberID, to)
+		if err != nil {
+			reqLog.WithError(err).Error("Failed to look up the user's last message")
+			apierror.Respond(c, http.StatusInternalServerError, apierror.Internal, "Failed to look up the user's last message")
+			return
+		}
+		if !open || req.SendAt.After(closes) {
+			apierror.Respond(c, http.StatusUnprocessableEntity, apierror.WhatsAppWindowClosed,
+				"The user's 24-hour window will have closed by send_at; schedule a template instead")
+			return
+		}
+	}
+
+	created := time.Now().UTC()
+	m := &ScheduledMessage{
+		ID:            newRequestID(),
+		Status:        schedulePending,
+		PhoneNumberID: phoneNumberID,
+		To:            to,
+		Text:          req.Text,
+		Template:      req.Template,
+		PreviewURL:    req.PreviewURL,
+		SendAt:        req.SendAt.UTC(),
+		CreatedAt:     created,
+	}
+	if err := s.save(m); err != nil {
+		reqLog.WithError(err).Error("Failed to save scheduled message")
+		apierror.Respond(c, http.StatusInternalServerError, apierror.Internal, "Failed to save the scheduled message")
+		return
+	}
+	reqLog.WithFields(logrus.Fields{"schedule_id": m.ID, "to": to, "send_at": m.SendAt}).Info("WhatsApp message scheduled")
+	c.JSON(http.StatusCreated, m)
+}
+
+// ListScheduled handles GET /whatsapp/schedule, listing the scheduled
+// messages soonest first, optionally only those to a number or with a
+// status
+func (h *WhatsAppHandler) ListScheduled(c *gin.Context) {
+	messages, err := h.schedule.list()
+	if err != nil {
+		requestLogger(c, h.log).WithError(err).Error("Failed to list scheduled messages")
+		apierror.Respond(c, http.StatusInternalServerError, apierror.Internal, "Failed to list the scheduled messages")
+		return
+	}
+	to, status := phone.Lenient(c.Query("to")), c.Query("status")
+	matching := make([]*ScheduledMessage, 0, len(messages))
+	for _, m := range messages {
+		// Messages scheduled before numbers were normalized may not be
+		if (to == "" || phone.Lenient(m.To) == to) && (status == "" || m.Status == status) {
+			matching = append(matching, m)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"messages": matching})
+}
+
+// GetScheduled handles GET /whatsapp/schedule/:id
+func (h *WhatsAppHandler) GetScheduled(c *gin.Context) {
+	m, err := h.schedule.load(c.Param("id"))
+	if errors.Is(err, store.ErrNotFound) {
+		apierror.Respond(c, http.StatusNotFound, apierror.NotFound, "Scheduled message not found")
+		return
+	}
+	if err != nil {
+		requestLogger(c, h.log).WithError(err).Error("Failed to load scheduled message")
+		apierror.Respond(c, http.StatusInternalServerError, apierror.Internal, "Failed to load the scheduled message")
+		return
+	}
+	c.JSON(http.StatusOK, m)
+}
+
+// CancelScheduled handles DELETE /whatsapp/schedule/:id: a message waiting
+// to be sent never is. A message being sent, sent, failed or cancelled is
+// returned as it is.
+func (h *WhatsAppHandler) CancelScheduled(c *gin.Context) {
+	reqLog := requestLogger(c, h.log)
+	cancelled := false
+	m, _, err := h.schedule.update(c.Param("id"), func(m *ScheduledMessage) {
+		if m.Status == schedulePending {
+			m.Status, m.NextAttemptAt, cancelled = scheduleCancelled, nil, true
+		}
+	})
+	if errors.Is(err, store.ErrNotFound) {
+		apierror.Respond(c, http.StatusNotFound, apierror.NotFound, "Scheduled message not found")
+		return
+	}
+	if err != nil {
+		reqLog.WithError(err).Error("Failed to cancel scheduled message")
+		apierror.Respond(c, http.StatusInternalServerError, apierror.Internal, "Failed to cancel the scheduled message")
+		return
+	}
+	if cancelled {
+		scheduledMessages.Inc(scheduleCancelled)
+		reqLog.WithField("schedule_id", m.ID).Info("Scheduled WhatsApp message cancelled")
+	}
+	c.JSON(http.StatusOK, m)
+}
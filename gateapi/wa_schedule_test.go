@@ -0,0 +1,128 @@
+package gateapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tracoco/DifyGate/config"
+)
+
+func TestScheduledMessages(t *testing.T) {
+	h, graph := newTestWhatsAppHandler(t)
+	h.cfg.PhoneNumberID = "123"
+	h.schedule = newScheduler(config.ScheduleConfig{Interval: time.Hour, MaxAhead: 72 * time.Hour, MaxAttempts: 3, Retention: time.Hour}, h)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/schedule", h.ScheduleMessage)
+	r.GET("/schedule", h.ListScheduled)
+	r.DELETE("/schedule/:id", h.CancelScheduled)
+	call := func(method, path, body string) (*httptest.ResponseRecorder, ScheduledMessage) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		var m ScheduledMessage
+		json.Unmarshal(w.Body.Bytes(), &m)
+		return w, m
+	}
+	at := func(d time.Duration) string { return time.Now().Add(d).Format(time.RFC3339) }
+
+	for _, tc := range []struct {
+		body string
+		want int
+	}{
+		{`{"to": "15550000001", "text": "hi"}`, http.StatusBadRequest},
+		{`{"to": "15550000001", "text": "hi", "send_at": "` + at(-time.Hour) + `"}`, http.StatusBadRequest},
+		{`{"to": "15550000001", "text": "hi", "send_at": "` + at(100*time.Hour) + `"}`, http.StatusBadRequest},
+		// The user never wrote, so only a template may be sent
+		{`{"to": "15550000001", "text": "hi", "send_at": "` + at(time.Hour) + `"}`, http.StatusUnprocessableEntity},
+	} {
+		if w, _ := call(http.MethodPost, "/schedule", tc.body); w.Code != tc.want {
+			t.Errorf("%s: status %d, want %d: %s", tc.body, w.Code, tc.want, w.Body)
+		}
+	}
+
+	h.noteInbound(testEntry(), "123", "15550000001")
+	if w, _ := call(http.MethodPost, "/schedule", `{"to": "15550000001", "text": "hi", "send_at": "`+at(25*time.Hour)+`"}`); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("text after the window closes: status %d, want 422", w.Code)
+	}
+	w, now := call(http.MethodPost, "/schedule", `{"to": "+15550000001", "text": "Your table is ready", "send_at": "`+at(0)+`"}`)
+	if w.Code != http.StatusCreated || now.Status != schedulePending {
+		t.Fatalf("text within the window: status %d: %s", w.Code, w.Body)
+	}
+	_, later := call(http.MethodPost, "/schedule", `{"to": "15550000002", "template": {"name": "reminder", "language": "en"}, "send_at": "`+at(48*time.Hour)+`"}`)
+	_, cancelled := call(http.MethodPost, "/schedule", `{"to": "15550000003", "template": {"name": "reminder", "language": "en"}, "send_at": "`+at(0)+`"}`)
+	if _, m := call(http.MethodDelete, "/schedule/"+cancelled.ID, ""); m.Status != scheduleCancelled {
+		t.Errorf("cancelled message is %s", m.Status)
+	}
+
+	h.schedule.dispatch(quietLogger())
+	graph.mu.Lock()
+	if len(graph.bodies) != 1 || graph.bodies[0] != "Your table is ready" {
+		t.Errorf("sent %q, want only the message due", graph.bodies)
+	}
+	graph.mu.Unlock()
+	if m, _ := h.schedule.load(now.ID); m.Status != scheduleSent || m.WAMID != "wamid.test" || m.Attempts != 1 {
+		t.Errorf("due message %+v, want sent", m)
+	}
+	if _, m := call(http.MethodDelete, "/schedule/"+now.ID, ""); m.Status != scheduleSent {
+		t.Errorf("cancelling a sent message made it %s", m.Status)
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/schedule?status=pending", nil))
+	var list struct {
+		Messages []ScheduledMessage `json:"messages"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &list)
+	if len(list.Messages) != 1 || list.Messages[0].ID != later.ID {
+		t.Errorf("pending messages %+v, want the one in two days", list.Messages)
+	}
+}
+
+func TestScheduledMessagesRetry(t *testing.T) {
+	h, _ := newTestWhatsAppHandler(t)
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`{"error": {"message": "Service unavailable", "code": 2}}`))
+			return
+		}
+		w.Write([]byte(`{"messages":[{"id":"wamid.retried"}]}`))
+	}))
+	t.Cleanup(srv.Close)
+	h.client = NewWhatsAppClient(config.WhatsAppConfig{GraphAPIToken: "token", GraphAPIBaseURL: srv.URL, APIVersion: "v22.0"}, srv.Client())
+	h.schedule = newScheduler(config.ScheduleConfig{Interval: time.Hour, MaxAhead: time.Hour, MaxAttempts: 3, Retention: time.Hour}, h)
+
+	m := &ScheduledMessage{ID: "retry", Status: schedulePending, PhoneNumberID: "123", To: "15550000001",
+		Template: &WhatsAppTemplate{Name: "reminder", Language: "en"}, SendAt: time.Now()}
+	if err := h.schedule.save(m); err != nil {
+		t.Fatal(err)
+	}
+	h.schedule.dispatch(quietLogger())
+	m, _ = h.schedule.load("retry")
+	if m.Status != schedulePending || m.Attempts != 1 || m.NextAttemptAt == nil || m.Error == "" {
+		t.Fatalf("after a 503: %+v, want pending with a next attempt", m)
+	}
+	// Not due again until the next attempt
+	h.schedule.dispatch(quietLogger())
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Fatalf("tried %d times before the next attempt, want 1", got)
+	}
+
+	past := time.Now().Add(-time.Second)
+	m.NextAttemptAt = &past
+	if err := h.schedule.save(m); err != nil {
+		t.Fatal(err)
+	}
+	h.schedule.dispatch(quietLogger())
+	if m, _ = h.schedule.load("retry"); m.Status != scheduleSent || m.Attempts != 2 || m.WAMID != "wamid.retried" {
+		t.Errorf("after the retry: %+v, want sent", m)
+	}
+}
@@ -0,0 +1,177 @@
+package gateapi
+
+import (
+	"errors"
+	"net/http"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/apierror"
+	"github.com/tracoco/DifyGate/history"
+)
+
+// whatsAppMaxSendLength is the Cloud API's limit on a text message body
+const whatsAppMaxSendLength = 4096
+
+// WhatsAppSendRequest is a proactive WhatsApp message from a backend system;
+// exactly one of Text and Template is set
+type WhatsAppSendRequest struct {
+	// PhoneNumberID is the business number to send from; empty uses
+	// DIFYGATE_WHATSAPP_PHONE_NUMBER_ID
+	PhoneNumberID string `json:"phone_number_id"`
+	// To is the user's number in international format
+	To       string            `json:"to" binding:"required"`
+	Text     string            `json:"text"`
+	Template *WhatsAppTemplate `json:"template"`
+	// PreviewURL overrides DIFYGATE_WHATSAPP_LINK_PREVIEWS for a text
+	PreviewURL *bool `json:"preview_url"`
+}
+
+// WhatsAppTemplate is an approved message template, the only kind of
+// message a user who hasn't written in 24 hours can be sent
+type WhatsAppTemplate struct {
+	Name string `json:"name"`
+	// Language is the template's language code, e.g. en_US
+	Language string `json:"language"`
+	// Components fill the template's parameters, passed to the Graph API
+	// as they are
+	Components []interface{} `json:"components,omitempty"`
+}
+
+// SendMessage sends a text or template message to a WhatsApp user and
+// returns its wamid, or the Graph API's error
+func (h *WhatsAppHandler) SendMessage(c *gin.Context) {
+	reqLog := requestLogger(c, h.log)
+
+	var req WhatsAppSendRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apierror.RespondBinding(c, err)
+		return
+	}
+	to, phoneNumberID, ok := h.sendTarget(c, req.To, req.PhoneNumberID)
+	if !ok {
+		return
+	}
+
+	var payload map[string]interface{}
+	var recorded string
+	switch {
+	case (req.Text == "") == (req.Template == nil):
+		apierror.Respond(c, http.StatusBadRequest, apierror.InvalidRequest, "Exactly one of text and template is required")
+		return
+	case req.Text != "":
+		if utf8.RuneCountInString(req.Text) > whatsAppMaxSendLength {
+			apierror.Respond(c, http.StatusBadRequest, apierror.InvalidRequest, "text must be at most 4096 characters")
+			return
+		}
+		previewURL := h.client.linkPreviews
+		if req.PreviewURL != nil {
+			previewURL = *req.PreviewURL
+		}
+		payload = textPayload(to, req.Text, "", previewURL)
+		recorded = req.Text
+	default:
+		if req.Template.Name == "" || req.Template.Language == "" {
+			apierror.Respond(c, http.StatusBadRequest, apierror.InvalidRequest, "template needs a name and a language")
+			return
+		}
+		payload = templatePayload(to, *req.Template)
+		recorded = "[template " + req.Template.Name + "]"
+	}
+
+	log := reqLog.WithFields(logrus.Fields{"phone_number_id": phoneNumberID, "to": to})
+	wamid, err := h.client.send(withLogger(c.Request.Context(), log), phoneNumberID, payload)
+	rec := history.Record{
+		ID:        wamid,
+		Channel:   "whatsapp",
+		UserID:    to,
+		Direction: history.Outbound,
+		Text:      recorded,
+		Status:    history.StatusSent,
+	}
+	if err != nil {
+		rec.Status, rec.Error = history.StatusFailed, err.Error()
+		h.history.Record(rec)
+		log.WithError(err).Warn("Failed to send proactive WhatsApp message")
+		whatsAppSendErrorResponse(c, err)
+		return
+	}
+	h.history.Record(rec)
+	log.WithField("wamid", wamid).Info("Proactive WhatsApp message sent")
+	c.JSON(http.StatusOK, gin.H{"wamid": wamid})
+}
+
+// sendTarget checks the recipient and business number of a proactive
+// message, defaulting the number to DIFYGATE_WHATSAPP_PHONE_NUMBER_ID; it
+// answers 400 and returns false when either is unusable
+func (h *WhatsAppHandler) sendTarget(c *gin.Context, to, phoneNumberID string) (string, string, bool) {
+	to, ok := apiNumber(c, "to", to)
+	if !ok {
+		return "", "", false
+	}
+	phoneNumberID, ok = h.sendFrom(c, phoneNumberID)
+	return to, phoneNumberID, ok
+}
+
+// sendFrom checks the business number a proactive message is sent from,
+// defaulting it to DIFYGATE_WHATSAPP_PHONE_NUMBER_ID; it answers 400 and
+// returns false when it is unusable
+func (h *WhatsAppHandler) sendFrom(c *gin.Context, phoneNumberID string) (string, bool) {
+	if phoneNumberID == "" {
+		phoneNumberID = h.cfg.PhoneNumberID
+	}
+	if phoneNumberID == "" || !h.cfg.ServesPhoneNumber(phoneNumberID) {
+		apierror.Respond(c, http.StatusBadRequest, apierror.InvalidRequest, "phone_number_id must be a business number this gateway serves")
+		return "", false
+	}
+	return phoneNumberID, true
+}
+
+// templatePayload builds the Cloud API payload for a template message
+func templatePayload(to string, tmpl WhatsAppTemplate) map[string]interface{} {
+	template := map[string]interface{}{
+		"name":     tmpl.Name,
+		"language": map[string]string{"code": tmpl.Language},
+	}
+	if len(tmpl.Components) > 0 {
+		template["components"] = tmpl.Components
+	}
+	return map[string]interface{}{
+		"messaging_product": "whatsapp",
+		"recipient_type":    "individual",
+		"to":                to,
+		"type":              "template",
+		"template":          template,
+	}
+}
+
+// whatsAppSendErrorResponse answers a caller whose message the Graph API
+// refused, passing Meta's code and details through so callers can tell a
+// closed 24-hour window from a bad number
+func whatsAppSendErrorResponse(c *gin.Context, err error) {
+	var apiErr *WhatsAppAPIError
+	if !errors.As(err, &apiErr) {
+		apierror.Respond(c, http.StatusBadGateway, apierror.WhatsAppUnreachable, "Failed to reach the WhatsApp API")
+		return
+	}
+	details := map[string]interface{}{"whatsapp_code": apiErr.Code}
+	if apiErr.Details != "" {
+		details["whatsapp_details"] = apiErr.Details
+	}
+	if apiErr.FBTraceID != "" {
+		details["fbtrace_id"] = apiErr.FBTraceID
+	}
+	switch {
+	case apiErr.OutsideWindow():
+		apierror.RespondWithDetails(c, http.StatusUnprocessableEntity, apierror.WhatsAppWindowClosed,
+			"The user hasn't written in the last 24 hours; send a template instead", details)
+	case apiErr.RateLimited():
+		apierror.RespondWithDetails(c, http.StatusTooManyRequests, apierror.WhatsAppRateLimited, apiErr.Message, details)
+	case apiErr.Status == http.StatusUnauthorized || apiErr.Status == http.StatusForbidden || apiErr.Status >= 500:
+		// The gateway's token or Meta is at fault, not the request
+		apierror.RespondWithDetails(c, http.StatusBadGateway, apierror.WhatsAppError, apiErr.Message, details)
+	default:
+		apierror.RespondWithDetails(c, http.StatusUnprocessableEntity, apierror.WhatsAppError, apiErr.Message, details)
+	}
+}
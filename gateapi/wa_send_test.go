@@ -0,0 +1,142 @@
+package gateapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tracoco/DifyGate/apierror"
+	"github.com/tracoco/DifyGate/config"
+)
+
+// postWhatsAppSend posts body to the send endpoint of h
+func postWhatsAppSend(h *WhatsAppHandler, body string) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/send", h.SendMessage)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/send", strings.NewReader(body)))
+	return w
+}
+
+func TestWhatsAppSendMessage(t *testing.T) {
+	h, graph := newTestWhatsAppHandler(t)
+	h.cfg.PhoneNumberID = "555"
+
+	w := postWhatsAppSend(h, `{"to": "+15551234567", "text": "Your report is ready: https://example.com/r/1", "preview_url": false}`)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"wamid":"wamid.test"`) {
+		t.Fatalf("text send = %d %s", w.Code, w.Body)
+	}
+	w = postWhatsAppSend(h, `{"to": "15551234567", "template": {"name": "report_ready", "language": "en_US"}}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("template send = %d %s", w.Code, w.Body)
+	}
+
+	graph.mu.Lock()
+	defer graph.mu.Unlock()
+	var text, tmpl map[string]interface{}
+	json.Unmarshal(graph.payloads[0], &text)
+	json.Unmarshal(graph.payloads[1], &tmpl)
+	if text["to"] != "15551234567" || text["text"].(map[string]interface{})["preview_url"] != false {
+		t.Errorf("text payload = %s", graph.payloads[0])
+	}
+	if tmpl["type"] != "template" || tmpl["template"].(map[string]interface{})["name"] != "report_ready" {
+		t.Errorf("template payload = %s", graph.payloads[1])
+	}
+}
+
+func TestWhatsAppSendMessageRejectsBadRequests(t *testing.T) {
+	h, _ := newTestWhatsAppHandler(t)
+	h.cfg.PhoneNumberID = "555"
+	h.cfg.PhoneNumberIDs = []string{"555"}
+
+	for _, body := range []string{
+		`{"to": "15551234567"}`,
+		`{"to": "15551234567", "text": "hi", "template": {"name": "x", "language": "en"}}`,
+		`{"to": "not a number", "text": "hi"}`,
+		`{"to": "15551234567", "template": {"name": "report_ready"}}`,
+		`{"to": "15551234567", "text": "hi", "phone_number_id": "666"}`,
+		`{"to": "15551234567", "text": "` + strings.Repeat("a", whatsAppMaxSendLength+1) + `"}`,
+	} {
+		if w := postWhatsAppSend(h, body); w.Code != http.StatusBadRequest {
+			t.Errorf("%.80s = %d, want 400", body, w.Code)
+		}
+	}
+}
+
+func TestWhatsAppSendNormalizesNumbers(t *testing.T) {
+	h, graph := newTestWhatsAppHandler(t)
+	h.cfg.PhoneNumberID = "555"
+
+	for _, to := range []string{"4915112345678", "+4915112345678", "+49 151 12345678", "0049 (151) 123-456.78"} {
+		if w := postWhatsAppSend(h, `{"to": "`+to+`", "text": "hi"}`); w.Code != http.StatusOK {
+			t.Errorf("to %q = %d %s", to, w.Code, w.Body)
+		}
+	}
+	graph.mu.Lock()
+	for _, payload := range graph.payloads {
+		var sent map[string]interface{}
+		json.Unmarshal(payload, &sent)
+		if sent["to"] != "4915112345678" {
+			t.Errorf("sent to %v, want the canonical number", sent["to"])
+		}
+	}
+	graph.mu.Unlock()
+
+	for to, reason := range map[string]string{
+		"0151 12345678":    "country code is missing",
+		"+49 151 1234567x": "is not a digit",
+		"+49 151":          "7 to 15 digits",
+	} {
+		w := postWhatsAppSend(h, `{"to": "`+to+`", "text": "hi"}`)
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), reason) {
+			t.Errorf("to %q = %d %s, want 400 saying %q", to, w.Code, w.Body, reason)
+		}
+	}
+}
+
+func TestWhatsAppSendMessageReportsGraphErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		body       string
+		wantStatus int
+		wantError  string
+		wantCode   float64
+	}{
+		{"outside 24-hour window", http.StatusBadRequest,
+			`{"error":{"message":"(#131047) Re-engagement message","code":131047,"error_data":{"details":"More than 24 hours have passed"},"fbtrace_id":"AbC"}}`,
+			http.StatusUnprocessableEntity, apierror.WhatsAppWindowClosed, 131047},
+		{"rate limited", http.StatusBadRequest,
+			`{"error":{"message":"(#130429) Rate limit hit","code":130429}}`,
+			http.StatusTooManyRequests, apierror.WhatsAppRateLimited, 130429},
+		{"expired token", http.StatusUnauthorized,
+			`{"error":{"message":"Error validating access token","code":190}}`,
+			http.StatusBadGateway, apierror.WhatsAppError, 190},
+		{"invalid recipient", http.StatusBadRequest,
+			`{"error":{"message":"(#131026) Message undeliverable","code":131026}}`,
+			http.StatusUnprocessableEntity, apierror.WhatsAppError, 131026},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer srv.Close()
+			h, _ := newTestWhatsAppHandler(t)
+			h.cfg.PhoneNumberID = "555"
+			h.client = NewWhatsAppClient(config.WhatsAppConfig{GraphAPIToken: "token", GraphAPIBaseURL: srv.URL, APIVersion: "v22.0"}, srv.Client())
+
+			w := postWhatsAppSend(h, `{"to": "15551234567", "text": "hi"}`)
+			var resp apierror.Envelope
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			if w.Code != tt.wantStatus || resp.Error.Code != tt.wantError || resp.Error.Details["whatsapp_code"] != tt.wantCode {
+				t.Errorf("got %d %s, want %d %s with Meta code %v", w.Code, w.Body, tt.wantStatus, tt.wantError, tt.wantCode)
+			}
+		})
+	}
+}
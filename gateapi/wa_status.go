@@ -0,0 +1,184 @@
+package gateapi
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/apierror"
+	"github.com/tracoco/DifyGate/history"
+	"github.com/tracoco/DifyGate/metrics"
+	"github.com/tracoco/DifyGate/store"
+)
+
+// whatsAppMessageStatuses counts the delivery statuses WhatsApp reported
+// for sent messages
+var whatsAppMessageStatuses = metrics.NewCounter("difygate_whatsapp_message_statuses_total",
+	"Delivery statuses reported by WhatsApp for sent messages, by status", "status")
+
+// DeliveryStatus is the delivery of one message sent to a WhatsApp user
+type DeliveryStatus struct {
+	WAMID         string `json:"wamid"`
+	PhoneNumberID string `json:"phone_number_id,omitempty"`
+	Recipient     string `json:"recipient,omitempty"`
+	// Status is sent, delivered, read or failed
+	Status string `json:"status"`
+	// ErrorCode and ErrorTitle are WhatsApp's reason for a failed delivery
+	ErrorCode  int       `json:"error_code,omitempty"`
+	ErrorTitle string    `json:"error_title,omitempty"`
+	SentAt     time.Time `json:"sent_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// deliveryTracker keeps the delivery status of sent messages in the store
+// for a retention period, so a status reported to another instance can be
+// looked up on this one when the store is shared
+type deliveryTracker struct {
+	store     store.Store
+	retention time.Duration
+	log       *logrus.Logger
+
+	// mu serialises updates on this instance, so delivered and read
+	// arriving together can't overwrite each other
+	mu sync.Mutex
+}
+
+// newDeliveryTracker creates a delivery tracker, or returns nil when
+// retention is 0
+func newDeliveryTracker(kv store.Store, retention time.Duration, log *logrus.Logger) *deliveryTracker {
+	if retention <= 0 {
+		return nil
+	}
+	return &deliveryTracker{store: kv, retention: retention, log: log}
+}
+
+func deliveryStoreKey(wamid string) string {
+	return "whatsapp:status:" + wamid
+}
+
+// deliveryRecipientKey indexes the status of wamid by its recipient, so
+// erasing a user's data finds the statuses of the messages sent to them
+func deliveryRecipientKey(recipient, wamid string) string {
+	return "whatsapp:status-recipient:" + recipient + ":" + wamid
+}
+
+// sent records a message WhatsApp accepted
+func (t *deliveryTracker) sent(phoneNumberID, to, wamid string) {
+	if t == nil || wamid == "" {
+		return
+	}
+	now := time.Now()
+	t.update(wamid, func(d *DeliveryStatus) bool {
+		// A status webhook may have beaten the send response here
+		if d.Status == "" {
+			d.Status = history.StatusSent
+		}
+		d.PhoneNumberID, d.Recipient = phoneNumberID, to
+		if d.SentAt.IsZero() {
+			d.SentAt = now
+		}
+		return true
+	})
+}
+
+// report applies a status from the webhook; statuses never move back, so
+// a late "delivered" doesn't hide a "read"
+func (t *deliveryTracker) report(phoneNumberID, recipient, wamid, status, timestamp string, errs []WhatsAppWebhookError) {
+	if t == nil || wamid == "" {
+		return
+	}
+	at := time.Now()
+	if sec, err := strconv.ParseInt(timestamp, 10, 64); err == nil {
+		at = time.Unix(sec, 0)
+	}
+	t.update(wamid, func(d *DeliveryStatus) bool {
+		if !history.Supersedes(status, d.Status) {
+			return false
+		}
+		d.Status, d.UpdatedAt = status, at
+		if d.PhoneNumberID == "" {
+			d.PhoneNumberID = phoneNumberID
+		}
+		if d.Recipient == "" {
+			d.Recipient = recipient
+		}
+		if d.SentAt.IsZero() || status == history.StatusSent {
+			d.SentAt = at
+		}
+		if len(errs) > 0 {
+			d.ErrorCode, d.ErrorTitle = errs[0].Code, errs[0].Title
+		}
+		return true
+	})
+	whatsAppMessageStatuses.Inc(status)
+}
+
+// update applies change to the stored status of wamid, writing it back
+// when change returns true
+func (t *deliveryTracker) update(wamid string, change func(*DeliveryStatus) bool) {
+	log := t.log.WithField("wamid", wamid)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	d, err := t.get(wamid)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		log.WithError(err).Warn("Failed to read WhatsApp delivery status")
+		return
+	}
+	d.WAMID = wamid
+	if d.UpdatedAt.IsZero() {
+		d.UpdatedAt = time.Now()
+	}
+	if !change(&d) {
+		return
+	}
+	b, err := json.Marshal(d)
+	if err != nil {
+		log.WithError(err).Error("Failed to encode WhatsApp delivery status")
+		return
+	}
+	if err := t.store.Set(deliveryStoreKey(wamid), b, t.retention); err != nil {
+		log.WithError(err).Warn("Failed to store WhatsApp delivery status")
+		return
+	}
+	if d.Recipient != "" {
+		if err := t.store.Set(deliveryRecipientKey(d.Recipient, wamid), nil, t.retention); err != nil {
+			log.WithError(err).Warn("Failed to index WhatsApp delivery status")
+		}
+	}
+}
+
+// get returns the stored status of wamid, or store.ErrNotFound
+func (t *deliveryTracker) get(wamid string) (DeliveryStatus, error) {
+	var d DeliveryStatus
+	b, err := t.store.Get(deliveryStoreKey(wamid))
+	if err != nil {
+		return d, err
+	}
+	err = json.Unmarshal(b, &d)
+	return d, err
+}
+
+// GetMessageStatus returns the delivery status of a message sent to a
+// WhatsApp user
+func (h *WhatsAppHandler) GetMessageStatus(c *gin.Context) {
+	if h.deliveries == nil {
+		apierror.Respond(c, http.StatusNotFound, apierror.FeatureDisabled, "Delivery tracking is disabled")
+		return
+	}
+	d, err := h.deliveries.get(c.Param("wamid"))
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		apierror.Respond(c, http.StatusNotFound, apierror.NotFound, "No delivery status is known for this message")
+	case err != nil:
+		requestLogger(c, h.log).WithError(err).Error("Failed to read WhatsApp delivery status")
+		apierror.Respond(c, http.StatusInternalServerError, apierror.Internal, "Failed to read the delivery status")
+	default:
+		c.JSON(http.StatusOK, d)
+	}
+}
@@ -0,0 +1,69 @@
+package gateapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// getMessageStatus looks up the delivery status of wamid through h
+func getMessageStatus(t *testing.T, h *WhatsAppHandler, wamid string) (int, DeliveryStatus) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/messages/:wamid/status", h.GetMessageStatus)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/messages/"+wamid+"/status", nil))
+	var d DeliveryStatus
+	if w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), &d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Code, d
+}
+
+func TestWhatsAppDeliveryStatus(t *testing.T) {
+	h, _ := newTestWhatsAppHandler(t)
+	h.cfg.PhoneNumberID = "555"
+
+	if code, _ := getMessageStatus(t, h, "wamid.test"); code != http.StatusNotFound {
+		t.Fatalf("status before sending = %d, want 404", code)
+	}
+	if w := postWhatsAppSend(h, `{"to": "15551234567", "text": "Your order shipped"}`); w.Code != http.StatusOK {
+		t.Fatalf("send = %d %s", w.Code, w.Body)
+	}
+	code, d := getMessageStatus(t, h, "wamid.test")
+	if code != http.StatusOK || d.Status != "sent" || d.Recipient != "15551234567" || d.PhoneNumberID != "555" || d.SentAt.IsZero() {
+		t.Fatalf("after send = %d %+v", code, d)
+	}
+
+	before := whatsAppMessageStatuses.Value("read")
+	if w := postWhatsAppFixture(t, h, "whatsapp_statuses.json"); w.Code != http.StatusOK {
+		t.Fatalf("webhook = %d", w.Code)
+	}
+	// The late "delivered" doesn't move the message back from "read"
+	if _, d = getMessageStatus(t, h, "wamid.test"); d.Status != "read" || d.UpdatedAt.Unix() != 1760000200 {
+		t.Errorf("after webhook = %+v, want read at 1760000200", d)
+	}
+	if got := whatsAppMessageStatuses.Value("read") - before; got != 1 {
+		t.Errorf("read counted %v times, want 1", got)
+	}
+
+	// Statuses of messages sent before tracking are kept too
+	code, d = getMessageStatus(t, h, "wamid.unknown")
+	if code != http.StatusOK || d.Status != "failed" || d.ErrorCode != 131026 || d.Recipient != "15557654321" {
+		t.Errorf("failed message = %d %+v", code, d)
+	}
+}
+
+func TestWhatsAppDeliveryStatusDisabled(t *testing.T) {
+	h, _ := newTestWhatsAppHandler(t)
+	h.deliveries = nil
+	if code, _ := getMessageStatus(t, h, "wamid.test"); code != http.StatusNotFound {
+		t.Errorf("status = %d, want 404", code)
+	}
+}
@@ -7,16 +7,22 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
-	"fmt"
 	"io"
-	"log"
 	"net/http"
-	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/apierror"
+	"github.com/tracoco/DifyGate/config"
+	"github.com/tracoco/DifyGate/events"
+	"github.com/tracoco/DifyGate/history"
+	"github.com/tracoco/DifyGate/metrics"
+	"github.com/tracoco/DifyGate/phone"
+	"github.com/tracoco/DifyGate/store"
 )
 
 // WebhookRequest represents the incoming WhatsApp webhook payload
@@ -27,30 +33,75 @@ type WebhookRequest struct {
 				Metadata struct {
 					PhoneNumberID string `json:"phone_number_id"`
 				} `json:"metadata"`
-				Messages []struct {
-					From string `json:"from"`
-					ID   string `json:"id"`
-					Text struct {
-						Body string `json:"body"`
-					} `json:"text"`
-					Type string `json:"type"`
-				} `json:"messages"`
+				Messages []WhatsAppWebhookMessage `json:"messages"`
+				// Statuses report the delivery of messages we sent
+				Statuses []struct {
+					ID          string                 `json:"id"`
+					Status      string                 `json:"status"`
+					Timestamp   string                 `json:"timestamp"`
+					RecipientID string                 `json:"recipient_id"`
+					Errors      []WhatsAppWebhookError `json:"errors"`
+				} `json:"statuses"`
+				// Errors are problems Meta reports outside any one message
+				Errors []WhatsAppWebhookError `json:"errors"`
 			} `json:"value"`
 		} `json:"changes"`
 	} `json:"entry"`
 }
 
-// VerifyWebhook verifies the authenticity of the webhook request by comparing HMAC signatures
-func VerifyWebhook(data []byte, hmacHeader string) bool {
+// WhatsAppWebhookMessage is a message a user sent to a business number
+type WhatsAppWebhookMessage struct {
+	From string `json:"from"`
+	ID   string `json:"id"`
+	Text struct {
+		Body string `json:"body"`
+	} `json:"text"`
+	Type string `json:"type"`
+	// Errors explain messages of type unsupported
+	Errors []WhatsAppWebhookError `json:"errors"`
+}
+
+// WhatsAppWebhookError is an error Meta reports in a webhook, e.g. 131051
+// for an unsupported message type or 131047 when the 24-hour window to
+// re-engage a user has passed
+type WhatsAppWebhookError struct {
+	Code      int    `json:"code"`
+	Title     string `json:"title"`
+	Message   string `json:"message"`
+	ErrorData struct {
+		Details string `json:"details"`
+	} `json:"error_data"`
+	Href string `json:"href"`
+}
+
+// whatsAppWebhookErrors counts errors reported in webhooks
+var whatsAppWebhookErrors = metrics.NewCounter("difygate_whatsapp_webhook_errors_total",
+	"Errors Meta reported in WhatsApp webhooks", "code")
+
+// logWhatsAppErrors logs and counts the errors of a webhook
+func logWhatsAppErrors(log *logrus.Entry, errs []WhatsAppWebhookError) {
+	for _, e := range errs {
+		whatsAppWebhookErrors.Inc(strconv.Itoa(e.Code))
+		log.WithFields(logrus.Fields{
+			"code":    e.Code,
+			"title":   e.Title,
+			"details": e.ErrorData.Details,
+		}).Warn("WhatsApp webhook reported an error")
+	}
+}
+
+// VerifyWebhook verifies the authenticity of the webhook request by
+// comparing HMAC signatures; without a secret nothing verifies
+func VerifyWebhook(data []byte, hmacHeader, appSecret string) bool {
+	if appSecret == "" {
+		return false
+	}
 	// Remove prefix if present
 	hmacReceived := hmacHeader
 	if strings.HasPrefix(hmacReceived, "sha256=") {
 		hmacReceived = strings.TrimPrefix(hmacReceived, "sha256=")
 	}
 
-	// Get the API secret from environment variables
-	appSecret := os.Getenv("DIFYGATE_WHATSAPP_APP_SECRET")
-
 	// Create HMAC hash using SHA-256
 	h := hmac.New(sha256.New, []byte(appSecret))
 	h.Write(data)
@@ -61,374 +112,473 @@ func VerifyWebhook(data []byte, hmacHeader string) bool {
 	return hmac.Equal([]byte(hmacReceived), []byte(digest))
 }
 
-// logRequestHeaders prints all headers from the request
-func logRequestHeaders(c *gin.Context) {
-	if os.Getenv("DIFYGATE_DEBUG") != "true" {
-		return
+// defaultWebhookBodyLimit caps webhook bodies read before their signature
+// is checked, until RegisterRoutes applies DIFYGATE_WEBHOOK_MAX_BODY_BYTES
+const defaultWebhookBodyLimit = 256 << 10
+
+// metaSignatures checks the X-Hub-Signature-256 Meta signs WhatsApp and
+// Messenger webhooks with, holding the app secret from the configuration.
+// Without DIFYGATE_WHATSAPP_APP_SECRET every webhook is rejected, unless
+// DIFYGATE_WHATSAPP_SKIP_SIGNATURE_VERIFY is on for local development.
+type metaSignatures struct {
+	channel   string
+	appSecret string
+	skip      bool
+	// bodyLimit caps the bytes read, whatever route the handler is on
+	bodyLimit int64
+	// missing logs the missing secret once
+	missing sync.Once
+}
+
+// newMetaSignatures creates the checker of a channel's webhooks, warning
+// when signatures aren't checked
+func newMetaSignatures(channel string, cfg config.WhatsAppConfig, log *logrus.Logger) *metaSignatures {
+	s := &metaSignatures{channel: channel, appSecret: cfg.AppSecret, skip: cfg.SkipSignatureVerify, bodyLimit: defaultWebhookBodyLimit}
+	if s.skip {
+		log.WithField("channel", channel).Warn("DIFYGATE_WHATSAPP_SKIP_SIGNATURE_VERIFY is on: webhooks are accepted without checking their signature, so anyone can post messages. Only use it for local development.")
 	}
+	return s
+}
 
-	log.Println("--- Request Headers ---")
+// read reads the webhook body, at most bodyLimit bytes of it, and checks
+// its signature. When the body mustn't be processed it answers the request,
+// logs why and returns false.
+func (s *metaSignatures) read(c *gin.Context, log *logrus.Entry) ([]byte, bool) {
+	if limit, ok := c.Get(bodyLimitKey); !ok || limit.(int64) > s.bodyLimit {
+		c.Set(bodyLimitKey, s.bodyLimit)
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, s.bodyLimit))
+	if err != nil {
+		if isBodyTooLarge(err) {
+			log.WithFields(logrus.Fields{
+				"limit":     c.GetInt64(bodyLimitKey),
+				"remote_ip": c.ClientIP(),
+			}).Warn("Webhook body exceeds size limit")
+			abortBodyTooLarge(c)
+			return nil, false
+		}
+		log.WithError(err).Error("Failed to read webhook body")
+		apierror.Respond(c, http.StatusBadRequest, apierror.InvalidBody, "Failed to read request body")
+		return nil, false
+	}
+	return body, s.verify(c, log, body)
+}
 
-	// Get all headers
-	headers := c.Request.Header
+// verify reports whether the webhook body may be processed, answering the
+// request and logging why when it may not
+func (s *metaSignatures) verify(c *gin.Context, log *logrus.Entry, body []byte) bool {
+	if s.skip {
+		return true
+	}
+	if s.appSecret == "" {
+		s.missing.Do(func() {
+			log.WithField("channel", s.channel).Error("DIFYGATE_WHATSAPP_APP_SECRET is not set, so every webhook is rejected; set it, or DIFYGATE_WHATSAPP_SKIP_SIGNATURE_VERIFY=true for local development")
+		})
+		log.WithField("reason", "app_secret_missing").Warn("Rejecting webhook: its signature can't be checked")
+		apierror.Respond(c, http.StatusServiceUnavailable, apierror.NotConfigured, "Webhook signatures can't be verified: DIFYGATE_WHATSAPP_APP_SECRET is not set")
+		return false
+	}
+	header := c.GetHeader("X-Hub-Signature-256")
+	if VerifyWebhook(body, header, s.appSecret) {
+		signatureFailures.verified(s.channel)
+		return true
+	}
+	reason := "signature_mismatch"
+	if header == "" {
+		reason = "signature_missing"
+	}
+	// The body may hold personal data; its hash tells retries apart
+	sum := sha256.Sum256(body)
+	log.WithFields(logrus.Fields{
+		"reason":      reason,
+		"remote_ip":   c.ClientIP(),
+		"body_sha256": hex.EncodeToString(sum[:8]),
+		"body_bytes":  len(body),
+	}).Warn("Rejecting webhook with an invalid signature")
+	signatureFailures.failed(s.channel)
+	apierror.Respond(c, http.StatusForbidden, apierror.InvalidSignature, "Invalid signature")
+	return false
+}
 
-	// Print each header
-	for name, values := range headers {
-		for _, value := range values {
-			log.Printf("%s: %s\n", name, value)
-		}
+// logRequestHeaders logs all headers from the request at debug level
+func logRequestHeaders(log *logrus.Entry, c *gin.Context) {
+	if !log.Logger.IsLevelEnabled(logrus.DebugLevel) {
+		return
 	}
 
-	// Specifically check for the signature header that we care about
-	sigHeader := c.GetHeader("X-Hub-Signature-256")
-	log.Printf("X-Hub-Signature-256: %s\n", sigHeader)
+	// Flatten multi-valued headers into a single field set
+	headers := logrus.Fields{}
+	for name, values := range c.Request.Header {
+		headers[name] = strings.Join(values, ", ")
+	}
 
-	log.Println("----------------------")
+	// Specifically include the signature header that we care about
+	log.WithFields(logrus.Fields{
+		"headers":             headers,
+		"x_hub_signature_256": c.GetHeader("X-Hub-Signature-256"),
+	}).Debug("Request headers")
 }
 
+// ignoredWhatsAppTypes are message types that need no answer, such as
+// reactions and notices about the sender's account
+var ignoredWhatsAppTypes = map[string]bool{
+	"reaction": true,
+	"system":   true,
+}
+
+// whatsAppSupportedTypes are the message types answered through the
+// pipeline, as listed in the unsupported-type reply; a type handled in
+// HandleWhatsAppWebhookPost must be added here too
+var whatsAppSupportedTypes = []string{"text"}
+
 // WhatsAppHandler manages WhatsApp webhook handling
 type WhatsAppHandler struct {
-	log         *logrus.Logger
-	difyHandler *DifyHandler
+	log      *logrus.Logger
+	cfg      config.WhatsAppConfig
+	client   *WhatsAppClient
+	pipeline *MessagePipeline
+	messages *Messages
+	store    store.Store
+	history  *history.Recorder
+	// deliveries tracks the status of sent messages; nil when
+	// DIFYGATE_WHATSAPP_STATUS_RETENTION is 0
+	deliveries *deliveryTracker
+	// broadcasts sends broadcasts and reports their progress
+	broadcasts *broadcaster
+	// schedule sends messages scheduled for later
+	schedule *scheduler
+	// signatures checks the webhooks' signatures
+	signatures *metaSignatures
 }
 
 // NewWhatsAppHandler creates a new WhatsApp webhook handler
-func NewWhatsAppHandler(log *logrus.Logger) *WhatsAppHandler {
-	return &WhatsAppHandler{
-		log:         log,
-		difyHandler: NewDifyHandler(log),
+func NewWhatsAppHandler(cfg config.WhatsAppConfig, chatCfg config.ChatConfig, difyCfg config.DifyConfig, clients *HTTPClients, difyHandler *DifyHandler, messages *Messages, kv store.Store, dispatcher *events.Dispatcher, recorder *history.Recorder, log *logrus.Logger) *WhatsAppHandler {
+	client := NewWhatsAppClient(cfg, clients.Meta)
+	client.deliveries = newDeliveryTracker(kv, cfg.StatusRetention, log)
+	h := &WhatsAppHandler{
+		log:        log,
+		cfg:        cfg,
+		client:     client,
+		messages:   messages,
+		store:      kv,
+		history:    recorder,
+		deliveries: client.deliveries,
+		signatures: newMetaSignatures("whatsapp", cfg, log),
+	}
+	opts := PipelineOptions{
+		Channel:          "whatsapp",
+		MaxMessageLength: whatsAppMaxTextLength,
+		ConversationTTL:  cfg.ConversationTTL,
+		// Dify has always known WhatsApp users by their bare number
+		DifyUser:     func(msg ChannelMessage) string { return msg.UserID },
+		History:      recorder,
+		Inputs:       func(msg ChannelMessage) map[string]interface{} { return cfg.Inputs[msg.ChannelID] },
+		LanguageHint: func(msg ChannelMessage) string { return numberLanguage(msg.UserID) },
+	}
+	if cfg.ReactionProcessing != "" || cfg.ReactionDone != "" {
+		opts.Acknowledge = h.react
 	}
+	sender := &whatsAppSender{client: client}
+	if cfg.VoiceReplies {
+		opts.SendVoice = sender.SendVoice
+	}
+	h.pipeline = NewMessagePipeline(opts, sender, chatCfg, messages, difyCfg, difyHandler, kv, dispatcher)
+	return h
 }
 
-// HandleWhatsAppWebhookPost handles POST requests to the WhatsApp webhook
-func (h *WhatsAppHandler) HandleWhatsAppWebhookPost(c *gin.Context) {
-	logRequestHeaders(c)
-	// Read the request body
-	body, err := io.ReadAll(c.Request.Body)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read request body"})
+// Hooks returns the message hooks of the WhatsApp pipeline, for adding
+// custom ones
+func (h *WhatsAppHandler) Hooks() *MessageHooks {
+	return h.pipeline.hooks
+}
+
+// reactionTimeout bounds a reaction, which holds up the message it marks
+const reactionTimeout = 5 * time.Second
+
+// react puts DIFYGATE_WHATSAPP_REACTION_PROCESSING on a message when it is
+// taken up and DIFYGATE_WHATSAPP_REACTION_DONE once it is answered.
+// Reactions are a courtesy: a failure is logged and the message answered
+// all the same.
+func (h *WhatsAppHandler) react(ctx context.Context, msg ChannelMessage, done bool) {
+	emoji := h.cfg.ReactionProcessing
+	if done {
+		emoji = h.cfg.ReactionDone
+	}
+	if emoji == "" || msg.ReplyTo == "" {
 		return
 	}
+	ctx, cancel := context.WithTimeout(ctx, reactionTimeout)
+	defer cancel()
+	if err := h.client.SendReaction(ctx, msg.ChannelID, msg.UserID, msg.ReplyTo, emoji); err != nil {
+		loggerFromContext(ctx, h.log).WithError(err).WithField("emoji", emoji).Warn("Failed to react to WhatsApp message")
+	}
+}
 
-	if !VerifyWebhook(body, c.GetHeader("X-Hub-Signature-256")) {
-		// Respond with '403 Forbidden' if verify signature do not match
-		c.Status(http.StatusForbidden)
-		return
+// whatsAppSender replies from the business number the message was sent to
+type whatsAppSender struct {
+	client *WhatsAppClient
+}
+
+// SendText sends a text reply quoting the user's message
+func (s *whatsAppSender) SendText(ctx context.Context, msg ChannelMessage, text string) (string, error) {
+	return s.client.SendText(ctx, msg.ChannelID, msg.UserID, text, msg.ReplyTo)
+}
+
+// SendTyping does nothing; the webhook marks the message as read instead,
+// where read receipts are on
+func (s *whatsAppSender) SendTyping(ctx context.Context, msg ChannelMessage) error {
+	return nil
+}
+
+// SendMedia sends a file by link
+func (s *whatsAppSender) SendMedia(ctx context.Context, msg ChannelMessage, media ChannelAttachment) error {
+	wamid, err := s.client.SendMedia(ctx, msg.ChannelID, msg.UserID, whatsAppMediaType(media.Type), media.URL, media.Caption)
+	if err == nil {
+		loggerFromContext(ctx, logrus.StandardLogger()).WithField("wamid", wamid).Debug("WhatsApp media sent")
 	}
+	return err
+}
 
-	// Log incoming messages
-	if os.Getenv("DIFYGATE_DEBUG") == "true" {
-		h.log.WithField("message", string(body)).Info("Incoming webhook message")
+// SendVoice uploads the speech of an answer, MP3 as Dify makes it, and
+// sends it as audio
+func (s *whatsAppSender) SendVoice(ctx context.Context, msg ChannelMessage, audio []byte) error {
+	mediaID, err := s.client.UploadMedia(ctx, msg.ChannelID, "audio/mpeg", "answer.mp3", bytes.NewReader(audio))
+	if err != nil {
+		return err
 	}
+	_, err = s.client.sendMedia(ctx, msg.ChannelID, msg.UserID, "audio", map[string]string{"id": mediaID}, "")
+	return err
+}
 
-	// Parse the request body
-	var webhookRequest WebhookRequest
-	if err := json.Unmarshal(body, &webhookRequest); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to parse request body"})
-		return
+// whatsAppMediaType maps a Dify file type onto a WhatsApp message type
+func whatsAppMediaType(fileType string) string {
+	switch fileType {
+	case "image", "audio", "video":
+		return fileType
+	default:
+		return "document"
 	}
+}
 
-	// Check if the webhook request contains a message
-	if len(webhookRequest.Entry) > 0 && len(webhookRequest.Entry[0].Changes) > 0 &&
-		len(webhookRequest.Entry[0].Changes[0].Value.Messages) > 0 {
+// Configured reports whether a Graph API token is set, i.e. whether this
+// deployment uses WhatsApp
+func (h *WhatsAppHandler) Configured() bool {
+	return h.cfg.GraphAPIToken != ""
+}
 
-		message := webhookRequest.Entry[0].Changes[0].Value.Messages[0]
+// CheckGraphToken verifies that the configured Graph API token is valid
+func (h *WhatsAppHandler) CheckGraphToken(ctx context.Context) error {
+	return h.client.CheckToken(ctx, h.cfg.PhoneNumberID)
+}
 
-		// Check if the incoming message contains text
-		if message.Type == "text" {
-			// Extract the business number to send the reply from it
-			businessPhoneNumberID := webhookRequest.Entry[0].Changes[0].Value.Metadata.PhoneNumberID
+// HandleWhatsAppWebhookPost handles POST requests to the WhatsApp webhook
+func (h *WhatsAppHandler) HandleWhatsAppWebhookPost(c *gin.Context) {
+	reqLog := requestLogger(c, h.log)
+	logRequestHeaders(reqLog, c)
+	body, ok := h.signatures.read(c, reqLog)
+	if !ok {
+		return
+	}
 
-			// Process the message asynchronously
-			// We don't want to block the webhook response
-			go h.processWhatsAppMessage(businessPhoneNumberID, message.From, message.Text.Body, message.ID)
+	// Log incoming messages
+	reqLog.WithField("message", string(body)).Debug("Incoming webhook message")
 
-			// Mark incoming message as read
-			markMessageAsRead(businessPhoneNumberID, message.ID)
-		}
+	// Parse the request body
+	var webhookRequest WebhookRequest
+	if err := json.Unmarshal(body, &webhookRequest); err != nil {
+		apierror.Respond(c, http.StatusBadRequest, apierror.InvalidBody, "Failed to parse request body")
+		return
 	}
 
+	// Messages are answered asynchronously; we don't want to block the
+	// webhook response
+	h.processWebhook(reqLog, webhookRequest, h.pipeline.Accept, false)
+
 	// Return 200 OK (must respond quickly to webhook)
 	c.Status(http.StatusOK)
 }
 
-// processWhatsAppMessage handles the WhatsApp message processing and Dify integration
-func (h *WhatsAppHandler) processWhatsAppMessage(phoneNumberID, from, messageBody, messageID string) {
-	// Send initial acknowledgment
-	/* 	initialResponse := "I'm processing your request..."
-	   	sendReplyMessage(phoneNumberID, from, initialResponse, messageID) */
-
-	// Create context with reasonable timeout
-	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
-	defer cancel()
+// Outcomes of processWebhook for the first message it answers
+const (
+	webhookNoMessage   = "no_message"
+	webhookNotServed   = "not_served"
+	webhookAnswered    = "answered"
+	webhookIgnored     = "ignored"
+	webhookUnsupported = "unsupported"
+)
 
-	// Use user's WhatsApp number as the conversation ID to maintain context
-	// Format the phone number to ensure it's consistent
-	userID := strings.TrimPrefix(from, "+")
-
-	// Prepare request to Dify
-	difyReq := DifyChatMessageRequest{
-		Inputs:         map[string]interface{}{},
-		Query:          messageBody,
-		User:           userID,      // Set the user ID as the WhatsApp number
-		ConversationID: "",          //"whatsapp_" + userID, // Prefix to ensure uniqueness
-		ResponseMode:   "streaming", // Use streaming for real-time responses
-	}
-
-	// Log what we're doing
-	h.log.WithFields(logrus.Fields{
-		"userID":         userID,
-		"query":          messageBody,
-		"conversationID": "whatsapp_" + userID,
-	}).Info("Sending request to Dify")
-
-	// Start streaming response from Dify
-	respChan, errChan := h.difyHandler.DifyChatMessageStreaming(ctx, difyReq)
-
-	// Variables to build the complete response
-	var fullAnswer strings.Builder
-	//var lastMessageSent time.Time
-	//lastMessageSent = time.Now() // Initialize to now to prevent immediate send
-
-	// Constants for message handling
-	const minSendInterval = 10 * time.Second // Minimum time between messages (prevent rate limiting)
-	const minChunkSize = 100                 // Minimum characters per message
-
-	// Process streaming responses
-	for {
-		select {
-		case err, ok := <-errChan:
-			if !ok {
-				// Error channel closed, no errors occurred
+// processWebhook acts on a verified webhook: it records the delivery
+// statuses and answers every message sent to a number served here, passing
+// text messages to answer, and returns the outcome for the first of them.
+// Meta batches several entries, changes and messages into one delivery
+// when it is busy or retrying. A dry run leaves out everything but answer:
+// the statuses, read receipts and unsupported-type replies.
+func (h *WhatsAppHandler) processWebhook(log *logrus.Entry, webhookRequest WebhookRequest, answer func(*logrus.Entry, ChannelMessage), dryRun bool) (outcome string) {
+	outcome = webhookNoMessage
+	for _, entry := range webhookRequest.Entry {
+		for _, change := range entry.Changes {
+			businessPhoneNumberID := change.Value.Metadata.PhoneNumberID
+			if !h.cfg.ServesPhoneNumber(businessPhoneNumberID) {
+				// Another instance (or nobody) answers this number; Meta
+				// still needs the 200 or it keeps retrying
+				if len(change.Value.Messages) > 0 {
+					log.WithField("phone_number_id", businessPhoneNumberID).Info("Ignoring WhatsApp message for a phone number not served here")
+					if outcome == webhookNoMessage {
+						outcome = webhookNotServed
+					}
+				}
 				continue
 			}
-
-			// Something went wrong
-			h.log.WithError(err).Error("Error in Dify streaming response")
-			errorMessage := fmt.Sprintf("Sorry, I encountered an error: %s", err.Error())
-			sendReplyMessage(phoneNumberID, from, errorMessage, messageID)
-			return
-
-		case resp, ok := <-respChan:
-			if !ok {
-				// Response channel closed, stream completed
-				h.log.Info("Dify response stream completed")
-
-				// Send any remaining text
-				if fullAnswer.Len() > 0 {
-					finalResponse := fullAnswer.String()
-					h.log.WithField("final_response", finalResponse).Info("Sending final response")
-					sendReplyMessage(phoneNumberID, from, finalResponse, messageID)
+			logWhatsAppErrors(log, change.Value.Errors)
+			if !dryRun {
+				for _, status := range change.Value.Statuses {
+					var errMsg string
+					if len(status.Errors) > 0 {
+						errMsg = status.Errors[0].Title
+					}
+					h.history.UpdateStatus(status.ID, status.Status, errMsg)
+					h.deliveries.report(businessPhoneNumberID, phone.Lenient(status.RecipientID), status.ID, status.Status, status.Timestamp, status.Errors)
 				}
-				return
 			}
-
-			// Log each response we get
-			h.log.WithFields(logrus.Fields{
-				"event":  resp.Event,
-				"answer": resp.Answer,
-				"id":     resp.ID,
-			}).Info("Received Dify response chunk")
-
-			// Process different event types
-			switch resp.Event {
-			case "message_start":
-				// First message in the stream, reset
-				fullAnswer.Reset()
-
-			case "agent_message":
-				// Add to the answer if there's content
-				if resp.Answer != "" {
-					fullAnswer.WriteString(resp.Answer)
-
-					// Check if we should send a partial message
-					/* 					if time.Since(lastMessageSent) >= minSendInterval && fullAnswer.Len() >= minChunkSize {
-						partialResponse := fullAnswer.String()
-						h.log.WithField("partial_response", partialResponse).Info("Sending partial response")
-						sendReplyMessage(phoneNumberID, from, partialResponse, messageID)
-
-						// Reset and update timing
-						fullAnswer.Reset()
-						lastMessageSent = time.Now()
-					} */
-				}
-
-			case "message_end":
-				// Send final message if there's anything left
-				if fullAnswer.Len() > 0 {
-					finalResponse := fullAnswer.String()
-					h.log.WithField("final_response", finalResponse).Info("Sending final message")
-					sendReplyMessage(phoneNumberID, from, finalResponse, messageID)
+			for _, message := range change.Value.Messages {
+				logWhatsAppErrors(log.WithField("message_id", message.ID), message.Errors)
+				got := h.processMessage(log, businessPhoneNumberID, message, answer, dryRun)
+				if outcome == webhookNoMessage || outcome == webhookNotServed {
+					outcome = got
 				}
-				return
-
-			case "error":
-				// Handle error events
-				errMsg := fmt.Sprintf("Error from AI: %s", resp.ErrorMsg)
-				h.log.Error(errMsg)
-				sendReplyMessage(phoneNumberID, from, errMsg, messageID)
-				return
-			}
-
-		case <-ctx.Done():
-			// Context timeout or cancellation
-			h.log.Warn("Context canceled or timed out while processing Dify response")
-			timeoutMessage := "Sorry, the response took too long. Please try again later."
-			sendReplyMessage(phoneNumberID, from, timeoutMessage, messageID)
-			return
-
-		case <-time.After(15 * time.Second):
-			// No messages for 15 seconds but we have accumulated text
-			if fullAnswer.Len() >= minChunkSize {
-				partialResponse := fullAnswer.String()
-				h.log.WithField("timeout_response", partialResponse).Info("Sending response after timeout")
-				sendReplyMessage(phoneNumberID, from, partialResponse, messageID)
-
-				// Reset and update timing
-				fullAnswer.Reset()
-				//lastMessageSent = time.Now()
 			}
 		}
 	}
+	return outcome
 }
 
-// HandleWhatsAppWebhookGet handles GET requests to the WhatsApp webhook (for verification)
-func (h *WhatsAppHandler) HandleWhatsAppWebhookGet(c *gin.Context) {
-	webhookVerifyToken := os.Getenv("DIFYGATE_WEBHOOK_VERIFY_TOKEN")
-
-	// Get query parameters
-	mode := c.Query("hub.mode")
-	token := c.Query("hub.verify_token")
-	challenge := c.Query("hub.challenge")
-
-	// Check the mode and token sent are correct
-	if mode == "subscribe" && token == webhookVerifyToken {
-		// Respond with 200 OK and challenge token from the request
-		c.String(http.StatusOK, challenge)
-		h.log.Info("Webhook verified successfully!")
-	} else {
-		// Respond with '403 Forbidden' if verify tokens do not match
-		c.Status(http.StatusForbidden)
-		h.log.Warn("Webhook verification failed")
-	}
-}
-
-// sendReplyMessage sends a reply to a WhatsApp message
-func sendReplyMessage(phoneNumberID, to, messageBody, messageID string) {
-	if messageBody == "" {
-		log.Println("Warning: Attempted to send empty message, skipping")
-		return
-	}
-
-	graphAPIToken := os.Getenv("DIFYGATE_GRAPH_API_TOKEN")
-	if graphAPIToken == "" {
-		log.Println("Error: DIFYGATE_GRAPH_API_TOKEN is not set")
-		return
-	}
-
-	url := fmt.Sprintf("https://graph.facebook.com/v22.0/%s/messages", phoneNumberID)
-
-	// Truncate message if too long for WhatsApp (limit is around 4096 characters)
-	if len(messageBody) > 4000 {
-		messageBody = messageBody[:3997] + "..."
-	}
-
-	// Create request payload
-	payload := map[string]interface{}{
-		"messaging_product": "whatsapp",
-		"to":                to,
-		"text": map[string]string{
-			"body": messageBody,
-		},
-		"context": map[string]string{
-			"message_id": messageID,
-		},
+// processMessage acts on one message sent to the business number
+// businessPhoneNumberID, as processWebhook describes
+func (h *WhatsAppHandler) processMessage(log *logrus.Entry, businessPhoneNumberID string, message WhatsAppWebhookMessage, answer func(*logrus.Entry, ChannelMessage), dryRun bool) (outcome string) {
+	// WhatsApp already reports the canonical form; normalizing keeps every
+	// store key and comparison in it should that change
+	message.From = phone.Lenient(message.From)
+	// Any message opens the 24-hour window, even one that isn't answered
+	if !dryRun && message.From != "" {
+		h.noteInbound(log, businessPhoneNumberID, message.From)
 	}
 
-	payloadBytes, err := json.Marshal(payload)
-	if err != nil {
-		log.Printf("Failed to marshal reply payload: %v", err)
-		return
-	}
-
-	// Log what we're about to send
-	if os.Getenv("DIFYGATE_DEBUG") == "true" {
-		log.Printf("Sending WhatsApp message to %s (length: %d): %s", to, len(messageBody), messageBody)
-		var prettyJSON bytes.Buffer
-		if err := json.Indent(&prettyJSON, payloadBytes, "", "  "); err == nil {
-			log.Printf("WhatsApp API request payload: %s", prettyJSON.String())
+	switch {
+	case message.Type == "text":
+		// The request ID travels with the log entry so every log line
+		// for this message can be correlated
+		answer(log.WithField("wa_message_id", message.ID), ChannelMessage{
+			ChannelID: businessPhoneNumberID,
+			UserID:    message.From,
+			Text:      message.Text.Body,
+			ReplyTo:   message.ID,
+		})
+
+		// Mark incoming message as read
+		if !dryRun {
+			h.markRead(log, businessPhoneNumberID, message.ID)
+		}
+		return webhookAnswered
+	case message.Type == "" || ignoredWhatsAppTypes[message.Type]:
+		return webhookIgnored
+	default:
+		// Stickers, contacts, video, polls etc. get an apology rather
+		// than silence, but are still marked as read; so do messages
+		// Meta itself can't deliver, which arrive as type unsupported
+		if !dryRun {
+			go h.replyUnsupported(log, businessPhoneNumberID, message.From, message.ID, message.Type)
+			h.markRead(log, businessPhoneNumberID, message.ID)
 		}
+		return webhookUnsupported
 	}
+}
 
-	// Create HTTP request
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(payloadBytes))
-	if err != nil {
-		log.Printf("Failed to create reply request: %v", err)
+// markRead marks a received message as read in the background, unless
+// read receipts are off for the business number it was sent to
+func (h *WhatsAppHandler) markRead(log *logrus.Entry, phoneNumberID, messageID string) {
+	if !h.cfg.MarksRead(phoneNumberID) {
 		return
 	}
+	go h.client.MarkMessageAsRead(log, phoneNumberID, messageID)
+}
 
-	req.Header.Set("Authorization", "Bearer "+graphAPIToken)
-	req.Header.Set("Content-Type", "application/json")
-
-	// Send request with timeout
-	client := &http.Client{
-		Timeout: 10 * time.Second,
-	}
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Printf("Failed to send reply: %v", err)
+// replyUnsupported tells the sender the message type can't be handled, at
+// most once per type every UnsupportedReplyInterval so a burst of stickers
+// gets one apology
+func (h *WhatsAppHandler) replyUnsupported(log *logrus.Entry, phoneNumberID, from, messageID, messageType string) {
+	log = log.WithField("message_type", messageType)
+	if h.cfg.UnsupportedReplyInterval <= 0 {
+		log.Info("Ignoring unsupported WhatsApp message")
 		return
 	}
-	defer resp.Body.Close()
 
-	// Check response status
-	respBody, _ := io.ReadAll(resp.Body)
-	if resp.StatusCode != http.StatusOK {
-		log.Printf("WhatsApp API error (status %d): %s", resp.StatusCode, string(respBody))
+	key := "whatsapp:unsupported:" + phoneNumberID + ":" + from + ":" + messageType
+	count, err := h.store.Incr(key, h.cfg.UnsupportedReplyInterval)
+	if err != nil {
+		log.WithError(err).Warn("Failed to check unsupported message reply limit")
+	} else if count > 1 {
+		log.Debug("Unsupported WhatsApp message already answered recently")
 		return
 	}
 
-	// Log response for debugging
-	if os.Getenv("DIFYGATE_DEBUG") == "true" {
-		log.Printf("WhatsApp API response: %s", string(respBody))
-	} else {
-		log.Printf("Message sent successfully to %s", to)
+	log.Info("Replying to unsupported WhatsApp message")
+	text := strings.ReplaceAll(h.messages.Get(h.messages.Locale(""), config.MsgUnsupportedMessage), "{types}", joinWords(whatsAppSupportedTypes))
+	if _, err := h.client.SendText(withLogger(context.Background(), log), phoneNumberID, from, text, messageID); err != nil {
+		log.WithError(err).Error("Failed to reply to unsupported WhatsApp message")
 	}
 }
 
-func markMessageAsRead(phoneNumberID, messageID string) {
-	graphAPIToken := os.Getenv("DIFYGATE_GRAPH_API_TOKEN")
-	url := fmt.Sprintf("https://graph.facebook.com/v22.0/%s/messages", phoneNumberID)
-
-	// Create request payload
-	payload := map[string]interface{}{
-		"messaging_product": "whatsapp",
-		"status":            "read",
-		"message_id":        messageID,
+// whatsAppUserKeys are glob patterns of the store keys holding state about
+// a WhatsApp user on any business number: the Dify conversation mapping,
+// the unsupported-message reply limit, the chosen language, replies
+// queued for retry, a handoff with the messages it held, abuse counts,
+// the transcript limit, when the user last wrote and the index of the
+// delivery statuses of messages sent to them
+func whatsAppUserKeys(number string) []string {
+	return []string{
+		"whatsapp:conversation:*:" + number,
+		"whatsapp:unsupported:*:" + number + ":*",
+		"whatsapp:language:*:" + number,
+		"whatsapp:ack:*:" + number,
+		"outbox:whatsapp:" + number + ":*",
+		"whatsapp:handoff:*:" + number,
+		"abuse:*:whatsapp:*:" + number,
+		"whatsapp:transcript:*:" + number,
+		"whatsapp:last-inbound:*:" + number,
+		"cost:user:*:whatsapp:" + number,
+		deliveryRecipientKey(number, "*"),
 	}
+}
 
-	payloadBytes, err := json.Marshal(payload)
-	if err != nil {
-		log.Printf("Failed to marshal read status payload: %v", err)
-		return
+// joinWords lists items in prose, e.g. "text, image and audio"
+func joinWords(items []string) string {
+	if len(items) <= 1 {
+		return strings.Join(items, "")
 	}
+	return strings.Join(items[:len(items)-1], ", ") + " and " + items[len(items)-1]
+}
 
-	// Create HTTP request
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(payloadBytes))
-	if err != nil {
-		log.Printf("Failed to create read status request: %v", err)
-		return
-	}
+// HandleWhatsAppWebhookGet handles GET requests to the WhatsApp webhook (for verification)
+func (h *WhatsAppHandler) HandleWhatsAppWebhookGet(c *gin.Context) {
+	verifyMetaSubscription(c, h.cfg.VerifyToken, h.log)
+}
 
-	req.Header.Set("Authorization", "Bearer "+graphAPIToken)
-	req.Header.Set("Content-Type", "application/json")
+// verifyMetaSubscription answers Meta's webhook subscription handshake,
+// shared by every Meta product webhook
+func verifyMetaSubscription(c *gin.Context, verifyToken string, log *logrus.Logger) {
+	// Get query parameters
+	mode := c.Query("hub.mode")
+	token := c.Query("hub.verify_token")
+	challenge := c.Query("hub.challenge")
 
-	// Send request
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Printf("Failed to mark message as read: %v", err)
-		return
+	// Check the mode and token sent are correct
+	if mode == "subscribe" && token == verifyToken {
+		// Respond with 200 OK and challenge token from the request
+		c.String(http.StatusOK, challenge)
+		log.WithField("path", c.Request.URL.Path).Info("Webhook verified successfully!")
+	} else {
+		// Respond with '403 Forbidden' if verify tokens do not match
+		apierror.Respond(c, http.StatusForbidden, apierror.VerificationFailed, "Webhook verification failed")
+		log.WithField("path", c.Request.URL.Path).Warn("Webhook verification failed")
 	}
-	defer resp.Body.Close()
 }
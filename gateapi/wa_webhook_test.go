@@ -0,0 +1,340 @@
+package gateapi
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/config"
+	"github.com/tracoco/DifyGate/store"
+)
+
+// postWhatsAppFixture posts a testdata payload to the webhook, signed with
+// the app secret "secret"
+func postWhatsAppFixture(t *testing.T, h *WhatsAppHandler, name string) *httptest.ResponseRecorder {
+	t.Helper()
+	body, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(body)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/webhook", h.HandleWhatsAppWebhookPost)
+	req := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(string(body)))
+	req.Header.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func newTestWhatsAppHandler(t *testing.T) (*WhatsAppHandler, *fakeGraphAPI) {
+	t.Helper()
+	graph, client := newFakeGraphAPI(t)
+	cfg := config.WhatsAppConfig{AppSecret: "secret", UnsupportedReplyInterval: time.Hour, StatusRetention: time.Hour}
+	h := NewWhatsAppHandler(cfg, config.ChatConfig{}, config.DifyConfig{}, &HTTPClients{}, nil,
+		NewMessages(config.MessagesConfig{}), store.New("", quietLogger()), nil, nil, quietLogger())
+	client.deliveries = h.deliveries
+	h.client = client
+	return h, graph
+}
+
+func TestWhatsAppWebhookCountsMessageErrors(t *testing.T) {
+	h, graph := newTestWhatsAppHandler(t)
+	before := whatsAppWebhookErrors.Value("131051")
+
+	if w := postWhatsAppFixture(t, h, "whatsapp_unsupported_message.json"); w.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200", w.Code)
+	}
+	if got := whatsAppWebhookErrors.Value("131051") - before; got != 1 {
+		t.Errorf("code 131051 counted %v times, want 1", got)
+	}
+
+	// The sender still gets the unsupported-type reply
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		graph.mu.Lock()
+		bodies := append([]string(nil), graph.bodies...)
+		graph.mu.Unlock()
+		var reply string
+		for _, b := range bodies {
+			if b != "" {
+				reply = b
+			}
+		}
+		if reply != "" {
+			if !strings.Contains(reply, "text") {
+				t.Errorf("reply %q doesn't list the supported types", reply)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no unsupported-type reply was sent")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWhatsAppWebhookCountsChangeErrors(t *testing.T) {
+	h, _ := newTestWhatsAppHandler(t)
+	before := whatsAppWebhookErrors.Value("131000")
+
+	if w := postWhatsAppFixture(t, h, "whatsapp_change_error.json"); w.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200", w.Code)
+	}
+	if got := whatsAppWebhookErrors.Value("131000") - before; got != 1 {
+		t.Errorf("code 131000 counted %v times, want 1", got)
+	}
+}
+
+func TestWhatsAppReactsToMessages(t *testing.T) {
+	tests := []struct {
+		name   string
+		answer []StreamingChatResponse
+		want   []string
+	}{
+		{"answered", difyAnswer("conv-1", "hello"), []string{"⏳", "text", "✅"}},
+		// The error message is sent, but the message isn't marked done
+		{"failed", []StreamingChatResponse{{Event: "error", Code: "invalid_param", Message: "bad"}}, []string{"⏳", "text"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			graph, client := newFakeGraphAPI(t)
+			_, difyHandler := newFakeDify(t, func(req ChatMessageRequest) []StreamingChatResponse { return tt.answer })
+			h := NewWhatsAppHandler(config.WhatsAppConfig{ReactionProcessing: "⏳", ReactionDone: "✅"}, config.ChatConfig{},
+				config.DifyConfig{StreamTimeout: 5 * time.Second}, &HTTPClients{}, difyHandler,
+				NewMessages(config.MessagesConfig{}), store.New("", quietLogger()), nil, nil, quietLogger())
+			h.client = client
+			h.pipeline.sender = &whatsAppSender{client: client}
+
+			h.pipeline.Handle(testEntry(), ChannelMessage{ChannelID: "123", UserID: "15551234567", Text: "hi", ReplyTo: "wamid.in"})
+
+			var got []string
+			for _, raw := range graph.payloads {
+				var p struct {
+					Type     string `json:"type"`
+					Reaction struct {
+						MessageID string `json:"message_id"`
+						Emoji     string `json:"emoji"`
+					} `json:"reaction"`
+				}
+				json.Unmarshal(raw, &p)
+				if p.Type == "reaction" && p.Reaction.MessageID == "wamid.in" {
+					got = append(got, p.Reaction.Emoji)
+				} else {
+					got = append(got, "text")
+				}
+			}
+			if strings.Join(got, ", ") != strings.Join(tt.want, ", ") {
+				t.Errorf("sent %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWhatsAppReadReceiptsPerNumber(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  config.WhatsAppConfig
+		want bool
+	}{
+		{"on", config.WhatsAppConfig{MarkRead: true}, true},
+		{"off", config.WhatsAppConfig{MarkRead: false}, false},
+		{"off for the number", config.WhatsAppConfig{MarkRead: true, MarkReadNumbers: map[string]bool{"106540352242922": false}}, false},
+		{"on for the number", config.WhatsAppConfig{MarkReadNumbers: map[string]bool{"106540352242922": true}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, graph := newTestWhatsAppHandler(t)
+			h.cfg.MarkRead, h.cfg.MarkReadNumbers = tt.cfg.MarkRead, tt.cfg.MarkReadNumbers
+			if w := postWhatsAppFixture(t, h, "whatsapp_unsupported_message.json"); w.Code != http.StatusOK {
+				t.Fatalf("status %d, want 200", w.Code)
+			}
+
+			// Wait for the unsupported-type reply, and the receipt
+			// sent alongside it
+			want := 1
+			if tt.want {
+				want = 2
+			}
+			deadline := time.Now().Add(2 * time.Second)
+			for {
+				graph.mu.Lock()
+				n := len(graph.payloads)
+				graph.mu.Unlock()
+				if n >= want || time.Now().After(deadline) {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			time.Sleep(50 * time.Millisecond)
+
+			graph.mu.Lock()
+			defer graph.mu.Unlock()
+			read := 0
+			for _, p := range graph.payloads {
+				if strings.Contains(string(p), `"status":"read"`) {
+					read++
+				}
+			}
+			if marked := read > 0; marked != tt.want || len(graph.payloads) != want {
+				t.Errorf("sent %d payloads with %d read receipts, want receipts %v", len(graph.payloads), read, tt.want)
+			}
+		})
+	}
+}
+
+func TestWhatsAppWebhookWithoutAppSecret(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  config.WhatsAppConfig
+		want int
+	}{
+		{"wrong secret", config.WhatsAppConfig{AppSecret: "other"}, http.StatusForbidden},
+		{"no secret", config.WhatsAppConfig{}, http.StatusServiceUnavailable},
+		{"verification skipped", config.WhatsAppConfig{SkipSignatureVerify: true}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, _ := newTestWhatsAppHandler(t)
+			h.signatures = newMetaSignatures("whatsapp", tt.cfg, quietLogger())
+			if w := postWhatsAppFixture(t, h, "whatsapp_change_error.json"); w.Code != tt.want {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+	if VerifyWebhook([]byte("{}"), "sha256=", "") {
+		t.Error("an empty secret verified a signature")
+	}
+}
+
+func TestWhatsAppWebhookSignatures(t *testing.T) {
+	body, err := os.ReadFile("testdata/whatsapp_change_error.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign := func(b []byte, secret string) string {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(b)
+		return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+	large := append(append([]byte(nil), body...), strings.Repeat(" ", 1024)...)
+	tests := []struct {
+		name      string
+		body      []byte
+		signature string
+		want      int
+		// failed is whether the failure counts as a bad signature
+		failed bool
+	}{
+		{"valid", body, sign(body, "secret"), http.StatusOK, false},
+		{"valid without prefix", body, strings.TrimPrefix(sign(body, "secret"), "sha256="), http.StatusOK, false},
+		{"wrong secret", body, sign(body, "rotated"), http.StatusForbidden, true},
+		{"tampered body", append([]byte(" "), body...), sign(body, "secret"), http.StatusForbidden, true},
+		{"missing header", body, "", http.StatusForbidden, true},
+		// Read no further than the limit, even correctly signed
+		{"oversized body", large, sign(large, "secret"), http.StatusRequestEntityTooLarge, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, _ := newTestWhatsAppHandler(t)
+			h.signatures.bodyLimit = int64(len(body) + 512)
+			before := webhookSignatureFailures.Value("whatsapp")
+
+			gin.SetMode(gin.TestMode)
+			r := gin.New()
+			r.POST("/webhook", h.HandleWhatsAppWebhookPost)
+			req := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(string(tt.body)))
+			if tt.signature != "" {
+				req.Header.Set("X-Hub-Signature-256", tt.signature)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != tt.want {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if failed := webhookSignatureFailures.Value("whatsapp") > before; failed != tt.failed {
+				t.Errorf("counted as a signature failure: %v, want %v", failed, tt.failed)
+			}
+		})
+	}
+}
+
+func TestWhatsAppWebhookAnswersEveryMessage(t *testing.T) {
+	body, err := os.ReadFile("testdata/whatsapp_batched_messages.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var req WebhookRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		t.Fatal(err)
+	}
+	h, _ := newTestWhatsAppHandler(t)
+	h.cfg.PhoneNumberIDs = []string{"106540352242922"}
+
+	var got []string
+	outcome := h.processWebhook(testEntry(), req, func(_ *logrus.Entry, msg ChannelMessage) {
+		got = append(got, msg.ReplyTo+" from "+msg.UserID+": "+msg.Text)
+	}, true)
+
+	// The message to the number served elsewhere is left out
+	want := []string{
+		"wamid.first from 16505551234: first",
+		"wamid.second from 16505551234: second",
+		"wamid.third from 16505559876: third",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("answered %q, want %q", got, want)
+	}
+	if outcome != webhookAnswered {
+		t.Errorf("outcome %q, want %q", outcome, webhookAnswered)
+	}
+}
+
+func TestWhatsAppWebhookSavesEveryMessageToTheInbox(t *testing.T) {
+	_, client := newFakeGraphAPI(t)
+	release := make(chan struct{})
+	_, difyHandler := newFakeDify(t, func(req ChatMessageRequest) []StreamingChatResponse {
+		<-release
+		return difyAnswer("conv-1", "answer")
+	})
+	kv := store.New("", quietLogger())
+	cfg := config.WhatsAppConfig{AppSecret: "secret", PhoneNumberIDs: []string{"106540352242922"}}
+	h := NewWhatsAppHandler(cfg, config.ChatConfig{DurableInbox: true}, config.DifyConfig{StreamTimeout: 5 * time.Second},
+		&HTTPClients{}, difyHandler, NewMessages(config.MessagesConfig{}), kv, nil, nil, quietLogger())
+	h.client = client
+	h.pipeline.sender = &whatsAppSender{client: client}
+
+	if w := postWhatsAppFixture(t, h, "whatsapp_batched_messages.json"); w.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200", w.Code)
+	}
+	// Every message is saved by the time Meta gets its 200, while none
+	// is answered yet
+	keys, _ := kv.Keys("inbox:whatsapp:*")
+	sort.Strings(keys)
+	want := []string{"inbox:whatsapp:wamid.first", "inbox:whatsapp:wamid.second", "inbox:whatsapp:wamid.third"}
+	if strings.Join(keys, " ") != strings.Join(want, " ") {
+		t.Errorf("inbox holds %q, want %q", keys, want)
+	}
+
+	close(release)
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if keys, _ := kv.Keys("inbox:whatsapp:*"); len(keys) == 0 {
+			return
+		}
+	}
+	t.Error("answered messages left in the inbox")
+}
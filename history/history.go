@@ -0,0 +1,491 @@
+// Package history keeps the gateway's own record of chat messages for
+// support lookups, independently of Dify's logs
+package history
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/config"
+	"github.com/tracoco/DifyGate/metrics"
+	"github.com/tracoco/DifyGate/store"
+)
+
+// Directions of a message
+const (
+	Inbound  = "inbound"
+	Outbound = "outbound"
+)
+
+// Delivery statuses. Delivered and read come from the platform's status
+// callbacks, so they only appear on channels that send them.
+const (
+	StatusReceived  = "received"
+	StatusSent      = "sent"
+	StatusDelivered = "delivered"
+	StatusRead      = "read"
+	StatusFailed    = "failed"
+)
+
+// queueSize bounds the records waiting to be written
+const queueSize = 1024
+
+// ErrNotFound is returned when no record has the requested ID
+var ErrNotFound = errors.New("history: message not found")
+
+// errSealed is returned for an encrypted record that can't be opened
+var errSealed = errors.New("history: can't decrypt record")
+
+var dropped = metrics.NewCounter("difygate_history_records_dropped_total",
+	"Message history records dropped because the write queue was full")
+
+// statusRank orders statuses so a late callback can't move one back,
+// e.g. "delivered" arriving after "read"
+var statusRank = map[string]int{
+	StatusSent:      1,
+	StatusDelivered: 2,
+	StatusRead:      3,
+	StatusFailed:    4,
+}
+
+// Supersedes reports whether status may replace current, which it only
+// can when it comes later in a message's delivery
+func Supersedes(status, current string) bool {
+	return statusRank[status] > statusRank[current]
+}
+
+// Record is one message in or out of a chat
+type Record struct {
+	// ID is the platform's message ID, e.g. a WhatsApp wamid, or a
+	// generated one when the platform gave none
+	ID        string `json:"id"`
+	Channel   string `json:"channel"`
+	UserID    string `json:"user_id"`
+	Direction string `json:"direction"`
+	Text      string `json:"text"`
+	// ReplyTo is the ID of the inbound message a reply answers
+	ReplyTo string `json:"reply_to,omitempty"`
+	Status  string `json:"status"`
+	Error   string `json:"error,omitempty"`
+	// Human marks an outbound message written by a person rather than
+	// the bot, and Agent names them when known
+	Human     bool      `json:"human,omitempty"`
+	Agent     string    `json:"agent,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Query selects records; zero fields match everything
+type Query struct {
+	UserID  string
+	Channel string
+	Status  string
+	Since   time.Time
+	Limit   int
+}
+
+// change is a queued write: a new record, or a status update
+type change struct {
+	record     Record
+	statusOnly bool
+}
+
+// diskRecord is a line of the history file, with the text sealed when
+// encryption keys are configured
+type diskRecord struct {
+	Record
+	// Encrypted is the text sealed by the keyring, naming its key
+	Encrypted string `json:"encrypted,omitempty"`
+	// Sealed is the nonce and text sealed before keyrings, by a key that
+	// isn't named
+	Sealed []byte `json:"sealed,omitempty"`
+}
+
+// Recorder keeps message records in memory and, when a path is configured,
+// in an append-only file that is compacted as records expire. Writes are
+// queued and never block the caller. A nil *Recorder records nothing.
+type Recorder struct {
+	log       *logrus.Logger
+	path      string
+	retention time.Duration
+	keys      *store.Keyring
+
+	// writeMu serializes changes so the file matches the records
+	writeMu sync.Mutex
+	mu      sync.RWMutex
+	records map[string]*Record
+	file    *os.File
+
+	queue chan change
+	done  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// New loads the history file and starts the writer, or returns nil when
+// history is disabled
+func New(cfg config.HistoryConfig, log *logrus.Logger) (*Recorder, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	r := &Recorder{
+		log:       log,
+		path:      cfg.Path,
+		retention: cfg.Retention,
+		records:   make(map[string]*Record),
+		queue:     make(chan change, queueSize),
+		done:      make(chan struct{}),
+	}
+	keys, err := store.NewKeyring("history", cfg.EncryptionKeys)
+	if err != nil {
+		return nil, err
+	}
+	r.keys = keys
+	if r.path != "" {
+		if err := r.load(); err != nil {
+			return nil, err
+		}
+		if err := r.compact(); err != nil {
+			return nil, err
+		}
+	}
+
+	r.wg.Add(1)
+	go r.run(cfg.PruneInterval)
+	log.WithFields(logrus.Fields{"path": r.path, "records": len(r.records)}).Info("Message history enabled")
+	return r, nil
+}
+
+// Record queues rec to be stored, filling in a missing ID and timestamp.
+// It never blocks: records are dropped when the queue is full.
+func (r *Recorder) Record(rec Record) {
+	if r == nil {
+		return
+	}
+	if rec.ID == "" {
+		rec.ID = newID()
+	}
+	if rec.Timestamp.IsZero() {
+		rec.Timestamp = time.Now().UTC()
+	}
+	rec.UpdatedAt = rec.Timestamp
+	r.enqueue(change{record: rec})
+}
+
+// UpdateStatus queues a delivery status for the record with the given ID;
+// unknown IDs are ignored, as are statuses behind the current one
+func (r *Recorder) UpdateStatus(id, status, errMsg string) {
+	if r == nil || id == "" {
+		return
+	}
+	r.enqueue(change{
+		record:     Record{ID: id, Status: status, Error: errMsg, UpdatedAt: time.Now().UTC()},
+		statusOnly: true,
+	})
+}
+
+// Get returns the record with the given ID, or ErrNotFound
+func (r *Recorder) Get(id string) (Record, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	rec, ok := r.records[id]
+	if !ok {
+		return Record{}, ErrNotFound
+	}
+	return *rec, nil
+}
+
+// Find returns the records matching q, newest first
+func (r *Recorder) Find(q Query) []Record {
+	r.mu.RLock()
+	var found []Record
+	for _, rec := range r.records {
+		if (q.UserID == "" || rec.UserID == q.UserID) && (q.Channel == "" || rec.Channel == q.Channel) &&
+			(q.Status == "" || rec.Status == q.Status) && !rec.Timestamp.Before(q.Since) {
+			found = append(found, *rec)
+		}
+	}
+	r.mu.RUnlock()
+
+	sort.Slice(found, func(i, j int) bool { return found[i].Timestamp.After(found[j].Timestamp) })
+	if q.Limit > 0 && len(found) > q.Limit {
+		found = found[:q.Limit]
+	}
+	return found
+}
+
+// Close writes the queued records and closes the file
+func (r *Recorder) Close() {
+	if r == nil {
+		return
+	}
+	close(r.done)
+	r.wg.Wait()
+}
+
+// enqueue adds c to the write queue unless it is full
+func (r *Recorder) enqueue(c change) {
+	select {
+	case r.queue <- c:
+	default:
+		dropped.Inc()
+		r.log.WithField("message_id", c.record.ID).Warn("Message history queue full, dropping record")
+	}
+}
+
+// run applies queued changes and prunes expired records until Close
+func (r *Recorder) run(pruneInterval time.Duration) {
+	defer r.wg.Done()
+	ticker := time.NewTicker(pruneInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case c := <-r.queue:
+			r.apply(c)
+		case <-ticker.C:
+			r.prune()
+		case <-r.done:
+			for {
+				select {
+				case c := <-r.queue:
+					r.apply(c)
+				default:
+					r.writeMu.Lock()
+					if r.file != nil {
+						r.file.Close()
+						r.file = nil
+					}
+					r.writeMu.Unlock()
+					return
+				}
+			}
+		}
+	}
+}
+
+// apply stores a change in memory and appends the resulting record to the
+// file
+func (r *Recorder) apply(c change) {
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+
+	r.mu.Lock()
+	rec := c.record
+	if c.statusOnly {
+		existing, ok := r.records[rec.ID]
+		if !ok || !Supersedes(rec.Status, existing.Status) {
+			r.mu.Unlock()
+			return
+		}
+		existing.Status = rec.Status
+		existing.Error = rec.Error
+		existing.UpdatedAt = rec.UpdatedAt
+		rec = *existing
+	} else {
+		r.records[rec.ID] = &rec
+	}
+	r.mu.Unlock()
+
+	if r.file == nil {
+		return
+	}
+	line, err := r.encode(rec)
+	if err == nil {
+		_, err = r.file.Write(line)
+	}
+	if err != nil {
+		r.log.WithError(err).WithField("message_id", rec.ID).Error("Failed to write message history record")
+	}
+}
+
+// prune forgets records past the retention period
+func (r *Recorder) prune() {
+	cutoff := time.Now().Add(-r.retention)
+	removed, err := r.remove(func(rec *Record) bool { return rec.Timestamp.Before(cutoff) })
+	if removed > 0 {
+		r.log.WithField("removed", removed).Info("Pruned message history")
+	}
+	if err != nil {
+		r.log.WithError(err).Error("Failed to compact message history file")
+	}
+}
+
+// DeleteUser erases every record of the user, from memory and the file,
+// and returns how many there were
+func (r *Recorder) DeleteUser(userID string) (int, error) {
+	if r == nil {
+		return 0, nil
+	}
+	return r.remove(func(rec *Record) bool { return rec.UserID == userID })
+}
+
+// remove forgets the matching records and compacts the file without them
+func (r *Recorder) remove(match func(*Record) bool) (int, error) {
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+
+	removed := 0
+	r.mu.Lock()
+	for id, rec := range r.records {
+		if match(rec) {
+			delete(r.records, id)
+			removed++
+		}
+	}
+	r.mu.Unlock()
+
+	if removed == 0 || r.path == "" {
+		return removed, nil
+	}
+	return removed, r.compact()
+}
+
+// load reads the history file; later lines for an ID replace earlier ones
+func (r *Recorder) load() error {
+	f, err := os.Open(r.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open message history: %w", err)
+	}
+	defer f.Close()
+
+	cutoff := time.Now().Add(-r.retention)
+	skipped, sealed := 0, 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		rec, err := r.decode(scanner.Bytes())
+		if errors.Is(err, errSealed) {
+			sealed++
+			continue
+		}
+		if err != nil {
+			// e.g. a line cut short by a crash
+			skipped++
+			continue
+		}
+		if rec.Timestamp.Before(cutoff) {
+			delete(r.records, rec.ID)
+			continue
+		}
+		r.records[rec.ID] = &rec
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read message history: %w", err)
+	}
+	// Compacting would drop them, so refuse to start rather than lose them
+	if sealed > 0 {
+		return fmt.Errorf("%d message history records can't be decrypted with the configured DIFYGATE_HISTORY_ENCRYPTION_KEY or DIFYGATE_STORE_ENCRYPTION_KEY", sealed)
+	}
+	if skipped > 0 {
+		r.log.WithField("skipped", skipped).Warn("Skipped unreadable message history records")
+	}
+	return nil
+}
+
+// compact rewrites the file with only the current records and reopens it
+// for appending
+func (r *Recorder) compact() error {
+	tmp := r.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to create message history: %w", err)
+	}
+
+	w := bufio.NewWriter(f)
+	r.mu.RLock()
+	for _, rec := range r.records {
+		line, encErr := r.encode(*rec)
+		if encErr == nil {
+			_, encErr = w.Write(line)
+		}
+		if encErr != nil && err == nil {
+			err = encErr
+		}
+	}
+	r.mu.RUnlock()
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, r.path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write message history: %w", err)
+	}
+
+	file, err := os.OpenFile(r.path, os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open message history: %w", err)
+	}
+	if r.file != nil {
+		r.file.Close()
+	}
+	r.file = file
+	return nil
+}
+
+// encode renders rec as a line of the file
+func (r *Recorder) encode(rec Record) ([]byte, error) {
+	d := diskRecord{Record: rec}
+	if !r.keys.Empty() {
+		sealed, err := r.keys.Seal([]byte(rec.Text), []byte(rec.ID))
+		if err != nil {
+			return nil, err
+		}
+		d.Encrypted = string(sealed)
+		d.Text = ""
+	}
+	line, err := json.Marshal(d)
+	if err != nil {
+		return nil, err
+	}
+	return append(line, '\n'), nil
+}
+
+// decode parses a line of the file, opening a sealed text
+func (r *Recorder) decode(line []byte) (Record, error) {
+	var d diskRecord
+	if err := json.Unmarshal(line, &d); err != nil {
+		return Record{}, err
+	}
+	var text []byte
+	var err error
+	switch {
+	case d.Encrypted != "":
+		text, err = r.keys.Open([]byte(d.Encrypted), []byte(d.ID))
+	case d.Sealed != nil:
+		text, err = r.keys.OpenUnlabeled(d.Sealed, []byte(d.ID))
+	default:
+		return d.Record, nil
+	}
+	if err != nil {
+		return Record{}, fmt.Errorf("%w: %w", errSealed, err)
+	}
+	d.Text = string(text)
+	return d.Record, nil
+}
+
+// newID generates an ID for a record the platform gave none
+func newID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
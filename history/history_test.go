@@ -0,0 +1,169 @@
+package history
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/config"
+)
+
+func testConfig(path string) config.HistoryConfig {
+	return config.HistoryConfig{
+		Enabled:        true,
+		Path:           path,
+		Retention:      time.Hour,
+		PruneInterval:  time.Hour,
+		EncryptionKeys: []string{testKey(7)},
+	}
+}
+
+func testKey(b byte) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32))
+}
+
+func quietLogger() *logrus.Logger {
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	return log
+}
+
+func TestRecorderPersistsEncryptedRecords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	r, err := New(testConfig(path), quietLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Record(Record{ID: "wamid.IN", Channel: "whatsapp", UserID: "123", Direction: Inbound, Text: "secret question", Status: StatusReceived})
+	r.Record(Record{ID: "wamid.OUT", Channel: "whatsapp", UserID: "123", Direction: Outbound, Text: "answer", ReplyTo: "wamid.IN", Status: StatusSent})
+	r.UpdateStatus("wamid.OUT", StatusRead, "")
+	// A late "delivered" must not move the status back
+	r.UpdateStatus("wamid.OUT", StatusDelivered, "")
+	r.Close()
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(raw, []byte("secret question")) {
+		t.Error("message body stored in plain text")
+	}
+
+	r, err = New(testConfig(path), quietLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	in, err := r.Get("wamid.IN")
+	if err != nil || in.Text != "secret question" {
+		t.Errorf("reloaded inbound record = %+v, %v", in, err)
+	}
+	out, err := r.Get("wamid.OUT")
+	if err != nil || out.Status != StatusRead {
+		t.Errorf("reloaded outbound status = %q, %v; want read", out.Status, err)
+	}
+	if got := r.Find(Query{UserID: "123", Limit: 1}); len(got) != 1 || got[0].ID != "wamid.OUT" {
+		t.Errorf("Find = %+v, want only the newest record", got)
+	}
+	if got := r.Find(Query{Channel: "whatsapp", Status: StatusReceived}); len(got) != 1 || got[0].ID != "wamid.IN" {
+		t.Errorf("Find by channel and status = %+v, want the inbound record", got)
+	}
+	if got := r.Find(Query{Channel: "email"}); len(got) != 0 {
+		t.Errorf("Find by another channel = %+v, want nothing", got)
+	}
+}
+
+func TestRecorderRefusesRecordsItCantDecrypt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	r, err := New(testConfig(path), quietLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Record(Record{ID: "wamid.IN", UserID: "123", Text: "hello"})
+	r.Close()
+
+	cfg := testConfig(path)
+	cfg.EncryptionKeys = []string{testKey(8)}
+	if _, err := New(cfg, quietLogger()); err == nil {
+		t.Error("opened history encrypted with another key, which compaction would lose")
+	}
+}
+
+func TestRecorderRotatesKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	// A record from before keyrings: the nonce and text sealed by an
+	// unnamed key
+	block, _ := aes.NewCipher(bytes.Repeat([]byte{7}, 32))
+	aead, _ := cipher.NewGCM(block)
+	nonce := make([]byte, aead.NonceSize())
+	legacy, _ := json.Marshal(map[string]interface{}{
+		"id": "wamid.OLD", "user_id": "123", "timestamp": time.Now(),
+		"sealed": aead.Seal(nonce, nonce, []byte("old question"), []byte("wamid.OLD")),
+	})
+	os.WriteFile(path, append(legacy, '\n'), 0o600)
+
+	// The new key seals, the old one still opens
+	cfg := testConfig(path)
+	cfg.EncryptionKeys = []string{testKey(9), testKey(7)}
+	r, err := New(cfg, quietLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if old, err := r.Get("wamid.OLD"); err != nil || old.Text != "old question" {
+		t.Fatalf("legacy record = %+v, %v", old, err)
+	}
+	r.Record(Record{ID: "wamid.NEW", UserID: "123", Text: "new question"})
+	r.Close()
+
+	raw, _ := os.ReadFile(path)
+	if !bytes.Contains(raw, []byte(`"encrypted":"enc1:`)) || bytes.Contains(raw, []byte("question")) {
+		t.Errorf("history file %s, want texts sealed with a named key", raw)
+	}
+	// Compaction sealed every record with the new key
+	cfg.EncryptionKeys = []string{testKey(9)}
+	r, err = New(cfg, quietLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if rec, err := r.Get("wamid.OLD"); err != nil || rec.Text != "old question" {
+		t.Errorf("record after dropping the old key = %+v, %v", rec, err)
+	}
+}
+
+func TestRecorderPrunesExpiredRecords(t *testing.T) {
+	r, err := New(testConfig(""), quietLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Record(Record{ID: "old", UserID: "123", Timestamp: time.Now().Add(-2 * time.Hour)})
+	r.Record(Record{ID: "new", UserID: "123"})
+	// Closing writes the queue, leaving the records to prune
+	r.Close()
+
+	r.prune()
+	if _, err := r.Get("old"); err != ErrNotFound {
+		t.Errorf("expired record still found: %v", err)
+	}
+	if _, err := r.Get("new"); err != nil {
+		t.Errorf("current record lost: %v", err)
+	}
+}
+
+func TestNilRecorderRecordsNothing(t *testing.T) {
+	r, err := New(config.HistoryConfig{}, quietLogger())
+	if err != nil || r != nil {
+		t.Fatalf("New with history disabled = %v, %v; want nil", r, err)
+	}
+	r.Record(Record{ID: "x"})
+	r.UpdateStatus("x", StatusRead, "")
+	r.Close()
+}
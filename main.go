@@ -1,44 +1,209 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
-	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
 	"github.com/tracoco/DifyGate/config"
+	"github.com/tracoco/DifyGate/events"
 	"github.com/tracoco/DifyGate/gate"
 	"github.com/tracoco/DifyGate/gateapi"
+	"github.com/tracoco/DifyGate/history"
+	"github.com/tracoco/DifyGate/mock"
+	"github.com/tracoco/DifyGate/sentry"
+	"github.com/tracoco/DifyGate/version"
 )
 
 func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+// runServe runs the server until a termination signal, then shuts it down
+// gracefully and returns the process exit code
+func runServe(envFile string) int {
 	// Initialize logger
 	log := logrus.New()
 	log.SetFormatter(&logrus.JSONFormatter{})
 
-	// Check for API key
-	apiKey := os.Getenv("DIFYGATE_API_KEY")
-	if apiKey == "" {
-		log.Warn("DIFYGATE_API_KEY environment variable not set - API endpoints will not be securely protected")
-	}
-
 	// Load configuration
-	cfg, err := config.Load()
+	cfg, err := config.LoadEnvFile(envFile)
 	if err != nil {
 		log.WithError(err).Fatal("Failed to load configuration")
 	}
 
+	// Swap Dify and the Graph API for fakes before anything reads their
+	// settings
+	var mocks *mock.Servers
+	if cfg.Mock.Enabled {
+		mocks = mock.Start(cfg, log)
+		defer mocks.Close()
+	}
+
+	if err := cfg.Validate(); err != nil {
+		log.WithError(err).Fatal("Invalid configuration")
+	}
+
+	// Apply configured log level and format
+	if err := config.ConfigureLogger(log, cfg.Log); err != nil {
+		log.WithError(err).Warn("Invalid logging configuration, using defaults")
+	}
+
+	build := version.Get()
+	log.WithFields(logrus.Fields{
+		"version":    build.Version,
+		"git_sha":    build.GitSHA,
+		"build_date": build.BuildDate,
+		"go_version": build.GoVersion,
+	}).Info("Starting DifyGate")
+
+	// Report panics and upstream failures, if DIFYGATE_SENTRY_DSN is set
+	if err := sentry.Init(cfg.Sentry, log); err != nil {
+		log.WithError(err).Warn("Invalid Sentry configuration, not reporting errors")
+	}
+
+	// Check for API key
+	if len(cfg.Auth.EffectiveKeys()) == 0 && !cfg.Auth.JWT.Enabled() {
+		log.Warn("No API keys or JWT validation configured - protected API endpoints will reject every request")
+	}
+
 	// Initialize gate service
 	gateService := gate.NewService(cfg.DIFYGATE, log)
 
+	// Verify SMTP connectivity so bad credentials show up immediately
+	if err := gateService.Ping(); err != nil {
+		log.WithError(err).Error("SMTP connectivity check failed - emails will not be delivered")
+	} else {
+		log.WithField("smtp_host", cfg.DIFYGATE.Host).Info("SMTP connectivity check succeeded")
+	}
+
+	// Initialize shared store
+	kv, err := gateapi.NewStore(cfg.Store, log)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to open the store")
+	}
+	defer kv.Close()
+
+	// Start delivering outgoing webhooks
+	dispatcher := events.NewDispatcher(cfg.Webhooks, log)
+
+	// Start recording message history, if enabled
+	recorder, err := history.New(cfg.History, log)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to open message history")
+	}
+
 	// Initialize Gin router
-	router := gin.Default()
+	router := gateapi.NewRouter(cfg.Server, log)
 
-	// Register API routes
-	gateapi.RegisterRoutes(router, gateService, log)
+	// Register API routes on a configuration that SIGHUP and
+	// POST /api/v1/admin/reload load again
+	reloader := gateapi.NewReloader(cfg, func() (*config.Config, error) {
+		reloaded, err := config.LoadEnvFile(envFile)
+		if err == nil && mocks != nil {
+			mocks.Configure(reloaded)
+		}
+		return reloaded, err
+	}, log)
+	readiness := gateapi.NewReadiness(cfg, log)
+	gateapi.RegisterRoutes(router, reloader, gateService, kv, dispatcher, recorder, readiness, log)
+	if mocks != nil {
+		gateapi.RegisterMockRoutes(router, mocks)
+	}
+
+	srv := &http.Server{
+		Addr:              cfg.Server.Addr(),
+		Handler:           router,
+		ReadHeaderTimeout: cfg.Server.ReadHeaderTimeout,
+		ReadTimeout:       cfg.Server.ReadTimeout,
+		WriteTimeout:      cfg.Server.WriteTimeout,
+		IdleTimeout:       cfg.Server.IdleTimeout,
+	}
+
+	challengeSrv, err := configureTLS(srv, cfg.TLS, cfg.Server.BindAddr)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to configure TLS")
+	}
+
+	// Start the ACME challenge and redirect listener when using autocert
+	if challengeSrv != nil {
+		go func() {
+			log.WithField("addr", challengeSrv.Addr).Info("Starting ACME challenge listener")
+			if err := challengeSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.WithError(err).Fatal("ACME challenge listener failed to start")
+			}
+		}()
+	}
+
+	// Start the profiling listener, kept off the main port
+	var debugSrv *http.Server
+	if cfg.Debug.EnablePprof && cfg.Debug.Port != 0 {
+		debugSrv = &http.Server{
+			Addr:              cfg.Debug.Addr(),
+			Handler:           gateapi.NewDebugRouter(cfg.Server, log),
+			ReadHeaderTimeout: cfg.Server.ReadHeaderTimeout,
+		}
+		go func() {
+			log.WithField("addr", debugSrv.Addr).Warn("Starting pprof listener without authentication")
+			if err := debugSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.WithError(err).Error("pprof listener failed")
+			}
+		}()
+	}
 
 	// Start the server
-	log.WithField("port", 6001).Info("Starting server")
-	if err := router.Run(":6001"); err != nil {
-		log.WithError(err).Fatal("Server failed to start")
+	go func() {
+		var err error
+		if srv.TLSConfig != nil {
+			log.WithFields(logrus.Fields{"addr": srv.Addr, "tls": true}).Info("Starting server")
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			log.WithField("addr", srv.Addr).Info("Starting server")
+			err = srv.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.WithError(err).Fatal("Server failed to start")
+		}
+	}()
+
+	// Reload the configuration on SIGHUP; Reload logs the outcome
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.Info("SIGHUP received, reloading configuration")
+			_, _ = reloader.Reload()
+		}
+	}()
+
+	// Wait for a termination signal, then drain and shut down gracefully
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-quit
+	log.WithField("signal", sig.String()).Info("Shutdown signal received")
+
+	readiness.StartDraining()
+	time.Sleep(cfg.Server.ShutdownDrain)
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	defer cancel()
+	if challengeSrv != nil {
+		_ = challengeSrv.Shutdown(ctx)
+	}
+	if debugSrv != nil {
+		_ = debugSrv.Close()
+	}
+	if err := srv.Shutdown(ctx); err != nil {
+		log.WithError(err).Error("Server shutdown did not complete cleanly")
 	}
+	dispatcher.Close(ctx)
+	sentry.Flush(ctx)
+	recorder.Close()
+	log.Info("Server stopped")
+	return 0
 }
@@ -0,0 +1,161 @@
+package mock
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tracoco/DifyGate/config"
+)
+
+// Dify is a fake Dify chat app. It answers every query with the configured
+// answer, streamed word by word like Dify's SSE responses.
+type Dify struct {
+	cfg config.MockConfig
+	mux *http.ServeMux
+}
+
+// NewDify creates a fake Dify answering as cfg says
+func NewDify(cfg config.MockConfig) *Dify {
+	d := &Dify{cfg: cfg, mux: http.NewServeMux()}
+	d.mux.HandleFunc("/v1/chat-messages", d.chatMessages)
+	d.mux.HandleFunc("/v1/parameters", d.parameters)
+	d.mux.HandleFunc("/v1/conversations/", d.conversation)
+	return d
+}
+
+// ServeHTTP checks the API key like Dify, then routes the request
+func (d *Dify) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		difyError(w, http.StatusUnauthorized, "unauthorized", "Access token is invalid")
+		return
+	}
+	d.mux.ServeHTTP(w, r)
+}
+
+// chatRequest is the part of a chat-messages request the fake reads
+type chatRequest struct {
+	Query          string `json:"query"`
+	ResponseMode   string `json:"response_mode"`
+	User           string `json:"user"`
+	ConversationID string `json:"conversation_id"`
+}
+
+// chatEvent is one event of a streamed answer, or the blocking response
+type chatEvent struct {
+	Event          string                 `json:"event"`
+	TaskID         string                 `json:"task_id"`
+	ID             string                 `json:"id"`
+	MessageID      string                 `json:"message_id"`
+	ConversationID string                 `json:"conversation_id"`
+	Mode           string                 `json:"mode,omitempty"`
+	Answer         string                 `json:"answer,omitempty"`
+	Metadata       map[string]interface{} `json:"metadata,omitempty"`
+	CreatedAt      int64                  `json:"created_at"`
+}
+
+func (d *Dify) chatMessages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		difyError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+		return
+	}
+	var req chatRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Query == "" || req.User == "" {
+		difyError(w, http.StatusBadRequest, "invalid_param", "query and user are required")
+		return
+	}
+
+	answer := strings.ReplaceAll(d.cfg.Answer, "{query}", req.Query)
+	base := chatEvent{
+		TaskID:         newID("mock-task-"),
+		MessageID:      newID("mock-message-"),
+		ConversationID: req.ConversationID,
+		CreatedAt:      time.Now().Unix(),
+	}
+	base.ID = base.MessageID
+	if base.ConversationID == "" {
+		base.ConversationID = newID("mock-conversation-")
+	}
+	end := base
+	end.Event = "message_end"
+	end.Metadata = map[string]interface{}{"usage": map[string]int{
+		"prompt_tokens":     len(strings.Fields(req.Query)),
+		"completion_tokens": len(strings.Fields(answer)),
+		"total_tokens":      len(strings.Fields(req.Query)) + len(strings.Fields(answer)),
+	}}
+
+	if !sleep(r, d.cfg.Delay) {
+		return
+	}
+	if req.ResponseMode != "streaming" {
+		resp := end
+		resp.Event = "message"
+		resp.Mode = "chat"
+		resp.Answer = answer
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	flusher, _ := w.(http.Flusher)
+	write := func(event string) {
+		fmt.Fprint(w, event)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	write("event: ping\n\n")
+	for i, chunk := range strings.SplitAfter(answer, " ") {
+		if i > 0 && !sleep(r, d.cfg.ChunkDelay) {
+			return
+		}
+		event := base
+		event.Event = "message"
+		event.Answer = chunk
+		data, _ := json.Marshal(event)
+		write("data: " + string(data) + "\n\n")
+	}
+	data, _ := json.Marshal(end)
+	write("data: " + string(data) + "\n\n")
+}
+
+func (d *Dify) parameters(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"opening_statement": "",
+		"user_input_form":   []interface{}{},
+	})
+}
+
+func (d *Dify) conversation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		difyError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"result": "success"})
+}
+
+// difyError answers with an error shaped like Dify's
+func difyError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"code": code, "message": message, "status": status})
+}
+
+// sleep waits for d, returning false when the client goes away first
+func sleep(r *http.Request, d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	select {
+	case <-r.Context().Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
@@ -0,0 +1,187 @@
+package mock
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxSent bounds the messages a Graph keeps; older ones are dropped
+const maxSent = 1000
+
+// SentMessage is a message sent through the fake Graph API
+type SentMessage struct {
+	ID string `json:"id"`
+	// Channel is whatsapp or messenger
+	Channel string `json:"channel"`
+	// From is the WhatsApp phone number ID sent from; empty for Messenger
+	From string `json:"from,omitempty"`
+	// To is the WhatsApp number or Messenger PSID sent to
+	To   string `json:"to"`
+	Type string `json:"type"`
+	// Text is the body of text messages
+	Text string `json:"text,omitempty"`
+	// Payload is the request body as sent
+	Payload json.RawMessage `json:"payload"`
+	SentAt  time.Time       `json:"sent_at"`
+}
+
+// Graph is a fake Graph API. It accepts every WhatsApp and Messenger send
+// and keeps them for inspection.
+type Graph struct {
+	mu   sync.Mutex
+	sent []SentMessage
+}
+
+// NewGraph creates an empty fake Graph API
+func NewGraph() *Graph {
+	return &Graph{}
+}
+
+// Sent returns the messages sent so far, oldest first
+func (g *Graph) Sent() []SentMessage {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]SentMessage{}, g.sent...)
+}
+
+// Reset forgets the messages sent so far
+func (g *Graph) Reset() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.sent = nil
+}
+
+func (g *Graph) record(m SentMessage) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.sent = append(g.sent, m)
+	if len(g.sent) > maxSent {
+		g.sent = g.sent[len(g.sent)-maxSent:]
+	}
+}
+
+// ServeHTTP answers /{version}/{resource}[/{edge}] like the Graph API
+func (g *Graph) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		graphError(w, http.StatusUnauthorized, 190, "Invalid OAuth access token.")
+		return
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 2 && r.Method == http.MethodGet:
+		writeJSON(w, map[string]string{"id": parts[1], "verified_name": "DifyGate Mock"})
+	case len(parts) == 3 && parts[2] == "media" && r.Method == http.MethodPost:
+		writeJSON(w, map[string]string{"id": newID("mock-media-")})
+	case len(parts) == 3 && parts[1] == "me" && parts[2] == "messages" && r.Method == http.MethodPost:
+		g.messengerMessage(w, r)
+	case len(parts) == 3 && parts[2] == "messages" && r.Method == http.MethodPost:
+		g.whatsAppMessage(w, r, parts[1])
+	default:
+		graphError(w, http.StatusBadRequest, 100, "Unsupported request to the mock Graph API")
+	}
+}
+
+func (g *Graph) whatsAppMessage(w http.ResponseWriter, r *http.Request, phoneNumberID string) {
+	body, _ := io.ReadAll(r.Body)
+	var msg struct {
+		Status string `json:"status"`
+		To     string `json:"to"`
+		Type   string `json:"type"`
+		Text   struct {
+			Body string `json:"body"`
+		} `json:"text"`
+	}
+	if err := json.Unmarshal(body, &msg); err != nil {
+		graphError(w, http.StatusBadRequest, 100, "Invalid JSON")
+		return
+	}
+	// Read receipts aren't messages
+	if msg.Status == "read" {
+		writeJSON(w, map[string]bool{"success": true})
+		return
+	}
+	if msg.To == "" {
+		graphError(w, http.StatusBadRequest, 100, "The parameter to is required.")
+		return
+	}
+
+	// Like the Graph API, a message without a type is text
+	if msg.Type == "" {
+		msg.Type = "text"
+	}
+	id := newID("wamid.mock-")
+	g.record(SentMessage{
+		ID:      id,
+		Channel: "whatsapp",
+		From:    phoneNumberID,
+		To:      msg.To,
+		Type:    msg.Type,
+		Text:    msg.Text.Body,
+		Payload: body,
+		SentAt:  time.Now().UTC(),
+	})
+	writeJSON(w, map[string]interface{}{
+		"messaging_product": "whatsapp",
+		"contacts":          []map[string]string{{"input": msg.To, "wa_id": msg.To}},
+		"messages":          []map[string]string{{"id": id}},
+	})
+}
+
+func (g *Graph) messengerMessage(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	var msg struct {
+		Recipient struct {
+			ID string `json:"id"`
+		} `json:"recipient"`
+		SenderAction string `json:"sender_action"`
+		Message      struct {
+			Text string `json:"text"`
+		} `json:"message"`
+	}
+	if err := json.Unmarshal(body, &msg); err != nil || msg.Recipient.ID == "" {
+		graphError(w, http.StatusBadRequest, 100, "The parameter recipient is required.")
+		return
+	}
+	// Typing indicators and seen marks aren't messages
+	if msg.SenderAction != "" {
+		writeJSON(w, map[string]string{"recipient_id": msg.Recipient.ID})
+		return
+	}
+
+	id := newID("m_mock-")
+	typ := "attachment"
+	if msg.Message.Text != "" {
+		typ = "text"
+	}
+	g.record(SentMessage{
+		ID:      id,
+		Channel: "messenger",
+		To:      msg.Recipient.ID,
+		Type:    typ,
+		Text:    msg.Message.Text,
+		Payload: body,
+		SentAt:  time.Now().UTC(),
+	})
+	writeJSON(w, map[string]string{"recipient_id": msg.Recipient.ID, "message_id": id})
+}
+
+// graphError answers with an error shaped like the Graph API's
+func graphError(w http.ResponseWriter, status, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": map[string]interface{}{
+		"message":    message,
+		"type":       "OAuthException",
+		"code":       code,
+		"fbtrace_id": "mock",
+	}})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
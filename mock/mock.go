@@ -0,0 +1,82 @@
+// Package mock provides fake Dify and Graph API backends for local
+// development and integration tests. They are served over HTTP and the
+// gateway is pointed at them through its base URLs, so every request takes
+// the same path as against the real services.
+package mock
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/config"
+)
+
+// Credentials used in mock mode for settings left unset, so the gateway
+// is ready without real accounts
+const (
+	DifyAPIKey    = "mock-dify-key"
+	GraphAPIToken = "mock-graph-token"
+	AppSecret     = "mock-app-secret"
+	PhoneNumberID = "mock-phone-number-id"
+)
+
+// Servers are the running fakes
+type Servers struct {
+	Dify  *Dify
+	Graph *Graph
+
+	difyServer  *httptest.Server
+	graphServer *httptest.Server
+}
+
+// Start serves the fakes on local ports and points cfg at them, filling in
+// the credentials it lacks
+func Start(cfg *config.Config, log *logrus.Logger) *Servers {
+	s := &Servers{
+		Dify:  NewDify(cfg.Mock),
+		Graph: NewGraph(),
+	}
+	s.difyServer = httptest.NewServer(s.Dify)
+	s.graphServer = httptest.NewServer(s.Graph)
+	s.Configure(cfg)
+
+	log.WithFields(logrus.Fields{
+		"dify_base_url":      cfg.Dify.BaseURL,
+		"graph_api_base_url": cfg.WhatsApp.GraphAPIBaseURL,
+	}).Warn("Mock mode: Dify and the Graph API are replaced by built-in fakes")
+	return s
+}
+
+// Configure points cfg at the fakes, as Start did with the configuration
+// it was given; a reloaded configuration needs it again
+func (s *Servers) Configure(cfg *config.Config) {
+	// Dify's base URL includes the API version
+	cfg.Dify.BaseURL = s.difyServer.URL + "/v1"
+	cfg.WhatsApp.GraphAPIBaseURL = s.graphServer.URL
+	setDefault(&cfg.Dify.APIKey, DifyAPIKey)
+	setDefault(&cfg.WhatsApp.GraphAPIToken, GraphAPIToken)
+	setDefault(&cfg.WhatsApp.AppSecret, AppSecret)
+	setDefault(&cfg.WhatsApp.PhoneNumberID, PhoneNumberID)
+}
+
+// Close stops the fakes
+func (s *Servers) Close() {
+	s.difyServer.Close()
+	s.graphServer.Close()
+}
+
+func setDefault(value *string, def string) {
+	if *value == "" {
+		*value = def
+	}
+}
+
+// ids numbers the IDs the fakes hand out
+var ids atomic.Int64
+
+// newID returns a unique ID with prefix
+func newID(prefix string) string {
+	return fmt.Sprintf("%s%d", prefix, ids.Add(1))
+}
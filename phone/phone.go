@@ -0,0 +1,73 @@
+// Package phone normalizes phone numbers to the one form the gateway
+// stores and compares them in: E.164 digits without the +, as WhatsApp
+// reports senders, e.g. 4915112345678
+package phone
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// E.164 numbers have at most 15 digits; shorter than 7 is no real
+// international number
+const (
+	minDigits = 7
+	maxDigits = 15
+)
+
+// ErrNational is returned for a number given without its country code
+var ErrNational = errors.New("the country code is missing, e.g. +49 for Germany")
+
+// Normalize returns number in canonical form. It takes the international
+// format with a +, a 00 prefix or neither, with any spaces, dashes, dots,
+// slashes or brackets between the digits, so "+49 (151) 123-45678",
+// "004915112345678" and "4915112345678" are all 4915112345678. The
+// national trunk prefix written in brackets after the country code, as in
+// "+49 (0) 151 12345678", is dropped. National numbers, starting with a
+// single 0, can't be told apart across countries and are refused with
+// ErrNational.
+func Normalize(number string) (string, error) {
+	var b strings.Builder
+	s := strings.TrimSpace(number)
+	// A bracketed 0 after the country code is the trunk prefix, dialled
+	// within the country only
+	if i := strings.Index(s, "(0)"); i > 0 && strings.ContainsAny(s[:i], "0123456789") {
+		s = s[:i] + s[i+len("(0)"):]
+	}
+	switch {
+	case strings.HasPrefix(s, "+"):
+		s = s[1:]
+	case strings.HasPrefix(s, "00"):
+		s = s[2:]
+	case strings.HasPrefix(s, "0"):
+		return "", fmt.Errorf("phone number %q: %w", number, ErrNational)
+	}
+	for _, r := range s {
+		switch {
+		case r >= '0' && r <= '9':
+			b.WriteRune(r)
+		case r == ' ' || r == '-' || r == '.' || r == '/' || r == '(' || r == ')' || r == '\u00a0':
+		default:
+			return "", fmt.Errorf("phone number %q: %q is not a digit", number, r)
+		}
+	}
+	digits := b.String()
+	switch {
+	case len(digits) < minDigits || len(digits) > maxDigits:
+		return "", fmt.Errorf("phone number %q: must have %d to %d digits with the country code", number, minDigits, maxDigits)
+	case digits[0] == '0':
+		return "", fmt.Errorf("phone number %q: %w", number, ErrNational)
+	}
+	return digits, nil
+}
+
+// Lenient is number in canonical form or, when it can't be normalized, as
+// given without surrounding space and a leading +. It matches numbers kept
+// before normalization, which may not all be valid.
+func Lenient(number string) string {
+	if n, err := Normalize(number); err == nil {
+		return n
+	}
+	return strings.TrimPrefix(strings.TrimSpace(number), "+")
+}
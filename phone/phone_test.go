@@ -0,0 +1,76 @@
+package phone
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		number string
+		want   string
+		err    error
+	}{
+		{"+4915112345678", "4915112345678", nil},
+		{"004915112345678", "4915112345678", nil},
+		{"4915112345678", "4915112345678", nil},
+		{"  +49 151 12345678 ", "4915112345678", nil},
+		{"+49 (151) 123-45678", "4915112345678", nil},
+		{"+49.151/123.456.78", "4915112345678", nil},
+		{"+49 151 12345678", "4915112345678", nil},
+		{"+1 (555) 123-4567", "15551234567", nil},
+		// The trunk prefix in brackets after the country code
+		{"+49 (0) 151 12345678", "4915112345678", nil},
+		{"+49(0)15112345678", "4915112345678", nil},
+		{"0049 (0)151 12345678", "4915112345678", nil},
+		{"+44 (0)20 7946 0958", "442079460958", nil},
+		// but not in place of one
+		{"(0)151 12345678", "", ErrNational},
+		{"015112345678", "", ErrNational},
+		{"0 151 12345678", "", ErrNational},
+		{"+0151 12345678", "", ErrNational},
+		{"1234567", "1234567", nil},
+		{"123456789012345", "123456789012345", nil},
+	}
+	for _, tt := range tests {
+		got, err := Normalize(tt.number)
+		if got != tt.want || !errors.Is(err, tt.err) || (tt.err == nil) != (err == nil) {
+			t.Errorf("Normalize(%q) = %q, %v; want %q, %v", tt.number, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestNormalizeRefusesNonNumbers(t *testing.T) {
+	for _, number := range []string{
+		"",
+		"+",
+		"123456",           // too short
+		"1234567890123456", // too long
+		"+49 151 1234567x",
+		"+49 151*",
+		"tel:+4915112345678",
+	} {
+		if got, err := Normalize(number); err == nil {
+			t.Errorf("Normalize(%q) = %q, want an error", number, got)
+		}
+	}
+}
+
+func TestLenient(t *testing.T) {
+	tests := []struct {
+		number string
+		want   string
+	}{
+		{"+49 (0) 151 12345678", "4915112345678"},
+		{"004915112345678", "4915112345678"},
+		// Numbers that can't be normalized are kept as given
+		{" +12345 ", "12345"},
+		{"015112345678", "015112345678"},
+		{"whatsapp-user", "whatsapp-user"},
+	}
+	for _, tt := range tests {
+		if got := Lenient(tt.number); got != tt.want {
+			t.Errorf("Lenient(%q) = %q, want %q", tt.number, got, tt.want)
+		}
+	}
+}
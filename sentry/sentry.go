@@ -0,0 +1,450 @@
+// Package sentry reports panics and failures needing an operator to Sentry,
+// or any service accepting its envelope protocol. Events are queued and sent
+// in the background, so reporting never waits on the network; until Init is
+// called with a DSN, every function does nothing.
+package sentry
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tracoco/DifyGate/config"
+	"github.com/tracoco/DifyGate/metrics"
+	"github.com/tracoco/DifyGate/version"
+)
+
+// Levels of an event
+const (
+	LevelError   = "error"
+	LevelWarning = "warning"
+	LevelFatal   = "fatal"
+)
+
+const (
+	// queueSize is how many events wait to be sent; later ones are dropped
+	queueSize = 100
+	// repeatInterval is how long events with the same fingerprint are
+	// dropped after one is sent, so a failure on every request doesn't
+	// use up the project's quota
+	repeatInterval = time.Minute
+	// defaultRetryAfter is how long Sentry is left alone after a 429
+	// without Retry-After
+	defaultRetryAfter = time.Minute
+	// sdkName identifies the client to Sentry
+	sdkName = "difygate"
+)
+
+var (
+	// events counts events by outcome: sent, failed, dropped (queue full
+	// or rate limited) or repeated (a fingerprint sent recently)
+	events = metrics.NewCounter("difygate_sentry_events_total",
+		"Events reported to Sentry, by outcome", "outcome")
+
+	emailPattern = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)
+	phonePattern = regexp.MustCompile(`\+?\d[\d\s().-]{6,}\d`)
+)
+
+// Event is a failure to report
+type Event struct {
+	// Level is LevelError unless set
+	Level string
+	// Message says what failed; it is scrubbed of email addresses and
+	// phone numbers, so it may quote an error
+	Message string
+	// Err is the error behind the event, if any; its text is scrubbed too
+	Err error
+	// Tags index the event in Sentry, e.g. channel or error code; they are
+	// sent as they are, so they must not hold personal data
+	Tags map[string]string
+	// Fingerprint groups the event in Sentry and throttles repeats;
+	// empty uses the message
+	Fingerprint []string
+	// Request is the API request that failed, if any
+	Request *http.Request
+	// stack are the frames of a panic, innermost last
+	stack []frame
+}
+
+// frame is a stack frame in Sentry's format
+type frame struct {
+	Function string `json:"function"`
+	Module   string `json:"module,omitempty"`
+	Filename string `json:"filename"`
+	AbsPath  string `json:"abs_path"`
+	Lineno   int    `json:"lineno"`
+	InApp    bool   `json:"in_app"`
+}
+
+// client sends events to one DSN
+type client struct {
+	endpoint    string
+	auth        string
+	environment string
+	release     string
+	serverName  string
+	http        *http.Client
+	log         *logrus.Logger
+	queue       chan []byte
+
+	mu   sync.Mutex
+	seen map[string]time.Time
+	// until is when Sentry accepts events again after a 429
+	until   time.Time
+	pending sync.WaitGroup
+}
+
+// current is the client of Init; nil reports nothing
+var current atomic.Pointer[client]
+
+// transport holds the roundTripper set by UseTransport
+var transport atomic.Value
+
+// roundTripper wraps the transport of UseTransport, as an atomic.Value
+// takes one concrete type
+type roundTripper struct{ http.RoundTripper }
+
+// UseTransport sends events through rt, e.g. to reach Sentry through the
+// gateway's outbound proxy, including from a client Init started earlier;
+// nil goes back to http.DefaultTransport
+func UseTransport(rt http.RoundTripper) {
+	transport.Store(roundTripper{rt})
+}
+
+// eventTransport sends with the transport of UseTransport
+type eventTransport struct{}
+
+func (eventTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if rt, _ := transport.Load().(roundTripper); rt.RoundTripper != nil {
+		return rt.RoundTrip(req)
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// Init starts reporting to cfg.DSN, replacing an earlier client; an empty
+// DSN stops reporting
+func Init(cfg config.SentryConfig, log *logrus.Logger) error {
+	if cfg.DSN == "" {
+		current.Store(nil)
+		return nil
+	}
+	endpoint, key, err := parseDSN(cfg.DSN)
+	if err != nil {
+		return err
+	}
+	host, _ := os.Hostname()
+	c := &client{
+		endpoint:    endpoint,
+		auth:        fmt.Sprintf("Sentry sentry_version=7, sentry_client=%s/%s, sentry_key=%s", sdkName, version.Get().Version, key),
+		environment: cfg.Environment,
+		release:     version.Get().Version,
+		serverName:  host,
+		http:        &http.Client{Transport: eventTransport{}, Timeout: 10 * time.Second},
+		log:         log,
+		queue:       make(chan []byte, queueSize),
+		seen:        make(map[string]time.Time),
+	}
+	go c.run()
+	current.Store(c)
+	log.WithField("environment", cfg.Environment).Info("Error reporting to Sentry enabled")
+	return nil
+}
+
+// Enabled reports whether events are sent anywhere
+func Enabled() bool {
+	return current.Load() != nil
+}
+
+// parseDSN returns the envelope endpoint and public key of a DSN such as
+// https://<key>@o0.ingest.sentry.io/<project>
+func parseDSN(dsn string) (endpoint, key string, err error) {
+	u, err := url.Parse(dsn)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.User == nil || u.User.Username() == "" || u.Host == "" {
+		return "", "", errors.New("sentry: DSN must look like https://<key>@<host>/<project>")
+	}
+	path := strings.Trim(u.Path, "/")
+	i := strings.LastIndex(path, "/")
+	prefix, project := "", path
+	if i >= 0 {
+		prefix, project = "/"+path[:i], path[i+1:]
+	}
+	if project == "" {
+		return "", "", errors.New("sentry: DSN has no project ID")
+	}
+	return fmt.Sprintf("%s://%s%s/api/%s/envelope/", u.Scheme, u.Host, prefix, project), u.User.Username(), nil
+}
+
+// Capture queues e without blocking
+func Capture(e Event) {
+	c := current.Load()
+	if c == nil {
+		return
+	}
+	c.capture(e)
+}
+
+// CapturePanic queues a recovered panic with the stack it unwound; call it
+// from the deferred function that recovered
+func CapturePanic(rec interface{}, e Event) {
+	c := current.Load()
+	if c == nil {
+		return
+	}
+	// Skip runtime.Callers, this function and the deferred caller
+	pcs := make([]uintptr, 64)
+	n := runtime.Callers(3, pcs)
+	e.stack = frames(pcs[:n])
+	if e.Level == "" {
+		e.Level = LevelFatal
+	}
+	if e.Message == "" {
+		e.Message = fmt.Sprintf("panic: %v", rec)
+	}
+	c.capture(e)
+}
+
+// Flush waits, until ctx is done, for the events queued to be sent, for
+// shutdown
+func Flush(ctx context.Context) {
+	c := current.Load()
+	if c == nil {
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		c.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+// Scrub replaces email addresses and phone numbers in s, as events leave
+// the gateway
+func Scrub(s string) string {
+	s = emailPattern.ReplaceAllString(s, "[email]")
+	return phonePattern.ReplaceAllString(s, "[phone]")
+}
+
+// capture builds e and queues it, unless it repeats one sent recently
+func (c *client) capture(e Event) {
+	if e.Level == "" {
+		e.Level = LevelError
+	}
+	fingerprint := e.Fingerprint
+	if len(fingerprint) == 0 {
+		fingerprint = []string{Scrub(e.Message)}
+	}
+	key := strings.Join(fingerprint, "\x00")
+	now := time.Now()
+	c.mu.Lock()
+	if now.Before(c.until) {
+		c.mu.Unlock()
+		events.Inc("dropped")
+		return
+	}
+	if last, ok := c.seen[key]; ok && now.Sub(last) < repeatInterval {
+		c.mu.Unlock()
+		events.Inc("repeated")
+		return
+	}
+	c.seen[key] = now
+	for k, t := range c.seen {
+		if now.Sub(t) >= repeatInterval {
+			delete(c.seen, k)
+		}
+	}
+	c.mu.Unlock()
+
+	body, err := c.envelope(e, fingerprint, now)
+	if err != nil {
+		c.log.WithError(err).Warn("Failed to encode the Sentry event")
+		return
+	}
+	c.pending.Add(1)
+	select {
+	case c.queue <- body:
+	default:
+		c.pending.Done()
+		events.Inc("dropped")
+	}
+}
+
+// envelope encodes e as a Sentry envelope holding one event
+func (c *client) envelope(e Event, fingerprint []string, now time.Time) ([]byte, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	event := map[string]interface{}{
+		"event_id":    hex.EncodeToString(id),
+		"timestamp":   now.UTC().Format(time.RFC3339Nano),
+		"level":       e.Level,
+		"platform":    "go",
+		"logger":      sdkName,
+		"server_name": c.serverName,
+		"release":     c.release,
+		"message":     map[string]string{"formatted": Scrub(e.Message)},
+		"fingerprint": fingerprint,
+		"sdk":         map[string]string{"name": sdkName, "version": c.release},
+		"contexts": map[string]interface{}{
+			"runtime": map[string]string{"name": "go", "version": runtime.Version()},
+		},
+	}
+	if c.environment != "" {
+		event["environment"] = c.environment
+	}
+	if len(e.Tags) > 0 {
+		event["tags"] = e.Tags
+	}
+	if e.Err != nil || len(e.stack) > 0 {
+		exception := map[string]interface{}{"type": "panic", "value": Scrub(e.Message)}
+		if e.Err != nil {
+			exception["type"] = errorType(e.Err)
+			exception["value"] = Scrub(e.Err.Error())
+		}
+		if len(e.stack) > 0 {
+			exception["stacktrace"] = map[string]interface{}{"frames": e.stack}
+		}
+		event["exception"] = map[string]interface{}{"values": []interface{}{exception}}
+	}
+	if r := e.Request; r != nil {
+		// The query and body may hold personal data, so only the route is sent
+		event["request"] = map[string]string{"method": r.Method, "url": Scrub(r.URL.Path)}
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	header, _ := json.Marshal(map[string]string{"event_id": event["event_id"].(string), "sent_at": now.UTC().Format(time.RFC3339Nano)})
+	b.Write(header)
+	b.WriteString("\n")
+	item, _ := json.Marshal(map[string]interface{}{"type": "event", "length": len(payload)})
+	b.Write(item)
+	b.WriteString("\n")
+	b.Write(payload)
+	b.WriteString("\n")
+	return b.Bytes(), nil
+}
+
+// run sends queued events one at a time
+func (c *client) run() {
+	for body := range c.queue {
+		c.send(body)
+		c.pending.Done()
+	}
+}
+
+// send POSTs one envelope, backing off when Sentry rate limits
+func (c *client) send(body []byte) {
+	req, err := http.NewRequest(http.MethodPost, c.endpoint, bytes.NewReader(body))
+	if err != nil {
+		events.Inc("failed")
+		return
+	}
+	req.Header.Set("Content-Type", "application/x-sentry-envelope")
+	req.Header.Set("X-Sentry-Auth", c.auth)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		events.Inc("failed")
+		c.log.WithError(err).Warn("Failed to send an event to Sentry")
+		return
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		wait := defaultRetryAfter
+		if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs > 0 {
+			wait = time.Duration(secs) * time.Second
+		}
+		c.mu.Lock()
+		c.until = time.Now().Add(wait)
+		c.mu.Unlock()
+		events.Inc("dropped")
+		c.log.WithField("retry_after", wait.String()).Warn("Sentry is rate limiting events, dropping them for a while")
+	case resp.StatusCode >= 300:
+		events.Inc("failed")
+		c.log.WithField("status", resp.StatusCode).Warn("Sentry refused an event")
+	default:
+		events.Inc("sent")
+	}
+}
+
+// errorType names the type of the innermost error err wraps
+func errorType(err error) string {
+	for {
+		next := errors.Unwrap(err)
+		if next == nil {
+			return fmt.Sprintf("%T", err)
+		}
+		err = next
+	}
+}
+
+// frames converts program counters to Sentry frames, outermost first as
+// Sentry expects
+func frames(pcs []uintptr) []frame {
+	var out []frame
+	iter := runtime.CallersFrames(pcs)
+	for {
+		f, more := iter.Next()
+		module, function := splitFunction(f.Function)
+		out = append(out, frame{
+			Function: function,
+			Module:   module,
+			Filename: shortFile(f.File),
+			AbsPath:  f.File,
+			Lineno:   f.Line,
+			InApp:    strings.HasPrefix(f.Function, "github.com/tracoco/DifyGate"),
+		})
+		if !more {
+			break
+		}
+	}
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return out
+}
+
+// splitFunction splits a function name such as
+// github.com/x/y/pkg.(*T).Method into its package and the rest
+func splitFunction(name string) (module, function string) {
+	slash := strings.LastIndex(name, "/")
+	dot := strings.Index(name[slash+1:], ".")
+	if dot < 0 {
+		return "", name
+	}
+	return name[:slash+1+dot], name[slash+1+dot+1:]
+}
+
+// shortFile is the file's name relative to its module, as far as can be
+// told from the path
+func shortFile(path string) string {
+	if i := strings.Index(path, "/DifyGate/"); i >= 0 {
+		return path[i+len("/DifyGate/"):]
+	}
+	if i := strings.LastIndex(path, "/"); i >= 0 {
+		return path[i+1:]
+	}
+	return path
+}
@@ -0,0 +1,68 @@
+package store
+
+import (
+	"fmt"
+	"path"
+	"time"
+)
+
+// EncryptedStore seals the values of sensitive keys with AES-256-GCM
+// before they reach the backend, so customer data doesn't sit in Redis or
+// on disk in plain text. Each value gets a random nonce and is bound to its
+// key, and names the encryption key that sealed it, so keys can be
+// rotated: the first key seals and every key opens. Values written before
+// encryption was turned on are returned as they are and sealed when next
+// written. Counters and key names aren't encrypted.
+type EncryptedStore struct {
+	Store
+	keys *Keyring
+	// patterns are the globs of the keys whose values are sealed
+	patterns []string
+}
+
+// NewEncryptedStore wraps inner, sealing the values of keys matching
+// patterns with keys, base64 AES-256 keys of which the first encrypts.
+// With no keys nothing is sealed, but sealed values are still refused
+// with ErrSealed rather than handed out as ciphertext.
+func NewEncryptedStore(inner Store, keys []string, patterns []string) (*EncryptedStore, error) {
+	keyring, err := NewKeyring("store", keys)
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptedStore{Store: inner, keys: keyring, patterns: patterns}, nil
+}
+
+// sensitive reports whether the value of key is sealed
+func (s *EncryptedStore) sensitive(key string) bool {
+	for _, pattern := range s.patterns {
+		if ok, _ := path.Match(pattern, key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Get returns the value for key, opening it when it is sealed
+func (s *EncryptedStore) Get(key string) ([]byte, error) {
+	value, err := s.Store.Get(key)
+	if err != nil || !Sealed(value) {
+		return value, err
+	}
+	plain, err := s.keys.Open(value, []byte(key))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", key, err)
+	}
+	return plain, nil
+}
+
+// Set stores value under key, sealed when key is sensitive
+func (s *EncryptedStore) Set(key string, value []byte, ttl time.Duration) error {
+	if !s.keys.Empty() && s.sensitive(key) {
+		sealed, err := s.keys.Seal(value, []byte(key))
+		if err != nil {
+			return err
+		}
+		value = sealed
+	}
+	return s.Store.Set(key, value, ttl)
+}
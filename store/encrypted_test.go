@@ -0,0 +1,85 @@
+package store
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"testing"
+)
+
+func testKey(b byte) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32))
+}
+
+func TestEncryptedStoreSealsSensitiveValues(t *testing.T) {
+	inner := NewMemoryStore()
+	defer inner.Close()
+	s, err := NewEncryptedStore(inner, []string{testKey(1)}, []string{"*:conversation:*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Set("whatsapp:conversation:123:15551234567", []byte("conv-1"), 0); err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := inner.Get("whatsapp:conversation:123:15551234567")
+	if bytes.Contains(raw, []byte("conv-1")) || !bytes.HasPrefix(raw, []byte(sealedPrefix)) {
+		t.Errorf("stored %q, want it sealed", raw)
+	}
+	if got, err := s.Get("whatsapp:conversation:123:15551234567"); err != nil || string(got) != "conv-1" {
+		t.Errorf("Get = %q, %v; want conv-1", got, err)
+	}
+
+	// The same value is sealed differently each time
+	s.Set("whatsapp:conversation:123:15550000000", []byte("conv-1"), 0)
+	other, _ := inner.Get("whatsapp:conversation:123:15550000000")
+	if bytes.Equal(raw, other) {
+		t.Error("two seals of the same value are equal, want a random nonce")
+	}
+	// and bound to its key, so it can't be moved to another
+	inner.Set("whatsapp:conversation:123:15550000000", raw, 0)
+	if _, err := s.Get("whatsapp:conversation:123:15550000000"); !errors.Is(err, ErrSealed) {
+		t.Errorf("value moved to another key: %v, want ErrSealed", err)
+	}
+
+	s.Set("whatsapp:language:123:15551234567", []byte("de"), 0)
+	if raw, _ := inner.Get("whatsapp:language:123:15551234567"); string(raw) != "de" {
+		t.Errorf("stored %q for a key that isn't sensitive, want it in plain text", raw)
+	}
+	// Values from before encryption was turned on still read
+	inner.Set("sms:conversation:x:15551234567", []byte("legacy"), 0)
+	if got, err := s.Get("sms:conversation:x:15551234567"); err != nil || string(got) != "legacy" {
+		t.Errorf("Get of a plain value = %q, %v", got, err)
+	}
+}
+
+func TestEncryptedStoreKeyRotation(t *testing.T) {
+	inner := NewMemoryStore()
+	defer inner.Close()
+	patterns := []string{"outbox:*"}
+	old, _ := NewEncryptedStore(inner, []string{testKey(1)}, patterns)
+	old.Set("outbox:a", []byte("queued reply"), 0)
+
+	rotated, _ := NewEncryptedStore(inner, []string{testKey(2), testKey(1)}, patterns)
+	if got, err := rotated.Get("outbox:a"); err != nil || string(got) != "queued reply" {
+		t.Errorf("Get after rotation = %q, %v; want the old key to still open it", got, err)
+	}
+	rotated.Set("outbox:b", []byte("new reply"), 0)
+	if _, err := old.Get("outbox:b"); !errors.Is(err, ErrSealed) {
+		t.Errorf("old key opened a value sealed with the new one: %v", err)
+	}
+
+	// A wrong key, or none, fails rather than returning ciphertext
+	wrong, _ := NewEncryptedStore(inner, []string{testKey(3)}, patterns)
+	if got, err := wrong.Get("outbox:a"); !errors.Is(err, ErrSealed) || got != nil {
+		t.Errorf("Get with the wrong key = %q, %v; want ErrSealed", got, err)
+	}
+	none, _ := NewEncryptedStore(inner, nil, patterns)
+	if _, err := none.Get("outbox:a"); !errors.Is(err, ErrSealed) {
+		t.Errorf("Get without keys = %v, want ErrSealed", err)
+	}
+
+	if _, err := NewEncryptedStore(inner, []string{"c2hvcnQ="}, patterns); err == nil {
+		t.Error("accepted a short key")
+	}
+}
@@ -0,0 +1,119 @@
+package store
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// sealedPrefix starts every encrypted value; the ID of the key that sealed
+// it and a colon follow, then the base64 nonce and ciphertext
+const sealedPrefix = "enc1:"
+
+// ErrSealed is returned for an encrypted value none of the configured keys
+// can open, rather than the ciphertext
+var ErrSealed = errors.New("store: value can't be decrypted with the configured keys")
+
+// sealingKey is an encryption key and the ID stored with what it seals
+type sealingKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// Keyring seals values with AES-256-GCM for the encrypted store and the
+// message history. Each value gets a random nonce, is bound to associated
+// data such as its store key, and names the key that sealed it, so keys
+// can be rotated: the first key seals and every key opens.
+type Keyring struct {
+	keys []sealingKey
+}
+
+// NewKeyring decodes keys, base64 AES-256 keys of which the first seals;
+// name says whose keys they are in errors
+func NewKeyring(name string, keys []string) (*Keyring, error) {
+	k := &Keyring{}
+	for i, encoded := range keys {
+		raw, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(raw) != 32 {
+			return nil, fmt.Errorf("%s encryption key %d must be 32 bytes, base64 encoded", name, i+1)
+		}
+		block, err := aes.NewCipher(raw)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(raw)
+		k.keys = append(k.keys, sealingKey{id: hex.EncodeToString(sum[:4]), aead: aead})
+	}
+	return k, nil
+}
+
+// Empty reports whether the keyring has no keys, so it can't seal
+func (k *Keyring) Empty() bool {
+	return len(k.keys) == 0
+}
+
+// Sealed reports whether value was sealed by a Keyring
+func Sealed(value []byte) bool {
+	return bytes.HasPrefix(value, []byte(sealedPrefix))
+}
+
+// Seal encrypts value with the first key, bound to ad
+func (k *Keyring) Seal(value, ad []byte) ([]byte, error) {
+	key := k.keys[0]
+	nonce := make([]byte, key.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := key.aead.Seal(nonce, nonce, value, ad)
+	out := []byte(sealedPrefix + key.id + ":")
+	return base64.StdEncoding.AppendEncode(out, sealed), nil
+}
+
+// Open decrypts a sealed value with the key that sealed it
+func (k *Keyring) Open(value, ad []byte) ([]byte, error) {
+	id, encoded, ok := bytes.Cut(bytes.TrimPrefix(value, []byte(sealedPrefix)), []byte(":"))
+	if !ok || !Sealed(value) {
+		return nil, fmt.Errorf("%w: malformed", ErrSealed)
+	}
+	for _, key := range k.keys {
+		if key.id != string(id) {
+			continue
+		}
+		sealed, err := base64.StdEncoding.DecodeString(string(encoded))
+		if err != nil || len(sealed) < key.aead.NonceSize() {
+			return nil, fmt.Errorf("%w: malformed", ErrSealed)
+		}
+		nonce, ciphertext := sealed[:key.aead.NonceSize()], sealed[key.aead.NonceSize():]
+		plain, err := key.aead.Open(nil, nonce, ciphertext, ad)
+		if err != nil {
+			return nil, fmt.Errorf("%w: altered", ErrSealed)
+		}
+		return plain, nil
+	}
+	return nil, fmt.Errorf("%w: sealed with key %s, which isn't configured", ErrSealed, id)
+}
+
+// OpenUnlabeled decrypts a nonce and ciphertext sealed without a key ID,
+// trying every key; it reads what was sealed before keyrings
+func (k *Keyring) OpenUnlabeled(sealed, ad []byte) ([]byte, error) {
+	for _, key := range k.keys {
+		if len(sealed) < key.aead.NonceSize() {
+			break
+		}
+		nonce, ciphertext := sealed[:key.aead.NonceSize()], sealed[key.aead.NonceSize():]
+		if plain, err := key.aead.Open(nil, nonce, ciphertext, ad); err == nil {
+			return plain, nil
+		}
+	}
+	return nil, ErrSealed
+}
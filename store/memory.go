@@ -0,0 +1,160 @@
+package store
+
+import (
+	"path"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type memoryItem struct {
+	value     []byte
+	expiresAt time.Time
+}
+
+func (i memoryItem) expired(now time.Time) bool {
+	return !i.expiresAt.IsZero() && now.After(i.expiresAt)
+}
+
+// MemoryStore is an in-process Store. State is lost on restart and is not
+// shared between instances.
+type MemoryStore struct {
+	mu    sync.Mutex
+	items map[string]memoryItem
+	done  chan struct{}
+}
+
+// NewMemoryStore creates a new in-memory store
+func NewMemoryStore() *MemoryStore {
+	s := &MemoryStore{
+		items: make(map[string]memoryItem),
+		done:  make(chan struct{}),
+	}
+	go s.sweep()
+	return s
+}
+
+// sweep periodically removes expired items so the map doesn't grow unbounded
+func (s *MemoryStore) sweep() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-ticker.C:
+			s.mu.Lock()
+			for key, item := range s.items {
+				if item.expired(now) {
+					delete(s.items, key)
+				}
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+// Get returns the value for key, or ErrNotFound
+func (s *MemoryStore) Get(key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	item, ok := s.items[key]
+	if !ok || item.expired(time.Now()) {
+		return nil, ErrNotFound
+	}
+	return append([]byte(nil), item.value...), nil
+}
+
+// Set stores value under key; a zero ttl means no expiry
+func (s *MemoryStore) Set(key string, value []byte, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	item := memoryItem{value: append([]byte(nil), value...)}
+	if ttl > 0 {
+		item.expiresAt = time.Now().Add(ttl)
+	}
+	s.items[key] = item
+	return nil
+}
+
+// Delete removes key
+func (s *MemoryStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.items, key)
+	return nil
+}
+
+// Incr atomically increments the counter at key
+func (s *MemoryStore) Incr(key string, ttl time.Duration) (int64, error) {
+	return s.IncrBy(key, 1, ttl)
+}
+
+// IncrBy atomically adds delta to the counter at key
+func (s *MemoryStore) IncrBy(key string, delta int64, ttl time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	item, ok := s.items[key]
+	if !ok || item.expired(now) {
+		item = memoryItem{}
+		if ttl > 0 {
+			item.expiresAt = now.Add(ttl)
+		}
+	}
+
+	var n int64
+	if len(item.value) > 0 {
+		v, err := strconv.ParseInt(string(item.value), 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		n = v
+	}
+	n += delta
+	item.value = []byte(strconv.FormatInt(n, 10))
+	s.items[key] = item
+	return n, nil
+}
+
+// Keys returns the keys matching a glob pattern
+func (s *MemoryStore) Keys(pattern string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var keys []string
+	for key, item := range s.items {
+		if item.expired(now) {
+			continue
+		}
+		ok, err := path.Match(pattern, key)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// Ping always succeeds for the in-memory store
+func (s *MemoryStore) Ping() error {
+	return nil
+}
+
+// Close stops the background sweeper
+func (s *MemoryStore) Close() error {
+	select {
+	case <-s.done:
+	default:
+		close(s.done)
+	}
+	return nil
+}
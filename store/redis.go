@@ -0,0 +1,302 @@
+package store
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	redisDialTimeout = 5 * time.Second
+	redisIOTimeout   = 3 * time.Second
+	redisMaxIdle     = 8
+)
+
+// RedisStore is a Store backed by Redis. It speaks the RESP protocol
+// directly and keeps a small pool of idle connections.
+type RedisStore struct {
+	addr string
+	// host is the server name TLS certificates are checked against,
+	// without the port or the brackets of an IPv6 address
+	host     string
+	password string
+	db       int
+	useTLS   bool
+	idle     chan *redisConn
+}
+
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// redisError is an error reply returned by the server
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// NewRedisStore creates a Redis store from a redis:// or rediss:// URL
+func NewRedisStore(rawURL string) (*RedisStore, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis URL: %w", err)
+	}
+
+	s := &RedisStore{
+		addr:   u.Host,
+		host:   u.Hostname(),
+		useTLS: u.Scheme == "rediss",
+		idle:   make(chan *redisConn, redisMaxIdle),
+	}
+	if u.Port() == "" {
+		s.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		if p, ok := u.User.Password(); ok {
+			s.password = p
+		} else {
+			s.password = u.User.Username()
+		}
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		if s.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid redis database %q", db)
+		}
+	}
+
+	return s, nil
+}
+
+func (s *RedisStore) dial() (*redisConn, error) {
+	dialer := &net.Dialer{Timeout: redisDialTimeout}
+
+	var conn net.Conn
+	var err error
+	if s.useTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", s.addr, &tls.Config{ServerName: s.host})
+	} else {
+		conn, err = dialer.Dial("tcp", s.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rc := &redisConn{conn: conn, r: bufio.NewReader(conn)}
+	if s.password != "" {
+		if _, err := rc.do("AUTH", s.password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if s.db != 0 {
+		if _, err := rc.do("SELECT", strconv.Itoa(s.db)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+// do runs a single command on a pooled connection
+func (s *RedisStore) do(args ...string) (interface{}, error) {
+	var rc *redisConn
+	select {
+	case rc = <-s.idle:
+	default:
+		var err error
+		if rc, err = s.dial(); err != nil {
+			return nil, err
+		}
+	}
+
+	reply, err := rc.do(args...)
+
+	// Server error replies leave the connection usable; anything else
+	// (timeouts, protocol errors) means it must be discarded.
+	var rerr redisError
+	if err != nil && !errors.As(err, &rerr) {
+		rc.conn.Close()
+		return nil, err
+	}
+
+	select {
+	case s.idle <- rc:
+	default:
+		rc.conn.Close()
+	}
+	return reply, err
+}
+
+func (c *redisConn) do(args ...string) (interface{}, error) {
+	if err := c.conn.SetDeadline(time.Now().Add(redisIOTimeout)); err != nil {
+		return nil, err
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(c.conn, b.String()); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+func (c *redisConn) readReply() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	payload := line[1 : len(line)-2]
+
+	switch line[0] {
+	case '+':
+		return payload, nil
+	case '-':
+		return nil, redisError(payload)
+	case ':':
+		return strconv.ParseInt(payload, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = c.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("redis: unexpected reply type %q", line[0])
+	}
+}
+
+// Get returns the value for key, or ErrNotFound
+func (s *RedisStore) Get(key string) ([]byte, error) {
+	reply, err := s.do("GET", key)
+	if err != nil {
+		return nil, err
+	}
+	if reply == nil {
+		return nil, ErrNotFound
+	}
+	return reply.([]byte), nil
+}
+
+// Set stores value under key; a zero ttl means no expiry
+func (s *RedisStore) Set(key string, value []byte, ttl time.Duration) error {
+	args := []string{"SET", key, string(value)}
+	if ttl > 0 {
+		args = append(args, "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	}
+	_, err := s.do(args...)
+	return err
+}
+
+// Delete removes key
+func (s *RedisStore) Delete(key string) error {
+	_, err := s.do("DEL", key)
+	return err
+}
+
+// Incr atomically increments the counter at key
+func (s *RedisStore) Incr(key string, ttl time.Duration) (int64, error) {
+	return s.IncrBy(key, 1, ttl)
+}
+
+// incrByScript adds to a counter and gives it its expiry in one step, so
+// a dropped connection can't leave a counter that never expires. The TTL
+// is set whenever the counter has none, not only on creation, so a
+// counter coming back to its first value doesn't get it again.
+const incrByScript = `local n = redis.call('INCRBY', KEYS[1], ARGV[1])
+if tonumber(ARGV[2]) > 0 and redis.call('PTTL', KEYS[1]) == -1 then
+  redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return n`
+
+// IncrBy atomically adds delta to the counter at key
+func (s *RedisStore) IncrBy(key string, delta int64, ttl time.Duration) (int64, error) {
+	reply, err := s.do("EVAL", incrByScript, "1", key, strconv.FormatInt(delta, 10), strconv.FormatInt(ttl.Milliseconds(), 10))
+	if err != nil {
+		return 0, err
+	}
+	n, ok := reply.(int64)
+	if !ok {
+		return 0, fmt.Errorf("redis: unexpected INCRBY reply %v", reply)
+	}
+	return n, nil
+}
+
+// Keys returns the keys matching a glob pattern, using SCAN so Redis isn't
+// blocked the way KEYS would block it
+func (s *RedisStore) Keys(pattern string) ([]string, error) {
+	var keys []string
+	cursor := "0"
+	for {
+		reply, err := s.do("SCAN", cursor, "MATCH", pattern, "COUNT", "500")
+		if err != nil {
+			return nil, err
+		}
+		parts, ok := reply.([]interface{})
+		if !ok || len(parts) != 2 {
+			return nil, errors.New("redis: malformed SCAN reply")
+		}
+		next, _ := parts[0].([]byte)
+		batch, _ := parts[1].([]interface{})
+		for _, key := range batch {
+			if b, ok := key.([]byte); ok {
+				keys = append(keys, string(b))
+			}
+		}
+		if cursor = string(next); cursor == "0" || cursor == "" {
+			return keys, nil
+		}
+	}
+}
+
+// Ping checks that Redis is reachable
+func (s *RedisStore) Ping() error {
+	_, err := s.do("PING")
+	return err
+}
+
+// Close closes all idle connections
+func (s *RedisStore) Close() error {
+	for {
+		select {
+		case rc := <-s.idle:
+			rc.conn.Close()
+		default:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package store
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis speaks enough RESP to serve RedisStore, running incrByScript
+// the way Redis would and recording every command it is sent
+type fakeRedis struct {
+	mu       sync.Mutex
+	values   map[string]string
+	expiries map[string]time.Duration
+	// expirySets counts the expiries given to each key
+	expirySets map[string]int
+	commands   []string
+}
+
+func startFakeRedis(t *testing.T) (*fakeRedis, *RedisStore) {
+	t.Helper()
+	f := &fakeRedis{values: map[string]string{}, expiries: map[string]time.Duration{}, expirySets: map[string]int{}}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	s, err := NewRedisStore("redis://" + ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return f, s
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		io.WriteString(conn, f.run(args))
+	}
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		header, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(header[1:]))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func (f *fakeRedis) run(args []string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.commands = append(f.commands, strings.ToUpper(args[0]))
+	switch strings.ToUpper(args[0]) {
+	case "SET":
+		f.values[args[1]] = args[2]
+		delete(f.expiries, args[1])
+		return "+OK\r\n"
+	case "GET":
+		v, ok := f.values[args[1]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+	case "EVAL":
+		if args[1] != incrByScript || args[2] != "1" {
+			return "-ERR unknown script\r\n"
+		}
+		key := args[3]
+		delta, _ := strconv.ParseInt(args[4], 10, 64)
+		ttl, _ := strconv.ParseInt(args[5], 10, 64)
+		n, _ := strconv.ParseInt(f.values[key], 10, 64)
+		n += delta
+		f.values[key] = strconv.FormatInt(n, 10)
+		if _, ok := f.expiries[key]; ttl > 0 && !ok {
+			f.expiries[key] = time.Duration(ttl) * time.Millisecond
+			f.expirySets[key]++
+		}
+		return fmt.Sprintf(":%d\r\n", n)
+	}
+	return "-ERR unknown command\r\n"
+}
+
+func TestRedisStoreIncrBySetsExpiryAtomically(t *testing.T) {
+	f, s := startFakeRedis(t)
+
+	if n, err := s.IncrBy("cost:user:1", 5, time.Hour); err != nil || n != 5 {
+		t.Fatalf("IncrBy = %d, %v", n, err)
+	}
+	f.mu.Lock()
+	commands := strings.Join(f.commands, " ")
+	ttl := f.expiries["cost:user:1"]
+	f.mu.Unlock()
+	if commands != "EVAL" {
+		t.Errorf("sent %s, want a single EVAL", commands)
+	}
+	if ttl != time.Hour {
+		t.Errorf("expiry %v, want 1h", ttl)
+	}
+
+	// Coming back to the first value doesn't give the counter a new expiry
+	s.IncrBy("cost:user:1", -5, time.Hour)
+	if n, _ := s.IncrBy("cost:user:1", 5, time.Hour); n != 5 {
+		t.Fatalf("counter at %d, want 5", n)
+	}
+	// nor does a counter created by a zero increment
+	s.IncrBy("cost:user:2", 0, time.Hour)
+	s.IncrBy("cost:user:2", 0, time.Hour)
+	f.mu.Lock()
+	sets1, sets2 := f.expirySets["cost:user:1"], f.expirySets["cost:user:2"]
+	f.mu.Unlock()
+	if sets1 != 1 || sets2 != 1 {
+		t.Errorf("expiries set %d and %d times, want once each", sets1, sets2)
+	}
+
+	// A counter left without an expiry gets one with its next increment
+	s.Set("ratelimit:1", []byte("3"), 0)
+	if n, err := s.Incr("ratelimit:1", time.Minute); err != nil || n != 4 {
+		t.Fatalf("Incr = %d, %v", n, err)
+	}
+	f.mu.Lock()
+	ttl = f.expiries["ratelimit:1"]
+	f.mu.Unlock()
+	if ttl != time.Minute {
+		t.Errorf("expiry %v, want 1m", ttl)
+	}
+}
+
+func TestRedisStoreIncrByReportsErrors(t *testing.T) {
+	_, s := startFakeRedis(t)
+	// The fake refuses scripts other than incrByScript
+	s.Set("other", []byte("1"), 0)
+	if _, err := s.do("EVAL", "return 1", "0"); err == nil {
+		t.Fatal("error reply not returned")
+	}
+	if n, err := s.IncrBy("other", 2, 0); err != nil || n != 3 {
+		t.Fatalf("IncrBy after an error reply = %d, %v; want the connection still usable", n, err)
+	}
+}
+
+func TestInMemory(t *testing.T) {
+	_, redis := startFakeRedis(t)
+	memory := NewMemoryStore()
+	defer memory.Close()
+	encrypted, _ := NewEncryptedStore(memory, nil, nil)
+	if !InMemory(memory) || !InMemory(encrypted) {
+		t.Error("memory store not reported, bare or encrypted")
+	}
+	if InMemory(redis) {
+		t.Error("Redis reported as in memory")
+	}
+}
+
+func TestNewRedisStoreAddress(t *testing.T) {
+	tests := []struct {
+		url, addr, host string
+	}{
+		{"rediss://cache.example.com", "cache.example.com:6379", "cache.example.com"},
+		{"rediss://:secret@cache.example.com:6380/2", "cache.example.com:6380", "cache.example.com"},
+		{"rediss://[2001:db8::1]:6380", "[2001:db8::1]:6380", "2001:db8::1"},
+		{"rediss://[2001:db8::1]", "[2001:db8::1]:6379", "2001:db8::1"},
+		{"redis://127.0.0.1", "127.0.0.1:6379", "127.0.0.1"},
+	}
+	for _, tt := range tests {
+		s, err := NewRedisStore(tt.url)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.url, err)
+		}
+		if s.addr != tt.addr || s.host != tt.host {
+			t.Errorf("%s: address %q and server name %q, want %q and %q", tt.url, s.addr, s.host, tt.addr, tt.host)
+		}
+	}
+}
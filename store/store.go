@@ -0,0 +1,72 @@
+package store
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ErrNotFound is returned when a key does not exist in the store
+var ErrNotFound = errors.New("store: key not found")
+
+// Store is a minimal key-value store shared by features that need state
+// across requests (rate limits, caches, conversation mappings). Backends
+// that live outside the process let that state hold across instances.
+type Store interface {
+	// Get returns the value for key, or ErrNotFound
+	Get(key string) ([]byte, error)
+	// Set stores value under key; a zero ttl means no expiry
+	Set(key string, value []byte, ttl time.Duration) error
+	// Delete removes key; deleting a missing key is not an error
+	Delete(key string) error
+	// Incr atomically increments the counter at key and returns the new
+	// value. The ttl is applied when the counter is created.
+	Incr(key string, ttl time.Duration) (int64, error)
+	// IncrBy is Incr adding n, which may be negative, rather than one
+	IncrBy(key string, n int64, ttl time.Duration) (int64, error)
+	// Keys returns the keys matching a glob pattern, where * matches any
+	// run of characters. It scans every key, so it is for rare admin
+	// operations, not request handling.
+	Keys(pattern string) ([]string, error)
+	// Ping checks that the backend is reachable
+	Ping() error
+	// Close releases any resources held by the store
+	Close() error
+}
+
+// InMemory reports whether s keeps its state in this process only, e.g.
+// because Redis couldn't be reached at startup
+func InMemory(s Store) bool {
+	if encrypted, ok := s.(*EncryptedStore); ok {
+		s = encrypted.Store
+	}
+	_, ok := s.(*MemoryStore)
+	return ok
+}
+
+// New creates a store from a URL. An empty URL selects the in-memory store;
+// redis:// and rediss:// URLs select Redis. If the configured backend can't
+// be reached the in-memory store is used instead so the gateway still starts.
+func New(url string, log *logrus.Logger) Store {
+	if url == "" {
+		return NewMemoryStore()
+	}
+
+	if strings.HasPrefix(url, "redis://") || strings.HasPrefix(url, "rediss://") {
+		rs, err := NewRedisStore(url)
+		if err == nil {
+			err = rs.Ping()
+		}
+		if err != nil {
+			log.WithError(err).Error("Failed to connect to Redis store, falling back to in-memory store")
+			return NewMemoryStore()
+		}
+		log.Info("Using Redis store")
+		return rs
+	}
+
+	log.WithField("url", url).Error("Unsupported store URL, falling back to in-memory store")
+	return NewMemoryStore()
+}
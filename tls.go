@@ -0,0 +1,50 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/tracoco/DifyGate/config"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// configureTLS prepares srv for HTTPS according to cfg. When autocert is
+// used it also returns a plain HTTP server on port 80 that answers ACME
+// HTTP-01 challenges and redirects everything else to HTTPS. With nothing
+// TLS-related configured srv is left untouched and serves plain HTTP.
+func configureTLS(srv *http.Server, cfg config.TLSConfig, bindAddr string) (*http.Server, error) {
+	switch {
+	case len(cfg.AutocertDomains) > 0:
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(cfg.AutocertDomains...),
+			Cache:      autocert.DirCache(cfg.AutocertCacheDir),
+			Email:      cfg.AutocertEmail,
+		}
+		srv.Addr = net.JoinHostPort(bindAddr, "443")
+		srv.TLSConfig = m.TLSConfig()
+
+		return &http.Server{
+			Addr:              net.JoinHostPort(bindAddr, "80"),
+			Handler:           m.HTTPHandler(nil),
+			ReadHeaderTimeout: srv.ReadHeaderTimeout,
+			ReadTimeout:       srv.ReadTimeout,
+			WriteTimeout:      srv.WriteTimeout,
+			IdleTimeout:       srv.IdleTimeout,
+		}, nil
+
+	case cfg.CertFile != "":
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load TLS certificate %s / key %s: %w", cfg.CertFile, cfg.KeyFile, err)
+		}
+		srv.TLSConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}
+	}
+
+	return nil, nil
+}
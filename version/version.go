@@ -0,0 +1,61 @@
+package version
+
+import (
+	"runtime"
+	"runtime/debug"
+)
+
+// Build information, set at link time:
+//
+//	go build -ldflags "-X github.com/tracoco/DifyGate/version.Version=v1.2.3 \
+//	  -X github.com/tracoco/DifyGate/version.GitSHA=$(git rev-parse HEAD) \
+//	  -X github.com/tracoco/DifyGate/version.BuildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// When left unset, whatever the Go toolchain embedded in the binary is used.
+var (
+	Version   = ""
+	GitSHA    = ""
+	BuildDate = ""
+)
+
+// Info describes the running build
+type Info struct {
+	Version   string `json:"version"`
+	GitSHA    string `json:"git_sha"`
+	BuildDate string `json:"build_date"`
+	GoVersion string `json:"go_version"`
+}
+
+// Get returns the build information, falling back to debug.ReadBuildInfo
+// for anything not set through -ldflags
+func Get() Info {
+	info := Info{
+		Version:   Version,
+		GitSHA:    GitSHA,
+		BuildDate: BuildDate,
+		GoVersion: runtime.Version(),
+	}
+
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		if info.Version == "" && bi.Main.Version != "(devel)" {
+			info.Version = bi.Main.Version
+		}
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				if info.GitSHA == "" {
+					info.GitSHA = s.Value
+				}
+			case "vcs.time":
+				if info.BuildDate == "" {
+					info.BuildDate = s.Value
+				}
+			}
+		}
+	}
+
+	if info.Version == "" {
+		info.Version = "dev"
+	}
+	return info
+}